@@ -5,7 +5,12 @@
 // Package apitype contains types for the Tailscale local API and control plane API.
 package apitype
 
-import "tailscale.com/tailcfg"
+import (
+	"net/netip"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
 
 // WhoIsResponse is the JSON type returned by tailscaled debug server's /whois?ip=$IP handler.
 type WhoIsResponse struct {
@@ -14,6 +19,10 @@ type WhoIsResponse struct {
 
 	// Caps are extra capabilities that the remote Node has to this node.
 	Caps []string `json:",omitempty"`
+
+	// CapMap is like Caps, but also includes any values granted
+	// with each capability. See tailcfg.RegisterPeerCap to decode them.
+	CapMap tailcfg.PeerCapMap `json:",omitempty"`
 }
 
 // FileTarget is a node to which files can be sent, and the PeerAPI
@@ -26,7 +35,241 @@ type FileTarget struct {
 	PeerAPIURL string
 }
 
+// WaitingFile is a file received over Taildrop that's waiting in
+// tailscaled's storage to be picked up.
 type WaitingFile struct {
 	Name string
 	Size int64
+
+	// Received is when the file finished arriving.
+	Received time.Time
+
+	// From, FromNodeID and FromLogin identify the peer that sent the
+	// file: its node name, stable node ID and owner's login name.
+	// They're only known for files received since tailscaled last
+	// started.
+	From       string               `json:",omitempty"`
+	FromNodeID tailcfg.StableNodeID `json:",omitempty"`
+	FromLogin  string               `json:",omitempty"`
+}
+
+// ReauthRequest is the JSON request body of the LocalAPI
+// /localapi/v0/reauth handler.
+type ReauthRequest struct {
+	// AuthKey, if non-empty, is an auth key with which to
+	// re-register the node. If empty, an interactive login
+	// is started instead.
+	AuthKey string `json:",omitempty"`
+}
+
+// PeerAPIHandler is a custom handler on a node's peerapi server, as
+// sent to and returned by the LocalAPI /localapi/v0/peerapi-handlers
+// handler. Peers reach it under "/v0/x/<Name>/" on the node's peerapi.
+type PeerAPIHandler struct {
+	// Name is the handler's name: lowercase letters, digits and dashes.
+	Name string
+
+	// Cap, if non-empty, is the capability peers must be granted to
+	// use the handler.
+	Cap string `json:",omitempty"`
+
+	// Target is the http URL on the loopback interface that requests
+	// are proxied to. It's empty for handlers registered in-process,
+	// such as with tsnet.
+	Target string `json:",omitempty"`
+}
+
+// NetMapGeneration is the JSON type streamed by the LocalAPI
+// /localapi/v0/watch-netmap-generation handler, once initially and
+// again each time the netmap changes.
+type NetMapGeneration struct {
+	Generation uint64
+}
+
+// IPAssignment is a period during which a tailnet IP address belonged
+// to a node, as seen in the node's netmaps. The LocalAPI
+// /localapi/v0/whois-history handler returns them as an array, oldest
+// first.
+type IPAssignment struct {
+	Addr netip.Addr
+
+	// Node and NodeID are the name and ID of the node the address
+	// belonged to, and User is the login name of its owner.
+	Node   string
+	NodeID tailcfg.StableNodeID
+	User   string `json:",omitempty"`
+
+	// From is when the address was first seen belonging to the node.
+	// Until is when it was first seen not to, or zero if it still
+	// does.
+	From  time.Time
+	Until time.Time
+}
+
+// HistoryEvent is a change to the tailnet as seen by a node, as
+// returned by the LocalAPI /localapi/v0/history handler, oldest first.
+type HistoryEvent struct {
+	Time time.Time
+
+	// Type is the kind of change: "peer-added", "peer-removed",
+	// "routes-changed", "key-rotated" or "exit-node-changed".
+	Type string
+
+	// Node and NodeID are the name and ID of the peer that changed, or
+	// empty for changes to the node itself.
+	Node   string               `json:",omitempty"`
+	NodeID tailcfg.StableNodeID `json:",omitempty"`
+
+	// Old and New describe the value before and after the change, such
+	// as the routes for "routes-changed".
+	Old string `json:",omitempty"`
+	New string `json:",omitempty"`
+}
+
+// MaintenanceStatus is the JSON response of the LocalAPI
+// /localapi/v0/maintenance handler.
+type MaintenanceStatus struct {
+	// Window is the maintenance window, as in ipn.Prefs, or empty if
+	// none is set.
+	Window string `json:",omitempty"`
+
+	// Allowed is whether disruptive operations run immediately now,
+	// because there's no window, it's in the window, or the window is
+	// overridden.
+	Allowed bool
+
+	// NextWindow is when the window is next open, or now if it is.
+	NextWindow time.Time `json:",omitempty"`
+
+	// OverrideUntil is when the current override of the window ends,
+	// if there is one.
+	OverrideUntil time.Time `json:",omitempty"`
+
+	// Pending are the operations waiting for the window.
+	Pending []PendingMaintenance `json:",omitempty"`
+}
+
+// WakeOnLANResponse is the JSON response of a node's PeerAPI
+// /v0/wol handler, and of the LocalAPI /localapi/v0/wol handler that
+// asks a peer to send a Wake-on-LAN packet.
+type WakeOnLANResponse struct {
+	// SentTo are the names of the network interfaces the peer
+	// broadcast the magic packet on.
+	SentTo []string
+
+	// Errors are the errors from the interfaces it couldn't send it on.
+	Errors []string
+
+	// Via is the name of the peer that sent the packet. It's only
+	// set by the LocalAPI handler.
+	Via string `json:",omitempty"`
+}
+
+// BenchResult is the JSON response of the LocalAPI /localapi/v0/bench
+// handler: the results of a throughput test over the tunnel to a
+// peer's PeerAPI.
+type BenchResult struct {
+	// Peer is the peer's MagicDNS name.
+	Peer string
+
+	// Path is how packets reached the peer before the test, such as
+	// "direct 1.2.3.4:41641" or "DERP nyc", or empty if the peer
+	// didn't answer a disco ping.
+	Path string `json:",omitempty"`
+
+	// Latency is the lowest round-trip time of a few disco pings
+	// to the peer before the test, or zero if it didn't answer.
+	Latency time.Duration
+
+	// Reverse is whether the peer sent the data to this node,
+	// rather than the other way around.
+	Reverse bool `json:",omitempty"`
+
+	// Bytes is how much data the test transferred.
+	Bytes int64
+
+	// Duration is how long the transfer took.
+	Duration time.Duration
+
+	// Packets is how many packets magicsock sent and received during
+	// the test, counting those of other peers too.
+	Packets int64
+
+	// CPU is the CPU time tailscaled used during the test, or zero
+	// if it's unknown on this platform.
+	CPU time.Duration `json:",omitempty"`
+}
+
+// ControllingUser is the JSON response of the LocalAPI
+// /localapi/v0/controlling-user handler: which OS user's prefs and
+// state tailscaled is using.
+//
+// Only on Windows does tailscaled keep state per OS user; elsewhere
+// UserID is always empty.
+type ControllingUser struct {
+	// UserID and Username identify the controlling user, or are empty
+	// if no user is in control. Another user can take control only
+	// once none of the controlling user's clients are connected, and
+	// not while ServerMode is set.
+	UserID   string `json:",omitempty"`
+	Username string `json:",omitempty"`
+
+	// Since is when the controlling user took control.
+	Since time.Time `json:",omitempty"`
+
+	// ServerMode is whether tailscaled keeps running with the
+	// controlling user's state even when they're not connected
+	// (Prefs.ForceDaemon).
+	ServerMode bool
+
+	// IsCaller is whether the controlling user is the caller.
+	IsCaller bool
+
+	// PreviousUserID and PreviousUsername identify the user who was
+	// in control before the current one, who took control at Since.
+	// Their state was reset then; it's loaded again when they take
+	// back control.
+	PreviousUserID   string `json:",omitempty"`
+	PreviousUsername string `json:",omitempty"`
+}
+
+// PendingMaintenance is an operation waiting for the maintenance window.
+type PendingMaintenance struct {
+	Kind  string    // "routes" or "reauth"
+	Since time.Time // when it was first deferred
+}
+
+// NetMapSize is the JSON response of the LocalAPI
+// /localapi/v0/netmap-size handler: an estimate of the memory used by
+// tailscaled's current decoded network map, in bytes, by part.
+type NetMapSize struct {
+	Total        int64
+	NumPeers     int
+	Peers        int64
+	PacketFilter int64 // parsed filter and SSH policy
+	DNS          int64
+	DERPMap      int64
+	UserProfiles int64
+	Other        int64 // self node, hostinfo and the rest
+
+	// TopPeers are the largest peers, largest first, if requested.
+	TopPeers []PeerSize `json:",omitempty"`
+
+	// History is the sampled size of recent network maps, oldest
+	// first.
+	History []NetMapSizeSample `json:",omitempty"`
+}
+
+// PeerSize is the memory used by one peer in a NetMapSize.
+type PeerSize struct {
+	StableID tailcfg.StableNodeID
+	Name     string
+	Bytes    int64
+}
+
+// NetMapSizeSample is a past network map's total size.
+type NetMapSizeSample struct {
+	Time     time.Time
+	Total    int64
+	NumPeers int
 }
@@ -0,0 +1,79 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apitype
+
+import (
+	"net/netip"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// CLIOutputVersion is the version of the JSON that the tailscale CLI
+// writes with --json, as found in each output object's Version field.
+// Fields may be added without changing it; it's incremented when
+// fields are removed or change meaning.
+const CLIOutputVersion = 1
+
+// PingOutput is written by "tailscale ping --json", one per line, for
+// each ping sent, or once if no ping could be sent.
+type PingOutput struct {
+	Version int
+
+	// Result is the ping's result. It's nil if TimedOut or Error is
+	// set. If the target is this node's own Tailscale IP, no ping is
+	// sent and Result has IsLocalIP set.
+	Result *ipnstate.PingResult `json:",omitempty"`
+
+	// TimedOut is whether no reply arrived within the ping timeout.
+	TimedOut bool `json:",omitempty"`
+
+	// Error, if non-empty, is why the ping couldn't be sent, such as
+	// Tailscale not running or the target not being found.
+	Error string `json:",omitempty"`
+}
+
+// IPOutput is written by "tailscale ip --json".
+type IPOutput struct {
+	Version int
+	IPs     []netip.Addr
+}
+
+// NetworkLockStatusOutput is written by "tailscale lock status --json".
+type NetworkLockStatusOutput struct {
+	Version int
+	Status  *ipnstate.NetworkLockStatus
+}
+
+// NetworkLockLogOutput is written by "tailscale lock log --json".
+type NetworkLockLogOutput struct {
+	Version int
+	Updates []ipnstate.NetworkLockUpdate
+
+	// NextCursor is the --cursor to get older updates with, if there
+	// are any.
+	NextCursor string `json:",omitempty"`
+}
+
+// WhoIsOutput is written by "tailscale whois --json".
+type WhoIsOutput struct {
+	Version     int
+	Assignments []IPAssignment
+}
+
+// FileGetOutput is written by "tailscale file get --json", one per
+// line, for each batch of files moved out of the inbox.
+type FileGetOutput struct {
+	Version int
+	Files   []ReceivedFile
+	Errors  []string `json:",omitempty"`
+}
+
+// ReceivedFile is a file that "tailscale file get" moved out of the
+// inbox.
+type ReceivedFile struct {
+	Name string // name it was sent with
+	Path string // where it was written
+	Size int64
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apitype
+
+import (
+	"encoding/json"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// TestCLIOutputJSON checks the JSON of the CLI's --json outputs, which
+// scripts depend on: fields may be added, but changing these requires
+// bumping CLIOutputVersion.
+func TestCLIOutputJSON(t *testing.T) {
+	t0 := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		v    any // pointer to an output value
+		want string
+	}{
+		{
+			name: "ping",
+			v: &PingOutput{
+				Version: CLIOutputVersion,
+				Result: &ipnstate.PingResult{
+					IP:             "100.64.0.2",
+					NodeIP:         "100.64.0.2",
+					NodeName:       "peer",
+					LatencySeconds: 0.025,
+					Endpoint:       "192.0.2.1:41641",
+				},
+			},
+			want: `{"Version":1,"Result":{"IP":"100.64.0.2","NodeIP":"100.64.0.2","NodeName":"peer","Err":"","LatencySeconds":0.025,"Endpoint":"192.0.2.1:41641","DERPRegionID":0,"DERPRegionCode":""}}`,
+		},
+		{
+			name: "ping_timeout",
+			v:    &PingOutput{Version: CLIOutputVersion, TimedOut: true},
+			want: `{"Version":1,"TimedOut":true}`,
+		},
+		{
+			name: "ping_error",
+			v:    &PingOutput{Version: CLIOutputVersion, Error: "Tailscale is stopped."},
+			want: `{"Version":1,"Error":"Tailscale is stopped."}`,
+		},
+		{
+			name: "ip",
+			v: &IPOutput{
+				Version: CLIOutputVersion,
+				IPs:     []netip.Addr{netip.MustParseAddr("100.64.0.1"), netip.MustParseAddr("fd7a:115c:a1e0::1")},
+			},
+			want: `{"Version":1,"IPs":["100.64.0.1","fd7a:115c:a1e0::1"]}`,
+		},
+		{
+			name: "lock_log",
+			v: &NetworkLockLogOutput{
+				Version: CLIOutputVersion,
+				Updates: []ipnstate.NetworkLockUpdate{{
+					Hash: "HASH",
+					Kind: "checkpoint",
+					Time: t0,
+					Raw:  []byte{1, 2},
+				}},
+				NextCursor: "CURSOR",
+			},
+			want: `{"Version":1,"Updates":[{"Hash":"HASH","Kind":"checkpoint","Signers":null,"Time":"2022-09-01T12:00:00Z","Raw":"AQI="}],"NextCursor":"CURSOR"}`,
+		},
+		{
+			name: "whois",
+			v: &WhoIsOutput{
+				Version: CLIOutputVersion,
+				Assignments: []IPAssignment{{
+					Addr:   netip.MustParseAddr("100.64.0.2"),
+					Node:   "peer",
+					NodeID: "nPEER",
+					User:   "alice@example.com",
+					From:   t0,
+				}},
+			},
+			want: `{"Version":1,"Assignments":[{"Addr":"100.64.0.2","Node":"peer","NodeID":"nPEER","User":"alice@example.com","From":"2022-09-01T12:00:00Z","Until":"0001-01-01T00:00:00Z"}]}`,
+		},
+		{
+			name: "file_get",
+			v: &FileGetOutput{
+				Version: CLIOutputVersion,
+				Files:   []ReceivedFile{{Name: "a.txt", Path: "/tmp/a.txt", Size: 3}},
+				Errors:  []string{`"b.txt" already exists`},
+			},
+			want: `{"Version":1,"Files":[{"Name":"a.txt","Path":"/tmp/a.txt","Size":3}],"Errors":["\"b.txt\" already exists"]}`,
+		},
+		{
+			name: "lock_status",
+			v: &NetworkLockStatusOutput{
+				Version: CLIOutputVersion,
+				Status:  &ipnstate.NetworkLockStatus{Enabled: true, Head: &[32]byte{1}},
+			},
+			want: `{"Version":1,"Status":{"Enabled":true,"Head":[1,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0],"PublicKey":"nlpub:0000000000000000000000000000000000000000000000000000000000000000"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j, err := json.Marshal(tt.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(j) != tt.want {
+				t.Errorf("JSON:\n got %s\nwant %s", j, tt.want)
+			}
+
+			// It decodes back to the same value.
+			got := reflect.New(reflect.TypeOf(tt.v).Elem()).Interface()
+			if err := json.Unmarshal(j, got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.v) {
+				t.Errorf("round trip:\n got %+v\nwant %+v", got, tt.v)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tailscale
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// certRenewBefore is how long before expiry a CertManager has its
+	// cert renewed. It matches tailscaled's own renewal window.
+	certRenewBefore = 14 * 24 * time.Hour
+
+	// certRecheckInterval is how often a CertManager checks for a cert
+	// that was renewed by someone else (for instance by "tailscale cert").
+	certRecheckInterval = 24 * time.Hour
+
+	// certRetryDelay is how long a CertManager waits to retry after
+	// failing to get a cert.
+	certRetryDelay = time.Minute
+
+	// ocspRetryDelay is how long a CertManager waits to retry after
+	// failing to get an OCSP response.
+	ocspRetryDelay = time.Hour
+)
+
+// CertManager keeps a TLS certificate for a tailnet domain up to date,
+// so servers don't need to implement their own renewal loops. It gets
+// the cert renewed ahead of expiry and staples OCSP responses to it.
+//
+// API maturity: this is an experimental API and may change.
+type CertManager struct {
+	lc      *LocalClient
+	domain  string
+	updates chan *tls.Certificate
+
+	mu   sync.Mutex
+	cert *tls.Certificate // with Leaf set
+}
+
+// NewCertManager returns a CertManager for domain, which must be one of
+// the node's cert domains (see ipnstate.Status.CertDomains). It returns
+// an error if the initial cert can't be obtained. The cert is kept up
+// to date until ctx is done.
+func (lc *LocalClient) NewCertManager(ctx context.Context, domain string) (*CertManager, error) {
+	m := &CertManager{
+		lc:      lc,
+		domain:  domain,
+		updates: make(chan *tls.Certificate, 1),
+	}
+	cert, err := m.fetch(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	nextOCSP, _ := m.staple(ctx, cert, time.Now())
+	m.cert = cert
+	go m.run(ctx, cert, nextOCSP)
+	return m, nil
+}
+
+// Certificate returns the current certificate.
+func (m *CertManager) Certificate() *tls.Certificate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cert
+}
+
+// GetCertificate returns the current certificate. It's the right
+// signature to use as the value of tls.Config.GetCertificate.
+func (m *CertManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return m.Certificate(), nil
+}
+
+// Updates returns a channel that receives the certificate each time
+// it's renewed or gets a new OCSP staple. Only the most recent update
+// is buffered; a slow reader skips older ones.
+func (m *CertManager) Updates() <-chan *tls.Certificate {
+	return m.updates
+}
+
+func (m *CertManager) publish(cert *tls.Certificate) {
+	m.mu.Lock()
+	m.cert = cert
+	m.mu.Unlock()
+
+	// Replace any update the reader hasn't received yet. There's
+	// only one sender, so the send below can't block.
+	select {
+	case <-m.updates:
+	default:
+	}
+	m.updates <- cert
+}
+
+func (m *CertManager) run(ctx context.Context, cert *tls.Certificate, nextOCSP time.Time) {
+	nextFetch := certNextFetch(cert.Leaf, time.Now())
+	for {
+		next := nextFetch
+		if !nextOCSP.IsZero() && nextOCSP.Before(next) {
+			next = nextOCSP
+		}
+		t := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+
+		now := time.Now()
+		if !now.Before(nextFetch) {
+			var minValidity time.Duration
+			if !now.Before(cert.Leaf.NotAfter.Add(-certRenewBefore)) {
+				minValidity = certRenewBefore
+			}
+			newCert, err := m.fetch(ctx, minValidity)
+			if err != nil {
+				nextFetch = now.Add(certRetryDelay)
+				continue
+			}
+			nextFetch = certNextFetch(newCert.Leaf, now)
+			if !bytes.Equal(newCert.Certificate[0], cert.Certificate[0]) {
+				cert = newCert
+				nextOCSP, _ = m.staple(ctx, cert, now)
+				m.publish(cert)
+			}
+			continue
+		}
+		if !nextOCSP.IsZero() && !now.Before(nextOCSP) {
+			c := *cert
+			var ok bool
+			if nextOCSP, ok = m.staple(ctx, &c, now); ok {
+				cert = &c
+				m.publish(cert)
+			}
+		}
+	}
+}
+
+// certNextFetch returns when to next fetch the cert, given that the
+// current one is leaf.
+func certNextFetch(leaf *x509.Certificate, now time.Time) time.Time {
+	next := leaf.NotAfter.Add(-certRenewBefore)
+	if max := now.Add(certRecheckInterval); next.After(max) {
+		next = max
+	}
+	if min := now.Add(certRetryDelay); next.Before(min) {
+		next = min
+	}
+	return next
+}
+
+// fetch gets the cert from tailscaled, requiring it to be valid for at
+// least minValidity.
+func (m *CertManager) fetch(ctx context.Context, minValidity time.Duration) (*tls.Certificate, error) {
+	certPEM, keyPEM, err := m.lc.CertPairWithValidity(ctx, m.domain, minValidity)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// staple sets cert's OCSP staple from its issuer's OCSP responder. It
+// returns when to refresh the staple (zero if the cert has no OCSP
+// responder) and whether it was updated.
+func (m *CertManager) staple(ctx context.Context, cert *tls.Certificate, now time.Time) (next time.Time, ok bool) {
+	if len(cert.Leaf.OCSPServer) == 0 || len(cert.Certificate) < 2 {
+		return time.Time{}, false
+	}
+	resp, raw, err := fetchOCSP(ctx, cert)
+	if err != nil {
+		return now.Add(ocspRetryDelay), false
+	}
+	cert.OCSPStaple = raw
+	// Refresh halfway through the response's validity period.
+	next = resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2)
+	if min := now.Add(ocspRetryDelay); resp.NextUpdate.IsZero() || next.Before(min) {
+		next = min
+	}
+	return next, true
+}
+
+func fetchOCSP(ctx context.Context, cert *tls.Certificate) (resp *ocsp.Response, raw []byte, err error) {
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	reqBody, err := ocsp.CreateRequest(cert.Leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", cert.Leaf.OCSPServer[0], bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, nil, fmt.Errorf("OCSP responder: %s", res.Status)
+	}
+	raw, err = io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err = ocsp.ParseResponseForCert(raw, cert.Leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.Status != ocsp.Good {
+		return nil, nil, errors.New("OCSP status not good")
+	}
+	return resp, raw, nil
+}
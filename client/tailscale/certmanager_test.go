@@ -0,0 +1,177 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tailscale
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCertPair returns a self-signed cert and key for domain, in the
+// form the LocalAPI returns for ?type=pair: the key PEM, then the
+// cert PEM.
+func testCertPair(t *testing.T, domain string, notAfter time.Time) []byte {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+}
+
+// newTestLocalClient returns a LocalClient whose requests are served
+// by h.
+func newTestLocalClient(t *testing.T, h http.Handler) *LocalClient {
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+	return &LocalClient{
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", ts.Listener.Addr().String())
+		},
+	}
+}
+
+func TestCertManager(t *testing.T) {
+	const domain = "node.example.ts.net"
+	notAfter := time.Now().Add(60 * 24 * time.Hour).Truncate(time.Second)
+	pair := testCertPair(t, domain, notAfter)
+
+	var mu sync.Mutex
+	var paths []string
+	lc := newTestLocalClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.RequestURI())
+		mu.Unlock()
+		if r.URL.Path != "/localapi/v0/cert/"+domain {
+			http.Error(w, "unknown domain", 404)
+			return
+		}
+		w.Write(pair)
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m, err := lc.NewCertManager(ctx, domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := m.Certificate()
+	if cert == nil || cert.Leaf == nil || !cert.Leaf.NotAfter.Equal(notAfter) {
+		t.Fatalf("Certificate = %+v; want leaf expiring %v", cert, notAfter)
+	}
+	if got, _ := m.GetCertificate(nil); got != cert {
+		t.Errorf("GetCertificate = %p; want %p", got, cert)
+	}
+	mu.Lock()
+	if want := "/localapi/v0/cert/" + domain + "?type=pair"; len(paths) != 1 || paths[0] != want {
+		t.Errorf("requests = %q; want [%q]", paths, want)
+	}
+	mu.Unlock()
+
+	// Only the latest update is kept for a slow reader.
+	c1, c2 := *cert, *cert
+	m.publish(&c1)
+	m.publish(&c2)
+	if got := <-m.Updates(); got != &c2 {
+		t.Errorf("update = %p; want the latest, %p", got, &c2)
+	}
+	select {
+	case got := <-m.Updates():
+		t.Errorf("unexpected second update %p", got)
+	default:
+	}
+	if m.Certificate() != &c2 {
+		t.Error("Certificate isn't the latest published cert")
+	}
+
+	if _, err := lc.NewCertManager(ctx, "other.example.ts.net"); err == nil {
+		t.Error("NewCertManager for an unknown domain succeeded")
+	}
+}
+
+func TestCertManagerFetchMinValidity(t *testing.T) {
+	const domain = "node.example.ts.net"
+	pair := testCertPair(t, domain, time.Now().Add(60*24*time.Hour))
+	var got string
+	lc := newTestLocalClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.Query().Get("min_validity")
+		w.Write(pair)
+	}))
+	m := &CertManager{lc: lc, domain: domain}
+	if _, err := m.fetch(context.Background(), certRenewBefore); err != nil {
+		t.Fatal(err)
+	}
+	if want := certRenewBefore.String(); got != want {
+		t.Errorf("min_validity = %q; want %q", got, want)
+	}
+}
+
+func TestCertNextFetch(t *testing.T) {
+	now := time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	tests := []struct {
+		name     string
+		notAfter time.Time
+		want     time.Time
+	}{
+		{"far_from_expiry", now.Add(60 * day), now.Add(certRecheckInterval)},
+		{"renewal_within_a_day", now.Add(certRenewBefore + 6*time.Hour), now.Add(6 * time.Hour)},
+		{"in_renewal_window", now.Add(certRenewBefore - day), now.Add(certRetryDelay)},
+		{"expired", now.Add(-day), now.Add(certRetryDelay)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := certNextFetch(&x509.Certificate{NotAfter: tt.notAfter}, now)
+			if !got.Equal(tt.want) {
+				t.Errorf("certNextFetch = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCertManagerStapleNoOCSP(t *testing.T) {
+	pair := testCertPair(t, "node.example.ts.net", time.Now().Add(time.Hour))
+	lc := newTestLocalClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(pair)
+	}))
+	m := &CertManager{lc: lc, domain: "node.example.ts.net"}
+	cert, err := m.fetch(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A cert without an OCSP responder isn't stapled or rechecked.
+	if next, ok := m.staple(context.Background(), cert, time.Now()); !next.IsZero() || ok {
+		t.Errorf("staple = %v, %v; want zero time, false", next, ok)
+	}
+}
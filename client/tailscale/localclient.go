@@ -30,6 +30,7 @@
 
 	"go4.org/mem"
 	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/health"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/netutil"
@@ -37,6 +38,8 @@
 	"tailscale.com/safesocket"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tka"
+	"tailscale.com/tsweb/tracing"
+	"tailscale.com/types/key"
 )
 
 // defaultLocalClient is the default LocalClient when using the legacy
@@ -115,7 +118,8 @@ func (lc *LocalClient) defaultDialer(ctx context.Context, network, addr string)
 // doesn't actually do any DNS lookup. The actual means of connecting to and
 // authenticating to the local Tailscale daemon vary by platform.
 //
-// DoLocalRequest may mutate the request to add Authorization headers.
+// DoLocalRequest may mutate the request to add Authorization headers, and
+// the tracing.Header with the trace ID of its context (or a new one).
 func (lc *LocalClient) DoLocalRequest(req *http.Request) (*http.Response, error) {
 	lc.tsClientOnce.Do(func() {
 		lc.tsClient = &http.Client{
@@ -127,6 +131,7 @@ func (lc *LocalClient) DoLocalRequest(req *http.Request) (*http.Response, error)
 	if _, token, err := safesocket.LocalTCPPortAndToken(); err == nil {
 		req.SetBasicAuth("", token)
 	}
+	tracing.SetHeader(req)
 	return lc.tsClient.Do(req)
 }
 
@@ -245,6 +250,26 @@ func (lc *LocalClient) WhoIs(ctx context.Context, remoteAddr string) (*apitype.W
 	return r, nil
 }
 
+// WhoIsHistory returns which nodes the tailnet IP address addr has
+// belonged to, oldest first, as far as tailscaled has seen. If at is
+// non-zero, it returns only the assignment in effect at that time, if
+// any.
+func (lc *LocalClient) WhoIsHistory(ctx context.Context, addr netip.Addr, at time.Time) ([]apitype.IPAssignment, error) {
+	v := url.Values{"addr": {addr.String()}}
+	if !at.IsZero() {
+		v.Set("at", at.Format(time.RFC3339Nano))
+	}
+	body, err := lc.get200(ctx, "/localapi/v0/whois-history?"+v.Encode())
+	if err != nil {
+		return nil, err
+	}
+	var res []apitype.IPAssignment
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, fmt.Errorf("invalid JSON from whois-history: %w", err)
+	}
+	return res, nil
+}
+
 // Goroutines returns a dump of the Tailscale daemon's current goroutines.
 func (lc *LocalClient) Goroutines(ctx context.Context) ([]byte, error) {
 	return lc.get200(ctx, "/localapi/v0/goroutines")
@@ -287,6 +312,119 @@ func (lc *LocalClient) DebugAction(ctx context.Context, action string) error {
 	return nil
 }
 
+// ComponentLogLevels returns the log verbosity levels that have been
+// set for individual components, keyed by component name.
+func (lc *LocalClient) ComponentLogLevels(ctx context.Context) (map[string]int, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/component-log-level")
+	if err != nil {
+		return nil, err
+	}
+	var levels map[string]int
+	if err := json.Unmarshal(body, &levels); err != nil {
+		return nil, fmt.Errorf("invalid JSON from component-log-level: %w", err)
+	}
+	return levels, nil
+}
+
+// SetComponentLogLevel sets the log verbosity level of a component,
+// such as "magicsock", in tailscaled's stderr output, without a
+// restart. Level 0 is the normal level and 1 and 2 are increasingly
+// verbose; a negative level resets the component to the default.
+func (lc *LocalClient) SetComponentLogLevel(ctx context.Context, component string, level int) error {
+	v := url.Values{
+		"component": {component},
+		"level":     {strconv.Itoa(level)},
+	}
+	body, err := lc.send(ctx, "POST", "/localapi/v0/component-log-level?"+v.Encode(), 200, nil)
+	if err != nil {
+		return fmt.Errorf("error %w: %s", err, body)
+	}
+	return nil
+}
+
+// History returns the changes to the tailnet that tailscaled has seen,
+// such as peers being added or changing routes, oldest first.
+func (lc *LocalClient) History(ctx context.Context) ([]apitype.HistoryEvent, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/history")
+	if err != nil {
+		return nil, err
+	}
+	var evs []apitype.HistoryEvent
+	if err := json.Unmarshal(body, &evs); err != nil {
+		return nil, fmt.Errorf("invalid JSON from history: %w", err)
+	}
+	return evs, nil
+}
+
+// DebugDiscoState returns the disco (NAT traversal) state of each
+// peer, or of just the peer with node key peer if it's non-zero.
+// This is a development tool and subject to change or removal.
+func (lc *LocalClient) DebugDiscoState(ctx context.Context, peer key.NodePublic) ([]ipnstate.PeerDiscoState, error) {
+	path := "/localapi/v0/debug-disco"
+	if !peer.IsZero() {
+		path += "?peer=" + url.QueryEscape(peer.String())
+	}
+	body, err := lc.get200(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	var states []ipnstate.PeerDiscoState
+	if err := json.Unmarshal(body, &states); err != nil {
+		return nil, fmt.Errorf("invalid JSON from debug-disco: %w", err)
+	}
+	return states, nil
+}
+
+// DebugDERPState returns the health of the connection to each DERP
+// region. This is a development tool and subject to change or removal.
+func (lc *LocalClient) DebugDERPState(ctx context.Context) ([]ipnstate.DERPConnState, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/debug-derp")
+	if err != nil {
+		return nil, err
+	}
+	var states []ipnstate.DERPConnState
+	if err := json.Unmarshal(body, &states); err != nil {
+		return nil, fmt.Errorf("invalid JSON from debug-derp: %w", err)
+	}
+	return states, nil
+}
+
+// DebugSetPathImpairment adds artificial latency, plus up to jitter
+// more, and a loss rate from 0 to 1 to the packets tailscaled sends to
+// the peer with node key peer over path, which is "udp", "derp", or
+// empty for both. All zeros removes it. tailscaled must be run with
+// TS_DEBUG_ALLOW_IMPAIRMENT=1.
+// This is a development tool and subject to change or removal.
+func (lc *LocalClient) DebugSetPathImpairment(ctx context.Context, peer key.NodePublic, path string, latency, jitter time.Duration, loss float64) error {
+	v := url.Values{
+		"peer":    {peer.String()},
+		"path":    {path},
+		"latency": {latency.String()},
+		"jitter":  {jitter.String()},
+		"loss":    {strconv.FormatFloat(loss, 'g', -1, 64)},
+	}
+	body, err := lc.send(ctx, "POST", "/localapi/v0/debug-impair?"+v.Encode(), 200, nil)
+	if err != nil {
+		return fmt.Errorf("error %w: %s", err, body)
+	}
+	return nil
+}
+
+// DebugPathImpairments returns the impairments set by
+// DebugSetPathImpairment.
+// This is a development tool and subject to change or removal.
+func (lc *LocalClient) DebugPathImpairments(ctx context.Context) ([]ipnstate.PathImpairment, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/debug-impair")
+	if err != nil {
+		return nil, err
+	}
+	var imps []ipnstate.PathImpairment
+	if err := json.Unmarshal(body, &imps); err != nil {
+		return nil, fmt.Errorf("invalid JSON from debug-impair: %w", err)
+	}
+	return imps, nil
+}
+
 // Status returns the Tailscale daemon's status.
 func Status(ctx context.Context) (*ipnstate.Status, error) {
 	return defaultLocalClient.Status(ctx)
@@ -372,6 +510,77 @@ func (lc *LocalClient) GetWaitingFile(ctx context.Context, baseName string) (rc
 	return res.Body, res.ContentLength, nil
 }
 
+// WatchIncomingFiles subscribes to files received over Taildrop,
+// calling fn for each file already waiting to be picked up and then for
+// each new one as it finishes arriving, until ctx is done or the
+// connection fails. The file's contents can be read with
+// GetWaitingFile and it's removed with DeleteWaitingFile; a file
+// received again under the same name is reported again. It returns
+// ctx.Err() if ctx was canceled.
+func (lc *LocalClient) WatchIncomingFiles(ctx context.Context, fn func(apitype.WaitingFile)) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://local-tailscaled.sock/localapi/v0/watch-files", nil)
+	if err != nil {
+		return err
+	}
+	res, err := lc.doLocalRequestNiceError(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return bestError(fmt.Errorf("HTTP %s: %s", res.Status, body), body)
+	}
+	dec := json.NewDecoder(res.Body)
+	for {
+		var wf apitype.WaitingFile
+		if err := dec.Decode(&wf); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		fn(wf)
+	}
+}
+
+// PeerAPIHandlers returns the custom handlers on the local node's
+// peerapi server.
+func (lc *LocalClient) PeerAPIHandlers(ctx context.Context) ([]apitype.PeerAPIHandler, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/peerapi-handlers")
+	if err != nil {
+		return nil, err
+	}
+	var phs []apitype.PeerAPIHandler
+	if err := json.Unmarshal(body, &phs); err != nil {
+		return nil, err
+	}
+	return phs, nil
+}
+
+// RegisterPeerAPIHandler mounts a handler on the local node's peerapi
+// server at "/v0/x/<ph.Name>/" that proxies peers' requests to
+// ph.Target, an http URL on the loopback interface. If ph.Cap is
+// non-empty, only peers with that capability may use it. Requests
+// identify the peer in Tailscale-User-Login, Tailscale-User-Name,
+// Tailscale-Node-Name and Tailscale-Node-ID headers.
+//
+// The handler lasts until it's unregistered or tailscaled restarts.
+func (lc *LocalClient) RegisterPeerAPIHandler(ctx context.Context, ph apitype.PeerAPIHandler) error {
+	j, err := json.Marshal(ph)
+	if err != nil {
+		return err
+	}
+	_, err = lc.send(ctx, "POST", "/localapi/v0/peerapi-handlers", http.StatusNoContent, bytes.NewReader(j))
+	return err
+}
+
+// UnregisterPeerAPIHandler removes the custom peerapi handler name.
+func (lc *LocalClient) UnregisterPeerAPIHandler(ctx context.Context, name string) error {
+	_, err := lc.send(ctx, "DELETE", "/localapi/v0/peerapi-handlers?name="+url.QueryEscape(name), http.StatusNoContent, nil)
+	return err
+}
+
 func (lc *LocalClient) FileTargets(ctx context.Context) ([]apitype.FileTarget, error) {
 	body, err := lc.get200(ctx, "/localapi/v0/file-targets")
 	if err != nil {
@@ -408,6 +617,69 @@ func (lc *LocalClient) PushFile(ctx context.Context, target tailcfg.StableNodeID
 	return bestError(fmt.Errorf("%s: %s", res.Status, all), all)
 }
 
+// WatchTrafficStats subscribes to the local Tailscale daemon's traffic
+// stats, calling fn with each new sample (about once per second) until
+// ctx is done or the connection fails. It returns ctx.Err() if ctx was
+// canceled.
+func (lc *LocalClient) WatchTrafficStats(ctx context.Context, fn func(ipn.TrafficStats)) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://local-tailscaled.sock/localapi/v0/traffic-stats", nil)
+	if err != nil {
+		return err
+	}
+	res, err := lc.doLocalRequestNiceError(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return bestError(fmt.Errorf("HTTP %s: %s", res.Status, body), body)
+	}
+	dec := json.NewDecoder(res.Body)
+	for {
+		var ts ipn.TrafficStats
+		if err := dec.Decode(&ts); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		fn(ts)
+	}
+}
+
+// WatchNetMapGeneration subscribes to changes of the local Tailscale
+// daemon's netmap, calling fn with the netmap generation, a counter
+// that increases on every netmap update, once initially and then each
+// time it changes, until ctx is done or the connection fails. It
+// returns ctx.Err() if ctx was canceled.
+func (lc *LocalClient) WatchNetMapGeneration(ctx context.Context, fn func(gen uint64)) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://local-tailscaled.sock/localapi/v0/watch-netmap-generation", nil)
+	if err != nil {
+		return err
+	}
+	res, err := lc.doLocalRequestNiceError(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return bestError(fmt.Errorf("HTTP %s: %s", res.Status, body), body)
+	}
+	dec := json.NewDecoder(res.Body)
+	for {
+		var g apitype.NetMapGeneration
+		if err := dec.Decode(&g); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		fn(g.Generation)
+	}
+}
+
 // CheckIPForwarding asks the local Tailscale daemon whether it looks like the
 // machine is properly configured to forward IP packets as a subnet router
 // or exit node.
@@ -456,14 +728,57 @@ func (lc *LocalClient) GetPrefs(ctx context.Context) (*ipn.Prefs, error) {
 }
 
 func (lc *LocalClient) EditPrefs(ctx context.Context, mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
+	return lc.EditPrefsIfMatch(ctx, mp, "")
+}
+
+// EditPrefsIfMatch is like EditPrefs, but only applies mp if etag
+// matches the current prefs' ETag (see ipn.Prefs.ETag), as read from
+// an earlier GetPrefs. If another writer changed the prefs since, it
+// returns an error for which IsPrefsConflictError reports true. An
+// empty etag applies mp unconditionally.
+func (lc *LocalClient) EditPrefsIfMatch(ctx context.Context, mp *ipn.MaskedPrefs, etag string) (*ipn.Prefs, error) {
+	return lc.editPrefs(ctx, mp, etag, false)
+}
+
+// PreviewEditPrefs returns the prefs that EditPrefs(mp) would result in,
+// or the error it would return, after the same validation tailscaled
+// does, without applying them.
+func (lc *LocalClient) PreviewEditPrefs(ctx context.Context, mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
+	return lc.editPrefs(ctx, mp, "", true)
+}
+
+func (lc *LocalClient) editPrefs(ctx context.Context, mp *ipn.MaskedPrefs, etag string, dryRun bool) (*ipn.Prefs, error) {
 	mpj, err := json.Marshal(mp)
 	if err != nil {
 		return nil, err
 	}
-	body, err := lc.send(ctx, "PATCH", "/localapi/v0/prefs", http.StatusOK, bytes.NewReader(mpj))
+	u := "http://local-tailscaled.sock/localapi/v0/prefs"
+	if dryRun {
+		u += "?dry-run=true"
+	}
+	req, err := http.NewRequestWithContext(ctx, "PATCH", u, bytes.NewReader(mpj))
 	if err != nil {
 		return nil, err
 	}
+	if etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
+	res, err := lc.doLocalRequestNiceError(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusPreconditionFailed:
+		return nil, &PrefsConflictError{errors.New(errorMessageFromBody(body))}
+	default:
+		return nil, bestError(fmt.Errorf("%v: %s", res.Status, bytes.TrimSpace(body)), body)
+	}
 	var p ipn.Prefs
 	if err := json.Unmarshal(body, &p); err != nil {
 		return nil, fmt.Errorf("invalid prefs JSON: %w", err)
@@ -471,11 +786,129 @@ func (lc *LocalClient) EditPrefs(ctx context.Context, mp *ipn.MaskedPrefs) (*ipn
 	return &p, nil
 }
 
+// PrefsConflictError is returned by EditPrefsIfMatch when the prefs
+// were changed by another writer.
+type PrefsConflictError struct {
+	err error
+}
+
+func (e *PrefsConflictError) Error() string { return e.err.Error() }
+func (e *PrefsConflictError) Unwrap() error { return e.err }
+
+// IsPrefsConflictError reports whether err is or wraps a
+// PrefsConflictError.
+func IsPrefsConflictError(err error) bool {
+	var pe *PrefsConflictError
+	return errors.As(err, &pe)
+}
+
 func (lc *LocalClient) Logout(ctx context.Context) error {
 	_, err := lc.send(ctx, "POST", "/localapi/v0/logout", http.StatusNoContent, nil)
 	return err
 }
 
+// Reauth starts re-authenticating the node to renew its node key, as
+// when the backend sends an ipn.Notify.KeyExpiryWarning. If authKey is
+// non-empty, the node re-registers with it non-interactively.
+// Otherwise an interactive login starts, and its URL is sent to
+// frontends as an ipn.Notify.BrowseToURL.
+//
+// Outside tailscaled's maintenance window, re-registering with an auth
+// key is queued for the window and an error saying so is returned.
+func (lc *LocalClient) Reauth(ctx context.Context, authKey string) error {
+	body, err := json.Marshal(apitype.ReauthRequest{AuthKey: authKey})
+	if err != nil {
+		return err
+	}
+	_, err = lc.send(ctx, "POST", "/localapi/v0/reauth", http.StatusNoContent, bytes.NewReader(body))
+	return err
+}
+
+// MaintenanceStatus returns tailscaled's maintenance window and the
+// disruptive operations waiting for it.
+func (lc *LocalClient) MaintenanceStatus(ctx context.Context) (*apitype.MaintenanceStatus, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/maintenance")
+	if err != nil {
+		return nil, err
+	}
+	st := new(apitype.MaintenanceStatus)
+	if err := json.Unmarshal(body, st); err != nil {
+		return nil, fmt.Errorf("invalid maintenance status JSON: %w", err)
+	}
+	return st, nil
+}
+
+// ControllingUser returns the OS user whose prefs and state tailscaled
+// is using. Any local user may call it, including those locked out by
+// the controlling user.
+func (lc *LocalClient) ControllingUser(ctx context.Context) (*apitype.ControllingUser, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/controlling-user")
+	if err != nil {
+		return nil, err
+	}
+	cu := new(apitype.ControllingUser)
+	if err := json.Unmarshal(body, cu); err != nil {
+		return nil, fmt.Errorf("invalid controlling user JSON: %w", err)
+	}
+	return cu, nil
+}
+
+// AllowMaintenance overrides the maintenance window for d, running
+// any deferred disruptive operations now. A d of zero ends an
+// override.
+func (lc *LocalClient) AllowMaintenance(ctx context.Context, d time.Duration) (*apitype.MaintenanceStatus, error) {
+	body, err := lc.send(ctx, "POST", "/localapi/v0/maintenance?allow="+url.QueryEscape(d.String()), 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	st := new(apitype.MaintenanceStatus)
+	if err := json.Unmarshal(body, st); err != nil {
+		return nil, fmt.Errorf("invalid maintenance status JSON: %w", err)
+	}
+	return st, nil
+}
+
+// NetMapSize returns an estimate of the memory tailscaled's current
+// netmap uses, including its top largest peers, and the sizes of
+// recent netmaps.
+func (lc *LocalClient) NetMapSize(ctx context.Context, top int) (*apitype.NetMapSize, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/netmap-size?top="+strconv.Itoa(top))
+	if err != nil {
+		return nil, err
+	}
+	s := new(apitype.NetMapSize)
+	if err := json.Unmarshal(body, s); err != nil {
+		return nil, fmt.Errorf("invalid netmap size JSON: %w", err)
+	}
+	return s, nil
+}
+
+// ExitNodeClients returns the peers using this node as an exit node,
+// or waiting for approval to, oldest first.
+func (lc *LocalClient) ExitNodeClients(ctx context.Context) ([]ipn.ExitNodeClient, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/exit-node-clients")
+	if err != nil {
+		return nil, err
+	}
+	var clients []ipn.ExitNodeClient
+	if err := json.Unmarshal(body, &clients); err != nil {
+		return nil, fmt.Errorf("invalid exit node clients JSON: %w", err)
+	}
+	return clients, nil
+}
+
+// SetExitNodeClientApproval approves or denies the peer at ip using
+// this node as an exit node. It only has an effect when
+// ipn.Prefs.ExitNodeClientApproval is set.
+func (lc *LocalClient) SetExitNodeClientApproval(ctx context.Context, ip netip.Addr, approve bool) error {
+	v := url.Values{
+		"ip":      {ip.String()},
+		"approve": {strconv.FormatBool(approve)},
+	}
+	_, err := lc.send(ctx, "POST", "/localapi/v0/exit-node-clients?"+v.Encode(), http.StatusNoContent, nil)
+	return err
+}
+
 // SetDNS adds a DNS TXT record for the given domain name, containing
 // the provided TXT value. The intended use case is answering
 // LetsEncrypt/ACME dns-01 challenges.
@@ -566,6 +999,20 @@ func (lc *LocalClient) CurrentDERPMap(ctx context.Context) (*tailcfg.DERPMap, er
 	return &derpMap, nil
 }
 
+// HealthWarnings returns tailscaled's current health warnings. Those
+// with no DependsOn are the root causes of the others.
+func (lc *LocalClient) HealthWarnings(ctx context.Context) ([]health.Warning, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/health")
+	if err != nil {
+		return nil, err
+	}
+	var ws []health.Warning
+	if err := json.Unmarshal(body, &ws); err != nil {
+		return nil, fmt.Errorf("invalid health JSON: %w", err)
+	}
+	return ws, nil
+}
+
 // CertPair returns a cert and private key for the provided DNS domain.
 //
 // It returns a cached certificate from disk if it's still valid.
@@ -581,7 +1028,18 @@ func CertPair(ctx context.Context, domain string) (certPEM, keyPEM []byte, err e
 //
 // API maturity: this is considered a stable API.
 func (lc *LocalClient) CertPair(ctx context.Context, domain string) (certPEM, keyPEM []byte, err error) {
-	res, err := lc.send(ctx, "GET", "/localapi/v0/cert/"+domain+"?type=pair", 200, nil)
+	return lc.CertPairWithValidity(ctx, domain, 0)
+}
+
+// CertPairWithValidity is like CertPair, but requires the returned
+// cert to remain valid for at least minValidity (at most 30 days),
+// renewing it first if the cached cert expires sooner.
+func (lc *LocalClient) CertPairWithValidity(ctx context.Context, domain string, minValidity time.Duration) (certPEM, keyPEM []byte, err error) {
+	path := "/localapi/v0/cert/" + domain + "?type=pair"
+	if minValidity > 0 {
+		path += "&min_validity=" + url.QueryEscape(minValidity.String())
+	}
+	res, err := lc.send(ctx, "GET", path, 200, nil)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -681,6 +1139,47 @@ func (lc *LocalClient) Ping(ctx context.Context, ip netip.Addr, pingtype tailcfg
 	return pr, nil
 }
 
+// WakeOnLAN sends a Wake-on-LAN magic packet for the MAC address mac
+// to wake the sleeping peer with Tailscale IP ip, through a peer on its
+// LAN. If via is valid, the peer with that Tailscale IP sends the
+// packet; otherwise tailscaled picks one.
+func (lc *LocalClient) WakeOnLAN(ctx context.Context, ip netip.Addr, mac string, via netip.Addr) (*apitype.WakeOnLANResponse, error) {
+	v := url.Values{}
+	v.Set("ip", ip.String())
+	v.Set("mac", mac)
+	if via.IsValid() {
+		v.Set("via", via.String())
+	}
+	body, err := lc.send(ctx, "POST", "/localapi/v0/wol?"+v.Encode(), 200, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error %w: %s", err, body)
+	}
+	res := new(apitype.WakeOnLANResponse)
+	if err := json.Unmarshal(body, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Bench measures the throughput of the tunnel to the peer with
+// Tailscale IP ip by sending it data for d, or, if reverse, having it
+// send data to this node.
+func (lc *LocalClient) Bench(ctx context.Context, ip netip.Addr, d time.Duration, reverse bool) (*apitype.BenchResult, error) {
+	v := url.Values{}
+	v.Set("ip", ip.String())
+	v.Set("duration", d.String())
+	v.Set("reverse", strconv.FormatBool(reverse))
+	body, err := lc.send(ctx, "POST", "/localapi/v0/bench?"+v.Encode(), 200, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error %w: %s", err, body)
+	}
+	res := new(apitype.BenchResult)
+	if err := json.Unmarshal(body, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
 // NetworkLockStatus fetches information about the tailnet key authority, if one is configured.
 func (lc *LocalClient) NetworkLockStatus(ctx context.Context) (*ipnstate.NetworkLockStatus, error) {
 	body, err := lc.send(ctx, "GET", "/localapi/v0/tka/status", 200, nil)
@@ -717,6 +1216,70 @@ type initRequest struct {
 	return pr, nil
 }
 
+// NetworkLockSign signs the node keys in reqs with the node's
+// network-lock key and submits the signatures to control, returning
+// one result per request. If dryRun is true, the signatures are only
+// generated and verified.
+func (lc *LocalClient) NetworkLockSign(ctx context.Context, reqs []ipnstate.NetworkLockSignRequest, dryRun bool) ([]ipnstate.NetworkLockSignResult, error) {
+	var b bytes.Buffer
+	type signRequest struct {
+		Requests []ipnstate.NetworkLockSignRequest
+		DryRun   bool
+	}
+
+	if err := json.NewEncoder(&b).Encode(signRequest{Requests: reqs, DryRun: dryRun}); err != nil {
+		return nil, err
+	}
+
+	body, err := lc.send(ctx, "POST", "/localapi/v0/tka/sign", 200, &b)
+	if err != nil {
+		return nil, fmt.Errorf("error: %w", err)
+	}
+
+	var res []ipnstate.NetworkLockSignResult
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// NetworkLockLog fetches a page of the tailnet key authority's log,
+// newest update first, of at most limit updates (or a server-chosen
+// number if limit is 0).
+//
+// Pass the previous page's NextCursor as cursor to get the next page,
+// or the empty string for the first. If kinds is non-empty, only
+// updates of those kinds (such as "add-key") are returned; if signer
+// is non-zero, only updates signed by it are.
+func (lc *LocalClient) NetworkLockLog(ctx context.Context, cursor string, limit int, kinds []string, signer key.NLPublic) (*ipnstate.NetworkLockLog, error) {
+	v := url.Values{}
+	if cursor != "" {
+		v.Set("cursor", cursor)
+	}
+	if limit > 0 {
+		v.Set("limit", strconv.Itoa(limit))
+	}
+	if len(kinds) > 0 {
+		v.Set("kind", strings.Join(kinds, ","))
+	}
+	if !signer.IsZero() {
+		s, err := signer.MarshalText()
+		if err != nil {
+			return nil, err
+		}
+		v.Set("signer", string(s))
+	}
+	body, err := lc.send(ctx, "GET", "/localapi/v0/tka/log?"+v.Encode(), 200, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error: %w", err)
+	}
+	log := new(ipnstate.NetworkLockLog)
+	if err := json.Unmarshal(body, log); err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
 // tailscaledConnectHint gives a little thing about why tailscaled (or
 // platform equivalent) is not answering localapi connections.
 //
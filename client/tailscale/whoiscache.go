@@ -0,0 +1,119 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tailscale
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/net/tsaddr"
+)
+
+// maxWhoIsCacheEntries is the most WhoIs results a WhoIsCache holds
+// before it starts over, bounding its memory use.
+const maxWhoIsCacheEntries = 10000
+
+// whoIsCacheRetryDelay is how long a WhoIsCache waits before
+// reconnecting to the daemon's netmap change stream after it fails.
+const whoIsCacheRetryDelay = 2 * time.Second
+
+// WhoIsCache is an in-process cache of LocalClient.WhoIs results, for
+// servers such as identity-aware proxies that would otherwise make a
+// LocalAPI round trip per request.
+//
+// Results are cached only for Tailscale IPs and are dropped whenever
+// the daemon's netmap changes. While the cache can't follow netmap
+// changes (for instance, while tailscaled is restarting), it doesn't
+// cache anything, and every lookup goes to the daemon.
+type WhoIsCache struct {
+	lc *LocalClient
+
+	mu    sync.Mutex
+	valid bool   // whether the netmap change stream is connected
+	epoch uint64 // incremented on each invalidation
+	m     map[string]*apitype.WhoIsResponse
+}
+
+// NewWhoIsCache returns a new WhoIsCache for lc. It follows netmap
+// changes until ctx is done, after which it no longer caches.
+func NewWhoIsCache(ctx context.Context, lc *LocalClient) *WhoIsCache {
+	c := &WhoIsCache{lc: lc}
+	go c.watch(ctx)
+	return c
+}
+
+func (c *WhoIsCache) watch(ctx context.Context) {
+	for {
+		c.lc.WatchNetMapGeneration(ctx, func(uint64) {
+			c.invalidate(true)
+		})
+		c.invalidate(false)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(whoIsCacheRetryDelay):
+		}
+	}
+}
+
+// invalidate drops all cached results and sets whether new results
+// may be cached.
+func (c *WhoIsCache) invalidate(valid bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.valid = valid
+	c.epoch++
+	c.m = nil
+}
+
+// WhoIs is like LocalClient.WhoIs, but may return a cached result.
+// The returned value is shared and must not be modified.
+func (c *WhoIsCache) WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	cacheable := isTailscaleIPAddr(remoteAddr)
+	c.mu.Lock()
+	if r, ok := c.m[remoteAddr]; ok {
+		c.mu.Unlock()
+		return r, nil
+	}
+	epoch := c.epoch
+	c.mu.Unlock()
+
+	r, err := c.lc.WhoIs(ctx, remoteAddr)
+	if err != nil || !cacheable {
+		return r, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Don't cache a result fetched across a netmap change, as it may
+	// be from before the change.
+	if c.valid && c.epoch == epoch {
+		if len(c.m) >= maxWhoIsCacheEntries {
+			c.m = nil
+		}
+		if c.m == nil {
+			c.m = make(map[string]*apitype.WhoIsResponse)
+		}
+		c.m[remoteAddr] = r
+	}
+	return r, nil
+}
+
+// isTailscaleIPAddr reports whether addr, an IP or IP:port, is a
+// Tailscale IP. Other addresses (such as the loopback addresses that
+// userspace-networking proxies connect from) can map to different
+// nodes without a netmap change, so they're not cached.
+func isTailscaleIPAddr(addr string) bool {
+	if ipp, err := netip.ParseAddrPort(addr); err == nil {
+		return tsaddr.IsTailscaleIP(ipp.Addr())
+	}
+	if ip, err := netip.ParseAddr(addr); err == nil {
+		return tsaddr.IsTailscaleIP(ip)
+	}
+	return false
+}
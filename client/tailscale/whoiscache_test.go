@@ -0,0 +1,138 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tailscale
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+func TestWhoIsCache(t *testing.T) {
+	gens := make(chan uint64)
+	var whoisCalls atomic.Int64
+	lc := newTestLocalClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/localapi/v0/watch-netmap-generation":
+			enc := json.NewEncoder(w)
+			for {
+				select {
+				case <-r.Context().Done():
+					return
+				case g := <-gens:
+					enc.Encode(apitype.NetMapGeneration{Generation: g})
+					w.(http.Flusher).Flush()
+				}
+			}
+		case "/localapi/v0/whois":
+			whoisCalls.Add(1)
+			if r.FormValue("addr") == "100.64.0.9:1234" {
+				http.Error(w, "no match for IP:port", 404)
+				return
+			}
+			json.NewEncoder(w).Encode(new(apitype.WhoIsResponse))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewWhoIsCache(ctx, lc)
+
+	epoch := func() uint64 {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.epoch
+	}
+	// sendGen sends a netmap generation and waits for the cache to
+	// be invalidated by it.
+	sendGen := func(g uint64) {
+		t.Helper()
+		e := epoch()
+		gens <- g
+		for deadline := time.Now().Add(5 * time.Second); epoch() == e; {
+			if time.Now().After(deadline) {
+				t.Fatalf("cache not invalidated by generation %d", g)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// lookup looks up addr and returns how many LocalAPI WhoIs calls
+	// that took.
+	lookup := func(addr string, wantErr bool) int64 {
+		t.Helper()
+		before := whoisCalls.Load()
+		_, err := c.WhoIs(ctx, addr)
+		if (err != nil) != wantErr {
+			t.Fatalf("WhoIs(%q) err = %v; want error: %v", addr, err, wantErr)
+		}
+		return whoisCalls.Load() - before
+	}
+
+	const addr = "100.64.0.1:1234"
+
+	// Nothing is cached until the change stream is connected, as
+	// the cache can't tell when results go stale.
+	if n := lookup(addr, false) + lookup(addr, false); n != 2 {
+		t.Errorf("before watch: %d WhoIs calls; want 2", n)
+	}
+
+	sendGen(1)
+	if n := lookup(addr, false); n != 1 {
+		t.Errorf("miss: %d WhoIs calls; want 1", n)
+	}
+	if n := lookup(addr, false); n != 0 {
+		t.Errorf("hit: %d WhoIs calls; want 0", n)
+	}
+	if n := lookup("100.64.0.1:5678", false); n != 1 {
+		t.Errorf("other port: %d WhoIs calls; want 1", n)
+	}
+
+	// Non-Tailscale addresses and errors aren't cached.
+	for _, addr := range []string{"127.0.0.1:1234", "[::1]:1234"} {
+		if n := lookup(addr, false) + lookup(addr, false); n != 2 {
+			t.Errorf("%s: %d WhoIs calls; want 2", addr, n)
+		}
+	}
+	if n := lookup("100.64.0.9:1234", true) + lookup("100.64.0.9:1234", true); n != 2 {
+		t.Errorf("error: %d WhoIs calls; want 2", n)
+	}
+
+	// A netmap change drops cached results.
+	sendGen(2)
+	if n := lookup(addr, false); n != 1 {
+		t.Errorf("after netmap change: %d WhoIs calls; want 1", n)
+	}
+	if n := lookup(addr, false); n != 0 {
+		t.Errorf("hit after netmap change: %d WhoIs calls; want 0", n)
+	}
+}
+
+func TestIsTailscaleIPAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"100.64.0.1", true},
+		{"100.64.0.1:80", true},
+		{"[fd7a:115c:a1e0::1]:80", true},
+		{"fd7a:115c:a1e0::1", true},
+		{"127.0.0.1:80", false},
+		{"192.168.0.1", false},
+		{"", false},
+		{"not-an-ip:80", false},
+	}
+	for _, tt := range tests {
+		if got := isTailscaleIPAddr(tt.addr); got != tt.want {
+			t.Errorf("isTailscaleIPAddr(%q) = %v; want %v", tt.addr, got, tt.want)
+		}
+	}
+}
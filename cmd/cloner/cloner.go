@@ -10,7 +10,9 @@
 // This tool makes lots of implicit assumptions about the types you feed it.
 // In particular, it can only write relatively "shallow" Clone methods.
 // That is, if a type contains another named struct type, cloner assumes that
-// named type will also have a Clone method.
+// named type will also have a Clone method. Such types in the same package
+// get one generated for them too, unless they already have a hand-written
+// one.
 package main
 
 import (
@@ -20,37 +22,62 @@
 	"go/types"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"tailscale.com/util/codegen"
 )
 
-var (
-	flagTypes     = flag.String("type", "", "comma-separated list of types; required")
-	flagBuildTags = flag.String("tags", "", "compiler build tags to apply")
-	flagCloneFunc = flag.Bool("clonefunc", false, "add a top-level Clone func")
-)
+// options are the command-line options of cloner.
+type options struct {
+	types     string // comma-separated
+	buildTags string
+	cloneFunc bool
+}
+
+func (o *options) addFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.types, "type", "", "comma-separated list of types; required")
+	fs.StringVar(&o.buildTags, "tags", "", "compiler build tags to apply")
+	fs.BoolVar(&o.cloneFunc, "clonefunc", false, "add a top-level Clone func")
+}
 
 func main() {
 	log.SetFlags(0)
 	log.SetPrefix("cloner: ")
+	var opts options
+	opts.addFlags(flag.CommandLine)
 	flag.Parse()
-	if len(*flagTypes) == 0 {
+	if len(opts.types) == 0 {
 		flag.Usage()
 		os.Exit(2)
 	}
-	typeNames := strings.Split(*flagTypes, ",")
+	if err := generate(".", opts, ""); err != nil {
+		log.Fatal(err)
+	}
+}
 
-	pkg, namedTypes, err := codegen.LoadTypes(*flagBuildTags, ".")
+// generate writes the Clone methods of opts.types in the package pkgName
+// to its _clone.go file in outDir, or in the current directory if outDir
+// is empty.
+//
+// Clone methods are also generated for the struct types that opts.types
+// reference, as their Clone methods are called by the generated code.
+func generate(pkgName string, opts options, outDir string) error {
+	typeNames := strings.Split(opts.types, ",")
+
+	pkg, namedTypes, err := codegen.LoadTypes(opts.buildTags, pkgName)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	cloneOutput := pkg.Name + "_clone.go"
+	typeNames = append(typeNames, codegen.ReferencedTypes(pkg, namedTypes, typeNames, cloneOutput)...)
+
 	it := codegen.NewImportTracker(pkg.Types)
 	buf := new(bytes.Buffer)
 	for _, typeName := range typeNames {
 		typ, ok := namedTypes[typeName]
 		if !ok {
-			log.Fatalf("could not find type %s", typeName)
+			return fmt.Errorf("could not find type %s", typeName)
 		}
 		gen(buf, it, typ)
 	}
@@ -58,10 +85,10 @@ func main() {
 	w := func(format string, args ...any) {
 		fmt.Fprintf(buf, format+"\n", args...)
 	}
-	if *flagCloneFunc {
+	if opts.cloneFunc {
 		w("// Clone duplicates src into dst and reports whether it succeeded.")
 		w("// To succeed, <src, dst> must be of types <*T, *T> or <*T, **T>,")
-		w("// where T is one of %s.", *flagTypes)
+		w("// where T is one of %s.", strings.Join(typeNames, ","))
 		w("func Clone(dst, src any) bool {")
 		w("	switch src := src.(type) {")
 		for _, typeName := range typeNames {
@@ -79,10 +106,7 @@ func main() {
 		w("	return false")
 		w("}")
 	}
-	cloneOutput := pkg.Name + "_clone.go"
-	if err := codegen.WritePackageFile("tailscale.com/cmd/cloner", pkg, cloneOutput, it, buf); err != nil {
-		log.Fatal(err)
-	}
+	return codegen.WritePackageFile("tailscale.com/cmd/cloner", pkg, filepath.Join(outDir, cloneOutput), it, buf)
 }
 
 func gen(buf *bytes.Buffer, it *codegen.ImportTracker, typ *types.Named) {
@@ -0,0 +1,68 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tailscale.com/util/codegen"
+)
+
+// TestGenerated checks that the output of each cloner go:generate
+// directive in the repo is up to date.
+func TestGenerated(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode; loads packages")
+	}
+	cmds, err := codegen.FindGenerateCommands("../..", "tailscale.com/cmd/cloner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cmds) == 0 {
+		t.Fatal("found no go:generate directives")
+	}
+	for _, c := range cmds {
+		c := c
+		t.Run(strings.TrimPrefix(filepath.ToSlash(c.Dir), "../../"), func(t *testing.T) {
+			var opts options
+			fs := flag.NewFlagSet("cloner", flag.ContinueOnError)
+			opts.addFlags(fs)
+			if err := fs.Parse(c.Args); err != nil {
+				t.Fatal(err)
+			}
+			out := t.TempDir()
+			if err := generate(c.Dir, opts, out); err != nil {
+				t.Fatal(err)
+			}
+			files, err := filepath.Glob(filepath.Join(out, "*_clone.go"))
+			if err != nil || len(files) != 1 {
+				t.Fatalf("generated files = %v, %v; want one", files, err)
+			}
+			name := filepath.Base(files[0])
+			got, err := os.ReadFile(files[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := os.ReadFile(filepath.Join(c.Dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The copyright line has the year the file was generated.
+			if !bytes.Equal(afterFirstLine(got), afterFirstLine(want)) {
+				t.Errorf("%s is out of date; run go generate in %s", name, c.Dir)
+			}
+		})
+	}
+}
+
+func afterFirstLine(b []byte) []byte {
+	_, rest, _ := bytes.Cut(b, []byte("\n"))
+	return rest
+}
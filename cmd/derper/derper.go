@@ -21,9 +21,12 @@
 	"net/http"
 	"net/netip"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
 	"golang.org/x/time/rate"
@@ -31,7 +34,7 @@
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
 	"tailscale.com/metrics"
-	"tailscale.com/net/stun"
+	"tailscale.com/net/stunserver"
 	"tailscale.com/tsweb"
 	"tailscale.com/types/key"
 )
@@ -51,31 +54,25 @@
 	meshWith      = flag.String("mesh-with", "", "optional comma-separated list of hostnames to mesh with; the server's own hostname can be in the list")
 	bootstrapDNS  = flag.String("bootstrap-dns-names", "", "optional comma-separated list of hostnames to make available at /bootstrap-dns")
 	verifyClients = flag.Bool("verify-clients", false, "verify clients to this DERP server through a local tailscaled instance.")
+	meshSrcCheck  = flag.String("mesh-source-check", "log", "how to check that packets forwarded by mesh peers are from clients connected to them: off, log (count and log failures), or enforce (drop failures)")
+
+	reusePort     = flag.Bool("reuse-port", false, "listen with SO_REUSEPORT, so a new derper process can start on the same ports while this one drains; see --drain-duration")
+	drainDuration = flag.Duration("drain-duration", 0, "if positive, on SIGTERM or SIGINT stop accepting connections and close existing ones gradually over this duration before exiting, rather than all at once")
 
 	acceptConnLimit = flag.Float64("accept-connection-limit", math.Inf(+1), "rate limit for accepting new connection")
 	acceptConnBurst = flag.Int("accept-connection-burst", math.MaxInt, "burst limit for accepting new connection")
+
+	stunRateLimit = flag.Float64("stun-rate-limit", 0, "if positive, rate limit for STUN requests from each source IP, in requests per second")
+	stunRateBurst = flag.Int("stun-rate-burst", 10, "burst limit for STUN requests from each source IP, with --stun-rate-limit")
+	stunAltServer = flag.String("stun-alternate-server", "", "optional ip:port of a STUN server to redirect clients over --stun-rate-limit to, instead of dropping their requests")
 )
 
 var (
-	stats             = new(metrics.Set)
-	stunDisposition   = &metrics.LabelMap{Label: "disposition"}
-	stunAddrFamily    = &metrics.LabelMap{Label: "family"}
 	tlsRequestVersion = &metrics.LabelMap{Label: "version"}
 	tlsActiveVersion  = &metrics.LabelMap{Label: "version"}
-
-	stunReadError  = stunDisposition.Get("read_error")
-	stunNotSTUN    = stunDisposition.Get("not_stun")
-	stunWriteError = stunDisposition.Get("write_error")
-	stunSuccess    = stunDisposition.Get("success")
-
-	stunIPv4 = stunAddrFamily.Get("ipv4")
-	stunIPv6 = stunAddrFamily.Get("ipv6")
 )
 
 func init() {
-	stats.Set("counter_requests", stunDisposition)
-	stats.Set("counter_addrfamily", stunAddrFamily)
-	expvar.Publish("stun", stats)
 	expvar.Publish("derper_tls_request_version", tlsRequestVersion)
 	expvar.Publish("gauge_derper_tls_active_version", tlsActiveVersion)
 }
@@ -143,6 +140,9 @@ func main() {
 	if err != nil {
 		log.Fatalf("invalid server address: %v", err)
 	}
+	if *reusePort && !reusePortSupported {
+		log.Fatalf("--reuse-port is not supported on %s", runtime.GOOS)
+	}
 
 	cfg := loadConfig()
 
@@ -150,6 +150,16 @@ func main() {
 
 	s := derp.NewServer(cfg.PrivateKey, log.Printf)
 	s.SetVerifyClient(*verifyClients)
+	switch *meshSrcCheck {
+	case "off":
+		s.SetMeshSourceCheck(derp.MeshSourceCheckOff)
+	case "log":
+		s.SetMeshSourceCheck(derp.MeshSourceCheckLog)
+	case "enforce":
+		s.SetMeshSourceCheck(derp.MeshSourceCheckEnforce)
+	default:
+		log.Fatalf("invalid --mesh-source-check %q; want off, log or enforce", *meshSrcCheck)
+	}
 
 	if *meshPSKFile != "" {
 		b, err := ioutil.ReadFile(*meshPSKFile)
@@ -205,7 +215,27 @@ func main() {
 	debug.Handle("traffic", "Traffic check", http.HandlerFunc(s.ServeDebugTraffic))
 
 	if *runSTUN {
-		go serveSTUN(listenHost, *stunPort)
+		ss := stunserver.New(log.Printf)
+		if *stunRateLimit > 0 {
+			ss.RateLimit = *stunRateLimit
+			ss.RateBurst = *stunRateBurst
+		}
+		if *stunAltServer != "" {
+			ss.AlternateServer, err = netip.ParseAddrPort(*stunAltServer)
+			if err != nil {
+				log.Fatalf("invalid --stun-alternate-server: %v", err)
+			}
+		}
+		expvar.Publish("stun", ss.ExpVar())
+		pc, err := listenConfig().ListenPacket(context.Background(), "udp", net.JoinHostPort(listenHost, fmt.Sprint(*stunPort)))
+		if err != nil {
+			log.Fatalf("failed to open STUN listener: %v", err)
+		}
+		log.Printf("running STUN server on %v", pc.LocalAddr())
+		go func() {
+			err := ss.Serve(context.Background(), pc)
+			log.Fatalf("STUN server: %v", err)
+		}()
 	}
 
 	httpsrv := &http.Server{
@@ -223,6 +253,25 @@ func main() {
 		WriteTimeout: 30 * time.Second,
 	}
 
+	drained := make(chan struct{})
+	if *drainDuration > 0 {
+		go func() {
+			sigc := make(chan os.Signal, 1)
+			signal.Notify(sigc, syscall.SIGTERM, os.Interrupt)
+			<-sigc
+			log.Printf("derper: draining connections over %v", *drainDuration)
+			// Stop accepting, so new connections go to a new
+			// process on the same port or to other region nodes.
+			// DERP connections are hijacked, so Shutdown leaves
+			// them for Drain.
+			httpsrv.Shutdown(context.Background())
+			ctx, cancel := context.WithTimeout(context.Background(), *drainDuration+10*time.Second)
+			defer cancel()
+			s.Drain(ctx, *drainDuration)
+			close(drained)
+		}()
+	}
+
 	if serveTLS {
 		log.Printf("derper: serving on %s with TLS", *addr)
 		var certManager certProvider
@@ -286,7 +335,7 @@ func main() {
 					// duration exceeds server's WriteTimeout".
 					WriteTimeout: 5 * time.Minute,
 				}
-				err := port80srv.ListenAndServe()
+				err := listenAndServe(port80srv)
 				if err != nil {
 					if err != http.ErrServerClosed {
 						log.Fatal(err)
@@ -297,13 +346,40 @@ func main() {
 		err = rateLimitedListenAndServeTLS(httpsrv)
 	} else {
 		log.Printf("derper: serving on %s", *addr)
-		err = httpsrv.ListenAndServe()
+		err = listenAndServe(httpsrv)
+	}
+	if err == http.ErrServerClosed && *drainDuration > 0 {
+		<-drained
+		return
 	}
 	if err != nil && err != http.ErrServerClosed {
 		log.Fatalf("derper: %v", err)
 	}
 }
 
+// listenConfig returns the config for derper's listeners.
+func listenConfig() *net.ListenConfig {
+	lc := new(net.ListenConfig)
+	if *reusePort {
+		lc.Control = setReusePort
+	}
+	return lc
+}
+
+// listenAndServe is like srv.ListenAndServe, but listens with
+// listenConfig.
+func listenAndServe(srv *http.Server) error {
+	addr := srv.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+	ln, err := listenConfig().Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(ln)
+}
+
 // probeHandler is the endpoint that js/wasm clients hit to measure
 // DERP latency, since they can't do UDP STUN queries.
 func probeHandler(w http.ResponseWriter, r *http.Request) {
@@ -315,59 +391,6 @@ func probeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func serveSTUN(host string, port int) {
-	pc, err := net.ListenPacket("udp", net.JoinHostPort(host, fmt.Sprint(port)))
-	if err != nil {
-		log.Fatalf("failed to open STUN listener: %v", err)
-	}
-	log.Printf("running STUN server on %v", pc.LocalAddr())
-	serverSTUNListener(context.Background(), pc.(*net.UDPConn))
-}
-
-func serverSTUNListener(ctx context.Context, pc *net.UDPConn) {
-	var buf [64 << 10]byte
-	var (
-		n   int
-		ua  *net.UDPAddr
-		err error
-	)
-	for {
-		n, ua, err = pc.ReadFromUDP(buf[:])
-		if err != nil {
-			if ctx.Err() != nil {
-				return
-			}
-			log.Printf("STUN ReadFrom: %v", err)
-			time.Sleep(time.Second)
-			stunReadError.Add(1)
-			continue
-		}
-		pkt := buf[:n]
-		if !stun.Is(pkt) {
-			stunNotSTUN.Add(1)
-			continue
-		}
-		txid, err := stun.ParseBindingRequest(pkt)
-		if err != nil {
-			stunNotSTUN.Add(1)
-			continue
-		}
-		if ua.IP.To4() != nil {
-			stunIPv4.Add(1)
-		} else {
-			stunIPv6.Add(1)
-		}
-		addr, _ := netip.AddrFromSlice(ua.IP)
-		res := stun.Response(txid, netip.AddrPortFrom(addr, uint16(ua.Port)))
-		_, err = pc.WriteTo(res, ua)
-		if err != nil {
-			stunWriteError.Add(1)
-		} else {
-			stunSuccess.Add(1)
-		}
-	}
-}
-
 var validProdHostname = regexp.MustCompile(`^derp([^.]*)\.tailscale\.com\.?$`)
 
 func prodAutocertHostPolicy(_ context.Context, host string) error {
@@ -395,7 +418,7 @@ func rateLimitedListenAndServeTLS(srv *http.Server) error {
 	if addr == "" {
 		addr = ":https"
 	}
-	ln, err := net.Listen("tcp", addr)
+	ln, err := listenConfig().Listen(context.Background(), "tcp", addr)
 	if err != nil {
 		return err
 	}
@@ -10,6 +10,7 @@
 	"testing"
 
 	"tailscale.com/net/stun"
+	"tailscale.com/net/stunserver"
 )
 
 func TestProdAutocertHostPolicy(t *testing.T) {
@@ -45,7 +46,7 @@ func BenchmarkServerSTUN(b *testing.B) {
 	defer pc.Close()
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	go serverSTUNListener(ctx, pc.(*net.UDPConn))
+	go stunserver.New(b.Logf).Serve(ctx, pc)
 	addr := pc.LocalAddr().(*net.UDPAddr)
 
 	var resBuf [1500]byte
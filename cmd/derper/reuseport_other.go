@@ -0,0 +1,19 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+const reusePortSupported = false
+
+func setReusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT not supported on this platform")
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+var benchArgs struct {
+	duration time.Duration
+	reverse  bool
+	json     bool
+}
+
+func runBench(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: bench [flags] <hostname-or-IP>")
+	}
+	ipStr, self, err := tailscaleIPFromArg(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if self {
+		return errors.New("can't benchmark the tunnel to self")
+	}
+	ip, err := netip.ParseAddr(ipStr)
+	if err != nil {
+		return err
+	}
+	if !benchArgs.json {
+		printf("benchmarking %s for %v...\n", args[0], benchArgs.duration)
+	}
+	res, err := localClient.Bench(ctx, ip, benchArgs.duration, benchArgs.reverse)
+	if err != nil {
+		return err
+	}
+	if benchArgs.json {
+		return printJSON(res)
+	}
+	outln(formatBench(res))
+	return nil
+}
+
+// formatBench formats res for "tailscale debug bench".
+func formatBench(res *apitype.BenchResult) string {
+	var sb strings.Builder
+	path := res.Path
+	if path == "" {
+		path = "unknown (no disco pong)"
+	}
+	fmt.Fprintf(&sb, "peer:       %s\n", res.Peer)
+	fmt.Fprintf(&sb, "path:       %s\n", path)
+	if res.Latency > 0 {
+		fmt.Fprintf(&sb, "latency:    %v\n", res.Latency.Round(10*time.Microsecond))
+	}
+	dir := "sent"
+	if res.Reverse {
+		dir = "received"
+	}
+	secs := res.Duration.Seconds()
+	if secs <= 0 {
+		secs = 1
+	}
+	fmt.Fprintf(&sb, "%-11s %.1f MB in %v\n", dir+":", float64(res.Bytes)/1e6, res.Duration.Round(time.Millisecond))
+	fmt.Fprintf(&sb, "throughput: %.1f Mbit/s\n", float64(res.Bytes)*8/1e6/secs)
+	fmt.Fprintf(&sb, "packets:    %.0f/s\n", float64(res.Packets)/secs)
+	if res.CPU > 0 {
+		fmt.Fprintf(&sb, "cpu:        %.0f%% of a core (tailscaled)\n", res.CPU.Seconds()/secs*100)
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
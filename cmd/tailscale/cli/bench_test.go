@@ -0,0 +1,50 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+func TestFormatBench(t *testing.T) {
+	got := formatBench(&apitype.BenchResult{
+		Peer:     "nas.example.ts.net",
+		Path:     "direct 192.168.1.2:41641",
+		Latency:  1234567 * time.Nanosecond,
+		Bytes:    125e6,
+		Duration: 2 * time.Second,
+		Packets:  100000,
+		CPU:      time.Second,
+	})
+	want := `peer:       nas.example.ts.net
+path:       direct 192.168.1.2:41641
+latency:    1.23ms
+sent:       125.0 MB in 2s
+throughput: 500.0 Mbit/s
+packets:    50000/s
+cpu:        50% of a core (tailscaled)`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	got = formatBench(&apitype.BenchResult{
+		Peer:     "nas.example.ts.net",
+		Reverse:  true,
+		Bytes:    1e6,
+		Duration: time.Second,
+		Packets:  800,
+	})
+	want = `peer:       nas.example.ts.net
+path:       unknown (no disco pong)
+received:   1.0 MB in 1s
+throughput: 8.0 Mbit/s
+packets:    800/s`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
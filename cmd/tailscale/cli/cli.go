@@ -8,6 +8,7 @@
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -29,6 +30,7 @@
 	"tailscale.com/ipn"
 	"tailscale.com/paths"
 	"tailscale.com/safesocket"
+	"tailscale.com/tsweb/tracing"
 	"tailscale.com/version/distro"
 )
 
@@ -48,6 +50,23 @@ func outln(a ...any) {
 	fmt.Fprintln(Stdout, a...)
 }
 
+// printJSON writes v to Stdout as indented JSON, for commands'
+// --json output.
+func printJSON(v any) error {
+	j, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	outln(string(j))
+	return nil
+}
+
+// printJSONLine writes v to Stdout as JSON on a single line, for
+// commands whose --json output is a stream of objects.
+func printJSONLine(v any) error {
+	return json.NewEncoder(Stdout).Encode(v)
+}
+
 // ActLikeCLI reports whether a GUI application should act like the
 // CLI based on os.Args, GOOS, the context the process is running in
 // (pty, parent PID), etc.
@@ -160,17 +179,22 @@ func Run(args []string) (err error) {
 			logoutCmd,
 			netcheckCmd,
 			ipCmd,
+			whoisCmd,
+			viaCmd,
 			statusCmd,
 			pingCmd,
 			ncCmd,
 			sshCmd,
+			wolCmd,
 			versionCmd,
 			webCmd,
 			fileCmd,
 			bugReportCmd,
 			certCmd,
 			netlockCmd,
+			exitNodeCmd,
 			licensesCmd,
+			completionCmd,
 		},
 		FlagSet:   rootfs,
 		Exec:      func(context.Context, []string) error { return flag.ErrHelp },
@@ -191,6 +215,10 @@ func Run(args []string) (err error) {
 		rootCmd.Subcommands = append(rootCmd.Subcommands, configureHostCmd)
 	}
 
+	if len(args) > 0 && args[0] == completeCmdName {
+		return runComplete(rootCmd, args[1:])
+	}
+
 	if err := rootCmd.Parse(args); err != nil {
 		if errors.Is(err, flag.ErrHelp) {
 			return nil
@@ -205,7 +233,14 @@ func Run(args []string) (err error) {
 		}
 	})
 
-	err = rootCmd.Run(context.Background())
+	// Tag all of this command's LocalAPI requests with one trace ID, so
+	// tailscaled's logs of them can be correlated. TS_TRACE_ID lets
+	// scripts supply their own.
+	traceID := envknob.String("TS_TRACE_ID")
+	if !tracing.Valid(traceID) {
+		traceID = tracing.NewID()
+	}
+	err = rootCmd.Run(tracing.WithID(context.Background(), traceID))
 	if tailscale.IsAccessDeniedError(err) && os.Getuid() != 0 && runtime.GOOS != "windows" {
 		return fmt.Errorf("%v\n\nUse 'sudo tailscale %s' or 'tailscale up --operator=$USER' to not require root.", err, strings.Join(args, " "))
 	}
@@ -0,0 +1,308 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/util/dnsname"
+)
+
+var completionCmd = &ffcli.Command{
+	Name:       "completion",
+	ShortUsage: "completion <bash|zsh|fish>",
+	ShortHelp:  "Print a shell completion script",
+	LongHelp: strings.TrimSpace(`
+Prints a script that makes the shell complete tailscale's subcommands
+and flags, along with live values from tailscaled: peer names for
+commands like "tailscale ping" and "tailscale ssh", and exit nodes
+for --exit-node.
+
+To load completions for the current bash session:
+
+	source <(tailscale completion bash)
+
+For zsh, add "source <(tailscale completion zsh)" to ~/.zshrc after
+compinit. For fish, run:
+
+	tailscale completion fish > ~/.config/fish/completions/tailscale.fish
+`),
+	Exec: runCompletion,
+}
+
+// completeCmdName is the hidden subcommand that the completion scripts
+// run to get the candidates for the words after "tailscale".
+const completeCmdName = "__complete"
+
+const bashCompletion = `_tailscale() {
+	local IFS=$'\n'
+	COMPREPLY=($(tailscale __complete -- "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+	if [[ $COMP_CWORD -gt 1 && ${COMP_WORDS[COMP_CWORD-1]} == "=" ]]; then
+		# bash splits "--flag=value" into three words; complete only the value.
+		COMPREPLY=("${COMPREPLY[@]#*=}")
+	fi
+}
+complete -o default -F _tailscale tailscale
+`
+
+const zshCompletion = `_tailscale() {
+	local -a candidates
+	candidates=("${(@f)$(tailscale __complete -- "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+	compadd -- $candidates
+}
+compdef _tailscale tailscale
+`
+
+const fishCompletion = `complete -c tailscale -f -a '(tailscale __complete -- (commandline -opc)[2..-1] (commandline -ct) 2>/dev/null)'
+`
+
+func runCompletion(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: completion <bash|zsh|fish>")
+	}
+	switch args[0] {
+	case "bash":
+		printf("%s", bashCompletion)
+	case "zsh":
+		printf("%s", zshCompletion)
+	case "fish":
+		printf("%s", fishCompletion)
+	default:
+		return fmt.Errorf("unsupported shell %q; want bash, zsh or fish", args[0])
+	}
+	return nil
+}
+
+// runComplete prints the completion candidates for words, the
+// arguments after "tailscale" up to and including the one being
+// completed, one per line.
+func runComplete(root *ffcli.Command, words []string) error {
+	if len(words) > 0 && words[0] == "--" {
+		words = words[1:]
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for _, c := range complete(ctx, root, words) {
+		outln(c)
+	}
+	return nil
+}
+
+// completeStatus returns the status used for live completions. It's a
+// variable for tests.
+var completeStatus = func(ctx context.Context) (*ipnstate.Status, error) {
+	return localClient.Status(ctx)
+}
+
+// complete returns the candidates for the last of words, which are the
+// arguments after "tailscale" up to and including the one being
+// completed.
+func complete(ctx context.Context, root *ffcli.Command, words []string) []string {
+	words = joinFlagValueWords(words)
+	partial := ""
+	if len(words) > 0 {
+		partial, words = words[len(words)-1], words[:len(words)-1]
+	}
+
+	cmd := root
+	var valueOf *flag.Flag // the preceding flag that takes a value, if any
+	nargs := 0             // positional arguments to cmd so far
+	for _, w := range words {
+		if valueOf != nil {
+			valueOf = nil
+			continue
+		}
+		if strings.HasPrefix(w, "-") {
+			name := strings.TrimLeft(w, "-")
+			if cmd.FlagSet == nil {
+				continue // e.g. "tailscale file", which has no flags
+			}
+			if f := cmd.FlagSet.Lookup(name); f != nil && !isBoolFlag(f) {
+				valueOf = f
+			}
+			continue
+		}
+		if nargs == 0 {
+			if sub := findSubcommand(cmd, w); sub != nil {
+				cmd = sub
+				continue
+			}
+		}
+		nargs++
+	}
+
+	if valueOf != nil {
+		return withPrefix(flagValues(ctx, valueOf.Name), partial)
+	}
+	if strings.HasPrefix(partial, "-") {
+		if i := strings.Index(partial, "="); i != -1 {
+			name := strings.TrimLeft(partial[:i], "-")
+			var cands []string
+			for _, v := range withPrefix(flagValues(ctx, name), partial[i+1:]) {
+				cands = append(cands, partial[:i+1]+v)
+			}
+			return cands
+		}
+		var cands []string
+		if cmd.FlagSet != nil {
+			cmd.FlagSet.VisitAll(func(f *flag.Flag) {
+				cands = append(cands, "--"+f.Name)
+			})
+		}
+		return withPrefix(cands, partial)
+	}
+
+	var cands []string
+	if nargs == 0 {
+		for _, sub := range cmd.Subcommands {
+			cands = append(cands, sub.Name)
+		}
+	}
+	if argValues := argCompleter(cmd, nargs); argValues != nil {
+		cands = append(cands, argValues(ctx, partial)...)
+	}
+	return withPrefix(cands, partial)
+}
+
+// joinFlagValueWords rejoins "--flag", "=", "value" into
+// "--flag=value", undoing bash's word splitting at "=".
+func joinFlagValueWords(words []string) []string {
+	var out []string
+	for i := 0; i < len(words); i++ {
+		w := words[i]
+		if w == "=" && len(out) > 0 && strings.HasPrefix(out[len(out)-1], "-") {
+			out[len(out)-1] += "="
+			if i+1 < len(words) {
+				i++
+				out[len(out)-1] += words[i]
+			}
+			continue
+		}
+		out = append(out, w)
+	}
+	return out
+}
+
+func findSubcommand(cmd *ffcli.Command, name string) *ffcli.Command {
+	for _, sub := range cmd.Subcommands {
+		if sub.Name == name {
+			return sub
+		}
+	}
+	return nil
+}
+
+// withPrefix returns the sorted, de-duplicated members of cands that
+// start with prefix.
+func withPrefix(cands []string, prefix string) []string {
+	sort.Strings(cands)
+	var out []string
+	for i, c := range cands {
+		if strings.HasPrefix(c, prefix) && (i == 0 || c != cands[i-1]) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// argCompleter returns the function completing cmd's positional
+// argument number nargs (counting from zero), or nil if there's none.
+func argCompleter(cmd *ffcli.Command, nargs int) func(ctx context.Context, partial string) []string {
+	switch cmd {
+	case pingCmd, ipCmd, ncCmd:
+		if nargs == 0 {
+			return func(ctx context.Context, _ string) []string { return peerNames(ctx) }
+		}
+	case sshCmd:
+		if nargs == 0 {
+			return func(ctx context.Context, partial string) []string {
+				user, _, ok := strings.Cut(partial, "@")
+				names := peerNames(ctx)
+				if ok {
+					for i, n := range names {
+						names[i] = user + "@" + n
+					}
+				}
+				return names
+			}
+		}
+	case fileCpCmd:
+		if nargs > 0 {
+			return func(ctx context.Context, partial string) []string {
+				if strings.Contains(partial, "/") {
+					return nil // leave files to the shell
+				}
+				var targets []string
+				for _, n := range peerNames(ctx) {
+					targets = append(targets, n+":")
+				}
+				return targets
+			}
+		}
+	}
+	return nil
+}
+
+// flagValues returns the candidate values for the flag with the given
+// name.
+func flagValues(ctx context.Context, name string) []string {
+	switch name {
+	case "exit-node":
+		st, err := completeStatus(ctx)
+		if err != nil {
+			return nil
+		}
+		var nodes []string
+		for _, ps := range st.Peer {
+			if !ps.ExitNodeOption {
+				continue
+			}
+			if n := peerBaseName(st, ps); n != "" {
+				nodes = append(nodes, n)
+			}
+			for _, ip := range ps.TailscaleIPs {
+				if ip.Is4() {
+					nodes = append(nodes, ip.String())
+				}
+			}
+		}
+		return nodes
+	case "netfilter-mode":
+		return []string{"on", "nodivert", "off"}
+	case "conflict":
+		return []string{"skip", "overwrite", "rename"}
+	}
+	return nil
+}
+
+// peerNames returns the MagicDNS base names of the peers, for
+// completing hostname arguments.
+func peerNames(ctx context.Context) []string {
+	st, err := completeStatus(ctx)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, ps := range st.Peer {
+		if n := peerBaseName(st, ps); n != "" {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+// peerBaseName returns ps's MagicDNS name without the tailnet suffix,
+// or the empty string if it has none.
+func peerBaseName(st *ipnstate.Status, ps *ipnstate.PeerStatus) string {
+	return dnsname.TrimSuffix(ps.DNSName, st.MagicDNSSuffix)
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+)
+
+func TestComplete(t *testing.T) {
+	st := &ipnstate.Status{
+		MagicDNSSuffix: "example.ts.net",
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): {
+				DNSName:      "alpha.example.ts.net.",
+				TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.1")},
+			},
+			key.NewNode().Public(): {
+				DNSName:        "exit.example.ts.net.",
+				TailscaleIPs:   []netip.Addr{netip.MustParseAddr("100.64.0.2"), netip.MustParseAddr("fd7a:115c:a1e0::2")},
+				ExitNodeOption: true,
+			},
+		},
+	}
+	old := completeStatus
+	defer func() { completeStatus = old }()
+	completeStatus = func(context.Context) (*ipnstate.Status, error) { return st, nil }
+
+	root := &ffcli.Command{
+		Name:        "tailscale",
+		FlagSet:     newFlagSet("tailscale"),
+		Subcommands: []*ffcli.Command{upCmd, pingCmd, sshCmd, fileCmd, statusCmd},
+	}
+
+	tests := []struct {
+		name  string
+		words []string
+		want  []string
+	}{
+		{"subcommands", []string{"s"}, []string{"ssh", "status"}},
+		{"flags", []string{"up", "--exit-node-"}, []string{"--exit-node-allow-lan-access", "--exit-node-client-approval", "--exit-node-exclude-routes", "--exit-node-rotate-every", "--exit-node-rotation"}},
+		{"ping_peer", []string{"ping", ""}, []string{"alpha", "exit"}},
+		{"ping_peer_after_flag", []string{"ping", "--c", "3", "a"}, []string{"alpha"}},
+		{"ping_second_arg", []string{"ping", "alpha", ""}, nil},
+		{"ssh_user", []string{"ssh", "root@e"}, []string{"root@exit"}},
+		{"file_cp_target", []string{"file", "cp", "foo.txt", ""}, []string{"alpha:", "exit:"}},
+		{"flag_without_flagset", []string{"file", "--verbose", "c"}, []string{"cp"}},
+		{"flags_without_flagset", []string{"file", "--"}, nil},
+		{"exit_node", []string{"up", "--exit-node", ""}, []string{"100.64.0.2", "exit"}},
+		{"exit_node_equals", []string{"up", "--exit-node=e"}, []string{"--exit-node=exit"}},
+		{"exit_node_bash_split", []string{"up", "--exit-node", "=", "1"}, []string{"--exit-node=100.64.0.2"}},
+		{"static_values", []string{"up", "--netfilter-mode", "no"}, []string{"nodivert"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := complete(context.Background(), root, tt.words)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("complete(%q) = %q; want %q", tt.words, got, tt.want)
+			}
+		})
+	}
+}
@@ -8,7 +8,6 @@
 	"bufio"
 	"bytes"
 	"context"
-	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -17,18 +16,20 @@
 	"log"
 	"net"
 	"net/http"
-	"net/netip"
 	"os"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/control/controlhttp"
 	"tailscale.com/hostinfo"
 	"tailscale.com/ipn"
-	"tailscale.com/net/tsaddr"
+	"tailscale.com/net/dropreason"
 	"tailscale.com/paths"
 	"tailscale.com/safesocket"
 	"tailscale.com/tailcfg"
@@ -68,6 +69,11 @@
 				return fs
 			})(),
 		},
+		{
+			Name:      "drops",
+			Exec:      runDrops,
+			ShortHelp: "print counts of packets dropped by tailscaled, by reason",
+		},
 		{
 			Name:      "env",
 			Exec:      runEnv,
@@ -98,6 +104,111 @@
 			Exec:      localAPIAction("rebind"),
 			ShortHelp: "force a magicsock rebind",
 		},
+		{
+			Name:       "disco",
+			Exec:       runDebugDisco,
+			ShortUsage: "disco [<hostname-or-IP>]",
+			ShortHelp:  "print disco ping/pong and call-me-maybe state per peer",
+		},
+		{
+			Name:      "derp",
+			Exec:      runDebugDERP,
+			ShortHelp: "print the health of the connection to each DERP region",
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("derp")
+				fs.BoolVar(&debugDERPArgs.json, "json", false, "output in JSON format")
+				return fs
+			})(),
+		},
+		{
+			Name:       "bench",
+			Exec:       runBench,
+			ShortUsage: "bench [flags] <hostname-or-IP>",
+			ShortHelp:  "measure throughput over the tunnel to a peer",
+			LongHelp: strings.TrimSpace(`
+Measures the throughput of the tunnel to a peer by sending data to its
+peer API, or with --reverse, having it send data here, like iperf but
+needing nothing running on the peer beyond tailscaled. It reports the
+path the packets take, the latency, the packet rate and tailscaled's
+CPU use, to help tell Tailscale's overhead apart from application
+problems.
+
+The peer must be owned by the same user as this machine or grant it
+debug access in the tailnet policy.
+`),
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("bench")
+				fs.DurationVar(&benchArgs.duration, "time", 10*time.Second, "how long to run the test, at most 1m")
+				fs.BoolVar(&benchArgs.reverse, "reverse", false, "have the peer send to this machine")
+				fs.BoolVar(&benchArgs.json, "json", false, "output in JSON format")
+				return fs
+			})(),
+		},
+		{
+			Name:       "inject-latency",
+			Exec:       runInjectLatency,
+			ShortUsage: "inject-latency [flags] [<hostname-or-IP>]",
+			ShortHelp:  "add artificial latency and loss to a peer's paths",
+			LongHelp: strings.TrimSpace(`
+Adds artificial latency and packet loss to the packets tailscaled sends
+to a peer, over direct UDP paths, DERP, or both, for testing failover
+and how applications cope with a bad path. Disco pings are impaired
+too, so path selection reacts as it would to a real bad path. Running
+it with no flags removes the peer's impairment, and running it with no
+peer lists the impairments set.
+
+It's only allowed when tailscaled runs with TS_DEBUG_ALLOW_IMPAIRMENT=1
+in its environment.
+
+Example: tailscale debug inject-latency --path=udp --loss=1 nas
+`),
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("inject-latency")
+				fs.StringVar(&injectLatencyArgs.path, "path", "", `path to impair: "udp", "derp", or empty for both`)
+				fs.DurationVar(&injectLatencyArgs.latency, "latency", 0, "latency to add to each packet")
+				fs.DurationVar(&injectLatencyArgs.jitter, "jitter", 0, "most random extra latency to add to each packet")
+				fs.Float64Var(&injectLatencyArgs.loss, "loss", 0, "fraction of packets to drop, from 0 to 1")
+				return fs
+			})(),
+		},
+		{
+			Name:      "history",
+			Exec:      runHistory,
+			ShortHelp: "print recent changes to peers, routes and the exit node",
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("history")
+				fs.DurationVar(&historyArgs.since, "since", 0, "only print changes in this long before now; 0 means all")
+				fs.BoolVar(&historyArgs.json, "json", false, "output in JSON format")
+				return fs
+			})(),
+		},
+		{
+			Name:      "netmap-size",
+			Exec:      runNetMapSize,
+			ShortHelp: "print an estimate of the memory used by the netmap",
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("netmap-size")
+				fs.IntVar(&netMapSizeArgs.top, "top", 10, "number of largest peers to print")
+				fs.BoolVar(&netMapSizeArgs.json, "json", false, "output in JSON format")
+				return fs
+			})(),
+		},
+		{
+			Name:       "loglevel",
+			Exec:       runLogLevel,
+			ShortUsage: "loglevel [<component>=<level>...]",
+			ShortHelp:  "print or change the log verbosity of components",
+			LongHelp: strings.TrimSpace(`
+Changes the verbosity of individual components' messages, such as
+magicsock, dns or control, in tailscaled's log output, without a
+restart. With no arguments, it prints the components' current levels.
+
+Levels are "info" (0), "verbose" (1), "debug" (2), or "default" to go
+back to tailscaled's --verbose level. Uploaded logs are unaffected.
+
+Example: tailscale debug loglevel magicsock=debug dns=default
+`),
+		},
 		{
 			Name:      "prefs",
 			Exec:      runPrefs,
@@ -399,49 +510,275 @@ type change struct {
 	}
 }
 
-func runVia(ctx context.Context, args []string) error {
+func runDrops(ctx context.Context, args []string) error {
+	out, err := localClient.DaemonMetrics(ctx)
+	if err != nil {
+		return err
+	}
+	bs := bufio.NewScanner(bytes.NewReader(out))
+	for bs.Scan() {
+		f := strings.Fields(bs.Text())
+		if len(f) != 2 || !strings.HasPrefix(f[0], dropreason.MetricPrefix) {
+			continue
+		}
+		fmt.Fprintf(Stdout, "%-16s %s\n", strings.TrimPrefix(f[0], dropreason.MetricPrefix), f[1])
+	}
+	return bs.Err()
+}
+
+func runDebugDisco(ctx context.Context, args []string) error {
+	var peer key.NodePublic
 	switch len(args) {
-	default:
-		return errors.New("expect either <site-id> <v4-cidr> or <v6-route>")
+	case 0:
 	case 1:
-		ipp, err := netip.ParsePrefix(args[0])
+		ip, self, err := tailscaleIPFromArg(ctx, args[0])
 		if err != nil {
 			return err
 		}
-		if !ipp.Addr().Is6() {
-			return errors.New("with one argument, expect an IPv6 CIDR")
+		if self {
+			return errors.New("can't print disco state of self")
 		}
-		if !tsaddr.TailscaleViaRange().Contains(ipp.Addr()) {
-			return errors.New("not a via route")
+		st, err := localClient.Status(ctx)
+		if err != nil {
+			return err
 		}
-		if ipp.Bits() < 96 {
-			return errors.New("short length, want /96 or more")
+		ps, ok := peerMatchingIP(st, ip)
+		if !ok {
+			return fmt.Errorf("no peer found with IP %v", ip)
 		}
-		v4 := tsaddr.UnmapVia(ipp.Addr())
-		a := ipp.Addr().As16()
-		siteID := binary.BigEndian.Uint32(a[8:12])
-		printf("site %v (0x%x), %v\n", siteID, siteID, netip.PrefixFrom(v4, ipp.Bits()-96))
-	case 2:
-		siteID, err := strconv.ParseUint(args[0], 0, 32)
-		if err != nil {
-			return fmt.Errorf("invalid site-id %q; must be decimal or hex with 0x prefix", args[0])
+		peer = ps.PublicKey
+	default:
+		return errors.New("usage: disco [<hostname-or-IP>]")
+	}
+	states, err := localClient.DebugDiscoState(ctx, peer)
+	if err != nil {
+		return err
+	}
+	return printJSON(states)
+}
+
+var debugDERPArgs struct {
+	json bool
+}
+
+func runDebugDERP(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	states, err := localClient.DebugDERPState(ctx)
+	if err != nil {
+		return err
+	}
+	if debugDERPArgs.json {
+		return printJSON(states)
+	}
+	tw := tabwriter.NewWriter(Stdout, 0, 2, 2, ' ', 0)
+	fmt.Fprintf(tw, "REGION\tSTATE\tRECONNECTS\tLAST PONG\tRTT\tPING FAILURES\n")
+	for _, st := range states {
+		region := fmt.Sprintf("%d/%s", st.RegionID, st.RegionCode)
+		if st.Home {
+			region += " (home)"
+		}
+		state := "disconnected"
+		if st.Connected {
+			state = "connected " + time.Since(st.ConnectedAt).Round(time.Second).String()
 		}
-		if siteID > 0xff {
-			return fmt.Errorf("site-id values over 255 are currently reserved")
+		lastPong, rtt := "-", "-"
+		if !st.LastPong.IsZero() {
+			lastPong = time.Since(st.LastPong).Round(time.Second).String() + " ago"
+			rtt = st.RTT.Round(100 * time.Microsecond).String()
 		}
-		ipp, err := netip.ParsePrefix(args[1])
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%d\n", region, state, st.Reconnects, lastPong, rtt, st.PingFailures)
+	}
+	return tw.Flush()
+}
+
+var injectLatencyArgs struct {
+	path    string
+	latency time.Duration
+	jitter  time.Duration
+	loss    float64
+}
+
+func runInjectLatency(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return listInjectedLatency(ctx)
+	}
+	if len(args) != 1 {
+		return errors.New("usage: inject-latency [flags] [<hostname-or-IP>]")
+	}
+	ip, self, err := tailscaleIPFromArg(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if self {
+		return errors.New("can't impair the paths to self")
+	}
+	st, err := localClient.Status(ctx)
+	if err != nil {
+		return err
+	}
+	ps, ok := peerMatchingIP(st, ip)
+	if !ok {
+		return fmt.Errorf("no peer found with IP %v", ip)
+	}
+	a := injectLatencyArgs
+	return localClient.DebugSetPathImpairment(ctx, ps.PublicKey, a.path, a.latency, a.jitter, a.loss)
+}
+
+// listInjectedLatency prints the path impairments set by
+// "tailscale debug inject-latency".
+func listInjectedLatency(ctx context.Context) error {
+	imps, err := localClient.DebugPathImpairments(ctx)
+	if err != nil {
+		return err
+	}
+	if len(imps) == 0 {
+		printf("no paths impaired\n")
+		return nil
+	}
+	st, err := localClient.Status(ctx)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(Stdout, 0, 2, 2, ' ', 0)
+	fmt.Fprintf(tw, "PEER\tPATH\tLATENCY\tJITTER\tLOSS\n")
+	for _, imp := range imps {
+		peer := imp.Peer.ShortString()
+		if ps, ok := st.Peer[imp.Peer]; ok {
+			peer = dnsOrQuoteHostname(st, ps)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%v\t%v\t%g\n", peer, imp.Path, imp.Latency, imp.Jitter, imp.Loss)
+	}
+	return tw.Flush()
+}
+
+var historyArgs struct {
+	since time.Duration
+	json  bool
+}
+
+func runHistory(ctx context.Context, args []string) error {
+	evs, err := localClient.History(ctx)
+	if err != nil {
+		return err
+	}
+	if historyArgs.since > 0 {
+		since := time.Now().Add(-historyArgs.since)
+		var recent []apitype.HistoryEvent
+		for _, ev := range evs {
+			if ev.Time.After(since) {
+				recent = append(recent, ev)
+			}
+		}
+		evs = recent
+	}
+	if historyArgs.json {
+		if evs == nil {
+			evs = []apitype.HistoryEvent{}
+		}
+		return printJSON(evs)
+	}
+	tw := tabwriter.NewWriter(Stdout, 0, 2, 2, ' ', 0)
+	for _, ev := range evs {
+		node := ev.Node
+		if node == "" {
+			node = "(self)"
+		}
+		change := ev.New
+		if ev.Old != "" {
+			change = ev.Old + " -> " + ev.New
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", ev.Time.Local().Format(time.RFC3339), ev.Type, node, change)
+	}
+	return tw.Flush()
+}
+
+var netMapSizeArgs struct {
+	top  int
+	json bool
+}
+
+func runNetMapSize(ctx context.Context, args []string) error {
+	s, err := localClient.NetMapSize(ctx, netMapSizeArgs.top)
+	if err != nil {
+		return err
+	}
+	if netMapSizeArgs.json {
+		return printJSON(s)
+	}
+	tw := tabwriter.NewWriter(Stdout, 0, 2, 2, ' ', 0)
+	fmt.Fprintf(tw, "total\t%d\t(%d peers)\n", s.Total, s.NumPeers)
+	fmt.Fprintf(tw, "peers\t%d\n", s.Peers)
+	fmt.Fprintf(tw, "packet filter\t%d\n", s.PacketFilter)
+	fmt.Fprintf(tw, "dns\t%d\n", s.DNS)
+	fmt.Fprintf(tw, "derp map\t%d\n", s.DERPMap)
+	fmt.Fprintf(tw, "user profiles\t%d\n", s.UserProfiles)
+	fmt.Fprintf(tw, "other\t%d\n", s.Other)
+	if len(s.TopPeers) > 0 {
+		fmt.Fprintf(tw, "\nlargest peers:\n")
+		for _, p := range s.TopPeers {
+			fmt.Fprintf(tw, "%s\t%d\t%s\n", p.Name, p.Bytes, p.StableID)
+		}
+	}
+	if len(s.History) > 0 {
+		fmt.Fprintf(tw, "\nhistory:\n")
+		for _, h := range s.History {
+			fmt.Fprintf(tw, "%s\t%d\t(%d peers)\n", h.Time.Local().Format(time.RFC3339), h.Total, h.NumPeers)
+		}
+	}
+	return tw.Flush()
+}
+
+func runLogLevel(ctx context.Context, args []string) error {
+	for _, arg := range args {
+		component, levelStr, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("invalid argument %q; want <component>=<level>", arg)
+		}
+		level, err := parseLogLevel(levelStr)
 		if err != nil {
 			return err
 		}
-		via, err := tsaddr.MapVia(uint32(siteID), ipp)
-		if err != nil {
+		if err := localClient.SetComponentLogLevel(ctx, component, level); err != nil {
 			return err
 		}
-		outln(via)
+	}
+	levels, err := localClient.ComponentLogLevels(ctx)
+	if err != nil {
+		return err
+	}
+	components := make([]string, 0, len(levels))
+	for c := range levels {
+		components = append(components, c)
+	}
+	sort.Strings(components)
+	for _, c := range components {
+		printf("%s=%d\n", c, levels[c])
 	}
 	return nil
 }
 
+// parseLogLevel parses a log verbosity level given by name or number.
+// The "default" level is -1.
+func parseLogLevel(s string) (int, error) {
+	switch s {
+	case "info":
+		return 0, nil
+	case "verbose":
+		return 1, nil
+	case "debug":
+		return 2, nil
+	case "default", "reset":
+		return -1, nil
+	}
+	level, err := strconv.Atoi(s)
+	if err != nil || level < 0 {
+		return 0, fmt.Errorf("invalid log level %q; want info, verbose, debug, default, or a number", s)
+	}
+	return level, nil
+}
+
 var ts2021Args struct {
 	host    string // "controlplane.tailscale.com"
 	version int    // 27 or whatever
@@ -0,0 +1,123 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/ipn"
+)
+
+var exitNodeCmd = &ffcli.Command{
+	Name:       "exit-node",
+	ShortUsage: "exit-node <clients|approve|deny> [arguments]",
+	ShortHelp:  "Show and approve the peers using this machine as an exit node",
+	Subcommands: []*ffcli.Command{
+		exitNodeClientsCmd,
+		{
+			Name:       "approve",
+			ShortUsage: "exit-node approve <peer hostname or ip address>",
+			ShortHelp:  "Let a peer use this exit node, with --exit-node-client-approval",
+			Exec:       func(ctx context.Context, args []string) error { return runExitNodeApprove(ctx, args, true) },
+		},
+		{
+			Name:       "deny",
+			ShortUsage: "exit-node deny <peer hostname or ip address>",
+			ShortHelp:  "Stop a peer from using this exit node, with --exit-node-client-approval",
+			Exec:       func(ctx context.Context, args []string) error { return runExitNodeApprove(ctx, args, false) },
+		},
+	},
+	Exec: runExitNodeClients,
+}
+
+var exitNodeClientsCmd = &ffcli.Command{
+	Name:       "clients",
+	ShortUsage: "exit-node clients [--json]",
+	ShortHelp:  "List the peers using this machine as an exit node",
+	Exec:       runExitNodeClients,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("clients")
+		fs.BoolVar(&exitNodeArgs.json, "json", false, "output in JSON format")
+		return fs
+	})(),
+}
+
+var exitNodeArgs struct {
+	json bool
+}
+
+func runExitNodeClients(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected non-flag arguments to 'tailscale exit-node clients'")
+	}
+	clients, err := localClient.ExitNodeClients(ctx)
+	if err != nil {
+		return fixTailscaledConnectError(err)
+	}
+	if exitNodeArgs.json {
+		j, err := json.MarshalIndent(clients, "", "  ")
+		if err != nil {
+			return err
+		}
+		outln(string(j))
+		return nil
+	}
+	if len(clients) == 0 {
+		outln("No peers are using this machine as an exit node.")
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 2, 2, ' ', 0)
+	fmt.Fprintln(tw, "IP\tNAME\tUSER\tSTATE\tSINCE\tRX\tTX")
+	for _, c := range clients {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%d\n",
+			c.IP, dashIfEmpty(c.Name), dashIfEmpty(c.User), exitNodeClientState(c),
+			c.Started.Local().Format(time.Stamp), c.RxBytes, c.TxBytes)
+	}
+	return tw.Flush()
+}
+
+func exitNodeClientState(c ipn.ExitNodeClient) string {
+	switch {
+	case c.Pending:
+		return "pending"
+	case c.Denied:
+		return "denied"
+	}
+	return "active"
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func runExitNodeApprove(ctx context.Context, args []string, approve bool) error {
+	if len(args) != 1 {
+		return errors.New("expected one peer hostname or IP address")
+	}
+	ipStr, self, err := tailscaleIPFromArg(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if self {
+		return errors.New("can't approve this machine as its own exit node client")
+	}
+	ip, err := netip.ParseAddr(ipStr)
+	if err != nil {
+		return err
+	}
+	return localClient.SetExitNodeClientApproval(ctx, ip, approve)
+}
@@ -311,7 +311,7 @@ func (v *onConflict) Set(s string) error {
 
 var fileGetCmd = &ffcli.Command{
 	Name:       "get",
-	ShortUsage: "file get [--wait] [--verbose] [--conflict=(skip|overwrite|rename)] <target-directory>",
+	ShortUsage: "file get [--wait] [--verbose] [--json] [--conflict=(skip|overwrite|rename)] <target-directory>",
 	ShortHelp:  "Move files out of the Tailscale file inbox",
 	Exec:       runFileGet,
 	FlagSet: (func() *flag.FlagSet {
@@ -319,6 +319,7 @@ func (v *onConflict) Set(s string) error {
 		fs.BoolVar(&getArgs.wait, "wait", false, "wait for a file to arrive if inbox is empty")
 		fs.BoolVar(&getArgs.loop, "loop", false, "run get in a loop, receiving files as they come in")
 		fs.BoolVar(&getArgs.verbose, "verbose", false, "verbose output")
+		fs.BoolVar(&getArgs.json, "json", false, "output one JSON object per batch of files moved out of the inbox")
 		fs.Var(&getArgs.conflict, "conflict", `behavior when a conflicting (same-named) file already exists in the target directory.
 	skip:       skip conflicting files: leave them in the taildrop inbox and print an error. get any non-conflicting files
 	overwrite:  overwrite existing file
@@ -331,6 +332,7 @@ func (v *onConflict) Set(s string) error {
 	wait     bool
 	loop     bool
 	verbose  bool
+	json     bool
 	conflict onConflict
 }{conflict: skipOnExist}
 
@@ -401,10 +403,9 @@ func receiveFile(ctx context.Context, wf apitype.WaitingFile, dir string) (targe
 	return f.Name(), size, f.Close()
 }
 
-func runFileGetOneBatch(ctx context.Context, dir string) []error {
+func runFileGetOneBatch(ctx context.Context, dir string) (received []apitype.ReceivedFile, errs []error) {
 	var wfs []apitype.WaitingFile
 	var err error
-	var errs []error
 	for len(errs) == 0 {
 		wfs, err = localClient.WaitingFiles(ctx)
 		if err != nil {
@@ -438,6 +439,7 @@ func runFileGetOneBatch(ctx context.Context, dir string) []error {
 		if getArgs.verbose {
 			printf("wrote %v as %v (%d bytes)\n", wf.Name, writtenFile, size)
 		}
+		received = append(received, apitype.ReceivedFile{Name: wf.Name, Path: writtenFile, Size: size})
 		if err = localClient.DeleteWaitingFile(ctx, wf.Name); err != nil {
 			errs = append(errs, fmt.Errorf("deleting %q from inbox: %v", wf.Name, err))
 			continue
@@ -450,7 +452,20 @@ func runFileGetOneBatch(ctx context.Context, dir string) []error {
 	} else if getArgs.verbose {
 		printf("moved %d/%d files\n", deleted, len(wfs))
 	}
-	return errs
+	return received, errs
+}
+
+// printFileGetJSON writes the results of a runFileGetOneBatch call for
+// "tailscale file get --json".
+func printFileGetJSON(received []apitype.ReceivedFile, errs []error) {
+	out := apitype.FileGetOutput{
+		Version: apitype.CLIOutputVersion,
+		Files:   received,
+	}
+	for _, err := range errs {
+		out.Errors = append(out.Errors, err.Error())
+	}
+	printJSONLine(out)
 }
 
 func runFileGet(ctx context.Context, args []string) error {
@@ -469,9 +484,13 @@ func runFileGet(ctx context.Context, args []string) error {
 	}
 	if getArgs.loop {
 		for {
-			errs := runFileGetOneBatch(ctx, dir)
-			for _, err := range errs {
-				outln(err)
+			received, errs := runFileGetOneBatch(ctx, dir)
+			if getArgs.json {
+				printFileGetJSON(received, errs)
+			} else {
+				for _, err := range errs {
+					outln(err)
+				}
 			}
 			if len(errs) > 0 {
 				// It's possible whatever caused the error(s) (e.g. conflicting target file,
@@ -488,7 +507,14 @@ func runFileGet(ctx context.Context, args []string) error {
 			}
 		}
 	}
-	errs := runFileGetOneBatch(ctx, dir)
+	received, errs := runFileGetOneBatch(ctx, dir)
+	if getArgs.json {
+		printFileGetJSON(received, errs)
+		if len(errs) > 0 {
+			return errors.New("failed to get some files")
+		}
+		return nil
+	}
 	if len(errs) == 0 {
 		return nil
 	}
@@ -12,12 +12,13 @@
 	"net/netip"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn/ipnstate"
 )
 
 var ipCmd = &ffcli.Command{
 	Name:       "ip",
-	ShortUsage: "ip [-1] [-4] [-6] [peer hostname or ip address]",
+	ShortUsage: "ip [-1] [-4] [-6] [--json] [peer hostname or ip address]",
 	ShortHelp:  "Show Tailscale IP addresses",
 	LongHelp:   "Show Tailscale IP addresses for peer. Peer defaults to the current machine.",
 	Exec:       runIP,
@@ -26,6 +27,7 @@
 		fs.BoolVar(&ipArgs.want1, "1", false, "only print one IP address")
 		fs.BoolVar(&ipArgs.want4, "4", false, "only print IPv4 address")
 		fs.BoolVar(&ipArgs.want6, "6", false, "only print IPv6 address")
+		fs.BoolVar(&ipArgs.json, "json", false, "output in JSON format")
 		return fs
 	})(),
 }
@@ -34,6 +36,7 @@
 	want1 bool
 	want4 bool
 	want6 bool
+	json  bool
 }
 
 func runIP(ctx context.Context, args []string) error {
@@ -81,14 +84,19 @@ func runIP(ctx context.Context, args []string) error {
 	if ipArgs.want1 {
 		ips = ips[:1]
 	}
-	match := false
+	var matches []netip.Addr
 	for _, ip := range ips {
 		if ip.Is4() && v4 || ip.Is6() && v6 {
-			match = true
-			outln(ip)
+			matches = append(matches, ip)
 		}
 	}
-	if !match {
+	if ipArgs.json && len(matches) > 0 {
+		return printJSON(apitype.IPOutput{Version: apitype.CLIOutputVersion, IPs: matches})
+	}
+	for _, ip := range matches {
+		outln(ip)
+	}
+	if len(matches) == 0 {
 		if ipArgs.want4 {
 			return errors.New("no Tailscale IPv4 address")
 		}
@@ -9,6 +9,7 @@
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"strconv"
 
@@ -49,6 +50,12 @@ func runNC(ctx context.Context, args []string) error {
 		return fmt.Errorf("Dial(%q, %v): %w", hostOrIP, port, err)
 	}
 	defer c.Close()
+	return pipeStdio(c)
+}
+
+// pipeStdio copies stdin to c and c to stdout until either direction
+// ends.
+func pipeStdio(c net.Conn) error {
 	errc := make(chan error, 1)
 	go func() {
 		_, err := io.Copy(os.Stdout, c)
@@ -5,13 +5,22 @@
 package cli
 
 import (
+	"bufio"
 	"context"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tka"
 	"tailscale.com/types/key"
 )
@@ -20,7 +29,7 @@
 	Name:        "lock",
 	ShortUsage:  "lock <sub-command> <arguments>",
 	ShortHelp:   "Manipulate the tailnet key authority",
-	Subcommands: []*ffcli.Command{nlInitCmd, nlStatusCmd},
+	Subcommands: []*ffcli.Command{nlInitCmd, nlStatusCmd, nlSignCmd, nlLogCmd},
 	Exec:        runNetworkLockStatus,
 }
 
@@ -77,9 +86,18 @@ func runNetworkLockInit(ctx context.Context, args []string) error {
 
 var nlStatusCmd = &ffcli.Command{
 	Name:       "status",
-	ShortUsage: "status",
+	ShortUsage: "status [--json]",
 	ShortHelp:  "Outputs the state of network lock",
 	Exec:       runNetworkLockStatus,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("status")
+		fs.BoolVar(&nlStatusArgs.json, "json", false, "output in JSON format")
+		return fs
+	})(),
+}
+
+var nlStatusArgs struct {
+	json bool
 }
 
 func runNetworkLockStatus(ctx context.Context, args []string) error {
@@ -87,6 +105,9 @@ func runNetworkLockStatus(ctx context.Context, args []string) error {
 	if err != nil {
 		return fixTailscaledConnectError(err)
 	}
+	if nlStatusArgs.json {
+		return printJSON(apitype.NetworkLockStatusOutput{Version: apitype.CLIOutputVersion, Status: st})
+	}
 	if st.Enabled {
 		fmt.Println("Network-lock is ENABLED.")
 	} else {
@@ -99,3 +120,289 @@ func runNetworkLockStatus(ctx context.Context, args []string) error {
 	fmt.Printf("our public-key: %s\n", p)
 	return nil
 }
+
+var nlSignCmd = &ffcli.Command{
+	Name:       "sign",
+	ShortUsage: "sign [--dry-run] {<node-key> [<rotation-key>] | --file=<path>}",
+	ShortHelp:  "Signs node keys with this node's network-lock key",
+	LongHelp: strings.TrimSpace(`
+Signs one or more node keys with this node's network-lock key, and
+submits the signatures to the coordination server.
+
+To sign many node keys at once, pass --file with a list of them (or
+"-" to read the list from stdin). The list is either CSV, with one
+"node-key[,rotation-key]" row per node and an optional header row, or
+a JSON array of objects with "NodeKey" and optional "RotationKey"
+fields.
+
+Nodes that already have a valid signature are skipped. With --dry-run,
+signatures are generated and checked but not submitted.
+`),
+	Exec: runNetworkLockSign,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("sign")
+		fs.StringVar(&nlSignArgs.file, "file", "", "file with a CSV or JSON list of node keys to sign, or \"-\" for stdin")
+		fs.BoolVar(&nlSignArgs.dryRun, "dry-run", false, "only check that the node keys can be signed, without submitting signatures")
+		return fs
+	})(),
+}
+
+var nlSignArgs struct {
+	file   string
+	dryRun bool
+}
+
+func runNetworkLockSign(ctx context.Context, args []string) error {
+	var reqs []ipnstate.NetworkLockSignRequest
+	switch {
+	case nlSignArgs.file != "" && len(args) > 0:
+		return errors.New("node keys must be given either as arguments or with --file, not both")
+	case nlSignArgs.file != "":
+		var r io.Reader = os.Stdin
+		if nlSignArgs.file != "-" {
+			f, err := os.Open(nlSignArgs.file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		var err error
+		reqs, err = parseNLSignList(r)
+		if err != nil {
+			return err
+		}
+	case len(args) == 1 || len(args) == 2:
+		rotKey := ""
+		if len(args) == 2 {
+			rotKey = args[1]
+		}
+		req, err := parseNLSignEntry(args[0], rotKey)
+		if err != nil {
+			return err
+		}
+		reqs = append(reqs, req)
+	default:
+		return errors.New("usage: lock sign [--dry-run] {<node-key> [<rotation-key>] | --file=<path>}")
+	}
+	if len(reqs) == 0 {
+		return errors.New("no node keys to sign")
+	}
+
+	results, err := localClient.NetworkLockSign(ctx, reqs, nlSignArgs.dryRun)
+	if err != nil {
+		return fixTailscaledConnectError(err)
+	}
+	var failed int
+	for _, res := range results {
+		switch {
+		case res.Err != "":
+			failed++
+			printf("%v: error: %s\n", res.NodeKey, res.Err)
+		case res.AlreadySigned:
+			printf("%v: already signed\n", res.NodeKey)
+		case nlSignArgs.dryRun:
+			printf("%v: ok (dry run, not submitted)\n", res.NodeKey)
+		default:
+			printf("%v: signed\n", res.NodeKey)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d node keys failed", failed, len(results))
+	}
+	return nil
+}
+
+var nlLogCmd = &ffcli.Command{
+	Name:       "log",
+	ShortUsage: "log [--limit=N] [--cursor=C] [--kind=K] [--signer=KEY] [--all] [--json]",
+	ShortHelp:  "List updates to the tailnet key authority",
+	LongHelp: strings.TrimSpace(`
+Lists the updates to the tailnet key authority known to this node,
+newest first, a page at a time. When there are older updates, the
+command to list the next page is printed after the page.
+
+Updates can be filtered by kind (add-key, remove-key, update-key,
+checkpoint or no-op; comma-separated) and by the network-lock public
+key that signed them.
+`),
+	Exec: runNetworkLockLog,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("log")
+		fs.IntVar(&nlLogArgs.limit, "limit", 50, "the most updates to list in a page")
+		fs.StringVar(&nlLogArgs.cursor, "cursor", "", "where to start listing, as printed after the previous page")
+		fs.StringVar(&nlLogArgs.kind, "kind", "", "only list updates of these comma-separated kinds")
+		fs.StringVar(&nlLogArgs.signer, "signer", "", "only list updates signed by this network-lock public key")
+		fs.BoolVar(&nlLogArgs.all, "all", false, "list all the updates rather than a page")
+		fs.BoolVar(&nlLogArgs.json, "json", false, "output in JSON format")
+		return fs
+	})(),
+}
+
+var nlLogArgs struct {
+	limit  int
+	cursor string
+	kind   string
+	signer string
+	all    bool
+	json   bool
+}
+
+func runNetworkLockLog(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected non-flag arguments to 'tailscale lock log'")
+	}
+	if nlLogArgs.limit <= 0 {
+		return errors.New("--limit must be positive")
+	}
+	var kinds []string
+	if nlLogArgs.kind != "" {
+		kinds = strings.Split(nlLogArgs.kind, ",")
+	}
+	var signer key.NLPublic
+	if nlLogArgs.signer != "" {
+		if err := signer.UnmarshalText([]byte(nlLogArgs.signer)); err != nil {
+			return fmt.Errorf("parsing --signer: %v", err)
+		}
+	}
+
+	out := apitype.NetworkLockLogOutput{Version: apitype.CLIOutputVersion}
+	cursor := nlLogArgs.cursor
+	for {
+		log, err := localClient.NetworkLockLog(ctx, cursor, nlLogArgs.limit, kinds, signer)
+		if err != nil {
+			return fixTailscaledConnectError(err)
+		}
+		out.Updates = append(out.Updates, log.Updates...)
+		out.NextCursor = log.NextCursor
+		if !nlLogArgs.all || log.NextCursor == "" {
+			break
+		}
+		cursor = log.NextCursor
+	}
+	if nlLogArgs.json {
+		if out.Updates == nil {
+			out.Updates = []ipnstate.NetworkLockUpdate{}
+		}
+		return printJSON(out)
+	}
+	printf("%s", formatNLLog(out.Updates))
+	if out.NextCursor != "" {
+		printf("\nTo list older updates: tailscale lock log --cursor=%s\n", out.NextCursor)
+	}
+	return nil
+}
+
+// formatNLLog formats updates for "tailscale lock log".
+func formatNLLog(updates []ipnstate.NetworkLockUpdate) string {
+	var sb strings.Builder
+	for i, u := range updates {
+		if i > 0 {
+			sb.WriteByte('\n')
+		}
+		fmt.Fprintf(&sb, "update %s (%s)\n", u.Hash, u.Kind)
+		if !u.Time.IsZero() {
+			fmt.Fprintf(&sb, "Stored:    %s\n", u.Time.Format(time.RFC1123Z))
+		}
+		if u.Key != nil {
+			k, _ := u.Key.MarshalText()
+			fmt.Fprintf(&sb, "Key:       %s\n", k)
+		}
+		for _, s := range u.Signers {
+			k, _ := s.MarshalText()
+			fmt.Fprintf(&sb, "Signed by: %s\n", k)
+		}
+	}
+	return sb.String()
+}
+
+// parseNLSignEntry parses a node key and optional rotation key (a
+// network-lock public key) into a sign request.
+func parseNLSignEntry(nodeKey, rotationKey string) (ipnstate.NetworkLockSignRequest, error) {
+	var req ipnstate.NetworkLockSignRequest
+	if err := req.NodeKey.UnmarshalText([]byte(strings.TrimSpace(nodeKey))); err != nil {
+		return req, fmt.Errorf("parsing node key %q: %v", nodeKey, err)
+	}
+	if rotationKey = strings.TrimSpace(rotationKey); rotationKey != "" {
+		var rk key.NLPublic
+		if err := rk.UnmarshalText([]byte(rotationKey)); err != nil {
+			return req, fmt.Errorf("parsing rotation key %q: %v", rotationKey, err)
+		}
+		req.RotationPublic = rk.Verifier()
+	}
+	return req, nil
+}
+
+// parseNLSignList parses a list of node keys to sign, for "lock sign
+// --file". See nlSignCmd for the accepted formats.
+func parseNLSignList(r io.Reader) ([]ipnstate.NetworkLockSignRequest, error) {
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			if err == io.EOF {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if !strings.ContainsRune(" \t\r\n", rune(b[0])) {
+			if b[0] == '[' {
+				return parseNLSignJSON(br)
+			}
+			return parseNLSignCSV(br)
+		}
+		br.ReadByte()
+	}
+}
+
+func parseNLSignJSON(r io.Reader) ([]ipnstate.NetworkLockSignRequest, error) {
+	var entries []struct {
+		NodeKey     string
+		RotationKey string
+	}
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("parsing JSON: %v", err)
+	}
+	reqs := make([]ipnstate.NetworkLockSignRequest, 0, len(entries))
+	for i, e := range entries {
+		req, err := parseNLSignEntry(e.NodeKey, e.RotationKey)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %v", i+1, err)
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+func parseNLSignCSV(r io.Reader) ([]ipnstate.NetworkLockSignRequest, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	var reqs []ipnstate.NetworkLockSignRequest
+	for first := true; ; first = false {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return reqs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parsing CSV: %v", err)
+		}
+		line, _ := cr.FieldPos(0)
+		if len(rec) > 2 {
+			return nil, fmt.Errorf("line %d: got %d fields, want node key and optional rotation key", line, len(rec))
+		}
+		if first && !strings.Contains(rec[0], ":") {
+			continue // header row
+		}
+		rotKey := ""
+		if len(rec) == 2 {
+			rotKey = rec[1]
+		}
+		req, err := parseNLSignEntry(rec[0], rotKey)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		reqs = append(reqs, req)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+)
+
+func TestParseNLSignList(t *testing.T) {
+	nk1 := key.NewNode().Public()
+	nk2 := key.NewNode().Public()
+	rk := key.NewNLPrivate().Public()
+	nk1s, _ := nk1.MarshalText()
+	nk2s, _ := nk2.MarshalText()
+	rks, _ := rk.MarshalText()
+
+	want := []ipnstate.NetworkLockSignRequest{
+		{NodeKey: nk1},
+		{NodeKey: nk2, RotationPublic: rk.Verifier()},
+	}
+	tests := []struct {
+		name    string
+		in      string
+		want    []ipnstate.NetworkLockSignRequest
+		wantErr string
+	}{
+		{
+			name: "csv",
+			in:   fmt.Sprintf("%s\n%s,%s\n", nk1s, nk2s, rks),
+			want: want,
+		},
+		{
+			name: "csv_header_comments",
+			in:   fmt.Sprintf("node_key,rotation_key\n# first\n%s\n\n%s, %s\n", nk1s, nk2s, rks),
+			want: want,
+		},
+		{
+			name: "json",
+			in:   fmt.Sprintf(" \n[{%q: %q}, {%q: %q, %q: %q}]", "NodeKey", nk1s, "NodeKey", nk2s, "RotationKey", rks),
+			want: want,
+		},
+		{
+			name: "empty",
+			in:   "\n",
+		},
+		{
+			name:    "csv_bad_key",
+			in:      fmt.Sprintf("%s\nnodekey:zz\n", nk1s),
+			wantErr: "line 2: parsing node key",
+		},
+		{
+			name:    "csv_too_many_fields",
+			in:      fmt.Sprintf("%s,%s,x\n", nk1s, rks),
+			wantErr: "line 1: got 3 fields",
+		},
+		{
+			name:    "json_bad_rotation_key",
+			in:      fmt.Sprintf(`[{"NodeKey": %q, "RotationKey": "nlpub:zz"}]`, nk1s),
+			wantErr: "entry 1: parsing rotation key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseNLSignList(strings.NewReader(tt.in))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v; want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatNLLog(t *testing.T) {
+	k1, k2 := key.NewNLPrivate().Public(), key.NewNLPrivate().Public()
+	k1s, _ := k1.MarshalText()
+	k2s, _ := k2.MarshalText()
+	updates := []ipnstate.NetworkLockUpdate{
+		{
+			Hash:    "AAAA",
+			Kind:    "add-key",
+			Key:     &k2,
+			Signers: []key.NLPublic{k1},
+			Time:    time.Date(2022, 10, 3, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			Hash:    "BBBB",
+			Kind:    "checkpoint",
+			Signers: []key.NLPublic{k1},
+		},
+	}
+	want := "update AAAA (add-key)\n" +
+		"Stored:    Mon, 03 Oct 2022 12:00:00 +0000\n" +
+		"Key:       " + string(k2s) + "\n" +
+		"Signed by: " + string(k1s) + "\n" +
+		"\n" +
+		"update BBBB (checkpoint)\n" +
+		"Signed by: " + string(k1s) + "\n"
+	if got := formatNLLog(updates); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -17,6 +17,7 @@
 	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tailcfg"
 )
@@ -54,6 +55,7 @@
 		fs.BoolVar(&pingArgs.peerAPI, "peerapi", false, "try hitting the peer's peerapi HTTP server")
 		fs.IntVar(&pingArgs.num, "c", 10, "max number of pings to send")
 		fs.DurationVar(&pingArgs.timeout, "timeout", 5*time.Second, "timeout before giving up on a ping")
+		fs.BoolVar(&pingArgs.json, "json", false, "output one JSON object per ping")
 		return fs
 	})(),
 }
@@ -65,6 +67,7 @@
 	tsmp        bool
 	icmp        bool
 	peerAPI     bool
+	json        bool
 	timeout     time.Duration
 }
 
@@ -84,26 +87,37 @@ func pingType() tailcfg.PingType {
 func runPing(ctx context.Context, args []string) error {
 	st, err := localClient.Status(ctx)
 	if err != nil {
-		return fixTailscaledConnectError(err)
+		return pingError(fixTailscaledConnectError(err))
 	}
 	description, ok := isRunningOrStarting(st)
 	if !ok {
-		printf("%s\n", description)
+		if pingArgs.json {
+			printJSONLine(apitype.PingOutput{Version: apitype.CLIOutputVersion, Error: description})
+		} else {
+			printf("%s\n", description)
+		}
 		os.Exit(1)
 	}
 
 	if len(args) != 1 || args[0] == "" {
-		return errors.New("usage: ping <hostname-or-IP>")
+		return pingError(errors.New("usage: ping <hostname-or-IP>"))
 	}
 	var ip string
 
 	hostOrIP := args[0]
 	ip, self, err := tailscaleIPFromArg(ctx, hostOrIP)
 	if err != nil {
-		return err
+		return pingError(err)
 	}
 	if self {
-		printf("%v is local Tailscale IP\n", ip)
+		if pingArgs.json {
+			printJSONLine(apitype.PingOutput{
+				Version: apitype.CLIOutputVersion,
+				Result:  &ipnstate.PingResult{IP: ip, Err: ip + " is local Tailscale IP", IsLocalIP: true},
+			})
+		} else {
+			printf("%v is local Tailscale IP\n", ip)
+		}
 		return nil
 	}
 
@@ -120,7 +134,11 @@ func runPing(ctx context.Context, args []string) error {
 		cancel()
 		if err != nil {
 			if errors.Is(err, context.DeadlineExceeded) {
-				printf("ping %q timed out\n", ip)
+				if pingArgs.json {
+					printJSONLine(apitype.PingOutput{Version: apitype.CLIOutputVersion, TimedOut: true})
+				} else {
+					printf("ping %q timed out\n", ip)
+				}
 				if n == pingArgs.num {
 					if !anyPong {
 						return errors.New("no reply")
@@ -129,35 +147,27 @@ func runPing(ctx context.Context, args []string) error {
 				}
 				continue
 			}
-			return err
+			return pingError(err)
+		}
+		if pingArgs.json {
+			printJSONLine(apitype.PingOutput{Version: apitype.CLIOutputVersion, Result: pr})
 		}
 		if pr.Err != "" {
 			if pr.IsLocalIP {
-				outln(pr.Err)
+				if !pingArgs.json {
+					outln(pr.Err)
+				}
 				return nil
 			}
 			return errors.New(pr.Err)
 		}
-		latency := time.Duration(pr.LatencySeconds * float64(time.Second)).Round(time.Millisecond)
-		via := pr.Endpoint
-		if pr.DERPRegionID != 0 {
-			via = fmt.Sprintf("DERP(%s)", pr.DERPRegionCode)
-		}
-		if via == "" {
-			// TODO(bradfitz): populate the rest of ipnstate.PingResult for TSMP queries?
-			// For now just say which protocol it used.
-			via = string(pingType())
+		if !pingArgs.json {
+			printPingResult(pr)
 		}
 		if pingArgs.peerAPI {
-			printf("hit peerapi of %s (%s) at %s in %s\n", pr.NodeIP, pr.NodeName, pr.PeerAPIURL, latency)
 			return nil
 		}
 		anyPong = true
-		extra := ""
-		if pr.PeerAPIPort != 0 {
-			extra = fmt.Sprintf(", %d", pr.PeerAPIPort)
-		}
-		printf("pong from %s (%s%s) via %v in %v\n", pr.NodeName, pr.NodeIP, extra, via, latency)
 		if pingArgs.tsmp || pingArgs.icmp {
 			return nil
 		}
@@ -178,6 +188,39 @@ func runPing(ctx context.Context, args []string) error {
 	}
 }
 
+// pingError returns err, first writing it as JSON with --json, as
+// the reason no ping could be sent.
+func pingError(err error) error {
+	if pingArgs.json {
+		printJSONLine(apitype.PingOutput{Version: apitype.CLIOutputVersion, Error: err.Error()})
+	}
+	return err
+}
+
+// printPingResult prints the successful ping result pr in the human
+// format.
+func printPingResult(pr *ipnstate.PingResult) {
+	latency := time.Duration(pr.LatencySeconds * float64(time.Second)).Round(time.Millisecond)
+	if pingArgs.peerAPI {
+		printf("hit peerapi of %s (%s) at %s in %s\n", pr.NodeIP, pr.NodeName, pr.PeerAPIURL, latency)
+		return
+	}
+	via := pr.Endpoint
+	if pr.DERPRegionID != 0 {
+		via = fmt.Sprintf("DERP(%s)", pr.DERPRegionCode)
+	}
+	if via == "" {
+		// TODO(bradfitz): populate the rest of ipnstate.PingResult for TSMP queries?
+		// For now just say which protocol it used.
+		via = string(pingType())
+	}
+	extra := ""
+	if pr.PeerAPIPort != 0 {
+		extra = fmt.Sprintf(", %d", pr.PeerAPIPort)
+	}
+	printf("pong from %s (%s%s) via %v in %v\n", pr.NodeName, pr.NodeIP, extra, via, latency)
+}
+
 func tailscaleIPFromArg(ctx context.Context, hostOrIP string) (ip string, self bool, err error) {
 	// If the argument is an IP address, use it directly without any resolution.
 	if net.ParseIP(hostOrIP) != nil {
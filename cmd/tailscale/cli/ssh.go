@@ -8,6 +8,7 @@
 	"bytes"
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/netip"
@@ -28,13 +29,41 @@
 	Name:       "ssh",
 	ShortUsage: "ssh [user@]<host> [args...]",
 	ShortHelp:  "SSH to a Tailscale machine",
-	Exec:       runSSH,
+	LongHelp: strings.TrimSpace(`
+The 'tailscale ssh' command runs the system ssh client, connecting to
+the Tailscale machine <host> over the tailnet.
+
+To keep using the regular ssh command and your existing ssh config
+instead, add the output of 'tailscale ssh --print-config' to
+~/.ssh/config. It makes ssh connect to Tailscale machines through
+'tailscale ssh --proxy', which dials them over the tailnet even when
+port 22 isn't reachable any other way, and checks that each is the
+same machine it was the first time.
+`),
+	Exec: runSSH,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("ssh")
+		fs.BoolVar(&sshArgs.printConfig, "print-config", false, "print an OpenSSH config block that makes ssh connect to Tailscale machines with --proxy, and exit")
+		fs.BoolVar(&sshArgs.proxy, "proxy", false, "act as an OpenSSH ProxyCommand: with arguments <host> <port>, connect stdin and stdout to the port of that Tailscale machine after checking its identity")
+		return fs
+	})(),
+}
+
+var sshArgs struct {
+	printConfig bool
+	proxy       bool
 }
 
 func runSSH(ctx context.Context, args []string) error {
 	if runtime.GOOS == "darwin" && version.IsSandboxedMacOS() && !envknob.UseWIPCode() {
 		return errors.New("The 'tailscale ssh' subcommand is not available on sandboxed macOS builds.\nUse the regular 'ssh' client instead.")
 	}
+	switch {
+	case sshArgs.printConfig:
+		return runSSHPrintConfig(ctx, args)
+	case sshArgs.proxy:
+		return runSSHProxy(ctx, args)
+	}
 	if len(args) == 0 {
 		return errors.New("usage: ssh [user@]<host>")
 	}
@@ -95,7 +124,7 @@ func runSSH(ctx context.Context, args []string) error {
 	// and they're not in userspace mode, so 'nc' isn't very useful.
 	if runtime.GOOS != "darwin" {
 		argv = append(argv,
-			"-o", fmt.Sprintf("ProxyCommand %q --socket=%q nc %%h %%p",
+			"-o", fmt.Sprintf("ProxyCommand %q --socket=%q ssh --proxy %%h %%p",
 				tailscaleBin,
 				rootArgs.socket,
 			))
@@ -122,7 +151,9 @@ func runSSH(ctx context.Context, args []string) error {
 	return execSSH(ssh, argv)
 }
 
-func writeKnownHosts(st *ipnstate.Status) (knownHostsFile string, err error) {
+// tsConfigFile returns the path of the file name in the user's
+// Tailscale config directory, creating the directory if needed.
+func tsConfigFile(name string) (string, error) {
 	confDir, err := os.UserConfigDir()
 	if err != nil {
 		return "", err
@@ -131,7 +162,14 @@ func writeKnownHosts(st *ipnstate.Status) (knownHostsFile string, err error) {
 	if err := os.MkdirAll(tsConfDir, 0700); err != nil {
 		return "", err
 	}
-	knownHostsFile = filepath.Join(tsConfDir, "ssh_known_hosts")
+	return filepath.Join(tsConfDir, name), nil
+}
+
+func writeKnownHosts(st *ipnstate.Status) (knownHostsFile string, err error) {
+	knownHostsFile, err = tsConfigFile("ssh_known_hosts")
+	if err != nil {
+		return "", err
+	}
 	want := genKnownHosts(st)
 	if cur, err := os.ReadFile(knownHostsFile); err != nil || !bytes.Equal(cur, want) {
 		if err := os.WriteFile(knownHostsFile, want, 0644); err != nil {
@@ -160,28 +198,36 @@ func genKnownHosts(st *ipnstate.Status) []byte {
 // in st that matches the input arg which can be a base name, full
 // DNS name, or an IP.
 func nodeDNSNameFromArg(st *ipnstate.Status, arg string) (dnsName string, ok bool) {
+	if ps, ok := peerFromArg(st, arg); ok {
+		return ps.DNSName, true
+	}
+	return "", false
+}
+
+// peerFromArg returns the peer in st that matches the input arg, which
+// can be a base name, full DNS name, or an IP.
+func peerFromArg(st *ipnstate.Status, arg string) (*ipnstate.PeerStatus, bool) {
 	if arg == "" {
-		return
+		return nil, false
 	}
 	argIP, _ := netip.ParseAddr(arg)
 	for _, ps := range st.Peer {
-		dnsName = ps.DNSName
 		if argIP.IsValid() {
 			for _, ip := range ps.TailscaleIPs {
 				if ip == argIP {
-					return dnsName, true
+					return ps, true
 				}
 			}
 			continue
 		}
-		if strings.EqualFold(strings.TrimSuffix(arg, "."), strings.TrimSuffix(dnsName, ".")) {
-			return dnsName, true
+		if strings.EqualFold(strings.TrimSuffix(arg, "."), strings.TrimSuffix(ps.DNSName, ".")) {
+			return ps, true
 		}
 		if base, _, ok := strings.Cut(ps.DNSName, "."); ok && strings.EqualFold(base, arg) {
-			return dnsName, true
+			return ps, true
 		}
 	}
-	return "", false
+	return nil, false
 }
 
 // getSSHClientEnvVar returns the "SSH_CLIENT" environment variable
@@ -0,0 +1,187 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// runSSHProxy implements "tailscale ssh --proxy <host> <port>", an
+// OpenSSH ProxyCommand. It checks host against the node pinned for it
+// in ssh_known_nodes and then connects stdin and stdout to port of its
+// Tailscale IP.
+func runSSHProxy(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: ssh --proxy <host> <port>")
+	}
+	host, portStr := args[0], args[1]
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port number %q", portStr)
+	}
+	st, err := localClient.Status(ctx)
+	if err != nil {
+		return fixTailscaledConnectError(err)
+	}
+	if description, ok := isRunningOrStarting(st); !ok {
+		return errors.New(description)
+	}
+	ps, ok := peerFromArg(st, host)
+	if !ok || len(ps.TailscaleIPs) == 0 {
+		return fmt.Errorf("%q is not a Tailscale machine", host)
+	}
+	ip := ps.TailscaleIPs[0]
+
+	// Dial by IP, having checked which node has it, rather than by
+	// name, so the node whose key WireGuard authenticates is the one
+	// checked against the pin.
+	who, err := localClient.WhoIs(ctx, netip.AddrPortFrom(ip, uint16(port)).String())
+	if err != nil {
+		return err
+	}
+	if who.Node == nil || who.Node.StableID != ps.ID {
+		return fmt.Errorf("%v is no longer %s", ip, ps.DNSName)
+	}
+	pins, err := tsConfigFile("ssh_known_nodes")
+	if err != nil {
+		return err
+	}
+	rekeyed, err := checkNodePin(pins, ps.DNSName, who.Node.StableID, who.Node.Key)
+	if err != nil {
+		return err
+	}
+	if rekeyed {
+		fmt.Fprintf(Stderr, "tailscale: %s has a new node key, %s, after logging in again\n", ps.DNSName, who.Node.Key.ShortString())
+	}
+	if _, err := writeKnownHosts(st); err != nil {
+		return err
+	}
+
+	c, err := localClient.DialTCP(ctx, ip.String(), uint16(port))
+	if err != nil {
+		return fmt.Errorf("Dial(%q, %v): %w", ip, port, err)
+	}
+	defer c.Close()
+	return pipeStdio(c)
+}
+
+// checkNodePin checks the node with ID id and node key nk that
+// answers to dnsName against the one pinned for dnsName in the
+// ssh_known_nodes file at path, pinning it if dnsName has no pin yet.
+//
+// A different node with that name is refused. A new node key for the
+// same node is accepted and pinned, as node keys change whenever a
+// node logs in again, and reported with rekeyed.
+//
+// The file has one "DNSNAME NODEID NODEKEY" line per pinned node.
+func checkNodePin(path, dnsName string, id tailcfg.StableNodeID, nk key.NodePublic) (rekeyed bool, err error) {
+	cur, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	var out bytes.Buffer
+	found := false
+	s := bufio.NewScanner(bytes.NewReader(cur))
+	for line := 1; s.Scan(); line++ {
+		f := strings.Fields(s.Text())
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) != 3 {
+			return false, fmt.Errorf("%s:%d: want DNSNAME NODEID NODEKEY", path, line)
+		}
+		if found || !strings.EqualFold(f[0], dnsName) {
+			fmt.Fprintln(&out, s.Text())
+			continue
+		}
+		found = true
+		if tailcfg.StableNodeID(f[1]) != id {
+			return false, fmt.Errorf("%s is a different machine (node %s) than when first connected to (node %s); if that's expected, remove its line from %s", dnsName, id, f[1], path)
+		}
+		var pinned key.NodePublic
+		if err := pinned.UnmarshalText([]byte(f[2])); err != nil {
+			return false, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		rekeyed = pinned != nk
+		fmt.Fprintf(&out, "%s %s %s\n", f[0], id, nk)
+	}
+	if err := s.Err(); err != nil {
+		return false, err
+	}
+	if found && !rekeyed {
+		return false, nil
+	}
+	if !found {
+		fmt.Fprintf(&out, "%s %s %s\n", dnsName, id, nk)
+	}
+	return rekeyed, os.WriteFile(path, out.Bytes(), 0600)
+}
+
+// runSSHPrintConfig implements "tailscale ssh --print-config".
+func runSSHPrintConfig(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected non-flag arguments to 'tailscale ssh --print-config'")
+	}
+	st, err := localClient.Status(ctx)
+	if err != nil {
+		return fixTailscaledConnectError(err)
+	}
+	tailscaleBin, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	knownHostsFile, err := writeKnownHosts(st)
+	if err != nil {
+		return err
+	}
+	printf("%s", genSSHConfig(st, tailscaleBin, rootArgs.socket, knownHostsFile))
+	return nil
+}
+
+// genSSHConfig returns an OpenSSH config block for connecting to the
+// peers in st with "tailscale ssh --proxy", run from tailscaleBin with
+// tailscaled at socket, trusting the host keys in knownHostsFile as
+// well as the user's usual known_hosts.
+func genSSHConfig(st *ipnstate.Status, tailscaleBin, socket, knownHostsFile string) []byte {
+	var hosts []string
+	if st.CurrentTailnet != nil && st.CurrentTailnet.MagicDNSSuffix != "" {
+		hosts = append(hosts, "*."+st.CurrentTailnet.MagicDNSSuffix)
+	}
+	var names []string
+	for _, ps := range st.Peer {
+		if base, _, ok := strings.Cut(ps.DNSName, "."); ok && base != "" {
+			names = append(names, base)
+		}
+	}
+	sort.Strings(names)
+	for i, n := range names {
+		if i == 0 || n != names[i-1] {
+			hosts = append(hosts, n)
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Tailscale machines, from \"tailscale ssh --print-config\".\n")
+	if len(hosts) == 0 {
+		return buf.Bytes()
+	}
+	fmt.Fprintf(&buf, "Host %s\n", strings.Join(hosts, " "))
+	fmt.Fprintf(&buf, "\tProxyCommand %q --socket=%q ssh --proxy %%h %%p\n", tailscaleBin, socket)
+	fmt.Fprintf(&buf, "\tUserKnownHostsFile %q ~/.ssh/known_hosts\n", knownHostsFile)
+	return buf.Bytes()
+}
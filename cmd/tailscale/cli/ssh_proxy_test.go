@@ -0,0 +1,75 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+func TestCheckNodePin(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ssh_known_nodes")
+	k1, k2 := key.NewNode().Public(), key.NewNode().Public()
+
+	check := func(name, id string, nk key.NodePublic, wantRekeyed bool, wantErr string) {
+		t.Helper()
+		rekeyed, err := checkNodePin(path, name, tailcfg.StableNodeID(id), nk)
+		if wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), wantErr) {
+				t.Fatalf("checkNodePin(%s, %s) error = %v; want one containing %q", name, id, err, wantErr)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("checkNodePin(%s, %s): %v", name, id, err)
+		}
+		if rekeyed != wantRekeyed {
+			t.Errorf("checkNodePin(%s, %s) rekeyed = %v; want %v", name, id, rekeyed, wantRekeyed)
+		}
+	}
+
+	check("db.example.ts.net.", "n1", k1, false, "")  // first use pins it
+	check("web.example.ts.net.", "n2", k2, false, "") // as does another host
+	check("db.example.ts.net.", "n1", k1, false, "")  // same node
+	check("DB.example.ts.net.", "n1", k2, true, "")   // logged in again
+	check("db.example.ts.net.", "n1", k2, false, "")  // new key pinned
+	check("db.example.ts.net.", "n3", k2, false, "is a different machine")
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "db.example.ts.net. n1 " + k2.String() + "\n" +
+		"web.example.ts.net. n2 " + k2.String() + "\n"
+	if string(got) != want {
+		t.Errorf("pins file = %q; want %q", got, want)
+	}
+}
+
+func TestGenSSHConfig(t *testing.T) {
+	st := &ipnstate.Status{
+		CurrentTailnet: &ipnstate.TailnetStatus{MagicDNSSuffix: "example.ts.net"},
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): {DNSName: "web.example.ts.net."},
+			key.NewNode().Public(): {DNSName: "db.example.ts.net."},
+			key.NewNode().Public(): {DNSName: ""},
+		},
+	}
+	got := string(genSSHConfig(st, "/usr/bin/tailscale", "/run/tailscale.sock", "/home/u/.config/tailscale/ssh_known_hosts"))
+	want := `# Tailscale machines, from "tailscale ssh --print-config".
+Host *.example.ts.net db web
+	ProxyCommand "/usr/bin/tailscale" --socket="/run/tailscale.sock" ssh --proxy %h %p
+	UserKnownHostsFile "/home/u/.config/tailscale/ssh_known_hosts" ~/.ssh/known_hosts
+`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -18,6 +18,7 @@
 	"reflect"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -25,15 +26,20 @@
 	shellquote "github.com/kballard/go-shellquote"
 	"github.com/peterbourgon/ff/v3/ffcli"
 	qrcode "github.com/skip2/go-qrcode"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn"
+	"tailscale.com/ipn/eventhook"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/dscp"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/safesocket"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/preftype"
+	"tailscale.com/util/maintwindow"
 	"tailscale.com/version"
 	"tailscale.com/version/distro"
+	"tailscale.com/wgengine/flowsample"
 )
 
 var upCmd = &ffcli.Command{
@@ -91,20 +97,43 @@ func newUpFlagSet(goos string, upArgs *upArgsT) *flag.FlagSet {
 	upf.BoolVar(&upArgs.json, "json", false, "output in JSON format (WARNING: format subject to change)")
 	upf.BoolVar(&upArgs.forceReauth, "force-reauth", false, "force reauthentication")
 	upf.BoolVar(&upArgs.reset, "reset", false, "reset unspecified settings to their default values")
+	upf.BoolVar(&upArgs.dryRun, "dry-run", false, "print the settings changes that would be made, after checking them with tailscaled, without making them")
 
 	upf.StringVar(&upArgs.server, "login-server", ipn.DefaultControlURL, "base URL of control server")
+	upf.StringVar(&upArgs.controlProxy, "control-proxy", "", "HTTP proxy to reach the control server through, as http://HOST:PORT, https:// or socks5://, or \"direct\" for none; empty means use the environment's proxy settings. Give tailscaled any proxy credentials with --control-proxy-auth-file")
 	upf.BoolVar(&upArgs.acceptRoutes, "accept-routes", acceptRouteDefault(goos), "accept routes advertised by other Tailscale nodes")
 	upf.BoolVar(&upArgs.acceptDNS, "accept-dns", true, "accept DNS configuration from the admin panel")
+	upf.BoolVar(&upArgs.syncHostsFile, "sync-hosts-file", false, "write the names and addresses of Tailscale peers to the hosts file, for software that doesn't use the system DNS resolver")
 	upf.BoolVar(&upArgs.singleRoutes, "host-routes", true, "install host routes to other Tailscale nodes")
 	upf.StringVar(&upArgs.exitNodeIP, "exit-node", "", "Tailscale exit node (IP or base name) for internet traffic, or empty string to not use an exit node")
 	upf.BoolVar(&upArgs.exitNodeAllowLANAccess, "exit-node-allow-lan-access", false, "Allow direct access to the local network when routing traffic via an exit node")
+	upf.StringVar(&upArgs.exitNodeExcludeRoutes, "exit-node-exclude-routes", "", "destinations to route directly rather than via the exit node (comma-separated, e.g. \"203.0.113.0/24,2001:db8::/32\")")
+	upf.StringVar(&upArgs.exitNodeRotation, "exit-node-rotation", "", "exit nodes to spread internet traffic across, in place of --exit-node (comma-separated hostnames or Tailscale IPs, e.g. \"fra,ams,100.101.102.103\"); offline ones are skipped")
+	upf.DurationVar(&upArgs.exitNodeRotateEvery, "exit-node-rotate-every", 0, "with --exit-node-rotation, how often to switch to the next exit node (at least 1m); 0 means use them all at once, spread per destination rather than per connection")
 	upf.BoolVar(&upArgs.shieldsUp, "shields-up", false, "don't allow incoming connections")
+	upf.StringVar(&upArgs.shields, "shields", "off", "incoming connections to block, also from outside Tailscale where supported: \"off\", \"lan\" (all but Tailscale and --shields-lan), \"tailnet\" (all but Tailscale) or \"all\"")
+	upf.StringVar(&upArgs.shieldsLAN, "shields-lan", "", "with --shields=lan, source ranges to allow incoming connections from (comma-separated, e.g. \"192.168.1.0/24,fd00::/64\")")
+	upf.BoolVar(&upArgs.stealth, "stealth", false, "silently drop UDP packets not from current peers or DERP STUN servers, so the WireGuard port looks closed to scanners")
 	upf.BoolVar(&upArgs.runSSH, "ssh", false, "run an SSH server, permitting access per tailnet admin's declared policy")
 	upf.StringVar(&upArgs.advertiseTags, "advertise-tags", "", "comma-separated ACL tags to request; each must start with \"tag:\" (e.g. \"tag:eng,tag:montreal,tag:ssh\")")
 	upf.StringVar(&upArgs.authKeyOrFile, "auth-key", "", `node authorization key; if it begins with "file:", then it's a path to a file containing the authkey`)
 	upf.StringVar(&upArgs.hostname, "hostname", "", "hostname to use instead of the one provided by the OS")
-	upf.StringVar(&upArgs.advertiseRoutes, "advertise-routes", "", "routes to advertise to other nodes (comma-separated, e.g. \"10.0.0.0/8,192.168.0.0/24\") or empty string to not advertise routes")
+	upf.StringVar(&upArgs.advertiseRoutes, "advertise-routes", "", "routes to advertise to other nodes (comma-separated, e.g. \"10.0.0.0/8,192.168.0.0/24\"; append @SITE to an IPv4 route to advertise it as a 4via6 route for that site ID) or empty string to not advertise routes")
 	upf.BoolVar(&upArgs.advertiseDefaultRoute, "advertise-exit-node", false, "offer to be an exit node for internet traffic for the tailnet")
+	upf.BoolVar(&upArgs.exitNodeClientApproval, "exit-node-client-approval", false, "when offering to be an exit node, require each peer that starts using it to be approved with \"tailscale exit-node approve\" first")
+	upf.IntVar(&upArgs.maxBandwidthKbps, "max-bandwidth", 0, "limit on tunnel traffic to and from all peers combined, in kbit/s in each direction; 0 means unlimited")
+	upf.IntVar(&upArgs.maxPeerBandwidthKbps, "max-peer-bandwidth", 0, "limit on tunnel traffic to and from each peer, in kbit/s in each direction; 0 means unlimited")
+	upf.StringVar(&upArgs.pinEndpoints, "pin-endpoint", "", "static UDP endpoints for peers, used as direct paths without waiting for discovery (comma-separated peerIP=ip:port, e.g. \"100.101.102.103=203.0.113.5:41641\")")
+	upf.IntVar(&upArgs.flowSampleRate, "flow-sample-rate", 0, "sample 1 in this many tunneled packets into flow records for --flow-collector; 0 means no sampling")
+	upf.StringVar(&upArgs.flowCollector, "flow-collector", "", "collector to export sampled flow records to, as ipfix://HOST:PORT or sflow://HOST:PORT")
+	upf.StringVar(&upArgs.dscpPassthrough, "dscp-passthrough", "", "comma-separated DSCP codepoints of tunneled packets to also mark the outer packets with, such as \"EF,AF41\"; use IN=OUT to remark, such as \"AF41=AF31\"")
+	upf.StringVar(&upArgs.maintenanceWindow, "maintenance-window", "", "recurring window outside of which disruptive changes such as policy route changes are deferred, as \"[DAYS ]HH:MM-HH:MM[ ZONE]\", e.g. \"Sat,Sun 02:00-04:00\"; empty means apply them immediately")
+	upf.BoolVar(&upArgs.lazyPeers, "lazy-peers", false, "configure peers into WireGuard only once they have traffic, even if the control server turns that off, to save memory on large tailnets")
+	upf.StringVar(&upArgs.alwaysOnPeers, "always-on-peers", "", "peers to always configure into WireGuard rather than once they have traffic (comma-separated hostnames or Tailscale IPs, e.g. \"db,100.101.102.103\")")
+	upf.StringVar(&upArgs.systemDialRules, "system-dial-rules", "", "how to connect to destinations outside the tailnet, such as the control and DERP servers, on multi-homed hosts (comma-separated PREFIX[=IFACE][@TIMEOUT], where the first rule containing a destination IP applies, e.g. \"10.0.0.0/8=eth1,0.0.0.0/0@5s\")")
+	upf.DurationVar(&upArgs.discoKeyRotation, "disco-key-rotation", 0, "keep the peer-to-peer path discovery key across restarts, replacing it once it's this old (at least 1h), so peers keep their paths to this machine when tailscaled restarts; 0 means a new key every start")
+	upf.StringVar(&upArgs.eventHooks, "event-hooks", "", "hooks to run when peers come online or go offline or routes change (comma-separated EVENTS[@PEERS]=TARGET, where TARGET is exec:NAME for a program in tailscaled's hooks directory or a localhost http URL, e.g. \"peer-online+peer-offline@nas=exec:nas-state\")")
+	upf.StringVar(&upArgs.taildropAccept, "taildrop-accept", "", "senders to accept Taildrop files from, rejecting all others (comma-separated FROM[=DIR[=QUOTA_MB]], where FROM is a login name, full node name, stable node ID or \"*\" and DIR is a directory under tailscaled's --taildrop-accept-root to save files to directly, e.g. \"alice@example.com=alice=1000\")")
 	if safesocket.GOOSUsesPeerCreds(goos) {
 		upf.StringVar(&upArgs.opUser, "operator", "", "Unix username to allow to operate on tailscaled without sudo")
 	}
@@ -130,24 +159,47 @@ func defaultNetfilterMode() string {
 type upArgsT struct {
 	qr                     bool
 	reset                  bool
+	dryRun                 bool
 	server                 string
+	controlProxy           string
 	acceptRoutes           bool
 	acceptDNS              bool
+	syncHostsFile          bool
 	singleRoutes           bool
 	exitNodeIP             string
 	exitNodeAllowLANAccess bool
+	exitNodeExcludeRoutes  string
+	exitNodeRotation       string
+	exitNodeRotateEvery    time.Duration
 	shieldsUp              bool
+	shields                string
+	shieldsLAN             string
+	stealth                bool
 	runSSH                 bool
 	forceReauth            bool
 	forceDaemon            bool
 	advertiseRoutes        string
 	advertiseDefaultRoute  bool
+	exitNodeClientApproval bool
 	advertiseTags          string
 	snat                   bool
 	netfilterMode          string
 	authKeyOrFile          string // "secret" or "file:/path/to/secret"
 	hostname               string
 	opUser                 string
+	maxBandwidthKbps       int
+	maxPeerBandwidthKbps   int
+	pinEndpoints           string
+	taildropAccept         string
+	flowSampleRate         int
+	flowCollector          string
+	dscpPassthrough        string
+	maintenanceWindow      string
+	lazyPeers              bool
+	alwaysOnPeers          string
+	systemDialRules        string
+	discoKeyRotation       time.Duration
+	eventHooks             string
 	json                   bool
 	timeout                time.Duration
 }
@@ -224,15 +276,227 @@ func validateViaPrefix(ipp netip.Prefix) error {
 	return nil
 }
 
+// parsePinnedEndpoints parses the --pin-endpoint flag value, a
+// comma-separated list of peerIP=ip:port pairs.
+func parsePinnedEndpoints(v string) ([]ipn.PinnedEndpoint, error) {
+	if v == "" {
+		return nil, nil
+	}
+	var pins []ipn.PinnedEndpoint
+	seen := map[netip.Addr]bool{}
+	for _, s := range strings.Split(v, ",") {
+		peerStr, epStr, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid --pin-endpoint %q; want peerIP=ip:port", s)
+		}
+		peer, err := netip.ParseAddr(peerStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --pin-endpoint %q: %v", s, err)
+		}
+		if !tsaddr.IsTailscaleIP(peer) {
+			return nil, fmt.Errorf("invalid --pin-endpoint %q: %v is not a Tailscale IP", s, peer)
+		}
+		ep, err := netip.ParseAddrPort(epStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --pin-endpoint %q: %v", s, err)
+		}
+		if ep.Port() == 0 || !ep.Addr().IsGlobalUnicast() {
+			return nil, fmt.Errorf("invalid --pin-endpoint %q: %v is not a usable UDP endpoint", s, ep)
+		}
+		if seen[peer] {
+			return nil, fmt.Errorf("--pin-endpoint lists peer %v more than once", peer)
+		}
+		seen[peer] = true
+		pins = append(pins, ipn.PinnedEndpoint{Peer: peer, Endpoint: ep})
+	}
+	return pins, nil
+}
+
+// minDiscoKeyRotation is the shortest --disco-key-rotation allowed, to
+// keep peers from rediscovering paths to this node too often.
+const minDiscoKeyRotation = time.Hour
+
+// minExitNodeRotateEvery is the shortest --exit-node-rotate-every
+// allowed, as each switch breaks the connections using the old exit
+// node.
+const minExitNodeRotateEvery = time.Minute
+
+// parseExitNodeRotation parses the --exit-node-rotation flag value, a
+// comma-separated list of exit node hostnames or Tailscale IPs.
+func parseExitNodeRotation(v string) ([]string, error) {
+	if v == "" {
+		return nil, nil
+	}
+	nodes := strings.Split(v, ",")
+	seen := map[string]bool{}
+	for _, n := range nodes {
+		if n == "" {
+			return nil, fmt.Errorf("invalid --exit-node-rotation %q: empty exit node", v)
+		}
+		if seen[n] {
+			return nil, fmt.Errorf("--exit-node-rotation lists %q more than once", n)
+		}
+		seen[n] = true
+	}
+	return nodes, nil
+}
+
+// parseSystemDialRules parses the --system-dial-rules flag value, a
+// comma-separated list of PREFIX[=IFACE][@TIMEOUT] rules.
+func parseSystemDialRules(v string) ([]ipn.DialRule, error) {
+	if v == "" {
+		return nil, nil
+	}
+	var rules []ipn.DialRule
+	for _, s := range strings.Split(v, ",") {
+		var r ipn.DialRule
+		rest := s
+		if i := strings.LastIndexByte(rest, '@'); i != -1 {
+			d, err := time.ParseDuration(rest[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid --system-dial-rules %q: %v", s, err)
+			}
+			if d <= 0 {
+				return nil, fmt.Errorf("invalid --system-dial-rules %q: timeout must be positive", s)
+			}
+			r.Timeout = d
+			rest = rest[:i]
+		}
+		prefStr, ifName, hasIf := strings.Cut(rest, "=")
+		if hasIf && ifName == "" {
+			return nil, fmt.Errorf("invalid --system-dial-rules %q: empty interface name", s)
+		}
+		r.Interface = ifName
+		p, err := netip.ParsePrefix(prefStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --system-dial-rules %q: %v", s, err)
+		}
+		if p != p.Masked() {
+			return nil, fmt.Errorf("invalid --system-dial-rules %q: %s has non-address bits set; expected %s", s, p, p.Masked())
+		}
+		r.Dest = p
+		if r.Interface == "" && r.Timeout == 0 {
+			return nil, fmt.Errorf("invalid --system-dial-rules %q: rule sets neither an interface nor a timeout", s)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// parseExitNodeExcludeRoutes parses the --exit-node-exclude-routes
+// flag value, a comma-separated list of CIDR prefixes.
+func parseExitNodeExcludeRoutes(v string) ([]netip.Prefix, error) {
+	if v == "" {
+		return nil, nil
+	}
+	var routes []netip.Prefix
+	for _, s := range strings.Split(v, ",") {
+		ipp, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --exit-node-exclude-routes %q: not a CIDR prefix", s)
+		}
+		if ipp != ipp.Masked() {
+			return nil, fmt.Errorf("%s has non-address bits set; expected %s", ipp, ipp.Masked())
+		}
+		if ipp.Bits() == 0 {
+			return nil, fmt.Errorf("invalid --exit-node-exclude-routes %q: can't exclude the whole default route", s)
+		}
+		routes = append(routes, ipp)
+	}
+	return routes, nil
+}
+
+// parseShieldsLANRoutes parses the --shields-lan flag value, a
+// comma-separated list of CIDR prefixes.
+func parseShieldsLANRoutes(v string) ([]netip.Prefix, error) {
+	if v == "" {
+		return nil, nil
+	}
+	var routes []netip.Prefix
+	for _, s := range strings.Split(v, ",") {
+		ipp, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --shields-lan %q: not a CIDR prefix", s)
+		}
+		if ipp != ipp.Masked() {
+			return nil, fmt.Errorf("%s has non-address bits set; expected %s", ipp, ipp.Masked())
+		}
+		routes = append(routes, ipp)
+	}
+	return routes, nil
+}
+
+// parseTaildropRules parses the --taildrop-accept flag value, a
+// comma-separated list of FROM[=DIR[=QUOTA_MB]] rules.
+func parseTaildropRules(v string) ([]ipn.TaildropRule, error) {
+	if v == "" {
+		return nil, nil
+	}
+	var rules []ipn.TaildropRule
+	seen := map[string]bool{}
+	for _, s := range strings.Split(v, ",") {
+		f := strings.SplitN(s, "=", 3)
+		r := ipn.TaildropRule{From: f[0]}
+		if r.From == "" {
+			return nil, fmt.Errorf("invalid --taildrop-accept %q; want FROM[=DIR[=QUOTA_MB]]", s)
+		}
+		if len(f) > 1 {
+			r.Dir = f[1]
+			if r.Dir != "" && !ipn.IsTaildropAcceptDir(r.Dir) {
+				return nil, fmt.Errorf("invalid --taildrop-accept %q: directory %q must be relative to tailscaled's --taildrop-accept-root, without \"..\"", s, r.Dir)
+			}
+		}
+		if len(f) > 2 {
+			mb, err := strconv.ParseInt(f[2], 10, 64)
+			if err != nil || mb <= 0 {
+				return nil, fmt.Errorf("invalid --taildrop-accept %q: quota %q is not a positive number of MB", s, f[2])
+			}
+			r.QuotaMB = mb
+		}
+		if seen[r.From] {
+			return nil, fmt.Errorf("--taildrop-accept lists sender %q more than once", r.From)
+		}
+		seen[r.From] = true
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// parseAdvertiseRoute parses s, an --advertise-routes entry. As well
+// as a CIDR prefix, it may be an IPv4 CIDR prefix and a 4via6 site ID
+// joined by '@', as in "10.0.0.0/24@7", meaning that prefix at that
+// site.
+func parseAdvertiseRoute(s string) (netip.Prefix, error) {
+	cidr, site, isVia := strings.Cut(s, "@")
+	ipp, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%q is not a valid IP address or CIDR prefix", s)
+	}
+	if !isVia {
+		return ipp, nil
+	}
+	if !ipp.Addr().Is4() {
+		return netip.Prefix{}, fmt.Errorf("%q: only IPv4 prefixes can be advertised at a 4via6 site", s)
+	}
+	if ipp != ipp.Masked() {
+		return netip.Prefix{}, fmt.Errorf("%s has non-address bits set; expected %s", ipp, ipp.Masked())
+	}
+	siteID, err := parseViaSiteID(site)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return tsaddr.MapVia(siteID, ipp)
+}
+
 func calcAdvertiseRoutes(advertiseRoutes string, advertiseDefaultRoute bool) ([]netip.Prefix, error) {
 	routeMap := map[netip.Prefix]bool{}
 	if advertiseRoutes != "" {
 		var default4, default6 bool
 		advroutes := strings.Split(advertiseRoutes, ",")
 		for _, s := range advroutes {
-			ipp, err := netip.ParsePrefix(s)
+			ipp, err := parseAdvertiseRoute(s)
 			if err != nil {
-				return nil, fmt.Errorf("%q is not a valid IP address or CIDR prefix", s)
+				return nil, err
 			}
 			if ipp != ipp.Masked() {
 				return nil, fmt.Errorf("%s has non-address bits set; expected %s", ipp, ipp.Masked())
@@ -284,8 +548,57 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 		return nil, err
 	}
 
-	if upArgs.exitNodeIP == "" && upArgs.exitNodeAllowLANAccess {
-		return nil, fmt.Errorf("--exit-node-allow-lan-access can only be used with --exit-node")
+	usesExitNode := upArgs.exitNodeIP != "" || upArgs.exitNodeRotation != ""
+	if !usesExitNode && upArgs.exitNodeAllowLANAccess {
+		return nil, fmt.Errorf("--exit-node-allow-lan-access can only be used with --exit-node or --exit-node-rotation")
+	}
+	if !usesExitNode && upArgs.exitNodeExcludeRoutes != "" {
+		return nil, fmt.Errorf("--exit-node-exclude-routes can only be used with --exit-node or --exit-node-rotation")
+	}
+	if upArgs.exitNodeIP != "" && upArgs.exitNodeRotation != "" {
+		return nil, fmt.Errorf("--exit-node and --exit-node-rotation can't be used together")
+	}
+	if upArgs.exitNodeRotation == "" && upArgs.exitNodeRotateEvery != 0 {
+		return nil, fmt.Errorf("--exit-node-rotate-every can only be used with --exit-node-rotation")
+	}
+	if r := upArgs.exitNodeRotateEvery; r < 0 || r != 0 && r < minExitNodeRotateEvery {
+		return nil, fmt.Errorf("--exit-node-rotate-every must be 0 or at least %v", minExitNodeRotateEvery)
+	}
+	exitRotation, err := parseExitNodeRotation(upArgs.exitNodeRotation)
+	if err != nil {
+		return nil, err
+	}
+	if upArgs.exitNodeClientApproval && !hasExitNodeRoutes(routes) {
+		return nil, fmt.Errorf("--exit-node-client-approval can only be used with --advertise-exit-node")
+	}
+	excludeRoutes, err := parseExitNodeExcludeRoutes(upArgs.exitNodeExcludeRoutes)
+	if err != nil {
+		return nil, err
+	}
+
+	if v := upArgs.controlProxy; v != "" && v != ipn.ControlProxyDirect {
+		if _, err := ipn.ParseControlProxy(v); err != nil {
+			return nil, fmt.Errorf("invalid --control-proxy: %v", err)
+		}
+	}
+
+	shields, err := ipn.ParseShields(upArgs.shields)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value --shields=%q; want off, lan, tailnet or all", upArgs.shields)
+	}
+	if shields != ipn.ShieldsLAN && upArgs.shieldsLAN != "" {
+		return nil, fmt.Errorf("--shields-lan can only be used with --shields=lan")
+	}
+	shieldsLAN, err := parseShieldsLANRoutes(upArgs.shieldsLAN)
+	if err != nil {
+		return nil, err
+	}
+	switch goos {
+	case "linux", "freebsd", "openbsd":
+	default:
+		if shields != ipn.ShieldsOff && shields != ipn.ShieldsAll {
+			warnf("--shields=%s only blocks traffic from outside Tailscale on Linux, FreeBSD and OpenBSD.", shields)
+		}
 	}
 
 	var tags []string
@@ -299,12 +612,73 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 		}
 	}
 
+	if upArgs.maxBandwidthKbps < 0 || upArgs.maxPeerBandwidthKbps < 0 {
+		return nil, errors.New("--max-bandwidth and --max-peer-bandwidth must not be negative")
+	}
+	if upArgs.flowSampleRate < 0 {
+		return nil, errors.New("--flow-sample-rate must not be negative")
+	}
+	if (upArgs.flowSampleRate > 0) != (upArgs.flowCollector != "") {
+		return nil, errors.New("--flow-sample-rate and --flow-collector must be used together")
+	}
+	if upArgs.flowCollector != "" {
+		if _, _, err := flowsample.ParseCollector(upArgs.flowCollector); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := dscp.ParsePolicy(upArgs.dscpPassthrough); err != nil {
+		return nil, fmt.Errorf("invalid --dscp-passthrough %q: %v", upArgs.dscpPassthrough, err)
+	}
+	if _, err := maintwindow.Parse(upArgs.maintenanceWindow); err != nil {
+		return nil, fmt.Errorf("invalid --maintenance-window %q: %v", upArgs.maintenanceWindow, err)
+	}
+
+	var alwaysOn []string
+	if upArgs.alwaysOnPeers != "" {
+		alwaysOn = strings.Split(upArgs.alwaysOnPeers, ",")
+		for _, p := range alwaysOn {
+			if p == "" {
+				return nil, fmt.Errorf("invalid --always-on-peers %q: empty peer", upArgs.alwaysOnPeers)
+			}
+		}
+	}
+
+	pinned, err := parsePinnedEndpoints(upArgs.pinEndpoints)
+	if err != nil {
+		return nil, err
+	}
+
+	taildropRules, err := parseTaildropRules(upArgs.taildropAccept)
+	if err != nil {
+		return nil, err
+	}
+
+	dialRules, err := parseSystemDialRules(upArgs.systemDialRules)
+	if err != nil {
+		return nil, err
+	}
+
+	if r := upArgs.discoKeyRotation; r != 0 && r < minDiscoKeyRotation {
+		return nil, fmt.Errorf("--disco-key-rotation must be 0 or at least %v", minDiscoKeyRotation)
+	}
+
+	var hooks []string
+	if upArgs.eventHooks != "" {
+		hooks = strings.Split(upArgs.eventHooks, ",")
+		for _, h := range hooks {
+			if _, err := eventhook.Parse(h); err != nil {
+				return nil, fmt.Errorf("invalid --event-hooks: %v", err)
+			}
+		}
+	}
+
 	if len(upArgs.hostname) > 256 {
 		return nil, fmt.Errorf("hostname too long: %d bytes (max 256)", len(upArgs.hostname))
 	}
 
 	prefs := ipn.NewPrefs()
 	prefs.ControlURL = upArgs.server
+	prefs.ControlProxy = upArgs.controlProxy
 	prefs.WantRunning = true
 	prefs.RouteAll = upArgs.acceptRoutes
 
@@ -319,15 +693,36 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 	}
 
 	prefs.ExitNodeAllowLANAccess = upArgs.exitNodeAllowLANAccess
+	prefs.ExitNodeClientApproval = upArgs.exitNodeClientApproval
+	prefs.ExitNodeExcludeRoutes = excludeRoutes
+	prefs.ExitNodeRotation = exitRotation
+	prefs.ExitNodeRotateEvery = upArgs.exitNodeRotateEvery
 	prefs.CorpDNS = upArgs.acceptDNS
+	prefs.SyncHostsFile = upArgs.syncHostsFile
 	prefs.AllowSingleHosts = upArgs.singleRoutes
 	prefs.ShieldsUp = upArgs.shieldsUp
+	prefs.Shields = shields
+	prefs.ShieldsLANRoutes = shieldsLAN
+	prefs.Stealth = upArgs.stealth
 	prefs.RunSSH = upArgs.runSSH
 	prefs.AdvertiseRoutes = routes
 	prefs.AdvertiseTags = tags
 	prefs.Hostname = upArgs.hostname
 	prefs.ForceDaemon = upArgs.forceDaemon
 	prefs.OperatorUser = upArgs.opUser
+	prefs.MaxBandwidthKbps = upArgs.maxBandwidthKbps
+	prefs.MaxPeerBandwidthKbps = upArgs.maxPeerBandwidthKbps
+	prefs.FlowSampleRate = upArgs.flowSampleRate
+	prefs.FlowCollector = upArgs.flowCollector
+	prefs.DSCPPassthrough = upArgs.dscpPassthrough
+	prefs.MaintenanceWindow = upArgs.maintenanceWindow
+	prefs.LazyPeers = upArgs.lazyPeers
+	prefs.AlwaysOnPeers = alwaysOn
+	prefs.PinnedEndpoints = pinned
+	prefs.TaildropRules = taildropRules
+	prefs.SystemDialRules = dialRules
+	prefs.DiscoKeyRotation = upArgs.discoKeyRotation
+	prefs.EventHooks = hooks
 
 	if goos == "linux" {
 		prefs.NoSNAT = !upArgs.snat
@@ -336,6 +731,9 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 		case "on":
 			prefs.NetfilterMode = preftype.NetfilterOn
 		case "nodivert":
+			if shields != ipn.ShieldsOff {
+				return nil, fmt.Errorf("--shields=%s can't be used with --netfilter-mode=nodivert", upArgs.shields)
+			}
 			prefs.NetfilterMode = preftype.NetfilterNoDivert
 			warnf("netfilter=nodivert; add iptables calls to ts-* chains manually.")
 		case "off":
@@ -472,12 +870,13 @@ func runUp(ctx context.Context, args []string) (retErr error) {
 	}
 
 	if upArgs.runSSH != curPrefs.RunSSH && isSSHOverTailscale() {
+		risk := `You are connected using Tailscale SSH; this action will result in your session disconnecting.`
 		if upArgs.runSSH {
-			err = presentRiskToUser(riskLoseSSH, `You are connected over Tailscale; this action will reroute SSH traffic to Tailscale SSH and will result in your session disconnecting.`)
-		} else {
-			err = presentRiskToUser(riskLoseSSH, `You are connected using Tailscale SSH; this action will result in your session disconnecting.`)
+			risk = `You are connected over Tailscale; this action will reroute SSH traffic to Tailscale SSH and will result in your session disconnecting.`
 		}
-		if err != nil {
+		if upArgs.dryRun {
+			warnf("%s", risk)
+		} else if err := presentRiskToUser(riskLoseSSH, risk); err != nil {
 			return err
 		}
 	}
@@ -492,6 +891,9 @@ func runUp(ctx context.Context, args []string) (retErr error) {
 	if err != nil {
 		fatalf("%s", err)
 	}
+	if upArgs.dryRun {
+		return previewUp(ctx, curPrefs, prefs, simpleUp, justEditMP)
+	}
 	if justEditMP != nil {
 		_, err := localClient.EditPrefs(ctx, justEditMP)
 		return err
@@ -734,13 +1136,35 @@ func init() {
 	addPrefFlagMapping("host-routes", "AllowSingleHosts")
 	addPrefFlagMapping("hostname", "Hostname")
 	addPrefFlagMapping("login-server", "ControlURL")
+	addPrefFlagMapping("control-proxy", "ControlProxy")
 	addPrefFlagMapping("netfilter-mode", "NetfilterMode")
 	addPrefFlagMapping("shields-up", "ShieldsUp")
+	addPrefFlagMapping("shields", "Shields")
+	addPrefFlagMapping("shields-lan", "ShieldsLANRoutes")
+	addPrefFlagMapping("stealth", "Stealth")
 	addPrefFlagMapping("snat-subnet-routes", "NoSNAT")
 	addPrefFlagMapping("exit-node-allow-lan-access", "ExitNodeAllowLANAccess")
+	addPrefFlagMapping("exit-node-exclude-routes", "ExitNodeExcludeRoutes")
+	addPrefFlagMapping("exit-node-rotation", "ExitNodeRotation")
+	addPrefFlagMapping("exit-node-rotate-every", "ExitNodeRotateEvery")
 	addPrefFlagMapping("unattended", "ForceDaemon")
 	addPrefFlagMapping("operator", "OperatorUser")
 	addPrefFlagMapping("ssh", "RunSSH")
+	addPrefFlagMapping("max-bandwidth", "MaxBandwidthKbps")
+	addPrefFlagMapping("max-peer-bandwidth", "MaxPeerBandwidthKbps")
+	addPrefFlagMapping("pin-endpoint", "PinnedEndpoints")
+	addPrefFlagMapping("taildrop-accept", "TaildropRules")
+	addPrefFlagMapping("sync-hosts-file", "SyncHostsFile")
+	addPrefFlagMapping("flow-sample-rate", "FlowSampleRate")
+	addPrefFlagMapping("flow-collector", "FlowCollector")
+	addPrefFlagMapping("dscp-passthrough", "DSCPPassthrough")
+	addPrefFlagMapping("maintenance-window", "MaintenanceWindow")
+	addPrefFlagMapping("lazy-peers", "LazyPeers")
+	addPrefFlagMapping("always-on-peers", "AlwaysOnPeers")
+	addPrefFlagMapping("system-dial-rules", "SystemDialRules")
+	addPrefFlagMapping("exit-node-client-approval", "ExitNodeClientApproval")
+	addPrefFlagMapping("disco-key-rotation", "DiscoKeyRotation")
+	addPrefFlagMapping("event-hooks", "EventHooks")
 }
 
 func addPrefFlagMapping(flagName string, prefNames ...string) {
@@ -758,7 +1182,7 @@ func addPrefFlagMapping(flagName string, prefNames ...string) {
 // correspond to an ipn.Pref.
 func preflessFlag(flagName string) bool {
 	switch flagName {
-	case "auth-key", "force-reauth", "reset", "qr", "json", "timeout", "accept-risk":
+	case "auth-key", "force-reauth", "reset", "qr", "json", "timeout", "accept-risk", "dry-run":
 		return true
 	}
 	return false
@@ -942,6 +1366,8 @@ func prefsToFlags(env upCheckEnv, prefs *ipn.Prefs) (flagVal map[string]any) {
 			set(prefs.RunSSH)
 		case "login-server":
 			set(prefs.ControlURL)
+		case "control-proxy":
+			set(prefs.ControlProxy)
 		case "accept-routes":
 			set(prefs.RouteAll)
 		case "host-routes":
@@ -950,10 +1376,36 @@ func prefsToFlags(env upCheckEnv, prefs *ipn.Prefs) (flagVal map[string]any) {
 			set(prefs.CorpDNS)
 		case "shields-up":
 			set(prefs.ShieldsUp)
+		case "shields":
+			if prefs.Shields == ipn.ShieldsOff {
+				set("off")
+			} else {
+				set(prefs.Shields)
+			}
+		case "shields-lan":
+			var sb strings.Builder
+			for i, r := range prefs.ShieldsLANRoutes {
+				if i > 0 {
+					sb.WriteByte(',')
+				}
+				sb.WriteString(r.String())
+			}
+			set(sb.String())
+		case "stealth":
+			set(prefs.Stealth)
 		case "exit-node":
 			set(exitNodeIPStr())
 		case "exit-node-allow-lan-access":
 			set(prefs.ExitNodeAllowLANAccess)
+		case "exit-node-exclude-routes":
+			var sb strings.Builder
+			for i, r := range prefs.ExitNodeExcludeRoutes {
+				if i > 0 {
+					sb.WriteByte(',')
+				}
+				sb.WriteString(r.String())
+			}
+			set(sb.String())
 		case "advertise-tags":
 			set(strings.Join(prefs.AdvertiseTags, ","))
 		case "hostname":
@@ -971,12 +1423,67 @@ func prefsToFlags(env upCheckEnv, prefs *ipn.Prefs) (flagVal map[string]any) {
 			set(sb.String())
 		case "advertise-exit-node":
 			set(hasExitNodeRoutes(prefs.AdvertiseRoutes))
+		case "exit-node-client-approval":
+			set(prefs.ExitNodeClientApproval)
 		case "snat-subnet-routes":
 			set(!prefs.NoSNAT)
 		case "netfilter-mode":
 			set(prefs.NetfilterMode.String())
 		case "unattended":
 			set(prefs.ForceDaemon)
+		case "sync-hosts-file":
+			set(prefs.SyncHostsFile)
+		case "max-bandwidth":
+			set(prefs.MaxBandwidthKbps)
+		case "max-peer-bandwidth":
+			set(prefs.MaxPeerBandwidthKbps)
+		case "flow-sample-rate":
+			set(prefs.FlowSampleRate)
+		case "flow-collector":
+			set(prefs.FlowCollector)
+		case "dscp-passthrough":
+			set(prefs.DSCPPassthrough)
+		case "maintenance-window":
+			set(prefs.MaintenanceWindow)
+		case "lazy-peers":
+			set(prefs.LazyPeers)
+		case "always-on-peers":
+			set(strings.Join(prefs.AlwaysOnPeers, ","))
+		case "system-dial-rules":
+			var sb strings.Builder
+			for i, r := range prefs.SystemDialRules {
+				if i > 0 {
+					sb.WriteByte(',')
+				}
+				sb.WriteString(r.String())
+			}
+			set(sb.String())
+		case "disco-key-rotation":
+			set(prefs.DiscoKeyRotation)
+		case "exit-node-rotation":
+			set(strings.Join(prefs.ExitNodeRotation, ","))
+		case "exit-node-rotate-every":
+			set(prefs.ExitNodeRotateEvery)
+		case "event-hooks":
+			set(strings.Join(prefs.EventHooks, ","))
+		case "pin-endpoint":
+			var sb strings.Builder
+			for i, pe := range prefs.PinnedEndpoints {
+				if i > 0 {
+					sb.WriteByte(',')
+				}
+				sb.WriteString(pe.String())
+			}
+			set(sb.String())
+		case "taildrop-accept":
+			var sb strings.Builder
+			for i, r := range prefs.TaildropRules {
+				if i > 0 {
+					sb.WriteByte(',')
+				}
+				sb.WriteString(r.String())
+			}
+			set(sb.String())
 		}
 	})
 	return ret
@@ -1045,3 +1552,135 @@ func exitNodeIP(p *ipn.Prefs, st *ipnstate.Status) (ip netip.Addr) {
 	}
 	return
 }
+
+// prefChange is a change to one ipn.Prefs field, as reported by
+// "tailscale up --dry-run".
+type prefChange struct {
+	Pref     string // ipn.Prefs field name
+	Old, New string // formatted values
+}
+
+// upDryRunJSON is the output of "tailscale up --dry-run --json".
+type upDryRunJSON struct {
+	Version int          // apitype.CLIOutputVersion
+	Changes []prefChange `json:",omitempty"`
+	Restart bool         `json:",omitempty"` // whether tailscaled would restart its login with these prefs
+	Prefs   *ipn.Prefs   // the resulting prefs
+}
+
+// previewUp prints the changes that runUp would make to curPrefs,
+// after checking them with tailscaled, without making them.
+func previewUp(ctx context.Context, curPrefs, prefs *ipn.Prefs, simpleUp bool, justEditMP *ipn.MaskedPrefs) error {
+	mp := justEditMP
+	restart := false
+	switch {
+	case mp != nil:
+	case simpleUp:
+		mp = &ipn.MaskedPrefs{Prefs: ipn.Prefs{WantRunning: true}, WantRunningSet: true}
+	default:
+		// runUp would restart tailscaled's login with prefs replacing
+		// all the current ones.
+		restart = true
+		mp = &ipn.MaskedPrefs{Prefs: *prefs}
+		mv := reflect.ValueOf(mp).Elem()
+		for i := 1; i < mv.NumField(); i++ {
+			mv.Field(i).SetBool(true)
+		}
+	}
+	newPrefs, err := localClient.PreviewEditPrefs(ctx, mp)
+	if err != nil {
+		return err
+	}
+	changes := prefsDiff(curPrefs, newPrefs)
+
+	if upArgs.json {
+		j, err := json.MarshalIndent(upDryRunJSON{Version: apitype.CLIOutputVersion, Changes: changes, Restart: restart, Prefs: newPrefs}, "", "  ")
+		if err != nil {
+			return err
+		}
+		outln(string(j))
+		return nil
+	}
+	if len(changes) == 0 {
+		outln("No settings would change.")
+	} else {
+		outln("Settings that would change:")
+		for _, c := range changes {
+			printf("\t%s: %s => %s\n", c.Pref, c.Old, c.New)
+		}
+	}
+	if added, removed := routesDiff(curPrefs.AdvertiseRoutes, newPrefs.AdvertiseRoutes); len(added)+len(removed) > 0 {
+		outln("Advertised routes that would change:")
+		for _, r := range added {
+			printf("\t+ %v\n", r)
+		}
+		for _, r := range removed {
+			printf("\t- %v\n", r)
+		}
+	}
+	if restart {
+		outln("tailscaled would restart its login with these settings, which might require logging in again.")
+	}
+	outln("Dry run; nothing was changed.")
+	return nil
+}
+
+// prefsDiff returns the user-visible differences between the prefs a
+// and b, in ipn.Prefs field order.
+func prefsDiff(a, b *ipn.Prefs) []prefChange {
+	var changes []prefChange
+	av, bv := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	t := av.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Name
+		if name == "Persist" {
+			// Not a pref; it's never changed by "tailscale up".
+			continue
+		}
+		af, bf := av.Field(i).Interface(), bv.Field(i).Interface()
+		if fmtPrefValue(af) == fmtPrefValue(bf) {
+			continue
+		}
+		changes = append(changes, prefChange{Pref: name, Old: fmtPrefValue(af), New: fmtPrefValue(bf)})
+	}
+	return changes
+}
+
+func fmtPrefValue(v any) string {
+	switch v := v.(type) {
+	case string:
+		return fmt.Sprintf("%q", v)
+	case netip.Addr:
+		if !v.IsValid() {
+			return `""`
+		}
+	case []string:
+		return fmt.Sprintf("%q", v)
+	case []netip.Prefix:
+		if len(v) == 0 {
+			return "[]"
+		}
+	}
+	return fmt.Sprint(v)
+}
+
+// routesDiff returns the routes in b but not a, and in a but not b.
+func routesDiff(a, b []netip.Prefix) (added, removed []netip.Prefix) {
+	inA := map[netip.Prefix]bool{}
+	for _, r := range a {
+		inA[r] = true
+	}
+	inB := map[netip.Prefix]bool{}
+	for _, r := range b {
+		inB[r] = true
+		if !inA[r] {
+			added = append(added, r)
+		}
+	}
+	for _, r := range a {
+		if !inB[r] {
+			removed = append(removed, r)
+		}
+	}
+	return added, removed
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/net/tsaddr"
+)
+
+var viaCmd = &ffcli.Command{
+	Name:       "via",
+	ShortUsage: "via <site-id> <v4-cidr>\n  via <v6-route>",
+	ShortHelp:  "Convert between site-specific IPv4 CIDRs and IPv6 4via6 routes",
+	LongHelp: `Convert between site-specific IPv4 CIDRs and IPv6 4via6 routes.
+
+4via6 routes let subnet routers at different sites advertise the same
+(overlapping) IPv4 ranges. With a site ID, which is a number from 0 to
+255, and an IPv4 CIDR, "tailscale via" prints the 4via6 route that
+"tailscale up --advertise-routes" takes; that flag also takes the
+shorthand CIDR@SITE. Given a 4via6 route, it prints the site ID and IPv4
+CIDR it stands for.
+
+For single addresses, the MagicDNS name that resolves to the 4via6
+address is printed too. In names, the site ID may also be given as the
+name of the subnet router, as in "10.1.2.3.via-office-router".`,
+	Exec: func(ctx context.Context, args []string) error {
+		return via(args, true)
+	},
+}
+
+// parseViaSiteID parses s, a 4via6 site ID in decimal or in hex with
+// a 0x prefix.
+func parseViaSiteID(s string) (uint32, error) {
+	siteID, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid site-id %q; must be decimal or hex with 0x prefix", s)
+	}
+	if siteID > 0xff {
+		return 0, fmt.Errorf("site-id values over 255 are currently reserved")
+	}
+	return uint32(siteID), nil
+}
+
+// viaDNSName returns the MagicDNS name that resolves to the 4via6
+// address for ip4 at siteID.
+func viaDNSName(siteID uint32, ip4 netip.Addr) string {
+	return fmt.Sprintf("%v.via-%d", ip4, siteID)
+}
+
+// runVia is "tailscale debug via", which predates "tailscale via" and
+// whose output scripts may depend on.
+func runVia(ctx context.Context, args []string) error {
+	return via(args, false)
+}
+
+// via converts between 4via6 routes and the site IDs and IPv4 CIDRs
+// they stand for. If withNames, it also prints the MagicDNS names of
+// single addresses.
+func via(args []string, withNames bool) error {
+	switch len(args) {
+	default:
+		return errors.New("expect either <site-id> <v4-cidr> or <v6-route>")
+	case 1:
+		ipp, err := netip.ParsePrefix(args[0])
+		if err != nil {
+			return err
+		}
+		if !ipp.Addr().Is6() {
+			return errors.New("with one argument, expect an IPv6 CIDR")
+		}
+		if !tsaddr.TailscaleViaRange().Contains(ipp.Addr()) {
+			return errors.New("not a via route")
+		}
+		if ipp.Bits() < 96 {
+			return errors.New("short length, want /96 or more")
+		}
+		v4 := tsaddr.UnmapVia(ipp.Addr())
+		a := ipp.Addr().As16()
+		siteID := binary.BigEndian.Uint32(a[8:12])
+		printf("site %v (0x%x), %v\n", siteID, siteID, netip.PrefixFrom(v4, ipp.Bits()-96))
+		if withNames && ipp.IsSingleIP() {
+			printf("MagicDNS name: %s\n", viaDNSName(siteID, v4))
+		}
+	case 2:
+		siteID, err := parseViaSiteID(args[0])
+		if err != nil {
+			return err
+		}
+		ipp, err := netip.ParsePrefix(args[1])
+		if err != nil {
+			return err
+		}
+		via, err := tsaddr.MapVia(siteID, ipp)
+		if err != nil {
+			return err
+		}
+		outln(via)
+		if withNames && ipp.IsSingleIP() {
+			printf("MagicDNS name: %s\n", viaDNSName(siteID, ipp.Addr()))
+		}
+	}
+	return nil
+}
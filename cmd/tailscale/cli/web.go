@@ -59,6 +59,9 @@ type tmplData struct {
 	IP                string
 	AdvertiseExitNode bool
 	AdvertiseRoutes   string
+	Brand             webBranding
+	Lang              string            // language tag of msgs
+	msgs              map[string]string // translated messages; see T
 }
 
 var webCmd = &ffcli.Command{
@@ -78,16 +81,22 @@ type tmplData struct {
 		webf := newFlagSet("web")
 		webf.StringVar(&webArgs.listen, "listen", "localhost:8088", "listen address; use port 0 for automatic")
 		webf.BoolVar(&webArgs.cgi, "cgi", false, "run as CGI script")
+		webf.StringVar(&webArgs.customDir, "custom-dir", "", "directory with a branding.json file and locales/LANG.json translations, for devices that ship the web UI with their own branding or languages")
 		return webf
 	})(),
 	Exec: runWeb,
 }
 
 var webArgs struct {
-	listen string
-	cgi    bool
+	listen    string
+	cgi       bool
+	customDir string
 }
 
+// webCustomization is the web UI's customization from --custom-dir, or
+// nil if there's none.
+var webCustomization *webCustom
+
 func tlsConfigFromEnvironment() *tls.Config {
 	crt := os.Getenv("TLS_CRT_PEM")
 	key := os.Getenv("TLS_KEY_PEM")
@@ -115,6 +124,13 @@ func runWeb(ctx context.Context, args []string) error {
 	if len(args) > 0 {
 		return fmt.Errorf("too many non-flag arguments: %q", args)
 	}
+	if webArgs.customDir != "" {
+		c, err := loadWebCustom(webArgs.customDir)
+		if err != nil {
+			return err
+		}
+		webCustomization = c
+	}
 
 	if webArgs.cgi {
 		if err := cgi.Serve(http.HandlerFunc(webHandler)); err != nil {
@@ -393,6 +409,13 @@ func webHandler(w http.ResponseWriter, r *http.Request) {
 		Status:       st.BackendState,
 		DeviceName:   deviceName,
 	}
+	data.msgs, data.Lang = webCustomization.messages(r.Header.Get("Accept-Language"))
+	if webCustomization != nil {
+		data.Brand = webCustomization.Branding
+	}
+	if data.Brand.Name == "" {
+		data.Brand.Name = "Tailscale"
+	}
 	exitNodeRouteV4 := netip.MustParsePrefix("0.0.0.0/0")
 	exitNodeRouteV6 := netip.MustParsePrefix("::/0")
 	for _, r := range prefs.AdvertiseRoutes {
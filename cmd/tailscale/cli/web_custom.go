@@ -0,0 +1,168 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// webMessages are the web UI's messages in English, by message ID.
+// Translations come from the --custom-dir directory; see
+// loadWebCustom.
+var webMessages = map[string]string{
+	"switch-account":     "Switch account",
+	"key-expired":        "Your device's key has expired. Reauthenticate this device by logging in again, or",
+	"learn-more":         "learn more",
+	"reauthenticate":     "Reauthenticate",
+	"log-in-title":       "Log in",
+	"log-in-text":        "Get started by logging in to your Tailscale network. Or, learn more at",
+	"log-in":             "Log In",
+	"needs-machine-auth": "This device is authorized, but needs approval from a network admin before it can connect to the network.",
+	"connected":          "You are connected! Access this device over Tailscale using the device name or IP address above.",
+	"exit-node-stop":     "Stop advertising Exit Node",
+	"exit-node-start":    "Advertise as Exit Node",
+	"log-in-failed":      "Failed to log in",
+}
+
+// webCustom is how a device vendor shipping "tailscale web" customizes
+// it, without having to patch it: their branding, and translations of
+// webMessages.
+type webCustom struct {
+	Branding webBranding
+
+	// locales are the translations of webMessages, by lower-case
+	// language tag, such as "de" or "pt-br". Messages missing from
+	// a translation are shown in English.
+	locales map[string]map[string]string
+}
+
+// webBranding is the branding.json file of the --custom-dir directory.
+type webBranding struct {
+	// Name is the product name to title the page with, in place of
+	// "Tailscale".
+	Name string
+
+	// LogoURL, if non-empty, is the URL of an image, often a data:
+	// URL, to show in place of the Tailscale logo.
+	LogoURL string
+
+	// AccentColor, if non-empty, is the CSS color of buttons and
+	// links, as a name or #RGB hex color.
+	AccentColor string
+
+	// Links are links to add to the bottom of the page, such as to
+	// the vendor's support pages.
+	Links []webLink
+}
+
+// webLink is a link in webBranding.
+type webLink struct {
+	Text string
+	URL  string
+}
+
+var cssColorRx = regexp.MustCompile(`^(#[0-9a-fA-F]{3,8}|[a-zA-Z]+)$`)
+
+// loadWebCustom loads the customizations in dir, as given by
+// "tailscale web --custom-dir". The directory may contain:
+//
+//   - branding.json, a webBranding
+//   - locales/LANG.json, for each language LANG (such as "de" or
+//     "pt-BR"), a JSON object of translations of webMessages by
+//     message ID
+func loadWebCustom(dir string) (*webCustom, error) {
+	c := &webCustom{locales: map[string]map[string]string{}}
+	b, err := os.ReadFile(filepath.Join(dir, "branding.json"))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(b, &c.Branding); err != nil {
+			return nil, fmt.Errorf("branding.json: %w", err)
+		}
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+	if col := c.Branding.AccentColor; col != "" && !cssColorRx.MatchString(col) {
+		return nil, fmt.Errorf("branding.json: invalid AccentColor %q", col)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "locales", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var msgs map[string]string
+		if err := json.Unmarshal(b, &msgs); err != nil {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+		for id := range msgs {
+			if _, ok := webMessages[id]; !ok {
+				return nil, fmt.Errorf("%s: unknown message ID %q", f, id)
+			}
+		}
+		lang := strings.ToLower(strings.TrimSuffix(filepath.Base(f), ".json"))
+		c.locales[lang] = msgs
+	}
+	return c, nil
+}
+
+// messages returns the translations of webMessages to use for a
+// request with the given Accept-Language header, and their language
+// tag. It returns nil and "en" if there are none, for English.
+func (c *webCustom) messages(acceptLanguage string) (msgs map[string]string, lang string) {
+	if c == nil {
+		return nil, "en"
+	}
+	// Browsers list languages in order of preference, so the q
+	// weights can be ignored.
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, _, _ := strings.Cut(part, ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		for {
+			if msgs, ok := c.locales[tag]; ok {
+				return msgs, tag
+			}
+			if tag == "en" {
+				return nil, "en"
+			}
+			i := strings.LastIndexByte(tag, '-')
+			if i < 0 {
+				break
+			}
+			tag = tag[:i]
+		}
+	}
+	return nil, "en"
+}
+
+// T returns the message with the given ID, translated if possible.
+func (d tmplData) T(id string) string {
+	if m, ok := d.msgs[id]; ok {
+		return m
+	}
+	if m, ok := webMessages[id]; ok {
+		return m
+	}
+	return id
+}
+
+// LogoURL returns the branding's logo URL for use in the page. It's
+// trusted, coming from the machine's administrator, so data: URLs are
+// allowed.
+func (d tmplData) LogoURL() template.URL {
+	return template.URL(d.Brand.LogoURL)
+}
@@ -4,7 +4,13 @@
 
 package cli
 
-import "testing"
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
 
 func TestUrlOfListenAddr(t *testing.T) {
 	tests := []struct {
@@ -42,3 +48,66 @@ func TestUrlOfListenAddr(t *testing.T) {
 		})
 	}
 }
+
+func TestWebCustom(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, contents string) {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("branding.json", `{"Name": "AcmeNAS", "LogoURL": "data:image/png;base64,AAAA", "AccentColor": "#0a7d3e",
+		"Links": [{"Text": "Support", "URL": "https://acme.example/support"}]}`)
+	write("locales/de.json", `{"log-in-title": "Anmelden", "log-in": "Anmelden"}`)
+	write("locales/pt-BR.json", `{"log-in": "Entrar"}`)
+	c, err := loadWebCustom(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	langs := []struct {
+		accept, want string
+	}{
+		{"", "en"},
+		{"de-AT,de;q=0.9", "de"},
+		{"fr-FR,pt-BR;q=0.8", "pt-br"},
+		{"en-GB,de;q=0.5", "en"},
+		{"fr", "en"},
+	}
+	for _, tt := range langs {
+		if _, got := c.messages(tt.accept); got != tt.want {
+			t.Errorf("messages(%q) language = %q; want %q", tt.accept, got, tt.want)
+		}
+	}
+
+	data := tmplData{Status: "NeedsLogin", Brand: c.Branding}
+	data.msgs, data.Lang = c.messages("de")
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		t.Fatal(err)
+	}
+	page := buf.String()
+	for _, want := range []string{
+		`<html class="bg-gray-50" lang="de">`,
+		"<title>AcmeNAS</title>",
+		`<img src="data:image/png;base64,AAAA" alt="AcmeNAS"`,
+		"background-color: #0a7d3e;",
+		`<h3 class="text-3xl font-semibold mb-3">Anmelden</h3>`,
+		webMessages["log-in-text"], // not translated
+		`<a href="https://acme.example/support" class="link mr-4" target="_blank">Support</a>`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page doesn't contain %q", want)
+		}
+	}
+
+	write("locales/fr.json", `{"bogus": "x"}`)
+	if _, err := loadWebCustom(dir); err == nil || !strings.Contains(err.Error(), "unknown message ID") {
+		t.Errorf("with unknown message ID, err = %v", err)
+	}
+}
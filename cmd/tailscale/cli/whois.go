@@ -0,0 +1,98 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/netip"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+var whoisCmd = &ffcli.Command{
+	Name:       "whois",
+	ShortUsage: "whois [--at=TIME] [--json] <tailscale-ip>",
+	ShortHelp:  "Show which machines a Tailscale IP belongs or belonged to",
+	LongHelp: strings.TrimSpace(`
+"tailscale whois" shows which machines a Tailscale IP address has
+belonged to, as recorded by this machine's tailscaled from its view of
+the tailnet, so that addresses in old logs can be attributed to the
+right machine even after they've been reassigned.
+
+With --at, it shows only the machine the address belonged to at that
+time, given in RFC 3339 format such as "2022-08-09T15:04:05Z".
+`),
+	Exec: runWhoIs,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("whois")
+		fs.StringVar(&whoisArgs.at, "at", "", "time to look up the IP's machine at, in RFC 3339 format")
+		fs.BoolVar(&whoisArgs.json, "json", false, "output in JSON format")
+		return fs
+	})(),
+}
+
+var whoisArgs struct {
+	at   string
+	json bool
+}
+
+func runWhoIs(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tailscale whois [--at=TIME] <tailscale-ip>")
+	}
+	ip, err := netip.ParseAddr(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid IP address %q", args[0])
+	}
+	var at time.Time
+	if whoisArgs.at != "" {
+		at, err = time.Parse(time.RFC3339, whoisArgs.at)
+		if err != nil {
+			return fmt.Errorf("invalid --at time %q; want RFC 3339 format, such as %q", whoisArgs.at, "2022-08-09T15:04:05Z")
+		}
+	}
+	assigns, err := localClient.WhoIsHistory(ctx, ip, at)
+	if err != nil {
+		return err
+	}
+	if whoisArgs.json {
+		return printJSON(apitype.WhoIsOutput{Version: apitype.CLIOutputVersion, Assignments: assigns})
+	}
+	if len(assigns) == 0 {
+		if !at.IsZero() {
+			return fmt.Errorf("no record of %v belonging to a machine at %v", ip, at.Format(time.RFC3339))
+		}
+		return fmt.Errorf("no record of %v belonging to a machine", ip)
+	}
+	outln(formatWhoIs(assigns))
+	return nil
+}
+
+// formatWhoIs formats assigns for "tailscale whois", one per line.
+func formatWhoIs(assigns []apitype.IPAssignment) string {
+	var sb strings.Builder
+	tw := tabwriter.NewWriter(&sb, 0, 2, 2, ' ', 0)
+	fmt.Fprintf(tw, "FROM\tUNTIL\tMACHINE\tUSER\tID\n")
+	for _, a := range assigns {
+		until := "now"
+		if !a.Until.IsZero() {
+			until = a.Until.Format(time.RFC3339)
+		}
+		user := a.User
+		if user == "" {
+			user = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", a.From.Format(time.RFC3339), until, a.Node, user, a.NodeID)
+	}
+	tw.Flush()
+	return strings.TrimSuffix(sb.String(), "\n")
+}
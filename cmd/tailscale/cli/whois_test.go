@@ -0,0 +1,28 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+func TestFormatWhoIs(t *testing.T) {
+	ip := netip.MustParseAddr("100.64.0.1")
+	t0 := time.Date(2022, 8, 9, 15, 0, 0, 0, time.UTC)
+	got := formatWhoIs([]apitype.IPAssignment{
+		{Addr: ip, Node: "laptop.example.ts.net", NodeID: "n1", User: "alice@example.com", From: t0, Until: t0.Add(48 * time.Hour)},
+		{Addr: ip, Node: "tagged.example.ts.net", NodeID: "n2", From: t0.Add(48 * time.Hour)},
+	})
+	want := `FROM                  UNTIL                 MACHINE                USER               ID
+2022-08-09T15:00:00Z  2022-08-11T15:00:00Z  laptop.example.ts.net  alice@example.com  n1
+2022-08-11T15:00:00Z  now                   tagged.example.ts.net  -                  n2`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+)
+
+var wolCmd = &ffcli.Command{
+	Name:       "wol",
+	ShortUsage: "wol <hostname-or-IP> --mac=<MAC> [--via=<relay>]",
+	ShortHelp:  "Wake a sleeping machine with a Wake-on-LAN packet",
+	LongHelp: strings.TrimSpace(`
+
+The 'tailscale wol' command wakes a machine that's asleep, and so
+offline from the tailnet, by asking a peer on its LAN, the relay, to
+broadcast a Wake-on-LAN magic packet for its MAC address there.
+
+By default the relay is an online peer last seen on the same LAN as
+the sleeping machine, such as an always-on home server. Use --via to
+pick it instead. The relay must be owned by the same user as this
+machine or grant it the Wake-on-LAN capability in the tailnet policy.
+
+`),
+	Exec:    runWOL,
+	FlagSet: wolFlagSet,
+}
+
+var wolFlagSet = (func() *flag.FlagSet {
+	fs := newFlagSet("wol")
+	fs.StringVar(&wolArgs.mac, "mac", "", "MAC address of the machine to wake, such as 01:23:45:67:89:ab")
+	fs.StringVar(&wolArgs.via, "via", "", "hostname or IP of the peer to send the packet; if empty, one on the same LAN is picked")
+	return fs
+})()
+
+var wolArgs struct {
+	mac string
+	via string
+}
+
+func runWOL(ctx context.Context, args []string) error {
+	// ffcli stops parsing flags at the first argument, so parse any
+	// that follow the machine to wake, as in "tailscale wol <peer> --mac=...".
+	if len(args) > 1 {
+		if err := wolFlagSet.Parse(args[1:]); err != nil {
+			return err
+		}
+		args = append(args[:1], wolFlagSet.Args()...)
+	}
+	if len(args) != 1 {
+		return errors.New("usage: wol <hostname-or-IP> --mac=<MAC> [--via=<relay>]")
+	}
+	if wolArgs.mac == "" {
+		return errors.New("missing --mac")
+	}
+	mac, err := net.ParseMAC(wolArgs.mac)
+	if err != nil {
+		return fmt.Errorf("invalid --mac: %w", err)
+	}
+	st, err := localClient.Status(ctx)
+	if err != nil {
+		return fixTailscaledConnectError(err)
+	}
+	if description, ok := isRunningOrStarting(st); !ok {
+		return errors.New(description)
+	}
+	ip, self, err := wolPeerIP(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if self {
+		return errors.New("this machine is already awake")
+	}
+	var via netip.Addr
+	if wolArgs.via != "" {
+		via, self, err = wolPeerIP(ctx, wolArgs.via)
+		if err != nil {
+			return err
+		}
+		if self {
+			return errors.New("--via must be another machine, on the same LAN as the one to wake")
+		}
+	}
+	res, err := localClient.WakeOnLAN(ctx, ip, mac.String(), via)
+	if err != nil {
+		return err
+	}
+	for _, e := range res.Errors {
+		fmt.Fprintln(Stderr, "error:", e)
+	}
+	printf("%s sent a Wake-on-LAN packet for %s (%v) on %s\n", res.Via, args[0], mac, strings.Join(res.SentTo, ", "))
+	return nil
+}
+
+// wolPeerIP returns the Tailscale IP of the machine hostOrIP, and
+// whether it's this one.
+func wolPeerIP(ctx context.Context, hostOrIP string) (ip netip.Addr, self bool, err error) {
+	ipStr, self, err := tailscaleIPFromArg(ctx, hostOrIP)
+	if err != nil {
+		return netip.Addr{}, false, err
+	}
+	ip, err = netip.ParseAddr(ipStr)
+	return ip, self, err
+}
@@ -16,18 +16,55 @@
 	"net/http"
 	"net/http/httputil"
 	"strings"
+
+	"tailscale.com/net/proxyauth"
+	"tailscale.com/types/logger"
 )
 
+// proxyUserKey is the context key for the user an HTTP proxy request
+// was authenticated as.
+type proxyUserKey struct{}
+
 // httpProxyHandler returns an HTTP proxy http.Handler using the
-// provided backend dialer.
-func httpProxyHandler(dialer func(ctx context.Context, netw, addr string) (net.Conn, error)) http.Handler {
+// provided backend dialer. If auth is non-nil, clients must
+// authenticate with credentials from it, may only connect to the
+// destinations it allows them, and their requests are logged to logf.
+func httpProxyHandler(dialer func(ctx context.Context, netw, addr string) (net.Conn, error), auth *proxyauth.Credentials, logf logger.Logf) http.Handler {
+	dial := dialer
+	if auth != nil {
+		dial = func(ctx context.Context, netw, addr string) (net.Conn, error) {
+			user, _ := ctx.Value(proxyUserKey{}).(string)
+			return auth.Dialer(user, dialer)(ctx, netw, addr)
+		}
+	}
 	rp := &httputil.ReverseProxy{
 		Director: func(r *http.Request) {}, // no change
 		Transport: &http.Transport{
-			DialContext: dialer,
+			DialContext: dial,
+			// Connections are checked against the destinations
+			// the user may reach when dialed, so they can't be
+			// shared between users.
+			DisableKeepAlives: auth != nil,
 		},
 	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth != nil {
+			user, err := auth.CheckHTTP(r)
+			if err != nil {
+				logf("rejected request from %v: %v", r.RemoteAddr, err)
+				w.Header().Set("Proxy-Authenticate", `Basic realm="tailscale"`)
+				http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+				return
+			}
+			// Log only the destination host; the rest of the URL
+			// may hold secrets.
+			host := r.URL.Host
+			if r.Method == "CONNECT" {
+				host = r.RequestURI
+			}
+			logf("user %q from %v: %s %s", user, r.RemoteAddr, r.Method, host)
+			r = r.WithContext(context.WithValue(r.Context(), proxyUserKey{}, user))
+		}
 		if r.Method != "CONNECT" {
 			backURL := r.RequestURI
 			if strings.HasPrefix(backURL, "/") || backURL == "*" {
@@ -41,7 +78,7 @@ func httpProxyHandler(dialer func(ctx context.Context, netw, addr string) (net.C
 		// CONNECT support:
 
 		dst := r.RequestURI
-		c, err := dialer(r.Context(), "tcp", dst)
+		c, err := dial(r.Context(), "tcp", dst)
 		if err != nil {
 			w.Header().Set("Tailscale-Connect-Error", err.Error())
 			http.Error(w, err.Error(), 500)
@@ -0,0 +1,62 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// statePassphraseEnv is the environment variable that can hold the
+// passphrase to encrypt the state file under, in place of
+// --state-passphrase-file.
+const statePassphraseEnv = "TS_STATE_PASSPHRASE"
+
+// readStatePassphrase returns the passphrase to encrypt the state file
+// under, or nil if there's none. It comes from $TS_STATE_PASSPHRASE or
+// from the --state-passphrase-file file, or is prompted for on the
+// terminal if that's "-".
+func readStatePassphrase() ([]byte, error) {
+	var pass []byte
+	if v, ok := os.LookupEnv(statePassphraseEnv); ok {
+		// Don't pass it on to child processes.
+		os.Unsetenv(statePassphraseEnv)
+		if args.statePassphraseFile != "" {
+			return nil, fmt.Errorf("--state-passphrase-file and $%s can't both be set", statePassphraseEnv)
+		}
+		pass = []byte(v)
+	} else {
+		switch args.statePassphraseFile {
+		case "":
+			return nil, nil
+		case "-":
+			fd := int(os.Stdin.Fd())
+			if !term.IsTerminal(fd) {
+				return nil, errors.New("--state-passphrase-file=- requires a terminal to prompt on")
+			}
+			fmt.Fprint(os.Stderr, "State passphrase: ")
+			var err error
+			pass, err = term.ReadPassword(fd)
+			fmt.Fprintln(os.Stderr)
+			if err != nil {
+				return nil, fmt.Errorf("reading state passphrase: %w", err)
+			}
+		default:
+			b, err := os.ReadFile(args.statePassphraseFile)
+			if err != nil {
+				return nil, err
+			}
+			pass = bytes.TrimRight(b, "\r\n")
+		}
+	}
+	if len(pass) == 0 {
+		return nil, errors.New("state passphrase is empty")
+	}
+	return pass, nil
+}
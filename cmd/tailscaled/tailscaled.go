@@ -22,6 +22,7 @@
 	"net/http"
 	"net/http/pprof"
 	"net/netip"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -34,12 +35,15 @@
 	"tailscale.com/control/controlclient"
 	"tailscale.com/envknob"
 	"tailscale.com/ipn"
+	"tailscale.com/ipn/conffile"
+	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/ipn/ipnserver"
 	"tailscale.com/ipn/store"
 	"tailscale.com/logpolicy"
 	"tailscale.com/logtail"
 	"tailscale.com/net/dns"
 	"tailscale.com/net/netns"
+	"tailscale.com/net/proxyauth"
 	"tailscale.com/net/proxymux"
 	"tailscale.com/net/socks5"
 	"tailscale.com/net/tsdial"
@@ -103,18 +107,30 @@ func defaultTunName() string {
 	// or comma-separated list thereof.
 	tunname string
 
-	cleanup        bool
-	debug          string
-	port           uint16
-	statepath      string
-	statedir       string
-	socketpath     string
-	birdSocketPath string
-	verbose        int
-	socksAddr      string // listen address for SOCKS5 server
-	httpProxyAddr  string // listen address for HTTP proxy server
+	cleanup              bool
+	debug                string
+	port                 uint16
+	statepath            string
+	statedir             string
+	socketpath           string
+	birdSocketPath       string
+	verbose              int
+	lowMemory            bool   // see wgengine.Config.LowMemory
+	socksAddr            string // listen address for SOCKS5 server
+	httpProxyAddr        string // listen address for HTTP proxy server
+	proxyAuthFile        string // path of proxy credentials; see proxyauth.Parse
+	controlProxyAuthFile string // path of "USER:PASSWORD" for the ControlProxy pref's proxy
+	confFile             string // path of config file; see conffile.Parse
+
+	taildropAcceptRoot string // see LocalBackend.SetTaildropAcceptRoot
+
+	statePassphraseFile string // or "-" to prompt; see readStatePassphrase
 }
 
+// statePassphrase, if non-nil, is the passphrase the state file is
+// encrypted under.
+var statePassphrase []byte
+
 var (
 	installSystemDaemon   func([]string) error                      // non-nil on some platforms
 	uninstallSystemDaemon func([]string) error                      // non-nil on some platforms
@@ -137,12 +153,18 @@ func main() {
 	flag.StringVar(&args.debug, "debug", "", "listen address ([ip]:port) of optional debug server")
 	flag.StringVar(&args.socksAddr, "socks5-server", "", `optional [ip]:port to run a SOCK5 server (e.g. "localhost:1080")`)
 	flag.StringVar(&args.httpProxyAddr, "outbound-http-proxy-listen", "", `optional [ip]:port to run an outbound HTTP proxy (e.g. "localhost:8080")`)
+	flag.StringVar(&args.proxyAuthFile, "proxy-auth-file", "", `optional path of a file of credentials that clients of --socks5-server and --outbound-http-proxy-listen must use, one "USER:PASSWORD [from=PREFIX,...] [to=PREFIX,...]" per line`)
+	flag.StringVar(&args.controlProxyAuthFile, "control-proxy-auth-file", "", `optional path of a file holding the "USER:PASSWORD" to authenticate to the proxy set with "tailscale up --control-proxy" with`)
+	flag.StringVar(&args.taildropAcceptRoot, "taildrop-accept-root", "", `optional absolute path of the directory that the auto-accept directories of "tailscale up --taildrop-accept" rules are under; if empty, files are never auto-accepted`)
+	flag.StringVar(&args.confFile, "config", "", `optional path of a config file setting prefs and the auth key, in place of "tailscale up" flags; reloaded on SIGHUP`)
 	flag.StringVar(&args.tunname, "tun", defaultTunName(), `tunnel interface name; use "userspace-networking" (beta) to not use TUN`)
 	flag.Var(flagtype.PortValue(&args.port, 0), "port", "UDP port to listen on for WireGuard and peer-to-peer traffic; 0 means automatically select")
 	flag.StringVar(&args.statepath, "state", "", "absolute path of state file; use 'kube:<secret-name>' to use Kubernetes secrets or 'arn:aws:ssm:...' to store in AWS SSM; use 'mem:' to not store state and register as an emphemeral node. If empty and --statedir is provided, the default is <statedir>/tailscaled.state. Default: "+paths.DefaultTailscaledStateFile())
+	flag.StringVar(&args.statePassphraseFile, "state-passphrase-file", "", `optional path of a file holding a passphrase to encrypt the state file under, for machines without an OS keystore; use "-" to prompt for it, or set $TS_STATE_PASSPHRASE instead`)
 	flag.StringVar(&args.statedir, "statedir", "", "path to directory for storage of config state, TLS certs, temporary incoming Taildrop files, etc. If empty, it's derived from --state when possible.")
 	flag.StringVar(&args.socketpath, "socket", paths.DefaultTailscaledSocket(), "path of the service unix socket")
 	flag.StringVar(&args.birdSocketPath, "bird-socket", "", "path of the bird unix socket")
+	flag.BoolVar(&args.lowMemory, "low-memory", false, "use smaller queues and buffers and configure WireGuard peers lazily, trading throughput for a smaller memory footprint on memory-constrained devices")
 	flag.BoolVar(&printVersion, "version", false, "print version information and exit")
 
 	if len(os.Args) > 0 && filepath.Base(os.Args[0]) == "tailscale" && beCLI != nil {
@@ -193,12 +215,24 @@ func main() {
 		log.Fatalf("--bird-socket is not supported on %s", runtime.GOOS)
 	}
 
+	if args.taildropAcceptRoot != "" && !filepath.IsAbs(args.taildropAcceptRoot) {
+		log.Fatalf("--taildrop-accept-root must be an absolute path")
+	}
+
 	// Only apply a default statepath when neither have been provided, so that a
 	// user may specify only --statedir if they wish.
 	if args.statepath == "" && args.statedir == "" {
 		args.statepath = paths.DefaultTailscaledStateFile()
 	}
 
+	if !args.cleanup {
+		var err error
+		if statePassphrase, err = readStatePassphrase(); err != nil {
+			log.SetFlags(0)
+			log.Fatal(err)
+		}
+	}
+
 	if beWindowsSubprocess() {
 		return
 	}
@@ -290,6 +324,45 @@ func ipnServerOpts() (o ipnserver.Options) {
 	return o
 }
 
+// readControlProxyAuth reads the "USER:PASSWORD" of the control proxy
+// from the file at path.
+func readControlProxyAuth(path string) (*url.Userinfo, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	user, pass, ok := strings.Cut(strings.TrimSpace(string(b)), ":")
+	if !ok || user == "" {
+		return nil, fmt.Errorf("%s: want USER:PASSWORD", path)
+	}
+	return url.UserPassword(user, pass), nil
+}
+
+// reloadConfigOnSIGHUP reloads the config file into lb each time
+// tailscaled gets SIGHUP, until ctx is done. A config file that fails to
+// load is logged and otherwise ignored.
+func reloadConfigOnSIGHUP(ctx context.Context, logf logger.Logf, lb *ipnlocal.LocalBackend) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-hup:
+		case <-ctx.Done():
+			return
+		}
+		c, err := conffile.Load(args.confFile)
+		if err == nil {
+			err = lb.SetConfigFile(c)
+		}
+		if err != nil {
+			logf("config file not reloaded: %v", err)
+			continue
+		}
+		logf("reloaded config file %s", args.confFile)
+	}
+}
+
 func run() error {
 	var err error
 
@@ -345,6 +418,28 @@ func run() error {
 	}
 	pol.Logtail.SetLinkMonitor(linkMon)
 
+	var proxyAuth *proxyauth.Credentials
+	if args.proxyAuthFile != "" {
+		proxyAuth, err = proxyauth.Load(args.proxyAuthFile)
+		if err != nil {
+			return fmt.Errorf("proxy credentials: %w", err)
+		}
+	}
+	var controlProxyAuth *url.Userinfo
+	if args.controlProxyAuthFile != "" {
+		controlProxyAuth, err = readControlProxyAuth(args.controlProxyAuthFile)
+		if err != nil {
+			return fmt.Errorf("control proxy credentials: %w", err)
+		}
+	}
+	var conf *conffile.Config
+	if args.confFile != "" {
+		conf, err = conffile.Load(args.confFile)
+		if err != nil {
+			return fmt.Errorf("config file: %w", err)
+		}
+	}
+
 	socksListener, httpProxyListener := mustStartProxyListeners(args.socksAddr, args.httpProxyAddr)
 
 	dialer := new(tsdial.Dialer) // mutated below (before used)
@@ -383,7 +478,7 @@ func run() error {
 	}
 	if socksListener != nil || httpProxyListener != nil {
 		if httpProxyListener != nil {
-			hs := &http.Server{Handler: httpProxyHandler(dialer.UserDial)}
+			hs := &http.Server{Handler: httpProxyHandler(dialer.UserDial, proxyAuth, logger.WithPrefix(logf, "http-proxy: "))}
 			go func() {
 				log.Fatalf("HTTP proxy exited: %v", hs.Serve(httpProxyListener))
 			}()
@@ -393,6 +488,10 @@ func run() error {
 				Logf:   logger.WithPrefix(logf, "socks5: "),
 				Dialer: dialer.UserDial,
 			}
+			if proxyAuth != nil {
+				ss.Authenticate = proxyAuth.Check
+				ss.CheckDest = proxyAuth.CheckDest
+			}
 			go func() {
 				log.Fatalf("SOCKS5 server exited: %v", ss.Serve(socksListener))
 			}()
@@ -422,7 +521,7 @@ func run() error {
 
 	opts := ipnServerOpts()
 
-	store, err := store.New(logf, statePathOrDefault())
+	store, err := store.NewWithPassphrase(logf, statePathOrDefault(), statePassphrase)
 	if err != nil {
 		return fmt.Errorf("store.New: %w", err)
 	}
@@ -430,6 +529,15 @@ func run() error {
 	if err != nil {
 		return fmt.Errorf("ipnserver.New: %w", err)
 	}
+	srv.LocalBackend().SetLogLeveler(pol.Logtail)
+	srv.LocalBackend().SetTaildropAcceptRoot(args.taildropAcceptRoot)
+	srv.LocalBackend().SetControlProxyAuth(controlProxyAuth)
+	if conf != nil {
+		if err := srv.LocalBackend().SetConfigFile(conf); err != nil {
+			return err
+		}
+		go reloadConfigOnSIGHUP(ctx, logf, srv.LocalBackend())
+	}
 	ns.SetLocalBackend(srv.LocalBackend())
 	if err := ns.Start(); err != nil {
 		log.Fatalf("failed to start netstack: %v", err)
@@ -494,6 +602,7 @@ func tryEngine(logf logger.Logf, linkMon *monitor.Mon, dialer *tsdial.Dialer, na
 		ListenPort:  args.port,
 		LinkMonitor: linkMon,
 		Dialer:      dialer,
+		LowMemory:   args.lowMemory,
 	}
 
 	useNetstack = name == "userspace-networking"
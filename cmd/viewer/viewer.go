@@ -14,6 +14,7 @@
 	"html/template"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"tailscale.com/util/codegen"
@@ -323,40 +324,63 @@ func genView(buf *bytes.Buffer, it *codegen.ImportTracker, typ *types.Named, thi
 	buf.Write(codegen.AssertStructUnchanged(t, args.StructName, "View", it))
 }
 
-var (
-	flagTypes     = flag.String("type", "", "comma-separated list of types; required")
-	flagBuildTags = flag.String("tags", "", "compiler build tags to apply")
-	flagCloneFunc = flag.Bool("clonefunc", false, "add a top-level Clone func")
+// options are the command-line options of viewer.
+type options struct {
+	types     string // comma-separated
+	buildTags string
+	cloneFunc bool
 
-	flagCloneOnlyTypes = flag.String("clone-only-type", "", "comma-separated list of types (a subset of --type) that should only generate a go:generate clone line and not actual views")
-)
+	cloneOnlyTypes string // comma-separated subset of types
+}
+
+func (o *options) addFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.types, "type", "", "comma-separated list of types; required")
+	fs.StringVar(&o.buildTags, "tags", "", "compiler build tags to apply")
+	fs.BoolVar(&o.cloneFunc, "clonefunc", false, "add a top-level Clone func")
+
+	fs.StringVar(&o.cloneOnlyTypes, "clone-only-type", "", "comma-separated list of types (a subset of --type) that should only generate a go:generate clone line and not actual views")
+}
 
 func main() {
 	log.SetFlags(0)
 	log.SetPrefix("viewer: ")
+	var opts options
+	opts.addFlags(flag.CommandLine)
 	flag.Parse()
-	if len(*flagTypes) == 0 {
+	if len(opts.types) == 0 {
 		flag.Usage()
 		os.Exit(2)
 	}
-	typeNames := strings.Split(*flagTypes, ",")
+	if err := generate(".", opts, ""); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// generate writes the views of opts.types in the package pkgName to its
+// _view.go file in outDir, or in the current directory if outDir is empty.
+//
+// Views are also generated for the struct types that opts.types reference,
+// as their View methods are called by the generated code.
+func generate(pkgName string, opts options, outDir string) error {
+	typeNames := strings.Split(opts.types, ",")
 
 	var flagArgs []string
-	flagArgs = append(flagArgs, fmt.Sprintf("-clonefunc=%v", *flagCloneFunc))
-	if *flagTypes != "" {
-		flagArgs = append(flagArgs, "-type="+*flagTypes)
+	flagArgs = append(flagArgs, fmt.Sprintf("-clonefunc=%v", opts.cloneFunc))
+	if opts.types != "" {
+		flagArgs = append(flagArgs, "-type="+opts.types)
 	}
-	if *flagBuildTags != "" {
-		flagArgs = append(flagArgs, "-tags="+*flagBuildTags)
+	if opts.buildTags != "" {
+		flagArgs = append(flagArgs, "-tags="+opts.buildTags)
 	}
-	pkg, namedTypes, err := codegen.LoadTypes(*flagBuildTags, ".")
+	pkg, namedTypes, err := codegen.LoadTypes(opts.buildTags, pkgName)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	typeNames = append(typeNames, codegen.ReferencedTypes(pkg, namedTypes, typeNames, pkg.Name+"_clone.go")...)
 	it := codegen.NewImportTracker(pkg.Types)
 
 	cloneOnlyType := map[string]bool{}
-	for _, t := range strings.Split(*flagCloneOnlyTypes, ",") {
+	for _, t := range strings.Split(opts.cloneOnlyTypes, ",") {
 		cloneOnlyType[t] = true
 	}
 
@@ -369,7 +393,7 @@ func main() {
 		}
 		typ, ok := namedTypes[typeName]
 		if !ok {
-			log.Fatalf("could not find type %s", typeName)
+			return fmt.Errorf("could not find type %s", typeName)
 		}
 		var hasClone bool
 		for i, n := 0, typ.NumMethods(); i < n; i++ {
@@ -383,9 +407,9 @@ func main() {
 		}
 		genView(buf, it, typ, pkg.Types)
 	}
-	out := pkg.Name + "_view.go"
+	out := filepath.Join(outDir, pkg.Name+"_view.go")
 	if err := codegen.WritePackageFile("tailscale/cmd/viewer", pkg, out, it, buf); err != nil {
-		log.Fatal(err)
+		return err
 	}
 	if runCloner {
 		// When a new pacakge is added or when existing generated files have
@@ -396,4 +420,5 @@ func main() {
 		// generated.
 		log.Printf("%v requires regeneration. Please run go generate again", pkg.Name+"_clone.go")
 	}
+	return nil
 }
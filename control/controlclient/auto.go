@@ -563,6 +563,17 @@ func (c *Auto) SetNetInfo(ni *tailcfg.NetInfo) {
 	c.sendNewMapRequest()
 }
 
+// SetDiscoPublicKey sets the disco key sent to the control server,
+// such as after it's rotated.
+func (c *Auto) SetDiscoPublicKey(k key.DiscoPublic) {
+	if !c.direct.SetDiscoPublicKey(k) {
+		return
+	}
+
+	// Send new disco key to server
+	c.sendNewMapRequest()
+}
+
 func (c *Auto) sendStatus(who string, err error, url string, nm *netmap.NetworkMap) {
 	c.mu.Lock()
 	if c.closed {
@@ -724,6 +735,12 @@ func (c *Auto) SetDNS(ctx context.Context, req *tailcfg.SetDNSRequest) error {
 	return c.direct.SetDNS(ctx, req)
 }
 
+// ReportHealth sends the HealthReportRequest req to the control plane
+// server.
+func (c *Auto) ReportHealth(ctx context.Context, req *tailcfg.HealthReportRequest) error {
+	return c.direct.ReportHealth(ctx, req)
+}
+
 func (c *Auto) DoNoiseRequest(req *http.Request) (*http.Response, error) {
 	return c.direct.DoNoiseRequest(req)
 }
@@ -13,6 +13,7 @@
 	"context"
 
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
 )
 
 type LoginFlags int
@@ -65,6 +66,9 @@ type Client interface {
 	// in a separate http request. It has nothing to do with the rest of
 	// the state machine.
 	SetNetInfo(*tailcfg.NetInfo)
+	// SetDiscoPublicKey changes the disco key that will be sent in
+	// subsequent map requests, such as after it's rotated.
+	SetDiscoPublicKey(key.DiscoPublic)
 	// UpdateEndpoints changes the Endpoint structure that will be sent
 	// in subsequent node registration requests.
 	// TODO: a server-side change would let us simply upload this
@@ -16,6 +16,7 @@
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
@@ -67,7 +68,6 @@ type Direct struct {
 	keepAlive              bool
 	logf                   logger.Logf
 	linkMon                *monitor.Mon // or nil
-	discoPubKey            key.DiscoPublic
 	getMachinePrivKey      func() (key.MachinePrivate, error)
 	getNLPublicKey         func() (key.NLPublic, error) // or nil
 	debugFlags             []string
@@ -76,6 +76,10 @@ type Direct struct {
 	pinger                 Pinger
 	popBrowser             func(url string) // or nil
 	c2nHandler             http.Handler     // or nil
+	recorder               *recorder        // or nil; see Options.RecordPath
+
+	controlDial  dnscache.DialContextFunc              // or nil for dialer.SystemDial
+	controlProxy func(*http.Request) (*url.URL, error) // or nil for the environment's
 
 	mu             sync.Mutex        // mutex guards the following fields
 	serverKey      key.MachinePublic // original ("legacy") nacl crypto_box-based public key
@@ -90,6 +94,7 @@ type Direct struct {
 	expiry        *time.Time
 	hostinfo      *tailcfg.Hostinfo // always non-nil
 	netinfo       *tailcfg.NetInfo
+	discoPubKey   key.DiscoPublic
 	endpoints     []tailcfg.Endpoint
 	everEndpoints bool   // whether we've ever had non-empty endpoints
 	lastPingURL   string // last PingRequest.URL received, for dup suppression
@@ -113,6 +118,24 @@ type Options struct {
 	Dialer               *tsdial.Dialer   // non-nil
 	C2NHandler           http.Handler     // or nil
 
+	// ControlDial, if non-nil, makes the TCP connections to the
+	// control server, including those for the Noise (ts2021)
+	// protocol, in place of Dialer.SystemDial, such as over an
+	// existing tunnel.
+	ControlDial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// ControlProxy, if non-nil, returns the HTTP proxy, if any, to
+	// connect to the control server through, in place of the
+	// environment's proxy settings. The proxy URL may include a
+	// username and password.
+	ControlProxy func(*http.Request) (*url.URL, error)
+
+	// RecordPath, if non-empty, is a file to append a redacted
+	// recording of map polls to, for debugging netmap processing
+	// offline with ReplayRecording. If empty, $TS_DEBUG_RECORD_MAP
+	// is used.
+	RecordPath string
+
 	// GetNLPublicKey specifies an optional function to use
 	// Network Lock. If nil, it's not used.
 	GetNLPublicKey func() (key.NLPublic, error)
@@ -184,10 +207,17 @@ func NewDirect(opts Options) (*Direct, error) {
 		}
 		tr := http.DefaultTransport.(*http.Transport).Clone()
 		tr.Proxy = tshttpproxy.ProxyFromEnvironment
+		if opts.ControlProxy != nil {
+			tr.Proxy = opts.ControlProxy
+		}
 		tshttpproxy.SetTransportGetProxyConnectHeader(tr)
 		tr.TLSClientConfig = tlsdial.Config(serverURL.Hostname(), tr.TLSClientConfig)
-		tr.DialContext = dnscache.Dialer(opts.Dialer.SystemDial, dnsCache)
-		tr.DialTLSContext = dnscache.TLSDialer(opts.Dialer.SystemDial, dnsCache, tr.TLSClientConfig)
+		dial := opts.Dialer.SystemDial
+		if opts.ControlDial != nil {
+			dial = opts.ControlDial
+		}
+		tr.DialContext = dnscache.Dialer(dial, dnsCache)
+		tr.DialTLSContext = dnscache.TLSDialer(dial, dnsCache, tr.TLSClientConfig)
 		tr.ForceAttemptHTTP2 = true
 		// Disable implicit gzip compression; the various
 		// handlers (register, map, set-dns, etc) do their own
@@ -216,6 +246,17 @@ func NewDirect(opts Options) (*Direct, error) {
 		popBrowser:             opts.PopBrowserURL,
 		c2nHandler:             opts.C2NHandler,
 		dialer:                 opts.Dialer,
+		controlDial:            opts.ControlDial,
+		controlProxy:           opts.ControlProxy,
+	}
+	if opts.RecordPath == "" {
+		opts.RecordPath = envknob.String("TS_DEBUG_RECORD_MAP")
+	}
+	if opts.RecordPath != "" {
+		c.recorder, err = newRecorder(opts.RecordPath, opts.Logf)
+		if err != nil {
+			return nil, fmt.Errorf("recording map polls: %w", err)
+		}
 	}
 	if opts.Hostinfo == nil {
 		c.SetHostinfo(hostinfo.New())
@@ -232,6 +273,9 @@ func NewDirect(opts Options) (*Direct, error) {
 
 // Close closes the underlying Noise connection(s).
 func (c *Direct) Close() error {
+	if c.recorder != nil {
+		c.recorder.Close()
+	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.noiseClient != nil {
@@ -278,6 +322,19 @@ func (c *Direct) SetNetInfo(ni *tailcfg.NetInfo) bool {
 	return true
 }
 
+// SetDiscoPublicKey sets the disco key sent in subsequent map
+// requests, such as after it's rotated. It reports whether k changed.
+func (c *Direct) SetDiscoPublicKey(k key.DiscoPublic) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if k == c.discoPubKey {
+		return false
+	}
+	c.discoPubKey = k
+	c.logf("DiscoKey: %v", k.ShortString())
+	return true
+}
+
 func (c *Direct) GetPersist() persist.Persist {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -694,6 +751,7 @@ func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, readOnly bool
 		epTypes = append(epTypes, ep.Type)
 	}
 	everEndpoints := c.everEndpoints
+	discoPubKey := c.discoPubKey
 	c.mu.Unlock()
 
 	machinePrivKey, err := c.getMachinePrivKey()
@@ -725,7 +783,7 @@ func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, readOnly bool
 		Version:       tailcfg.CurrentCapabilityVersion,
 		KeepAlive:     c.keepAlive,
 		NodeKey:       persist.PrivateNodeKey.Public(),
-		DiscoKey:      c.discoPubKey,
+		DiscoKey:      discoPubKey,
 		Endpoints:     epStrs,
 		EndpointTypes: epTypes,
 		Stream:        allowStream,
@@ -764,6 +822,10 @@ func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, readOnly bool
 	if c.newDecompressor != nil {
 		request.Compress = "zstd"
 	}
+	var recordPoll int
+	if c.recorder != nil {
+		recordPoll = c.recorder.startPoll(request)
+	}
 
 	bodyData, err := encode(request, serverKey, serverNoiseKey, machinePrivKey)
 	if err != nil {
@@ -881,6 +943,9 @@ func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, readOnly bool
 			vlogf("netmap: decode error: %v")
 			return err
 		}
+		if c.recorder != nil {
+			c.recorder.recordResponse(recordPoll, &resp)
+		}
 
 		metricMapResponseMessages.Add(1)
 
@@ -1363,7 +1428,11 @@ func (c *Direct) getNoiseClient() (*noiseClient, error) {
 		if err != nil {
 			return nil, err
 		}
-		nc, err := newNoiseClient(k, serverNoiseKey, c.serverURL, c.dialer)
+		dial := c.controlDial
+		if dial == nil {
+			dial = c.dialer.SystemDial
+		}
+		nc, err := newNoiseClient(k, serverNoiseKey, c.serverURL, dial, c.controlProxy)
 		if err != nil {
 			return nil, err
 		}
@@ -1409,6 +1478,50 @@ func (c *Direct) setDNSNoise(ctx context.Context, req *tailcfg.SetDNSRequest) er
 	return nil
 }
 
+// ReportHealth sends the HealthReportRequest req to the control plane
+// server. It's only supported over Noise, so that the report is
+// authenticated as coming from this machine.
+func (c *Direct) ReportHealth(ctx context.Context, req *tailcfg.HealthReportRequest) (err error) {
+	metricReportHealth.Add(1)
+	defer func() {
+		if err != nil {
+			metricReportHealthError.Add(1)
+		}
+	}()
+	if !c.noiseConfigured() {
+		return errors.New("health reports require a Noise connection to control")
+	}
+	newReq := *req
+	newReq.Version = tailcfg.CurrentCapabilityVersion
+	np, err := c.getNoiseClient()
+	if err != nil {
+		return err
+	}
+	bodyData, err := json.Marshal(newReq)
+	if err != nil {
+		return err
+	}
+	hreq, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("https://%v/%v", np.host, "machine/health-report"), bytes.NewReader(bodyData))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	res, err := np.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("health-report response: %v, %.200s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	var hrRes tailcfg.HealthReportResponse
+	if err := json.NewDecoder(res.Body).Decode(&hrRes); err != nil {
+		return fmt.Errorf("health-report response: %w", err)
+	}
+	return nil
+}
+
 // noiseConfigured reports whether the client can communicate with Control
 // over Noise.
 func (c *Direct) noiseConfigured() bool {
@@ -1554,4 +1667,7 @@ func postPingResult(start time.Time, logf logger.Logf, c *http.Client, pr *tailc
 
 	metricSetDNS      = clientmetric.NewCounter("controlclient_setdns")
 	metricSetDNSError = clientmetric.NewCounter("controlclient_setdns_error")
+
+	metricReportHealth      = clientmetric.NewCounter("controlclient_health_report")
+	metricReportHealthError = clientmetric.NewCounter("controlclient_health_report_error")
 )
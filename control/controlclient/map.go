@@ -9,6 +9,7 @@
 	"log"
 	"net/netip"
 	"sort"
+	"time"
 
 	"tailscale.com/envknob"
 	"tailscale.com/tailcfg"
@@ -33,7 +34,8 @@ type mapSession struct {
 	logf                   logger.Logf
 	vlogf                  logger.Logf
 	machinePubKey          key.MachinePublic
-	keepSharerAndUserSplit bool // see Options.KeepSharerAndUserSplit
+	keepSharerAndUserSplit bool             // see Options.KeepSharerAndUserSplit
+	timeNow                func() time.Time // or nil for clockNow
 
 	// Fields storing state over the the coards of multiple MapResponses.
 	lastNode               *tailcfg.Node
@@ -46,6 +48,7 @@ type mapSession struct {
 	previousPeers          []*tailcfg.Node // for delta-purposes
 	lastDomain             string
 	lastHealth             []string
+	lastTKACheckpoint      *tailcfg.TKACheckpointPolicy
 	lastPopBrowserURL      string
 	stickyDebug            tailcfg.Debug // accumulated opt.Bool values
 
@@ -80,7 +83,11 @@ func (ms *mapSession) addUserProfile(userID tailcfg.UserID) {
 // or incremental MapResponse within the session, filling in omitted
 // information from prior MapResponse values.
 func (ms *mapSession) netmapForResponse(resp *tailcfg.MapResponse) *netmap.NetworkMap {
-	undeltaPeers(resp, ms.previousPeers)
+	now := clockNow
+	if ms.timeNow != nil {
+		now = ms.timeNow
+	}
+	undeltaPeers(resp, ms.previousPeers, now)
 
 	ms.previousPeers = cloneNodes(resp.Peers) // defensive/lazy clone, since this escapes to who knows where
 	for _, up := range resp.UserProfiles {
@@ -115,6 +122,9 @@ func (ms *mapSession) netmapForResponse(resp *tailcfg.MapResponse) *netmap.Netwo
 	if resp.Health != nil {
 		ms.lastHealth = resp.Health
 	}
+	if resp.TKA != nil {
+		ms.lastTKACheckpoint = resp.TKA.Checkpoint
+	}
 
 	debug := resp.Debug
 	if debug != nil {
@@ -152,6 +162,7 @@ func (ms *mapSession) netmapForResponse(resp *tailcfg.MapResponse) *netmap.Netwo
 		DERPMap:         ms.lastDERPMap,
 		Debug:           debug,
 		ControlHealth:   ms.lastHealth,
+		TKACheckpoint:   ms.lastTKACheckpoint,
 	}
 	ms.netMapBuilding = nm
 
@@ -200,10 +211,10 @@ func (ms *mapSession) netmapForResponse(resp *tailcfg.MapResponse) *netmap.Netwo
 // undeltaPeers updates mapRes.Peers to be complete based on the
 // provided previous peer list and the PeersRemoved and PeersChanged
 // fields in mapRes, as well as the PeerSeenChange and OnlineChange
-// maps.
+// maps. The now func is used for the LastSeen times of peers seen.
 //
 // It then also nils out the delta fields.
-func undeltaPeers(mapRes *tailcfg.MapResponse, prev []*tailcfg.Node) {
+func undeltaPeers(mapRes *tailcfg.MapResponse, prev []*tailcfg.Node, now func() time.Time) {
 	if len(mapRes.Peers) > 0 {
 		// Not delta encoded.
 		if !nodesSorted(mapRes.Peers) {
@@ -268,7 +279,7 @@ func undeltaPeers(mapRes *tailcfg.MapResponse, prev []*tailcfg.Node) {
 		for _, n := range newFull {
 			peerByID[n.ID] = n
 		}
-		now := clockNow()
+		now := now()
 		for nodeID, seen := range mapRes.PeerSeenChange {
 			if n, ok := peerByID[nodeID]; ok {
 				if seen {
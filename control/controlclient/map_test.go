@@ -299,7 +299,7 @@ func TestUndeltaPeers(t *testing.T) {
 			if !tt.curTime.IsZero() {
 				curTime = tt.curTime
 			}
-			undeltaPeers(tt.mapRes, tt.prev)
+			undeltaPeers(tt.mapRes, tt.prev, clockNow)
 			if !reflect.DeepEqual(tt.mapRes.Peers, tt.want) {
 				t.Errorf("wrong results\n got: %s\nwant: %s", formatNodes(tt.mapRes.Peers), formatNodes(tt.want))
 			}
@@ -380,6 +380,31 @@ func TestNetmapForResponse(t *testing.T) {
 			t.Fatalf("2nd DNS wrong")
 		}
 	})
+	t.Run("tka_checkpoint", func(t *testing.T) {
+		policy := &tailcfg.TKACheckpointPolicy{MaxUpdates: 10}
+		ms := newTestMapSession(t)
+		nm := ms.netmapForResponse(&tailcfg.MapResponse{
+			Node: new(tailcfg.Node),
+			TKA:  &tailcfg.TKAMapResponse{Checkpoint: policy},
+		})
+		if nm.TKACheckpoint != policy {
+			t.Fatalf("1st TKACheckpoint = %v; want %v", nm.TKACheckpoint, policy)
+		}
+		nm = ms.netmapForResponse(&tailcfg.MapResponse{
+			Node: new(tailcfg.Node),
+			TKA:  nil, // implicit
+		})
+		if nm.TKACheckpoint != policy {
+			t.Fatalf("2nd TKACheckpoint = %v; want %v", nm.TKACheckpoint, policy)
+		}
+		nm = ms.netmapForResponse(&tailcfg.MapResponse{
+			Node: new(tailcfg.Node),
+			TKA:  &tailcfg.TKAMapResponse{},
+		})
+		if nm.TKACheckpoint != nil {
+			t.Fatalf("TKACheckpoint = %v after withdrawal; want nil", nm.TKACheckpoint)
+		}
+	})
 	t.Run("collect_services", func(t *testing.T) {
 		ms := newTestMapSession(t)
 		var nm *netmap.NetworkMap
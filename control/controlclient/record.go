@@ -0,0 +1,193 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netmap"
+)
+
+// maxRecordingSize is the size at which a recording stops growing.
+const maxRecordingSize = 64 << 20
+
+// redacted replaces secrets in recorded messages.
+const redacted = "REDACTED"
+
+// RecordedMessage is one message of a recording of map polls to the
+// control plane, as written to Options.RecordPath one JSON object per
+// line. Exactly one of Request and Response is set.
+//
+// URLs that would let their holder act on the node's behalf, such as
+// PingRequest.URL, are redacted.
+type RecordedMessage struct {
+	Time time.Time
+
+	// Poll is the number of the map poll the message is part of,
+	// counting from 1 in each process writing to the file. Each
+	// poll's Request comes before its Responses.
+	Poll int
+
+	Request  *tailcfg.MapRequest  `json:",omitempty"`
+	Response *tailcfg.MapResponse `json:",omitempty"`
+}
+
+// recorder appends RecordedMessages to a file.
+type recorder struct {
+	logf logger.Logf
+
+	mu    sync.Mutex
+	f     *os.File // nil once full or after a write error
+	size  int64
+	polls int
+}
+
+func newRecorder(path string, logf logger.Logf) (*recorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	logf("recording map polls to %s", path)
+	return &recorder{logf: logf, f: f, size: fi.Size()}, nil
+}
+
+// startPoll records req as the start of a new map poll and returns
+// the poll's number, for recordResponse.
+func (r *recorder) startPoll(req *tailcfg.MapRequest) int {
+	r.mu.Lock()
+	r.polls++
+	poll := r.polls
+	r.mu.Unlock()
+	r.write(&RecordedMessage{Poll: poll, Request: req})
+	return poll
+}
+
+// recordResponse records a response in the given poll. It must be
+// called before the response is processed, which modifies it.
+func (r *recorder) recordResponse(poll int, resp *tailcfg.MapResponse) {
+	r.write(&RecordedMessage{Poll: poll, Response: redactMapResponse(resp)})
+}
+
+func (r *recorder) write(m *RecordedMessage) {
+	m.Time = clockNow().UTC()
+	b, err := json.Marshal(m)
+	if err != nil {
+		r.logf("recording map poll: %v", err)
+		return
+	}
+	b = append(b, '\n')
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return
+	}
+	if r.size+int64(len(b)) > maxRecordingSize {
+		r.logf("map poll recording reached %d bytes; stopping", r.size)
+		r.closeLocked()
+		return
+	}
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	if err != nil {
+		r.logf("recording map poll: %v; stopping", err)
+		r.closeLocked()
+	}
+}
+
+func (r *recorder) closeLocked() {
+	r.f.Close()
+	r.f = nil
+}
+
+// Close stops recording.
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// redactMapResponse returns a shallow copy of resp with its secrets
+// redacted.
+func redactMapResponse(resp *tailcfg.MapResponse) *tailcfg.MapResponse {
+	r2 := *resp
+	if r2.PopBrowserURL != "" {
+		r2.PopBrowserURL = redacted
+	}
+	if pr := r2.PingRequest; pr != nil {
+		pr2 := *pr
+		pr2.URL = redacted
+		pr2.Payload = nil
+		r2.PingRequest = &pr2
+	}
+	if d := r2.Debug; d != nil && (d.LogHeapURL != "" || d.GoroutineDumpURL != "") {
+		d2 := *d
+		if d2.LogHeapURL != "" {
+			d2.LogHeapURL = redacted
+		}
+		if d2.GoroutineDumpURL != "" {
+			d2.GoroutineDumpURL = redacted
+		}
+		r2.Debug = &d2
+	}
+	return &r2
+}
+
+// ReplayRecording reads a recording written to Options.RecordPath and
+// processes its responses as Direct does, calling cb with the poll
+// number and resulting NetworkMap of each one that isn't a keep-alive.
+//
+// Each poll has its own map session, as in Direct. The recording
+// has no private keys, so the NetworkMaps have a new random node
+// private key. The current time, as used for peers' LastSeen, is that
+// of the response being replayed, so replays are deterministic.
+func ReplayRecording(r io.Reader, logf logger.Logf, cb func(poll int, nm *netmap.NetworkMap)) error {
+	br := bufio.NewReader(r)
+	sessions := map[int]*mapSession{} // by poll
+	for line := 1; ; line++ {
+		b, err := br.ReadBytes('\n')
+		if err == io.EOF && len(b) == 0 {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		var m RecordedMessage
+		if err := json.Unmarshal(b, &m); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		sess := sessions[m.Poll]
+		if m.Request != nil || sess == nil {
+			sess = newMapSession(key.NewNode())
+			sess.logf = logf
+			sessions[m.Poll] = sess
+		}
+		if m.Response == nil || m.Response.KeepAlive {
+			continue
+		}
+		at := m.Time
+		sess.timeNow = func() time.Time { return at }
+		cb(m.Poll, sess.netmapForResponse(m.Response))
+	}
+}
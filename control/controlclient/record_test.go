@@ -0,0 +1,71 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+func TestRecordReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "map.jsonl")
+	rec, err := newRecorder(path, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	defer func(old func() time.Time) { clockNow = old }(clockNow)
+	clockNow = func() time.Time { return t0 }
+
+	poll := rec.startPoll(&tailcfg.MapRequest{Stream: true})
+	rec.recordResponse(poll, &tailcfg.MapResponse{
+		Node:        &tailcfg.Node{ID: 1, Name: "self."},
+		Peers:       []*tailcfg.Node{{ID: 2, Name: "peer."}},
+		PingRequest: &tailcfg.PingRequest{URL: "https://control/secret"},
+	})
+	rec.recordResponse(poll, &tailcfg.MapResponse{KeepAlive: true})
+	clockNow = func() time.Time { return t0.Add(time.Minute) }
+	rec.recordResponse(poll, &tailcfg.MapResponse{
+		PeerSeenChange: map[tailcfg.NodeID]bool{2: true},
+	})
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "secret") {
+		t.Errorf("recording contains a secret URL:\n%s", b)
+	}
+
+	clockNow = func() time.Time { panic("replay used the current time") }
+	var nms []*netmap.NetworkMap
+	err = ReplayRecording(strings.NewReader(string(b)), t.Logf, func(p int, nm *netmap.NetworkMap) {
+		if p != poll {
+			t.Errorf("poll = %d; want %d", p, poll)
+		}
+		nms = append(nms, nm)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nms) != 2 {
+		t.Fatalf("got %d netmaps; want 2", len(nms))
+	}
+	if len(nms[1].Peers) != 1 || nms[1].Peers[0].LastSeen == nil {
+		t.Fatalf("second netmap peers = %v; want peer with LastSeen", nms[1].Peers)
+	}
+	if got, want := *nms[1].Peers[0].LastSeen, t0.Add(time.Minute); !got.Equal(want) {
+		t.Errorf("LastSeen = %v; want recorded time %v", got, want)
+	}
+}
@@ -53,6 +53,17 @@
 // The provided ctx is only used for the initial connection, until
 // Dial returns. It does not affect the connection once established.
 func Dial(ctx context.Context, host string, httpPort string, httpsPort string, machineKey key.MachinePrivate, controlKey key.MachinePublic, protocolVersion uint16, dialer dnscache.DialContextFunc) (*controlbase.Conn, error) {
+	return DialWithProxy(ctx, host, httpPort, httpsPort, machineKey, controlKey, protocolVersion, dialer, nil)
+}
+
+// DialWithProxy is like Dial, but if proxyFunc is non-nil, it's used in
+// place of the environment's proxy settings to choose the HTTP proxy,
+// if any, to connect through. A proxy URL may include a username and
+// password for proxies that require authentication.
+func DialWithProxy(ctx context.Context, host string, httpPort string, httpsPort string, machineKey key.MachinePrivate, controlKey key.MachinePublic, protocolVersion uint16, dialer dnscache.DialContextFunc, proxyFunc func(*http.Request) (*url.URL, error)) (*controlbase.Conn, error) {
+	if proxyFunc == nil {
+		proxyFunc = tshttpproxy.ProxyFromEnvironment
+	}
 	a := &dialParams{
 		host:       host,
 		httpPort:   httpPort,
@@ -60,7 +71,7 @@ func Dial(ctx context.Context, host string, httpPort string, httpsPort string, m
 		machineKey: machineKey,
 		controlKey: controlKey,
 		version:    protocolVersion,
-		proxyFunc:  tshttpproxy.ProxyFromEnvironment,
+		proxyFunc:  proxyFunc,
 		dialer:     dialer,
 	}
 	return a.dial(ctx)
@@ -7,6 +7,7 @@
 import (
 	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"log"
@@ -79,6 +80,16 @@ func TestControlHTTP(t *testing.T) {
 				allowHTTP:    true,
 			},
 		},
+		// HTTP->any with proxy authentication
+		{
+			name: "http_to_any_auth",
+			proxy: &httpProxy{
+				useTLS:       false,
+				allowConnect: true,
+				allowHTTP:    true,
+				auth:         "alice:secret",
+			},
+		},
 		// HTTPS->HTTP
 		{
 			name: "https_to_http",
@@ -298,9 +309,10 @@ func (s *socksProxy) ConnIsFromProxy(addr string) bool {
 }
 
 type httpProxy struct {
-	useTLS       bool // take incoming connections over TLS
-	allowConnect bool // allow CONNECT for TLS
-	allowHTTP    bool // allow plain HTTP proxying
+	useTLS       bool   // take incoming connections over TLS
+	allowConnect bool   // allow CONNECT for TLS
+	allowHTTP    bool   // allow plain HTTP proxying
+	auth         string // if non-empty, the USER:PASSWORD clients must send
 
 	sync.Mutex
 	ln              net.Listener
@@ -330,13 +342,17 @@ func (h *httpProxy) Start(t *testing.T) (url string) {
 	}
 	h.clientConnAddrs = map[string]bool{}
 	h.s.Handler = h
+	host := ln.Addr().String()
+	if h.auth != "" {
+		host = h.auth + "@" + host
+	}
 	if h.useTLS {
 		h.s.TLSConfig = tlsConfig(t)
 		go h.s.ServeTLS(h.ln, "", "")
-		return fmt.Sprintf("https://%s", ln.Addr().String())
+		return fmt.Sprintf("https://%s", host)
 	} else {
 		go h.s.Serve(h.ln)
-		return fmt.Sprintf("http://%s", ln.Addr().String())
+		return fmt.Sprintf("http://%s", host)
 	}
 }
 
@@ -347,6 +363,10 @@ func (h *httpProxy) Close() {
 }
 
 func (h *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.auth != "" && r.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(h.auth)) {
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
 	if r.Method != "CONNECT" {
 		if !h.allowHTTP {
 			http.Error(w, "http proxy not allowed", 500)
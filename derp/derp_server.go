@@ -28,6 +28,7 @@
 	"net/netip"
 	"os/exec"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -138,14 +139,20 @@ type Server struct {
 	multiForwarderCreated        expvar.Int
 	multiForwarderDeleted        expvar.Int
 	removePktForwardOther        expvar.Int
+	meshSourceCheckFailed        expvar.Int
 	avgQueueDuration             *uint64 // In milliseconds; accessed atomically
 
 	// verifyClients only accepts client connections to the DERP server if the clientKey is a
 	// known peer in the network, as specified by a running tailscaled's client's local api.
 	verifyClients bool
 
+	// meshSourceCheck is how packets forwarded by mesh peers are
+	// checked; see SetMeshSourceCheck.
+	meshSourceCheck MeshSourceCheck
+
 	mu       sync.Mutex
 	closed   bool
+	draining bool                   // Drain was called
 	netConns map[Conn]chan struct{} // chan is closed when conn closes
 	clients  map[key.NodePublic]clientSet
 	watchers map[*sclient]bool // mesh peer -> true
@@ -325,6 +332,8 @@ func NewServer(privateKey key.NodePrivate, logf logger.Logf) *Server {
 		s.packetsDroppedReason.Get("queue_head"),
 		s.packetsDroppedReason.Get("queue_tail"),
 		s.packetsDroppedReason.Get("write_error"),
+		s.packetsDroppedReason.Get("dup_client"),
+		s.packetsDroppedReason.Get("spoofed_source"),
 	}
 	s.packetsDroppedTypeDisco = s.packetsDroppedType.Get("disco")
 	s.packetsDroppedTypeOther = s.packetsDroppedType.Get("other")
@@ -346,6 +355,44 @@ func (s *Server) SetVerifyClient(v bool) {
 	s.verifyClients = v
 }
 
+// MeshSourceCheck is how a Server checks the source keys of packets
+// forwarded to it by mesh peers.
+//
+// A mesh peer may only forward packets from clients connected to it,
+// which it announces to the server's watch connection to it (see
+// AddPacketForwarder). Both the mesh peer's connection to the server
+// and the server's connection to the mesh peer are authenticated by
+// their DERP server keys, so a packet passes the check if its claimed
+// source is registered with a forwarder to the same server key that
+// sent it. A compromised mesh peer can then only send packets as the
+// clients actually connected to it, not as arbitrary keys.
+type MeshSourceCheck int
+
+const (
+	// MeshSourceCheckOff trusts mesh peers' source keys. It's the
+	// default.
+	MeshSourceCheckOff MeshSourceCheck = iota
+
+	// MeshSourceCheckLog counts and logs packets failing the check
+	// but still delivers them. It's for rolling out checking across
+	// a mesh: besides spoofing, packets fail if the server doesn't
+	// watch the mesh peer that sent them (such as an older one not
+	// configured to mesh both ways) or if they race ahead of the
+	// announcement of a newly connected client.
+	MeshSourceCheckLog
+
+	// MeshSourceCheckEnforce drops packets failing the check.
+	MeshSourceCheckEnforce
+)
+
+// SetMeshSourceCheck sets how the server checks the source keys of
+// packets forwarded by mesh peers.
+//
+// It must be called before serving begins.
+func (s *Server) SetMeshSourceCheck(v MeshSourceCheck) {
+	s.meshSourceCheck = v
+}
+
 // HasMeshKey reports whether the server is configured with a mesh key.
 func (s *Server) HasMeshKey() bool { return s.meshKey != "" }
 
@@ -384,10 +431,59 @@ func (s *Server) Close() error {
 	return nil
 }
 
+// Drain closes the server's connections gradually, spread evenly over
+// d, so their clients reconnect at a steady rate rather than all at
+// once, and then closes the server. Mesh peers' connections are closed
+// last, so the rest of the region keeps routing to this server's
+// clients until they've moved.
+//
+// Drain is for graceful restarts, where a new process is already
+// listening on the same port (with SO_REUSEPORT) or other servers in
+// the region can take the clients. The caller should stop accepting
+// new connections first. If ctx is done before d has passed, the
+// remaining connections are closed at once.
+func (s *Server) Drain(ctx context.Context, d time.Duration) error {
+	s.mu.Lock()
+	if s.closed || s.draining {
+		s.mu.Unlock()
+		return nil
+	}
+	s.draining = true
+	mesh := map[Conn]bool{}
+	for c := range s.watchers {
+		mesh[c.nc] = true
+	}
+	conns := make([]Conn, 0, len(s.netConns))
+	for nc := range s.netConns {
+		conns = append(conns, nc)
+	}
+	s.mu.Unlock()
+
+	sort.SliceStable(conns, func(i, j int) bool { return !mesh[conns[i]] && mesh[conns[j]] })
+	s.logf("derp: draining %d connections over %v", len(conns), d)
+	var interval time.Duration
+	if len(conns) > 0 {
+		interval = d / time.Duration(len(conns))
+	}
+	for i, nc := range conns {
+		if i > 0 && interval > 0 {
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+				return s.Close()
+			}
+		}
+		nc.Close()
+	}
+	return s.Close()
+}
+
+// isClosed reports whether the server is closed or draining, when
+// connection errors are expected.
 func (s *Server) isClosed() bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.closed
+	return s.closed || s.draining
 }
 
 // IsClientConnectedForTest reports whether the client with specified key is connected.
@@ -862,6 +958,15 @@ func (c *sclient) handleFrameForwardPacket(ft frameType, fl uint32) error {
 	var dst *sclient
 
 	s.mu.Lock()
+	if s.meshSourceCheck != MeshSourceCheckOff && !s.meshSourceOKLocked(c.key, srcKey) {
+		s.meshSourceCheckFailed.Add(1)
+		if s.meshSourceCheck == MeshSourceCheckEnforce {
+			s.mu.Unlock()
+			s.recordDrop(contents, srcKey, dstKey, dropReasonSpoofedSource)
+			return nil
+		}
+		s.limitedLogf("derp: mesh peer %s forwarded packet from %s, which isn't connected to it", c.key.ShortString(), srcKey.ShortString())
+	}
 	if set, ok := s.clients[dstKey]; ok {
 		dstLen = set.Len()
 		dst = set.ActiveClient()
@@ -887,6 +992,41 @@ func (c *sclient) handleFrameForwardPacket(ft frameType, fl uint32) error {
 	})
 }
 
+// meshSourceOKLocked reports whether the mesh peer with server key
+// peer may forward packets from src: whether src is registered with a
+// forwarder to peer. See MeshSourceCheck.
+//
+// s.mu must be held.
+func (s *Server) meshSourceOKLocked(peer, src key.NodePublic) bool {
+	switch fwd := s.clientsMesh[src].(type) {
+	case nil:
+		return false
+	case multiForwarder:
+		for f := range fwd {
+			if forwardsToPeer(f, peer) {
+				return true
+			}
+		}
+		return false
+	default:
+		return forwardsToPeer(fwd, peer)
+	}
+}
+
+// forwardsToPeer reports whether fwd forwards packets to the mesh
+// peer with server key peer, as verified by the DERP handshake of
+// fwd's connection. Forwarders that can't say which server they're
+// connected to, with a ServerPublicKey method as derphttp.Client has,
+// or that aren't connected yet, don't vouch for any peer.
+func forwardsToPeer(fwd PacketForwarder, peer key.NodePublic) bool {
+	k, ok := fwd.(interface{ ServerPublicKey() key.NodePublic })
+	if !ok {
+		return false
+	}
+	pub := k.ServerPublicKey()
+	return !pub.IsZero() && pub == peer
+}
+
 // notePeerSendLocked records that src sent to dst.  We keep track of
 // that so when src disconnects, we can tell dst (if it's still
 // around) that src is gone (a peerGone frame).
@@ -962,6 +1102,7 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 	dropReasonQueueTail                          // destination queue is full, dropped packet at queue tail
 	dropReasonWriteError                         // OS write() failed
 	dropReasonDupClient                          // the public key is connected 2+ times (active/active, fighting)
+	dropReasonSpoofedSource                      // mesh peer forwarded a packet from a client not connected to it
 )
 
 func (s *Server) recordDrop(packetBytes []byte, srcKey, dstKey key.NodePublic, reason dropReason) {
@@ -1697,6 +1838,7 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("multiforwarder_created", &s.multiForwarderCreated)
 	m.Set("multiforwarder_deleted", &s.multiForwarderDeleted)
 	m.Set("packet_forwarder_delete_other_value", &s.removePktForwardOther)
+	m.Set("mesh_source_check_failed", &s.meshSourceCheckFailed)
 	m.Set("average_queue_duration_ms", expvar.Func(func() any {
 		return math.Float64frombits(atomic.LoadUint64(s.avgQueueDuration))
 	}))
@@ -669,6 +669,111 @@ func pubAll(b byte) (ret key.NodePublic) {
 	return key.NodePublicFromRaw32(mem.B(bs[:]))
 }
 
+func TestServerDrain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+
+	w := newTestWatcher(t, ts, "w")
+	w.wantPresent(t, w.pub)
+	var clients []*testClient
+	for _, name := range []string{"c1", "c2", "c3"} {
+		c := newRegularClient(t, ts, name)
+		w.wantPresent(t, c.pub)
+		clients = append(clients, c)
+	}
+
+	const d = 300 * time.Millisecond
+	start := time.Now()
+	if err := ts.s.Drain(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < d/2 {
+		t.Errorf("Drain returned after %v; want about %v", elapsed, d)
+	}
+	if !ts.s.isClosed() {
+		t.Errorf("server not closed after Drain")
+	}
+
+	// The mesh watcher is closed last, so it sees the clients go.
+	gone := map[key.NodePublic]bool{}
+	for range clients {
+		m, err := w.c.recvTimeout(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m, ok := m.(PeerGoneMessage); ok {
+			gone[key.NodePublic(m)] = true
+		}
+	}
+	for _, c := range clients {
+		if !gone[c.pub] {
+			t.Errorf("watcher didn't see %s go", c.name)
+		}
+	}
+	for _, c := range append(clients, w) {
+		if _, err := c.c.recvTimeout(time.Second); err == nil {
+			t.Errorf("client %s still connected after Drain", c.name)
+		}
+	}
+}
+
+// meshFwd is a PacketForwarder to the mesh peer with server key pub.
+type meshFwd struct{ pub key.NodePublic }
+
+func (f meshFwd) ForwardPacket(key.NodePublic, key.NodePublic, []byte) error {
+	panic("not called in tests")
+}
+
+func (f meshFwd) ServerPublicKey() key.NodePublic { return f.pub }
+
+func TestMeshSourceCheck(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+	ts.s.SetMeshSourceCheck(MeshSourceCheckEnforce)
+
+	peer := newTestWatcher(t, ts, "peer")
+	peer.wantPresent(t, peer.pub)
+	dst := newRegularClient(t, ts, "dst")
+	peer.wantPresent(t, dst.pub)
+
+	viaPeer, viaOther, viaUnverified := pubAll(1), pubAll(2), pubAll(5)
+	ts.s.AddPacketForwarder(viaPeer, meshFwd{peer.pub})
+	ts.s.AddPacketForwarder(viaOther, meshFwd{pubAll(3)})
+	ts.s.AddPacketForwarder(viaUnverified, testFwd(1)) // no server key
+
+	// Forwarded packets from keys the peer didn't announce, including
+	// local clients and those of forwarders with no verified server
+	// key, are dropped.
+	for _, src := range []key.NodePublic{viaOther, dst.pub, pubAll(4), viaUnverified} {
+		if err := peer.c.ForwardPacket(src, dst.pub, []byte("spoofed")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := peer.c.ForwardPacket(viaPeer, dst.pub, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	m, err := dst.c.recvTimeout(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp, ok := m.(ReceivedPacket)
+	if !ok || rp.Source != viaPeer || string(rp.Data) != "hello" {
+		t.Fatalf("got %#v; want packet from viaPeer", m)
+	}
+	if got := ts.s.meshSourceCheckFailed.Value(); got != 4 {
+		t.Errorf("meshSourceCheckFailed = %v; want 4", got)
+	}
+	if got := ts.s.packetsDroppedReasonCounters[dropReasonSpoofedSource].Value(); got != 4 {
+		t.Errorf("spoofed_source drops = %v; want 4", got)
+	}
+}
+
 func TestForwarderRegistration(t *testing.T) {
 	s := &Server{
 		clients:     make(map[key.NodePublic]clientSet),
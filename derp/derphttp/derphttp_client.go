@@ -81,6 +81,34 @@ type Client struct {
 	serverPubKey key.NodePublic
 	tlsState     *tls.ConnectionState
 	pingOut      map[derp.PingMessage]chan<- bool // chan to send to on pong
+
+	probeInterval time.Duration // or zero to not probe; see SetHealthProbe
+	probeTimeout  time.Duration
+	connectedAt   time.Time     // when client was connected
+	lastPong      time.Time     // when a Ping was last answered
+	rtt           time.Duration // moving average of Ping round trip times
+	pingFailures  int           // Pings that went unanswered
+}
+
+// Health is the health of a Client's connection to its server, as
+// returned by Client.Health.
+type Health struct {
+	// Connected is whether the Client currently has a connection.
+	Connected bool
+	// ConnectedAt is when the current connection was made, if
+	// Connected.
+	ConnectedAt time.Time
+	// Reconnects is how many connections were made after the first.
+	Reconnects int
+	// LastPong is when the server last answered a Ping, or zero if
+	// it never has.
+	LastPong time.Time
+	// RTT is a moving average of the Ping round trip time, or zero
+	// if no Ping was answered.
+	RTT time.Duration
+	// PingFailures is how many Pings, including health probes, went
+	// unanswered.
+	PingFailures int
 }
 
 // NewRegionClient returns a new DERP-over-HTTP client. It connects lazily.
@@ -458,15 +486,21 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 	c.netConn = tcpConn
 	c.tlsState = tlsState
 	c.connGen++
+	c.connectedAt = time.Now()
+	if c.probeInterval > 0 {
+		go c.probeLoop(derpClient, c.probeInterval, c.probeTimeout)
+	}
 	return c.client, c.connGen, nil
 }
 
-// SetURLDialer sets the dialer to use for dialing URLs.
-// This dialer is only use for clients created with NewClient, not NewRegionClient.
-// If unset or nil, the default dialer is used.
+// SetURLDialer sets the dialer to use for dialing URLs, or, for
+// clients created with NewRegionClient, the region's nodes. Nodes are
+// dialed with "tcp4" or "tcp6" as their address family is chosen. If
+// unset or nil, the default dialer is used.
 //
-// The primary use for this is the derper mesh mode to connect to each
-// other over a VPC network.
+// The primary uses for this are the derper mesh mode to connect to
+// each other over a VPC network, and tailscaled dialing DERP servers
+// with its system dial rules.
 func (c *Client) SetURLDialer(dialer func(ctx context.Context, network, addr string) (net.Conn, error)) {
 	c.dialer = dialer
 }
@@ -572,6 +606,9 @@ func (c *Client) DialRegionTLS(ctx context.Context, reg *tailcfg.DERPRegion) (tl
 }
 
 func (c *Client) dialContext(ctx context.Context, proto, addr string) (net.Conn, error) {
+	if c.dialer != nil {
+		return c.dialer(ctx, proto, addr)
+	}
 	return netns.NewDialer(c.logf).DialContext(ctx, proto, addr)
 }
 
@@ -790,15 +827,26 @@ func (c *Client) handledPong(m derp.PongMessage) bool {
 	return false
 }
 
+// defaultPingTimeout is the longest Ping waits for a reply, unless
+// changed with SetHealthProbe.
+const defaultPingTimeout = 5 * time.Second
+
 // Ping sends a ping to the peer and waits for it either to be
 // acknowledged (in which case Ping returns nil) or waits for ctx to
-// be over and returns an error. It will wait at most 5 seconds
-// before returning an error.
+// be over and returns an error. It will wait at most 5 seconds, or the
+// timeout given to SetHealthProbe, before returning an error.
 //
 // Another goroutine must be in a loop calling Recv or
 // RecvDetail or ping responses won't be handled.
 func (c *Client) Ping(ctx context.Context) error {
-	maxDL := time.Now().Add(5 * time.Second)
+	c.mu.Lock()
+	timeout := c.probeTimeout
+	c.mu.Unlock()
+	if timeout <= 0 {
+		timeout = defaultPingTimeout
+	}
+	start := time.Now()
+	maxDL := start.Add(timeout)
 	if dl, ok := ctx.Deadline(); !ok || dl.After(maxDL) {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithDeadline(ctx, maxDL)
@@ -810,16 +858,106 @@ func (c *Client) Ping(ctx context.Context) error {
 	c.registerPing(data, gotPing)
 	defer c.unregisterPing(data)
 	if err := c.SendPing(data); err != nil {
+		c.notePingResult(start, false)
 		return err
 	}
 	select {
 	case <-gotPing:
+		c.notePingResult(start, true)
 		return nil
 	case <-ctx.Done():
+		c.notePingResult(start, false)
 		return ctx.Err()
 	}
 }
 
+// notePingResult records the outcome of a Ping started at start for
+// Health.
+func (c *Client) notePingResult(start time.Time, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !ok {
+		c.pingFailures++
+		return
+	}
+	now := time.Now()
+	rtt := now.Sub(start)
+	if c.lastPong.IsZero() {
+		c.rtt = rtt
+	} else {
+		c.rtt = (3*c.rtt + rtt) / 4
+	}
+	c.lastPong = now
+}
+
+// SetHealthProbe sets c to ping the server every interval and to
+// reconnect if it doesn't reply within timeout, to find broken
+// connections sooner than the server's keepalives or TCP would. An
+// interval of zero disables probing, which is the default. The timeout
+// also applies to Ping; if zero, it's 5 seconds.
+//
+// This only affects future connections.
+func (c *Client) SetHealthProbe(interval, timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.probeInterval = interval
+	c.probeTimeout = timeout
+}
+
+// probeLoop pings the server every interval while client is c's
+// connection, closing it for reconnect if a ping goes unanswered.
+func (c *Client) probeLoop(client *derp.Client, interval, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = defaultPingTimeout
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-t.C:
+		}
+		c.mu.Lock()
+		current := c.client == client
+		c.mu.Unlock()
+		if !current {
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.ctx, timeout)
+		err := c.Ping(ctx)
+		cancel()
+		if err == nil {
+			continue
+		}
+		if c.ctx.Err() != nil {
+			return
+		}
+		c.logf("derphttp: health probe failed, reconnecting: %v", err)
+		c.closeForReconnect(client)
+		return
+	}
+}
+
+// Health returns the health of c's connection to the server.
+func (c *Client) Health() Health {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := Health{
+		Connected:    c.client != nil,
+		LastPong:     c.lastPong,
+		RTT:          c.rtt,
+		PingFailures: c.pingFailures,
+	}
+	if h.Connected {
+		h.ConnectedAt = c.connectedAt
+	}
+	if c.connGen > 1 {
+		h.Reconnects = c.connGen - 1
+	}
+	return h
+}
+
 // SendPing writes a ping message, without any implicit connect or
 // reconnect. This is a lower-level interface that writes a frame
 // without any implicit handling of the response pong, if any. For a
@@ -7,13 +7,17 @@
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
 
 	"tailscale.com/derp"
+	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
 )
 
@@ -206,3 +210,80 @@ func TestPing(t *testing.T) {
 		t.Fatalf("Ping: %v", err)
 	}
 }
+
+func TestHealthProbe(t *testing.T) {
+	serverPrivateKey := key.NewNode()
+	s := derp.NewServer(serverPrivateKey, t.Logf)
+	defer s.Close()
+
+	httpsrv := httptest.NewServer(Handler(s))
+	defer httpsrv.Close()
+
+	c, err := NewClient(key.NewNode(), httpsrv.URL, t.Logf)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+	c.SetHealthProbe(10*time.Millisecond, time.Second)
+	if h := c.Health(); h.Connected || !h.LastPong.IsZero() {
+		t.Fatalf("before Connect, Health = %+v", h)
+	}
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("client Connect: %v", err)
+	}
+	go func() {
+		for {
+			if _, err := c.Recv(); err != nil {
+				return
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		h := c.Health()
+		if !h.LastPong.IsZero() {
+			if !h.Connected || h.RTT <= 0 || h.Reconnects != 0 {
+				t.Errorf("Health = %+v; want connected with an RTT and no reconnects", h)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no health probe answered; Health = %+v", h)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRegionClientURLDialer(t *testing.T) {
+	reg := &tailcfg.DERPRegion{
+		RegionID: 1,
+		Nodes: []*tailcfg.DERPNode{{
+			Name:     "1a",
+			RegionID: 1,
+			HostName: "derp.example.com",
+			IPv4:     "192.0.2.1",
+			IPv6:     "none",
+		}},
+	}
+	c := NewRegionClient(key.NewNode(), t.Logf, func() *tailcfg.DERPRegion { return reg })
+	defer c.Close()
+
+	errDial := errors.New("dial refused")
+	var mu sync.Mutex
+	var dialed []string
+	c.SetURLDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		dialed = append(dialed, network+" "+addr)
+		return nil, errDial
+	})
+	if _, _, err := c.dialRegion(context.Background(), reg); !errors.Is(err, errDial) {
+		t.Fatalf("dialRegion = %v; want %v", err, errDial)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"tcp4 192.0.2.1:443"}; !reflect.DeepEqual(dialed, want) {
+		t.Errorf("dialed %q; want %q", dialed, want)
+	}
+}
@@ -8,7 +8,6 @@
 
 import (
 	"errors"
-	"fmt"
 	"net/http"
 	"runtime"
 	"sort"
@@ -327,61 +326,14 @@ func OverallError() error {
 
 var fakeErrForTesting = envknob.String("TS_DEBUG_FAKE_HEALTH_ERROR")
 
+// overallErrorLocked returns the root causes among the current
+// warnings; the problems they cause are left out.
 func overallErrorLocked() error {
-	if !anyInterfaceUp {
-		return errors.New("network down")
-	}
-	if !ipnWantRunning {
-		return fmt.Errorf("state=%v, wantRunning=%v", ipnState, ipnWantRunning)
-	}
-	if lastLoginErr != nil {
-		return fmt.Errorf("not logged in, last login error=%v", lastLoginErr)
-	}
-	now := time.Now()
-	if !inMapPoll && (lastMapPollEndedAt.IsZero() || now.Sub(lastMapPollEndedAt) > 10*time.Second) {
-		return errors.New("not in map poll")
-	}
-	const tooIdle = 2*time.Minute + 5*time.Second
-	if d := now.Sub(lastStreamedMapResponse).Round(time.Second); d > tooIdle {
-		return fmt.Errorf("no map response in %v", d)
-	}
-	rid := derpHomeRegion
-	if rid == 0 {
-		return errors.New("no DERP home")
-	}
-	if !derpRegionConnected[rid] {
-		return fmt.Errorf("not connected to home DERP region %v", rid)
-	}
-	if d := now.Sub(derpRegionLastFrame[rid]).Round(time.Second); d > tooIdle {
-		return fmt.Errorf("haven't heard from home DERP region %v in %v", rid, d)
-	}
-	if udp4Unbound {
-		return errors.New("no udp4 bind")
-	}
-
-	// TODO: use
-	_ = inMapPollSince
-	_ = lastMapPollEndedAt
-	_ = lastStreamedMapResponse
-	_ = lastMapRequestHeard
-
 	var errs []error
-	for _, recv := range receiveFuncs {
-		if recv.missing {
-			errs = append(errs, fmt.Errorf("%s is not running", recv.name))
-		}
-	}
-	for sys, err := range sysErr {
-		if err == nil || sys == SysOverall {
-			continue
+	for _, w := range warningsLocked(time.Now()) {
+		if len(w.DependsOn) == 0 {
+			errs = append(errs, w.err)
 		}
-		errs = append(errs, fmt.Errorf("%v: %w", sys, err))
-	}
-	for regionID, problem := range derpRegionHealthProblem {
-		errs = append(errs, fmt.Errorf("derp%d: %v", regionID, problem))
-	}
-	for _, s := range controlHealth {
-		errs = append(errs, errors.New(s))
 	}
 	if e := fakeErrForTesting; len(errs) == 0 && e != "" {
 		return errors.New(e)
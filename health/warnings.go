@@ -0,0 +1,277 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package health
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Subsystems that warnings are attributed to, in addition to those
+// whose errors are set with the Set*Health funcs.
+const (
+	// SysNetwork is the host's network connectivity.
+	SysNetwork = Subsystem("network")
+
+	// SysIPN is the ipn backend's state machine.
+	SysIPN = Subsystem("ipn")
+
+	// SysControl is the connection to the control plane.
+	SysControl = Subsystem("control")
+
+	// SysDERP is the connection to the DERP relay servers.
+	SysDERP = Subsystem("derp")
+
+	// SysWireGuard is the WireGuard data plane: UDP sockets and
+	// wireguard-go's receive funcs.
+	SysWireGuard = Subsystem("wireguard")
+)
+
+// WarningCode is the stable, machine-readable identifier of a kind of
+// Warning. Warnings about a Subsystem's error use the Subsystem name
+// as their code.
+type WarningCode string
+
+const (
+	WarnNetworkDown          = WarningCode("network-down")
+	WarnNotRunning           = WarningCode("not-running")
+	WarnLoginError           = WarningCode("login-error")
+	WarnNotInMapPoll         = WarningCode("not-in-map-poll")
+	WarnNoMapResponse        = WarningCode("no-map-response")
+	WarnNoDERPHome           = WarningCode("no-derp-home")
+	WarnDERPHomeDisconnected = WarningCode("derp-home-disconnected")
+	WarnDERPHomeSilent       = WarningCode("derp-home-silent")
+	WarnDERPRegion           = WarningCode("derp-region")
+	WarnUDP4Unbound          = WarningCode("udp4-unbound")
+	WarnReceiveFuncStopped   = WarningCode("receive-func-stopped")
+	WarnControlMessage       = WarningCode("control-message")
+)
+
+// Severity is how much a Warning impairs the node.
+type Severity string
+
+const (
+	// SeverityLow means a feature may not work as expected.
+	SeverityLow = Severity("low")
+	// SeverityMedium means connectivity to some peers is impaired.
+	SeverityMedium = Severity("medium")
+	// SeverityHigh means the node is unlikely to reach any peers.
+	SeverityHigh = Severity("high")
+)
+
+// RemediationAction is a machine-readable kind of Remediation, for
+// GUIs to map to a button or menu item.
+type RemediationAction string
+
+const (
+	ActionCheckNetwork  = RemediationAction("check-network")
+	ActionCheckFirewall = RemediationAction("check-firewall")
+	ActionStart         = RemediationAction("start")
+	ActionLogin         = RemediationAction("login")
+	ActionRestart       = RemediationAction("restart")
+	ActionContactAdmin  = RemediationAction("contact-admin")
+	ActionBugReport     = RemediationAction("bugreport")
+)
+
+// Remediation is something the user can try to fix a Warning.
+type Remediation struct {
+	Action RemediationAction
+	Text   string // human-readable description of Action
+
+	// Command, if non-empty, is a CLI command that performs Action.
+	Command string `json:",omitempty"`
+}
+
+// Warning is one current health problem.
+type Warning struct {
+	Code      WarningCode
+	Subsystem Subsystem
+	Severity  Severity
+	Text      string // human-readable description
+
+	// DependsOn are the codes of other current warnings that this one
+	// is likely a consequence of, such as WarnNotInMapPoll for a
+	// WarnLoginError. A Warning with no DependsOn is a root cause.
+	DependsOn []WarningCode `json:",omitempty"`
+
+	// Remediation are suggested fixes, most likely first. They fix
+	// this warning itself; the warnings in DependsOn should usually
+	// be fixed first.
+	Remediation []Remediation `json:",omitempty"`
+
+	err error // for OverallError, if different from Text
+}
+
+// warnable describes a kind of Warning.
+type warnable struct {
+	sys Subsystem
+	sev Severity
+
+	// deps are the kinds of warnings that can cause this one. If one
+	// of them isn't current, its own deps are considered instead.
+	deps []WarningCode
+
+	fix []Remediation
+}
+
+var (
+	fixNetwork   = Remediation{ActionCheckNetwork, "Check that this device is connected to the internet.", ""}
+	fixFirewall  = Remediation{ActionCheckFirewall, "Check that a firewall isn't blocking Tailscale's outgoing connections.", ""}
+	fixStart     = Remediation{ActionStart, "Connect Tailscale.", "tailscale up"}
+	fixLogin     = Remediation{ActionLogin, "Log in to Tailscale again.", "tailscale login"}
+	fixRestart   = Remediation{ActionRestart, "Restart the Tailscale service.", ""}
+	fixAdmin     = Remediation{ActionContactAdmin, "Contact your network administrator.", ""}
+	fixBugReport = Remediation{ActionBugReport, "If the problem persists, file a bug report.", "tailscale bugreport"}
+)
+
+// controlDeps are the deps of warnings about things that need
+// working communication with the control plane.
+var controlDeps = []WarningCode{WarnLoginError, WarnNotInMapPoll, WarnNoMapResponse}
+
+var warnables = map[WarningCode]warnable{
+	WarnNetworkDown: {SysNetwork, SeverityHigh, nil, []Remediation{fixNetwork}},
+	WarnNotRunning:  {SysIPN, SeverityHigh, []WarningCode{WarnNetworkDown}, []Remediation{fixStart}},
+	WarnLoginError:  {SysControl, SeverityHigh, []WarningCode{WarnNotRunning}, []Remediation{fixLogin, fixFirewall}},
+
+	WarnNotInMapPoll:  {SysControl, SeverityHigh, []WarningCode{WarnLoginError}, []Remediation{fixFirewall, fixRestart}},
+	WarnNoMapResponse: {SysControl, SeverityMedium, []WarningCode{WarnNotInMapPoll}, []Remediation{fixFirewall}},
+
+	// The DERP map, and so the choice of home region, comes from control.
+	WarnNoDERPHome:           {SysDERP, SeverityMedium, controlDeps, []Remediation{fixFirewall}},
+	WarnDERPHomeDisconnected: {SysDERP, SeverityMedium, []WarningCode{WarnNoDERPHome}, []Remediation{fixFirewall}},
+	WarnDERPHomeSilent:       {SysDERP, SeverityMedium, []WarningCode{WarnDERPHomeDisconnected}, []Remediation{fixFirewall}},
+	WarnDERPRegion:           {SysDERP, SeverityLow, []WarningCode{WarnNotRunning}, nil},
+
+	WarnUDP4Unbound:        {SysWireGuard, SeverityMedium, []WarningCode{WarnNotRunning}, []Remediation{fixRestart}},
+	WarnReceiveFuncStopped: {SysWireGuard, SeverityHigh, []WarningCode{WarnNotRunning}, []Remediation{fixRestart, fixBugReport}},
+	WarnControlMessage:     {SysControl, SeverityMedium, nil, []Remediation{fixAdmin}},
+
+	// Subsystem errors.
+	WarningCode(SysRouter):          {SysRouter, SeverityHigh, []WarningCode{WarnNotRunning}, []Remediation{fixRestart, fixBugReport}},
+	WarningCode(SysDNS):             {SysDNS, SeverityMedium, append([]WarningCode{WarnNotRunning}, controlDeps...), []Remediation{fixBugReport}},
+	WarningCode(SysDNSOS):           {SysDNSOS, SeverityMedium, []WarningCode{WarnNotRunning}, []Remediation{fixBugReport}},
+	WarningCode(SysDNSManager):      {SysDNSManager, SeverityMedium, []WarningCode{WarnNotRunning}, []Remediation{fixBugReport}},
+	WarningCode(SysNetworkCategory): {SysNetworkCategory, SeverityLow, []WarningCode{WarnNotRunning}, []Remediation{fixRestart}},
+}
+
+// Warnings returns the current health problems, sorted by code and
+// then text.
+func Warnings() []Warning {
+	mu.Lock()
+	defer mu.Unlock()
+	return warningsLocked(time.Now())
+}
+
+func warningsLocked(now time.Time) []Warning {
+	var ws []Warning
+	add := func(code WarningCode, err error) {
+		wa, ok := warnables[code]
+		if !ok {
+			wa = warnable{sys: Subsystem(code), sev: SeverityMedium, deps: []WarningCode{WarnNotRunning}}
+		}
+		ws = append(ws, Warning{
+			Code:        code,
+			Subsystem:   wa.sys,
+			Severity:    wa.sev,
+			Text:        err.Error(),
+			Remediation: wa.fix,
+			err:         err,
+		})
+	}
+
+	if !anyInterfaceUp {
+		add(WarnNetworkDown, errors.New("network down"))
+	}
+	if !ipnWantRunning {
+		add(WarnNotRunning, fmt.Errorf("state=%v, wantRunning=%v", ipnState, ipnWantRunning))
+	}
+	if lastLoginErr != nil {
+		add(WarnLoginError, fmt.Errorf("not logged in, last login error=%v", lastLoginErr))
+	}
+	if !inMapPoll && (lastMapPollEndedAt.IsZero() || now.Sub(lastMapPollEndedAt) > 10*time.Second) {
+		add(WarnNotInMapPoll, errors.New("not in map poll"))
+	}
+	const tooIdle = 2*time.Minute + 5*time.Second
+	if d := now.Sub(lastStreamedMapResponse).Round(time.Second); d > tooIdle {
+		add(WarnNoMapResponse, fmt.Errorf("no map response in %v", d))
+	}
+	if rid := derpHomeRegion; rid == 0 {
+		add(WarnNoDERPHome, errors.New("no DERP home"))
+	} else if !derpRegionConnected[rid] {
+		add(WarnDERPHomeDisconnected, fmt.Errorf("not connected to home DERP region %v", rid))
+	} else if d := now.Sub(derpRegionLastFrame[rid]).Round(time.Second); d > tooIdle {
+		add(WarnDERPHomeSilent, fmt.Errorf("haven't heard from home DERP region %v in %v", rid, d))
+	}
+	if udp4Unbound {
+		add(WarnUDP4Unbound, errors.New("no udp4 bind"))
+	}
+
+	// TODO: use
+	_ = inMapPollSince
+	_ = lastMapRequestHeard
+
+	for _, recv := range receiveFuncs {
+		if recv.missing {
+			add(WarnReceiveFuncStopped, fmt.Errorf("%s is not running", recv.name))
+		}
+	}
+	for sys, err := range sysErr {
+		if err == nil || sys == SysOverall {
+			continue
+		}
+		add(WarningCode(sys), fmt.Errorf("%v: %w", sys, err))
+	}
+	for regionID, problem := range derpRegionHealthProblem {
+		add(WarnDERPRegion, fmt.Errorf("derp%d: %v", regionID, problem))
+	}
+	for _, s := range controlHealth {
+		add(WarnControlMessage, errors.New(s))
+	}
+
+	current := map[WarningCode]bool{}
+	for _, w := range ws {
+		current[w.Code] = true
+	}
+	for i := range ws {
+		ws[i].DependsOn = currentCauses(ws[i].Code, current)
+	}
+	sort.Slice(ws, func(i, j int) bool {
+		if ws[i].Code != ws[j].Code {
+			return ws[i].Code < ws[j].Code
+		}
+		return ws[i].Text < ws[j].Text
+	})
+	return ws
+}
+
+// currentCauses returns the nearest current warnings that can cause
+// a warning of kind code, walking past the kinds that aren't current.
+func currentCauses(code WarningCode, current map[WarningCode]bool) []WarningCode {
+	wa, ok := warnables[code]
+	if !ok {
+		wa.deps = []WarningCode{WarnNotRunning}
+	}
+	var causes []WarningCode
+	seen := map[WarningCode]bool{}
+	var walk func([]WarningCode)
+	walk = func(deps []WarningCode) {
+		for _, d := range deps {
+			if seen[d] {
+				continue
+			}
+			seen[d] = true
+			if current[d] {
+				causes = append(causes, d)
+			} else {
+				walk(warnables[d].deps)
+			}
+		}
+	}
+	walk(wa.deps)
+	sort.Slice(causes, func(i, j int) bool { return causes[i] < causes[j] })
+	return causes
+}
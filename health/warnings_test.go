@@ -0,0 +1,75 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package health
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWarningsDependencies(t *testing.T) {
+	now := time.Now()
+	mu.Lock()
+	defer mu.Unlock()
+	defer func() {
+		ipnWantRunning = false
+		inMapPoll = false
+		lastStreamedMapResponse = time.Time{}
+		derpHomeRegion = 0
+		derpRegionConnected = map[int]bool{}
+		derpRegionLastFrame = map[int]time.Time{}
+		delete(sysErr, SysDNS)
+		delete(sysErr, SysRouter)
+	}()
+
+	// A healthy node.
+	ipnWantRunning = true
+	inMapPoll = true
+	lastStreamedMapResponse = now
+	derpHomeRegion = 1
+	derpRegionConnected = map[int]bool{1: true}
+	derpRegionLastFrame = map[int]time.Time{1: now}
+	if ws := warningsLocked(now); len(ws) != 0 {
+		t.Fatalf("healthy node has warnings: %+v", ws)
+	}
+
+	// Losing control breaks DNS, but not the router.
+	inMapPoll = false
+	sysErr[SysDNS] = errors.New("no config")
+	sysErr[SysRouter] = errors.New("no routes")
+	got := map[WarningCode][]WarningCode{}
+	for _, w := range warningsLocked(now) {
+		got[w.Code] = w.DependsOn
+	}
+	want := map[WarningCode][]WarningCode{
+		WarnNotInMapPoll:       nil,
+		WarningCode(SysDNS):    {WarnNotInMapPoll},
+		WarningCode(SysRouter): nil,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got deps %v; want %v", got, want)
+	}
+	err := overallErrorLocked()
+	if err == nil || strings.Contains(err.Error(), "no config") || !strings.Contains(err.Error(), "no routes") {
+		t.Errorf("OverallError = %v; want root causes only", err)
+	}
+
+	// Stopping makes everything else a consequence.
+	ipnWantRunning = false
+	for _, w := range warningsLocked(now) {
+		if w.Code == WarnNotRunning {
+			if len(w.DependsOn) != 0 || len(w.Remediation) == 0 || w.Remediation[0].Action != ActionStart {
+				t.Errorf("not-running warning = %+v", w)
+			}
+			continue
+		}
+		if len(w.DependsOn) == 0 {
+			t.Errorf("%v is a root cause while stopped", w.Code)
+		}
+	}
+}
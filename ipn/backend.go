@@ -6,6 +6,7 @@
 
 import (
 	"fmt"
+	"net/netip"
 	"strings"
 	"time"
 
@@ -52,6 +53,26 @@ type EngineStatus struct {
 	LivePeers      map[key.NodePublic]ipnstate.PeerStatusLite
 }
 
+// TrafficStats is a periodic sample of tunnel throughput, derived from
+// successive EngineStatus updates. It's pushed to subscribers (such as
+// platform GUIs drawing live throughput graphs) at a fixed interval.
+type TrafficStats struct {
+	AsOf time.Time // time of the engine status sample
+
+	// RxBytesPerSec and TxBytesPerSec are the receive and transmit
+	// rates averaged over the time since the previous sample.
+	RxBytesPerSec float64
+	TxBytesPerSec float64
+
+	// RxBytes and TxBytes are the cumulative byte counts across all
+	// current peers.
+	RxBytes int64
+	TxBytes int64
+
+	// ActivePeers is the number of peers with a completed handshake.
+	ActivePeers int
+}
+
 // Notify is a communication from a backend (e.g. tailscaled) to a frontend
 // (cmd/tailscale, iOS, macOS, Win Tasktray).
 // In any given notification, any or all of these may be nil, meaning
@@ -91,6 +112,15 @@ type Notify struct {
 	// macOS Network Extension.
 	LocalTCPPort *uint16 `json:",omitempty"`
 
+	// KeyExpiryWarning, if non-nil, warns that the node key expires
+	// soon. The frontend can renew it with LocalClient.Reauth.
+	KeyExpiryWarning *KeyExpiryWarning `json:",omitempty"`
+
+	// ExitNodeClient, if non-nil, reports a change in a peer's use of
+	// this node as an exit node: it started or stopped using it, or
+	// is waiting for approval to. See Prefs.ExitNodeClientApproval.
+	ExitNodeClient *ExitNodeClient `json:",omitempty"`
+
 	// type is mirrored in xcode/Shared/IPN.swift
 }
 
@@ -130,10 +160,46 @@ func (n Notify) String() string {
 	if n.LocalTCPPort != nil {
 		fmt.Fprintf(&sb, "tcpport=%v ", n.LocalTCPPort)
 	}
+	if n.KeyExpiryWarning != nil {
+		fmt.Fprintf(&sb, "keyexpiry=%v ", n.KeyExpiryWarning.Expiry.Format(time.RFC3339))
+	}
+	if n.ExitNodeClient != nil {
+		fmt.Fprintf(&sb, "exitclient=%v ", n.ExitNodeClient.IP)
+	}
 	s := sb.String()
 	return s[0:len(s)-1] + "}"
 }
 
+// KeyExpiryWarning is a warning that the node key expires soon.
+type KeyExpiryWarning struct {
+	Expiry time.Time     // when the node key expires
+	Within time.Duration // the warning threshold that was reached
+}
+
+// ExitNodeClient is a peer's session of using, or asking to use, this
+// node as an exit node. A session ends after a few minutes without
+// traffic.
+type ExitNodeClient struct {
+	IP     netip.Addr           // the peer's Tailscale IP its traffic is from
+	NodeID tailcfg.StableNodeID `json:",omitempty"` // empty if the peer isn't in the netmap
+	Name   string               `json:",omitempty"` // the peer's MagicDNS name
+	User   string               `json:",omitempty"` // login name of the peer's owner
+
+	Started    time.Time // when the session's first packet was seen
+	LastActive time.Time // when its latest packet was seen
+
+	RxBytes int64 // bytes the peer sent on through this node
+	TxBytes int64 // bytes sent back to the peer
+
+	// Pending is whether the peer is waiting for approval, with its
+	// traffic dropped until then. Denied is whether it was refused.
+	Pending bool `json:",omitempty"`
+	Denied  bool `json:",omitempty"`
+
+	// Ended is set in the notification sent when the session ends.
+	Ended bool `json:",omitempty"`
+}
+
 // PartialFile represents an in-progress file transfer.
 type PartialFile struct {
 	Name         string    // e.g. "foo.jpg"
@@ -0,0 +1,267 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package conffile parses tailscaled's declarative configuration file
+// (tailscaled --config), which sets prefs and the auth key in place
+// of "tailscale up" flags, for deployments where the machine's
+// configuration is managed as a file.
+package conffile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/tailscale/hujson"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/eventhook"
+	"tailscale.com/net/dscp"
+	"tailscale.com/util/maintwindow"
+)
+
+// CurrentVersion is the config file Version this tailscaled writes
+// and understands. Files with any other Version are rejected, so the
+// format can change incompatibly under a new Version.
+const CurrentVersion = "alpha0"
+
+// Config is a parsed config file.
+type Config struct {
+	// Path is the file the config was loaded from, if any.
+	Path string
+
+	// Version is the file's format version; see CurrentVersion.
+	Version string
+
+	// AuthKey is the auth key to log in with if the node isn't
+	// logged in yet, or empty. A "file:" AuthKey in the file is
+	// resolved to the contents of the named file.
+	AuthKey string
+
+	// Prefs holds the prefs the file sets, which take precedence over
+	// those set any other way. Prefs it doesn't set are left alone.
+	Prefs ipn.MaskedPrefs
+}
+
+// file is the JSON structure of a config file.
+type file struct {
+	Version string
+	AuthKey string          `json:",omitempty"`
+	Prefs   json.RawMessage `json:",omitempty"`
+}
+
+// Load reads and validates the config file at path. See Parse for its
+// format.
+func Load(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	c.Path = path
+	if strings.HasPrefix(c.AuthKey, "file:") {
+		keyFile := strings.TrimPrefix(c.AuthKey, "file:")
+		if !filepath.IsAbs(keyFile) {
+			keyFile = filepath.Join(filepath.Dir(path), keyFile)
+		}
+		k, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: reading AuthKey: %w", path, err)
+		}
+		c.AuthKey = strings.TrimSpace(string(k))
+	}
+	return c, nil
+}
+
+// Parse parses and validates a config file, a HuJSON (JSON with
+// comments and trailing commas) object such as:
+//
+//	{
+//		"Version": "alpha0",
+//		"AuthKey": "file:/etc/tailscale/authkey",
+//		"Prefs": {
+//			"WantRunning": true,
+//			"Hostname": "db-1",
+//			"AdvertiseRoutes": ["10.0.0.0/24", "0.0.0.0/0", "::/0"],
+//		},
+//	}
+//
+// Prefs may set any field of ipn.Prefs except Persist, by its Go
+// field name and in its JSON representation. AuthKey is either an auth
+// key or "file:" and the path of a file holding one, relative to the
+// config file's directory.
+func Parse(b []byte) (*Config, error) {
+	std, err := hujson.Standardize(b)
+	if err != nil {
+		return nil, err
+	}
+	// Check the version before anything else, as other versions may
+	// have fields this one doesn't.
+	var f file
+	if err := json.Unmarshal(std, &struct{ Version *string }{&f.Version}); err != nil {
+		return nil, err
+	}
+	if f.Version == "" {
+		return nil, errors.New("missing Version")
+	}
+	if f.Version != CurrentVersion {
+		return nil, fmt.Errorf("unsupported Version %q; this tailscaled supports %q", f.Version, CurrentVersion)
+	}
+	if err := decodeStrict(std, &f); err != nil {
+		return nil, err
+	}
+	c := &Config{
+		Version: f.Version,
+		AuthKey: f.AuthKey,
+	}
+	if len(f.Prefs) > 0 {
+		if err := parsePrefs(f.Prefs, &c.Prefs); err != nil {
+			return nil, err
+		}
+	}
+	// Accept "off" for ShieldsOff, as "tailscale up --shields" does.
+	if c.Prefs.Shields == "off" {
+		c.Prefs.Shields = ipn.ShieldsOff
+	}
+	if err := validatePrefs(&c.Prefs); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// decodeStrict decodes the JSON b into v, rejecting fields v doesn't
+// have and trailing data.
+func decodeStrict(b []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("trailing data after config")
+	}
+	return nil
+}
+
+// parsePrefs decodes the Prefs object b into mp, marking the prefs
+// it sets.
+func parsePrefs(b json.RawMessage, mp *ipn.MaskedPrefs) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return fmt.Errorf("Prefs: %w", err)
+	}
+	mv := reflect.ValueOf(mp).Elem()
+	for name := range fields {
+		set := mv.FieldByName(name + "Set")
+		if !settablePref(name) || !set.IsValid() {
+			return fmt.Errorf("Prefs: unknown pref %q", name)
+		}
+		set.SetBool(true)
+	}
+	if err := decodeStrict(b, &mp.Prefs); err != nil {
+		return fmt.Errorf("Prefs: %w", err)
+	}
+	return nil
+}
+
+// settablePref reports whether name is the name of a pref that can be
+// set in a config file.
+func settablePref(name string) bool {
+	f, ok := reflect.TypeOf(ipn.Prefs{}).FieldByName(name)
+	// Prefs' JSON names are their field names, except Persist, which
+	// isn't a pref.
+	return ok && f.Tag.Get("json") != "Config"
+}
+
+// validatePrefs checks the prefs set in mp for values that "tailscale
+// up" would reject.
+func validatePrefs(mp *ipn.MaskedPrefs) error {
+	p := &mp.Prefs
+	var errs []string
+	if p.ExitNodeID != "" && p.ExitNodeIP.IsValid() {
+		errs = append(errs, "ExitNodeID and ExitNodeIP are mutually exclusive")
+	}
+	if len(p.ExitNodeRotation) > 0 && (p.ExitNodeID != "" || p.ExitNodeIP.IsValid()) {
+		errs = append(errs, "ExitNodeRotation can't be used with ExitNodeID or ExitNodeIP")
+	}
+	if p.ExitNodeRotateEvery < 0 {
+		errs = append(errs, "ExitNodeRotateEvery can't be negative")
+	}
+	for _, r := range p.AdvertiseRoutes {
+		if r != r.Masked() {
+			errs = append(errs, fmt.Sprintf("AdvertiseRoutes: %s has non-address bits set; expected %s", r, r.Masked()))
+		}
+	}
+	if v := p.ControlProxy; v != "" && v != ipn.ControlProxyDirect {
+		if _, err := ipn.ParseControlProxy(v); err != nil {
+			errs = append(errs, fmt.Sprintf("ControlProxy: %v", err))
+		}
+	}
+	if !ipn.ValidShields(p.Shields) {
+		errs = append(errs, fmt.Sprintf("Shields: unknown level %q", p.Shields))
+	}
+	for _, r := range p.ShieldsLANRoutes {
+		if r != r.Masked() {
+			errs = append(errs, fmt.Sprintf("ShieldsLANRoutes: %s has non-address bits set; expected %s", r, r.Masked()))
+		}
+	}
+	if len(p.Hostname) > 256 {
+		errs = append(errs, fmt.Sprintf("Hostname too long: %d bytes (max 256)", len(p.Hostname)))
+	}
+	if p.MaxBandwidthKbps < 0 || p.MaxPeerBandwidthKbps < 0 {
+		errs = append(errs, "bandwidth limits can't be negative")
+	}
+	if p.FlowSampleRate < 0 {
+		errs = append(errs, "FlowSampleRate can't be negative")
+	}
+	if p.DiscoKeyRotation < 0 {
+		errs = append(errs, "DiscoKeyRotation can't be negative")
+	}
+	if _, err := maintwindow.Parse(p.MaintenanceWindow); err != nil {
+		errs = append(errs, fmt.Sprintf("MaintenanceWindow: %v", err))
+	}
+	if _, err := dscp.ParsePolicy(p.DSCPPassthrough); err != nil {
+		errs = append(errs, fmt.Sprintf("DSCPPassthrough: %v", err))
+	}
+	for _, h := range p.EventHooks {
+		if _, err := eventhook.Parse(h); err != nil {
+			errs = append(errs, fmt.Sprintf("EventHooks: %v", err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Conflicts returns the names of the prefs c sets whose values in p
+// differ, in sorted order.
+func (c *Config) Conflicts(p *ipn.Prefs) []string {
+	var names []string
+	mv := reflect.ValueOf(&c.Prefs).Elem()
+	cv := reflect.ValueOf(&c.Prefs.Prefs).Elem()
+	pv := reflect.ValueOf(p).Elem()
+	for i := 1; i < mv.NumField(); i++ {
+		if !mv.Field(i).Bool() {
+			continue
+		}
+		a, b := cv.Field(i-1), pv.Field(i-1)
+		if a.Kind() == reflect.Slice && a.Len() == 0 && b.Len() == 0 {
+			continue // nil and empty are the same to prefs
+		}
+		if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+			names = append(names, cv.Type().Field(i-1).Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
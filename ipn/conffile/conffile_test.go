@@ -0,0 +1,189 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package conffile
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    ipn.MaskedPrefs
+		wantErr string
+	}{
+		{
+			name: "prefs",
+			in: `{
+				// Comments and trailing commas are fine.
+				"Version": "alpha0",
+				"Prefs": {
+					"WantRunning": true,
+					"Hostname": "db-1",
+					"AdvertiseRoutes": ["10.0.0.0/24", "0.0.0.0/0", "::/0"],
+					"DiscoKeyRotation": 86400000000000,
+				},
+			}`,
+			want: ipn.MaskedPrefs{
+				Prefs: ipn.Prefs{
+					WantRunning: true,
+					Hostname:    "db-1",
+					AdvertiseRoutes: []netip.Prefix{
+						netip.MustParsePrefix("10.0.0.0/24"),
+						netip.MustParsePrefix("0.0.0.0/0"),
+						netip.MustParsePrefix("::/0"),
+					},
+					DiscoKeyRotation: 24 * time.Hour,
+				},
+				WantRunningSet:      true,
+				HostnameSet:         true,
+				AdvertiseRoutesSet:  true,
+				DiscoKeyRotationSet: true,
+			},
+		},
+		{
+			name: "set_to_zero",
+			in:   `{"Version": "alpha0", "Prefs": {"ShieldsUp": false}}`,
+			want: ipn.MaskedPrefs{ShieldsUpSet: true},
+		},
+		{
+			name: "shields_off",
+			in:   `{"Version": "alpha0", "Prefs": {"Shields": "off"}}`,
+			want: ipn.MaskedPrefs{Prefs: ipn.Prefs{Shields: ipn.ShieldsOff}, ShieldsSet: true},
+		},
+		{
+			name: "no_prefs",
+			in:   `{"Version": "alpha0"}`,
+		},
+		{
+			name:    "missing_version",
+			in:      `{"Prefs": {}}`,
+			wantErr: "missing Version",
+		},
+		{
+			name:    "future_version",
+			in:      `{"Version": "beta1", "Serve": {}}`,
+			wantErr: `unsupported Version "beta1"`,
+		},
+		{
+			name:    "unknown_field",
+			in:      `{"Version": "alpha0", "Bogus": 1}`,
+			wantErr: `unknown field "Bogus"`,
+		},
+		{
+			name:    "unknown_pref",
+			in:      `{"Version": "alpha0", "Prefs": {"Bogus": 1}}`,
+			wantErr: `unknown pref "Bogus"`,
+		},
+		{
+			name:    "persist",
+			in:      `{"Version": "alpha0", "Prefs": {"Config": {}}}`,
+			wantErr: `unknown pref "Config"`,
+		},
+		{
+			name:    "unmasked_route",
+			in:      `{"Version": "alpha0", "Prefs": {"AdvertiseRoutes": ["10.0.0.5/24"]}}`,
+			wantErr: "10.0.0.5/24 has non-address bits set; expected 10.0.0.0/24",
+		},
+		{
+			name:    "exit_node_id_and_ip",
+			in:      `{"Version": "alpha0", "Prefs": {"ExitNodeID": "n123", "ExitNodeIP": "100.64.0.1"}}`,
+			wantErr: "mutually exclusive",
+		},
+		{
+			name:    "exit_node_and_rotation",
+			in:      `{"Version": "alpha0", "Prefs": {"ExitNodeIP": "100.64.0.1", "ExitNodeRotation": ["fra", "ams"]}}`,
+			wantErr: "ExitNodeRotation can't be used with ExitNodeID or ExitNodeIP",
+		},
+		{
+			name:    "bad_maintenance_window",
+			in:      `{"Version": "alpha0", "Prefs": {"MaintenanceWindow": "whenever"}}`,
+			wantErr: "MaintenanceWindow:",
+		},
+		{
+			name:    "bad_event_hook",
+			in:      `{"Version": "alpha0", "Prefs": {"EventHooks": ["*=exec:../bin/sh"]}}`,
+			wantErr: "EventHooks:",
+		},
+		{
+			name:    "bad_shields",
+			in:      `{"Version": "alpha0", "Prefs": {"Shields": "on"}}`,
+			wantErr: `Shields: unknown level "on"`,
+		},
+		{
+			name:    "bad_control_proxy",
+			in:      `{"Version": "alpha0", "Prefs": {"ControlProxy": "ftp://proxy.corp"}}`,
+			wantErr: `ControlProxy: unsupported proxy scheme "ftp"; want http, https or socks5`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Parse([]byte(tt.in))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v; want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(c.Prefs, tt.want) {
+				t.Errorf("prefs = %v; want %v", c.Prefs.Pretty(), tt.want.Pretty())
+			}
+		})
+	}
+}
+
+func TestLoadAuthKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "authkey"), []byte("tskey-abc\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "tailscaled.conf")
+	if err := os.WriteFile(path, []byte(`{"Version": "alpha0", "AuthKey": "file:authkey"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.AuthKey != "tskey-abc" {
+		t.Errorf("AuthKey = %q; want %q", c.AuthKey, "tskey-abc")
+	}
+	if c.Path != path {
+		t.Errorf("Path = %q; want %q", c.Path, path)
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	c, err := Parse([]byte(`{"Version": "alpha0", "Prefs": {
+		"ShieldsUp": true,
+		"Hostname": "db-1",
+		"AdvertiseTags": [],
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := ipn.NewPrefs()
+	p.ShieldsUp = true
+	p.RouteAll = false // not set by the file
+	if got, want := c.Conflicts(p), []string{"Hostname"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Conflicts = %q; want %q", got, want)
+	}
+	p.ApplyEdits(&c.Prefs)
+	if got := c.Conflicts(p); len(got) != 0 {
+		t.Errorf("after ApplyEdits, Conflicts = %q; want none", got)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package eventhook parses the event hooks of ipn.Prefs.EventHooks,
+// which run a command or POST to a local URL when peers come online or
+// go offline or their routes change, for triggering automations
+// without polling.
+package eventhook
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// Event types.
+const (
+	PeerOnline    = "peer-online"
+	PeerOffline   = "peer-offline"
+	RoutesChanged = "routes-changed"
+)
+
+// Hook is a parsed event hook.
+type Hook struct {
+	// Events are the event types the hook runs for.
+	Events []string
+
+	// Peers, if non-empty, limits the hook to events about these
+	// peers, by hostname, MagicDNS name or Tailscale IP.
+	Peers []string
+
+	// Exactly one of Exec and URL is set.
+
+	// Exec is the file name of an executable in tailscaled's hooks
+	// directory to run. Only executables put there, by whoever can
+	// write to tailscaled's state directory, can be run.
+	Exec string
+
+	// URL is an http URL on a loopback address to POST events to.
+	URL string
+}
+
+// Parse parses an event hook of the form
+//
+//	EVENTS[@PEERS]=TARGET
+//
+// where EVENTS are event types separated by "+", or "*" for all of
+// them; PEERS are hostnames, MagicDNS names or Tailscale IPs separated
+// by "+"; and TARGET is "exec:NAME", naming an executable in
+// tailscaled's hooks directory, or an http URL on a loopback address.
+// For example:
+//
+//	peer-online+peer-offline@nas=exec:nas-changed
+//	routes-changed=http://127.0.0.1:8123/api/webhook/tailscale
+func Parse(s string) (*Hook, error) {
+	spec, target, ok := strings.Cut(s, "=")
+	if !ok || target == "" {
+		return nil, fmt.Errorf("event hook %q: want EVENTS[@PEERS]=TARGET", s)
+	}
+	events, peers, hasPeers := strings.Cut(spec, "@")
+	h := new(Hook)
+	if events == "*" {
+		h.Events = []string{PeerOnline, PeerOffline, RoutesChanged}
+	} else {
+		for _, ev := range strings.Split(events, "+") {
+			switch ev {
+			case PeerOnline, PeerOffline, RoutesChanged:
+				h.Events = append(h.Events, ev)
+			default:
+				return nil, fmt.Errorf("event hook %q: unknown event %q", s, ev)
+			}
+		}
+	}
+	if hasPeers {
+		for _, p := range strings.Split(peers, "+") {
+			if p == "" {
+				return nil, fmt.Errorf("event hook %q: empty peer", s)
+			}
+			h.Peers = append(h.Peers, p)
+		}
+	}
+	var err error
+	if strings.HasPrefix(target, "exec:") {
+		h.Exec = strings.TrimPrefix(target, "exec:")
+		err = checkExecName(h.Exec)
+	} else {
+		h.URL = target
+		err = checkURL(h.URL)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("event hook %q: %w", s, err)
+	}
+	return h, nil
+}
+
+// checkExecName checks that name names a file in the hooks directory
+// rather than anywhere else.
+func checkExecName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("exec target %q isn't a file name", name)
+	}
+	return nil
+}
+
+// checkURL checks that u is an http URL on a loopback address.
+func checkURL(u string) error {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	if pu.Scheme != "http" {
+		return errors.New("target must be exec:NAME or an http URL")
+	}
+	host := pu.Hostname()
+	if host == "localhost" {
+		return nil
+	}
+	if ip, err := netip.ParseAddr(host); err == nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("URL host %q isn't a loopback address", pu.Host)
+}
+
+// Runs reports whether h runs for events of type typ.
+func (h *Hook) Runs(typ string) bool {
+	for _, ev := range h.Events {
+		if ev == typ {
+			return true
+		}
+	}
+	return false
+}
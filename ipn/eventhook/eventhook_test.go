@@ -0,0 +1,64 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eventhook
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    *Hook
+		wantErr string
+	}{
+		{
+			in: "peer-online+peer-offline@nas+100.64.0.5=exec:nas-changed",
+			want: &Hook{
+				Events: []string{PeerOnline, PeerOffline},
+				Peers:  []string{"nas", "100.64.0.5"},
+				Exec:   "nas-changed",
+			},
+		},
+		{
+			in: "*=http://127.0.0.1:8123/api/webhook/tailscale",
+			want: &Hook{
+				Events: []string{PeerOnline, PeerOffline, RoutesChanged},
+				URL:    "http://127.0.0.1:8123/api/webhook/tailscale",
+			},
+		},
+		{
+			in:   "routes-changed=http://localhost/hook",
+			want: &Hook{Events: []string{RoutesChanged}, URL: "http://localhost/hook"},
+		},
+		{in: "peer-online", wantErr: "want EVENTS[@PEERS]=TARGET"},
+		{in: "peer-online=", wantErr: "want EVENTS[@PEERS]=TARGET"},
+		{in: "peer-up=exec:x", wantErr: `unknown event "peer-up"`},
+		{in: "peer-online@=exec:x", wantErr: "empty peer"},
+		{in: "peer-online=exec:../bin/sh", wantErr: "isn't a file name"},
+		{in: "peer-online=exec:", wantErr: "isn't a file name"},
+		{in: "peer-online=https://127.0.0.1/", wantErr: "must be exec:NAME or an http URL"},
+		{in: "peer-online=http://example.com/", wantErr: "isn't a loopback address"},
+		{in: "peer-online=http://100.64.0.1:80/", wantErr: "isn't a loopback address"},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Parse(%q) error = %v; want one containing %q", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Parse(%q) = %+v; want %+v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -8,6 +8,7 @@
 
 import (
 	"net/netip"
+	"time"
 
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/persist"
@@ -22,8 +23,16 @@ func (src *Prefs) Clone() *Prefs {
 	}
 	dst := new(Prefs)
 	*dst = *src
+	dst.ExitNodeExcludeRoutes = append(src.ExitNodeExcludeRoutes[:0:0], src.ExitNodeExcludeRoutes...)
+	dst.ExitNodeRotation = append(src.ExitNodeRotation[:0:0], src.ExitNodeRotation...)
+	dst.ShieldsLANRoutes = append(src.ShieldsLANRoutes[:0:0], src.ShieldsLANRoutes...)
 	dst.AdvertiseTags = append(src.AdvertiseTags[:0:0], src.AdvertiseTags...)
 	dst.AdvertiseRoutes = append(src.AdvertiseRoutes[:0:0], src.AdvertiseRoutes...)
+	dst.PinnedEndpoints = append(src.PinnedEndpoints[:0:0], src.PinnedEndpoints...)
+	dst.TaildropRules = append(src.TaildropRules[:0:0], src.TaildropRules...)
+	dst.AlwaysOnPeers = append(src.AlwaysOnPeers[:0:0], src.AlwaysOnPeers...)
+	dst.SystemDialRules = append(src.SystemDialRules[:0:0], src.SystemDialRules...)
+	dst.EventHooks = append(src.EventHooks[:0:0], src.EventHooks...)
 	if dst.Persist != nil {
 		dst.Persist = new(persist.Persist)
 		*dst.Persist = *src.Persist
@@ -34,16 +43,24 @@ func (src *Prefs) Clone() *Prefs {
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _PrefsCloneNeedsRegeneration = Prefs(struct {
 	ControlURL             string
+	ControlProxy           string
 	RouteAll               bool
 	AllowSingleHosts       bool
 	ExitNodeID             tailcfg.StableNodeID
 	ExitNodeIP             netip.Addr
 	ExitNodeAllowLANAccess bool
+	ExitNodeExcludeRoutes  []netip.Prefix
+	ExitNodeRotation       []string
+	ExitNodeRotateEvery    time.Duration
 	CorpDNS                bool
+	SyncHostsFile          bool
 	RunSSH                 bool
 	WantRunning            bool
 	LoggedOut              bool
 	ShieldsUp              bool
+	Shields                string
+	ShieldsLANRoutes       []netip.Prefix
+	Stealth                bool
 	AdvertiseTags          []string
 	Hostname               string
 	NotepadURLs            bool
@@ -52,5 +69,19 @@ func (src *Prefs) Clone() *Prefs {
 	NoSNAT                 bool
 	NetfilterMode          preftype.NetfilterMode
 	OperatorUser           string
+	MaxBandwidthKbps       int
+	MaxPeerBandwidthKbps   int
+	PinnedEndpoints        []PinnedEndpoint
+	TaildropRules          []TaildropRule
+	FlowSampleRate         int
+	FlowCollector          string
+	DSCPPassthrough        string
+	MaintenanceWindow      string
+	LazyPeers              bool
+	AlwaysOnPeers          []string
+	SystemDialRules        []DialRule
+	ExitNodeClientApproval bool
+	DiscoKeyRotation       time.Duration
+	EventHooks             []string
 	Persist                *persist.Persist
 }{})
@@ -0,0 +1,220 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/clientmetric"
+)
+
+// MaxBenchDuration is the longest throughput test Bench runs, and the
+// longest the PeerAPI /v0/bench handler serves one for.
+const MaxBenchDuration = time.Minute
+
+// benchPings is how many disco pings Bench sends to find the path to
+// the peer and its latency.
+const benchPings = 3
+
+// benchPacketMetrics are the client metrics that count the packets
+// magicsock sends and receives.
+var benchPacketMetrics = map[string]bool{
+	"magicsock_send_udp":             true,
+	"magicsock_send_derp":            true,
+	"magicsock_recv_data_derp":       true,
+	"magicsock_recv_data_ipv4":       true,
+	"magicsock_recv_data_ipv6":       true,
+	"magicsock_recv_data_peer_relay": true,
+}
+
+// Bench measures the throughput of the tunnel to the peer with
+// Tailscale IP ip, by sending data to its PeerAPI /v0/bench handler
+// for d, or, if reverse, having it send data to us.
+//
+// The peer must be owned by the same user or grant this node
+// tailcfg.CapabilityDebugPeer.
+func (b *LocalBackend) Bench(ctx context.Context, ip netip.Addr, d time.Duration, reverse bool) (*apitype.BenchResult, error) {
+	if d <= 0 || d > MaxBenchDuration {
+		return nil, fmt.Errorf("duration must be between 0 and %v", MaxBenchDuration)
+	}
+	nm := b.NetMap()
+	if nm == nil {
+		return nil, errors.New("no netmap")
+	}
+	peer, ok := nm.PeerByTailscaleIP(ip)
+	if !ok {
+		return nil, fmt.Errorf("no peer found with Tailscale IP %v", ip)
+	}
+	base := peerAPIBase(nm, peer)
+	if base == "" {
+		return nil, fmt.Errorf("%v has no peer API; is it online?", peer.ComputedName)
+	}
+	res := &apitype.BenchResult{
+		Peer:    strings.TrimSuffix(peer.Name, "."),
+		Reverse: reverse,
+	}
+
+	// Pinging first also makes sure the path is set up, so the test
+	// doesn't start with the disco handshake.
+	for i := 0; i < benchPings; i++ {
+		pingCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		pr, err := b.Ping(pingCtx, ip, tailcfg.PingDisco)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		if pr.Err != "" {
+			continue
+		}
+		lat := time.Duration(pr.LatencySeconds * float64(time.Second))
+		if res.Latency == 0 || lat < res.Latency {
+			res.Latency = lat
+		}
+		res.Path = benchPath(pr.Endpoint, pr.DERPRegionCode)
+	}
+
+	var req *http.Request
+	var err error
+	if reverse {
+		req, err = http.NewRequestWithContext(ctx, "GET", base+"/v0/bench?duration="+d.String(), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, "POST", base+"/v0/bench", &benchReader{deadline: time.Now().Add(d)})
+	}
+	if err != nil {
+		return nil, err
+	}
+	packets0, cpu0 := benchPackets(), processCPUTime()
+	t0 := time.Now()
+	hres, err := b.Dialer().PeerAPITransport().RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer hres.Body.Close()
+	if hres.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(hres.Body, 4<<10))
+		return nil, fmt.Errorf("%v: %v: %s", peer.ComputedName, hres.Status, strings.TrimSpace(string(body)))
+	}
+	if reverse {
+		res.Bytes, err = io.Copy(io.Discard, hres.Body)
+	} else {
+		var body []byte
+		body, err = io.ReadAll(io.LimitReader(hres.Body, 64))
+		if err == nil {
+			res.Bytes, err = strconv.ParseInt(strings.TrimSpace(string(body)), 10, 64)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", peer.ComputedName, err)
+	}
+	res.Duration = time.Since(t0)
+	res.Packets = benchPackets() - packets0
+	if cpu0 > 0 {
+		res.CPU = processCPUTime() - cpu0
+	}
+	return res, nil
+}
+
+// benchPath describes the path of a disco ping that was answered from
+// endpoint, or over the DERP region derpRegion.
+func benchPath(endpoint, derpRegion string) string {
+	switch {
+	case derpRegion != "":
+		return "DERP " + derpRegion
+	case endpoint != "":
+		return "direct " + endpoint
+	}
+	return ""
+}
+
+// benchPackets returns how many packets magicsock has sent and
+// received.
+func benchPackets() (n int64) {
+	for _, m := range clientmetric.Metrics() {
+		if benchPacketMetrics[m.Name()] {
+			n += m.Value()
+		}
+	}
+	return n
+}
+
+// benchReader is the body of a Bench upload: zeros, until its
+// deadline.
+type benchReader struct {
+	deadline time.Time
+}
+
+func (r *benchReader) Read(p []byte) (int, error) {
+	if !time.Now().Before(r.deadline) {
+		return 0, io.EOF
+	}
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// handleServeBench serves the other end of a LocalBackend.Bench
+// throughput test. A GET sends zeros for the "duration" parameter; a
+// POST discards its body and replies with its length.
+func (h *peerAPIHandler) handleServeBench(w http.ResponseWriter, r *http.Request) {
+	if !h.canDebug() {
+		http.Error(w, "denied; no debug access", http.StatusForbidden)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), MaxBenchDuration+10*time.Second)
+	defer cancel()
+	switch r.Method {
+	case "GET":
+		d, err := time.ParseDuration(r.FormValue("duration"))
+		if err != nil || d <= 0 || d > MaxBenchDuration {
+			http.Error(w, "bad 'duration' param", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		buf := make([]byte, 32<<10)
+		for deadline := time.Now().Add(d); time.Now().Before(deadline) && ctx.Err() == nil; {
+			if _, err := w.Write(buf); err != nil {
+				return
+			}
+		}
+	case "POST":
+		n, err := io.Copy(io.Discard, readerWithContext(ctx, r.Body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "%d\n", n)
+	default:
+		http.Error(w, "bad method", http.StatusMethodNotAllowed)
+	}
+}
+
+// readerWithContext returns a reader of r that fails once ctx is done.
+func readerWithContext(ctx context.Context, r io.Reader) io.Reader {
+	return readerFunc(func(p []byte) (int, error) {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		return r.Read(p)
+	})
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
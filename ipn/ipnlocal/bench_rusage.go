@@ -0,0 +1,24 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows && !js
+// +build !windows,!js
+
+package ipnlocal
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// processCPUTime returns the user and system CPU time this process has
+// used, or 0 if it's unknown.
+func processCPUTime() time.Duration {
+	var ru unix.Rusage
+	if err := unix.Getrusage(unix.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
@@ -0,0 +1,15 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows || js
+// +build windows js
+
+package ipnlocal
+
+import "time"
+
+func processCPUTime() time.Duration {
+	// TODO: use GetProcessTimes on Windows.
+	return 0
+}
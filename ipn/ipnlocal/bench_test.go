@@ -0,0 +1,61 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPeerAPIBench(t *testing.T) {
+	h := &peerAPIHandler{isSelf: true}
+
+	rec := httptest.NewRecorder()
+	h.handleServeBench(rec, httptest.NewRequest("GET", "/v0/bench?duration=20ms", nil))
+	if rec.Code != http.StatusOK || rec.Body.Len() == 0 {
+		t.Errorf("GET: status %d, %d bytes; want 200 and some data", rec.Code, rec.Body.Len())
+	}
+
+	for _, q := range []string{"", "?duration=-1s", "?duration=1h"} {
+		rec = httptest.NewRecorder()
+		h.handleServeBench(rec, httptest.NewRequest("GET", "/v0/bench"+q, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("GET %q: status %d; want 400", q, rec.Code)
+		}
+	}
+
+	body := &benchReader{deadline: time.Now().Add(20 * time.Millisecond)}
+	rec = httptest.NewRecorder()
+	h.handleServeBench(rec, httptest.NewRequest("POST", "/v0/bench", body))
+	n, err := strconv.ParseInt(strings.TrimSpace(rec.Body.String()), 10, 64)
+	if rec.Code != http.StatusOK || err != nil || n == 0 {
+		t.Errorf("POST: status %d, body %q; want 200 and a byte count", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	(&peerAPIHandler{ps: &peerAPIServer{b: &LocalBackend{}}}).handleServeBench(rec, httptest.NewRequest("GET", "/v0/bench?duration=1s", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("without debug access: status %d; want 403", rec.Code)
+	}
+}
+
+func TestBenchPath(t *testing.T) {
+	tests := []struct {
+		endpoint, derp, want string
+	}{
+		{"1.2.3.4:41641", "", "direct 1.2.3.4:41641"},
+		{"", "nyc", "DERP nyc"},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		if got := benchPath(tt.endpoint, tt.derp); got != tt.want {
+			t.Errorf("benchPath(%q, %q) = %q; want %q", tt.endpoint, tt.derp, got, tt.want)
+		}
+	}
+}
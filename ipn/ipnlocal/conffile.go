@@ -0,0 +1,136 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"golang.org/x/exp/slices"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/conffile"
+)
+
+// SetConfigFile sets tailscaled's config file, such as when it's
+// reloaded. Its prefs are applied right away if the backend has
+// started, and otherwise when it starts. Prefs no longer set by the
+// file keep their current values, but can again be changed by other
+// means.
+//
+// It returns an error, and the previous config file stays in effect,
+// if the file's prefs aren't valid or if it changes the auth key after
+// the backend has started: the auth key is only used when starting.
+func (b *LocalBackend) SetConfigFile(c *conffile.Config) error {
+	b.mu.Lock()
+	old := b.conf
+	if b.cc != nil && c != nil {
+		var oldKey string
+		if old != nil {
+			oldKey = old.AuthKey
+		}
+		if c.AuthKey != oldKey {
+			b.mu.Unlock()
+			return fmt.Errorf("config file %s: AuthKey changed; restart tailscaled to use it", c.Path)
+		}
+	}
+	b.conf = c
+	if c == nil {
+		b.mu.Unlock()
+		return nil
+	}
+	p := b.prefs.Clone()
+	if p == nil {
+		p = ipn.NewPrefs()
+	}
+	p.ApplyEdits(&b.configFileLocked().Prefs)
+	if err := b.checkPrefsLocked(p); err != nil {
+		b.conf = old
+		b.mu.Unlock()
+		return fmt.Errorf("config file %s: %w", c.Path, err)
+	}
+	if b.cc == nil || p.Equals(b.prefs) {
+		b.mu.Unlock()
+		return nil
+	}
+	b.logf("config file: %v", c.Prefs.Pretty())
+	b.setPrefsLockedOnEntry("SetConfigFile", p) // does a b.mu.Unlock
+	return nil
+}
+
+// applyConfigFilePrefsLocked applies the prefs set by b.conf to
+// b.prefs, saving them under stateKey if they changed. It returns an
+// error, changing nothing, if the resulting prefs aren't valid.
+//
+// b.mu must be held and b.conf must be non-nil.
+func (b *LocalBackend) applyConfigFilePrefsLocked(stateKey ipn.StateKey) error {
+	p := b.prefs.Clone()
+	p.ApplyEdits(&b.configFileLocked().Prefs)
+	if p.Equals(b.prefs) {
+		return nil
+	}
+	if err := b.checkPrefsLocked(p); err != nil {
+		return fmt.Errorf("config file %s: %w", b.conf.Path, err)
+	}
+	b.logf("config file: %v", b.conf.Prefs.Pretty())
+	b.prefs = p
+	if stateKey != "" {
+		if err := b.store.WriteState(stateKey, p.ToBytes()); err != nil {
+			b.logf("failed to save config file prefs: %v", err)
+		}
+	}
+	b.setAtomicValuesFromPrefs(p)
+	return nil
+}
+
+// checkConfigFilePrefsLocked returns an error if p changes prefs set by
+// the config file.
+//
+// b.mu must be held.
+func (b *LocalBackend) checkConfigFilePrefsLocked(p *ipn.Prefs) error {
+	if b.conf == nil {
+		return nil
+	}
+	names := b.conf.Conflicts(p)
+	if c := b.configFileLocked(); c != b.conf {
+		// Either the file's ExitNodeIP or the ExitNodeID it
+		// resolved to is fine.
+		resolved := c.Conflicts(p)
+		both := names[:0]
+		for _, n := range names {
+			if slices.Contains(resolved, n) {
+				both = append(both, n)
+			}
+		}
+		names = both
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s set by config file %s; edit it and send tailscaled SIGHUP to change them", strings.Join(names, ", "), b.conf.Path)
+}
+
+// configFileLocked returns b.conf, the config file, or, if it sets an
+// ExitNodeIP that the netmap resolves to a peer, a copy of it setting
+// that peer's ExitNodeID instead. findExitNodeIDLocked replaces an
+// ExitNodeIP with the ExitNodeID it resolves to, so the copy is what
+// the file's prefs look like once applied.
+//
+// b.mu must be held and b.conf must be non-nil.
+func (b *LocalBackend) configFileLocked() *conffile.Config {
+	mp := &b.conf.Prefs
+	if !mp.ExitNodeIPSet || !mp.ExitNodeIP.IsValid() {
+		return b.conf
+	}
+	peer, ok := b.netMap.PeerByTailscaleIP(mp.ExitNodeIP)
+	if !ok {
+		return b.conf
+	}
+	c := *b.conf
+	c.Prefs.ExitNodeIP = netip.Addr{}
+	c.Prefs.ExitNodeID = peer.StableID
+	c.Prefs.ExitNodeIDSet = true
+	return &c
+}
@@ -0,0 +1,217 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"tailscale.com/control/controlclient"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/conffile"
+	"tailscale.com/ipn/store/mem"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine"
+)
+
+func TestConfigFilePrefs(t *testing.T) {
+	e, err := wgengine.NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	b, err := NewLocalBackend(t.Logf, "logid", new(mem.Store), nil, e, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.prefs = ipn.NewPrefs()
+	b.hostinfo = new(tailcfg.Hostinfo)
+
+	c, err := conffile.Parse([]byte(`{"Version": "alpha0", "Prefs": {"ShieldsUp": true, "Hostname": "db-1"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Path = "/etc/tailscaled.conf"
+	if err := b.SetConfigFile(c); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prefs set another way don't override the file's.
+	p := ipn.NewPrefs()
+	p.CorpDNS = false
+	b.SetPrefs(p)
+	got := b.Prefs()
+	if !got.ShieldsUp || got.Hostname != "db-1" || got.CorpDNS {
+		t.Errorf("after SetPrefs, prefs = %v", got.Pretty())
+	}
+
+	// Edits to the file's prefs are refused, others go through.
+	_, err = b.EditPrefs(&ipn.MaskedPrefs{
+		Prefs:        ipn.Prefs{ShieldsUp: false},
+		ShieldsUpSet: true,
+	})
+	if err == nil || !strings.Contains(err.Error(), "ShieldsUp set by config file /etc/tailscaled.conf") {
+		t.Errorf("editing ShieldsUp: error = %v; want config file conflict", err)
+	}
+	if _, err := b.EditPrefs(&ipn.MaskedPrefs{
+		Prefs:       ipn.Prefs{RouteAll: true},
+		RouteAllSet: true,
+	}); err != nil {
+		t.Errorf("editing RouteAll: %v", err)
+	}
+
+	// Once the file no longer sets a pref, it can be changed.
+	c, err = conffile.Parse([]byte(`{"Version": "alpha0", "Prefs": {"Hostname": "db-1"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetConfigFile(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.EditPrefs(&ipn.MaskedPrefs{
+		Prefs:        ipn.Prefs{ShieldsUp: false},
+		ShieldsUpSet: true,
+	}); err != nil {
+		t.Errorf("editing ShieldsUp after reload: %v", err)
+	}
+}
+
+func TestConfigFileStart(t *testing.T) {
+	e, err := wgengine.NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	b, err := NewLocalBackend(t.Logf, "logid", new(mem.Store), nil, e, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := newMockControl(t)
+	cc.statusFunc = b.setClientStatus
+	b.SetControlClientGetterForTesting(func(opts controlclient.Options) (controlclient.Client, error) {
+		cc.mu.Lock()
+		defer cc.mu.Unlock()
+		cc.opts = opts
+		cc.persist = opts.Persist
+		return cc, nil
+	})
+
+	parse := func(s string) *conffile.Config {
+		t.Helper()
+		c, err := conffile.Parse([]byte(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Path = "/etc/tailscaled.conf"
+		return c
+	}
+	if err := b.SetConfigFile(parse(`{"Version": "alpha0", "AuthKey": "tskey-1", "Prefs": {"Hostname": "db-1"}}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A fresh start can't change the file's prefs.
+	up := ipn.NewPrefs()
+	up.Hostname = "web-1"
+	err = b.Start(ipn.Options{StateKey: ipn.GlobalDaemonStateKey, UpdatePrefs: up})
+	if err == nil || !strings.Contains(err.Error(), "Hostname set by config file /etc/tailscaled.conf") {
+		t.Fatalf("Start with conflicting prefs: error = %v; want config file conflict", err)
+	}
+	up.Hostname = "db-1"
+	if err := b.Start(ipn.Options{StateKey: ipn.GlobalDaemonStateKey, UpdatePrefs: up}); err != nil {
+		t.Fatal(err)
+	}
+	if got := cc.opts.AuthKey; got != "tskey-1" {
+		t.Errorf("control client AuthKey = %q; want the config file's", got)
+	}
+
+	// Reloads with invalid prefs or a new auth key are refused, and
+	// leave the old file in effect.
+	if err := b.SetConfigFile(parse(`{"Version": "alpha0", "AuthKey": "tskey-1", "Prefs": {"Hostname": "badhostname.tailscale."}}`)); err == nil {
+		t.Error("SetConfigFile accepted invalid prefs")
+	}
+	if err := b.SetConfigFile(parse(`{"Version": "alpha0", "AuthKey": "tskey-2", "Prefs": {"Hostname": "db-2"}}`)); err == nil {
+		t.Error("SetConfigFile accepted a new AuthKey")
+	}
+	if got := b.Prefs().Hostname; got != "db-1" {
+		t.Errorf("Hostname = %q; want db-1", got)
+	}
+	if err := b.SetConfigFile(parse(`{"Version": "alpha0", "AuthKey": "tskey-1", "Prefs": {"Hostname": "db-2"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Prefs().Hostname; got != "db-2" {
+		t.Errorf("after reload, Hostname = %q; want db-2", got)
+	}
+}
+
+func TestConfigFileExitNodeIP(t *testing.T) {
+	e, err := wgengine.NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	b, err := NewLocalBackend(t.Logf, "logid", new(mem.Store), nil, e, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.prefs = ipn.NewPrefs()
+	b.hostinfo = new(tailcfg.Hostinfo)
+
+	c, err := conffile.Parse([]byte(`{"Version": "alpha0", "Prefs": {"ExitNodeIP": "100.64.0.2"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Path = "/etc/tailscaled.conf"
+	if err := b.SetConfigFile(c); err != nil {
+		t.Fatal(err)
+	}
+
+	// The netmap resolves the file's ExitNodeIP to an ExitNodeID.
+	b.mu.Lock()
+	if err := b.applyConfigFilePrefsLocked(""); err != nil {
+		t.Fatal(err)
+	}
+	b.netMap = &netmap.NetworkMap{
+		Peers: []*tailcfg.Node{{
+			StableID:  "exit",
+			Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")},
+		}},
+	}
+	b.findExitNodeIDLocked(b.netMap)
+	b.mu.Unlock()
+	wantResolved := func(what string) {
+		t.Helper()
+		if p := b.Prefs(); p.ExitNodeID != "exit" || p.ExitNodeIP.IsValid() {
+			t.Errorf("%s: ExitNodeID, ExitNodeIP = %q, %v; want exit and none", what, p.ExitNodeID, p.ExitNodeIP)
+		}
+	}
+	wantResolved("after netmap")
+
+	// Other edits still go through, without reapplying the IP.
+	if _, err := b.EditPrefs(&ipn.MaskedPrefs{
+		Prefs:       ipn.Prefs{RouteAll: true},
+		RouteAllSet: true,
+	}); err != nil {
+		t.Errorf("editing RouteAll: %v", err)
+	}
+	wantResolved("after EditPrefs")
+
+	// Giving the file's IP is also fine, but not another one.
+	if _, err := b.EditPrefs(&ipn.MaskedPrefs{
+		Prefs:         ipn.Prefs{ExitNodeIP: netip.MustParseAddr("100.64.0.2")},
+		ExitNodeIPSet: true,
+		ExitNodeIDSet: true,
+	}); err != nil {
+		t.Errorf("editing ExitNodeIP to the file's: %v", err)
+	}
+	if _, err := b.EditPrefs(&ipn.MaskedPrefs{
+		Prefs:         ipn.Prefs{ExitNodeIP: netip.MustParseAddr("100.64.0.3")},
+		ExitNodeIPSet: true,
+		ExitNodeIDSet: true,
+	}); err == nil || !strings.Contains(err.Error(), "ExitNodeIP set by config file") {
+		t.Errorf("editing ExitNodeIP: error = %v; want config file conflict", err)
+	}
+}
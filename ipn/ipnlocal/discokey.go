@@ -0,0 +1,169 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine"
+)
+
+// discoKeyGrace is how long the previous disco key is still accepted
+// after the control server confirms a rotation, for peers whose
+// netmaps haven't caught up yet.
+const discoKeyGrace = 2 * time.Minute
+
+// persistedDiscoKey is the value stored under ipn.DiscoKeyStateKey.
+type persistedDiscoKey struct {
+	Key     key.DiscoPrivate
+	Created time.Time
+}
+
+// readDiscoKeyLocked returns the persisted disco key, or nil if there
+// is none.
+//
+// b.mu must be held.
+func (b *LocalBackend) readDiscoKeyLocked() (*persistedDiscoKey, error) {
+	bs, err := b.store.ReadState(ipn.DiscoKeyStateKey)
+	if err == ipn.ErrStateNotExist {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %v key of %v: %w", ipn.DiscoKeyStateKey, b.store, err)
+	}
+	pk := new(persistedDiscoKey)
+	if err := json.Unmarshal(bs, pk); err != nil {
+		return nil, fmt.Errorf("invalid %v key of %v: %w", ipn.DiscoKeyStateKey, b.store, err)
+	}
+	if pk.Key.IsZero() {
+		return nil, fmt.Errorf("invalid zero key stored in %v key of %v", ipn.DiscoKeyStateKey, b.store)
+	}
+	return pk, nil
+}
+
+// updateDiscoKeyLocked starts or stops persisting and rotating the
+// disco key per prefs p, which may be nil.
+//
+// When it starts, the persisted key is used in place of the one made
+// at startup if it isn't due for rotation yet, so peers that already
+// know it can keep using their paths to this node. Turning rotation
+// off keeps the current key until tailscaled restarts.
+//
+// b.mu must be held.
+func (b *LocalBackend) updateDiscoKeyLocked(p *ipn.Prefs) {
+	var every time.Duration
+	if p != nil {
+		every = p.DiscoKeyRotation
+	}
+	if every == b.discoKeyRotation {
+		return
+	}
+	b.discoKeyRotation = every
+	if b.discoKeyTimer != nil {
+		b.discoKeyTimer.Stop()
+		b.discoKeyTimer = nil
+	}
+	if every <= 0 {
+		return
+	}
+
+	pk, err := b.readDiscoKeyLocked()
+	if err != nil {
+		b.logf("disco key: %v; making a new one", err)
+	}
+	if pk == nil || time.Since(pk.Created) >= every {
+		b.rotateDiscoKeyLocked()
+		return
+	}
+	b.setDiscoKeyLocked(pk.Key)
+	b.discoKeyTimer = time.AfterFunc(time.Until(pk.Created.Add(every)), b.rotateDiscoKey)
+}
+
+// rotateDiscoKey replaces the disco key, when Prefs.DiscoKeyRotation
+// says it's due.
+func (b *LocalBackend) rotateDiscoKey() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.discoKeyRotation <= 0 {
+		return
+	}
+	b.rotateDiscoKeyLocked()
+}
+
+// rotateDiscoKeyLocked makes, persists and starts using a new disco
+// key, and schedules its replacement.
+//
+// b.mu must be held and b.discoKeyRotation must be positive.
+func (b *LocalBackend) rotateDiscoKeyLocked() {
+	pk := &persistedDiscoKey{
+		Key:     key.NewDisco(),
+		Created: time.Now(),
+	}
+	bs, err := json.Marshal(pk)
+	if err != nil {
+		panic(err) // can't happen
+	}
+	if err := b.store.WriteState(ipn.DiscoKeyStateKey, bs); err != nil {
+		// Still rotate; the key just won't outlive this run.
+		b.logf("error writing disco key to store: %v", err)
+	}
+	b.setDiscoKeyLocked(pk.Key)
+	b.discoKeyTimer = time.AfterFunc(b.discoKeyRotation, b.rotateDiscoKey)
+}
+
+// setDiscoKeyLocked makes k the disco key.
+//
+// If a control client is running, the current key may be known to
+// peers, so it's rotated out rather than replaced: it's still accepted
+// until the control server has confirmed k with a netmap, plus
+// discoKeyGrace. Otherwise k is simply sent in the next map request.
+//
+// b.mu must be held.
+func (b *LocalBackend) setDiscoKeyLocked(k key.DiscoPrivate) {
+	ig, ok := b.e.(wgengine.InternalsGetter)
+	if !ok {
+		return
+	}
+	tunWrap, magicConn, _, ok := ig.GetInternals()
+	if !ok {
+		return
+	}
+	pub := k.Public()
+	if b.cc == nil {
+		magicConn.SetDiscoPrivateKey(k)
+	} else if pub != magicConn.DiscoPublicKey() {
+		magicConn.RotateDiscoKey(k)
+		b.discoKeyPending = pub
+		go b.cc.SetDiscoPublicKey(pub)
+	}
+	tunWrap.SetDiscoKey(pub)
+}
+
+// checkDiscoKeyConfirmedLocked retires the previous disco key once
+// the control server's netmap nm shows the rotated one.
+//
+// b.mu must be held.
+func (b *LocalBackend) checkDiscoKeyConfirmedLocked(nm *netmap.NetworkMap) {
+	if b.discoKeyPending.IsZero() || nm.SelfNode == nil || nm.SelfNode.DiscoKey != b.discoKeyPending {
+		return
+	}
+	b.discoKeyPending = key.DiscoPublic{}
+	ig, ok := b.e.(wgengine.InternalsGetter)
+	if !ok {
+		return
+	}
+	if _, magicConn, _, ok := ig.GetInternals(); ok {
+		b.logf("disco key rotation confirmed by control")
+		if b.discoKeyRetireTimer != nil {
+			b.discoKeyRetireTimer.Stop()
+		}
+		b.discoKeyRetireTimer = time.AfterFunc(discoKeyGrace, magicConn.RetireOldDiscoKey)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/store/mem"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine"
+)
+
+func TestDiscoKeyPersistence(t *testing.T) {
+	store := new(mem.Store)
+	newBackend := func() *LocalBackend {
+		e, err := wgengine.NewFakeUserspaceEngine(t.Logf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(e.Close)
+		b, err := NewLocalBackend(t.Logf, "logid", store, nil, e, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	prefs := &ipn.Prefs{DiscoKeyRotation: 24 * time.Hour}
+	setPrefs := func(b *LocalBackend, p *ipn.Prefs) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.updateDiscoKeyLocked(p)
+	}
+
+	b1 := newBackend()
+	setPrefs(b1, prefs)
+	k1 := b1.e.DiscoPublicKey()
+	stored, err := b1.readDiscoKeyLocked()
+	if err != nil || stored == nil {
+		t.Fatalf("no disco key stored: %v", err)
+	}
+	if stored.Key.Public() != k1 {
+		t.Fatal("stored disco key isn't the one in use")
+	}
+	setPrefs(b1, nil)
+
+	// The next run picks up the same key.
+	b2 := newBackend()
+	setPrefs(b2, prefs)
+	if got := b2.e.DiscoPublicKey(); got != k1 {
+		t.Errorf("after restart, disco key = %v; want %v", got.ShortString(), k1.ShortString())
+	}
+	setPrefs(b2, nil)
+
+	// Once the stored key is due for rotation, a new one is used.
+	stored.Created = time.Now().Add(-25 * time.Hour)
+	bs, _ := json.Marshal(stored)
+	store.WriteState(ipn.DiscoKeyStateKey, bs)
+	b3 := newBackend()
+	setPrefs(b3, prefs)
+	if got := b3.e.DiscoPublicKey(); got == k1 {
+		t.Error("disco key wasn't rotated when due")
+	}
+	setPrefs(b3, nil)
+
+	// Without rotation set, each run gets its own key.
+	b4 := newBackend()
+	setPrefs(b4, new(ipn.Prefs))
+	if got := b4.e.DiscoPublicKey(); got == k1 || got == b3.e.DiscoPublicKey() {
+		t.Error("disco key reused without DiscoKeyRotation")
+	}
+}
+
+func TestDiscoKeyRotationConfirmed(t *testing.T) {
+	e, err := wgengine.NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	b, err := NewLocalBackend(t.Logf, "logid", new(mem.Store), nil, e, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := b.e.DiscoPublicKey()
+
+	// With a control client running, the new key waits for control.
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cc = newMockControl(t)
+	b.discoKeyRotation = time.Hour
+	b.rotateDiscoKeyLocked()
+	defer b.updateDiscoKeyLocked(nil)
+	pending := b.discoKeyPending
+	if pending.IsZero() || pending == old {
+		t.Fatalf("pending key = %v; want a new key", pending.ShortString())
+	}
+	if got := b.e.DiscoPublicKey(); got != pending {
+		t.Errorf("disco key = %v; want %v", got.ShortString(), pending.ShortString())
+	}
+
+	b.checkDiscoKeyConfirmedLocked(&netmap.NetworkMap{SelfNode: &tailcfg.Node{DiscoKey: old}})
+	if b.discoKeyPending != pending {
+		t.Error("rotation confirmed by netmap with the old key")
+	}
+	b.checkDiscoKeyConfirmedLocked(&netmap.NetworkMap{SelfNode: &tailcfg.Node{DiscoKey: pending}})
+	if !b.discoKeyPending.IsZero() {
+		t.Error("rotation not confirmed by netmap with the new key")
+	}
+	if b.discoKeyRetireTimer == nil {
+		t.Fatal("no timer to retire the old key")
+	}
+
+	b.mu.Unlock()
+	b.Shutdown()
+	b.mu.Lock()
+	if b.discoKeyRetireTimer != nil {
+		t.Error("timer to retire the old key not stopped by Shutdown")
+	}
+}
@@ -57,6 +57,16 @@ func TestDNSConfigForNetmap(t *testing.T) {
 				Hosts:  map[dnsname.FQDN][]netip.Addr{},
 			},
 		},
+		{
+			name:  "sync_hosts_file_without_corp_dns",
+			nm:    &netmap.NetworkMap{},
+			prefs: &ipn.Prefs{SyncHostsFile: true},
+			want: &dns.Config{
+				Routes:        map[dnsname.FQDN][]*dnstype.Resolver{},
+				Hosts:         map[dnsname.FQDN][]netip.Addr{},
+				SyncHostsFile: true,
+			},
+		},
 		{
 			name: "self_name_and_peers",
 			nm: &netmap.NetworkMap{
@@ -0,0 +1,257 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/eventhook"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netmap"
+)
+
+// eventHookHTTPClient is the client URL hooks are POSTed with. It
+// doesn't follow redirects, so a hook URL can't bounce the event (and
+// its POST body) somewhere the user didn't configure.
+var eventHookHTTPClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return errors.New("event hook URLs may not redirect")
+	},
+}
+
+const (
+	// eventHookTimeout is how long an event hook may run.
+	eventHookTimeout = 30 * time.Second
+
+	// eventHookMaxPending is how many hook runs may be queued behind
+	// slow hooks before new ones are dropped.
+	eventHookMaxPending = 100
+)
+
+// eventHookRunner runs the event hooks of ipn.Prefs.EventHooks, one at
+// a time and in the order of the events, so a hook never sees a peer
+// come online after the event for it going offline again.
+type eventHookRunner struct {
+	logf  logger.Logf
+	dir   string // where exec hooks are; empty if there's no var root
+	hooks []*eventhook.Hook
+
+	mu      sync.Mutex
+	pending []eventHookRun
+	running bool           // whether run is running
+	runDone sync.WaitGroup // for tests
+}
+
+// eventHookRun is an event to run a hook for.
+type eventHookRun struct {
+	hook *eventhook.Hook
+	ev   apitype.HistoryEvent
+}
+
+// updateEventHooksLocked sets the event hooks to run per prefs p, which
+// may be nil. The hooks are only rebuilt when p.EventHooks changes.
+//
+// b.mu must be held.
+func (b *LocalBackend) updateEventHooksLocked(p *ipn.Prefs) {
+	var specs []string
+	if p != nil {
+		specs = p.EventHooks
+	}
+	if slices.Equal(specs, b.eventHookSpecs) {
+		return
+	}
+	b.eventHookSpecs = append([]string(nil), specs...)
+
+	var hooks []*eventhook.Hook
+	for _, s := range specs {
+		h, err := eventhook.Parse(s)
+		if err != nil {
+			b.logf("event hooks: %v", err)
+			continue
+		}
+		hooks = append(hooks, h)
+	}
+	if len(hooks) == 0 {
+		b.eventHooks = nil
+		return
+	}
+	var dir string
+	if root := b.TailscaleVarRoot(); root != "" {
+		dir = filepath.Join(root, "hooks")
+	}
+	// Hooks already queued run with the runner they were queued on.
+	b.eventHooks = &eventHookRunner{logf: b.logf, dir: dir, hooks: hooks}
+}
+
+// peerOnlineEvents returns the eventhook.PeerOnline and
+// eventhook.PeerOffline events for the peers in both old and nm whose
+// online status changed. Peers whose status the control server
+// doesn't report aren't considered.
+func peerOnlineEvents(now time.Time, old, nm *netmap.NetworkMap) []apitype.HistoryEvent {
+	if old == nil || nm == nil {
+		return nil
+	}
+	oldPeers := make(map[tailcfg.StableNodeID]*tailcfg.Node, len(old.Peers))
+	for _, p := range old.Peers {
+		oldPeers[p.StableID] = p
+	}
+	var evs []apitype.HistoryEvent
+	for _, p := range nm.Peers {
+		op, ok := oldPeers[p.StableID]
+		if !ok || op.Online == nil || p.Online == nil || *op.Online == *p.Online {
+			continue
+		}
+		ev := apitype.HistoryEvent{
+			Time:   now,
+			Type:   eventhook.PeerOffline,
+			Node:   historyNodeName(p),
+			NodeID: p.StableID,
+			Old:    "online",
+			New:    "offline",
+		}
+		if *p.Online {
+			ev.Type = eventhook.PeerOnline
+			ev.Old, ev.New = ev.New, ev.Old
+		}
+		evs = append(evs, ev)
+	}
+	return evs
+}
+
+// runsFor returns the hook runs for evs, changes that resulted in the
+// netmap nm. Events of types no hook runs for are ignored.
+func (r *eventHookRunner) runsFor(nm *netmap.NetworkMap, evs []apitype.HistoryEvent) []eventHookRun {
+	var runs []eventHookRun
+	for _, ev := range evs {
+		for _, h := range r.hooks {
+			if !h.Runs(ev.Type) || !hookMatchesPeer(h, nm, ev.NodeID) {
+				continue
+			}
+			runs = append(runs, eventHookRun{h, ev})
+		}
+	}
+	return runs
+}
+
+// hookMatchesPeer reports whether h runs for events about the peer
+// with ID id in nm.
+func hookMatchesPeer(h *eventhook.Hook, nm *netmap.NetworkMap, id tailcfg.StableNodeID) bool {
+	if len(h.Peers) == 0 {
+		return true
+	}
+	n, ok := nm.PeerWithStableID(id)
+	if !ok {
+		return false
+	}
+	for _, s := range h.Peers {
+		if peerMatches(n, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// queue queues runs to be run after those already queued. It doesn't
+// block on them running.
+func (r *eventHookRunner) queue(runs []eventHookRun) {
+	if len(runs) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n := len(r.pending) + len(runs) - eventHookMaxPending; n > 0 {
+		r.logf("event hooks: too many pending; dropping %d", n)
+		runs = runs[:len(runs)-n]
+	}
+	r.pending = append(r.pending, runs...)
+	if !r.running {
+		r.running = true
+		r.runDone.Add(1)
+		go r.run()
+	}
+}
+
+// run runs the pending hooks until there are no more.
+func (r *eventHookRunner) run() {
+	defer r.runDone.Done()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for len(r.pending) > 0 {
+		hr := r.pending[0]
+		r.pending = r.pending[1:]
+
+		r.mu.Unlock()
+		if err := r.runHook(hr.hook, hr.ev); err != nil {
+			r.logf("event hooks: %s %s: %v", hr.ev.Type, hr.ev.Node, err)
+		}
+		r.mu.Lock()
+	}
+	r.running = false
+}
+
+// runHook runs h for ev.
+//
+// Exec hooks get ev as JSON on stdin as well as in the environment
+// variables TS_EVENT, TS_PEER, TS_PEER_ID, TS_OLD and TS_NEW. URL
+// hooks get it POSTed as JSON.
+func (r *eventHookRunner) runHook(h *eventhook.Hook, ev apitype.HistoryEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), eventHookTimeout)
+	defer cancel()
+
+	if h.URL != "" {
+		req, err := http.NewRequestWithContext(ctx, "POST", h.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		res, err := eventHookHTTPClient.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode/100 != 2 {
+			return fmt.Errorf("%s: %s", h.URL, res.Status)
+		}
+		return nil
+	}
+
+	if r.dir == "" {
+		return errors.New("exec hooks need a state directory")
+	}
+	cmd := exec.CommandContext(ctx, filepath.Join(r.dir, h.Exec))
+	cmd.Env = append(os.Environ(),
+		"TS_EVENT="+ev.Type,
+		"TS_PEER="+ev.Node,
+		"TS_PEER_ID="+string(ev.NodeID),
+		"TS_OLD="+ev.Old,
+		"TS_NEW="+ev.New,
+	)
+	cmd.Stdin = bytes.NewReader(body)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if len(out) > 200 {
+			out = out[:200]
+		}
+		return fmt.Errorf("%s: %v; output: %q", h.Exec, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/eventhook"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+func TestPeerOnlineEvents(t *testing.T) {
+	now := time.Unix(1660000000, 0)
+	node := func(id string, online *bool) *tailcfg.Node {
+		return &tailcfg.Node{StableID: tailcfg.StableNodeID(id), Name: id + ".example.ts.net.", Online: online}
+	}
+	yes, no := new(bool), new(bool)
+	*yes = true
+	old := &netmap.NetworkMap{Peers: []*tailcfg.Node{
+		node("a", no),
+		node("b", yes),
+		node("c", yes),
+		node("d", nil),
+	}}
+	nm := &netmap.NetworkMap{Peers: []*tailcfg.Node{
+		node("a", yes),
+		node("b", no),
+		node("c", yes),
+		node("d", yes), // unknown before
+		node("e", yes), // new peer
+	}}
+	want := []apitype.HistoryEvent{
+		{Time: now, Type: "peer-online", Node: "a.example.ts.net", NodeID: "a", Old: "offline", New: "online"},
+		{Time: now, Type: "peer-offline", Node: "b.example.ts.net", NodeID: "b", Old: "online", New: "offline"},
+	}
+	if got := peerOnlineEvents(now, old, nm); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestEventHookRuns(t *testing.T) {
+	mustParse := func(s string) *eventhook.Hook {
+		h, err := eventhook.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	all := mustParse("*=exec:all")
+	nas := mustParse("peer-online+peer-offline@nas=exec:nas")
+	r := &eventHookRunner{hooks: []*eventhook.Hook{all, nas}}
+	nm := &netmap.NetworkMap{Peers: []*tailcfg.Node{
+		{StableID: "n1", Name: "nas.example.ts.net.", ComputedName: "nas"},
+		{StableID: "n2", Name: "web.example.ts.net.", ComputedName: "web"},
+	}}
+	evs := []apitype.HistoryEvent{
+		{Type: "peer-online", NodeID: "n1"},
+		{Type: "routes-changed", NodeID: "n1"},
+		{Type: "peer-offline", NodeID: "n2"},
+		{Type: "key-rotated", NodeID: "n2"},
+	}
+	want := []eventHookRun{
+		{all, evs[0]},
+		{nas, evs[0]},
+		{all, evs[1]},
+		{all, evs[2]},
+	}
+	if got := r.runsFor(nm, evs); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestEventHookURL(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		got []apitype.HistoryEvent
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev apitype.HistoryEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		got = append(got, ev)
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	h, err := eventhook.Parse("*=" + ts.URL + "/hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &eventHookRunner{logf: t.Logf, hooks: []*eventhook.Hook{h}}
+	want := []apitype.HistoryEvent{
+		{Type: "peer-offline", Node: "nas", NodeID: "n1", Old: "online", New: "offline"},
+		{Type: "peer-online", Node: "nas", NodeID: "n1", Old: "offline", New: "online"},
+	}
+	r.queue([]eventHookRun{{h, want[0]}})
+	r.queue([]eventHookRun{{h, want[1]}})
+	r.runDone.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestEventHookURLNoRedirect(t *testing.T) {
+	var redirected atomic.Bool
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirected.Store(true)
+	}))
+	defer target.Close()
+	ts := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusTemporaryRedirect))
+	defer ts.Close()
+
+	h, err := eventhook.Parse("*=" + ts.URL + "/hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &eventHookRunner{logf: t.Logf, hooks: []*eventhook.Hook{h}}
+	if err := r.runHook(h, apitype.HistoryEvent{Type: "peer-online"}); err == nil {
+		t.Error("runHook succeeded; want redirect error")
+	}
+	if redirected.Load() {
+		t.Error("event hook followed a redirect")
+	}
+}
+
+func TestUpdateEventHooks(t *testing.T) {
+	b := &LocalBackend{logf: t.Logf}
+	prefs := func(hooks ...string) *ipn.Prefs {
+		p := ipn.NewPrefs()
+		p.EventHooks = hooks
+		return p
+	}
+
+	b.updateEventHooksLocked(prefs("*=exec:a"))
+	r := b.eventHooks
+	if r == nil || len(r.hooks) != 1 {
+		t.Fatalf("eventHooks = %+v; want one hook", r)
+	}
+	b.updateEventHooksLocked(prefs("*=exec:a"))
+	if b.eventHooks != r {
+		t.Error("unchanged EventHooks rebuilt the hooks")
+	}
+	b.updateEventHooksLocked(prefs("*=exec:a", "peer-online=exec:b"))
+	if b.eventHooks == r || len(b.eventHooks.hooks) != 2 {
+		t.Errorf("eventHooks = %+v; want rebuilt with two hooks", b.eventHooks)
+	}
+	b.updateEventHooksLocked(nil)
+	if b.eventHooks != nil {
+		t.Errorf("eventHooks = %+v; want nil", b.eventHooks)
+	}
+}
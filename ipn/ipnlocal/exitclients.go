@@ -0,0 +1,432 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/net/packet"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/net/tstun"
+	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/filter"
+)
+
+// exitClientIdle is how long a peer can go without sending traffic
+// through this exit node before its session ends.
+const exitClientIdle = 5 * time.Minute
+
+// exitClientSweep is how often idle sessions and stale approvals are
+// looked for. It's also the precision of ipn.ExitNodeClient.LastActive.
+const exitClientSweep = exitClientIdle / 5
+
+// exitClientApprovalTTL is how long an approval or denial is kept
+// after it was made or the peer was last active, whichever is later.
+const exitClientApprovalTTL = 24 * time.Hour
+
+// exitClientTracker tracks the peers using this node as an exit node,
+// and holds back the traffic of those not yet approved when approval
+// is required.
+//
+// The packet hooks run for every exit packet, so they don't take mu:
+// they read the config and sessions from copy-on-write snapshots, and
+// count into atomics. Activity is only noted, and the time recorded
+// by the next sweep.
+type exitClientTracker struct {
+	// lookup fills in the identity of the peer at c.IP. notify sends
+	// frontends an update about c. Both are called without mu held.
+	lookup func(c *ipn.ExitNodeClient)
+	notify func(c ipn.ExitNodeClient)
+
+	localRoutes atomic.Pointer[[]netip.Prefix] // advertised routes other than the exit routes
+	clients     atomic.Pointer[map[netip.Addr]*exitClient]
+
+	mu              sync.Mutex // guards the fields below and writes to clients
+	requireApproval bool
+	approved        map[netip.Addr]exitClientApproval // by peer IP
+	sweep           *time.Timer                       // ends idle sessions; nil if there are none
+}
+
+// exitClientApproval is a decision about a peer using this node as an
+// exit node.
+type exitClientApproval struct {
+	approved bool      // or else denied
+	at       time.Time // when decided or last used, for expiry
+}
+
+// exitClient is a session of a peer using this node as an exit node.
+type exitClient struct {
+	blocked atomic.Bool  // whether its traffic is dropped (pending or denied)
+	active  atomic.Bool  // whether it's sent traffic since the last sweep
+	rx, tx  atomic.Int64 // bytes
+
+	// info is the session's state other than its byte counts. It's
+	// guarded by exitClientTracker.mu.
+	info ipn.ExitNodeClient
+}
+
+// snapshotLocked returns the current state of c.
+//
+// t.mu must be held.
+func (c *exitClient) snapshotLocked() ipn.ExitNodeClient {
+	ret := c.info
+	ret.RxBytes, ret.TxBytes = c.rx.Load(), c.tx.Load()
+	return ret
+}
+
+func newExitClientTracker(lookup func(*ipn.ExitNodeClient), notify func(ipn.ExitNodeClient)) *exitClientTracker {
+	t := &exitClientTracker{
+		lookup:   lookup,
+		notify:   notify,
+		approved: map[netip.Addr]exitClientApproval{},
+	}
+	t.localRoutes.Store(new([]netip.Prefix))
+	t.clients.Store(&map[netip.Addr]*exitClient{})
+	return t
+}
+
+// setConfig sets whether clients need approval and which of this
+// node's advertised routes are subnets rather than exit routes, whose
+// traffic isn't exit traffic. Frontends are notified of any sessions
+// whose approval changed in the background, so it can be called with
+// LocalBackend.mu held.
+func (t *exitClientTracker) setConfig(requireApproval bool, routes []netip.Prefix) {
+	var local []netip.Prefix
+	for _, r := range routes {
+		if r.Bits() != 0 {
+			local = append(local, r)
+		}
+	}
+	t.localRoutes.Store(&local)
+	t.mu.Lock()
+	t.requireApproval = requireApproval
+	changed := t.updateApprovalLocked()
+	t.mu.Unlock()
+	if len(changed) > 0 {
+		go func() {
+			for _, c := range changed {
+				t.notify(c)
+			}
+		}()
+	}
+}
+
+// setApproved approves or denies the peer at ips using this node as
+// an exit node.
+func (t *exitClientTracker) setApproved(ips []netip.Addr, approved bool) {
+	now := time.Now()
+	t.mu.Lock()
+	t.expireApprovalsLocked(now)
+	for _, ip := range ips {
+		t.approved[ip] = exitClientApproval{approved: approved, at: now}
+	}
+	changed := t.updateApprovalLocked()
+	t.mu.Unlock()
+	for _, c := range changed {
+		t.notify(c)
+	}
+}
+
+// expireApprovalsLocked forgets the approvals that have outlived
+// exitClientApprovalTTL.
+//
+// t.mu must be held.
+func (t *exitClientTracker) expireApprovalsLocked(now time.Time) {
+	clients := *t.clients.Load()
+	for ip, a := range t.approved {
+		if c, ok := clients[ip]; ok && a.at.Before(c.info.LastActive) {
+			a.at = c.info.LastActive
+			t.approved[ip] = a
+		}
+		if now.Sub(a.at) > exitClientApprovalTTL {
+			delete(t.approved, ip)
+		}
+	}
+}
+
+// updateApprovalLocked updates the approval state of the current
+// sessions, returning those that changed.
+//
+// t.mu must be held.
+func (t *exitClientTracker) updateApprovalLocked() (changed []ipn.ExitNodeClient) {
+	for ip, c := range *t.clients.Load() {
+		pending, denied := t.approvalLocked(ip)
+		if c.info.Pending != pending || c.info.Denied != denied {
+			c.info.Pending, c.info.Denied = pending, denied
+			c.blocked.Store(pending || denied)
+			changed = append(changed, c.snapshotLocked())
+		}
+	}
+	return changed
+}
+
+// approvalLocked returns whether the peer at ip is waiting for approval
+// or has been denied.
+//
+// t.mu must be held.
+func (t *exitClientTracker) approvalLocked(ip netip.Addr) (pending, denied bool) {
+	if !t.requireApproval {
+		return false, false
+	}
+	a, ok := t.approved[ip]
+	return !ok, ok && !a.approved
+}
+
+// isExitDst reports whether traffic to dst from a peer is going
+// through this node as an exit node, rather than to this node or one
+// of its subnet routes.
+func (t *exitClientTracker) isExitDst(dst netip.Addr) bool {
+	if !dst.IsGlobalUnicast() || tsaddr.IsTailscaleIP(dst) {
+		return false
+	}
+	for _, r := range *t.localRoutes.Load() {
+		if r.Contains(dst) {
+			return false
+		}
+	}
+	return true
+}
+
+// in is the packet hook for packets from peers.
+func (t *exitClientTracker) in(p *packet.Parsed, _ *tstun.Wrapper) filter.Response {
+	src := p.Src.Addr()
+	if !tsaddr.IsTailscaleIP(src) || !t.isExitDst(p.Dst.Addr()) {
+		return filter.Accept
+	}
+	c := (*t.clients.Load())[src]
+	if c == nil {
+		c = t.start(src)
+	}
+	if !c.active.Load() {
+		c.active.Store(true)
+	}
+	if c.blocked.Load() {
+		return filter.Drop
+	}
+	c.rx.Add(int64(len(p.Buffer())))
+	return filter.Accept
+}
+
+// out is the packet hook for packets to peers.
+func (t *exitClientTracker) out(p *packet.Parsed, _ *tstun.Wrapper) filter.Response {
+	dst := p.Dst.Addr()
+	if !tsaddr.IsTailscaleIP(dst) {
+		return filter.Accept
+	}
+	c := (*t.clients.Load())[dst]
+	if c == nil || c.blocked.Load() || !t.isExitDst(p.Src.Addr()) {
+		return filter.Accept
+	}
+	if !c.active.Load() {
+		c.active.Store(true)
+	}
+	c.tx.Add(int64(len(p.Buffer())))
+	return filter.Accept
+}
+
+// start returns the session of the peer at ip, starting it if needed.
+func (t *exitClientTracker) start(ip netip.Addr) *exitClient {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old := *t.clients.Load()
+	if c := old[ip]; c != nil {
+		return c // started concurrently
+	}
+	now := time.Now()
+	c := &exitClient{info: ipn.ExitNodeClient{IP: ip, Started: now, LastActive: now}}
+	c.info.Pending, c.info.Denied = t.approvalLocked(ip)
+	c.blocked.Store(c.info.Pending || c.info.Denied)
+	clients := make(map[netip.Addr]*exitClient, len(old)+1)
+	for k, v := range old {
+		clients[k] = v
+	}
+	clients[ip] = c
+	t.clients.Store(&clients)
+	if t.sweep == nil {
+		t.sweep = time.AfterFunc(exitClientSweep, t.endIdle)
+	}
+	go t.started(ip)
+	return c
+}
+
+// started looks up the peer of the new session from ip and notifies
+// frontends of it.
+func (t *exitClientTracker) started(ip netip.Addr) {
+	id := ipn.ExitNodeClient{IP: ip}
+	t.lookup(&id)
+	t.mu.Lock()
+	c := (*t.clients.Load())[ip]
+	if c == nil {
+		t.mu.Unlock()
+		return
+	}
+	c.info.NodeID, c.info.Name, c.info.User = id.NodeID, id.Name, id.User
+	snap := c.snapshotLocked()
+	t.mu.Unlock()
+	t.notify(snap)
+}
+
+// endIdle records the activity of sessions since the last sweep and
+// ends those that have been idle for exitClientIdle.
+func (t *exitClientTracker) endIdle() {
+	now := time.Now()
+	var ended []ipn.ExitNodeClient
+	t.mu.Lock()
+	old := *t.clients.Load()
+	clients := make(map[netip.Addr]*exitClient, len(old))
+	for ip, c := range old {
+		if c.active.Swap(false) {
+			c.info.LastActive = now
+		}
+		if now.Sub(c.info.LastActive) >= exitClientIdle {
+			c.info.Ended = true
+			ended = append(ended, c.snapshotLocked())
+			continue
+		}
+		clients[ip] = c
+	}
+	t.clients.Store(&clients)
+	t.expireApprovalsLocked(now)
+	if len(clients) > 0 {
+		t.sweep.Reset(exitClientSweep)
+	} else {
+		t.sweep = nil
+	}
+	t.mu.Unlock()
+	for _, c := range ended {
+		t.notify(c)
+	}
+}
+
+// stop ends all sessions, without notifying frontends.
+func (t *exitClientTracker) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sweep != nil {
+		t.sweep.Stop()
+		t.sweep = nil
+	}
+	t.clients.Store(&map[netip.Addr]*exitClient{})
+}
+
+// list returns the current sessions, oldest first.
+func (t *exitClientTracker) list() []ipn.ExitNodeClient {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	clients := *t.clients.Load()
+	ret := make([]ipn.ExitNodeClient, 0, len(clients))
+	for _, c := range clients {
+		snap := c.snapshotLocked()
+		if c.active.Load() {
+			snap.LastActive = now
+		}
+		ret = append(ret, snap)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Started.Before(ret[j].Started) })
+	return ret
+}
+
+// updateExitClientsLocked starts or stops tracking exit node clients
+// per whether prefs p advertise this node as an exit node.
+//
+// b.mu must be held.
+func (b *LocalBackend) updateExitClientsLocked(p *ipn.Prefs) {
+	if p == nil || !p.AdvertisesExitNode() {
+		if b.removeExitClientHook != nil {
+			b.removeExitClientHook()
+			b.removeExitClientHook = nil
+		}
+		if b.exitClients != nil {
+			b.exitClients.stop()
+		}
+		return
+	}
+	t := b.exitClientsLocked()
+	t.setConfig(p.ExitNodeClientApproval, p.AdvertiseRoutes)
+	if b.removeExitClientHook != nil {
+		return
+	}
+	ig, ok := b.e.(wgengine.InternalsGetter)
+	if !ok {
+		return
+	}
+	tunWrap, _, _, ok := ig.GetInternals()
+	if !ok {
+		return
+	}
+	remove, err := tunWrap.AddPacketHook(tstun.PacketHook{
+		Version: tstun.PacketHookVersion,
+		Name:    "exitclients",
+		Stage:   tstun.HookPostFilter,
+		In:      t.in,
+		Out:     t.out,
+	})
+	if err != nil {
+		b.logf("exit node clients: %v", err)
+		return
+	}
+	b.removeExitClientHook = remove
+}
+
+// exitClientsLocked returns b.exitClients, creating it if needed.
+//
+// b.mu must be held.
+func (b *LocalBackend) exitClientsLocked() *exitClientTracker {
+	if b.exitClients == nil {
+		b.exitClients = newExitClientTracker(b.lookupExitNodeClient, func(c ipn.ExitNodeClient) {
+			b.send(ipn.Notify{ExitNodeClient: &c})
+		})
+	}
+	return b.exitClients
+}
+
+// lookupExitNodeClient fills in the identity of the peer at c.IP.
+func (b *LocalBackend) lookupExitNodeClient(c *ipn.ExitNodeClient) {
+	n, u, ok := b.WhoIs(netip.AddrPortFrom(c.IP, 0))
+	if !ok {
+		return
+	}
+	c.NodeID = n.StableID
+	c.Name = n.Name
+	c.User = u.LoginName
+}
+
+// ExitNodeClients returns the peers currently using this node as an
+// exit node, or waiting for approval to, oldest first.
+func (b *LocalBackend) ExitNodeClients() []ipn.ExitNodeClient {
+	b.mu.Lock()
+	t := b.exitClients
+	b.mu.Unlock()
+	if t == nil {
+		return nil
+	}
+	return t.list()
+}
+
+// SetExitNodeClientApproval approves or denies the peer at ip, and
+// its other Tailscale IPs, using this node as an exit node when
+// Prefs.ExitNodeClientApproval requires it. Decisions last until
+// tailscaled restarts or for exitClientApprovalTTL after the peer was
+// last active, whichever is sooner.
+func (b *LocalBackend) SetExitNodeClientApproval(ip netip.Addr, approved bool) {
+	ips := []netip.Addr{ip}
+	b.mu.Lock()
+	if n, ok := b.nodeByAddr[ip]; ok {
+		for _, a := range n.Addresses {
+			if a.IsSingleIP() && a.Addr() != ip {
+				ips = append(ips, a.Addr())
+			}
+		}
+	}
+	t := b.exitClientsLocked()
+	b.mu.Unlock()
+	t.setApproved(ips, approved)
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/net/packet"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/wgengine/filter"
+)
+
+func udp4(src, dst string) *packet.Parsed {
+	b := packet.Generate(packet.UDP4Header{
+		IP4Header: packet.IP4Header{
+			IPProto: ipproto.UDP,
+			Src:     netip.MustParseAddr(src),
+			Dst:     netip.MustParseAddr(dst),
+		},
+		SrcPort: 1234,
+		DstPort: 53,
+	}, []byte("payload"))
+	p := new(packet.Parsed)
+	p.Decode(b)
+	return p
+}
+
+func TestExitClientTracker(t *testing.T) {
+	var mu sync.Mutex
+	var notes []ipn.ExitNodeClient
+	notified := make(chan bool, 10)
+	tr := newExitClientTracker(func(c *ipn.ExitNodeClient) {
+		c.Name = "peer.example.ts.net."
+	}, func(c ipn.ExitNodeClient) {
+		mu.Lock()
+		notes = append(notes, c)
+		mu.Unlock()
+		notified <- true
+	})
+	defer tr.stop()
+	tr.setConfig(false, []netip.Prefix{
+		netip.MustParsePrefix("0.0.0.0/0"),
+		netip.MustParsePrefix("::/0"),
+		netip.MustParsePrefix("192.168.1.0/24"),
+	})
+
+	const peer = "100.64.0.2"
+	for _, dst := range []string{"100.64.0.1", "192.168.1.5", "224.0.0.251"} {
+		if res := tr.in(udp4(peer, dst), nil); res != filter.Accept {
+			t.Errorf("packet to %s: %v; want accepted", dst, res)
+		}
+	}
+	if got := tr.list(); len(got) != 0 {
+		t.Fatalf("non-exit traffic started sessions: %+v", got)
+	}
+
+	in := udp4(peer, "8.8.8.8")
+	if res := tr.in(in, nil); res != filter.Accept {
+		t.Fatalf("exit packet: %v; want accepted", res)
+	}
+	<-notified
+	out := udp4("8.8.8.8", peer)
+	tr.out(out, nil)
+	tr.out(out, nil)
+
+	got := tr.list()
+	if len(got) != 1 {
+		t.Fatalf("got %d sessions; want 1", len(got))
+	}
+	c := got[0]
+	if c.IP != netip.MustParseAddr(peer) || c.Name != "peer.example.ts.net." || c.Pending {
+		t.Errorf("session = %+v", c)
+	}
+	if want := int64(len(in.Buffer())); c.RxBytes != want {
+		t.Errorf("RxBytes = %d; want %d", c.RxBytes, want)
+	}
+	if want := 2 * int64(len(out.Buffer())); c.TxBytes != want {
+		t.Errorf("TxBytes = %d; want %d", c.TxBytes, want)
+	}
+	mu.Lock()
+	if len(notes) != 1 || notes[0].Name == "" {
+		t.Errorf("notifications = %+v; want one with the peer's name", notes)
+	}
+	mu.Unlock()
+}
+
+func TestExitClientTrackerApproval(t *testing.T) {
+	notified := make(chan ipn.ExitNodeClient, 10)
+	tr := newExitClientTracker(func(*ipn.ExitNodeClient) {}, func(c ipn.ExitNodeClient) {
+		notified <- c
+	})
+	defer tr.stop()
+	tr.setConfig(true, []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")})
+
+	const peer = "100.64.0.2"
+	p := udp4(peer, "1.1.1.1")
+	if res := tr.in(p, nil); !res.IsDrop() {
+		t.Fatalf("unapproved packet: %v; want dropped", res)
+	}
+	if c := <-notified; !c.Pending {
+		t.Errorf("first notification = %+v; want pending", c)
+	}
+	if res := tr.in(p, nil); !res.IsDrop() {
+		t.Fatalf("second unapproved packet: %v; want dropped", res)
+	}
+
+	tr.setApproved([]netip.Addr{netip.MustParseAddr(peer)}, true)
+	if c := <-notified; c.Pending || c.Denied {
+		t.Errorf("notification after approval = %+v; want active", c)
+	}
+	if res := tr.in(p, nil); res != filter.Accept {
+		t.Errorf("approved packet: %v; want accepted", res)
+	}
+
+	tr.setApproved([]netip.Addr{netip.MustParseAddr(peer)}, false)
+	if c := <-notified; !c.Denied {
+		t.Errorf("notification after denial = %+v; want denied", c)
+	}
+	if res := tr.in(p, nil); !res.IsDrop() {
+		t.Errorf("denied packet: %v; want dropped", res)
+	}
+
+	// Turning approval off lets everyone through.
+	tr.setConfig(false, []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")})
+	if c := <-notified; c.Denied {
+		t.Errorf("notification after disabling approval = %+v; want active", c)
+	}
+	if res := tr.in(p, nil); res != filter.Accept {
+		t.Errorf("packet without approval required: %v; want accepted", res)
+	}
+}
+
+func TestExitClientApprovalExpiry(t *testing.T) {
+	tr := newExitClientTracker(func(*ipn.ExitNodeClient) {}, func(ipn.ExitNodeClient) {})
+	defer tr.stop()
+	tr.setConfig(true, []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")})
+
+	old, cur := netip.MustParseAddr("100.64.0.2"), netip.MustParseAddr("100.64.0.3")
+	tr.setApproved([]netip.Addr{old}, true)
+	tr.mu.Lock()
+	tr.approved[old] = exitClientApproval{approved: true, at: time.Now().Add(-exitClientApprovalTTL - time.Minute)}
+	tr.mu.Unlock()
+	tr.setApproved([]netip.Addr{cur}, true)
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if _, ok := tr.approved[old]; ok {
+		t.Error("stale approval not expired")
+	}
+	if _, ok := tr.approved[cur]; !ok {
+		t.Error("fresh approval expired")
+	}
+}
+
+func BenchmarkExitClientTracker(b *testing.B) {
+	tr := newExitClientTracker(func(*ipn.ExitNodeClient) {}, func(ipn.ExitNodeClient) {})
+	defer tr.stop()
+	tr.setConfig(false, []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")})
+	p := udp4("100.64.0.2", "8.8.8.8")
+	tr.in(p, nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			tr.in(p, nil)
+		}
+	})
+}
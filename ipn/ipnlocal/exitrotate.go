@@ -0,0 +1,224 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"net/netip"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine/wgcfg"
+)
+
+// exitSpreadBits is the prefix length of the slices of the IPv4 and
+// IPv6 address spaces that Prefs.ExitNodeRotation spreads across exit
+// nodes when it isn't rotating on a schedule.
+const exitSpreadBits = 8
+
+// exitRotationUnavailable is the exit node ID used when none of the
+// nodes in Prefs.ExitNodeRotation is in the netmap, so that internet
+// traffic is blackholed, as for an ExitNodeID that's not in the
+// netmap, rather than leaking to the local network.
+const exitRotationUnavailable tailcfg.StableNodeID = "exit-rotation-unavailable"
+
+// exitRotationCandidates returns the peers in nm named by names, as in
+// Prefs.ExitNodeRotation, that offer to be exit nodes, in the order of
+// names. Offline ones are left out, unless all of them are offline.
+func exitRotationCandidates(nm *netmap.NetworkMap, names []string) []*tailcfg.Node {
+	var online, all []*tailcfg.Node
+	seen := map[tailcfg.StableNodeID]bool{}
+	for _, s := range names {
+		for _, n := range nm.Peers {
+			if seen[n.StableID] || !peerMatches(n, s) || !tsaddr.ContainsExitRoutes(n.AllowedIPs) {
+				continue
+			}
+			seen[n.StableID] = true
+			all = append(all, n)
+			if n.Online == nil || *n.Online {
+				online = append(online, n)
+			}
+			break
+		}
+	}
+	if len(online) > 0 {
+		return online
+	}
+	return all
+}
+
+// scheduledExitNode returns the node among cands, which must be
+// non-empty, to use as the exit node at now when rotating every
+// interval, and when the next one is due. The schedule is based on
+// wall time, so it's the same across restarts.
+func scheduledExitNode(cands []*tailcfg.Node, every time.Duration, now time.Time) (n *tailcfg.Node, next time.Time) {
+	slot := now.UnixNano() / int64(every)
+	return cands[slot%int64(len(cands))], time.Unix(0, (slot+1)*int64(every))
+}
+
+// exitRotationPrefs returns prefs with ExitNodeID set to the exit node
+// that Prefs.ExitNodeRotation selects in nm, and the exit nodes to
+// spread traffic across, or prefs itself and nil if there's no
+// rotation. When rotating on a schedule, it arranges for authReconfig
+// to run again when the next exit node is due.
+func (b *LocalBackend) exitRotationPrefs(prefs *ipn.Prefs, nm *netmap.NetworkMap) (*ipn.Prefs, []*tailcfg.Node) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.exitRotateTimer != nil {
+		b.exitRotateTimer.Stop()
+		b.exitRotateTimer = nil
+	}
+	old := b.exitRotationNodes
+	b.exitRotationNodes = nil
+	if len(prefs.ExitNodeRotation) == 0 {
+		return prefs, nil
+	}
+
+	cands := exitRotationCandidates(nm, prefs.ExitNodeRotation)
+	prefs = prefs.Clone()
+	prefs.ExitNodeIP = netip.Addr{}
+	switch {
+	case len(cands) == 0:
+		prefs.ExitNodeID = exitRotationUnavailable
+	case prefs.ExitNodeRotateEvery > 0:
+		n, next := scheduledExitNode(cands, prefs.ExitNodeRotateEvery, time.Now())
+		prefs.ExitNodeID = n.StableID
+		cands = cands[:0:0]
+		cands = append(cands, n)
+		if !b.shutdownCalled {
+			b.exitRotateTimer = time.AfterFunc(time.Until(next), b.authReconfig)
+		}
+	default:
+		prefs.ExitNodeID = cands[0].StableID
+	}
+	for _, n := range cands {
+		b.exitRotationNodes = append(b.exitRotationNodes, n.StableID)
+	}
+	if !equalStableIDs(old, b.exitRotationNodes) {
+		b.logf("exit node rotation: using %v", b.exitRotationNodes)
+	}
+	return prefs, cands
+}
+
+// exitNodeIDLocked returns the exit node in use: the one chosen by
+// Prefs.ExitNodeRotation, or the first of them if traffic is spread
+// across several, or else Prefs.ExitNodeID.
+//
+// b.mu must be held.
+func (b *LocalBackend) exitNodeIDLocked() tailcfg.StableNodeID {
+	if len(b.exitRotationNodes) > 0 {
+		return b.exitRotationNodes[0]
+	}
+	if b.prefs == nil {
+		return ""
+	}
+	return b.prefs.ExitNodeID
+}
+
+// isExitNodeLocked reports whether id is an exit node in use.
+//
+// b.mu must be held.
+func (b *LocalBackend) isExitNodeLocked(id tailcfg.StableNodeID) bool {
+	if id == "" {
+		return false
+	}
+	for _, n := range b.exitRotationNodes {
+		if n == id {
+			return true
+		}
+	}
+	return id == b.exitNodeIDLocked()
+}
+
+// spreadExitRoutes splits the default routes in cfg, which nmcfg gave
+// to the first of cands, across all of cands that are in cfg, each
+// getting an equal share of the address space. Traffic is spread per
+// destination, not per connection. A destination only moves to another
+// exit node when cands changes, so connections stick to theirs.
+//
+// Slices that a peer's subnet route already covers are left out, so
+// that the subnet router keeps them: WireGuard gives an exact prefix to
+// only one peer, and a more specific one takes over a broader route.
+func spreadExitRoutes(cfg *wgcfg.Config, cands []*tailcfg.Node) {
+	var peers []int // indexes of cands in cfg.Peers
+	for _, n := range cands {
+		for i := range cfg.Peers {
+			if cfg.Peers[i].PublicKey == n.Key {
+				peers = append(peers, i)
+				break
+			}
+		}
+	}
+	if len(peers) < 2 {
+		return
+	}
+	var has4, has6 bool
+	for i := range cfg.Peers {
+		p := &cfg.Peers[i]
+		var kept []netip.Prefix
+		for j, r := range p.AllowedIPs {
+			if r.Bits() != 0 {
+				if kept != nil {
+					kept = append(kept, r)
+				}
+				continue
+			}
+			if kept == nil {
+				kept = append([]netip.Prefix{}, p.AllowedIPs[:j]...)
+			}
+			if r.Addr().Is4() {
+				has4 = true
+			} else {
+				has6 = true
+			}
+		}
+		if kept != nil {
+			p.AllowedIPs = kept
+		}
+	}
+	var routed []netip.Prefix // peer routes that slices mustn't override
+	for _, p := range cfg.Peers {
+		for _, r := range p.AllowedIPs {
+			if r.Bits() <= exitSpreadBits {
+				routed = append(routed, r)
+			}
+		}
+	}
+	isRouted := func(slice netip.Prefix) bool {
+		for _, r := range routed {
+			if r.Contains(slice.Addr()) {
+				return true
+			}
+		}
+		return false
+	}
+	for i := 0; i < 1<<exitSpreadBits; i++ {
+		p := &cfg.Peers[peers[i%len(peers)]]
+		if has4 {
+			if s := netip.PrefixFrom(netip.AddrFrom4([4]byte{byte(i)}), exitSpreadBits); !isRouted(s) {
+				p.AllowedIPs = append(p.AllowedIPs, s)
+			}
+		}
+		if has6 {
+			if s := netip.PrefixFrom(netip.AddrFrom16([16]byte{byte(i)}), exitSpreadBits); !isRouted(s) {
+				p.AllowedIPs = append(p.AllowedIPs, s)
+			}
+		}
+	}
+}
+
+func equalStableIDs(a, b []tailcfg.StableNodeID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
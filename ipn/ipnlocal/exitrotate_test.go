@@ -0,0 +1,166 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine/wgcfg"
+)
+
+func TestExitRotationCandidates(t *testing.T) {
+	exitRoutes := []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+	yes, no := new(bool), new(bool)
+	*yes = true
+	node := func(name string, online *bool, exit bool) *tailcfg.Node {
+		n := &tailcfg.Node{StableID: tailcfg.StableNodeID(name), Name: name + ".example.ts.net.", ComputedName: name, Online: online}
+		if exit {
+			n.AllowedIPs = exitRoutes
+		}
+		return n
+	}
+	ids := func(nodes []*tailcfg.Node) (ret []string) {
+		for _, n := range nodes {
+			ret = append(ret, string(n.StableID))
+		}
+		return ret
+	}
+	nm := &netmap.NetworkMap{Peers: []*tailcfg.Node{
+		node("a", yes, true),
+		node("b", no, true),
+		node("c", nil, true),
+		node("d", yes, false), // not an exit node
+	}}
+	tests := []struct {
+		names []string
+		want  []string
+	}{
+		{[]string{"c", "a"}, []string{"c", "a"}},
+		{[]string{"a", "b", "c"}, []string{"a", "c"}},
+		{[]string{"a", "a.example.ts.net", "d", "zz"}, []string{"a"}},
+		{[]string{"b"}, []string{"b"}}, // all offline
+		{[]string{"d"}, nil},
+	}
+	for _, tt := range tests {
+		got := ids(exitRotationCandidates(nm, tt.names))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("exitRotationCandidates(%q) = %q; want %q", tt.names, got, tt.want)
+		}
+	}
+}
+
+func TestScheduledExitNode(t *testing.T) {
+	cands := []*tailcfg.Node{{StableID: "a"}, {StableID: "b"}, {StableID: "c"}}
+	every := 10 * time.Minute
+	start := time.Unix(0, 0).Add(3000 * every) // a slot for cands[0]
+	tests := []struct {
+		now      time.Time
+		want     tailcfg.StableNodeID
+		wantNext time.Time
+	}{
+		{start, "a", start.Add(every)},
+		{start.Add(every - 1), "a", start.Add(every)},
+		{start.Add(every), "b", start.Add(2 * every)},
+		{start.Add(5*every + time.Second), "c", start.Add(6 * every)},
+		{start.Add(6 * every), "a", start.Add(7 * every)},
+	}
+	for _, tt := range tests {
+		n, next := scheduledExitNode(cands, every, tt.now)
+		if n.StableID != tt.want || !next.Equal(tt.wantNext) {
+			t.Errorf("at %v: got %v, %v; want %v, %v", tt.now.Sub(start), n.StableID, next.Sub(start), tt.want, tt.wantNext.Sub(start))
+		}
+	}
+}
+
+func TestSpreadExitRoutes(t *testing.T) {
+	k1, k2, k3 := key.NewNode().Public(), key.NewNode().Public(), key.NewNode().Public()
+	subnetRouter := key.NewNode().Public()
+	self := netip.MustParsePrefix("100.64.0.1/32")
+	cfg := &wgcfg.Config{Peers: []wgcfg.Peer{
+		{PublicKey: k1, AllowedIPs: []netip.Prefix{
+			netip.MustParsePrefix("100.64.0.2/32"),
+			netip.MustParsePrefix("0.0.0.0/0"),
+			netip.MustParsePrefix("::/0"),
+		}},
+		{PublicKey: k2, AllowedIPs: []netip.Prefix{netip.MustParsePrefix("100.64.0.3/32")}},
+		{PublicKey: k3, AllowedIPs: []netip.Prefix{self}},
+		{PublicKey: subnetRouter, AllowedIPs: []netip.Prefix{
+			netip.MustParsePrefix("10.0.0.0/8"),
+			netip.MustParsePrefix("172.0.0.0/7"),
+			netip.MustParsePrefix("192.168.0.0/16"),
+		}},
+	}}
+	spreadExitRoutes(cfg, []*tailcfg.Node{{Key: k1}, {Key: k2}})
+
+	owner := func(ip string) key.NodePublic {
+		a := netip.MustParseAddr(ip)
+		// Longest prefix wins, as in WireGuard.
+		var ret key.NodePublic
+		best := -1
+		for _, p := range cfg.Peers {
+			for _, r := range p.AllowedIPs {
+				if r.Bits() == 0 {
+					t.Fatalf("peer %v still has %v", p.PublicKey.ShortString(), r)
+				}
+				if r.Contains(a) && r.Bits() > best {
+					ret, best = p.PublicKey, r.Bits()
+				}
+			}
+		}
+		return ret
+	}
+	tests := []struct {
+		ip   string
+		want key.NodePublic
+	}{
+		{"8.8.8.8", k1},
+		{"1.1.1.1", k2},
+		{"100.64.0.2", k1},
+		{"100.64.0.3", k2},
+		{"2001:db8::1", k1}, // 0x20
+		{"2101:db8::1", k2}, // 0x21
+		{"2201:db8::1", k1}, // 0x22
+		{"10.1.2.3", subnetRouter},
+		{"11.1.2.3", k2},
+		{"172.16.0.1", subnetRouter},
+		{"173.0.0.1", subnetRouter},
+		{"192.168.1.1", subnetRouter},
+		{"192.169.1.1", k1},
+	}
+	for _, tt := range tests {
+		if got := owner(tt.ip); got != tt.want {
+			t.Errorf("%v routed to %v; want %v", tt.ip, got.ShortString(), tt.want.ShortString())
+		}
+	}
+	if got := len(cfg.Peers[2].AllowedIPs); got != 1 {
+		t.Errorf("non-candidate peer has %d routes; want 1", got)
+	}
+	// WireGuard gives an exact prefix to only one peer, so none may
+	// be handed out twice.
+	seen := map[netip.Prefix]bool{}
+	for _, p := range cfg.Peers {
+		for _, r := range p.AllowedIPs {
+			if seen[r] {
+				t.Errorf("%v routed to more than one peer", r)
+			}
+			seen[r] = true
+		}
+	}
+
+	// With a single candidate, the default routes are left alone.
+	cfg = &wgcfg.Config{Peers: []wgcfg.Peer{
+		{PublicKey: k1, AllowedIPs: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")}},
+	}}
+	spreadExitRoutes(cfg, []*tailcfg.Node{{Key: k1}, {Key: k3}})
+	if got := cfg.Peers[0].AllowedIPs; len(got) != 1 || got[0].Bits() != 0 {
+		t.Errorf("single candidate: got %v", got)
+	}
+}
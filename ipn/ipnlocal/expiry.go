@@ -0,0 +1,168 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+// defaultKeyExpiryWarnings are the times before node key expiry at
+// which an ipn.Notify.KeyExpiryWarning is sent, unless changed with
+// SetKeyExpiryWarnings.
+var defaultKeyExpiryWarnings = []time.Duration{
+	7 * 24 * time.Hour,
+	24 * time.Hour,
+	time.Hour,
+	10 * time.Minute,
+}
+
+// keyExpiryWarner tracks which key expiry warnings have been sent.
+// It's guarded by LocalBackend.mu.
+type keyExpiryWarner struct {
+	thresholds []time.Duration // in decreasing order; nil means defaultKeyExpiryWarnings
+	expiry     time.Time       // node key expiry that warned is for; zero if none
+	warned     time.Duration   // smallest threshold warned about for expiry, or 0
+	timer      *time.Timer     // fires at the next warning, or nil
+}
+
+// SetKeyExpiryWarnings sets how long before node key expiry frontends
+// are sent an ipn.Notify.KeyExpiryWarning. Each threshold produces at
+// most one warning per key expiry time. A nil thresholds restores the
+// defaults; an empty, non-nil one disables warnings.
+func (b *LocalBackend) SetKeyExpiryWarnings(thresholds []time.Duration) {
+	if thresholds != nil {
+		thresholds = append([]time.Duration{}, thresholds...)
+		sort.Slice(thresholds, func(i, j int) bool { return thresholds[i] > thresholds[j] })
+	}
+	b.mu.Lock()
+	b.keyExpiryWarn.thresholds = thresholds
+	b.keyExpiryWarn.warned = 0
+	warn := b.updateKeyExpiryWarningLocked(b.keyExpiryWarn.expiry)
+	b.mu.Unlock()
+	b.sendKeyExpiryWarning(warn)
+}
+
+// updateKeyExpiryWarningLocked notes that the node key expires at
+// expiry (zero if never) and schedules the next warning. It returns a
+// warning to send now, if one is due.
+//
+// b.mu must be held.
+func (b *LocalBackend) updateKeyExpiryWarningLocked(expiry time.Time) *ipn.KeyExpiryWarning {
+	w := &b.keyExpiryWarn
+	if !expiry.Equal(w.expiry) {
+		w.expiry = expiry
+		w.warned = 0
+	}
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if expiry.IsZero() || b.shutdownCalled {
+		return nil
+	}
+	thresholds := w.thresholds
+	if thresholds == nil {
+		thresholds = defaultKeyExpiryWarnings
+	}
+	due, next := nextKeyExpiryWarning(thresholds, expiry, time.Now(), w.warned)
+	if !next.IsZero() {
+		w.timer = time.AfterFunc(time.Until(next), b.keyExpiryWarningTimerFired)
+	}
+	if due == 0 {
+		return nil
+	}
+	w.warned = due
+	return &ipn.KeyExpiryWarning{Expiry: expiry, Within: due}
+}
+
+// keyExpiryWarningTimerFired sends the key expiry warning that's now
+// due, if any. The expiry is re-read rather than captured when the
+// timer was set, as it may have changed (and the timer been stopped
+// too late) since.
+func (b *LocalBackend) keyExpiryWarningTimerFired() {
+	b.mu.Lock()
+	warn := b.updateKeyExpiryWarningLocked(b.keyExpiryWarn.expiry)
+	b.mu.Unlock()
+	b.sendKeyExpiryWarning(warn)
+}
+
+func (b *LocalBackend) sendKeyExpiryWarning(warn *ipn.KeyExpiryWarning) {
+	if warn == nil {
+		return
+	}
+	b.logf("node key expires in %v (at %v)", time.Until(warn.Expiry).Round(time.Second), warn.Expiry.Format(time.RFC3339))
+	b.send(ipn.Notify{KeyExpiryWarning: warn})
+}
+
+// nextKeyExpiryWarning returns the smallest of thresholds (which must
+// be in decreasing order) that has been reached at now for a key
+// expiring at expiry, ignoring those at or above warned if it's
+// non-zero. It also returns when the next threshold after that is
+// reached, or the zero time if there isn't one. No warnings are due
+// once the key has expired.
+func nextKeyExpiryWarning(thresholds []time.Duration, expiry, now time.Time, warned time.Duration) (due time.Duration, next time.Time) {
+	if !now.Before(expiry) {
+		return 0, time.Time{}
+	}
+	for _, t := range thresholds {
+		if warned != 0 && t >= warned {
+			continue
+		}
+		at := expiry.Add(-t)
+		if now.Before(at) {
+			return due, at
+		}
+		due = t
+	}
+	return due, time.Time{}
+}
+
+// Reauth starts re-authenticating the node to renew its node key, for
+// instance in response to an ipn.Notify.KeyExpiryWarning. If authKey is
+// non-empty, the node re-registers with it non-interactively.
+// Otherwise, an interactive login is started and its URL is sent to
+// frontends as an ipn.Notify.BrowseToURL.
+//
+// Re-registering with an auth key rotates the node key, so if a
+// maintenance window is set, it's queued for the window and Reauth
+// returns an error wrapping ErrMaintenanceDeferred.
+func (b *LocalBackend) Reauth(authKey string) error {
+	if authKey == "" {
+		b.StartLoginInteractive()
+		return nil
+	}
+	if b.deferMaintenance(maintReauth, func() {
+		if err := b.reauthWithKey(authKey); err != nil {
+			b.logf("maintenance: reauth: %v", err)
+		}
+	}) {
+		return fmt.Errorf("reauth %w", ErrMaintenanceDeferred)
+	}
+	return b.reauthWithKey(authKey)
+}
+
+func (b *LocalBackend) reauthWithKey(authKey string) error {
+	b.mu.Lock()
+	opts := ipn.Options{
+		StateKey: b.stateKey,
+		AuthKey:  authKey,
+	}
+	if b.stateKey == "" {
+		opts.Prefs = b.prefs.Clone()
+	}
+	if b.hostinfo != nil {
+		opts.FrontendLogID = b.hostinfo.FrontendLogID
+	}
+	b.mu.Unlock()
+	if err := b.Start(opts); err != nil {
+		return err
+	}
+	b.StartLoginInteractive()
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+func TestNextKeyExpiryWarning(t *testing.T) {
+	expiry := time.Date(2022, 10, 1, 0, 0, 0, 0, time.UTC)
+	thresholds := []time.Duration{24 * time.Hour, time.Hour, 10 * time.Minute}
+	tests := []struct {
+		name     string
+		before   time.Duration // how long before expiry "now" is
+		warned   time.Duration
+		wantDue  time.Duration
+		wantNext time.Duration // before expiry; 0 means none
+	}{
+		{
+			name:     "far_away",
+			before:   48 * time.Hour,
+			wantNext: 24 * time.Hour,
+		},
+		{
+			name:     "first_due",
+			before:   23 * time.Hour,
+			wantDue:  24 * time.Hour,
+			wantNext: time.Hour,
+		},
+		{
+			name:     "first_already_warned",
+			before:   23 * time.Hour,
+			warned:   24 * time.Hour,
+			wantNext: time.Hour,
+		},
+		{
+			name:     "skipped_to_smaller",
+			before:   30 * time.Minute,
+			wantDue:  time.Hour,
+			wantNext: 10 * time.Minute,
+		},
+		{
+			name:    "last_due",
+			before:  5 * time.Minute,
+			warned:  time.Hour,
+			wantDue: 10 * time.Minute,
+		},
+		{
+			name:   "all_warned",
+			before: 5 * time.Minute,
+			warned: 10 * time.Minute,
+		},
+		{
+			name:   "expired",
+			before: -time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			due, next := nextKeyExpiryWarning(thresholds, expiry, expiry.Add(-tt.before), tt.warned)
+			if due != tt.wantDue {
+				t.Errorf("due = %v; want %v", due, tt.wantDue)
+			}
+			var wantNext time.Time
+			if tt.wantNext != 0 {
+				wantNext = expiry.Add(-tt.wantNext)
+			}
+			if !next.Equal(wantNext) {
+				t.Errorf("next = %v; want %v", next, wantNext)
+			}
+		})
+	}
+}
+
+func TestKeyExpiryWarningStaleTimer(t *testing.T) {
+	b := &LocalBackend{logf: t.Logf}
+	var warnings []*ipn.KeyExpiryWarning
+	b.SetNotifyCallback(func(n ipn.Notify) {
+		if n.KeyExpiryWarning != nil {
+			warnings = append(warnings, n.KeyExpiryWarning)
+		}
+	})
+	b.SetKeyExpiryWarnings([]time.Duration{time.Hour})
+
+	soon := time.Now().Add(30 * time.Minute)
+	renewed := time.Now().Add(48 * time.Hour)
+	b.mu.Lock()
+	b.updateKeyExpiryWarningLocked(soon)
+	b.updateKeyExpiryWarningLocked(renewed)
+	b.mu.Unlock()
+
+	// A timer set for the old expiry that fires after the key was
+	// renewed neither warns nor reverts to the old expiry.
+	b.keyExpiryWarningTimerFired()
+	if len(warnings) != 0 {
+		t.Errorf("got warnings %+v; want none", warnings)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if got := b.keyExpiryWarn.expiry; !got.Equal(renewed) {
+		t.Errorf("expiry = %v; want %v", got, renewed)
+	}
+	b.keyExpiryWarn.timer.Stop()
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// noteFilesChanged wakes up any WatchIncomingFiles callers.
+func (b *LocalBackend) noteFilesChanged() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.filesChanged != nil {
+		close(b.filesChanged)
+		b.filesChanged = nil
+	}
+}
+
+// WatchIncomingFiles calls fn for each Taildrop file waiting to be
+// picked up, and then for each file as it finishes arriving, until ctx
+// is done. It's the push-based alternative to polling WaitingFiles.
+// A file that's received again under the same name is reported again.
+//
+// It returns ctx.Err() once ctx is done, or an error right away if
+// Taildrop isn't available or files are written directly to a
+// download directory.
+func (b *LocalBackend) WatchIncomingFiles(ctx context.Context, fn func(apitype.WaitingFile)) error {
+	seen := map[string]time.Time{} // name => Received
+	for {
+		b.mu.Lock()
+		apiSrv := b.peerAPIServer
+		if b.filesChanged == nil {
+			b.filesChanged = make(chan struct{})
+		}
+		changed := b.filesChanged
+		b.mu.Unlock()
+
+		if apiSrv != nil && apiSrv.directFileMode {
+			return errors.New("files are written directly to a download directory")
+		}
+		wfs, err := apiSrv.WaitingFiles()
+		if err != nil {
+			return err
+		}
+		present := make(map[string]bool, len(wfs))
+		for _, wf := range wfs {
+			present[wf.Name] = true
+			if t, ok := seen[wf.Name]; ok && t.Equal(wf.Received) {
+				continue
+			}
+			seen[wf.Name] = wf.Received
+			fn(wf)
+		}
+		for name := range seen {
+			if !present[name] {
+				delete(seen, name)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
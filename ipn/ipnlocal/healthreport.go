@@ -0,0 +1,162 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"tailscale.com/health"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+	"tailscale.com/util/clientmetric"
+)
+
+const (
+	// healthReportInterval is how often health reports are sent
+	// while the node's warnings stay the same.
+	healthReportInterval = 15 * time.Minute
+
+	// healthReportCheckInterval is how often the node's warnings are
+	// checked for changes, and so the least time between reports.
+	healthReportCheckInterval = time.Minute
+)
+
+// healthReportMetrics are the client metrics included in health
+// reports.
+var healthReportMetrics = []string{
+	"derp_home_change",
+	"magicsock_netmap_num_peers",
+	"magicsock_num_derp_conns",
+	"magicsock_rebind_calls",
+	"magicsock_send_derp_error",
+	"magicsock_send_udp_error",
+	"controlclient_map_requests",
+}
+
+// healthReporter sends health reports to the control plane while the
+// tailnet policy opts in with tailcfg.CapabilityHealthReport. It's
+// guarded by LocalBackend.mu.
+type healthReporter struct {
+	timer   *time.Timer // checks for a report due next, or nil when not reporting
+	last    time.Time   // when the last report was sent
+	lastKey string      // healthReportKey of the last report
+}
+
+// updateHealthReporterLocked starts or stops health reports according
+// to whether nm has tailcfg.CapabilityHealthReport. A nil nm stops
+// them.
+//
+// b.mu must be held.
+func (b *LocalBackend) updateHealthReporterLocked(nm *netmap.NetworkMap) {
+	r := &b.healthReport
+	if nm == nil || !hasCapability(nm, tailcfg.CapabilityHealthReport) {
+		if r.timer != nil {
+			r.timer.Stop()
+			r.timer = nil
+		}
+		return
+	}
+	if r.timer == nil {
+		// Give the node a moment to settle after starting before
+		// its first report.
+		r.timer = time.AfterFunc(healthReportCheckInterval, b.checkHealthReport)
+	}
+}
+
+// checkHealthReport sends a health report if one is due, either
+// because the node's warnings changed or because healthReportInterval
+// passed since the last one, and schedules the next check.
+func (b *LocalBackend) checkHealthReport() {
+	now := time.Now()
+	req := newHealthReport(health.Warnings())
+	key := healthReportKey(req)
+
+	b.mu.Lock()
+	r := &b.healthReport
+	if r.timer == nil {
+		b.mu.Unlock()
+		return // stopped
+	}
+	r.timer.Reset(healthReportCheckInterval)
+	cc := b.ccAuto
+	if b.prefs != nil && b.prefs.Persist != nil {
+		req.NodeKey = b.prefs.Persist.PrivateNodeKey.Public()
+	}
+	if cc == nil || req.NodeKey.IsZero() || !healthReportDue(r.last, r.lastKey, now, key) {
+		b.mu.Unlock()
+		return
+	}
+	// Failed reports aren't retried until the next is due, so an
+	// unreachable control plane isn't sent one every check.
+	r.last, r.lastKey = now, key
+	b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(b.ctx, 30*time.Second)
+	defer cancel()
+	if err := cc.ReportHealth(ctx, req); err != nil {
+		b.logf("health report: %v", err)
+	}
+}
+
+// healthReportDue reports whether a health report with the given
+// healthReportKey is due at now, the last report having been sent at
+// last with lastKey.
+func healthReportDue(last time.Time, lastKey string, now time.Time, key string) bool {
+	return last.IsZero() || key != lastKey || now.Sub(last) >= healthReportInterval
+}
+
+// healthReportKey returns a summary of the warnings in req for
+// noticing when they change. It leaves out the warnings' text, which
+// can change from one check to the next without anything new going
+// wrong, such as in how long ago a map response was received.
+func healthReportKey(req *tailcfg.HealthReportRequest) string {
+	var sb strings.Builder
+	for _, w := range req.Warnings {
+		sb.WriteString(w.Code)
+		sb.WriteByte('/')
+		sb.WriteString(w.Severity)
+		sb.WriteByte(' ')
+	}
+	return sb.String()
+}
+
+// newHealthReport returns a health report, without a node key, for the
+// warnings ws and the current values of healthReportMetrics.
+func newHealthReport(ws []health.Warning) *tailcfg.HealthReportRequest {
+	req := &tailcfg.HealthReportRequest{
+		Healthy: len(ws) == 0,
+		Metrics: map[string]int64{},
+	}
+	inReport := map[health.WarningCode]bool{}
+	for _, w := range ws {
+		inReport[w.Code] = true
+	}
+	for _, w := range ws {
+		rootCause := true
+		for _, c := range w.DependsOn {
+			if inReport[c] {
+				rootCause = false
+				break
+			}
+		}
+		req.Warnings = append(req.Warnings, tailcfg.HealthReportWarning{
+			Code:      string(w.Code),
+			Subsystem: string(w.Subsystem),
+			Severity:  string(w.Severity),
+			Text:      w.Text,
+			RootCause: rootCause,
+		})
+	}
+	for _, m := range clientmetric.Metrics() {
+		for _, name := range healthReportMetrics {
+			if m.Name() == name {
+				req.Metrics[name] = m.Value()
+			}
+		}
+	}
+	return req
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"tailscale.com/health"
+	"tailscale.com/tailcfg"
+)
+
+func TestNewHealthReport(t *testing.T) {
+	if req := newHealthReport(nil); !req.Healthy || len(req.Warnings) != 0 {
+		t.Errorf("no warnings: got Healthy=%v, Warnings=%v; want healthy", req.Healthy, req.Warnings)
+	}
+
+	ws := []health.Warning{
+		{Code: health.WarnNotInMapPoll, Subsystem: health.SysControl, Severity: health.SeverityHigh, Text: "not in map poll"},
+		{Code: health.WarnNoMapResponse, Subsystem: health.SysControl, Severity: health.SeverityMedium, Text: "no map response in 3m0s",
+			DependsOn: []health.WarningCode{health.WarnNotInMapPoll}},
+	}
+	req := newHealthReport(ws)
+	if req.Healthy {
+		t.Error("Healthy with warnings")
+	}
+	want := []tailcfg.HealthReportWarning{
+		{Code: "not-in-map-poll", Subsystem: "control", Severity: "high", Text: "not in map poll", RootCause: true},
+		{Code: "no-map-response", Subsystem: "control", Severity: "medium", Text: "no map response in 3m0s"},
+	}
+	if !reflect.DeepEqual(req.Warnings, want) {
+		t.Errorf("Warnings = %+v; want %+v", req.Warnings, want)
+	}
+
+	// A warning depending only on warnings not in the report is a
+	// root cause of it.
+	if got := newHealthReport(ws[1:]).Warnings[0]; !got.RootCause {
+		t.Errorf("warning whose cause isn't reported has RootCause = false")
+	}
+
+	// The warnings' text changing doesn't make a new report due.
+	ws[1].Text = "no map response in 4m0s"
+	if a, b := healthReportKey(req), healthReportKey(newHealthReport(ws)); a != b {
+		t.Errorf("key changed with text: %q != %q", a, b)
+	}
+	if a, b := healthReportKey(req), healthReportKey(newHealthReport(ws[:1])); a == b {
+		t.Errorf("key didn't change with warnings: %q", a)
+	}
+}
+
+func TestHealthReportDue(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		last    time.Time
+		lastKey string
+		key     string
+		want    bool
+	}{
+		{"first", time.Time{}, "", "", true},
+		{"unchanged", now.Add(-time.Minute), "derp-home-silent/medium ", "derp-home-silent/medium ", false},
+		{"changed", now.Add(-time.Minute), "", "derp-home-silent/medium ", true},
+		{"recovered", now.Add(-time.Minute), "derp-home-silent/medium ", "", true},
+		{"interval", now.Add(-healthReportInterval), "", "", true},
+	}
+	for _, tt := range tests {
+		if got := healthReportDue(tt.last, tt.lastKey, now, tt.key); got != tt.want {
+			t.Errorf("%s: healthReportDue = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
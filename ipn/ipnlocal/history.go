@@ -0,0 +1,289 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/atomicfile"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netmap"
+)
+
+// historyMaxEvents is the number of events a changeHistory keeps.
+const historyMaxEvents = 1000
+
+// changeHistory is a bounded history of the netmap changes a user
+// might want to correlate with connectivity problems, persisted to a
+// JSON lines file. The file is read on first use, without
+// LocalBackend.mu held.
+type changeHistory struct {
+	logf logger.Logf
+	path string // or empty to not persist
+
+	loadOnce sync.Once // reads path
+
+	mu        sync.Mutex
+	events    []apitype.HistoryEvent // oldest first; at most historyMaxEvents
+	pending   []apitype.HistoryEvent // not yet written to path
+	fileLines int                    // number of events in path, once loaded
+	flushing  bool                   // whether flush is running
+	flushDone sync.WaitGroup         // for tests
+}
+
+// changeHistoryLocked returns b's change history, creating it on
+// first use: the var root isn't known until the LocalBackend is set up.
+func (b *LocalBackend) changeHistoryLocked() *changeHistory {
+	if b.history == nil {
+		var path string
+		if root := b.TailscaleVarRoot(); root != "" {
+			path = filepath.Join(root, "history.jsonl")
+		}
+		b.history = newChangeHistory(b.logf, path)
+	}
+	return b.history
+}
+
+// ChangeHistory returns the recorded changes to the tailnet, such as
+// peers being added or changing routes, oldest first.
+func (b *LocalBackend) ChangeHistory() []apitype.HistoryEvent {
+	b.mu.Lock()
+	h := b.changeHistoryLocked()
+	b.mu.Unlock()
+	return h.Events()
+}
+
+// newChangeHistory returns a new changeHistory persisted to path, if
+// non-empty. It doesn't read path until it's first used.
+func newChangeHistory(logf logger.Logf, path string) *changeHistory {
+	return &changeHistory{logf: logf, path: path}
+}
+
+// load reads the events already in the history file, if it hasn't yet,
+// putting them before any added since.
+//
+// h.mu must not be held.
+func (h *changeHistory) load() {
+	h.loadOnce.Do(func() {
+		if h.path == "" {
+			return
+		}
+		f, err := os.Open(h.path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				h.logf("history: %v", err)
+			}
+			return
+		}
+		defer f.Close()
+		var evs []apitype.HistoryEvent
+		bs := bufio.NewScanner(f)
+		for bs.Scan() {
+			var ev apitype.HistoryEvent
+			if err := json.Unmarshal(bs.Bytes(), &ev); err != nil {
+				continue // truncated final write, most likely
+			}
+			evs = append(evs, ev)
+		}
+
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.fileLines += len(evs)
+		added := h.events
+		h.events = nil
+		for _, ev := range evs {
+			h.appendLocked(ev)
+		}
+		for _, ev := range added {
+			h.appendLocked(ev)
+		}
+	})
+}
+
+// Events returns a copy of the history, oldest first.
+func (h *changeHistory) Events() []apitype.HistoryEvent {
+	h.load()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]apitype.HistoryEvent(nil), h.events...)
+}
+
+// add adds evs to the history. It doesn't block on reading or writing
+// the history file.
+func (h *changeHistory) add(evs ...apitype.HistoryEvent) {
+	if len(evs) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, ev := range evs {
+		h.appendLocked(ev)
+	}
+	if h.path == "" {
+		return
+	}
+	h.pending = append(h.pending, evs...)
+	if !h.flushing {
+		h.flushing = true
+		h.flushDone.Add(1)
+		go h.flush()
+	}
+}
+
+func (h *changeHistory) appendLocked(ev apitype.HistoryEvent) {
+	if len(h.events) >= historyMaxEvents {
+		n := copy(h.events, h.events[len(h.events)-historyMaxEvents+1:])
+		h.events = h.events[:n]
+	}
+	h.events = append(h.events, ev)
+}
+
+// flush writes the pending events to the history file until there
+// are no more. Once the file has twice as many events as are kept, it's
+// rewritten with just the kept ones.
+func (h *changeHistory) flush() {
+	defer h.flushDone.Done()
+	h.load() // so that fileLines and compaction account for the file
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for len(h.pending) > 0 {
+		evs := h.pending
+		h.pending = nil
+		compact := h.fileLines+len(evs) > 2*historyMaxEvents
+		if compact {
+			evs = append([]apitype.HistoryEvent(nil), h.events...)
+		}
+
+		h.mu.Unlock()
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for _, ev := range evs {
+			enc.Encode(ev)
+		}
+		var err error
+		if compact {
+			err = atomicfile.WriteFile(h.path, buf.Bytes(), 0600)
+		} else {
+			err = appendFile(h.path, buf.Bytes())
+		}
+		h.mu.Lock()
+
+		if err != nil {
+			h.logf("history: %v", err)
+			continue
+		}
+		if compact {
+			h.fileLines = 0
+		}
+		h.fileLines += len(evs)
+	}
+	h.flushing = false
+}
+
+func appendFile(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// netMapHistoryEvents returns the events for the changes from old to
+// nm. It returns none if old is nil, as there's nothing to compare to.
+func netMapHistoryEvents(now time.Time, old, nm *netmap.NetworkMap) []apitype.HistoryEvent {
+	if old == nil || nm == nil {
+		return nil
+	}
+	var evs []apitype.HistoryEvent
+	add := func(typ string, n *tailcfg.Node, oldVal, newVal string) {
+		ev := apitype.HistoryEvent{Time: now, Type: typ, Old: oldVal, New: newVal}
+		if n != nil {
+			ev.Node = historyNodeName(n)
+			ev.NodeID = n.StableID
+		}
+		evs = append(evs, ev)
+	}
+
+	if old.NodeKey != nm.NodeKey && !old.NodeKey.IsZero() {
+		add("key-rotated", nil, old.NodeKey.ShortString(), nm.NodeKey.ShortString())
+	}
+
+	oldPeers := make(map[tailcfg.StableNodeID]*tailcfg.Node, len(old.Peers))
+	for _, p := range old.Peers {
+		oldPeers[p.StableID] = p
+	}
+	for _, p := range nm.Peers {
+		op, ok := oldPeers[p.StableID]
+		if !ok {
+			add("peer-added", p, "", historyPrefixes(p))
+			continue
+		}
+		delete(oldPeers, p.StableID)
+		if op.Key != p.Key {
+			add("key-rotated", p, op.Key.ShortString(), p.Key.ShortString())
+		}
+		if o, n := historyPrefixes(op), historyPrefixes(p); o != n {
+			add("routes-changed", p, o, n)
+		}
+	}
+	for _, p := range old.Peers {
+		if _, ok := oldPeers[p.StableID]; ok {
+			add("peer-removed", p, historyPrefixes(p), "")
+		}
+	}
+	return evs
+}
+
+// exitNodeHistoryName describes the exit node in prefs for history
+// events, using its name from nm if possible.
+func exitNodeHistoryName(nm *netmap.NetworkMap, prefs *ipn.Prefs) string {
+	switch {
+	case prefs.ExitNodeID != "":
+		if nm != nil {
+			if p, ok := nm.PeerWithStableID(prefs.ExitNodeID); ok {
+				return historyNodeName(p)
+			}
+		}
+		return string(prefs.ExitNodeID)
+	case prefs.ExitNodeIP.IsValid():
+		return prefs.ExitNodeIP.String()
+	}
+	return ""
+}
+
+// historyNodeName returns the name of n for history events.
+func historyNodeName(n *tailcfg.Node) string {
+	if n.Name != "" {
+		return strings.TrimSuffix(n.Name, ".")
+	}
+	return string(n.StableID)
+}
+
+// historyPrefixes returns n's AllowedIPs, as a string for comparisons
+// and history events.
+func historyPrefixes(n *tailcfg.Node) string {
+	var sb strings.Builder
+	for i, p := range n.AllowedIPs {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(p.String())
+	}
+	return sb.String()
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"fmt"
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+)
+
+func TestNetMapHistoryEvents(t *testing.T) {
+	now := time.Unix(1660000000, 0)
+	k1, k2 := key.NewNode().Public(), key.NewNode().Public()
+	node := func(id string, k key.NodePublic, prefixes ...string) *tailcfg.Node {
+		n := &tailcfg.Node{StableID: tailcfg.StableNodeID(id), Name: id + ".example.ts.net.", Key: k}
+		for _, p := range prefixes {
+			n.AllowedIPs = append(n.AllowedIPs, netip.MustParsePrefix(p))
+		}
+		return n
+	}
+	old := &netmap.NetworkMap{Peers: []*tailcfg.Node{
+		node("a", k1, "100.64.0.1/32"),
+		node("b", k1, "100.64.0.2/32"),
+		node("c", k1, "100.64.0.3/32"),
+	}}
+	nm := &netmap.NetworkMap{Peers: []*tailcfg.Node{
+		node("a", k1, "100.64.0.1/32", "10.0.0.0/24"),
+		node("b", k2, "100.64.0.2/32"),
+		node("d", k1, "100.64.0.4/32"),
+	}}
+	want := []apitype.HistoryEvent{
+		{Time: now, Type: "routes-changed", Node: "a.example.ts.net", NodeID: "a", Old: "100.64.0.1/32", New: "100.64.0.1/32,10.0.0.0/24"},
+		{Time: now, Type: "key-rotated", Node: "b.example.ts.net", NodeID: "b", Old: k1.ShortString(), New: k2.ShortString()},
+		{Time: now, Type: "peer-added", Node: "d.example.ts.net", NodeID: "d", New: "100.64.0.4/32"},
+		{Time: now, Type: "peer-removed", Node: "c.example.ts.net", NodeID: "c", Old: "100.64.0.3/32"},
+	}
+	if got := netMapHistoryEvents(now, old, nm); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+	if got := netMapHistoryEvents(now, nil, nm); got != nil {
+		t.Errorf("with no old netmap, got %+v; want none", got)
+	}
+}
+
+func TestChangeHistoryPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	h := newChangeHistory(t.Logf, path)
+	total := 2*historyMaxEvents + 10
+	for i := 0; i < total; i++ {
+		h.add(apitype.HistoryEvent{Time: time.Unix(int64(i), 0).UTC(), Type: "peer-added", Node: fmt.Sprint(i)})
+	}
+	h.flushDone.Wait()
+
+	check := func(h *changeHistory) {
+		t.Helper()
+		evs := h.Events()
+		if len(evs) != historyMaxEvents {
+			t.Fatalf("got %d events; want %d", len(evs), historyMaxEvents)
+		}
+		if got, want := evs[0].Node, fmt.Sprint(total-historyMaxEvents); got != want {
+			t.Errorf("oldest event is %q; want %q", got, want)
+		}
+		if got, want := evs[len(evs)-1].Node, fmt.Sprint(total-1); got != want {
+			t.Errorf("newest event is %q; want %q", got, want)
+		}
+	}
+	check(h)
+	h2 := newChangeHistory(t.Logf, path)
+	check(h2)
+	if h2.fileLines > 2*historyMaxEvents {
+		t.Errorf("history file has %d events; want at most %d", h2.fileLines, 2*historyMaxEvents)
+	}
+}
+
+func TestChangeHistoryLazyLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	ev := func(i int) apitype.HistoryEvent {
+		return apitype.HistoryEvent{Time: time.Unix(int64(i), 0).UTC(), Type: "peer-added", Node: fmt.Sprint(i)}
+	}
+	h := newChangeHistory(t.Logf, path)
+	h.add(ev(1), ev(2))
+	h.flushDone.Wait()
+
+	// Events added before the file is read come after those in it.
+	h2 := newChangeHistory(t.Logf, path)
+	h2.add(ev(3))
+	var got []string
+	for _, e := range h2.Events() {
+		got = append(got, e.Node)
+	}
+	if want := []string{"1", "2", "3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,309 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"tailscale.com/atomicfile"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netmap"
+	"tailscale.com/util/mak"
+)
+
+// ipHistoryMaxAge is how long an ipHistory keeps assignments after
+// they end.
+const ipHistoryMaxAge = 90 * 24 * time.Hour
+
+// ipHistoryPruneInterval is how often an ipHistory forgets assignments
+// that ended more than ipHistoryMaxAge ago.
+const ipHistoryPruneInterval = time.Hour
+
+// ipHistory is the history of which nodes a tailnet's IP addresses
+// belonged to, as seen by one profile, so that addresses in old logs
+// can still be attributed to the right node after they've been
+// reassigned. It's persisted to a JSON file, which is read on first
+// use.
+//
+// Netmaps are applied in the background, so that neither reading the
+// file nor applying them happens with LocalBackend.mu held.
+type ipHistory struct {
+	logf logger.Logf
+	path string // or empty to not persist
+
+	mu        sync.Mutex
+	loaded    bool                   // whether path has been read
+	assigns   []apitype.IPAssignment // ordered by From
+	open      map[netip.Addr]int     // index in assigns of each current assignment
+	lastPrune time.Time              // when ended assignments were last pruned
+	pending   []ipHistoryUpdate      // not yet applied
+	dirty     bool                   // whether assigns changed since last written
+	running   bool                   // whether run is running
+	runDone   sync.WaitGroup         // for tests
+}
+
+// ipHistoryUpdate is a netmap's IP assignments, to be applied to an
+// ipHistory.
+type ipHistoryUpdate struct {
+	now time.Time
+	cur map[netip.Addr]apitype.IPAssignment
+}
+
+// ipHistoryProfile returns the key of the profile nm is for, its
+// tailnet and user. Profiles' IP histories are kept apart, as IP
+// addresses are only meaningful within a tailnet.
+func ipHistoryProfile(nm *netmap.NetworkMap) string {
+	return nm.Domain + "/" + strconv.FormatInt(int64(nm.User), 10)
+}
+
+// ipHistoryLocked returns b's IP history for profile, creating it on
+// first use.
+//
+// b.mu must be held.
+func (b *LocalBackend) ipHistoryLocked(profile string) *ipHistory {
+	if h, ok := b.ipHistories[profile]; ok {
+		return h
+	}
+	var path string
+	if root := b.TailscaleVarRoot(); root != "" {
+		sum := sha256.Sum256([]byte(profile))
+		path = filepath.Join(root, "ip-history", hex.EncodeToString(sum[:8])+".json")
+	}
+	h := newIPHistory(b.logf, path)
+	mak.Set(&b.ipHistories, profile, h)
+	return h
+}
+
+// IPHistory returns the recorded assignments of the tailnet IP address
+// addr to nodes, oldest first, in the tailnet of the current (or last)
+// netmap. If at is non-zero, it returns only the one in effect at that
+// time, if any.
+func (b *LocalBackend) IPHistory(addr netip.Addr, at time.Time) []apitype.IPAssignment {
+	b.mu.Lock()
+	nm := b.historyNetMap
+	var h *ipHistory
+	if nm != nil {
+		h = b.ipHistoryLocked(ipHistoryProfile(nm))
+	}
+	b.mu.Unlock()
+	if h == nil {
+		return nil
+	}
+	return h.lookup(addr, at)
+}
+
+// newIPHistory returns a new ipHistory persisted to path, if non-empty.
+// It doesn't read path until it's first used.
+func newIPHistory(logf logger.Logf, path string) *ipHistory {
+	return &ipHistory{logf: logf, path: path}
+}
+
+// loadLocked reads the history's file, if it hasn't yet.
+//
+// h.mu must be held.
+func (h *ipHistory) loadLocked() {
+	if h.loaded {
+		return
+	}
+	h.loaded = true
+	h.open = map[netip.Addr]int{}
+	if h.path == "" {
+		return
+	}
+	b, err := os.ReadFile(h.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			h.logf("ip history: %v", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(b, &h.assigns); err != nil {
+		h.logf("ip history: %v", err)
+		h.assigns = nil
+	}
+	h.indexLocked()
+}
+
+// indexLocked rebuilds h.open from h.assigns.
+//
+// h.mu must be held.
+func (h *ipHistory) indexLocked() {
+	h.open = make(map[netip.Addr]int, len(h.open))
+	for i, a := range h.assigns {
+		if a.Until.IsZero() {
+			h.open[a.Addr] = i
+		}
+	}
+}
+
+// lookup implements LocalBackend.IPHistory. It reflects all updates
+// made before it's called.
+func (h *ipHistory) lookup(addr netip.Addr, at time.Time) []apitype.IPAssignment {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.loadLocked()
+	h.applyPendingLocked()
+	var ret []apitype.IPAssignment
+	for _, a := range h.assigns {
+		if a.Addr != addr {
+			continue
+		}
+		if !at.IsZero() && (at.Before(a.From) || !a.Until.IsZero() && !at.Before(a.Until)) {
+			continue
+		}
+		ret = append(ret, a)
+	}
+	return ret
+}
+
+// update records the assignments of IP addresses in nm, as of now,
+// ending those that no longer hold. It only queues them; they're
+// applied and written out in the background.
+func (h *ipHistory) update(now time.Time, nm *netmap.NetworkMap) {
+	cur := netMapIPAssignments(now, nm)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pending = append(h.pending, ipHistoryUpdate{now, cur})
+	if !h.running {
+		h.running = true
+		h.runDone.Add(1)
+		go h.run()
+	}
+}
+
+// applyPendingLocked applies the queued updates.
+//
+// h.mu must be held, and h loaded.
+func (h *ipHistory) applyPendingLocked() {
+	for _, u := range h.pending {
+		if h.applyLocked(u.now, u.cur) {
+			h.dirty = true
+		}
+	}
+	h.pending = nil
+}
+
+// applyLocked applies the IP assignments cur, as of now, and reports
+// whether the history changed. It takes time proportional to the
+// number of current assignments, not the length of the history.
+//
+// h.mu must be held, and h loaded.
+func (h *ipHistory) applyLocked(now time.Time, cur map[netip.Addr]apitype.IPAssignment) (changed bool) {
+	for addr, i := range h.open {
+		a := &h.assigns[i]
+		c, ok := cur[addr]
+		if !ok || c.NodeID != a.NodeID {
+			a.Until = now
+			delete(h.open, addr)
+			changed = true
+			continue
+		}
+		delete(cur, addr)
+		if c.Node != a.Node || c.User != a.User {
+			// Renamed or transferred; it's still the same node.
+			a.Node, a.User = c.Node, c.User
+			changed = true
+		}
+	}
+	added := make([]apitype.IPAssignment, 0, len(cur))
+	for _, c := range cur {
+		added = append(added, c)
+	}
+	sort.Slice(added, func(i, j int) bool { return added[i].Addr.Less(added[j].Addr) })
+	for _, c := range added {
+		h.open[c.Addr] = len(h.assigns)
+		h.assigns = append(h.assigns, c)
+		changed = true
+	}
+
+	if now.Sub(h.lastPrune) < ipHistoryPruneInterval {
+		return changed
+	}
+	h.lastPrune = now
+	kept := h.assigns[:0]
+	for _, a := range h.assigns {
+		if !a.Until.IsZero() && now.Sub(a.Until) > ipHistoryMaxAge {
+			changed = true
+			continue
+		}
+		kept = append(kept, a)
+	}
+	if len(kept) < len(h.assigns) {
+		h.assigns = kept
+		h.indexLocked()
+	}
+	return changed
+}
+
+// run loads the history, applies pending updates and writes the
+// history to its file until there's nothing more to do.
+func (h *ipHistory) run() {
+	defer h.runDone.Done()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.loadLocked()
+	for {
+		h.applyPendingLocked()
+		if !h.dirty || h.path == "" {
+			break
+		}
+		h.dirty = false
+		b, err := json.Marshal(h.assigns)
+
+		h.mu.Unlock()
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(h.path), 0700)
+		}
+		if err == nil {
+			err = atomicfile.WriteFile(h.path, b, 0600)
+		}
+		h.mu.Lock()
+
+		if err != nil {
+			h.logf("ip history: %v", err)
+		}
+	}
+	h.dirty = false
+	h.running = false
+}
+
+// netMapIPAssignments returns the assignments of the tailnet IP
+// addresses of the nodes in nm, starting at now, by address.
+func netMapIPAssignments(now time.Time, nm *netmap.NetworkMap) map[netip.Addr]apitype.IPAssignment {
+	ret := map[netip.Addr]apitype.IPAssignment{}
+	add := func(addrs []netip.Prefix, name string, id tailcfg.StableNodeID, user tailcfg.UserID) {
+		for _, p := range addrs {
+			if !p.IsSingleIP() {
+				continue
+			}
+			ret[p.Addr()] = apitype.IPAssignment{
+				Addr:   p.Addr(),
+				Node:   name,
+				NodeID: id,
+				User:   nm.UserProfiles[user].LoginName,
+				From:   now,
+			}
+		}
+	}
+	if nm.SelfNode != nil {
+		add(nm.Addresses, historyNodeName(nm.SelfNode), nm.SelfNode.StableID, nm.User)
+	}
+	for _, p := range nm.Peers {
+		add(p.Addresses, historyNodeName(p), p.StableID, p.User)
+	}
+	return ret
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+func TestIPHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ip-history.json")
+	h := newIPHistory(t.Logf, path)
+
+	ip1, ip2 := netip.MustParseAddr("100.64.0.1"), netip.MustParseAddr("100.64.0.2")
+	node := func(id string, user tailcfg.UserID, addr netip.Addr) *tailcfg.Node {
+		return &tailcfg.Node{
+			StableID:  tailcfg.StableNodeID(id),
+			Name:      id + ".example.ts.net.",
+			User:      user,
+			Addresses: []netip.Prefix{netip.PrefixFrom(addr, addr.BitLen())},
+		}
+	}
+	profiles := map[tailcfg.UserID]tailcfg.UserProfile{
+		1: {LoginName: "alice@example.com"},
+		2: {LoginName: "bob@example.com"},
+	}
+	t0 := time.Unix(1660000000, 0).UTC()
+	t1 := t0.Add(time.Hour)
+	t2 := t1.Add(time.Hour)
+
+	h.update(t0, &netmap.NetworkMap{UserProfiles: profiles, Peers: []*tailcfg.Node{
+		node("a", 1, ip1),
+		node("b", 2, ip2),
+	}})
+	h.update(t0.Add(time.Minute), &netmap.NetworkMap{UserProfiles: profiles, Peers: []*tailcfg.Node{
+		node("a", 1, ip1),
+		node("b", 2, ip2),
+	}})
+	// a goes away and its address is given to c.
+	h.update(t1, &netmap.NetworkMap{UserProfiles: profiles, Peers: []*tailcfg.Node{
+		node("b", 2, ip2),
+		node("c", 2, ip1),
+	}})
+
+	a := apitype.IPAssignment{Addr: ip1, Node: "a.example.ts.net", NodeID: "a", User: "alice@example.com", From: t0, Until: t1}
+	b := apitype.IPAssignment{Addr: ip2, Node: "b.example.ts.net", NodeID: "b", User: "bob@example.com", From: t0}
+	c := apitype.IPAssignment{Addr: ip1, Node: "c.example.ts.net", NodeID: "c", User: "bob@example.com", From: t1}
+	tests := []struct {
+		addr netip.Addr
+		at   time.Time
+		want []apitype.IPAssignment
+	}{
+		{ip1, time.Time{}, []apitype.IPAssignment{a, c}},
+		{ip1, t0.Add(30 * time.Minute), []apitype.IPAssignment{a}},
+		{ip1, t1, []apitype.IPAssignment{c}},
+		{ip1, t2, []apitype.IPAssignment{c}},
+		{ip1, t0.Add(-time.Second), nil},
+		{ip2, t2, []apitype.IPAssignment{b}},
+	}
+	check := func(h *ipHistory) {
+		t.Helper()
+		for _, tt := range tests {
+			if got := h.lookup(tt.addr, tt.at); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lookup(%v, %v) = %+v; want %+v", tt.addr, tt.at, got, tt.want)
+			}
+		}
+	}
+	check(h)
+
+	h.runDone.Wait()
+	check(newIPHistory(t.Logf, path))
+
+	// Ended assignments are forgotten once they're old enough.
+	h.update(t1.Add(ipHistoryMaxAge+time.Second), &netmap.NetworkMap{UserProfiles: profiles, Peers: []*tailcfg.Node{
+		node("b", 2, ip2),
+		node("c", 2, ip1),
+	}})
+	if got := h.lookup(ip1, time.Time{}); !reflect.DeepEqual(got, []apitype.IPAssignment{c}) {
+		t.Errorf("after expiry, got %+v; want %+v", got, []apitype.IPAssignment{c})
+	}
+	h.runDone.Wait()
+}
+
+func TestIPHistoryProfiles(t *testing.T) {
+	b := &LocalBackend{logf: t.Logf, varRoot: t.TempDir()}
+	ip := netip.MustParseAddr("100.64.0.1")
+	netMap := func(domain string, user tailcfg.UserID, peerID string) *netmap.NetworkMap {
+		return &netmap.NetworkMap{
+			Domain: domain,
+			User:   user,
+			Peers: []*tailcfg.Node{{
+				StableID:  tailcfg.StableNodeID(peerID),
+				Name:      peerID + "." + domain + ".",
+				Addresses: []netip.Prefix{netip.PrefixFrom(ip, 32)},
+			}},
+		}
+	}
+	now := time.Unix(1660000000, 0).UTC()
+	nmA, nmB := netMap("a.example.com", 1, "a"), netMap("b.example.com", 1, "b")
+
+	b.mu.Lock()
+	hA := b.ipHistoryLocked(ipHistoryProfile(nmA))
+	hB := b.ipHistoryLocked(ipHistoryProfile(nmB))
+	if hA == hB || hA.path == hB.path {
+		t.Fatalf("profiles share an IP history at %q", hA.path)
+	}
+	if b.ipHistoryLocked(ipHistoryProfile(nmA)) != hA {
+		t.Error("profile's IP history wasn't reused")
+	}
+	hA.update(now, nmA)
+	hB.update(now, nmB)
+	b.historyNetMap = nmA
+	b.mu.Unlock()
+
+	check := func(wantID tailcfg.StableNodeID) {
+		t.Helper()
+		got := b.IPHistory(ip, time.Time{})
+		if len(got) != 1 || got[0].NodeID != wantID {
+			t.Errorf("IPHistory = %+v; want only node %q", got, wantID)
+		}
+	}
+	check("a")
+	b.mu.Lock()
+	b.historyNetMap = nmB
+	b.mu.Unlock()
+	check("b")
+
+	hA.runDone.Wait()
+	hB.runDone.Wait()
+	if got := newIPHistory(t.Logf, hA.path).lookup(ip, time.Time{}); len(got) != 1 || got[0].NodeID != "a" {
+		t.Errorf("reloaded history = %+v; want only node a", got)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"net/netip"
+	"strings"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine/wgcfg"
+)
+
+// markAlwaysOnPeers marks the peers in cfg named by alwaysOn, as in
+// Prefs.AlwaysOnPeers, as AlwaysOn. Names that match no peer are
+// ignored, as the peer may not be in the netmap yet.
+func markAlwaysOnPeers(cfg *wgcfg.Config, nm *netmap.NetworkMap, alwaysOn []string) {
+	if len(alwaysOn) == 0 {
+		return
+	}
+	keys := map[key.NodePublic]bool{}
+	for _, n := range nm.Peers {
+		for _, s := range alwaysOn {
+			if peerMatches(n, s) {
+				keys[n.Key] = true
+				break
+			}
+		}
+	}
+	for i := range cfg.Peers {
+		if keys[cfg.Peers[i].PublicKey] {
+			cfg.Peers[i].AlwaysOn = true
+		}
+	}
+}
+
+// peerMatches reports whether s is one of n's Tailscale IPs, its
+// hostname, or its MagicDNS name, with or without the trailing dot.
+func peerMatches(n *tailcfg.Node, s string) bool {
+	if ip, err := netip.ParseAddr(s); err == nil {
+		for _, a := range n.Addresses {
+			if a.IsSingleIP() && a.Addr() == ip {
+				return true
+			}
+		}
+		return false
+	}
+	return strings.EqualFold(s, n.ComputedName) ||
+		strings.EqualFold(strings.TrimSuffix(s, "."), strings.TrimSuffix(n.Name, "."))
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"net/netip"
+	"testing"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine/wgcfg"
+)
+
+func TestMarkAlwaysOnPeers(t *testing.T) {
+	keys := []key.NodePublic{key.NewNode().Public(), key.NewNode().Public(), key.NewNode().Public()}
+	nm := &netmap.NetworkMap{
+		Peers: []*tailcfg.Node{
+			{Key: keys[0], Name: "db.example.ts.net.", ComputedName: "db", Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")}},
+			{Key: keys[1], Name: "web.example.ts.net.", ComputedName: "web", Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")}},
+			{Key: keys[2], Name: "cache.example.ts.net.", ComputedName: "cache", Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.3/32")}},
+		},
+	}
+	cfg := &wgcfg.Config{}
+	for _, k := range keys {
+		cfg.Peers = append(cfg.Peers, wgcfg.Peer{PublicKey: k})
+	}
+
+	markAlwaysOnPeers(cfg, nm, []string{"DB", "100.64.0.3", "gone"})
+
+	want := []bool{true, false, true}
+	for i, p := range cfg.Peers {
+		if p.AlwaysOn != want[i] {
+			t.Errorf("peer %v AlwaysOn = %v; want %v", nm.Peers[i].ComputedName, p.AlwaysOn, want[i])
+		}
+	}
+
+	for _, s := range []string{"web", "web.example.ts.net", "web.example.ts.net.", "100.64.0.2"} {
+		if !peerMatches(nm.Peers[1], s) {
+			t.Errorf("peerMatches(web, %q) = false; want true", s)
+		}
+	}
+	if peerMatches(nm.Peers[1], "100.64.0.1") {
+		t.Errorf("peerMatches(web, db's IP) = true; want false")
+	}
+}
@@ -6,12 +6,14 @@
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/netip"
+	"net/url"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -31,13 +33,17 @@
 	"tailscale.com/health"
 	"tailscale.com/hostinfo"
 	"tailscale.com/ipn"
+	"tailscale.com/ipn/conffile"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/ipn/policy"
+	"tailscale.com/logtail/backoff"
 	"tailscale.com/net/dns"
+	"tailscale.com/net/dscp"
 	"tailscale.com/net/interfaces"
 	"tailscale.com/net/netutil"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tsdial"
+	"tailscale.com/net/tshttpproxy"
 	"tailscale.com/paths"
 	"tailscale.com/portlist"
 	"tailscale.com/syncs"
@@ -55,11 +61,14 @@
 	"tailscale.com/util/dnsname"
 	"tailscale.com/util/multierr"
 	"tailscale.com/util/osshare"
+	"tailscale.com/util/ringbuffer"
 	"tailscale.com/util/systemd"
+	"tailscale.com/util/winutil"
 	"tailscale.com/version"
 	"tailscale.com/version/distro"
 	"tailscale.com/wgengine"
 	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/flowsample"
 	"tailscale.com/wgengine/magicsock"
 	"tailscale.com/wgengine/router"
 	"tailscale.com/wgengine/wgcfg"
@@ -69,6 +78,11 @@
 var controlDebugFlags = getControlDebugFlags()
 var canSSH = envknob.CanSSHD()
 
+// advertisePeerRelay is whether this node offers to relay packets
+// between peers that can't connect directly, if the tailnet policy
+// grants it tailcfg.CapabilityPeerRelay.
+var advertisePeerRelay = envknob.Bool("TS_EXPERIMENTAL_PEER_RELAY")
+
 func getControlDebugFlags() []string {
 	if e := envknob.String("TS_DEBUG_CONTROL_FLAGS"); e != "" {
 		return strings.Split(e, ",")
@@ -125,6 +139,7 @@ type LocalBackend struct {
 	portpollOnce          sync.Once        // guards starting readPoller
 	gotPortPollRes        chan struct{}    // closed upon first readPoller result
 	serverURL             string           // tailcontrol URL
+	logLeveler            LogLeveler       // or nil if SetLogLeveler never called
 	newDecompressor       func() (controlclient.Decompressor, error)
 	varRoot               string // or empty if SetVarRoot never called
 	sshAtomicBool         atomic.Bool
@@ -132,6 +147,8 @@ type LocalBackend struct {
 
 	filterAtomic            atomic.Pointer[filter.Filter]
 	containsViaIPFuncAtomic syncs.AtomicValue[func(netip.Addr) bool]
+	controlProxyAtomic      syncs.AtomicValue[string]        // Prefs.ControlProxy
+	controlProxyAuth        syncs.AtomicValue[*url.Userinfo] // or nil; see SetControlProxyAuth
 
 	// The mutex protects the following elements.
 	mu             sync.Mutex
@@ -144,6 +161,8 @@ type LocalBackend struct {
 	ccAuto         *controlclient.Auto // if cc is of type *controlclient.Auto
 	stateKey       ipn.StateKey        // computed in part from user-provided value
 	userID         string              // current controlling user ID (for Windows, primarily)
+	lastUser       osUser              // last controlling user, kept across resets
+	userSwitch     *userSwitch         // when lastUser took control, or nil
 	prefs          *ipn.Prefs
 	inServerMode   bool
 	machinePrivKey key.MachinePrivate
@@ -154,22 +173,31 @@ type LocalBackend struct {
 	// hostinfo is mutated in-place while mu is held.
 	hostinfo *tailcfg.Hostinfo
 	// netMap is not mutated in-place once set.
-	netMap           *netmap.NetworkMap
-	nodeByAddr       map[netip.Addr]*tailcfg.Node
-	activeLogin      string // last logged LoginName from netMap
-	engineStatus     ipn.EngineStatus
-	endpoints        []tailcfg.Endpoint
-	blocked          bool
-	keyExpired       bool
-	authURL          string // cleared on Notify
-	authURLSticky    string // not cleared on Notify
-	interact         bool
-	prevIfState      *interfaces.State
-	peerAPIServer    *peerAPIServer // or nil
-	peerAPIListeners []*peerAPIListener
-	loginFlags       controlclient.LoginFlags
-	incomingFiles    map[*incomingFile]bool
-	lastStatusTime   time.Time // status.AsOf value of the last processed status update
+	netMap               *netmap.NetworkMap
+	nodeByAddr           map[netip.Addr]*tailcfg.Node
+	activeLogin          string // last logged LoginName from netMap
+	engineStatus         ipn.EngineStatus
+	endpoints            []tailcfg.Endpoint
+	history              *changeHistory                                   // or nil until first used; see changeHistoryLocked
+	historyNetMap        *netmap.NetworkMap                               // last non-nil netMap, as recorded in history
+	ipHistories          map[string]*ipHistory                            // by ipHistoryProfile; see ipHistoryLocked
+	eventHooks           *eventHookRunner                                 // or nil if no event hooks are set
+	eventHookSpecs       []string                                         // the ipn.Prefs.EventHooks eventHooks was built from
+	netMapSizes          *ringbuffer.RingBuffer[apitype.NetMapSizeSample] // or nil until first sample
+	lastNetMapSizeSample time.Time
+	blocked              bool
+	keyExpired           bool
+	keyExpiryWarn        keyExpiryWarner
+	maint                maintenanceScheduler
+	authURL              string // cleared on Notify
+	authURLSticky        string // not cleared on Notify
+	interact             bool
+	prevIfState          *interfaces.State
+	peerAPIServer        *peerAPIServer // or nil
+	peerAPIListeners     []*peerAPIListener
+	loginFlags           controlclient.LoginFlags
+	incomingFiles        map[*incomingFile]bool
+	lastStatusTime       time.Time // status.AsOf value of the last processed status update
 	// directFileRoot, if non-empty, means to write received files
 	// directly to this directory, without staging them in an
 	// intermediate buffered directory for "pick-up" later. If
@@ -185,10 +213,94 @@ type LocalBackend struct {
 	directFileRoot          string
 	directFileDoFinalRename bool // false on macOS, true on several NAS platforms
 
+	// taildropAcceptRoot is the directory that Taildrop rules'
+	// auto-accept directories are under, from SetTaildropAcceptRoot,
+	// or empty to not auto-accept files. taildropQuotas tracks the
+	// usage of the directories with quotas while files are being
+	// written to them. Both are guarded by mu.
+	taildropAcceptRoot string
+	taildropQuotas     map[string]*dirQuota
+
 	// statusLock must be held before calling statusChanged.Wait() or
 	// statusChanged.Broadcast().
 	statusLock    sync.Mutex
 	statusChanged *sync.Cond
+
+	trafficStats trafficStatsTracker
+
+	// exitClients, if non-nil, tracks the peers using this node as
+	// an exit node. removeExitClientHook, if non-nil, removes its
+	// packet hook, which is installed while advertising exit routes.
+	exitClients          *exitClientTracker
+	removeExitClientHook func()
+
+	// discoKeyRotation is the Prefs.DiscoKeyRotation the disco key was
+	// last set up for. discoKeyTimer, if non-nil, rotates it next.
+	// discoKeyPending is the public key of a rotated disco key that
+	// the control server hasn't yet confirmed. discoKeyRetireTimer,
+	// if non-nil, retires the previous key once a confirmed rotation's
+	// grace period is over. All are guarded by mu.
+	discoKeyRotation    time.Duration
+	discoKeyTimer       *time.Timer
+	discoKeyPending     key.DiscoPublic
+	discoKeyRetireTimer *time.Timer
+
+	healthReport healthReporter
+
+	// conf, if non-nil, is tailscaled's config file, whose prefs
+	// take precedence over any others. It's guarded by mu.
+	conf *conffile.Config
+
+	// ephemeralLogoutTimeout is how long Shutdown keeps trying to
+	// log out an ephemeral node. Zero means the default; negative
+	// means not to log out. It's guarded by mu.
+	ephemeralLogoutTimeout time.Duration
+
+	// controlDial, if non-nil, dials connections to the control
+	// server; see SetControlDialer. It's guarded by mu.
+	controlDial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// netMapGen is incremented on each call to setNetMapLocked, at
+	// which point netMapChanged (if non-nil) is closed and cleared.
+	// Both are guarded by mu.
+	netMapGen     uint64
+	netMapChanged chan struct{}
+
+	// filesChanged, if non-nil, is closed and cleared when a file is
+	// added to the Taildrop waiting-files directory. It's guarded by mu.
+	filesChanged chan struct{}
+
+	// fileSenders is who sent each waiting Taildrop file received
+	// since tailscaled started, keyed by its base name. It's kept
+	// here rather than on the peerAPIServer, which is recreated as
+	// the netmap changes. It's guarded by fileSendersMu.
+	fileSendersMu sync.Mutex
+	fileSenders   map[string]fileSender
+
+	// routeSelections are the subnet routers selected for routes with
+	// more than one; see selectSubnetRouters. routeReselectTimer, if
+	// non-nil, re-evaluates them. Both are guarded by mu.
+	routeSelections    map[netip.Prefix]routeSelection
+	routeReselectTimer *time.Timer
+
+	// exitRotationNodes are the exit nodes Prefs.ExitNodeRotation
+	// last selected; see exitRotationPrefs. exitRotateTimer, if
+	// non-nil, moves to the next one on schedule. Both are guarded by
+	// mu.
+	exitRotationNodes []tailcfg.StableNodeID
+	exitRotateTimer   *time.Timer
+
+	// flowSampler, if non-nil, samples tunneled packets per the
+	// FlowSampleRate and FlowCollector prefs, as last requested in
+	// flowSamplerWant. Both are guarded by mu. flowSamplerMu
+	// serializes updateFlowSampler.
+	flowSampler     *flowsample.Sampler
+	flowSamplerWant flowSamplerConfig
+	flowSamplerMu   sync.Mutex
+
+	// customPeerAPIHandlers are the handlers registered with
+	// RegisterPeerAPIHandler, keyed by name. It's guarded by mu.
+	customPeerAPIHandlers map[string]*customPeerAPIHandler
 }
 
 // clientGen is a func that creates a control plane client.
@@ -291,6 +403,17 @@ func (b *LocalBackend) SetDirectFileDoFinalRename(v bool) {
 	b.directFileDoFinalRename = v
 }
 
+// SetTaildropAcceptRoot sets the directory that the auto-accept
+// directories of Prefs.TaildropRules are relative to. It's set by the
+// machine's administrator, not by prefs, since tailscaled writes files
+// from peers there with its own privileges. If empty, as by default,
+// files are never auto-accepted.
+func (b *LocalBackend) SetTaildropAcceptRoot(dir string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.taildropAcceptRoot = dir
+}
+
 // b.mu must be held.
 func (b *LocalBackend) maybePauseControlClientLocked() {
 	if b.cc == nil {
@@ -343,6 +466,71 @@ func (b *LocalBackend) onHealthChange(sys health.Subsystem, err error) {
 	}
 }
 
+// defaultEphemeralLogoutTimeout is how long Shutdown tries to log out
+// an ephemeral node by default.
+const defaultEphemeralLogoutTimeout = 5 * time.Second
+
+// SetEphemeralLogoutTimeout sets how long Shutdown keeps trying, with
+// backoff, to log out an ephemeral node so the control server deletes
+// it right away. Zero means the default of 5 seconds; a negative d
+// disables the logout, leaving the node to be removed for inactivity.
+func (b *LocalBackend) SetEphemeralLogoutTimeout(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ephemeralLogoutTimeout = d
+}
+
+// SetControlDialer sets the function to make TCP connections to the
+// control server with, in place of the system dialer, for embedders
+// that must reach it in some other way, such as over an existing
+// tunnel. The proxy of the ControlProxy pref, if any, is still used on
+// top of it. It only affects control clients started afterwards.
+func (b *LocalBackend) SetControlDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.controlDial = dial
+}
+
+// SetControlProxyAuth sets the username and password, or nil for
+// none, to authenticate to the proxy of the ControlProxy pref with.
+// They're kept out of prefs, which every local user can read.
+func (b *LocalBackend) SetControlProxyAuth(u *url.Userinfo) {
+	b.controlProxyAuth.Store(u)
+}
+
+// controlProxy returns the HTTP proxy, if any, to connect to the
+// control server through for req, per the ControlProxy pref.
+func (b *LocalBackend) controlProxy(req *http.Request) (*url.URL, error) {
+	switch v := b.controlProxyAtomic.Load(); v {
+	case "":
+		return tshttpproxy.ProxyFromEnvironment(req)
+	case ipn.ControlProxyDirect:
+		return nil, nil
+	default:
+		u, err := ipn.ParseControlProxy(v)
+		if err != nil {
+			return nil, err
+		}
+		u.User = b.controlProxyAuth.Load()
+		return u, nil
+	}
+}
+
+// logoutWithRetry calls logout until it succeeds or ctx is done,
+// backing off between attempts, so that an ephemeral node still gets
+// deleted if the control server is briefly unreachable.
+func logoutWithRetry(ctx context.Context, logf logger.Logf, logout func(context.Context) error) error {
+	bo := backoff.NewBackoff("ephemeral-logout", logf, time.Second)
+	for {
+		err := logout(ctx)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		logf("ephemeral logout failed, retrying: %v", err)
+		bo.BackOff(ctx, err)
+	}
+}
+
 // Shutdown halts the backend and all its sub-components. The backend
 // can no longer be used after Shutdown returns.
 func (b *LocalBackend) Shutdown() {
@@ -353,19 +541,47 @@ func (b *LocalBackend) Shutdown() {
 	}
 	b.shutdownCalled = true
 
-	if b.loginFlags&controlclient.LoginEphemeral != 0 {
+	if b.loginFlags&controlclient.LoginEphemeral != 0 && b.ephemeralLogoutTimeout >= 0 {
+		timeout := b.ephemeralLogoutTimeout
+		if timeout == 0 {
+			timeout = defaultEphemeralLogoutTimeout
+		}
+		hasClient := b.cc != nil
 		b.mu.Unlock()
-		ctx, cancel := context.WithTimeout(b.ctx, 5*time.Second)
-		defer cancel()
-		b.LogoutSync(ctx) // best effort
+		if hasClient {
+			ctx, cancel := context.WithTimeout(b.ctx, timeout)
+			defer cancel()
+			// Best effort: if control stays unreachable, the node
+			// is eventually removed for inactivity instead.
+			if err := logoutWithRetry(ctx, b.logf, b.LogoutSync); err != nil {
+				b.logf("ephemeral logout: %v", err)
+			}
+		}
 		b.mu.Lock()
 	}
 	cc := b.cc
+	if b.routeReselectTimer != nil {
+		b.routeReselectTimer.Stop()
+		b.routeReselectTimer = nil
+	}
+	if b.exitRotateTimer != nil {
+		b.exitRotateTimer.Stop()
+		b.exitRotateTimer = nil
+	}
+	b.setFlowSamplerLocked(0, "")
 	if b.sshServer != nil {
 		b.sshServer.Shutdown()
 		b.sshServer = nil
 	}
 	b.closePeerAPIListenersLocked()
+	b.updateKeyExpiryWarningLocked(time.Time{})
+	b.rearmMaintenanceLocked(time.Now()) // stops its timer
+	b.updateDiscoKeyLocked(nil)          // stops its timer
+	b.updateHealthReporterLocked(nil)    // stops its timer
+	if b.discoKeyRetireTimer != nil {
+		b.discoKeyRetireTimer.Stop()
+		b.discoKeyRetireTimer = nil
+	}
 	b.mu.Unlock()
 
 	b.unregisterLinkMon()
@@ -383,12 +599,18 @@ func (b *LocalBackend) Prefs() *ipn.Prefs {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	p := b.prefs.Clone()
+	redactPrivateKeys(p)
+	return p
+}
+
+// redactPrivateKeys zeroes the private keys in p.Persist, if any, for
+// prefs that are handed out to LocalAPI clients.
+func redactPrivateKeys(p *ipn.Prefs) {
 	if p != nil && p.Persist != nil {
 		p.Persist.LegacyFrontendPrivateMachineKey = key.MachinePrivate{}
 		p.Persist.PrivateNodeKey = key.NodePrivate{}
 		p.Persist.OldPrivateNodeKey = key.NodePrivate{}
 	}
-	return p
 }
 
 // Status returns the latest status of the backend and its
@@ -446,14 +668,14 @@ func (b *LocalBackend) updateStatus(sb *ipnstate.StatusBuilder, extraLocked func
 			s.CurrentTailnet.MagicDNSSuffix = b.netMap.MagicDNSSuffix()
 			s.CurrentTailnet.MagicDNSEnabled = b.netMap.DNS.Proxied
 			s.CurrentTailnet.Name = b.netMap.Domain
-			if b.prefs != nil && !b.prefs.ExitNodeID.IsZero() {
-				if exitPeer, ok := b.netMap.PeerWithStableID(b.prefs.ExitNodeID); ok {
+			if exitID := b.exitNodeIDLocked(); !exitID.IsZero() {
+				if exitPeer, ok := b.netMap.PeerWithStableID(exitID); ok {
 					var online = false
 					if exitPeer.Online != nil {
 						online = *exitPeer.Online
 					}
 					s.ExitNodeStatus = &ipnstate.ExitNodeStatus{
-						ID:           b.prefs.ExitNodeID,
+						ID:           exitID,
 						Online:       online,
 						TailscaleIPs: exitPeer.Addresses,
 					}
@@ -535,7 +757,7 @@ func (b *LocalBackend) populatePeerStatusLocked(sb *ipnstate.StatusBuilder) {
 			LastSeen:       lastSeen,
 			Online:         p.Online != nil && *p.Online,
 			ShareeNode:     p.Hostinfo.ShareeNode(),
-			ExitNode:       p.StableID != "" && p.StableID == b.prefs.ExitNodeID,
+			ExitNode:       b.isExitNodeLocked(p.StableID),
 			ExitNodeOption: exitNodeOption,
 			SSH_HostKeys:   p.Hostinfo.SSH_HostKeys().AsSlice(),
 		})
@@ -569,6 +791,29 @@ func (b *LocalBackend) WhoIs(ipp netip.AddrPort) (n *tailcfg.Node, u tailcfg.Use
 	return n, u, true
 }
 
+// PeerCapMap returns the capabilities, along with any values granted
+// with them, that remote src IP has to the current node.
+func (b *LocalBackend) PeerCapMap(src netip.Addr) tailcfg.PeerCapMap {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.netMap == nil {
+		return nil
+	}
+	filt := b.filterAtomic.Load()
+	if filt == nil {
+		return nil
+	}
+	for _, a := range b.netMap.Addresses {
+		if !a.IsSingleIP() {
+			continue
+		}
+		if a.Addr().BitLen() == src.BitLen() {
+			return filt.CapsWithValues(src, a.Addr())
+		}
+	}
+	return nil
+}
+
 // PeerCaps returns the capabilities that remote src IP has to
 // ths current node.
 func (b *LocalBackend) PeerCaps(src netip.Addr) []string {
@@ -625,6 +870,7 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 	b.mu.Lock()
 	wasBlocked := b.blocked
 	keyExpiryExtended := false
+	var expiryWarning *ipn.KeyExpiryWarning
 	if st.NetMap != nil {
 		wasExpired := b.keyExpired
 		isExpired := !st.NetMap.Expiry.IsZero() && st.NetMap.Expiry.Before(time.Now())
@@ -632,8 +878,10 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 			keyExpiryExtended = true
 		}
 		b.keyExpired = isExpired
+		expiryWarning = b.updateKeyExpiryWarningLocked(st.NetMap.Expiry)
 	}
 	b.mu.Unlock()
+	b.sendKeyExpiryWarning(expiryWarning)
 
 	if keyExpiryExtended && wasBlocked {
 		// Key extended, unblock the engine
@@ -685,6 +933,8 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 			prefsChanged = true
 		}
 		b.setNetMapLocked(st.NetMap)
+		b.checkDiscoKeyConfirmedLocked(st.NetMap)
+		b.updateHealthReporterLocked(st.NetMap)
 	}
 	if st.URL != "" {
 		b.authURL = st.URL
@@ -732,6 +982,7 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 		b.e.SetDERPMap(st.NetMap.DERPMap)
 
 		b.send(ipn.Notify{NetMap: st.NetMap})
+		b.tkaCheckpointIfDue(st.NetMap)
 	}
 	if st.URL != "" {
 		b.logf("Received auth URL: %.20v...", st.URL)
@@ -820,6 +1071,7 @@ func (b *LocalBackend) setWgengineStatus(s *wgengine.Status, err error) {
 	}
 	b.broadcastStatusChanged()
 	b.send(ipn.Notify{Engine: &es})
+	b.publishTrafficStats(s.AsOf, es)
 }
 
 func (b *LocalBackend) broadcastStatusChanged() {
@@ -957,6 +1209,7 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 	hostinfo.FrontendLogID = opts.FrontendLogID
 	hostinfo.Userspace.Set(wgengine.IsNetstack(b.e))
 	hostinfo.UserspaceRouter.Set(wgengine.IsNetstackRouter(b.e))
+	hostinfo.PeerRelay.Set(advertisePeerRelay)
 
 	if b.cc != nil {
 		// TODO(apenwarr): avoid the need to reinit controlclient.
@@ -971,6 +1224,7 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 		b.mu.Lock()
 	}
 	httpTestClient := b.httpTestClient
+	controlDial := b.controlDial
 
 	if b.hostinfo != nil {
 		hostinfo.Services = b.hostinfo.Services // keep any previous services
@@ -984,6 +1238,12 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 	}
 
 	if opts.UpdatePrefs != nil {
+		// As with EditPrefs, prefs set by the config file can't be
+		// changed another way.
+		if err := b.checkConfigFilePrefsLocked(opts.UpdatePrefs); err != nil {
+			b.mu.Unlock()
+			return err
+		}
 		newPrefs := opts.UpdatePrefs
 		newPrefs.Persist = b.prefs.Persist
 		b.prefs = newPrefs
@@ -996,6 +1256,18 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 		b.setAtomicValuesFromPrefs(b.prefs)
 	}
 
+	confAuthKey := false
+	if b.conf != nil {
+		if err := b.applyConfigFilePrefsLocked(opts.StateKey); err != nil {
+			b.mu.Unlock()
+			return err
+		}
+		if opts.AuthKey == "" && b.conf.AuthKey != "" {
+			opts.AuthKey = b.conf.AuthKey
+			confAuthKey = true
+		}
+	}
+
 	wantRunning := b.prefs.WantRunning
 	if wantRunning {
 		if err := b.initMachineKeyLocked(); err != nil {
@@ -1076,6 +1348,8 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 		Pinger:               b,
 		PopBrowserURL:        b.tellClientToBrowseToURL,
 		Dialer:               b.Dialer(),
+		ControlDial:          controlDial,
+		ControlProxy:         b.controlProxy,
 		Status:               b.setClientStatus,
 		C2NHandler:           http.HandlerFunc(b.handleC2N),
 
@@ -1113,6 +1387,10 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 		// is one. If you want tailscaled to be completely idle,
 		// use logout instead.
 		cc.Login(nil, controlclient.LoginDefault)
+	} else if confAuthKey && !loggedOut && prefs.WantRunning {
+		// Log in with the config file's auth key, as "tailscale up"
+		// would with --auth-key.
+		cc.Login(nil, b.loginFlags|controlclient.LoginDefault)
 	}
 	b.stateMachine()
 	return nil
@@ -1134,7 +1412,7 @@ func (b *LocalBackend) updateFilterLocked(netMap *netmap.NetworkMap, prefs *ipn.
 		packetFilter []filter.Match
 		localNetsB   netipx.IPSetBuilder
 		logNetsB     netipx.IPSetBuilder
-		shieldsUp    = prefs == nil || prefs.ShieldsUp // Be conservative when not ready
+		shieldsUp    = prefs == nil || tailnetShieldsUp(prefs) // Be conservative when not ready
 	)
 	// Log traffic for Tailscale IPs.
 	logNetsB.AddPrefix(tsaddr.CGNATRange())
@@ -1320,6 +1598,84 @@ func interfaceRoutes() (ips *netipx.IPSet, hostIPs []netip.Addr, err error) {
 	return ipSet, hostIPs, nil
 }
 
+// exitNodeExcludeRoutes returns the destinations to route directly
+// rather than via the exit node: prefs.ExitNodeExcludeRoutes, plus on
+// Windows any in the comma-separated ExitNodeExcludeRoutes system
+// policy.
+func exitNodeExcludeRoutes(prefs *ipn.Prefs) []netip.Prefix {
+	ret := prefs.ExitNodeExcludeRoutes
+	if pol := winutil.GetPolicyString("ExitNodeExcludeRoutes", ""); pol != "" {
+		ret = append(ret[:len(ret):len(ret)], parsePrefixList(pol)...)
+	}
+	return ret
+}
+
+// shieldsLevel returns the ipn.Prefs.Shields level in effect: the
+// stricter of prefs.Shields and, on Windows, the ShieldsLevel system
+// policy, which is "off" or another level.
+func shieldsLevel(prefs *ipn.Prefs) string {
+	level := prefs.Shields
+	if pol := winutil.GetPolicyString("ShieldsLevel", ""); pol != "" && pol != "off" {
+		level = ipn.StricterShields(level, pol)
+	}
+	return level
+}
+
+// tailnetShieldsUp reports whether to block all incoming connections
+// over Tailscale, per prefs.ShieldsUp or the shields level.
+func tailnetShieldsUp(prefs *ipn.Prefs) bool {
+	return prefs.ShieldsUp || shieldsLevel(prefs) == ipn.ShieldsAll
+}
+
+// shieldsLANRoutes returns the sources allowed in at the ipn.ShieldsLAN
+// shields level: prefs.ShieldsLANRoutes, plus on Windows any in the
+// comma-separated ShieldsLANRoutes system policy.
+func shieldsLANRoutes(prefs *ipn.Prefs) []netip.Prefix {
+	ret := prefs.ShieldsLANRoutes
+	if pol := winutil.GetPolicyString("ShieldsLANRoutes", ""); pol != "" {
+		ret = append(ret[:len(ret):len(ret)], parsePrefixList(pol)...)
+	}
+	return ret
+}
+
+// parsePrefixList parses a comma-separated list of CIDR prefixes,
+// skipping any that are invalid.
+func parsePrefixList(s string) []netip.Prefix {
+	var ret []netip.Prefix
+	for _, f := range strings.Split(s, ",") {
+		if p, err := netip.ParsePrefix(strings.TrimSpace(f)); err == nil {
+			ret = append(ret, p.Masked())
+		}
+	}
+	return ret
+}
+
+// excludeFromDefaultRoutes returns routes with any default routes
+// (0.0.0.0/0 and ::/0) replaced by the set of prefixes that covers
+// them minus excl. Other routes are left alone, so more specific
+// routes to excluded destinations still apply.
+func excludeFromDefaultRoutes(routes, excl []netip.Prefix) []netip.Prefix {
+	var ret []netip.Prefix
+	for _, r := range routes {
+		if r.Bits() != 0 {
+			ret = append(ret, r)
+			continue
+		}
+		var b netipx.IPSetBuilder
+		b.AddPrefix(r)
+		for _, p := range excl {
+			b.RemovePrefix(p)
+		}
+		set, err := b.IPSet()
+		if err != nil {
+			ret = append(ret, r)
+			continue
+		}
+		ret = append(ret, set.Prefixes()...)
+	}
+	return ret
+}
+
 // shrinkDefaultRoute returns an IPSet representing the IPs in route,
 // minus those in removeFromDefaultRoute and localInterfaceRoutes,
 // plus the IPs in hostIPs.
@@ -1745,16 +2101,161 @@ func (b *LocalBackend) loadStateLocked(key ipn.StateKey, prefs *ipn.Prefs) (err
 	return nil
 }
 
-// setAtomicValuesFromPrefs populates sshAtomicBool and containsViaIPFuncAtomic
-// from the prefs p, which may be nil.
+// setAtomicValuesFromPrefs populates sshAtomicBool, controlProxyAtomic and
+// containsViaIPFuncAtomic,
+// the engine's bandwidth limits, pinned endpoints, stealth mode, flow
+// sampler and DSCP passthrough policy, and the maintenance window, from
+// the prefs p, which may be nil.
+//
+// b.mu must be held.
 func (b *LocalBackend) setAtomicValuesFromPrefs(p *ipn.Prefs) {
 	b.sshAtomicBool.Store(p != nil && p.RunSSH && canSSH)
+	if p == nil {
+		b.controlProxyAtomic.Store("")
+	} else {
+		b.controlProxyAtomic.Store(p.ControlProxy)
+	}
 
+	var bw magicsock.BandwidthLimits
+	var pins map[netip.Addr]netip.AddrPort
 	if p == nil {
 		b.containsViaIPFuncAtomic.Store(tsaddr.NewContainsIPFunc(nil))
 	} else {
 		b.containsViaIPFuncAtomic.Store(tsaddr.NewContainsIPFunc(tsaddr.FilterPrefixesCopy(p.AdvertiseRoutes, tsaddr.IsViaPrefix)))
+		bw.Total = kbpsToBytesPerSec(p.MaxBandwidthKbps)
+		bw.PerPeer = kbpsToBytesPerSec(p.MaxPeerBandwidthKbps)
+		if len(p.PinnedEndpoints) > 0 {
+			pins = make(map[netip.Addr]netip.AddrPort, len(p.PinnedEndpoints))
+			for _, pe := range p.PinnedEndpoints {
+				pins[pe.Peer] = pe.Endpoint
+			}
+		}
+	}
+	if mc, err := b.magicConn(); err == nil {
+		mc.SetBandwidthLimits(bw)
+		mc.SetPinnedEndpoints(pins)
+		mc.SetStealth(p != nil && p.Stealth)
+	}
+	if p == nil {
+		b.setFlowSamplerLocked(0, "")
+	} else {
+		b.setFlowSamplerLocked(p.FlowSampleRate, p.FlowCollector)
 	}
+
+	var dscpPolicy *dscp.Policy
+	if p != nil {
+		var err error
+		dscpPolicy, err = dscp.ParsePolicy(p.DSCPPassthrough)
+		if err != nil {
+			b.logf("DSCP passthrough: %v", err)
+		}
+	}
+	if ig, ok := b.e.(wgengine.InternalsGetter); ok {
+		if tunWrap, _, _, ok := ig.GetInternals(); ok {
+			tunWrap.SetDSCPPolicy(dscpPolicy)
+		}
+	}
+
+	if p == nil {
+		b.setMaintenanceWindowLocked("")
+	} else {
+		b.setMaintenanceWindowLocked(p.MaintenanceWindow)
+	}
+
+	var dialRules []tsdial.SystemDialRule
+	if p != nil {
+		for _, r := range p.SystemDialRules {
+			dialRules = append(dialRules, tsdial.SystemDialRule{
+				Dest:      r.Dest,
+				Timeout:   r.Timeout,
+				Interface: r.Interface,
+			})
+		}
+	}
+	b.dialer.SetSystemDialRules(dialRules)
+
+	b.updateExitClientsLocked(p)
+	b.updateDiscoKeyLocked(p)
+	b.updateEventHooksLocked(p)
+}
+
+// flowSamplerConfig is the rate and collector of a flow sampler, both
+// zero for none.
+type flowSamplerConfig struct {
+	rate      int
+	collector string
+}
+
+// setFlowSamplerLocked starts sampling 1 in rate tunneled packets to
+// collector, replacing any previous sampler. If either is zero,
+// sampling is stopped. The sampler is started, which may resolve and
+// dial the collector, and the old one closed in the background,
+// without b.mu held.
+//
+// b.mu must be held.
+func (b *LocalBackend) setFlowSamplerLocked(rate int, collector string) {
+	want := flowSamplerConfig{rate, collector}
+	if rate <= 0 || collector == "" {
+		want = flowSamplerConfig{}
+	}
+	if want == b.flowSamplerWant {
+		return
+	}
+	b.flowSamplerWant = want
+	go b.updateFlowSampler()
+}
+
+// updateFlowSampler replaces the flow sampler with one per
+// b.flowSamplerWant, if it's not that already.
+func (b *LocalBackend) updateFlowSampler() {
+	b.flowSamplerMu.Lock()
+	defer b.flowSamplerMu.Unlock()
+
+	b.mu.Lock()
+	want, cur := b.flowSamplerWant, b.flowSampler
+	b.mu.Unlock()
+	if cur == nil && want.rate == 0 || cur != nil && cur.Rate() == want.rate && cur.Collector() == want.collector {
+		return
+	}
+	var fs *flowsample.Sampler
+	if want.rate > 0 {
+		var err error
+		fs, err = flowsample.New(b.logf, want.rate, want.collector)
+		if err != nil {
+			b.logf("flow sampling: %v", err)
+		}
+	}
+
+	b.mu.Lock()
+	if b.flowSamplerWant != want {
+		// Changed meanwhile; the updateFlowSampler started by that
+		// change will apply it.
+		b.mu.Unlock()
+		if fs != nil {
+			fs.Close()
+		}
+		return
+	}
+	if ig, ok := b.e.(wgengine.InternalsGetter); ok {
+		if tunWrap, _, _, ok := ig.GetInternals(); ok {
+			tunWrap.SetFlowSampler(fs)
+		}
+	}
+	old := b.flowSampler
+	b.flowSampler = fs
+	b.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
+
+// kbpsToBytesPerSec converts kbps, in kilobits per second, to bytes
+// per second. Non-positive values (unlimited) map to zero.
+func kbpsToBytesPerSec(kbps int) int64 {
+	if kbps <= 0 {
+		return 0
+	}
+	return int64(kbps) * 1000 / 8
 }
 
 // State returns the backend state machine's current state.
@@ -1870,6 +2371,136 @@ func (b *LocalBackend) pingPeerAPI(ctx context.Context, ip netip.Addr) (peer *ta
 	return peer, base, nil
 }
 
+// WakeOnLAN sends a Wake-on-LAN magic packet for mac to wake the peer
+// with Tailscale IP target, which is asleep and so offline from the
+// tailnet, by asking a peer on its LAN to broadcast the packet there.
+//
+// If via is valid, the peer with that Tailscale IP is asked. Otherwise
+// each online peer last seen on the same LAN as target, per
+// wolRelays, is asked in turn until one sends it. A relay must be
+// owned by the same user or grant this node
+// tailcfg.CapabilityWakeOnLAN.
+func (b *LocalBackend) WakeOnLAN(ctx context.Context, target netip.Addr, mac net.HardwareAddr, via netip.Addr) (*apitype.WakeOnLANResponse, error) {
+	nm := b.NetMap()
+	if nm == nil {
+		return nil, errors.New("no netmap")
+	}
+	var relays []*tailcfg.Node
+	if via.IsValid() {
+		peer, ok := nm.PeerByTailscaleIP(via)
+		if !ok {
+			return nil, fmt.Errorf("no peer found with Tailscale IP %v", via)
+		}
+		relays = append(relays, peer)
+	} else {
+		peer, ok := nm.PeerByTailscaleIP(target)
+		if !ok {
+			return nil, fmt.Errorf("no peer found with Tailscale IP %v", target)
+		}
+		relays = wolRelays(nm, peer)
+		if len(relays) == 0 {
+			return nil, fmt.Errorf("no online peer found on the same LAN as %v", peer.ComputedName)
+		}
+	}
+	var errs []error
+	for _, relay := range relays {
+		res, err := b.sendWakeOnLAN(ctx, nm, relay, mac)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(res.SentTo) == 0 {
+			errs = append(errs, fmt.Errorf("%v sent no packet: %s", relay.ComputedName, strings.Join(res.Errors, "; ")))
+			continue
+		}
+		res.Via = relay.ComputedName
+		return res, nil
+	}
+	return nil, multierr.New(errs...)
+}
+
+// wolRelays returns the online peers, other than target, that nm last
+// saw on the same LAN as target: behind the same public IPv4 address
+// or in the same public IPv6 /64. Peers owned by target's user come
+// first, as they're the most likely to allow waking it.
+func wolRelays(nm *netmap.NetworkMap, target *tailcfg.Node) []*tailcfg.Node {
+	lans := wolLANs(target)
+	if len(lans) == 0 {
+		return nil
+	}
+	var relays []*tailcfg.Node
+	for _, p := range nm.Peers {
+		if p == target || p.Online == nil || !*p.Online || peerAPIBase(nm, p) == "" {
+			continue
+		}
+		for lan := range wolLANs(p) {
+			if lans[lan] {
+				relays = append(relays, p)
+				break
+			}
+		}
+	}
+	sort.SliceStable(relays, func(i, j int) bool {
+		return relays[i].User == target.User && relays[j].User != target.User
+	})
+	return relays
+}
+
+// wolLANs returns the LANs that n's public endpoints put it on, as the
+// public IPv4 address it's behind or its public IPv6 /64.
+func wolLANs(n *tailcfg.Node) map[netip.Prefix]bool {
+	ret := map[netip.Prefix]bool{}
+	for _, ep := range n.Endpoints {
+		ipp, err := netip.ParseAddrPort(ep)
+		if err != nil {
+			continue
+		}
+		ip := ipp.Addr().Unmap()
+		if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+			continue
+		}
+		bits := 32
+		if ip.Is6() {
+			bits = 64
+		}
+		pfx, _ := ip.Prefix(bits)
+		ret[pfx] = true
+	}
+	return ret
+}
+
+// sendWakeOnLAN asks the peer relay to broadcast a Wake-on-LAN magic
+// packet for mac on its local networks.
+func (b *LocalBackend) sendWakeOnLAN(ctx context.Context, nm *netmap.NetworkMap, relay *tailcfg.Node, mac net.HardwareAddr) (*apitype.WakeOnLANResponse, error) {
+	base := peerAPIBase(nm, relay)
+	if base == "" {
+		return nil, fmt.Errorf("%v has no peer API; is it online?", relay.ComputedName)
+	}
+	form := url.Values{"mac": {mac.String()}}
+	req, err := http.NewRequestWithContext(ctx, "POST", base+"/v0/wol", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := b.Dialer().PeerAPITransport().RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%v: %v: %s", relay.ComputedName, res.Status, strings.TrimSpace(string(body)))
+	}
+	ret := new(apitype.WakeOnLANResponse)
+	if err := json.Unmarshal(body, ret); err != nil {
+		return nil, fmt.Errorf("invalid response from %v: %w", relay.ComputedName, err)
+	}
+	return ret, nil
+}
+
 // parseWgStatusLocked returns an EngineStatus based on s.
 //
 // b.mu must be held; mostly because the caller is about to anyway, and doing so
@@ -1912,13 +2543,7 @@ func (b *LocalBackend) shouldUploadServices() bool {
 	if b.prefs == nil || b.netMap == nil {
 		return false // default to safest setting
 	}
-	return !b.prefs.ShieldsUp && b.netMap.CollectServices
-}
-
-func (b *LocalBackend) SetCurrentUserID(uid string) {
-	b.mu.Lock()
-	b.userID = uid
-	b.mu.Unlock()
+	return !tailnetShieldsUp(b.prefs) && b.netMap.CollectServices
 }
 
 func (b *LocalBackend) CheckPrefs(p *ipn.Prefs) error {
@@ -1936,9 +2561,33 @@ func (b *LocalBackend) checkPrefsLocked(p *ipn.Prefs) error {
 	if err := b.checkSSHPrefsLocked(p); err != nil {
 		errs = append(errs, err)
 	}
+	if err := b.checkConfigFilePrefsLocked(p); err != nil {
+		errs = append(errs, err)
+	}
+	if v := p.ControlProxy; v != "" && v != ipn.ControlProxyDirect {
+		if _, err := ipn.ParseControlProxy(v); err != nil {
+			errs = append(errs, fmt.Errorf("ControlProxy: %w", err))
+		}
+	}
+	if err := checkShieldsPrefs(p); err != nil {
+		errs = append(errs, err)
+	}
 	return multierr.New(errs...)
 }
 
+// checkShieldsPrefs checks p's Shields level, which is only enforced
+// outside Tailscale on Linux if Tailscale's netfilter chains are
+// hooked in.
+func checkShieldsPrefs(p *ipn.Prefs) error {
+	if !ipn.ValidShields(p.Shields) {
+		return fmt.Errorf("Shields: unknown level %q", p.Shields)
+	}
+	if p.Shields != ipn.ShieldsOff && p.NetfilterMode == preftype.NetfilterNoDivert && runtime.GOOS == "linux" {
+		return fmt.Errorf("Shields: level %q can't be used with netfilter mode nodivert", p.Shields)
+	}
+	return nil
+}
+
 func (b *LocalBackend) checkSSHPrefsLocked(p *ipn.Prefs) error {
 	if !p.RunSSH {
 		return nil
@@ -2014,20 +2663,30 @@ func (b *LocalBackend) isDefaultServerLocked() bool {
 }
 
 func (b *LocalBackend) EditPrefs(mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
+	return b.EditPrefsIfMatch(mp, "")
+}
+
+// ErrPrefsConflict is returned by EditPrefsIfMatch when the prefs were
+// changed since the caller read them.
+var ErrPrefsConflict = errors.New("prefs were changed by another writer; re-read and retry")
+
+// EditPrefsIfMatch is like EditPrefs, but if etag is non-empty, it only
+// applies mp if etag is the ipn.Prefs.ETag of the current prefs, and
+// otherwise returns ErrPrefsConflict. This lets writers that
+// read-modify-write prefs detect that they raced with another writer.
+func (b *LocalBackend) EditPrefsIfMatch(mp *ipn.MaskedPrefs, etag string) (*ipn.Prefs, error) {
 	b.mu.Lock()
+	if etag != "" && b.prefs.ETag() != etag {
+		b.mu.Unlock()
+		return nil, ErrPrefsConflict
+	}
 	p0 := b.prefs.Clone()
-	p1 := b.prefs.Clone()
-	p1.ApplyEdits(mp)
-	if err := b.checkPrefsLocked(p1); err != nil {
+	p1, err := b.editedPrefsLocked(mp)
+	if err != nil {
 		b.mu.Unlock()
 		b.logf("EditPrefs check error: %v", err)
 		return nil, err
 	}
-	if p1.RunSSH && !canSSH {
-		b.mu.Unlock()
-		b.logf("EditPrefs requests SSH, but disabled by envknob; returning error")
-		return nil, errors.New("Tailscale SSH server administratively disabled.")
-	}
 	if p1.Equals(p0) {
 		b.mu.Unlock()
 		return p1, nil
@@ -2041,6 +2700,35 @@ func (b *LocalBackend) EditPrefs(mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
 	return p1, nil
 }
 
+// PreviewEditPrefs returns the prefs that EditPrefs(mp) would result
+// in, or the error it would return, without changing anything. Like
+// Prefs, the returned prefs have their private keys redacted.
+func (b *LocalBackend) PreviewEditPrefs(mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p, err := b.editedPrefsLocked(mp)
+	if err != nil {
+		return nil, err
+	}
+	redactPrivateKeys(p)
+	return p, nil
+}
+
+// editedPrefsLocked returns a copy of the current prefs with mp
+// applied, or an error if the result isn't valid.
+func (b *LocalBackend) editedPrefsLocked(mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
+	p1 := b.prefs.Clone()
+	p1.ApplyEdits(mp)
+	if err := b.checkPrefsLocked(p1); err != nil {
+		return nil, err
+	}
+	if p1.RunSSH && !canSSH {
+		b.logf("EditPrefs requests SSH, but disabled by envknob; returning error")
+		return nil, errors.New("Tailscale SSH server administratively disabled.")
+	}
+	return p1, nil
+}
+
 // SetPrefs saves new user preferences and propagates them throughout
 // the system. Implements Backend.
 func (b *LocalBackend) SetPrefs(newp *ipn.Prefs) {
@@ -2057,6 +2745,10 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) {
 	netMap := b.netMap
 	stateKey := b.stateKey
 
+	if b.conf != nil {
+		// The config file wins over prefs set any other way.
+		newp.ApplyEdits(&b.configFileLocked().Prefs)
+	}
 	b.setAtomicValuesFromPrefs(newp)
 
 	oldp := b.prefs
@@ -2066,6 +2758,14 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) {
 	// everything in this function treats b.prefs as completely new
 	// anyway. No-op if no exit node resolution is needed.
 	b.findExitNodeIDLocked(netMap)
+	if oldp.ExitNodeID != b.prefs.ExitNodeID || oldp.ExitNodeIP != b.prefs.ExitNodeIP {
+		b.changeHistoryLocked().add(apitype.HistoryEvent{
+			Time: time.Now(),
+			Type: "exit-node-changed",
+			Old:  exitNodeHistoryName(netMap, oldp),
+			New:  exitNodeHistoryName(netMap, b.prefs),
+		})
+	}
 	b.inServerMode = newp.ForceDaemon
 	// We do this to avoid holding the lock while doing everything else.
 	newp = b.prefs.Clone()
@@ -2114,7 +2814,7 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) {
 		}
 	}
 
-	if oldp.ShieldsUp != newp.ShieldsUp || hostInfoChanged {
+	if tailnetShieldsUp(oldp) != tailnetShieldsUp(newp) || hostInfoChanged {
 		b.doSetHostinfoFilterServices(newHi)
 	}
 
@@ -2275,6 +2975,7 @@ func (b *LocalBackend) authReconfig() {
 		b.logf("[v1] authReconfig: skipping because !WantRunning.")
 		return
 	}
+	prefs, exitNodes := b.exitRotationPrefs(prefs, nm)
 
 	var flags netmap.WGConfigFlags
 	if prefs.RouteAll {
@@ -2304,10 +3005,21 @@ func (b *LocalBackend) authReconfig() {
 		b.logf("wgcfg: %v", err)
 		return
 	}
+	routeSel, _ := b.selectSubnetRouters(nm)
+	applySubnetRouterSelection(cfg, nm, routeSel)
+	cfg.LazyPeers = prefs.LazyPeers
+	markAlwaysOnPeers(cfg, nm, prefs.AlwaysOnPeers)
 
 	oneCGNATRoute := shouldUseOneCGNATRoute(nm, b.logf, version.OS())
 	rcfg := b.routerConfig(cfg, prefs, oneCGNATRoute)
 	dcfg := dnsConfigForNetmap(nm, prefs, b.logf, version.OS())
+	// Only WireGuard needs the exit routes split; the OS routes all
+	// internet traffic into the tunnel either way.
+	spreadExitRoutes(cfg, exitNodes)
+
+	b.mu.Lock()
+	b.holdPolicyRoutesLocked(cfg, rcfg, nm, policyRoutesKey(prefs, flags))
+	b.mu.Unlock()
 
 	err = b.e.Reconfig(cfg, rcfg, dcfg, nm.Debug)
 	if err == wgengine.ErrNoChanges {
@@ -2350,6 +3062,24 @@ func shouldUseOneCGNATRoute(nm *netmap.NetworkMap, logf logger.Logf, versionOS s
 	return false
 }
 
+// addViaRoutes adds the 4via6 routes that peer is the primary subnet
+// router for to dcfg.ViaRoutes, so that "<IPv4>.via-<peer>" resolves.
+func addViaRoutes(dcfg *dns.Config, peer *tailcfg.Node) {
+	name := strings.ToLower(dnsname.FirstLabel(peer.Name))
+	if name == "" {
+		return
+	}
+	for _, r := range peer.PrimaryRoutes {
+		if !tsaddr.IsViaPrefix(r) {
+			continue
+		}
+		if dcfg.ViaRoutes == nil {
+			dcfg.ViaRoutes = map[string][]netip.Prefix{}
+		}
+		dcfg.ViaRoutes[name] = append(dcfg.ViaRoutes[name], r)
+	}
+}
+
 // dnsConfigForNetmap returns a *dns.Config for the given netmap,
 // prefs, client OS version, and cloud hosting environment.
 //
@@ -2406,6 +3136,7 @@ func dnsConfigForNetmap(nm *netmap.NetworkMap, prefs *ipn.Prefs, logf logger.Log
 	set(nm.Name, nm.Addresses)
 	for _, peer := range nm.Peers {
 		set(peer.Name, peer.Addresses)
+		addViaRoutes(dcfg, peer)
 	}
 	for _, rec := range nm.DNS.ExtraRecords {
 		switch rec.Type {
@@ -2426,6 +3157,9 @@ func dnsConfigForNetmap(nm *netmap.NetworkMap, prefs *ipn.Prefs, logf logger.Log
 		}
 		dcfg.Hosts[fqdn] = append(dcfg.Hosts[fqdn], ip)
 	}
+	// The hosts file is for software that doesn't see the DNS config
+	// we'd give the OS, so it's synced even if CorpDNS is off.
+	dcfg.SyncHostsFile = prefs.SyncHostsFile
 
 	if !prefs.CorpDNS {
 		return dcfg
@@ -2525,6 +3259,49 @@ func (b *LocalBackend) SetVarRoot(dir string) {
 	b.varRoot = dir
 }
 
+// LogLeveler controls the verbosity of individual components' log
+// messages, such as the "magicsock: ..." ones. It's implemented by
+// *logtail.Logger.
+type LogLeveler interface {
+	// SetComponentVerbosityLevel sets the verbosity level of the
+	// named component. A negative level resets it to the default.
+	SetComponentVerbosityLevel(component string, level int)
+
+	// ComponentVerbosityLevels returns the components whose levels
+	// have been set, and their levels.
+	ComponentVerbosityLevels() map[string]int
+}
+
+// SetLogLeveler sets the LogLeveler used by SetComponentLogLevel.
+//
+// It should only be called before the LocalBackend is used.
+func (b *LocalBackend) SetLogLeveler(l LogLeveler) {
+	b.logLeveler = l
+}
+
+// SetComponentLogLevel sets the log verbosity level of component. A
+// negative level resets it to the default.
+func (b *LocalBackend) SetComponentLogLevel(component string, level int) error {
+	if b.logLeveler == nil {
+		return errors.New("per-component log levels not supported")
+	}
+	if component == "" || strings.ContainsAny(component, ": \n") {
+		return fmt.Errorf("invalid component name %q", component)
+	}
+	b.logf("setting log level of %q to %d", component, level)
+	b.logLeveler.SetComponentVerbosityLevel(component, level)
+	return nil
+}
+
+// ComponentLogLevels returns the log verbosity levels set with
+// SetComponentLogLevel, keyed by component.
+func (b *LocalBackend) ComponentLogLevels() (map[string]int, error) {
+	if b.logLeveler == nil {
+		return nil, errors.New("per-component log levels not supported")
+	}
+	return b.logLeveler.ComponentVerbosityLevels(), nil
+}
+
 // TailscaleVarRoot returns the root directory of Tailscale's writable
 // storage area. (e.g. "/var/lib/tailscale")
 //
@@ -2765,6 +3542,15 @@ func (b *LocalBackend) routerConfig(cfg *wgcfg.Config, prefs *ipn.Prefs, oneCGNA
 		Routes:           peerRoutes(cfg.Peers, singleRouteThreshold),
 	}
 
+	switch shieldsLevel(prefs) {
+	case ipn.ShieldsOff:
+	case ipn.ShieldsLAN:
+		rs.InboundShields = true
+		rs.InboundAllowed = shieldsLANRoutes(prefs)
+	default:
+		rs.InboundShields = true
+	}
+
 	if distro.Get() == distro.Synology {
 		// Issue 1995: we don't use iptables on Synology.
 		rs.NetfilterMode = preftype.NetfilterOff
@@ -2810,6 +3596,10 @@ func (b *LocalBackend) routerConfig(cfg *wgcfg.Config, prefs *ipn.Prefs, oneCGNA
 			}
 			b.logf("allowing exit node access to local IPs: %v", rs.LocalRoutes)
 		}
+		if excl := exitNodeExcludeRoutes(prefs); len(excl) > 0 {
+			rs.Routes = excludeFromDefaultRoutes(rs.Routes, excl)
+			b.logf("routing around exit node: %v", excl)
+		}
 	}
 
 	if tsaddr.PrefixesContainsFunc(rs.LocalAddrs, tsaddr.PrefixIs4) {
@@ -2839,7 +3629,7 @@ func (b *LocalBackend) applyPrefsToHostinfo(hi *tailcfg.Hostinfo, prefs *ipn.Pre
 	}
 	hi.RoutableIPs = append(prefs.AdvertiseRoutes[:0:0], prefs.AdvertiseRoutes...)
 	hi.RequestTags = append(prefs.AdvertiseTags[:0:0], prefs.AdvertiseTags...)
-	hi.ShieldsUp = prefs.ShieldsUp
+	hi.ShieldsUp = tailnetShieldsUp(prefs)
 
 	var sshHostKeys []string
 	if prefs.RunSSH && canSSH {
@@ -3157,7 +3947,24 @@ func (b *LocalBackend) setNetMapLocked(nm *netmap.NetworkMap) {
 			login = "<missing-profile>"
 		}
 	}
+	if nm != nil {
+		now := time.Now()
+		evs := netMapHistoryEvents(now, b.historyNetMap, nm)
+		b.changeHistoryLocked().add(evs...)
+		b.ipHistoryLocked(ipHistoryProfile(nm)).update(now, nm)
+		if b.eventHooks != nil {
+			evs = append(peerOnlineEvents(now, b.historyNetMap, nm), evs...)
+			b.eventHooks.queue(b.eventHooks.runsFor(nm, evs))
+		}
+		b.historyNetMap = nm
+	}
+	b.maybeSampleNetMapSizeLocked(nm)
 	b.netMap = nm
+	b.netMapGen++
+	if b.netMapChanged != nil {
+		close(b.netMapChanged)
+		b.netMapChanged = nil
+	}
 	if login != b.activeLogin {
 		b.logf("active login: %v", login)
 		b.activeLogin = login
@@ -3544,6 +4351,55 @@ func (b *LocalBackend) DebugReSTUN() error {
 	return nil
 }
 
+// DiscoDebugState returns the state of the disco protocol with each
+// peer. See magicsock.Conn.DiscoDebugState.
+func (b *LocalBackend) DiscoDebugState() ([]ipnstate.PeerDiscoState, error) {
+	mc, err := b.magicConn()
+	if err != nil {
+		return nil, err
+	}
+	return mc.DiscoDebugState(), nil
+}
+
+// DERPHealth returns the health of the connection to each DERP region.
+// See magicsock.Conn.DERPHealth.
+func (b *LocalBackend) DERPHealth() ([]ipnstate.DERPConnState, error) {
+	mc, err := b.magicConn()
+	if err != nil {
+		return nil, err
+	}
+	return mc.DERPHealth(), nil
+}
+
+// SetPathImpairment adds artificial latency and loss to the packets
+// sent to the peer with public key peer, for testing. See
+// magicsock.Conn.SetPathImpairment.
+func (b *LocalBackend) SetPathImpairment(peer key.NodePublic, imp magicsock.PathImpairment) error {
+	mc, err := b.magicConn()
+	if err != nil {
+		return err
+	}
+	return mc.SetPathImpairment(peer, imp)
+}
+
+// PathImpairments returns the impairments set by SetPathImpairment.
+func (b *LocalBackend) PathImpairments() ([]ipnstate.PathImpairment, error) {
+	mc, err := b.magicConn()
+	if err != nil {
+		return nil, err
+	}
+	return mc.PathImpairments(), nil
+}
+
+// WritePeerLatencyMetrics writes per-peer latency histograms to w in
+// the Prometheus text exposition format. See
+// magicsock.Conn.WritePeerLatencyMetrics.
+func (b *LocalBackend) WritePeerLatencyMetrics(w io.Writer) {
+	if mc, err := b.magicConn(); err == nil {
+		mc.WritePeerLatencyMetrics(w)
+	}
+}
+
 func (b *LocalBackend) magicConn() (*magicsock.Conn, error) {
 	ig, ok := b.e.(wgengine.InternalsGetter)
 	if !ok {
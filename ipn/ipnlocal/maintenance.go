@@ -0,0 +1,315 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"time"
+
+	"golang.org/x/exp/slices"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+	"tailscale.com/util/maintwindow"
+	"tailscale.com/wgengine/router"
+	"tailscale.com/wgengine/wgcfg"
+)
+
+// Kinds of disruptive operations deferred to the maintenance window.
+const (
+	maintRoutes = "routes" // route changes from the tailnet policy
+	maintReauth = "reauth" // re-registering with an auth key, rotating the node key
+)
+
+// ErrMaintenanceDeferred is wrapped by the errors of operations that
+// were queued for the maintenance window rather than run.
+var ErrMaintenanceDeferred = errors.New("deferred to the maintenance window")
+
+// maintenanceScheduler defers disruptive operations until the
+// maintenance window set by ipn.Prefs.MaintenanceWindow. It's guarded
+// by LocalBackend.mu.
+type maintenanceScheduler struct {
+	window        *maintwindow.Window // or nil to run everything immediately
+	overrideUntil time.Time           // until when to run everything immediately
+
+	pending map[string]pendingMaintenance // by kind; at most one of each
+	timer   *time.Timer                   // fires when pending can next run, or nil
+
+	// routes are the routes last given to the router, peerRoutes the
+	// AllowedIPs last given to WireGuard (by node, so that they survive
+	// node key rotation), and routesKey the prefs they were computed
+	// from, for holdPolicyRoutesLocked.
+	routes     []netip.Prefix
+	peerRoutes map[tailcfg.StableNodeID][]netip.Prefix
+	routesKey  string
+	haveRoutes bool
+}
+
+type pendingMaintenance struct {
+	since time.Time // when first deferred
+	run   func()
+}
+
+// setMaintenanceWindowLocked parses and sets the maintenance window
+// from the MaintenanceWindow pref s.
+//
+// b.mu must be held.
+func (b *LocalBackend) setMaintenanceWindowLocked(s string) {
+	m := &b.maint
+	if m.window == nil && s == "" || m.window != nil && m.window.String() == s {
+		return
+	}
+	w, err := maintwindow.Parse(s)
+	if err != nil {
+		b.logf("maintenance window: %v", err)
+	}
+	m.window = w
+	b.rearmMaintenanceLocked(time.Now())
+}
+
+// maintenanceAllowedLocked reports whether disruptive operations may
+// run at now.
+//
+// b.mu must be held.
+func (b *LocalBackend) maintenanceAllowedLocked(now time.Time) bool {
+	m := &b.maint
+	return m.window == nil || now.Before(m.overrideUntil) || m.window.Contains(now)
+}
+
+// deferMaintenance reports whether the disruptive operation run, of
+// the given kind, must wait for the maintenance window. If so, it's
+// run in the window instead, replacing any earlier pending operation
+// of the same kind; otherwise the caller should run it now.
+func (b *LocalBackend) deferMaintenance(kind string, run func()) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.maintenanceAllowedLocked(time.Now()) {
+		return false
+	}
+	b.deferMaintenanceLocked(kind, run)
+	return true
+}
+
+// deferMaintenanceLocked queues run as the pending operation of the
+// given kind.
+//
+// b.mu must be held.
+func (b *LocalBackend) deferMaintenanceLocked(kind string, run func()) {
+	m := &b.maint
+	now := time.Now()
+	pm, ok := m.pending[kind]
+	if !ok {
+		pm.since = now
+		b.logf("maintenance: deferring %s until %v", kind, m.window.Next(now).Format(time.RFC3339))
+	}
+	pm.run = run
+	if m.pending == nil {
+		m.pending = map[string]pendingMaintenance{}
+	}
+	m.pending[kind] = pm
+	b.rearmMaintenanceLocked(now)
+}
+
+// rearmMaintenanceLocked schedules the pending operations to run as
+// soon as they're allowed.
+//
+// b.mu must be held.
+func (b *LocalBackend) rearmMaintenanceLocked(now time.Time) {
+	m := &b.maint
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+	if len(m.pending) == 0 || b.shutdownCalled {
+		return
+	}
+	at := now
+	if !b.maintenanceAllowedLocked(now) {
+		at = m.window.Next(now)
+	}
+	m.timer = time.AfterFunc(at.Sub(now), b.runMaintenance)
+}
+
+// runMaintenance runs the pending operations, if they're allowed now.
+func (b *LocalBackend) runMaintenance() {
+	b.mu.Lock()
+	now := time.Now()
+	if b.shutdownCalled {
+		b.mu.Unlock()
+		return
+	}
+	if !b.maintenanceAllowedLocked(now) {
+		// Woken early, as by a clock change.
+		b.rearmMaintenanceLocked(now)
+		b.mu.Unlock()
+		return
+	}
+	pending := b.maint.pending
+	b.maint.pending = nil
+	b.maint.timer = nil
+	b.mu.Unlock()
+
+	kinds := make([]string, 0, len(pending))
+	for kind := range pending {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		b.logf("maintenance: running %s deferred since %v", kind, pending[kind].since.Format(time.RFC3339))
+		pending[kind].run()
+	}
+}
+
+// AllowMaintenance overrides the maintenance window, letting
+// disruptive operations, including those already deferred, run
+// immediately for the next d. A d of zero or less ends any override.
+func (b *LocalBackend) AllowMaintenance(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if d > 0 {
+		b.maint.overrideUntil = now.Add(d)
+		b.logf("maintenance: window overridden until %v", b.maint.overrideUntil.Format(time.RFC3339))
+	} else {
+		b.maint.overrideUntil = time.Time{}
+	}
+	b.rearmMaintenanceLocked(now)
+}
+
+// MaintenanceStatus returns the maintenance window and the operations
+// waiting for it.
+func (b *LocalBackend) MaintenanceStatus() *apitype.MaintenanceStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m := &b.maint
+	now := time.Now()
+	st := &apitype.MaintenanceStatus{
+		Allowed: b.maintenanceAllowedLocked(now),
+	}
+	if m.window != nil {
+		st.Window = m.window.String()
+		st.NextWindow = m.window.Next(now)
+	}
+	if now.Before(m.overrideUntil) {
+		st.OverrideUntil = m.overrideUntil
+	}
+	for kind, pm := range m.pending {
+		st.Pending = append(st.Pending, apitype.PendingMaintenance{Kind: kind, Since: pm.since})
+	}
+	sort.Slice(st.Pending, func(i, j int) bool { return st.Pending[i].Kind < st.Pending[j].Kind })
+	return st
+}
+
+// policyRoutesKey returns a key for the prefs that routes are computed
+// from, so that route changes from prefs changes, which the user asked
+// for, aren't deferred.
+func policyRoutesKey(prefs *ipn.Prefs, flags netmap.WGConfigFlags) string {
+	return fmt.Sprintf("%v/%v/%v/%v/%v", flags, prefs.ExitNodeID, prefs.ExitNodeIP, prefs.ExitNodeAllowLANAccess, prefs.ExitNodeExcludeRoutes)
+}
+
+// holdPolicyRoutesLocked holds back changes to the subnet and exit
+// node routes in cfg, the WireGuard config, and rcfg, the router
+// config, that aren't due to a prefs change (as identified by
+// routesKey), keeping the routes last used in their place, and defers
+// an authReconfig to apply them in the maintenance window. Routes to
+// peers' Tailscale IPs are always updated, as are routes whose router
+// in nm has gone offline, so that failover isn't held back.
+//
+// b.mu must be held.
+func (b *LocalBackend) holdPolicyRoutesLocked(cfg *wgcfg.Config, rcfg *router.Config, nm *netmap.NetworkMap, routesKey string) {
+	m := &b.maint
+	nodes := make(map[key.NodePublic]*tailcfg.Node)
+	if nm != nil {
+		for _, n := range nm.Peers {
+			nodes[n.Key] = n
+		}
+	}
+	if !m.haveRoutes || m.routesKey != routesKey || b.maintenanceAllowedLocked(time.Now()) {
+		m.routes, m.routesKey, m.haveRoutes = rcfg.Routes, routesKey, true
+		m.peerRoutes = make(map[tailcfg.StableNodeID][]netip.Prefix, len(cfg.Peers))
+		for _, p := range cfg.Peers {
+			if n, ok := nodes[p.PublicKey]; ok {
+				m.peerRoutes[n.StableID] = p.AllowedIPs
+			}
+		}
+		delete(m.pending, maintRoutes)
+		return
+	}
+
+	// Routes whose router is gone or offline fail over to their new
+	// router right away.
+	isOnline := func(sid tailcfg.StableNodeID) bool {
+		n, ok := nm.PeerWithStableID(sid)
+		return ok && (n.Online == nil || *n.Online)
+	}
+	var released []netip.Prefix
+	for sid, routes := range m.peerRoutes {
+		if nm == nil || !isOnline(sid) {
+			released = append(released, routes...)
+		}
+	}
+	isReleased := func(p netip.Prefix) bool { return slices.Contains(released, p) }
+
+	held, changed := mergePolicyRoutes(m.routes, rcfg.Routes)
+	rcfg.Routes = held
+	m.routes = held
+	peerRoutes := make(map[tailcfg.StableNodeID][]netip.Prefix, len(cfg.Peers))
+	for i := range cfg.Peers {
+		p := &cfg.Peers[i]
+		n, ok := nodes[p.PublicKey]
+		if !ok {
+			continue
+		}
+		if n.Online != nil && !*n.Online {
+			peerRoutes[n.StableID] = p.AllowedIPs
+			continue
+		}
+		old := tsaddr.FilterPrefixesCopy(m.peerRoutes[n.StableID], func(p netip.Prefix) bool { return !isReleased(p) })
+		cur := tsaddr.FilterPrefixesCopy(p.AllowedIPs, func(p netip.Prefix) bool { return !isReleased(p) })
+		merged, peerChanged := mergePolicyRoutes(old, cur)
+		merged = append(merged, tsaddr.FilterPrefixesCopy(p.AllowedIPs, isReleased)...)
+		changed = changed || peerChanged
+		p.AllowedIPs = merged
+		peerRoutes[n.StableID] = merged
+	}
+	m.peerRoutes = peerRoutes
+	if changed {
+		b.deferMaintenanceLocked(maintRoutes, b.authReconfig)
+	}
+}
+
+// mergePolicyRoutes returns the routes to Tailscale IPs from cur along
+// with the other routes from old, and whether those other routes
+// differ between old and cur.
+func mergePolicyRoutes(old, cur []netip.Prefix) (merged []netip.Prefix, changed bool) {
+	isPeer := func(p netip.Prefix) bool { return tsaddr.IsTailscaleIP(p.Addr()) }
+	oldOther := tsaddr.FilterPrefixesCopy(old, func(p netip.Prefix) bool { return !isPeer(p) })
+	curOther := tsaddr.FilterPrefixesCopy(cur, func(p netip.Prefix) bool { return !isPeer(p) })
+	changed = !prefixSetsEqual(oldOther, curOther)
+	merged = append(tsaddr.FilterPrefixesCopy(cur, isPeer), oldOther...)
+	return merged, changed
+}
+
+func prefixSetsEqual(a, b []netip.Prefix) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[netip.Prefix]bool, len(a))
+	for _, p := range a {
+		set[p] = true
+	}
+	for _, p := range b {
+		if !set[p] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"errors"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine/router"
+	"tailscale.com/wgengine/wgcfg"
+)
+
+func TestMaintenanceDefer(t *testing.T) {
+	b := &LocalBackend{logf: t.Logf}
+	if b.deferMaintenance(maintReauth, func() {}) {
+		t.Fatal("deferred without a window")
+	}
+
+	// A window that's not open now.
+	start := time.Now().UTC().Add(2 * time.Hour)
+	b.mu.Lock()
+	b.setMaintenanceWindowLocked(start.Format("15:04") + "-" + start.Add(time.Minute).Format("15:04") + " UTC")
+	b.mu.Unlock()
+
+	if err := b.Reauth("tskey-foo"); !errors.Is(err, ErrMaintenanceDeferred) {
+		t.Errorf("Reauth outside the window = %v; want ErrMaintenanceDeferred", err)
+	}
+
+	ran := make(chan string, 2)
+	b.deferMaintenance(maintReauth, func() { ran <- "first" })
+	if !b.deferMaintenance(maintReauth, func() { ran <- "second" }) {
+		t.Fatal("not deferred outside the window")
+	}
+	st := b.MaintenanceStatus()
+	if st.Allowed || len(st.Pending) != 1 || st.Pending[0].Kind != maintReauth || !st.NextWindow.After(time.Now()) {
+		t.Errorf("status = %+v; want one pending reauth", st)
+	}
+
+	b.AllowMaintenance(time.Minute)
+	select {
+	case got := <-ran:
+		if got != "second" {
+			t.Errorf("ran %q; want the latest operation", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("override didn't run the pending operation")
+	}
+	if b.deferMaintenance(maintReauth, func() {}) {
+		t.Error("deferred during override")
+	}
+	if st := b.MaintenanceStatus(); !st.Allowed || len(st.Pending) != 0 {
+		t.Errorf("status after override = %+v", st)
+	}
+}
+
+func TestMergePolicyRoutes(t *testing.T) {
+	pfx := func(ss ...string) (ret []netip.Prefix) {
+		for _, s := range ss {
+			ret = append(ret, netip.MustParsePrefix(s))
+		}
+		return ret
+	}
+	old := pfx("100.64.1.1/32", "10.0.0.0/24")
+
+	merged, changed := mergePolicyRoutes(old, pfx("100.64.1.1/32", "100.64.1.2/32", "10.0.0.0/24"))
+	if changed {
+		t.Error("new peer route counted as a policy route change")
+	}
+	if want := pfx("100.64.1.1/32", "100.64.1.2/32", "10.0.0.0/24"); !reflect.DeepEqual(merged, want) {
+		t.Errorf("merged = %v; want %v", merged, want)
+	}
+
+	merged, changed = mergePolicyRoutes(old, pfx("100.64.1.1/32", "0.0.0.0/0"))
+	if !changed {
+		t.Error("subnet route change not counted")
+	}
+	if want := pfx("100.64.1.1/32", "10.0.0.0/24"); !reflect.DeepEqual(merged, want) {
+		t.Errorf("merged = %v; want old subnet routes %v", merged, want)
+	}
+}
+
+func TestHoldPolicyRoutes(t *testing.T) {
+	pfx := func(ss ...string) (ret []netip.Prefix) {
+		for _, s := range ss {
+			ret = append(ret, netip.MustParsePrefix(s))
+		}
+		return ret
+	}
+	k1, k2 := key.NewNode().Public(), key.NewNode().Public()
+	nm := &netmap.NetworkMap{Peers: []*tailcfg.Node{
+		{StableID: "n1", Key: k1},
+		{StableID: "n2", Key: k2},
+	}}
+	b := &LocalBackend{logf: t.Logf}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	defer b.rearmMaintenanceLocked(time.Now()) // stops its timer
+	start := time.Now().UTC().Add(2 * time.Hour)
+	b.setMaintenanceWindowLocked(start.Format("15:04") + "-" + start.Add(time.Minute).Format("15:04") + " UTC")
+
+	cfg := &wgcfg.Config{Peers: []wgcfg.Peer{
+		{PublicKey: k1, AllowedIPs: pfx("100.64.1.1/32", "10.0.0.0/24")},
+	}}
+	rcfg := &router.Config{Routes: pfx("100.64.1.1/32", "10.0.0.0/24")}
+	b.holdPolicyRoutesLocked(cfg, rcfg, nm, "k")
+
+	// The subnet route moves to a new peer outside the window.
+	cfg = &wgcfg.Config{Peers: []wgcfg.Peer{
+		{PublicKey: k1, AllowedIPs: pfx("100.64.1.1/32")},
+		{PublicKey: k2, AllowedIPs: pfx("100.64.1.2/32", "10.0.0.0/24")},
+	}}
+	rcfg = &router.Config{Routes: pfx("100.64.1.1/32", "100.64.1.2/32", "10.0.0.0/24")}
+	b.holdPolicyRoutesLocked(cfg, rcfg, nm, "k")
+	if want := pfx("100.64.1.1/32", "10.0.0.0/24"); !reflect.DeepEqual(cfg.Peers[0].AllowedIPs, want) {
+		t.Errorf("held peer 1 AllowedIPs = %v; want %v", cfg.Peers[0].AllowedIPs, want)
+	}
+	if want := pfx("100.64.1.2/32"); !reflect.DeepEqual(cfg.Peers[1].AllowedIPs, want) {
+		t.Errorf("held peer 2 AllowedIPs = %v; want %v", cfg.Peers[1].AllowedIPs, want)
+	}
+	if _, ok := b.maint.pending[maintRoutes]; !ok {
+		t.Error("route change not deferred")
+	}
+
+	// The router rotates its node key; its held routes follow it.
+	k1 = key.NewNode().Public()
+	nm.Peers[0].Key = k1
+	cfg.Peers[0] = wgcfg.Peer{PublicKey: k1, AllowedIPs: pfx("100.64.1.1/32")}
+	cfg.Peers[1].AllowedIPs = pfx("100.64.1.2/32", "10.0.0.0/24")
+	b.holdPolicyRoutesLocked(cfg, rcfg, nm, "k")
+	if want := pfx("100.64.1.1/32", "10.0.0.0/24"); !reflect.DeepEqual(cfg.Peers[0].AllowedIPs, want) {
+		t.Errorf("after key rotation, peer 1 AllowedIPs = %v; want %v", cfg.Peers[0].AllowedIPs, want)
+	}
+
+	// The router goes offline; its routes fail over right away.
+	nm.Peers[0].Online = new(bool)
+	cfg.Peers[0].AllowedIPs = pfx("100.64.1.1/32")
+	cfg.Peers[1].AllowedIPs = pfx("100.64.1.2/32", "10.0.0.0/24")
+	b.holdPolicyRoutesLocked(cfg, rcfg, nm, "k")
+	if want := pfx("100.64.1.1/32"); !reflect.DeepEqual(cfg.Peers[0].AllowedIPs, want) {
+		t.Errorf("offline peer 1 AllowedIPs = %v; want %v", cfg.Peers[0].AllowedIPs, want)
+	}
+	if want := pfx("100.64.1.2/32", "10.0.0.0/24"); !reflect.DeepEqual(cfg.Peers[1].AllowedIPs, want) {
+		t.Errorf("failover peer 2 AllowedIPs = %v; want %v", cfg.Peers[1].AllowedIPs, want)
+	}
+
+	// A prefs change applies the routes immediately.
+	b.holdPolicyRoutesLocked(cfg, rcfg, nm, "k2")
+	if _, ok := b.maint.pending[maintRoutes]; ok {
+		t.Error("route change still pending after prefs change")
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"sort"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/types/netmap"
+	"tailscale.com/util/memsize"
+	"tailscale.com/util/ringbuffer"
+)
+
+const (
+	// netMapSizeInterval is the minimum time between samples of the
+	// netmap's size. Estimating it walks the whole netmap, so it's
+	// not done for every update.
+	netMapSizeInterval = time.Minute
+
+	// maxNetMapSizeSamples is how many samples of the netmap's size
+	// are kept: a day's worth at one per netMapSizeInterval.
+	maxNetMapSizeSamples = 24 * 60
+)
+
+// netMapSize estimates the memory used by nm, including the topPeers
+// largest peers.
+func netMapSize(nm *netmap.NetworkMap, topPeers int) *apitype.NetMapSize {
+	c := memsize.NewCounter()
+	s := &apitype.NetMapSize{NumPeers: len(nm.Peers)}
+
+	// Count the parts shared with other parts first, so they're
+	// attributed to the part they're really about.
+	s.DERPMap = c.Add(nm.DERPMap)
+	s.DNS = c.Add(&nm.DNS)
+	s.PacketFilter = c.Add(&nm.PacketFilter) + c.Add(nm.SSHPolicy)
+	s.UserProfiles = c.Add(&nm.UserProfiles)
+	var peers []apitype.PeerSize
+	for _, p := range nm.Peers {
+		n := c.Add(p)
+		s.Peers += n
+		if topPeers > 0 {
+			peers = append(peers, apitype.PeerSize{StableID: p.StableID, Name: p.Name, Bytes: n})
+		}
+	}
+	s.Peers += c.Add(&nm.Peers)
+	s.Other = c.Add(nm)
+	s.Total = s.DERPMap + s.DNS + s.PacketFilter + s.UserProfiles + s.Peers + s.Other
+
+	if len(peers) > 0 {
+		sort.SliceStable(peers, func(i, j int) bool { return peers[i].Bytes > peers[j].Bytes })
+		if len(peers) > topPeers {
+			peers = peers[:topPeers]
+		}
+		s.TopPeers = peers
+	}
+	return s
+}
+
+// maybeSampleNetMapSizeLocked records the size of the new netmap nm
+// in the background, if netMapSizeInterval has passed since the last
+// sample.
+//
+// b.mu must be held.
+func (b *LocalBackend) maybeSampleNetMapSizeLocked(nm *netmap.NetworkMap) {
+	now := time.Now()
+	if nm == nil || now.Sub(b.lastNetMapSizeSample) < netMapSizeInterval {
+		return
+	}
+	b.lastNetMapSizeSample = now
+	if b.netMapSizes == nil {
+		b.netMapSizes = ringbuffer.New[apitype.NetMapSizeSample](maxNetMapSizeSamples)
+	}
+	sizes := b.netMapSizes
+	// Netmaps aren't mutated once set, so it can be walked without b.mu.
+	go func() {
+		s := netMapSize(nm, 0)
+		sizes.Add(apitype.NetMapSizeSample{Time: now, Total: s.Total, NumPeers: s.NumPeers})
+	}()
+}
+
+// NetMapSize returns the estimated memory used by the current netmap,
+// including its topPeers largest peers, and the sampled sizes of
+// recent netmaps. It returns nil if there's no netmap.
+func (b *LocalBackend) NetMapSize(topPeers int) *apitype.NetMapSize {
+	b.mu.Lock()
+	nm := b.netMap
+	sizes := b.netMapSizes
+	b.mu.Unlock()
+	if nm == nil {
+		return nil
+	}
+	s := netMapSize(nm, topPeers)
+	s.History = sizes.GetAll()
+	// Samples are taken concurrently, so can be added out of order.
+	sort.Slice(s.History, func(i, j int) bool { return s.History[i].Time.Before(s.History[j].Time) })
+	return s
+}
@@ -0,0 +1,43 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"strings"
+	"testing"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+func TestNetMapSize(t *testing.T) {
+	big := &tailcfg.Node{
+		ID:       2,
+		StableID: "big",
+		Name:     "big.",
+		Hostinfo: (&tailcfg.Hostinfo{Hostname: strings.Repeat("x", 4096)}).View(),
+	}
+	small := &tailcfg.Node{ID: 3, StableID: "small", Name: "small."}
+	nm := &netmap.NetworkMap{
+		Peers: []*tailcfg.Node{small, big},
+	}
+
+	s := netMapSize(nm, 1)
+	if s.NumPeers != 2 {
+		t.Errorf("NumPeers = %d; want 2", s.NumPeers)
+	}
+	if got := s.Peers + s.PacketFilter + s.DNS + s.DERPMap + s.UserProfiles + s.Other; got != s.Total {
+		t.Errorf("parts sum to %d; want Total %d", got, s.Total)
+	}
+	if len(s.TopPeers) != 1 || s.TopPeers[0].StableID != "big" {
+		t.Fatalf("TopPeers = %+v; want just big", s.TopPeers)
+	}
+	if s.TopPeers[0].Bytes < 4096 {
+		t.Errorf("big peer is %d bytes; want at least 4096", s.TopPeers[0].Bytes)
+	}
+	if s.Peers < s.TopPeers[0].Bytes {
+		t.Errorf("Peers = %d; less than largest peer %d", s.Peers, s.TopPeers[0].Bytes)
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import "context"
+
+// WatchNetMapGeneration calls fn with the current netmap generation
+// and then again each time the netmap changes, until ctx is done.
+// The generation is a counter that increases on every netmap update;
+// rapid successive updates may be coalesced into a single call. It's
+// meant for callers that cache data derived from the netmap (such as
+// WhoIs results) and need to know when to drop it.
+func (b *LocalBackend) WatchNetMapGeneration(ctx context.Context, fn func(gen uint64)) {
+	for {
+		b.mu.Lock()
+		gen := b.netMapGen
+		if b.netMapChanged == nil {
+			b.netMapChanged = make(chan struct{})
+		}
+		changed := b.netMapChanged
+		b.mu.Unlock()
+
+		fn(gen)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		}
+	}
+}
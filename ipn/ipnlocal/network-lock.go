@@ -7,11 +7,13 @@
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"tailscale.com/envknob"
@@ -29,6 +31,8 @@
 type tkaState struct {
 	authority *tka.Authority
 	storage   *tka.FS
+
+	checkpointing atomic.Bool // whether a tkaCheckpointIfDue is running
 }
 
 // CanSupportNetworkLock returns true if tailscaled is able to operate
@@ -137,6 +141,178 @@ func (b *LocalBackend) NetworkLockInit(keys []tka.Key) error {
 	return err
 }
 
+// NetworkLockSign signs each of the node keys in reqs with this node's
+// network-lock key and submits the signatures to control. Node keys of
+// nodes in the netmap that already have a valid signature are skipped.
+//
+// If dryRun is true, the signatures are generated and verified against
+// the authority but not submitted, so a batch can be checked before
+// it's applied.
+//
+// Failures for individual node keys are reported in the corresponding
+// result rather than stopping the batch. The returned error is only
+// for problems that affect the whole batch.
+func (b *LocalBackend) NetworkLockSign(reqs []ipnstate.NetworkLockSignRequest, dryRun bool) ([]ipnstate.NetworkLockSignResult, error) {
+	if b.tka == nil {
+		return nil, errors.New("network-lock is not enabled")
+	}
+	if !b.tka.authority.KeyTrusted(b.nlPrivKey.KeyID()) {
+		return nil, errors.New("this node's network-lock key is not trusted by the tailnet key authority")
+	}
+	nm := b.NetMap()
+	if nm == nil {
+		return nil, errors.New("no netmap: are you logged into tailscale?")
+	}
+	existing := make(map[key.NodePublic]tkatype.MarshaledSignature, len(nm.Peers))
+	for _, p := range nm.Peers {
+		existing[p.Key] = p.KeySignature
+	}
+
+	results := make([]ipnstate.NetworkLockSignResult, len(reqs))
+	for i, req := range reqs {
+		res := &results[i]
+		res.NodeKey = req.NodeKey
+		if req.NodeKey.IsZero() {
+			res.Err = "missing node key"
+			continue
+		}
+		if sig := existing[req.NodeKey]; len(sig) > 0 && b.tka.authority.NodeKeyAuthorized(req.NodeKey, sig) == nil {
+			res.AlreadySigned = true
+			continue
+		}
+		nks, err := signNodeKey(tailcfg.TKASignInfo{
+			NodePublic:     req.NodeKey,
+			RotationPubkey: req.RotationPublic,
+		}, b.nlPrivKey)
+		if err != nil {
+			res.Err = fmt.Sprintf("generating signature: %v", err)
+			continue
+		}
+		sig := nks.Serialize()
+		if err := b.tka.authority.NodeKeyAuthorized(req.NodeKey, sig); err != nil {
+			res.Err = fmt.Sprintf("verifying signature: %v", err)
+			continue
+		}
+		if dryRun {
+			continue
+		}
+		if _, err := b.tkaSubmitSignature(nm, sig); err != nil {
+			res.Err = fmt.Sprintf("submitting signature: %v", err)
+		}
+	}
+	return results, nil
+}
+
+// maxNetworkLockLogPage is the most updates NetworkLockLog returns
+// at once.
+const maxNetworkLockLogPage = 1000
+
+// NetworkLockLog returns a page of the tailnet key authority's log,
+// newest update first, of at most limit updates (or
+// maxNetworkLockLogPage if limit isn't positive or is more than that).
+//
+// The page starts at the update named by cursor, the NextCursor of the
+// previous page, or at the head if cursor is empty. If kinds is
+// non-empty, only updates of those kinds (such as "add-key") are
+// returned; if signer is non-zero, only updates it signed are.
+func (b *LocalBackend) NetworkLockLog(cursor string, limit int, kinds []string, signer key.NLPublic) (*ipnstate.NetworkLockLog, error) {
+	if b.tka == nil {
+		return nil, errors.New("network-lock is not enabled")
+	}
+	if limit <= 0 || limit > maxNetworkLockLogPage {
+		limit = maxNetworkLockLogPage
+	}
+	for _, k := range kinds {
+		if !validAUMKind(k) {
+			return nil, fmt.Errorf("unknown update kind %q", k)
+		}
+	}
+	from := b.tka.authority.Head()
+	if cursor != "" {
+		if err := from.UnmarshalText([]byte(cursor)); err != nil {
+			return nil, fmt.Errorf("invalid cursor %q", cursor)
+		}
+	}
+
+	storage := b.tka.storage
+	log := new(ipnstate.NetworkLockLog)
+	err := tka.IterAUMs(storage, from, func(h tka.AUMHash, aum tka.AUM) bool {
+		if !aumMatches(aum, kinds, signer) {
+			return true
+		}
+		// The next page starts at the next matching update, so
+		// that there's only a next page if it isn't empty.
+		if len(log.Updates) == limit {
+			log.NextCursor = h.String()
+			return false
+		}
+		log.Updates = append(log.Updates, networkLockUpdate(storage, h, aum))
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+// validAUMKind reports whether s is the name of a kind of AUM.
+func validAUMKind(s string) bool {
+	for k := tka.AUMAddKey; k <= tka.AUMCheckpoint; k++ {
+		if k.String() == s {
+			return true
+		}
+	}
+	return false
+}
+
+// aumMatches reports whether aum is one of kinds, if any, and was
+// signed by signer, if non-zero.
+func aumMatches(aum tka.AUM, kinds []string, signer key.NLPublic) bool {
+	if len(kinds) > 0 {
+		found := false
+		for _, k := range kinds {
+			if aum.MessageKind.String() == k {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if signer.IsZero() {
+		return true
+	}
+	for _, sig := range aum.Signatures {
+		if bytes.Equal(sig.KeyID, signer.Verifier()) {
+			return true
+		}
+	}
+	return false
+}
+
+// networkLockUpdate describes aum, with hash h, for the log.
+func networkLockUpdate(storage tka.Chonk, h tka.AUMHash, aum tka.AUM) ipnstate.NetworkLockUpdate {
+	u := ipnstate.NetworkLockUpdate{
+		Hash: h.String(),
+		Kind: aum.MessageKind.String(),
+		Raw:  aum.Serialize(),
+	}
+	switch {
+	case aum.Key != nil:
+		k := key.NLPublicFromEd25519Unsafe(aum.Key.Public)
+		u.Key = &k
+	case len(aum.KeyID) > 0:
+		k := key.NLPublicFromEd25519Unsafe(ed25519.PublicKey(aum.KeyID))
+		u.Key = &k
+	}
+	for _, sig := range aum.Signatures {
+		u.Signers = append(u.Signers, key.NLPublicFromEd25519Unsafe(ed25519.PublicKey(sig.KeyID)))
+	}
+	u.Time, _ = storage.CommitTime(h)
+	return u
+}
+
 func signNodeKey(nodeInfo tailcfg.TKASignInfo, signer key.NLPrivate) (*tka.NodeKeySignature, error) {
 	p, err := nodeInfo.NodePublic.MarshalBinary()
 	if err != nil {
@@ -156,6 +332,59 @@ func signNodeKey(nodeInfo tailcfg.TKASignInfo, signer key.NLPrivate) (*tka.NodeK
 	return &sig, nil
 }
 
+// tkaCheckpointIfDue adds a checkpoint AUM to the tailnet key authority
+// in the background, if control has asked this node to by the checkpoint
+// policy in nm and the policy calls for one now.
+func (b *LocalBackend) tkaCheckpointIfDue(nm *netmap.NetworkMap) {
+	p := nm.TKACheckpoint
+	if b.tka == nil || p == nil || nm.SelfNode == nil || !b.tka.authority.KeyTrusted(b.nlPrivKey.KeyID()) {
+		return
+	}
+	if !b.tka.checkpointing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer b.tka.checkpointing.Store(false)
+		policy := tka.CheckpointPolicy{MaxUpdates: p.MaxUpdates, MaxAge: p.MaxAge}
+		send := func(head tka.AUMHash, aums []tka.AUM) error {
+			_, err := b.tkaSyncSend(nm, head, aums)
+			return err
+		}
+		if err := b.tkaCheckpoint(policy, time.Now(), send); err != nil {
+			b.logf("network-lock: checkpoint: %v", err)
+		}
+	}()
+}
+
+// tkaCheckpoint adds a checkpoint AUM to the tailnet key authority if
+// policy calls for one at now. The checkpoint is only applied locally
+// once send has submitted it to control, along with the head it builds
+// on, so that this node doesn't fork from control's chain.
+func (b *LocalBackend) tkaCheckpoint(policy tka.CheckpointPolicy, now time.Time, send func(tka.AUMHash, []tka.AUM) error) error {
+	authority, storage := b.tka.authority, b.tka.storage
+	due, err := authority.CheckpointDue(storage, policy, now)
+	if err != nil || !due {
+		return err
+	}
+	head := authority.Head()
+	u := authority.NewUpdater(b.nlPrivKey)
+	if err := u.Checkpoint(); err != nil {
+		return fmt.Errorf("generating checkpoint: %v", err)
+	}
+	aums, err := u.Finalize()
+	if err != nil {
+		return err
+	}
+	if err := send(head, aums); err != nil {
+		return fmt.Errorf("submitting checkpoint: %w", err)
+	}
+	if err := authority.Inform(storage, aums); err != nil {
+		return fmt.Errorf("applying checkpoint: %v", err)
+	}
+	b.logf("network-lock: added checkpoint %v", authority.Head())
+	return nil
+}
+
 func (b *LocalBackend) tkaInitBegin(nm *netmap.NetworkMap, aum tka.AUM) (*tailcfg.TKAInitBeginResponse, error) {
 	var req bytes.Buffer
 	if err := json.NewEncoder(&req).Encode(tailcfg.TKAInitBeginRequest{
@@ -237,3 +466,90 @@ func (b *LocalBackend) tkaInitFinish(nm *netmap.NetworkMap, nks map[tailcfg.Node
 		return a, nil
 	}
 }
+
+func (b *LocalBackend) tkaSubmitSignature(nm *netmap.NetworkMap, sig tkatype.MarshaledSignature) (*tailcfg.TKASubmitSignatureResponse, error) {
+	var req bytes.Buffer
+	if err := json.NewEncoder(&req).Encode(tailcfg.TKASubmitSignatureRequest{
+		NodeID:    nm.SelfNode.ID,
+		Signature: sig,
+	}); err != nil {
+		return nil, fmt.Errorf("encoding request: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	bo := backoff.NewBackoff("tka-submit-sig", b.logf, 5*time.Second)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("ctx: %w", err)
+		}
+		req, err := http.NewRequestWithContext(ctx, "POST", "https://unused/machine/tka/sign", bytes.NewReader(req.Bytes()))
+		if err != nil {
+			return nil, fmt.Errorf("req: %w", err)
+		}
+		res, err := b.DoNoiseRequest(req)
+		if err != nil {
+			bo.BackOff(ctx, err)
+			continue
+		}
+		if res.StatusCode != 200 {
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			return nil, fmt.Errorf("request returned (%d): %s", res.StatusCode, string(body))
+		}
+		a := new(tailcfg.TKASubmitSignatureResponse)
+		err = json.NewDecoder(res.Body).Decode(a)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding JSON: %w", err)
+		}
+
+		return a, nil
+	}
+}
+
+func (b *LocalBackend) tkaSyncSend(nm *netmap.NetworkMap, head tka.AUMHash, aums []tka.AUM) (*tailcfg.TKASyncSendResponse, error) {
+	sendReq := tailcfg.TKASyncSendRequest{
+		NodeID:      nm.SelfNode.ID,
+		Head:        head.String(),
+		MissingAUMs: make([]tkatype.MarshaledAUM, len(aums)),
+	}
+	for i, aum := range aums {
+		sendReq.MissingAUMs[i] = aum.Serialize()
+	}
+	var req bytes.Buffer
+	if err := json.NewEncoder(&req).Encode(sendReq); err != nil {
+		return nil, fmt.Errorf("encoding request: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	bo := backoff.NewBackoff("tka-sync-send", b.logf, 5*time.Second)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("ctx: %w", err)
+		}
+		req, err := http.NewRequestWithContext(ctx, "POST", "https://unused/machine/tka/sync/send", bytes.NewReader(req.Bytes()))
+		if err != nil {
+			return nil, fmt.Errorf("req: %w", err)
+		}
+		res, err := b.DoNoiseRequest(req)
+		if err != nil {
+			bo.BackOff(ctx, err)
+			continue
+		}
+		if res.StatusCode != 200 {
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			return nil, fmt.Errorf("request returned (%d): %s", res.StatusCode, string(body))
+		}
+		a := new(tailcfg.TKASyncSendResponse)
+		err = json.NewDecoder(res.Body).Decode(a)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding JSON: %w", err)
+		}
+
+		return a, nil
+	}
+}
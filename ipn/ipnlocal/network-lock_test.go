@@ -0,0 +1,198 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"tailscale.com/tka"
+	"tailscale.com/types/key"
+)
+
+func TestNetworkLockLog(t *testing.T) {
+	storage, err := tka.ChonkDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nlKey := func(k key.NLPrivate, votes uint) tka.Key {
+		return tka.Key{Kind: tka.Key25519, Public: k.Public().Verifier(), Votes: votes}
+	}
+	k1, k2, k3 := key.NewNLPrivate(), key.NewNLPrivate(), key.NewNLPrivate()
+	a, _, err := tka.Create(storage, tka.State{
+		Keys:               []tka.Key{nlKey(k1, 2), nlKey(k2, 1)},
+		DisablementSecrets: [][]byte{make([]byte, 32)},
+	}, k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := func(signer key.NLPrivate, f func(*tka.UpdateBuilder) error) {
+		t.Helper()
+		b := a.NewUpdater(signer)
+		if err := f(b); err != nil {
+			t.Fatal(err)
+		}
+		aums, err := b.Finalize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Inform(storage, aums); err != nil {
+			t.Fatal(err)
+		}
+	}
+	update(k1, func(b *tka.UpdateBuilder) error { return b.AddKey(nlKey(k3, 1)) })
+	update(k2, func(b *tka.UpdateBuilder) error { return b.SetKeyVote(k3.KeyID(), 2) })
+
+	b := &LocalBackend{}
+	b.SetTailnetKeyAuthority(a, storage)
+
+	type entry struct {
+		kind   string
+		key    key.NLPublic
+		signer key.NLPublic
+	}
+	entries := func(cursor string, limit int, kinds []string, signer key.NLPublic) (got []entry, next string) {
+		t.Helper()
+		log, err := b.NetworkLockLog(cursor, limit, kinds, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, u := range log.Updates {
+			if len(u.Signers) != 1 {
+				t.Fatalf("update %s has signers %v; want 1", u.Hash, u.Signers)
+			}
+			if u.Time.IsZero() {
+				t.Errorf("update %s has no time", u.Hash)
+			}
+			e := entry{kind: u.Kind, signer: u.Signers[0]}
+			if u.Key != nil {
+				e.key = *u.Key
+			}
+			got = append(got, e)
+		}
+		return got, log.NextCursor
+	}
+
+	all := []entry{
+		{"update-key", k3.Public(), k2.Public()},
+		{"add-key", k3.Public(), k1.Public()},
+		{"checkpoint", key.NLPublic{}, k1.Public()},
+	}
+	if got, next := entries("", 0, nil, key.NLPublic{}); !reflect.DeepEqual(got, all) || next != "" {
+		t.Errorf("full log = %+v, %q; want %+v, no cursor", got, next, all)
+	}
+
+	var paged []entry
+	cursor := ""
+	for i := 0; ; i++ {
+		if i > len(all) {
+			t.Fatal("too many pages")
+		}
+		page, next := entries(cursor, 1, nil, key.NLPublic{})
+		paged = append(paged, page...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if !reflect.DeepEqual(paged, all) {
+		t.Errorf("paged log = %+v; want %+v", paged, all)
+	}
+
+	if got, _ := entries("", 0, []string{"add-key", "checkpoint"}, key.NLPublic{}); !reflect.DeepEqual(got, all[1:]) {
+		t.Errorf("filtered by kind = %+v; want %+v", got, all[1:])
+	}
+	if got, next := entries("", 0, nil, k2.Public()); !reflect.DeepEqual(got, all[:1]) || next != "" {
+		t.Errorf("filtered by signer = %+v, %q; want %+v, no cursor", got, next, all[:1])
+	}
+	// A filtered page that ends with the last match has no next
+	// page, even though there are older, unmatched updates.
+	if got, next := entries("", 1, nil, k2.Public()); !reflect.DeepEqual(got, all[:1]) || next != "" {
+		t.Errorf("filtered by signer, limit 1 = %+v, %q; want %+v, no cursor", got, next, all[:1])
+	}
+	got, next := entries("", 1, []string{"update-key", "checkpoint"}, key.NLPublic{})
+	if !reflect.DeepEqual(got, all[:1]) || next == "" {
+		t.Fatalf("filtered by kind, limit 1 = %+v, %q; want %+v and a cursor", got, next, all[:1])
+	}
+	if got, next := entries(next, 1, []string{"update-key", "checkpoint"}, key.NLPublic{}); !reflect.DeepEqual(got, all[2:]) || next != "" {
+		t.Errorf("filtered by kind, second page = %+v, %q; want %+v, no cursor", got, next, all[2:])
+	}
+
+	if _, err := b.NetworkLockLog("", 0, []string{"bogus"}, key.NLPublic{}); err == nil {
+		t.Error("unknown kind: got no error")
+	}
+	if _, err := b.NetworkLockLog("bogus", 0, nil, key.NLPublic{}); err == nil {
+		t.Error("bad cursor: got no error")
+	}
+}
+
+func TestNetworkLockCheckpoint(t *testing.T) {
+	storage, err := tka.ChonkDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nlPriv := key.NewNLPrivate()
+	a, _, err := tka.Create(storage, tka.State{
+		Keys:               []tka.Key{{Kind: tka.Key25519, Public: nlPriv.Public().Verifier(), Votes: 1}},
+		DisablementSecrets: [][]byte{make([]byte, 32)},
+	}, nlPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		u := a.NewUpdater(nlPriv)
+		if err := u.SetKeyVote(nlPriv.KeyID(), uint(i+2)); err != nil {
+			t.Fatal(err)
+		}
+		aums, err := u.Finalize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Inform(storage, aums); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := &LocalBackend{logf: t.Logf, nlPrivKey: nlPriv}
+	b.SetTailnetKeyAuthority(a, storage)
+	policy := tka.CheckpointPolicy{MaxUpdates: 2}
+	var sent []tka.AUM
+	send := func(head tka.AUMHash, aums []tka.AUM) error {
+		if head != a.Head() {
+			t.Errorf("sent head %v; want %v", head, a.Head())
+		}
+		sent = append(sent, aums...)
+		return nil
+	}
+
+	if err := b.tkaCheckpoint(tka.CheckpointPolicy{MaxUpdates: 3}, time.Now(), send); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 0 {
+		t.Fatalf("sent %d AUMs before a checkpoint was due", len(sent))
+	}
+
+	// A failure to submit leaves the authority unchanged.
+	head := a.Head()
+	failSend := func(tka.AUMHash, []tka.AUM) error { return errors.New("boom") }
+	if err := b.tkaCheckpoint(policy, time.Now(), failSend); err == nil {
+		t.Fatal("checkpoint succeeded without being submitted")
+	}
+	if a.Head() != head {
+		t.Fatal("checkpoint applied without being submitted")
+	}
+
+	if err := b.tkaCheckpoint(policy, time.Now(), send); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 1 || sent[0].MessageKind != tka.AUMCheckpoint {
+		t.Fatalf("sent %v; want one checkpoint", sent)
+	}
+	if a.Head() != sent[0].Hash() {
+		t.Errorf("head = %v; want the checkpoint %v", a.Head(), sent[0].Hash())
+	}
+}
@@ -43,7 +43,9 @@
 	"tailscale.com/net/netaddr"
 	"tailscale.com/net/netutil"
 	"tailscale.com/tailcfg"
+	"tailscale.com/tsweb/tracing"
 	"tailscale.com/util/clientmetric"
+	"tailscale.com/util/mak"
 	"tailscale.com/wgengine"
 	"tailscale.com/wgengine/filter"
 )
@@ -77,6 +79,14 @@ type peerAPIServer struct {
 	directFileDoFinalRename bool
 }
 
+// fileSender is the peer a file was received from.
+type fileSender struct {
+	name   string // node's ComputedName
+	nodeID tailcfg.StableNodeID
+	login  string // owner's LoginName
+	at     time.Time
+}
+
 const (
 	// partialSuffix is the suffix appened to files while they're
 	// still in the process of being transferred.
@@ -236,8 +246,9 @@ func (s *peerAPIServer) WaitingFiles() (ret []apitype.WaitingFile, err error) {
 					continue
 				}
 				ret = append(ret, apitype.WaitingFile{
-					Name: filepath.Base(name),
-					Size: fi.Size(),
+					Name:     filepath.Base(name),
+					Size:     fi.Size(),
+					Received: fi.ModTime(),
 				})
 			}
 		}
@@ -265,10 +276,41 @@ func (s *peerAPIServer) WaitingFiles() (ret []apitype.WaitingFile, err error) {
 			tryDeleteAgain(filepath.Join(s.rootDir, name))
 		}
 	}
+	s.b.fileSendersMu.Lock()
+	for i := range ret {
+		if snd, ok := s.b.fileSenders[ret[i].Name]; ok {
+			ret[i].From = snd.name
+			ret[i].FromNodeID = snd.nodeID
+			ret[i].FromLogin = snd.login
+			ret[i].Received = snd.at
+		}
+	}
+	s.b.fileSendersMu.Unlock()
 	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
 	return ret, nil
 }
 
+// renameWaitingFile renames partialFile, just received from the peer
+// at h, to dstFile, its name in the waiting-files directory, and
+// records who sent it. Both happen under fileSendersMu, so that
+// WaitingFiles, which lists the directory before taking the lock,
+// never reports the file without its sender (and then again with it).
+func (s *peerAPIServer) renameWaitingFile(partialFile, dstFile, baseName string, h *peerAPIHandler) error {
+	snd := fileSender{login: h.peerUser.LoginName, at: time.Now()}
+	if n := h.peerNode; n != nil {
+		snd.name = n.ComputedName
+		snd.nodeID = n.StableID
+	}
+	b := s.b
+	b.fileSendersMu.Lock()
+	defer b.fileSendersMu.Unlock()
+	if err := os.Rename(partialFile, dstFile); err != nil {
+		return err
+	}
+	mak.Set(&b.fileSenders, baseName, snd)
+	return nil
+}
+
 var (
 	errNilPeerAPIServer = errors.New("peerapi unavailable; not listening")
 	errNoTaildrop       = errors.New("Taildrop disabled; no storage directory")
@@ -302,6 +344,9 @@ func (s *peerAPIServer) DeleteFile(baseName string) error {
 	if !ok {
 		return errors.New("bad filename")
 	}
+	s.b.fileSendersMu.Lock()
+	delete(s.b.fileSenders, baseName)
+	s.b.fileSendersMu.Unlock()
 	var bo *backoff.Backoff
 	logf := s.b.logf
 	t0 := time.Now()
@@ -541,6 +586,7 @@ func (h *peerAPIHandler) logf(format string, a ...any) {
 }
 
 func (h *peerAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = tracing.Request(w, r)
 	if strings.HasPrefix(r.URL.Path, "/v0/put/") {
 		h.handlePeerPut(w, r)
 		return
@@ -549,6 +595,10 @@ func (h *peerAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.handleDNSQuery(w, r)
 		return
 	}
+	if strings.HasPrefix(r.URL.Path, customPeerAPIPrefix) {
+		h.handleCustom(w, r)
+		return
+	}
 	switch r.URL.Path {
 	case "/v0/goroutines":
 		h.handleServeGoroutines(w, r)
@@ -571,6 +621,9 @@ func (h *peerAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case "/v0/interfaces":
 		h.handleServeInterfaces(w, r)
 		return
+	case "/v0/bench":
+		h.handleServeBench(w, r)
+		return
 	}
 	who := h.peerUser.DisplayName
 	fmt.Fprintf(w, `<html>
@@ -703,6 +756,7 @@ func (h *peerAPIHandler) peerHasCap(wantCap string) bool {
 }
 
 func (h *peerAPIHandler) handlePeerPut(w http.ResponseWriter, r *http.Request) {
+	logf := tracing.Logf(r.Context(), h.logf)
 	if !h.canPutFile() {
 		http.Error(w, "Taildrop access denied", http.StatusForbidden)
 		return
@@ -743,21 +797,86 @@ func (h *peerAPIHandler) handlePeerPut(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bad filename", 400)
 		return
 	}
+
+	// Check the local Taildrop rules before reading any of the body,
+	// so that senders that wait for a 100 Continue don't send it.
+	rule, ok := h.taildropRule()
+	if !ok {
+		logf("put from %v/%v rejected by local Taildrop rules", h.remoteAddr.Addr(), h.peerNode.ComputedName)
+		http.Error(w, "Taildrop from this sender not accepted", http.StatusForbidden)
+		return
+	}
+	autoAccept := false
+	dir := h.ps.rootDir
+	if rule.Dir != "" {
+		acceptDir, err := h.ps.b.taildropAcceptDir(rule.Dir)
+		if err != nil {
+			logf("put auto-accept: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if acceptDir == "" {
+			logf("put from %v/%v: no --taildrop-accept-root; leaving file in waiting-files directory", h.remoteAddr.Addr(), h.peerNode.ComputedName)
+		} else {
+			autoAccept, dir = true, acceptDir
+		}
+	}
+
+	var success bool
+	var quota *quotaWriter
+	if rule.QuotaMB > 0 {
+		q, err := h.ps.b.taildropQuota(dir)
+		if err != nil {
+			logf("put quota: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		quota = &quotaWriter{q: q, limit: rule.QuotaMB << 20}
+		defer func() { quota.end(success) }()
+		// Reserving a known length up front rejects the file before
+		// any of it is sent.
+		if r.ContentLength > 0 {
+			if err := quota.reserve(r.ContentLength); err != nil {
+				http.Error(w, err.Error(), http.StatusInsufficientStorage)
+				return
+			}
+		}
+	}
+
+	if autoAccept {
+		dstFile, err = reserveAutoAcceptPath(dir, baseName)
+		if err != nil {
+			logf("put reserve error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer func() {
+			if !success {
+				os.Remove(dstFile)
+			}
+		}()
+	}
+	directFileMode := h.ps.directFileMode && !autoAccept
+
 	t0 := time.Now()
 	// TODO(bradfitz): prevent same filename being sent by two peers at once
 	partialFile := dstFile + partialSuffix
 	f, err := os.Create(partialFile)
 	if err != nil {
-		h.logf("put Create error: %v", redactErr(err))
+		logf("put Create error: %v", redactErr(err))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	var success bool
 	defer func() {
 		if !success {
 			os.Remove(partialFile)
 		}
 	}()
+	var fw io.Writer = f
+	if quota != nil {
+		quota.w = f
+		fw = quota
+	}
 	var finalSize int64
 	var inFile *incomingFile
 	if r.ContentLength != 0 {
@@ -765,10 +884,10 @@ func (h *peerAPIHandler) handlePeerPut(w http.ResponseWriter, r *http.Request) {
 			name:    baseName,
 			started: time.Now(),
 			size:    r.ContentLength,
-			w:       f,
+			w:       fw,
 			ph:      h,
 		}
-		if h.ps.directFileMode {
+		if directFileMode {
 			inFile.partialPath = partialFile
 		}
 		h.ps.b.registerIncomingFile(inFile, true)
@@ -777,38 +896,51 @@ func (h *peerAPIHandler) handlePeerPut(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			err = redactErr(err)
 			f.Close()
-			h.logf("put Copy error: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			logf("put Copy error: %v", err)
+			code := http.StatusInternalServerError
+			if errors.Is(err, errQuotaExceeded) {
+				code = http.StatusInsufficientStorage
+			}
+			http.Error(w, err.Error(), code)
 			return
 		}
 		finalSize = n
 	}
 	if err := redactErr(f.Close()); err != nil {
-		h.logf("put Close error: %v", err)
+		logf("put Close error: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if h.ps.directFileMode && !h.ps.directFileDoFinalRename {
+	if directFileMode && !h.ps.directFileDoFinalRename {
 		if inFile != nil { // non-zero length; TODO: notify even for zero length
 			inFile.markAndNotifyDone()
 		}
 	} else {
-		if err := os.Rename(partialFile, dstFile); err != nil {
+		var err error
+		if !directFileMode && !autoAccept {
+			err = h.ps.renameWaitingFile(partialFile, dstFile, baseName, h)
+		} else {
+			err = os.Rename(partialFile, dstFile)
+		}
+		if err != nil {
 			err = redactErr(err)
-			h.logf("put final rename: %v", err)
+			logf("put final rename: %v", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 	}
 
 	d := time.Since(t0).Round(time.Second / 10)
-	h.logf("got put of %s in %v from %v/%v", approxSize(finalSize), d, h.remoteAddr.Addr(), h.peerNode.ComputedName)
+	logf("got put of %s in %v from %v/%v (auto-accept=%v)", approxSize(finalSize), d, h.remoteAddr.Addr(), h.peerNode.ComputedName, autoAccept)
 
 	// TODO: set modtime
 	// TODO: some real response
 	success = true
 	io.WriteString(w, "{}\n")
 	h.ps.knownEmpty.Store(false)
+	if !directFileMode && !autoAccept {
+		h.ps.b.noteFilesChanged()
+	}
 	h.ps.b.sendFileNotify()
 }
 
@@ -920,10 +1052,7 @@ func (h *peerAPIHandler) handleWakeOnLAN(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "failed to get interfaces state", http.StatusInternalServerError)
 		return
 	}
-	var res struct {
-		SentTo []string
-		Errors []string
-	}
+	var res apitype.WakeOnLANResponse
 	for ifName, ips := range st.InterfaceIPs {
 		for _, ip := range ips {
 			if ip.Addr().IsLoopback() || ip.Addr().Is6() {
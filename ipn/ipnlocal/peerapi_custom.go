@@ -0,0 +1,182 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strings"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// customPeerAPIPrefix is the peerapi path prefix under which handlers
+// registered with RegisterPeerAPIHandler are mounted, each at
+// customPeerAPIPrefix + name + "/".
+const customPeerAPIPrefix = "/v0/x/"
+
+// Request headers set on requests to custom peerapi handlers to
+// identify the peer making them. Any sent by the peer are removed.
+// The node name is the peer's MagicDNS name, as assigned by control.
+const (
+	PeerAPIHeaderUserLogin = "Tailscale-User-Login"
+	PeerAPIHeaderUserName  = "Tailscale-User-Name"
+	PeerAPIHeaderNodeName  = "Tailscale-Node-Name"
+	PeerAPIHeaderNodeID    = "Tailscale-Node-ID"
+)
+
+// customPeerAPIHandler is a handler registered with
+// RegisterPeerAPIHandler.
+type customPeerAPIHandler struct {
+	name   string
+	cap    string // required peer capability, or empty for any peer
+	target string // for RegisterPeerAPIProxy, the URL proxied to
+	h      http.Handler
+}
+
+// validCustomPeerAPIName reports whether name may be used as the name
+// of a custom peerapi handler: non-empty lowercase letters, digits and
+// dashes.
+func validCustomPeerAPIName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, r := range name {
+		if !('a' <= r && r <= 'z' || '0' <= r && r <= '9' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// RegisterPeerAPIHandler mounts h on this node's peerapi server at
+// "/v0/x/<name>/", so that other nodes can reach a lightweight service
+// without it running its own listener. Paths h sees have that prefix
+// removed.
+//
+// If capability is non-empty, only peers granted it by the tailnet's
+// ACLs (and nodes owned by the same user as this one) may make
+// requests; others get a 403. The peer making a request is identified
+// by the PeerAPIHeader* request headers, as well as by the request's
+// RemoteAddr.
+//
+// The returned func unregisters h. It's an error to register a name
+// that's already in use.
+func (b *LocalBackend) RegisterPeerAPIHandler(name, capability string, h http.Handler) (unregister func(), err error) {
+	if h == nil {
+		return nil, errors.New("nil handler")
+	}
+	return b.registerPeerAPIHandler(&customPeerAPIHandler{
+		name: name,
+		cap:  capability,
+		h:    http.StripPrefix(customPeerAPIPrefix+name, h),
+	})
+}
+
+// RegisterPeerAPIProxy is like RegisterPeerAPIHandler, but proxies
+// requests to target, an http URL on the loopback interface. It's for
+// services in other processes, registered over the LocalAPI.
+func (b *LocalBackend) RegisterPeerAPIProxy(name, capability, target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" || !isLoopbackHost(u.Hostname()) {
+		return fmt.Errorf("peerapi proxy target %q is not an http URL on the loopback interface", target)
+	}
+	_, err = b.registerPeerAPIHandler(&customPeerAPIHandler{
+		name:   name,
+		cap:    capability,
+		target: target,
+		h:      http.StripPrefix(customPeerAPIPrefix+name, httputil.NewSingleHostReverseProxy(u)),
+	})
+	return err
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
+
+// UnregisterPeerAPIHandler removes the custom peerapi handler name, if
+// registered.
+func (b *LocalBackend) UnregisterPeerAPIHandler(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.customPeerAPIHandlers, name)
+}
+
+func (b *LocalBackend) registerPeerAPIHandler(ch *customPeerAPIHandler) (unregister func(), err error) {
+	name := ch.name
+	if !validCustomPeerAPIName(name) {
+		return nil, fmt.Errorf("invalid peerapi handler name %q", name)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.customPeerAPIHandlers[name]; ok {
+		return nil, fmt.Errorf("peerapi handler %q already registered", name)
+	}
+	if b.customPeerAPIHandlers == nil {
+		b.customPeerAPIHandlers = make(map[string]*customPeerAPIHandler)
+	}
+	b.customPeerAPIHandlers[name] = ch
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.customPeerAPIHandlers[name] == ch {
+			delete(b.customPeerAPIHandlers, name)
+		}
+	}, nil
+}
+
+// CustomPeerAPIHandlers returns the handlers registered with
+// RegisterPeerAPIHandler and RegisterPeerAPIProxy, sorted by name.
+func (b *LocalBackend) CustomPeerAPIHandlers() []apitype.PeerAPIHandler {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ret := make([]apitype.PeerAPIHandler, 0, len(b.customPeerAPIHandlers))
+	for _, ch := range b.customPeerAPIHandlers {
+		ret = append(ret, apitype.PeerAPIHandler{Name: ch.name, Cap: ch.cap, Target: ch.target})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+// handleCustom serves requests under customPeerAPIPrefix with the
+// handlers registered with RegisterPeerAPIHandler.
+func (h *peerAPIHandler) handleCustom(w http.ResponseWriter, r *http.Request) {
+	name, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, customPeerAPIPrefix), "/")
+	b := h.ps.b
+	b.mu.Lock()
+	ch := b.customPeerAPIHandlers[name]
+	b.mu.Unlock()
+	if ch == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if ch.cap != "" && !h.isSelf && !h.peerHasCap(ch.cap) {
+		http.Error(w, "denied; no "+ch.cap+" capability", http.StatusForbidden)
+		return
+	}
+	r.Header.Set(PeerAPIHeaderUserLogin, h.peerUser.LoginName)
+	r.Header.Set(PeerAPIHeaderUserName, h.peerUser.DisplayName)
+	if n := h.peerNode; n != nil {
+		// Not ComputedName, which the peer can choose.
+		r.Header.Set(PeerAPIHeaderNodeName, strings.TrimSuffix(n.Name, "."))
+		r.Header.Set(PeerAPIHeaderNodeID, string(n.StableID))
+	} else {
+		r.Header.Del(PeerAPIHeaderNodeName)
+		r.Header.Del(PeerAPIHeaderNodeID)
+	}
+	ch.h.ServeHTTP(w, r)
+}
@@ -6,6 +6,7 @@
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/fs"
@@ -16,11 +17,15 @@
 	"net/netip"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"go4.org/netipx"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
@@ -401,6 +406,27 @@ func TestHandlePeerAPI(t *testing.T) {
 				bodyContains("bad filename"),
 			),
 		},
+		{
+			name:   "wol_deny",
+			isSelf: false,
+			req:    httptest.NewRequest("POST", "/v0/wol?mac=01:23:45:67:89:ab", nil),
+			checks: checks(httpStatus(403)),
+		},
+		{
+			name:   "wol_get",
+			isSelf: true,
+			req:    httptest.NewRequest("GET", "/v0/wol?mac=01:23:45:67:89:ab", nil),
+			checks: checks(httpStatus(http.StatusMethodNotAllowed)),
+		},
+		{
+			name:   "wol_bad_mac",
+			isSelf: true,
+			req:    httptest.NewRequest("POST", "/v0/wol?mac=bogus", nil),
+			checks: checks(
+				httpStatus(400),
+				bodyContains("bad 'mac' param"),
+			),
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -575,6 +601,393 @@ func TestDeletedMarkers(t *testing.T) {
 
 }
 
+func TestWatchIncomingFiles(t *testing.T) {
+	b := &LocalBackend{
+		logf:           t.Logf,
+		capFileSharing: true,
+	}
+	ps := &peerAPIServer{
+		b:       b,
+		rootDir: t.TempDir(),
+	}
+	b.peerAPIServer = ps
+	ph := &peerAPIHandler{
+		isSelf: true,
+		peerNode: &tailcfg.Node{
+			ComputedName: "some-peer-name",
+			StableID:     "nSOMEPEER",
+		},
+		peerUser: tailcfg.UserProfile{LoginName: "alice@example.com"},
+		ps:       ps,
+	}
+	put := func(name string) {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		ph.ServeHTTP(rr, httptest.NewRequest("PUT", "/v0/put/"+name, strings.NewReader("contents")))
+		if res := rr.Result(); res.StatusCode != 200 {
+			t.Fatal(res.Status)
+		}
+	}
+	put("old.txt")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan apitype.WaitingFile, 10)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- b.WatchIncomingFiles(ctx, func(wf apitype.WaitingFile) { got <- wf })
+	}()
+	next := func() apitype.WaitingFile {
+		t.Helper()
+		select {
+		case wf := <-got:
+			return wf
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout waiting for file")
+			panic("unreachable")
+		}
+	}
+
+	if wf := next(); wf.Name != "old.txt" {
+		t.Fatalf("first file = %q; want already-waiting old.txt", wf.Name)
+	}
+	put("new.txt")
+	wf := next()
+	if wf.Name != "new.txt" || wf.Size != int64(len("contents")) {
+		t.Errorf("got %q of size %d; want new.txt of size %d", wf.Name, wf.Size, len("contents"))
+	}
+	if wf.From != "some-peer-name" || wf.FromNodeID != "nSOMEPEER" || wf.FromLogin != "alice@example.com" {
+		t.Errorf("sender = %q, %q, %q; want some-peer-name, nSOMEPEER, alice@example.com", wf.From, wf.FromNodeID, wf.FromLogin)
+	}
+	if wf.Received.IsZero() {
+		t.Error("Received not set")
+	}
+
+	if err := ps.DeleteFile("new.txt"); err != nil {
+		t.Fatal(err)
+	}
+	put("new.txt")
+	if wf := next(); wf.Name != "new.txt" {
+		t.Errorf("re-sent file = %q; want new.txt", wf.Name)
+	}
+
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("WatchIncomingFiles = %v; want context.Canceled", err)
+	}
+	select {
+	case wf := <-got:
+		t.Errorf("unexpected extra file %q", wf.Name)
+	default:
+	}
+}
+
+func TestTaildropRules(t *testing.T) {
+	acceptRoot := t.TempDir()
+	inbox := filepath.Join(acceptRoot, "alice")
+	if err := os.Mkdir(inbox, 0700); err != nil {
+		t.Fatal(err)
+	}
+	b := &LocalBackend{
+		logf:               t.Logf,
+		capFileSharing:     true,
+		taildropAcceptRoot: acceptRoot,
+		prefs: &ipn.Prefs{
+			TaildropRules: []ipn.TaildropRule{
+				{From: "alice@example.com", Dir: "alice", QuotaMB: 1},
+				{From: "bob-laptop.example.ts.net"},
+				{From: "nBobPhone"},
+			},
+		},
+	}
+	ps := &peerAPIServer{
+		b:       b,
+		rootDir: t.TempDir(),
+	}
+	b.peerAPIServer = ps
+	put := func(login, node, name string, body io.Reader) int {
+		t.Helper()
+		ph := &peerAPIHandler{
+			isSelf: true,
+			peerNode: &tailcfg.Node{
+				Name:         node + ".example.ts.net.",
+				ComputedName: node,
+				StableID:     tailcfg.StableNodeID("n" + node),
+			},
+			peerUser: tailcfg.UserProfile{LoginName: login},
+			ps:       ps,
+		}
+		rr := httptest.NewRecorder()
+		ph.ServeHTTP(rr, httptest.NewRequest("PUT", "/v0/put/"+name, body))
+		return rr.Code
+	}
+	inboxFiles := func() (names []string) {
+		t.Helper()
+		des, err := os.ReadDir(inbox)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, de := range des {
+			names = append(names, de.Name())
+		}
+		return names
+	}
+
+	if code := put("mallory@example.com", "mallory-pc", "foo.txt", strings.NewReader("x")); code != http.StatusForbidden {
+		t.Errorf("unlisted sender: status %d; want %d", code, http.StatusForbidden)
+	}
+	if wfs, _ := ps.WaitingFiles(); len(wfs) != 0 {
+		t.Errorf("unlisted sender's file is waiting: %+v", wfs)
+	}
+
+	if code := put("bob@example.com", "bob-laptop", "foo.txt", strings.NewReader("x")); code != 200 {
+		t.Errorf("listed node: status %d; want 200", code)
+	}
+	if wfs, _ := ps.WaitingFiles(); len(wfs) != 1 {
+		t.Errorf("waiting files = %+v; want bob's foo.txt", wfs)
+	}
+	if code := put("bob@example.com", "BobPhone", "bar.txt", strings.NewReader("x")); code != 200 {
+		t.Errorf("node listed by stable ID: status %d; want 200", code)
+	}
+	// A node can report any hostname, so its ComputedName isn't
+	// trusted to match a rule.
+	spoof := &peerAPIHandler{
+		isSelf:   true,
+		peerNode: &tailcfg.Node{Name: "mallory.example.ts.net.", ComputedName: "bob-laptop.example.ts.net"},
+		peerUser: tailcfg.UserProfile{LoginName: "mallory@example.com"},
+		ps:       ps,
+	}
+	rr := httptest.NewRecorder()
+	spoof.ServeHTTP(rr, httptest.NewRequest("PUT", "/v0/put/spoof.txt", strings.NewReader("x")))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("spoofed ComputedName: status %d; want %d", rr.Code, http.StatusForbidden)
+	}
+	if wfs, _ := ps.WaitingFiles(); len(wfs) != 2 {
+		t.Errorf("waiting files = %+v; want bob's two", wfs)
+	}
+
+	for _, name := range []string{"foo.txt", "foo.txt", ".hidden"} {
+		if code := put("alice@example.com", "alice-pc", name, strings.NewReader("x")); code != 200 {
+			t.Errorf("auto-accept of %q: status %d; want 200", name, code)
+		}
+	}
+	want := []string{"_hidden", "foo (1).txt", "foo.txt"}
+	if got := inboxFiles(); !reflect.DeepEqual(got, want) {
+		t.Errorf("auto-accepted files = %q; want %q", got, want)
+	}
+	if wfs, _ := ps.WaitingFiles(); len(wfs) != 2 {
+		t.Errorf("auto-accepted files also waiting: %+v", wfs)
+	}
+
+	big := bytes.Repeat([]byte("x"), 1<<20)
+	if code := put("alice@example.com", "alice-pc", "big.bin", bytes.NewReader(big)); code != http.StatusInsufficientStorage {
+		t.Errorf("over quota: status %d; want %d", code, http.StatusInsufficientStorage)
+	}
+	// Without a Content-Length, the quota is enforced while copying.
+	if code := put("alice@example.com", "alice-pc", "big.bin", io.MultiReader(bytes.NewReader(big))); code != http.StatusInsufficientStorage {
+		t.Errorf("over quota, unknown length: status %d; want %d", code, http.StatusInsufficientStorage)
+	}
+	if got := inboxFiles(); !reflect.DeepEqual(got, want) {
+		t.Errorf("after over-quota puts, files = %q; want %q", got, want)
+	}
+	// Two files that each fit, but not together, can't both be
+	// accepted, even when their writes interleave.
+	half := bytes.Repeat([]byte("x"), 600<<10)
+	q, err := b.taildropQuota(inbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w1 := &quotaWriter{w: io.Discard, q: q, limit: 1 << 20}
+	if _, err := w1.Write(half); err != nil {
+		t.Fatalf("first half: %v", err)
+	}
+	if code := put("alice@example.com", "alice-pc", "half.bin", io.MultiReader(bytes.NewReader(half))); code != http.StatusInsufficientStorage {
+		t.Errorf("concurrent over quota: status %d; want %d", code, http.StatusInsufficientStorage)
+	}
+	w1.end(false)
+	if code := put("alice@example.com", "alice-pc", "half.bin", bytes.NewReader(half)); code != 200 {
+		t.Errorf("after other transfer failed: status %d; want 200", code)
+	}
+
+	// A symlink can't redirect auto-accepted files elsewhere.
+	os.RemoveAll(inbox)
+	if err := os.Symlink(t.TempDir(), inbox); err != nil {
+		t.Skipf("can't make symlink: %v", err)
+	}
+	if code := put("alice@example.com", "alice-pc", "foo.txt", strings.NewReader("x")); code != http.StatusInternalServerError {
+		t.Errorf("symlinked auto-accept directory: status %d; want %d", code, http.StatusInternalServerError)
+	}
+}
+
+func TestTaildropAcceptDirWithoutRoot(t *testing.T) {
+	b := &LocalBackend{
+		logf:           t.Logf,
+		capFileSharing: true,
+		prefs: &ipn.Prefs{
+			TaildropRules: []ipn.TaildropRule{{From: "*", Dir: "inbox"}},
+		},
+	}
+	ps := &peerAPIServer{b: b, rootDir: t.TempDir()}
+	b.peerAPIServer = ps
+	ph := &peerAPIHandler{isSelf: true, peerNode: &tailcfg.Node{}, ps: ps}
+	rr := httptest.NewRecorder()
+	ph.ServeHTTP(rr, httptest.NewRequest("PUT", "/v0/put/foo.txt", strings.NewReader("x")))
+	if rr.Code != 200 {
+		t.Fatalf("status %d; want 200", rr.Code)
+	}
+	if wfs, _ := ps.WaitingFiles(); len(wfs) != 1 {
+		t.Errorf("waiting files = %+v; want foo.txt, as there's no accept root", wfs)
+	}
+}
+
+func TestCustomPeerAPIHandler(t *testing.T) {
+	b := &LocalBackend{logf: t.Logf}
+	ps := &peerAPIServer{b: b}
+	unregister, err := b.RegisterPeerAPIHandler("echo", "https://example.com/cap/echo", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s", r.URL.Path, r.Header.Get(PeerAPIHeaderUserLogin), r.Header.Get(PeerAPIHeaderNodeName))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.RegisterPeerAPIHandler("echo", "", http.NotFoundHandler()); err == nil {
+		t.Error("duplicate registration succeeded")
+	}
+	if _, err := b.RegisterPeerAPIHandler("Bad/Name", "", http.NotFoundHandler()); err == nil {
+		t.Error("registration with bad name succeeded")
+	}
+	if err := b.RegisterPeerAPIProxy("remote", "", "http://example.com/"); err == nil {
+		t.Error("proxy to non-loopback target registered")
+	}
+
+	do := func(isSelf bool, path string) *httptest.ResponseRecorder {
+		ph := &peerAPIHandler{
+			isSelf:   isSelf,
+			peerNode: &tailcfg.Node{Name: "peer-node.example.ts.net.", ComputedName: "spoofed-node"},
+			peerUser: tailcfg.UserProfile{LoginName: "alice@example.com"},
+			ps:       ps,
+		}
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set(PeerAPIHeaderUserLogin, "spoofed@example.com")
+		rr := httptest.NewRecorder()
+		ph.ServeHTTP(rr, req)
+		return rr
+	}
+	if rr := do(false, "/v0/x/echo/hi"); rr.Code != http.StatusForbidden {
+		t.Errorf("peer without capability: status %d; want %d", rr.Code, http.StatusForbidden)
+	}
+	rr := do(true, "/v0/x/echo/hi")
+	if want := "/hi alice@example.com peer-node.example.ts.net"; rr.Code != 200 || rr.Body.String() != want {
+		t.Errorf("got %d %q; want 200 %q", rr.Code, rr.Body.String(), want)
+	}
+	if rr := do(true, "/v0/x/other/hi"); rr.Code != http.StatusNotFound {
+		t.Errorf("unknown handler: status %d; want %d", rr.Code, http.StatusNotFound)
+	}
+	if got := b.CustomPeerAPIHandlers(); len(got) != 1 || got[0].Name != "echo" {
+		t.Errorf("CustomPeerAPIHandlers = %+v; want just echo", got)
+	}
+	unregister()
+	if rr := do(true, "/v0/x/echo/hi"); rr.Code != http.StatusNotFound {
+		t.Errorf("after unregister: status %d; want %d", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestWatchIncomingFilesReportsOnce(t *testing.T) {
+	b := &LocalBackend{
+		logf:           t.Logf,
+		capFileSharing: true,
+	}
+	ps := &peerAPIServer{
+		b:       b,
+		rootDir: t.TempDir(),
+	}
+	b.peerAPIServer = ps
+	ph := &peerAPIHandler{
+		isSelf:   true,
+		peerNode: &tailcfg.Node{ComputedName: "some-peer-name"},
+		ps:       ps,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var mu sync.Mutex
+	seen := map[string]int{}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- b.WatchIncomingFiles(ctx, func(wf apitype.WaitingFile) {
+			mu.Lock()
+			defer mu.Unlock()
+			seen[wf.Name]++
+		})
+	}()
+
+	// Files arriving concurrently wake the watcher while others are
+	// still being renamed into place; each is reported once.
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			ph.ServeHTTP(rr, httptest.NewRequest("PUT", fmt.Sprintf("/v0/put/f%d.txt", i), strings.NewReader("contents")))
+			if rr.Code != 200 {
+				t.Errorf("put %d: status %d", i, rr.Code)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		mu.Lock()
+		got := len(seen)
+		mu.Unlock()
+		if got == n {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("saw %d files; want %d", got, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-errc
+	mu.Lock()
+	defer mu.Unlock()
+	for name, c := range seen {
+		if c != 1 {
+			t.Errorf("%s reported %d times; want 1", name, c)
+		}
+	}
+}
+
+func TestFileSendersOutlivePeerAPIServer(t *testing.T) {
+	b := &LocalBackend{
+		logf:           t.Logf,
+		capFileSharing: true,
+	}
+	rootDir := t.TempDir()
+	ps := &peerAPIServer{b: b, rootDir: rootDir}
+	ph := &peerAPIHandler{
+		isSelf:   true,
+		peerNode: &tailcfg.Node{ComputedName: "some-peer-name", StableID: "nSOMEPEER"},
+		ps:       ps,
+	}
+	rr := httptest.NewRecorder()
+	ph.ServeHTTP(rr, httptest.NewRequest("PUT", "/v0/put/foo.txt", strings.NewReader("contents")))
+	if rr.Code != 200 {
+		t.Fatalf("put: status %d", rr.Code)
+	}
+
+	// The peerAPIServer is recreated, as on a netmap change.
+	ps = &peerAPIServer{b: b, rootDir: rootDir}
+	wfs, err := ps.WaitingFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wfs) != 1 || wfs[0].From != "some-peer-name" || wfs[0].FromNodeID != "nSOMEPEER" {
+		t.Errorf("WaitingFiles = %+v; want foo.txt from some-peer-name", wfs)
+	}
+}
+
 func TestPeerAPIReplyToDNSQueries(t *testing.T) {
 	var h peerAPIHandler
 
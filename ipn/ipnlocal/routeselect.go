@@ -0,0 +1,238 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"net/netip"
+	"time"
+
+	"tailscale.com/envknob"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine/wgcfg"
+)
+
+var disableRouteSelection = envknob.Bool("TS_DEBUG_DISABLE_ROUTE_SELECTION")
+
+const (
+	// routeReselectInterval is how often the choice of subnet router
+	// is re-evaluated while some route has more than one.
+	routeReselectInterval = 30 * time.Second
+
+	// routeSelectHold is how long a healthy subnet router is kept
+	// after being selected, before a better one may replace it.
+	routeSelectHold = 2 * time.Minute
+
+	// routeSelectMinGain is the least latency improvement, in
+	// addition to a fifth of the current router's, for which a
+	// healthy router is replaced.
+	routeSelectMinGain = 5 * time.Millisecond
+)
+
+// routeSelection is the subnet router selected for a route.
+type routeSelection struct {
+	node  tailcfg.StableNodeID
+	since time.Time
+}
+
+// routerCandidate is a node that serves a subnet route.
+type routerCandidate struct {
+	n          *tailcfg.Node
+	primary    bool
+	latency    time.Duration
+	hasLatency bool // whether there's a direct path; if not, latency is unknown
+}
+
+// better reports whether c is a better router than o, ignoring
+// hysteresis (see clearlyBetter): one with a known latency beats one
+// without, then lower latency and then higher RoutePriority win, and
+// the primary router breaks ties.
+func (c routerCandidate) better(o routerCandidate) bool {
+	if c.hasLatency != o.hasLatency {
+		return c.hasLatency
+	}
+	if c.hasLatency && c.latency != o.latency && !c.closeTo(o) {
+		return c.latency < o.latency
+	}
+	if c.n.RoutePriority != o.n.RoutePriority {
+		return c.n.RoutePriority > o.n.RoutePriority
+	}
+	if c.primary != o.primary {
+		return c.primary
+	}
+	return c.n.StableID < o.n.StableID
+}
+
+// clearlyBetter reports whether c is enough better than o to switch
+// to it from o: on latency, or on RoutePriority if their latencies are
+// about the same, but not just on the tie-breakers.
+func (c routerCandidate) clearlyBetter(o routerCandidate) bool {
+	if c.hasLatency != o.hasLatency {
+		return c.hasLatency
+	}
+	if c.hasLatency && !c.closeTo(o) {
+		return c.latency < o.latency
+	}
+	return c.n.RoutePriority > o.n.RoutePriority
+}
+
+// closeTo reports whether c's and o's latencies are too close to
+// switch between them.
+func (c routerCandidate) closeTo(o routerCandidate) bool {
+	hi, lo := c.latency, o.latency
+	if lo > hi {
+		hi, lo = lo, hi
+	}
+	return hi-lo < hi/5+routeSelectMinGain
+}
+
+// subnetRouterCandidates returns the healthy nodes in nm serving each
+// subnet route that more than one node does.
+func subnetRouterCandidates(nm *netmap.NetworkMap, latency func(key.NodePublic) (time.Duration, bool)) map[netip.Prefix][]routerCandidate {
+	all := map[netip.Prefix][]routerCandidate{}
+	routers := map[netip.Prefix]int{} // including unhealthy ones
+	add := func(n *tailcfg.Node, routes []netip.Prefix, primary bool) {
+		for _, r := range routes {
+			if r.Bits() == 0 {
+				continue // exit node routes are chosen by prefs
+			}
+			routers[r]++
+			if n.Online != nil && !*n.Online {
+				continue
+			}
+			c := routerCandidate{n: n, primary: primary}
+			c.latency, c.hasLatency = latency(n.Key)
+			all[r] = append(all[r], c)
+		}
+	}
+	for _, n := range nm.Peers {
+		add(n, n.PrimaryRoutes, true)
+		add(n, n.StandbyRoutes, false)
+	}
+	for r := range all {
+		if routers[r] < 2 {
+			delete(all, r)
+		}
+	}
+	return all
+}
+
+// selectSubnetRouters returns the subnet router to use for each route
+// in candidates, given the previous selections prev, so that a router
+// is only replaced if it's no longer healthy or, after routeSelectHold,
+// if another is clearly better.
+func selectSubnetRouters(candidates map[netip.Prefix][]routerCandidate, prev map[netip.Prefix]routeSelection, now time.Time) map[netip.Prefix]routeSelection {
+	ret := make(map[netip.Prefix]routeSelection, len(candidates))
+	for r, cs := range candidates {
+		best := cs[0]
+		for _, c := range cs[1:] {
+			if c.better(best) {
+				best = c
+			}
+		}
+		if p, ok := prev[r]; ok {
+			var cur *routerCandidate
+			for i := range cs {
+				if cs[i].n.StableID == p.node {
+					cur = &cs[i]
+				}
+			}
+			if cur != nil && (now.Sub(p.since) < routeSelectHold || !best.clearlyBetter(*cur)) {
+				ret[r] = p
+				continue
+			}
+		}
+		ret[r] = routeSelection{node: best.n.StableID, since: now}
+	}
+	return ret
+}
+
+// applySubnetRouterSelection moves each selected route in cfg to the
+// selected router's AllowedIPs, if cfg routes it to some peer at all.
+func applySubnetRouterSelection(cfg *wgcfg.Config, nm *netmap.NetworkMap, sel map[netip.Prefix]routeSelection) {
+	keyOf := map[tailcfg.StableNodeID]key.NodePublic{}
+	for _, n := range nm.Peers {
+		keyOf[n.StableID] = n.Key
+	}
+	for r, s := range sel {
+		to := -1
+		for i := range cfg.Peers {
+			if cfg.Peers[i].PublicKey == keyOf[s.node] {
+				to = i
+			}
+		}
+		if to == -1 {
+			continue
+		}
+		routed := false
+		for i := range cfg.Peers {
+			p := &cfg.Peers[i]
+			for j, ip := range p.AllowedIPs {
+				if ip == r {
+					routed = true
+					p.AllowedIPs = append(p.AllowedIPs[:j:j], p.AllowedIPs[j+1:]...)
+					break
+				}
+			}
+		}
+		if routed {
+			cfg.Peers[to].AllowedIPs = append(cfg.Peers[to].AllowedIPs, r)
+		}
+	}
+}
+
+// sameRouters reports whether a and b select the same router for
+// each route.
+func sameRouters(a, b map[netip.Prefix]routeSelection) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for r, s := range a {
+		if bs, ok := b[r]; !ok || bs.node != s.node {
+			return false
+		}
+	}
+	return true
+}
+
+// selectSubnetRouters updates b.routeSelections for nm and returns
+// them, and whether any route's router changed. If any route has a
+// choice of routers, it arranges for the choice to be re-evaluated
+// after routeReselectInterval.
+func (b *LocalBackend) selectSubnetRouters(nm *netmap.NetworkMap) (sel map[netip.Prefix]routeSelection, changed bool) {
+	if disableRouteSelection {
+		return nil, false
+	}
+	latency := func(key.NodePublic) (time.Duration, bool) { return 0, false }
+	if mc, err := b.magicConn(); err == nil {
+		latency = mc.PeerPathLatency
+	}
+	candidates := subnetRouterCandidates(nm, latency)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	prev := b.routeSelections
+	b.routeSelections = selectSubnetRouters(candidates, prev, time.Now())
+	if len(candidates) > 0 && b.routeReselectTimer == nil && !b.shutdownCalled {
+		b.routeReselectTimer = time.AfterFunc(routeReselectInterval, b.reselectSubnetRouters)
+	}
+	return b.routeSelections, !sameRouters(prev, b.routeSelections)
+}
+
+// reselectSubnetRouters re-evaluates the choice of subnet routers,
+// reconfiguring only if it changed.
+func (b *LocalBackend) reselectSubnetRouters() {
+	b.mu.Lock()
+	b.routeReselectTimer = nil
+	nm := b.netMap
+	b.mu.Unlock()
+	if nm == nil {
+		return
+	}
+	if _, changed := b.selectSubnetRouters(nm); changed {
+		b.authReconfig()
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine/wgcfg"
+)
+
+func TestSelectSubnetRouters(t *testing.T) {
+	route := netip.MustParsePrefix("10.0.0.0/24")
+	other := netip.MustParsePrefix("10.9.0.0/24")
+	a := &tailcfg.Node{StableID: "a", Key: key.NewNode().Public(), PrimaryRoutes: []netip.Prefix{route}}
+	b := &tailcfg.Node{StableID: "b", Key: key.NewNode().Public(), StandbyRoutes: []netip.Prefix{route}}
+	c := &tailcfg.Node{StableID: "c", Key: key.NewNode().Public(), PrimaryRoutes: []netip.Prefix{other}}
+	nm := &netmap.NetworkMap{Peers: []*tailcfg.Node{a, b, c}}
+
+	lat := map[key.NodePublic]time.Duration{}
+	latency := func(k key.NodePublic) (time.Duration, bool) {
+		d, ok := lat[k]
+		return d, ok
+	}
+	now := time.Now()
+	var sel map[netip.Prefix]routeSelection
+	step := func(d time.Duration, want tailcfg.StableNodeID) {
+		t.Helper()
+		now = now.Add(d)
+		sel = selectSubnetRouters(subnetRouterCandidates(nm, latency), sel, now)
+		if _, ok := sel[other]; ok {
+			t.Errorf("selected a router for %v, which has only one", other)
+		}
+		if got := sel[route].node; got != want {
+			t.Errorf("selected %q; want %q", got, want)
+		}
+	}
+
+	step(0, "a") // no latency known: primary
+	lat[b.Key] = 50 * time.Millisecond
+	step(time.Second, "a") // held
+	step(routeSelectHold, "b")
+	lat[a.Key] = 45 * time.Millisecond
+	step(routeSelectHold, "b") // not enough better
+	lat[a.Key] = 10 * time.Millisecond
+	step(routeSelectHold, "a")
+	a.Online = new(bool)
+	step(time.Second, "b") // unhealthy routers are replaced right away
+	a.Online = nil
+	lat[a.Key] = 50 * time.Millisecond
+	b.RoutePriority = 1
+	step(routeSelectHold, "b")
+
+	cfg := &wgcfg.Config{Peers: []wgcfg.Peer{
+		{PublicKey: a.Key, AllowedIPs: []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32"), route}},
+		{PublicKey: b.Key, AllowedIPs: []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")}},
+	}}
+	applySubnetRouterSelection(cfg, nm, sel)
+	want := [][]netip.Prefix{
+		{netip.MustParsePrefix("100.64.0.1/32")},
+		{netip.MustParsePrefix("100.64.0.2/32"), route},
+	}
+	for i, p := range cfg.Peers {
+		if !reflect.DeepEqual(p.AllowedIPs, want[i]) {
+			t.Errorf("peer %d AllowedIPs = %v; want %v", i, p.AllowedIPs, want[i])
+		}
+	}
+}
+
+func TestSelectSubnetRoutersTieBreakers(t *testing.T) {
+	route := netip.MustParsePrefix("10.0.0.0/24")
+	a := &tailcfg.Node{StableID: "a", Key: key.NewNode().Public(), PrimaryRoutes: []netip.Prefix{route}}
+	b := &tailcfg.Node{StableID: "b", Key: key.NewNode().Public(), StandbyRoutes: []netip.Prefix{route}}
+	nm := &netmap.NetworkMap{Peers: []*tailcfg.Node{a, b}}
+
+	lat := map[key.NodePublic]time.Duration{b.Key: 20 * time.Millisecond}
+	latency := func(k key.NodePublic) (time.Duration, bool) {
+		d, ok := lat[k]
+		return d, ok
+	}
+	now := time.Now()
+	sel := selectSubnetRouters(subnetRouterCandidates(nm, latency), nil, now)
+	if got := sel[route].node; got != "b" {
+		t.Fatalf("selected %q; want b, the only one with a known latency", got)
+	}
+
+	// a is now as fast and is the primary, but that's only a
+	// tie-breaker, so b is kept.
+	lat[a.Key] = 20 * time.Millisecond
+	now = now.Add(routeSelectHold)
+	sel = selectSubnetRouters(subnetRouterCandidates(nm, latency), sel, now)
+	if got := sel[route].node; got != "b" {
+		t.Errorf("selected %q; want b kept on tie-breakers", got)
+	}
+
+	// With b offline, the route still has a selection: a.
+	b.Online = new(bool)
+	sel = selectSubnetRouters(subnetRouterCandidates(nm, latency), sel, now.Add(time.Second))
+	if got := sel[route].node; got != "a" {
+		t.Errorf("selected %q with b offline; want a", got)
+	}
+}
+
+func TestSelectSubnetRoutersChanged(t *testing.T) {
+	route := netip.MustParsePrefix("10.0.0.0/24")
+	a := &tailcfg.Node{StableID: "a", Key: key.NewNode().Public(), PrimaryRoutes: []netip.Prefix{route}}
+	b := &tailcfg.Node{StableID: "b", Key: key.NewNode().Public(), StandbyRoutes: []netip.Prefix{route}}
+	nm := &netmap.NetworkMap{Peers: []*tailcfg.Node{a, b}}
+
+	lb := &LocalBackend{logf: t.Logf}
+	defer func() {
+		lb.mu.Lock()
+		defer lb.mu.Unlock()
+		if lb.routeReselectTimer != nil {
+			lb.routeReselectTimer.Stop()
+		}
+	}()
+	if sel, changed := lb.selectSubnetRouters(nm); !changed || sel[route].node != "a" {
+		t.Errorf("first selection = %v, changed %v; want a, changed", sel, changed)
+	}
+	if _, changed := lb.selectSubnetRouters(nm); changed {
+		t.Error("unchanged selection reported as changed")
+	}
+	a.Online = new(bool)
+	if sel, changed := lb.selectSubnetRouters(nm); !changed || sel[route].node != "b" {
+		t.Errorf("selection with a offline = %v, changed %v; want b, changed", sel, changed)
+	}
+}
@@ -247,6 +247,11 @@ func (cc *mockControl) SetNetInfo(ni *tailcfg.NetInfo) {
 	cc.called("SetNetInfo")
 }
 
+func (cc *mockControl) SetDiscoPublicKey(k key.DiscoPublic) {
+	cc.logf("SetDiscoPublicKey: %v", k.ShortString())
+	cc.called("SetDiscoPublicKey")
+}
+
 func (cc *mockControl) UpdateEndpoints(endpoints []tailcfg.Endpoint) {
 	// validate endpoint information here?
 	cc.logf("UpdateEndpoints:  ep=%v", endpoints)
@@ -0,0 +1,253 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"tailscale.com/ipn"
+	"tailscale.com/util/mak"
+)
+
+// errQuotaExceeded is returned when a received file doesn't fit in its
+// Taildrop rule's quota.
+var errQuotaExceeded = errors.New("Taildrop quota exceeded")
+
+// taildropRules returns the current prefs' TaildropRules.
+func (b *LocalBackend) taildropRules() []ipn.TaildropRule {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.prefs == nil {
+		return nil
+	}
+	return b.prefs.TaildropRules
+}
+
+// taildropAcceptDir returns the directory to auto-accept files into
+// for a TaildropRule with Dir dir, or "" if there's none because the
+// administrator hasn't set a root with SetTaildropAcceptRoot.
+//
+// The directory must already exist and may not be a symlink, so that
+// the user setting prefs can't redirect files elsewhere.
+func (b *LocalBackend) taildropAcceptDir(dir string) (string, error) {
+	b.mu.Lock()
+	root := b.taildropAcceptRoot
+	b.mu.Unlock()
+	if root == "" {
+		return "", nil
+	}
+	if !ipn.IsTaildropAcceptDir(dir) {
+		return "", fmt.Errorf("invalid auto-accept directory %q", dir)
+	}
+	full := filepath.Join(root, dir)
+	for p := full; p != root; p = filepath.Dir(p) {
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return "", redactErr(err)
+		}
+		if !fi.IsDir() {
+			return "", fmt.Errorf("auto-accept directory %q: %q isn't a directory", dir, p)
+		}
+	}
+	return full, nil
+}
+
+// taildropRule returns the first of the local Taildrop rules that
+// matches the sender of h, and whether h may send files at all. With
+// no rules, everyone allowed by canPutFile may, into the waiting-files
+// directory.
+func (h *peerAPIHandler) taildropRule() (_ ipn.TaildropRule, ok bool) {
+	rules := h.ps.b.taildropRules()
+	if len(rules) == 0 {
+		return ipn.TaildropRule{}, true
+	}
+	for _, r := range rules {
+		if h.senderMatches(r.From) {
+			return r, true
+		}
+	}
+	return ipn.TaildropRule{}, false
+}
+
+// senderMatches reports whether from, a TaildropRule.From value,
+// matches the sender of h. Nodes are matched by their full name or
+// stable ID, which the control server assigns, and not by their
+// ComputedName, which derives from the hostname they report.
+func (h *peerAPIHandler) senderMatches(from string) bool {
+	if from == "*" {
+		return true
+	}
+	if h.peerUser.LoginName != "" && strings.EqualFold(from, h.peerUser.LoginName) {
+		return true
+	}
+	if n := h.peerNode; n != nil {
+		if n.Name != "" && strings.EqualFold(strings.TrimSuffix(from, "."), strings.TrimSuffix(n.Name, ".")) {
+			return true
+		}
+		if n.StableID != "" && from == string(n.StableID) {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeAutoAcceptName returns baseName, which diskPath has already
+// validated, as it should be named when written directly to a
+// user-visible directory. Leading dots are replaced so that received
+// files aren't hidden.
+func sanitizeAutoAcceptName(baseName string) string {
+	if i := strings.IndexFunc(baseName, func(r rune) bool { return r != '.' }); i > 0 {
+		baseName = strings.Repeat("_", i) + baseName[i:]
+	}
+	return baseName
+}
+
+// reserveAutoAcceptPath creates a new empty file in dir for a received
+// file named baseName and returns its path. If baseName is taken, a
+// number is added to it, as in "foo (1).jpg", so that existing files
+// are never overwritten.
+func reserveAutoAcceptPath(dir, baseName string) (string, error) {
+	baseName = sanitizeAutoAcceptName(baseName)
+	ext := filepath.Ext(baseName)
+	stem := strings.TrimSuffix(baseName, ext)
+	for i := 0; i < 100; i++ {
+		name := baseName
+		if i > 0 {
+			name = fmt.Sprintf("%s (%d)%s", stem, i, ext)
+		}
+		path := filepath.Join(dir, name)
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", redactErr(err)
+		}
+		return path, f.Close()
+	}
+	return "", errors.New("too many files with the same name")
+}
+
+// dirUsage returns the total size of the regular files in dir, not
+// including subdirectories.
+func dirUsage(dir string) (int64, error) {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, redactErr(err)
+	}
+	var n int64
+	for _, de := range des {
+		if !de.Type().IsRegular() {
+			continue
+		}
+		if fi, err := de.Info(); err == nil {
+			n += fi.Size()
+		}
+	}
+	return n, nil
+}
+
+// dirQuota tracks how much of a directory with a Taildrop quota is
+// used while files are being written to it, so concurrent transfers
+// can't each see the same free space.
+type dirQuota struct {
+	dir string
+
+	mu     sync.Mutex
+	active int   // transfers in progress
+	used   int64 // bytes in dir; only valid while active > 0
+}
+
+// taildropQuota returns the dirQuota for dir, starting a transfer into
+// it. The caller must call end when the transfer is done.
+func (b *LocalBackend) taildropQuota(dir string) (*dirQuota, error) {
+	b.mu.Lock()
+	q, ok := b.taildropQuotas[dir]
+	if !ok {
+		q = &dirQuota{dir: dir}
+		mak.Set(&b.taildropQuotas, dir, q)
+	}
+	b.mu.Unlock()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.active == 0 {
+		used, err := dirUsage(dir)
+		if err != nil {
+			return nil, err
+		}
+		q.used = used
+	}
+	q.active++
+	return q, nil
+}
+
+// reserve accounts for n more bytes being written, if that keeps the
+// directory within limit.
+func (q *dirQuota) reserve(n, limit int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.used+n > limit {
+		return errQuotaExceeded
+	}
+	q.used += n
+	return nil
+}
+
+// end ends a transfer that taildropQuota started, of which released
+// bytes were removed again.
+func (q *dirQuota) end(released int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.used -= released
+	q.active--
+}
+
+// quotaWriter is an io.Writer that reserves space in a dirQuota for
+// each write before making it, failing with errQuotaExceeded once the
+// quota is used up.
+type quotaWriter struct {
+	w        io.Writer
+	q        *dirQuota
+	limit    int64
+	reserved int64
+	written  int64
+}
+
+// reserve reserves n bytes up front, such as a file's known length.
+func (w *quotaWriter) reserve(n int64) error {
+	if err := w.q.reserve(n, w.limit); err != nil {
+		return err
+	}
+	w.reserved += n
+	return nil
+}
+
+func (w *quotaWriter) Write(p []byte) (int, error) {
+	if need := w.written + int64(len(p)) - w.reserved; need > 0 {
+		if err := w.reserve(need); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.w.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// end ends the transfer in w's dirQuota. If kept, the bytes written
+// stay accounted for; otherwise the file was removed.
+func (w *quotaWriter) end(kept bool) {
+	if kept {
+		w.q.end(w.reserved - w.written)
+	} else {
+		w.q.end(w.reserved)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+// trafficStatsInterval is how often the engine is polled for status
+// while at least one traffic stats watcher is registered.
+const trafficStatsInterval = time.Second
+
+// trafficStatsTracker turns the cumulative byte counts in successive
+// engine status updates into per-interval rates and fans them out to
+// registered watchers.
+type trafficStatsTracker struct {
+	mu       sync.Mutex
+	watchers map[*trafficStatsWatcher]bool
+	last     ipn.TrafficStats // zero until the first sample
+	stopPoll context.CancelFunc
+}
+
+type trafficStatsWatcher struct {
+	fn func(ipn.TrafficStats)
+}
+
+// update records a new engine status sample and returns the derived stats.
+func (t *trafficStatsTracker) update(asOf time.Time, es ipn.EngineStatus) ipn.TrafficStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ts := ipn.TrafficStats{
+		AsOf:        asOf,
+		RxBytes:     es.RBytes,
+		TxBytes:     es.WBytes,
+		ActivePeers: es.NumLive,
+	}
+	prev := t.last
+	if !prev.AsOf.IsZero() {
+		if d := asOf.Sub(prev.AsOf).Seconds(); d > 0 {
+			// Totals can go down when peers are removed from the
+			// config; report zero rather than a negative rate.
+			if delta := ts.RxBytes - prev.RxBytes; delta > 0 {
+				ts.RxBytesPerSec = float64(delta) / d
+			}
+			if delta := ts.TxBytes - prev.TxBytes; delta > 0 {
+				ts.TxBytesPerSec = float64(delta) / d
+			}
+		}
+	}
+	t.last = ts
+	return ts
+}
+
+// callbacks returns the current watcher callbacks.
+func (t *trafficStatsTracker) callbacks() []func(ipn.TrafficStats) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fns := make([]func(ipn.TrafficStats), 0, len(t.watchers))
+	for w := range t.watchers {
+		fns = append(fns, w.fn)
+	}
+	return fns
+}
+
+// WatchTrafficStats registers fn to be called with a new ipn.TrafficStats
+// sample about once per second until ctx is done. While any watcher is
+// registered, the backend polls the engine for status at that interval;
+// otherwise no extra polling is done.
+//
+// fn must not block.
+// WatchTrafficStats blocks until ctx is done.
+func (b *LocalBackend) WatchTrafficStats(ctx context.Context, fn func(ipn.TrafficStats)) {
+	t := &b.trafficStats
+	w := &trafficStatsWatcher{fn: fn}
+
+	t.mu.Lock()
+	if t.watchers == nil {
+		t.watchers = map[*trafficStatsWatcher]bool{}
+	}
+	t.watchers[w] = true
+	if t.stopPoll == nil {
+		pollCtx, cancel := context.WithCancel(b.ctx)
+		t.stopPoll = cancel
+		go b.pollTrafficStats(pollCtx)
+	}
+	t.mu.Unlock()
+
+	<-ctx.Done()
+
+	t.mu.Lock()
+	delete(t.watchers, w)
+	if len(t.watchers) == 0 && t.stopPoll != nil {
+		t.stopPoll()
+		t.stopPoll = nil
+		t.last = ipn.TrafficStats{}
+	}
+	t.mu.Unlock()
+}
+
+// pollTrafficStats requests an engine status update every
+// trafficStatsInterval until ctx is done. The resulting status
+// callbacks are what deliver samples to watchers.
+func (b *LocalBackend) pollTrafficStats(ctx context.Context) {
+	b.e.RequestStatus()
+	ticker := time.NewTicker(trafficStatsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.e.RequestStatus()
+		}
+	}
+}
+
+// publishTrafficStats feeds an engine status sample to any registered
+// traffic stats watchers.
+func (b *LocalBackend) publishTrafficStats(asOf time.Time, es ipn.EngineStatus) {
+	fns := b.trafficStats.callbacks()
+	if len(fns) == 0 {
+		return
+	}
+	ts := b.trafficStats.update(asOf, es)
+	for _, fn := range fns {
+		fn(ts)
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+func TestTrafficStatsTracker(t *testing.T) {
+	var tr trafficStatsTracker
+	t0 := time.Unix(1000, 0)
+
+	ts := tr.update(t0, ipn.EngineStatus{RBytes: 100, WBytes: 50, NumLive: 2})
+	if ts.RxBytesPerSec != 0 || ts.TxBytesPerSec != 0 {
+		t.Errorf("first sample has non-zero rates: %+v", ts)
+	}
+	if ts.ActivePeers != 2 {
+		t.Errorf("ActivePeers = %d; want 2", ts.ActivePeers)
+	}
+
+	ts = tr.update(t0.Add(2*time.Second), ipn.EngineStatus{RBytes: 300, WBytes: 150, NumLive: 1})
+	if ts.RxBytesPerSec != 100 {
+		t.Errorf("RxBytesPerSec = %v; want 100", ts.RxBytesPerSec)
+	}
+	if ts.TxBytesPerSec != 50 {
+		t.Errorf("TxBytesPerSec = %v; want 50", ts.TxBytesPerSec)
+	}
+
+	// A peer going away can make the totals shrink; that must not
+	// produce a negative rate.
+	ts = tr.update(t0.Add(3*time.Second), ipn.EngineStatus{RBytes: 10, WBytes: 10})
+	if ts.RxBytesPerSec != 0 || ts.TxBytesPerSec != 0 {
+		t.Errorf("rates after counter decrease = %v/%v; want 0/0", ts.RxBytesPerSec, ts.TxBytesPerSec)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"fmt"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// osUser is an OS user that controls the LocalBackend. Only Windows
+// has them; see ipnserver.
+type osUser struct {
+	id   string
+	name string
+}
+
+// userSwitch is a change of the controlling user.
+type userSwitch struct {
+	from, to osUser
+	at       time.Time
+}
+
+// SwitchUser makes the OS user with ID uid and the given username the
+// controlling user, whose state the LocalBackend uses. It's called by
+// ipnserver for each accepted frontend connection.
+//
+// If another user controlled the LocalBackend last, its state is reset
+// first, so nothing of that user's leaks to the new one. In that case,
+// if the new user was themselves switched away from when the previous
+// user took control, SwitchUser returns a notice saying so for the
+// new user's frontend to show.
+func (b *LocalBackend) SwitchUser(uid, username string) (notice string) {
+	b.mu.Lock()
+	b.userID = uid
+	prev := b.lastUser
+	if uid == "" || uid == prev.id {
+		b.mu.Unlock()
+		return ""
+	}
+	b.mu.Unlock()
+
+	if prev.id != "" {
+		b.logf("controlling user changed from %s to %s; resetting state", prev.name, username)
+		b.ResetForClientDisconnect()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if sw := b.userSwitch; sw != nil && sw.from.id == uid && sw.to.id == prev.id {
+		notice = fmt.Sprintf("Tailscale was in use by %s on this computer since %s, which stopped your previous session.", sw.to.name, sw.at.Format(time.Stamp))
+	}
+	cur := osUser{id: uid, name: username}
+	if prev.id != "" {
+		b.userSwitch = &userSwitch{from: prev, to: cur, at: now}
+	} else {
+		b.userSwitch = &userSwitch{to: cur, at: now}
+	}
+	b.userID = uid
+	b.lastUser = cur
+	return notice
+}
+
+// ControllingUser returns the controlling user, as seen by the OS user
+// with ID callerUID.
+func (b *LocalBackend) ControllingUser(callerUID string) *apitype.ControllingUser {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cu := &apitype.ControllingUser{
+		ServerMode: b.inServerMode,
+	}
+	// The controlling user keeps control while disconnected only in
+	// server mode; otherwise the LocalBackend was reset when their last
+	// frontend disconnected and the next user to connect takes control.
+	if b.userID == "" && !b.inServerMode {
+		return cu
+	}
+	cu.UserID, cu.Username = b.lastUser.id, b.lastUser.name
+	cu.IsCaller = cu.UserID != "" && cu.UserID == callerUID
+	if sw := b.userSwitch; sw != nil && sw.to == b.lastUser {
+		cu.Since = sw.at
+		cu.PreviousUserID, cu.PreviousUsername = sw.from.id, sw.from.name
+	}
+	return cu
+}
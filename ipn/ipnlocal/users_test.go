@@ -0,0 +1,75 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"strings"
+	"testing"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/store/mem"
+	"tailscale.com/wgengine"
+)
+
+func TestSwitchUser(t *testing.T) {
+	e, err := wgengine.NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	b, err := NewLocalBackend(t.Logf, "logid", new(mem.Store), nil, e, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setHostname := func(name string) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.prefs = &ipn.Prefs{Hostname: name}
+	}
+	hostname := func() string {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.prefs.Hostname
+	}
+
+	if notice := b.SwitchUser("1001", "alice"); notice != "" {
+		t.Errorf("first user got notice %q", notice)
+	}
+	setHostname("alice-pc")
+	cu := b.ControllingUser("1001")
+	if cu.UserID != "1001" || cu.Username != "alice" || !cu.IsCaller || cu.PreviousUserID != "" {
+		t.Errorf("alice in control: got %+v", cu)
+	}
+
+	// Alice connecting again changes nothing.
+	if notice := b.SwitchUser("1001", "alice"); notice != "" {
+		t.Errorf("same user got notice %q", notice)
+	}
+	if got := hostname(); got != "alice-pc" {
+		t.Errorf("same user: Hostname = %q; want alice-pc", got)
+	}
+
+	// Bob doesn't see Alice's prefs.
+	b.SwitchUser("1002", "bob")
+	if got := hostname(); got != "" {
+		t.Errorf("after switching to bob, Hostname = %q; want empty", got)
+	}
+	cu = b.ControllingUser("1001")
+	if cu.UserID != "1002" || cu.IsCaller || cu.PreviousUserID != "1001" || cu.PreviousUsername != "alice" || cu.Since.IsZero() {
+		t.Errorf("bob in control, as seen by alice: got %+v", cu)
+	}
+
+	// Alice is told Bob took over.
+	notice := b.SwitchUser("1001", "alice")
+	if !strings.Contains(notice, "in use by bob") {
+		t.Errorf("alice back: notice = %q; want one about bob", notice)
+	}
+
+	// Once reset, nobody is in control until a user connects.
+	b.ResetForClientDisconnect()
+	if cu := b.ControllingUser("1001"); cu.UserID != "" {
+		t.Errorf("after reset, controlling user = %q; want none", cu.UserID)
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServeHTTPPeekedConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	c1.SetDeadline(time.Now().Add(10 * time.Second))
+
+	var s *Server
+	go func() {
+		br := bufio.NewReader(c2)
+		br.Peek(4)
+		s.serveHTTP(t.Logf, c2, br, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.URL.Path)
+		}))
+	}()
+
+	if _, err := io.WriteString(c1, "GET /localapi/v0/controlling-user HTTP/1.0\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(c1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(body), "/localapi/v0/controlling-user"; got != want {
+		t.Errorf("served path %q; want %q", got, want)
+	}
+}
@@ -109,7 +109,6 @@ type Server struct {
 
 	mu             sync.Mutex
 	serverModeUser *user.User                   // or nil if not in server mode
-	lastUserID     string                       // tracks last userid; on change, Reset state for paranoia
 	allClients     map[net.Conn]connIdentity    // HTTP or IPN
 	clients        map[net.Conn]bool            // subset of allClients; only IPN protocol
 	disconnectSub  map[chan<- struct{}]struct{} // keys are subscribers of disconnects
@@ -278,6 +277,11 @@ func (s *Server) serveConn(ctx context.Context, c net.Conn, logf logger.Logf) {
 
 	ci, err := s.addConn(c, isHTTPReq)
 	if err != nil {
+		if _, occupied := err.(inUseOtherUserError); occupied && isHTTPReq {
+			// Let the user find out who's in control, but nothing else.
+			s.serveHTTP(logf, c, br, s.inUseHandler(ci, err))
+			return
+		}
 		if isHTTPReq {
 			fmt.Fprintf(c, "HTTP/1.0 500 Nope\r\nContent-Type: text/plain\r\nX-Content-Type-Options: nosniff\r\n\r\n%s\n", err.Error())
 			c.Close()
@@ -296,28 +300,24 @@ func (s *Server) serveConn(ctx context.Context, c net.Conn, logf logger.Logf) {
 		return
 	}
 
-	// Tell the LocalBackend about the identity we're now running as.
-	s.b.SetCurrentUserID(ci.UserID)
+	// Tell the LocalBackend about the identity we're now running as,
+	// which resets its state if another user was using it.
+	var username string
+	if ci.User != nil {
+		username = ci.User.Username
+	}
+	notice := s.b.SwitchUser(ci.UserID, username)
 
 	if isHTTPReq {
-		httpServer := &http.Server{
-			// Localhost connections are cheap; so only do
-			// keep-alives for a short period of time, as these
-			// active connections lock the server into only serving
-			// that user. If the user has this page open, we don't
-			// want another switching user to be locked out for
-			// minutes. 5 seconds is enough to let browser hit
-			// favicon.ico and such.
-			IdleTimeout: 5 * time.Second,
-			ErrorLog:    logger.StdLogger(logf),
-			Handler:     s.localhostHandler(ci),
-		}
-		httpServer.Serve(netutil.NewOneConnListener(&protoSwitchConn{s: s, br: br, Conn: c}, nil))
+		s.serveHTTP(logf, &protoSwitchConn{s: s, br: br, Conn: c}, br, s.localhostHandler(ci))
 		return
 	}
 
 	defer s.removeAndCloseConn(c)
 	logf("[v1] incoming control connection")
+	if notice != "" {
+		jsonNotifier(c, s.logf)(ipn.Notify{ErrMessage: &notice})
+	}
 
 	if isReadonlyConn(ci, s.b.OperatorUserID(), logf) {
 		ctx = ipn.ReadonlyContextOf(ctx)
@@ -345,6 +345,41 @@ func (s *Server) serveConn(ctx context.Context, c net.Conn, logf logger.Logf) {
 	}
 }
 
+// serveHTTP serves HTTP requests on c, a localhost connection already
+// peeked into with br, with h.
+func (s *Server) serveHTTP(logf logger.Logf, c net.Conn, br *bufio.Reader, h http.Handler) {
+	// Read through br so the bytes it peeked at aren't lost.
+	c = &bufferedConn{Conn: c, br: br}
+	httpServer := &http.Server{
+		// Localhost connections are cheap; so only do
+		// keep-alives for a short period of time, as these
+		// active connections lock the server into only serving
+		// that user. If the user has this page open, we don't
+		// want another switching user to be locked out for
+		// minutes. 5 seconds is enough to let browser hit
+		// favicon.ico and such.
+		IdleTimeout: 5 * time.Second,
+		ErrorLog:    logger.StdLogger(logf),
+		Handler:     h,
+	}
+	httpServer.Serve(netutil.NewOneConnListener(c, nil))
+}
+
+// inUseHandler returns the HTTP handler for ci, a user who can't use
+// the server because another user is in control, as described by
+// inUseErr. It only answers who the controlling user is.
+func (s *Server) inUseHandler(ci connIdentity, inUseErr error) http.Handler {
+	lah := localapi.NewHandler(s.b, s.logf, s.backendLogID)
+	lah.CallerUserID = ci.UserID
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/localapi/v0/controlling-user" {
+			lah.ServeHTTP(w, r)
+			return
+		}
+		http.Error(w, inUseErr.Error(), http.StatusInternalServerError)
+	})
+}
+
 func isReadonlyConn(ci connIdentity, operatorUID string, logf logger.Logf) bool {
 	if runtime.GOOS == "windows" {
 		// Windows doesn't need/use this mechanism, at least yet. It
@@ -527,16 +562,6 @@ func (s *Server) addConn(c net.Conn, isHTTP bool) (ci connIdentity, err error) {
 		return
 	}
 
-	// If the connected user changes, reset the backend server state to make
-	// sure node keys don't leak between users.
-	var doReset bool
-	defer func() {
-		if doReset {
-			s.logf("identity changed; resetting server")
-			s.b.ResetForClientDisconnect()
-		}
-	}()
-
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -555,13 +580,6 @@ func (s *Server) addConn(c net.Conn, isHTTP bool) (ci connIdentity, err error) {
 		s.clients[c] = true
 	}
 	s.allClients[c] = ci
-
-	if s.lastUserID != ci.UserID {
-		if s.lastUserID != "" {
-			doReset = true
-		}
-		s.lastUserID = ci.UserID
-	}
 	return ci, nil
 }
 
@@ -824,6 +842,9 @@ func New(logf logger.Logf, logid string, store ipn.StateStore, eng wgengine.Engi
 			opts.AutostartStateKey = ipn.StateKey(key)
 		}
 	}
+	if serverModeUser != nil {
+		b.SwitchUser(serverModeUser.Uid, serverModeUser.Username)
+	}
 
 	server := &Server{
 		b:                 b,
@@ -1060,10 +1081,20 @@ func (psc *protoSwitchConn) Close() error {
 	return nil
 }
 
+// bufferedConn is a net.Conn that reads from br, a bufio.Reader of Conn
+// that may have data buffered already.
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (bc *bufferedConn) Read(p []byte) (int, error) { return bc.br.Read(p) }
+
 func (s *Server) localhostHandler(ci connIdentity) http.Handler {
 	lah := localapi.NewHandler(s.b, s.logf, s.backendLogID)
 	lah.PermitRead, lah.PermitWrite = s.localAPIPermissions(ci)
 	lah.PermitCert = s.connCanFetchCerts(ci)
+	lah.CallerUserID = ci.UserID
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasPrefix(r.URL.Path, "/localapi/") {
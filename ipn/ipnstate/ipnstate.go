@@ -82,6 +82,66 @@ type NetworkLockStatus struct {
 	PublicKey key.NLPublic
 }
 
+// NetworkLockUpdate describes an update to the tailnet key authority,
+// an authority update message (AUM), as shown in its log.
+type NetworkLockUpdate struct {
+	// Hash is the AUM's hash, in the base32 form of tka.AUMHash.
+	Hash string
+
+	// Kind is the kind of update, such as "add-key" or "checkpoint";
+	// see tka.AUMKind.
+	Kind string
+
+	// Key is the key that the update adds, removes or updates, if
+	// any.
+	Key *key.NLPublic `json:",omitempty"`
+
+	// Signers are the keys that signed the update.
+	Signers []key.NLPublic
+
+	// Time is when this node first stored the update, or the zero
+	// time if that's not known.
+	Time time.Time
+
+	// Raw is the serialized AUM, for the details not described
+	// above.
+	Raw []byte
+}
+
+// NetworkLockLog is a page of the tailnet key authority's log, newest
+// update first.
+type NetworkLockLog struct {
+	Updates []NetworkLockUpdate
+
+	// NextCursor, if non-empty, is the cursor to get the next page of
+	// (older) updates with. It's empty on the last page.
+	NextCursor string `json:",omitempty"`
+}
+
+// NetworkLockSignRequest describes a node key to sign with the node's
+// network-lock key.
+type NetworkLockSignRequest struct {
+	NodeKey key.NodePublic
+
+	// RotationPublic, if non-nil, is the raw ed25519 public key
+	// that may later rotate NodeKey. See tailcfg.TKASignInfo.
+	RotationPublic []byte `json:",omitempty"`
+}
+
+// NetworkLockSignResult describes the outcome of signing one node key
+// in a batch.
+type NetworkLockSignResult struct {
+	NodeKey key.NodePublic
+
+	// AlreadySigned is whether the node, known from the netmap,
+	// already had a valid signature, so it wasn't signed again.
+	AlreadySigned bool `json:",omitempty"`
+
+	// Err, if non-empty, describes why the node key couldn't be
+	// signed (or, in a dry run, why it wouldn't be).
+	Err string `json:",omitempty"`
+}
+
 // TailnetStatus is information about a Tailscale network ("tailnet").
 type TailnetStatus struct {
 	// Name is the name of the network that's currently in use.
@@ -173,6 +233,10 @@ type PeerStatus struct {
 	// change.
 	Active bool
 
+	// ConnQuality, if non-nil, summarizes the health of the
+	// connection to the peer. It's only set while Active.
+	ConnQuality *ConnQuality `json:",omitempty"`
+
 	PeerAPIURL   []string
 	Capabilities []string `json:",omitempty"`
 
@@ -198,6 +262,36 @@ type PeerStatus struct {
 	InEngine bool
 }
 
+// ConnQuality is a summary of the health of the connection to a peer.
+type ConnQuality struct {
+	// Score is from 1 (worst) to 100 (best), combining the other
+	// fields. See Rating.
+	Score int
+
+	// Path is how packets are sent to the peer: "direct",
+	// "peer-relay" or "derp". Relayed paths score lower.
+	Path string
+
+	// RTT is the latest round trip time of the direct path, or zero
+	// if unknown.
+	RTT time.Duration `json:",omitempty"`
+
+	// Loss is the fraction of recent heartbeat pings to the peer that
+	// went unanswered. Heartbeats are only sent on direct paths.
+	Loss float64 `json:",omitempty"`
+}
+
+// Rating returns "good", "fair" or "poor" per q.Score.
+func (q *ConnQuality) Rating() string {
+	switch {
+	case q.Score >= 80:
+		return "good"
+	case q.Score >= 50:
+		return "fair"
+	}
+	return "poor"
+}
+
 type StatusBuilder struct {
 	mu     sync.Mutex
 	locked bool
@@ -345,6 +439,9 @@ func (sb *StatusBuilder) AddPeer(peer key.NodePublic, st *PeerStatus) {
 	if v := st.LastWrite; !v.IsZero() {
 		e.LastWrite = v
 	}
+	if v := st.ConnQuality; v != nil {
+		e.ConnQuality = v
+	}
 	if st.Online {
 		e.Online = true
 	}
@@ -413,7 +510,7 @@ func (st *Status) WriteHTML(w io.Writer) {
 	f("<p>Tailscale IP: %s", strings.Join(ips, ", "))
 
 	f("<table>\n<thead>\n")
-	f("<tr><th>Peer</th><th>OS</th><th>Node</th><th>Owner</th><th>Rx</th><th>Tx</th><th>Activity</th><th>Connection</th></tr>\n")
+	f("<tr><th>Peer</th><th>OS</th><th>Node</th><th>Owner</th><th>Rx</th><th>Tx</th><th>Activity</th><th>Connection</th><th>Quality</th></tr>\n")
 	f("</thead>\n<tbody>\n")
 
 	now := time.Now()
@@ -483,6 +580,12 @@ func (st *Status) WriteHTML(w io.Writer) {
 
 		f("</td>") // end Addrs
 
+		f("<td class=\"acenter\">")
+		if q := ps.ConnQuality; q != nil {
+			f("%d (%s)", q.Score, q.Rating())
+		}
+		f("</td>")
+
 		f("</tr>\n")
 	}
 	f("</tbody>\n</table>\n")
@@ -568,6 +671,114 @@ func (pr *PingResult) ToPingResponse(pingType tailcfg.PingType) *tailcfg.PingRes
 	}
 }
 
+// PathImpairment is the artificial latency and loss added to the
+// packets sent to a peer over one of its paths, as returned by a GET of
+// the LocalAPI /localapi/v0/debug-impair handler.
+type PathImpairment struct {
+	Peer key.NodePublic
+
+	// Path is "udp" for direct paths or "derp" for DERP.
+	Path string
+
+	Latency time.Duration
+	Jitter  time.Duration `json:",omitempty"`
+	Loss    float64       `json:",omitempty"` // from 0 to 1
+}
+
+// DERPConnState is the health of the connection to a DERP region, as
+// returned by the LocalAPI /localapi/v0/debug-derp handler.
+type DERPConnState struct {
+	RegionID   int
+	RegionCode string
+
+	// Home is whether this is the home DERP region.
+	Home bool
+
+	// Created is when the client for the region was created.
+	Created time.Time
+
+	// Connected is whether there's currently a connection, and
+	// ConnectedAt when it was made.
+	Connected   bool
+	ConnectedAt time.Time
+
+	// Reconnects is how many times the client reconnected.
+	Reconnects int
+
+	// LastPong is when the server last answered a ping, if ever, and
+	// RTT the moving average of the ping round trip time.
+	LastPong time.Time
+	RTT      time.Duration `json:",omitempty"`
+
+	// PingFailures is how many pings went unanswered.
+	PingFailures int
+}
+
+// PeerDiscoState is the state of the disco (NAT traversal) protocol
+// with a peer, as returned by the LocalAPI /localapi/v0/debug-disco
+// handler.
+type PeerDiscoState struct {
+	NodeKey  key.NodePublic
+	DiscoKey key.DiscoPublic
+
+	// BestAddr is the UDP address used to reach the peer directly, if
+	// any, and BestAddrLatency its latency.
+	BestAddr        netip.AddrPort
+	BestAddrLatency time.Duration `json:",omitempty"`
+
+	// TrustedUntil is when BestAddr stops being trusted without
+	// hearing a new pong from it. Until then, DERP isn't used.
+	TrustedUntil time.Time
+
+	Endpoints []DiscoEndpointState
+	Counters  DiscoCounters
+
+	// Events are the peer's most recent disco events, oldest first.
+	Events []DiscoEvent
+}
+
+// DiscoEndpointState is the disco state of one candidate UDP endpoint
+// of a peer.
+type DiscoEndpointState struct {
+	Addr netip.AddrPort
+
+	// Source is where the endpoint came from: "netmap",
+	// "call-me-maybe", "ping" or "pinned".
+	Source string
+
+	LastPing time.Time // last ping we sent to it, if any
+	LastPong time.Time // last pong we got from it, if any
+
+	// Latency is the round trip time of the last pong.
+	Latency time.Duration `json:",omitempty"`
+}
+
+// DiscoCounters counts the disco messages exchanged with a peer.
+type DiscoCounters struct {
+	PingsSent       int
+	PongsReceived   int
+	PingTimeouts    int
+	PingsReceived   int
+	CallMeMaybeSent int
+	CallMeMaybeRecv int
+}
+
+// DiscoEvent is something that happened in the disco protocol with a
+// peer.
+type DiscoEvent struct {
+	Time time.Time
+
+	// Type is one of "ping-sent", "pong-received", "ping-timeout",
+	// "ping-received", "call-me-maybe-sent", "call-me-maybe-received",
+	// "best-addr" (BestAddr changed) or "trust-reset" (BestAddr is no
+	// longer trusted, or was cleared).
+	Type string
+
+	Addr    netip.AddrPort // zero if not applicable
+	Latency time.Duration  `json:",omitempty"`
+	Detail  string         `json:",omitempty"`
+}
+
 func SortPeers(peers []*PeerStatus) {
 	sort.Slice(peers, func(i, j int) bool { return sortKey(peers[i]) < sortKey(peers[j]) })
 }
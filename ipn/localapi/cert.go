@@ -75,6 +75,11 @@ func (h *Handler) certDir() (string, error) {
 
 var acmeDebug = envknob.Bool("TS_DEBUG_ACME")
 
+// maxCertMinValidity is the largest min_validity accepted by serveCert.
+// It's well under the lifetime of a new cert, so that asking for it
+// doesn't cause a new cert to be issued on every request.
+const maxCertMinValidity = 30 * 24 * time.Hour
+
 func (h *Handler) serveCert(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitWrite && !h.PermitCert {
 		http.Error(w, "cert access denied", http.StatusForbidden)
@@ -93,6 +98,17 @@ func (h *Handler) serveCert(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// min_validity, if set, requires the returned cert to be valid for
+	// at least that much longer, renewing it synchronously if needed.
+	var minValidity time.Duration
+	if v := r.FormValue("min_validity"); v != "" {
+		minValidity, err = time.ParseDuration(v)
+		if err != nil || minValidity < 0 || minValidity > maxCertMinValidity {
+			http.Error(w, fmt.Sprintf("invalid min_validity; want a duration between 0 and %v", maxCertMinValidity), 400)
+			return
+		}
+	}
+
 	now := time.Now()
 	logf := logger.WithPrefix(h.logf, fmt.Sprintf("cert(%q): ", domain))
 	traceACME := func(v any) {
@@ -103,7 +119,7 @@ func (h *Handler) serveCert(w http.ResponseWriter, r *http.Request) {
 		log.Printf("acme %T: %s", v, j)
 	}
 
-	if pair, ok := h.getCertPEMCached(dir, domain, now); ok {
+	if pair, ok := h.getCertPEMCached(dir, domain, now.Add(minValidity)); ok {
 		future := now.AddDate(0, 0, 14)
 		if h.shouldStartDomainRenewal(dir, domain, future) {
 			logf("starting async renewal")
@@ -114,7 +130,7 @@ func (h *Handler) serveCert(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	pair, err := h.getCertPEM(r.Context(), logf, traceACME, dir, domain, now)
+	pair, err := h.getCertPEM(r.Context(), logf, traceACME, dir, domain, now.Add(minValidity))
 	if err != nil {
 		logf("getCertPEM: %v", err)
 		http.Error(w, fmt.Sprint(err), 500)
@@ -217,9 +233,14 @@ func (h *Handler) getCertPEM(ctx context.Context, logf logger.Logf, traceACME fu
 
 	// Before hitting LetsEncrypt, see if this is a domain that Tailscale will do DNS challenges for.
 	st := h.b.StatusWithoutPeers()
-	if err := checkCertDomain(st, domain); err != nil {
+	var resolver net.Resolver
+	challengeDomain, err := certChallengeDomain(ctx, st, domain, resolver.LookupCNAME)
+	if err != nil {
 		return nil, err
 	}
+	if challengeDomain != domain {
+		logf("using DNS-01 challenge delegated to %q", challengeDomain)
+	}
 
 	order, err := ac.AuthorizeOrder(ctx, []acme.AuthzID{{Type: "dns", Value: domain}})
 	if err != nil {
@@ -239,9 +260,8 @@ func (h *Handler) getCertPEM(ctx context.Context, logf logger.Logf, traceACME fu
 				if err != nil {
 					return nil, err
 				}
-				key := "_acme-challenge." + domain
+				key := "_acme-challenge." + challengeDomain
 
-				var resolver net.Resolver
 				var ok bool
 				txts, _ := resolver.LookupTXT(ctx, key)
 				for _, txt := range txts {
@@ -455,3 +475,32 @@ func checkCertDomain(st *ipnstate.Status, domain string) error {
 		return fmt.Errorf("invalid domain %q; must be one of %q", domain, okay)
 	}
 }
+
+// certChallengeDomain returns the domain whose ACME DNS-01 challenge
+// record the control server sets when a cert is requested for domain.
+// That's domain itself if it's one of the node's cert domains.
+//
+// Otherwise domain may be a user-owned custom domain (typically
+// CNAME'd to the node's name) whose challenge name
+// "_acme-challenge.<domain>" has a CNAME record pointing to
+// "_acme-challenge.<cert domain>". ACME CAs follow that CNAME when
+// validating, so the challenge is delegated to the node's cert domain.
+func certChallengeDomain(ctx context.Context, st *ipnstate.Status, domain string, lookupCNAME func(context.Context, string) (string, error)) (string, error) {
+	err := checkCertDomain(st, domain)
+	if err == nil || domain == "" {
+		return domain, err
+	}
+	const prefix = "_acme-challenge."
+	// LookupCNAME can return the canonical name along with an
+	// error when the target has no A records, as is usual for a
+	// challenge name, so only cname is looked at.
+	cname, _ := lookupCNAME(ctx, prefix+domain)
+	cname = strings.TrimSuffix(cname, ".")
+	if strings.HasPrefix(cname, prefix) {
+		target := strings.TrimPrefix(cname, prefix)
+		if target != domain && checkCertDomain(st, target) == nil {
+			return target, nil
+		}
+	}
+	return "", fmt.Errorf("%w; to use a custom domain, add a CNAME record for %s%s pointing to %s<cert domain>", err, prefix, domain, prefix)
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !ios && !android && !js
+// +build !ios,!android,!js
+
+package localapi
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+func TestCertChallengeDomain(t *testing.T) {
+	st := &ipnstate.Status{
+		CertDomains: []string{"node.tailnet.ts.net", "other.tailnet.ts.net"},
+	}
+	cnames := map[string]string{
+		"_acme-challenge.www.example.com":   "_acme-challenge.node.tailnet.ts.net.",
+		"_acme-challenge.nodot.example.com": "_acme-challenge.node.tailnet.ts.net",
+		"_acme-challenge.evil.example.com":  "_acme-challenge.stranger.ts.net.",
+		"_acme-challenge.bad.example.com":   "node.tailnet.ts.net.",
+		"_acme-challenge.loop.example.com":  "_acme-challenge.loop.example.com.",
+	}
+	lookupCNAME := func(ctx context.Context, name string) (string, error) {
+		if c, ok := cnames[name]; ok {
+			// Like net.LookupCNAME for a challenge name without
+			// A records: the canonical name and an error.
+			return c, errors.New("no such host")
+		}
+		return "", errors.New("no such host")
+	}
+	tests := []struct {
+		domain  string
+		want    string
+		wantErr string // substring; empty means no error
+	}{
+		{domain: "node.tailnet.ts.net", want: "node.tailnet.ts.net"},
+		{domain: "other.tailnet.ts.net", want: "other.tailnet.ts.net"},
+		{domain: "", wantErr: "missing domain name"},
+		{domain: "www.example.com", want: "node.tailnet.ts.net"},
+		{domain: "nodot.example.com", want: "node.tailnet.ts.net"},
+		{domain: "evil.example.com", wantErr: "add a CNAME record for _acme-challenge.evil.example.com"},
+		{domain: "bad.example.com", wantErr: "invalid domain"},
+		{domain: "loop.example.com", wantErr: "invalid domain"},
+		{domain: "unknown.example.com", wantErr: "invalid domain"},
+	}
+	for _, tt := range tests {
+		got, err := certChallengeDomain(context.Background(), st, tt.domain, lookupCNAME)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("certChallengeDomain(%q) = %q, %v; want error containing %q", tt.domain, got, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("certChallengeDomain(%q) = %q, %v; want %q", tt.domain, got, err, tt.want)
+		}
+	}
+}
@@ -7,6 +7,7 @@
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
@@ -26,15 +27,19 @@
 	"time"
 
 	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/health"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/netutil"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tka"
+	"tailscale.com/tsweb/tracing"
+	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/clientmetric"
 	"tailscale.com/version"
+	"tailscale.com/wgengine/magicsock"
 )
 
 func randHex(n int) string {
@@ -76,16 +81,50 @@ type Handler struct {
 	// cert fetching access.
 	PermitCert bool
 
+	// CallerUserID is the OS user ID of the client, if known. It's
+	// only used to tell the client whether it's the controlling user.
+	CallerUserID string
+
 	b            *ipnlocal.LocalBackend
 	logf         logger.Logf
 	backendLogID string
 }
 
+// slowRequestThreshold is how long a LocalAPI request can take before
+// it's logged, along with its trace ID.
+const slowRequestThreshold = 5 * time.Second
+
+// isLongRunning reports whether requests to the LocalAPI path are
+// expected to take a long time, such as streams, so aren't logged as
+// slow.
+func isLongRunning(path string) bool {
+	switch path {
+	case "/localapi/v0/bench",
+		"/localapi/v0/dial",
+		"/localapi/v0/profile",
+		"/localapi/v0/traffic-stats",
+		"/localapi/v0/watch-files",
+		"/localapi/v0/watch-netmap-generation":
+		return true
+	}
+	return strings.HasPrefix(path, "/localapi/v0/files/") ||
+		strings.HasPrefix(path, "/localapi/v0/file-put/")
+}
+
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if h.b == nil {
 		http.Error(w, "server has no local backend", http.StatusInternalServerError)
 		return
 	}
+	r = tracing.Request(w, r)
+	if !isLongRunning(r.URL.Path) {
+		start := time.Now()
+		defer func() {
+			if d := time.Since(start); d > slowRequestThreshold {
+				tracing.Logf(r.Context(), h.logf)("localapi: slow request %s %s took %v", r.Method, r.URL.Path, d.Round(time.Millisecond))
+			}
+		}()
+	}
 	w.Header().Set("Tailscale-Version", version.Long)
 	if h.RequiredPassword != "" {
 		_, pass, ok := r.BasicAuth()
@@ -113,6 +152,8 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.URL.Path {
 	case "/localapi/v0/whois":
 		h.serveWhoIs(w, r)
+	case "/localapi/v0/whois-history":
+		h.serveWhoIsHistory(w, r)
 	case "/localapi/v0/goroutines":
 		h.serveGoroutines(w, r)
 	case "/localapi/v0/profile":
@@ -123,10 +164,16 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.serveLogout(w, r)
 	case "/localapi/v0/login-interactive":
 		h.serveLoginInteractive(w, r)
+	case "/localapi/v0/reauth":
+		h.serveReauth(w, r)
 	case "/localapi/v0/prefs":
 		h.servePrefs(w, r)
 	case "/localapi/v0/ping":
 		h.servePing(w, r)
+	case "/localapi/v0/wol":
+		h.serveWakeOnLAN(w, r)
+	case "/localapi/v0/bench":
+		h.serveBench(w, r)
 	case "/localapi/v0/check-prefs":
 		h.serveCheckPrefs(w, r)
 	case "/localapi/v0/check-ip-forwarding":
@@ -139,10 +186,30 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.serveSetDNS(w, r)
 	case "/localapi/v0/derpmap":
 		h.serveDERPMap(w, r)
+	case "/localapi/v0/health":
+		h.serveHealth(w, r)
+	case "/localapi/v0/maintenance":
+		h.serveMaintenance(w, r)
+	case "/localapi/v0/controlling-user":
+		h.serveControllingUser(w, r)
+	case "/localapi/v0/netmap-size":
+		h.serveNetMapSize(w, r)
+	case "/localapi/v0/exit-node-clients":
+		h.serveExitNodeClients(w, r)
 	case "/localapi/v0/metrics":
 		h.serveMetrics(w, r)
 	case "/localapi/v0/debug":
 		h.serveDebug(w, r)
+	case "/localapi/v0/component-log-level":
+		h.serveComponentLogLevel(w, r)
+	case "/localapi/v0/history":
+		h.serveHistory(w, r)
+	case "/localapi/v0/debug-disco":
+		h.serveDebugDisco(w, r)
+	case "/localapi/v0/debug-derp":
+		h.serveDebugDERP(w, r)
+	case "/localapi/v0/debug-impair":
+		h.serveDebugImpair(w, r)
 	case "/localapi/v0/set-expiry-sooner":
 		h.serveSetExpirySooner(w, r)
 	case "/localapi/v0/dial":
@@ -151,10 +218,22 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.serveIDToken(w, r)
 	case "/localapi/v0/upload-client-metrics":
 		h.serveUploadClientMetrics(w, r)
+	case "/localapi/v0/traffic-stats":
+		h.serveTrafficStats(w, r)
+	case "/localapi/v0/watch-netmap-generation":
+		h.serveWatchNetMapGeneration(w, r)
+	case "/localapi/v0/watch-files":
+		h.serveWatchFiles(w, r)
+	case "/localapi/v0/peerapi-handlers":
+		h.servePeerAPIHandlers(w, r)
 	case "/localapi/v0/tka/status":
 		h.serveTkaStatus(w, r)
 	case "/localapi/v0/tka/init":
 		h.serveTkaInit(w, r)
+	case "/localapi/v0/tka/sign":
+		h.serveTkaSign(w, r)
+	case "/localapi/v0/tka/log":
+		h.serveTkaLog(w, r)
 	case "/":
 		io.WriteString(w, "tailscaled\n")
 	default:
@@ -248,6 +327,7 @@ func (h *Handler) serveWhoIs(w http.ResponseWriter, r *http.Request) {
 		Node:        n,
 		UserProfile: &u,
 		Caps:        b.PeerCaps(ipp.Addr()),
+		CapMap:      b.PeerCapMap(ipp.Addr()),
 	}
 	j, err := json.MarshalIndent(res, "", "\t")
 	if err != nil {
@@ -258,6 +338,36 @@ func (h *Handler) serveWhoIs(w http.ResponseWriter, r *http.Request) {
 	w.Write(j)
 }
 
+// serveWhoIsHistory returns which nodes the tailnet IP address in the
+// "addr" parameter has belonged to, as a JSON array of
+// apitype.IPAssignment. With an "at" parameter, an RFC 3339 time, it
+// returns only the assignment in effect at that time, if any.
+func (h *Handler) serveWhoIsHistory(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "whois access denied", http.StatusForbidden)
+		return
+	}
+	addr, err := netip.ParseAddr(r.FormValue("addr"))
+	if err != nil {
+		http.Error(w, "invalid 'addr' parameter", 400)
+		return
+	}
+	var at time.Time
+	if v := r.FormValue("at"); v != "" {
+		at, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "invalid 'at' parameter", 400)
+			return
+		}
+	}
+	res := h.b.IPHistory(addr, at)
+	if res == nil {
+		res = []apitype.IPAssignment{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
 func (h *Handler) serveGoroutines(w http.ResponseWriter, r *http.Request) {
 	// Require write access out of paranoia that the goroutine dump
 	// (at least its arguments) might contain something sensitive.
@@ -280,6 +390,7 @@ func (h *Handler) serveMetrics(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Header().Set("Content-Type", "text/plain")
 	clientmetric.WritePrometheusExpositionFormat(w)
+	h.b.WritePeerLatencyMetrics(w)
 }
 
 func (h *Handler) serveDebug(w http.ResponseWriter, r *http.Request) {
@@ -311,6 +422,170 @@ func (h *Handler) serveDebug(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, "done\n")
 }
 
+// serveComponentLogLevel handles requests to get (GET) or set (POST)
+// the log verbosity levels of individual components, like magicsock.
+func (h *Handler) serveComponentLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if !h.PermitRead {
+			http.Error(w, "log level access denied", http.StatusForbidden)
+			return
+		}
+	case "POST":
+		if !h.PermitWrite {
+			http.Error(w, "log level access denied", http.StatusForbidden)
+			return
+		}
+		level, err := strconv.Atoi(r.FormValue("level"))
+		if err != nil {
+			http.Error(w, "invalid 'level' parameter", 400)
+			return
+		}
+		if err := h.b.SetComponentLogLevel(r.FormValue("component"), level); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	default:
+		http.Error(w, "GET or POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	levels, err := h.b.ComponentLogLevels()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(levels)
+}
+
+// serveHistory returns the node's history of tailnet changes, as a
+// JSON array of apitype.HistoryEvent.
+func (h *Handler) serveHistory(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "history access denied", http.StatusForbidden)
+		return
+	}
+	evs := h.b.ChangeHistory()
+	if evs == nil {
+		evs = []apitype.HistoryEvent{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(evs)
+}
+
+// serveDebugDisco returns the disco state of each peer, optionally
+// limited to the one with the node key in the "peer" parameter, as a
+// JSON array of ipnstate.PeerDiscoState.
+func (h *Handler) serveDebugDisco(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "debug-disco access denied", http.StatusForbidden)
+		return
+	}
+	var peer key.NodePublic
+	if v := r.FormValue("peer"); v != "" {
+		if err := peer.UnmarshalText([]byte(v)); err != nil {
+			http.Error(w, "invalid 'peer' parameter", 400)
+			return
+		}
+	}
+	states, err := h.b.DiscoDebugState()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	ret := []ipnstate.PeerDiscoState{}
+	for _, st := range states {
+		if peer.IsZero() || st.NodeKey == peer {
+			ret = append(ret, st)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(ret)
+}
+
+// serveDebugDERP returns the health of the connection to each DERP
+// region as a JSON array of ipnstate.DERPConnState.
+func (h *Handler) serveDebugDERP(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "debug-derp access denied", http.StatusForbidden)
+		return
+	}
+	states, err := h.b.DERPHealth()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(states)
+}
+
+// serveDebugImpair sets artificial latency and loss on the paths to
+// the peer with the node key in the "peer" parameter, for testing, on
+// POST. See magicsock.Conn.SetPathImpairment. On GET, it returns the
+// impairments set as a JSON array of ipnstate.PathImpairment.
+func (h *Handler) serveDebugImpair(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		if !h.PermitRead {
+			http.Error(w, "debug-impair access denied", http.StatusForbidden)
+			return
+		}
+		imps, err := h.b.PathImpairments()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(imps)
+		return
+	}
+	if !h.PermitWrite {
+		http.Error(w, "debug-impair access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "GET or POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	var peer key.NodePublic
+	if err := peer.UnmarshalText([]byte(r.FormValue("peer"))); err != nil {
+		http.Error(w, "invalid 'peer' parameter", 400)
+		return
+	}
+	imp := magicsock.PathImpairment{Path: r.FormValue("path")}
+	for _, d := range []struct {
+		param string
+		dst   *time.Duration
+	}{
+		{"latency", &imp.Latency},
+		{"jitter", &imp.Jitter},
+	} {
+		if v := r.FormValue(d.param); v != "" {
+			var err error
+			if *d.dst, err = time.ParseDuration(v); err != nil {
+				http.Error(w, fmt.Sprintf("invalid '%s' parameter", d.param), 400)
+				return
+			}
+		}
+	}
+	if v := r.FormValue("loss"); v != "" {
+		var err error
+		if imp.Loss, err = strconv.ParseFloat(v, 64); err != nil {
+			http.Error(w, "invalid 'loss' parameter", 400)
+			return
+		}
+	}
+	if err := h.b.SetPathImpairment(peer, imp); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, "done\n")
+}
+
 // serveProfileFunc is the implementation of Handler.serveProfile, after auth,
 // for platforms where we want to link it in.
 var serveProfileFunc func(http.ResponseWriter, *http.Request)
@@ -377,6 +652,31 @@ func (h *Handler) serveLoginInteractive(w http.ResponseWriter, r *http.Request)
 	return
 }
 
+func (h *Handler) serveReauth(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "reauth access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", 400)
+		return
+	}
+	var req apitype.ReauthRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := h.b.Reauth(req.AuthKey); err != nil {
+		if errors.Is(err, ipnlocal.ErrMaintenanceDeferred) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (h *Handler) serveLogout(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitWrite {
 		http.Error(w, "logout access denied", http.StatusForbidden)
@@ -412,10 +712,18 @@ func (h *Handler) servePrefs(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		var err error
-		prefs, err = h.b.EditPrefs(mp)
+		if r.FormValue("dry-run") == "true" {
+			prefs, err = h.b.PreviewEditPrefs(mp)
+		} else {
+			prefs, err = h.b.EditPrefsIfMatch(mp, r.Header.Get("If-Match"))
+		}
 		if err != nil {
 			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
+			if errors.Is(err, ipnlocal.ErrPrefsConflict) {
+				w.WriteHeader(http.StatusPreconditionFailed)
+			} else {
+				w.WriteHeader(http.StatusBadRequest)
+			}
 			json.NewEncoder(w).Encode(resJSON{Error: err.Error()})
 			return
 		}
@@ -426,6 +734,7 @@ func (h *Handler) servePrefs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", prefs.ETag())
 	e := json.NewEncoder(w)
 	e.SetIndent("", "\t")
 	e.Encode(prefs)
@@ -501,6 +810,82 @@ func (h *Handler) serveFiles(w http.ResponseWriter, r *http.Request) {
 	io.Copy(w, rc)
 }
 
+// serveWatchFiles streams an apitype.WaitingFile as JSON for each file
+// waiting to be picked up and then for each new one as it arrives.
+func (h *Handler) serveWatchFiles(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "file access denied", http.StatusForbidden)
+		return
+	}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	// Check up front that Taildrop is available, while an error can
+	// still be returned with a status code.
+	if _, err := h.b.WaitingFiles(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	enc := json.NewEncoder(w)
+	err := h.b.WatchIncomingFiles(ctx, func(wf apitype.WaitingFile) {
+		if err := enc.Encode(wf); err != nil {
+			cancel()
+			return
+		}
+		f.Flush()
+	})
+	if err != nil && ctx.Err() == nil {
+		h.logf("watch-files: %v", err)
+	}
+}
+
+// servePeerAPIHandlers lists (GET), registers (POST) and unregisters
+// (DELETE, with a "name" parameter) custom peerapi handlers that proxy
+// to local services.
+func (h *Handler) servePeerAPIHandlers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if !h.PermitRead {
+			http.Error(w, "peerapi handlers access denied", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.b.CustomPeerAPIHandlers())
+	case "POST":
+		if !h.PermitWrite {
+			http.Error(w, "peerapi handlers access denied", http.StatusForbidden)
+			return
+		}
+		var ph apitype.PeerAPIHandler
+		if err := json.NewDecoder(r.Body).Decode(&ph); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := h.b.RegisterPeerAPIProxy(ph.Name, ph.Cap, ph.Target); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		if !h.PermitWrite {
+			http.Error(w, "peerapi handlers access denied", http.StatusForbidden)
+			return
+		}
+		h.b.UnregisterPeerAPIHandler(r.FormValue("name"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "want GET, POST or DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
 func writeErrorJSON(w http.ResponseWriter, err error) {
 	if err == nil {
 		err = errors.New("unexpected nil error")
@@ -596,6 +981,10 @@ func (h *Handler) serveFilePut(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	outReq.ContentLength = r.ContentLength
+	tracing.SetHeader(outReq)
+	// Let the peer reject the file, such as by its local Taildrop
+	// rules, before it's sent.
+	outReq.Header.Set("Expect", "100-continue")
 
 	rp := httputil.NewSingleHostReverseProxy(dstURL)
 	rp.Transport = h.b.Dialer().PeerAPITransport()
@@ -632,6 +1021,136 @@ func (h *Handler) serveDERPMap(w http.ResponseWriter, r *http.Request) {
 	e.Encode(h.b.DERPMap())
 }
 
+// serveHealth returns the current health warnings as a JSON array of
+// health.Warning, root causes and all.
+func (h *Handler) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "health access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	ws := health.Warnings()
+	if ws == nil {
+		ws = []health.Warning{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(ws)
+}
+
+// serveMaintenance returns the maintenance window status on GET. On
+// POST, it overrides the window for the duration in the "allow" form
+// value first, running deferred operations now; "0" ends an override.
+func (h *Handler) serveMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if !h.PermitRead {
+			http.Error(w, "maintenance access denied", http.StatusForbidden)
+			return
+		}
+	case "POST":
+		if !h.PermitWrite {
+			http.Error(w, "maintenance access denied", http.StatusForbidden)
+			return
+		}
+		d, err := time.ParseDuration(r.FormValue("allow"))
+		if err != nil {
+			http.Error(w, "invalid allow duration: "+err.Error(), 400)
+			return
+		}
+		h.b.AllowMaintenance(d)
+	default:
+		http.Error(w, "want GET or POST", 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.b.MaintenanceStatus())
+}
+
+// serveControllingUser returns the OS user whose state tailscaled is
+// using, as an apitype.ControllingUser.
+//
+// It needs no permissions, so that users locked out by another one
+// controlling tailscaled can find out who.
+func (h *Handler) serveControllingUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.b.ControllingUser(h.CallerUserID))
+}
+
+// serveNetMapSize returns an estimate of the memory used by the current
+// netmap, with the largest "top" peers, as an apitype.NetMapSize.
+func (h *Handler) serveNetMapSize(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "netmap-size access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	var top int
+	if v := r.FormValue("top"); v != "" {
+		var err error
+		if top, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "invalid top", 400)
+			return
+		}
+	}
+	s := h.b.NetMapSize(top)
+	if s == nil {
+		http.Error(w, "no netmap", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(s)
+}
+
+// serveExitNodeClients serves the peers using this node as an exit
+// node on GET. On POST, it approves (approve=true) or denies
+// (approve=false) the peer with the ip param.
+func (h *Handler) serveExitNodeClients(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if !h.PermitRead {
+			http.Error(w, "exit-node-clients access denied", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		e := json.NewEncoder(w)
+		e.SetIndent("", "\t")
+		e.Encode(h.b.ExitNodeClients())
+	case "POST":
+		if !h.PermitWrite {
+			http.Error(w, "exit-node-clients access denied", http.StatusForbidden)
+			return
+		}
+		ip, err := netip.ParseAddr(r.FormValue("ip"))
+		if err != nil {
+			http.Error(w, "invalid ip", 400)
+			return
+		}
+		approve, err := strconv.ParseBool(r.FormValue("approve"))
+		if err != nil {
+			http.Error(w, "invalid approve", 400)
+			return
+		}
+		h.b.SetExitNodeClientApproval(ip, approve)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "want GET or POST", 400)
+	}
+}
+
 // serveSetExpirySooner sets the expiry date on the current machine, specified
 // by an `expiry` unix timestamp as POST or query param.
 func (h *Handler) serveSetExpirySooner(w http.ResponseWriter, r *http.Request) {
@@ -691,6 +1210,78 @@ func (h *Handler) servePing(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(res)
 }
 
+// serveWakeOnLAN wakes the sleeping peer with Tailscale IP "ip" with a
+// Wake-on-LAN packet for the MAC address "mac", sent by a peer on its
+// LAN: the one with Tailscale IP "via" if set, else one tailscaled
+// picks.
+func (h *Handler) serveWakeOnLAN(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "wol access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", 400)
+		return
+	}
+	ip, err := netip.ParseAddr(r.FormValue("ip"))
+	if err != nil {
+		http.Error(w, "invalid 'ip' parameter", 400)
+		return
+	}
+	mac, err := net.ParseMAC(r.FormValue("mac"))
+	if err != nil {
+		http.Error(w, "invalid 'mac' parameter", 400)
+		return
+	}
+	var via netip.Addr
+	if v := r.FormValue("via"); v != "" {
+		via, err = netip.ParseAddr(v)
+		if err != nil {
+			http.Error(w, "invalid 'via' parameter", 400)
+			return
+		}
+	}
+	res, err := h.b.WakeOnLAN(r.Context(), ip, mac, via)
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// serveBench runs a throughput test over the tunnel to the peer with
+// Tailscale IP "ip" for "duration", with the peer sending if "reverse"
+// is true, and returns an apitype.BenchResult.
+func (h *Handler) serveBench(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "bench access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", 400)
+		return
+	}
+	ip, err := netip.ParseAddr(r.FormValue("ip"))
+	if err != nil {
+		http.Error(w, "invalid 'ip' parameter", 400)
+		return
+	}
+	d, err := time.ParseDuration(r.FormValue("duration"))
+	if err != nil {
+		http.Error(w, "invalid 'duration' parameter", 400)
+		return
+	}
+	reverse, _ := strconv.ParseBool(r.FormValue("reverse"))
+	res, err := h.b.Bench(r.Context(), ip, d, reverse)
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
 func (h *Handler) serveDial(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "POST required", http.StatusMethodNotAllowed)
@@ -796,6 +1387,81 @@ type clientMetricJSON struct {
 	json.NewEncoder(w).Encode(struct{}{})
 }
 
+// serveTrafficStats streams newline-delimited JSON ipn.TrafficStats
+// samples to the client until it disconnects.
+func (h *Handler) serveTrafficStats(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "traffic stats access denied", http.StatusForbidden)
+		return
+	}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	// The callback runs on the backend's engine status path, so it
+	// only hands samples to this goroutine, which does the writing.
+	// Samples are dropped if the client falls behind.
+	ctx, cancel := context.WithCancel(r.Context())
+	ch := make(chan ipn.TrafficStats, 1)
+	watchDone := make(chan struct{})
+	go func() {
+		defer close(watchDone)
+		h.b.WatchTrafficStats(ctx, func(ts ipn.TrafficStats) {
+			select {
+			case ch <- ts:
+			default:
+			}
+		})
+	}()
+	defer func() {
+		cancel()
+		<-watchDone // unregistered
+	}()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ts := <-ch:
+			if err := enc.Encode(ts); err != nil {
+				return
+			}
+			f.Flush()
+		}
+	}
+}
+
+func (h *Handler) serveWatchNetMapGeneration(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "netmap generation access denied", http.StatusForbidden)
+		return
+	}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	enc := json.NewEncoder(w)
+	h.b.WatchNetMapGeneration(ctx, func(gen uint64) {
+		if err := enc.Encode(apitype.NetMapGeneration{Generation: gen}); err != nil {
+			cancel()
+			return
+		}
+		f.Flush()
+	})
+}
+
 func (h *Handler) serveTkaStatus(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitRead {
 		http.Error(w, "lock status access denied", http.StatusForbidden)
@@ -848,6 +1514,89 @@ type initRequest struct {
 	w.Write(j)
 }
 
+func (h *Handler) serveTkaSign(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "lock sign access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	type signRequest struct {
+		Requests []ipnstate.NetworkLockSignRequest
+		DryRun   bool
+	}
+	var req signRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", 400)
+		return
+	}
+
+	results, err := h.b.NetworkLockSign(req.Requests, req.DryRun)
+	if err != nil {
+		http.Error(w, "signing failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.MarshalIndent(results, "", "\t")
+	if err != nil {
+		http.Error(w, "JSON encoding error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// serveTkaLog serves a page of the tailnet key authority's log as an
+// ipnstate.NetworkLockLog. The optional params are cursor, from the
+// previous page; limit; kind, comma-separated update kinds to return;
+// and signer, a network-lock public key that signed the updates.
+func (h *Handler) serveTkaLog(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "lock log access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	var limit int
+	if v := r.FormValue("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			http.Error(w, "invalid limit", 400)
+			return
+		}
+	}
+	var kinds []string
+	if v := r.FormValue("kind"); v != "" {
+		kinds = strings.Split(v, ",")
+	}
+	var signer key.NLPublic
+	if v := r.FormValue("signer"); v != "" {
+		if err := signer.UnmarshalText([]byte(v)); err != nil {
+			http.Error(w, "invalid signer", 400)
+			return
+		}
+	}
+
+	log, err := h.b.NetworkLockLog(r.FormValue("cursor"), limit, kinds, signer)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	makeNonNil(&log.Updates)
+	j, err := json.MarshalIndent(log, "", "\t")
+	if err != nil {
+		http.Error(w, "JSON encoding error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
 func defBool(a string, def bool) bool {
 	if a == "" {
 		return def
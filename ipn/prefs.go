@@ -6,17 +6,21 @@
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
 	"runtime"
 	"strings"
+	"time"
 
 	"tailscale.com/atomicfile"
 	"tailscale.com/ipn/ipnstate"
@@ -35,6 +39,48 @@
 // The default control plane is the hosted version run by Tailscale.com.
 const DefaultControlURL = "https://controlplane.tailscale.com"
 
+// ControlProxyDirect is the Prefs.ControlProxy value for connecting to
+// the control server without a proxy, whatever the environment says.
+const ControlProxyDirect = "direct"
+
+// ParseControlProxy parses v, a Prefs.ControlProxy value other than
+// empty or ControlProxyDirect, as a proxy URL.
+//
+// The URL may not include a username or password: prefs are readable
+// by every local user, so proxy credentials are instead given to
+// tailscaled with its --control-proxy-auth-file flag.
+func ParseControlProxy(v string) (*url.URL, error) {
+	u, err := url.Parse(v)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q; want http, https or socks5", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, errors.New("no proxy host")
+	}
+	if u.User != nil {
+		return nil, errors.New("proxy URL can't include credentials; give them to tailscaled with --control-proxy-auth-file")
+	}
+	return u, nil
+}
+
+// redactControlProxy returns v, a Prefs.ControlProxy value, with any
+// password in it redacted.
+func redactControlProxy(v string) string {
+	if v == ControlProxyDirect {
+		return v
+	}
+	u, err := url.Parse(v)
+	if err != nil {
+		return "(invalid)"
+	}
+	return u.Redacted()
+}
+
 var (
 	// ErrExitNodeIDAlreadySet is returned from (*Prefs).SetExitNodeIP when the
 	// Prefs.ExitNodeID field is already set.
@@ -47,6 +93,64 @@ func IsLoginServerSynonym(val any) bool {
 	return val == "https://login.tailscale.com" || val == "https://controlplane.tailscale.com"
 }
 
+// The values of Prefs.Shields, from least to most strict.
+const (
+	// ShieldsOff blocks no traffic, beyond what ShieldsUp does.
+	ShieldsOff = ""
+
+	// ShieldsLAN allows incoming traffic over Tailscale and from
+	// Prefs.ShieldsLANRoutes, and blocks all other incoming traffic.
+	ShieldsLAN = "lan"
+
+	// ShieldsTailnet allows only incoming traffic over Tailscale.
+	ShieldsTailnet = "tailnet"
+
+	// ShieldsAll blocks all incoming traffic, as ShieldsUp does for
+	// Tailscale traffic.
+	ShieldsAll = "all"
+)
+
+var shieldsLevels = []string{ShieldsOff, ShieldsLAN, ShieldsTailnet, ShieldsAll}
+
+// ValidShields reports whether level is a valid Prefs.Shields value.
+func ValidShields(level string) bool {
+	return shieldsRank(level) >= 0
+}
+
+// ParseShields returns the Prefs.Shields level named s: one of the
+// Shields constants, or "off", the user-facing name of ShieldsOff.
+func ParseShields(s string) (string, error) {
+	if s == "off" {
+		return ShieldsOff, nil
+	}
+	if !ValidShields(s) {
+		return "", fmt.Errorf("unknown shields level %q; want off, lan, tailnet or all", s)
+	}
+	return s, nil
+}
+
+// StricterShields returns the stricter of shields levels a and b. An
+// invalid level is treated as ShieldsAll.
+func StricterShields(a, b string) string {
+	ra, rb := shieldsRank(a), shieldsRank(b)
+	if ra < 0 || rb < 0 {
+		return ShieldsAll
+	}
+	if ra > rb {
+		return a
+	}
+	return b
+}
+
+func shieldsRank(level string) int {
+	for i, l := range shieldsLevels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
+
 // Prefs are the user modifiable settings of the Tailscale node agent.
 type Prefs struct {
 	// ControlURL is the URL of the control server to use.
@@ -65,6 +169,13 @@ type Prefs struct {
 	// Options.UpdatePrefs when calling Backend.Start().
 	ControlURL string
 
+	// ControlProxy is the HTTP proxy to connect to the control server
+	// through: an http, https or socks5 URL without credentials (see
+	// ParseControlProxy), or ControlProxyDirect to not use a proxy.
+	// If empty, the proxy settings of the environment are used. It
+	// takes effect on the next connection to the server.
+	ControlProxy string `json:",omitempty"`
+
 	// RouteAll specifies whether to accept subnets advertised by
 	// other nodes on the Tailscale network. Note that this does not
 	// include default routes (0.0.0.0/0 and ::/0), those are
@@ -105,10 +216,36 @@ type Prefs struct {
 	// routed directly or via the exit node.
 	ExitNodeAllowLANAccess bool
 
+	// ExitNodeExcludeRoutes are destinations that are routed directly
+	// rather than via the exit node, such as a video conferencing
+	// service's ranges. They split the exit node's default route only;
+	// subnet routes advertised by peers still apply.
+	ExitNodeExcludeRoutes []netip.Prefix `json:",omitempty"`
+
+	// ExitNodeRotation, if non-empty, are exit nodes, by hostname or
+	// Tailscale IP, to spread internet traffic across in place of a
+	// single ExitNodeID or ExitNodeIP, which must then be unset. See
+	// ExitNodeRotateEvery for how. Offline ones are skipped.
+	ExitNodeRotation []string `json:",omitempty"`
+
+	// ExitNodeRotateEvery, if non-zero, is how often to move from one
+	// exit node in ExitNodeRotation to the next. If zero, traffic is
+	// spread across all of them at once per destination, not per
+	// connection: each destination address range is routed through
+	// one exit node, so all connections to a destination use the same
+	// one and a single busy destination isn't balanced at all.
+	ExitNodeRotateEvery time.Duration `json:",omitempty"`
+
 	// CorpDNS specifies whether to install the Tailscale network's
 	// DNS configuration, if it exists.
 	CorpDNS bool
 
+	// SyncHostsFile specifies whether to maintain a section of the
+	// OS's hosts file (/etc/hosts, or the Windows equivalent) with
+	// the names and addresses of Tailscale peers, for software that
+	// bypasses the system resolver and so never sees MagicDNS.
+	SyncHostsFile bool `json:",omitempty"`
+
 	// RunSSH bool is whether this node should run an SSH
 	// server, permitting access to peers according to the
 	// policies as configured by the Tailnet's admin(s).
@@ -132,6 +269,24 @@ type Prefs struct {
 	// connections. This overrides tailcfg.Hostinfo's ShieldsUp.
 	ShieldsUp bool
 
+	// Shields is how much incoming traffic to block, tailnet or not,
+	// as one of the Shields constants. Unlike ShieldsUp, it also
+	// blocks traffic that doesn't come over Tailscale, using the OS
+	// firewall (on Linux, FreeBSD and OpenBSD, and only if
+	// NetfilterMode isn't off).
+	Shields string `json:",omitempty"`
+
+	// ShieldsLANRoutes are the source ranges, typically the local
+	// network, allowed in when Shields is ShieldsLAN.
+	ShieldsLANRoutes []netip.Prefix `json:",omitempty"`
+
+	// Stealth, if true, drops UDP packets that can't be attributed
+	// to a current peer, or to a STUN server in the DERP map, before
+	// they're processed at all, so the node's WireGuard port looks
+	// closed to scanners. Peers can still connect, but only once
+	// they're in the netmap.
+	Stealth bool `json:",omitempty"`
+
 	// AdvertiseTags specifies groups that this node wants to join, for
 	// purposes of ACL enforcement. These can be referenced from the ACL
 	// security policy. Note that advertising a tag doesn't guarantee that
@@ -190,6 +345,89 @@ type Prefs struct {
 	// operate tailscaled without being root or using sudo.
 	OperatorUser string `json:",omitempty"`
 
+	// MaxBandwidthKbps and MaxPeerBandwidthKbps, if positive, limit
+	// the rate of WireGuard traffic this node sends and receives, in
+	// kilobits per second, for all peers combined and for each peer
+	// respectively. Each direction is limited separately. They're
+	// for links where Tailscale must never crowd out other traffic.
+	MaxBandwidthKbps     int `json:",omitempty"`
+	MaxPeerBandwidthKbps int `json:",omitempty"`
+
+	// PinnedEndpoints are static UDP endpoints for specific peers,
+	// such as servers with a fixed public ip:port. They're used as
+	// direct path candidates from the start, without waiting for
+	// endpoint discovery, and are preferred over discovered ones.
+	PinnedEndpoints []PinnedEndpoint `json:",omitempty"`
+
+	// TaildropRules, if non-empty, are the senders that files sent to
+	// this node over Taildrop are accepted from, and how. Files from
+	// senders not matching any rule are rejected before they're
+	// transferred. If empty, files are accepted from any peer allowed
+	// to send them, into the waiting-files directory.
+	TaildropRules []TaildropRule `json:",omitempty"`
+
+	// FlowSampleRate and FlowCollector, if both set, sample 1 in
+	// FlowSampleRate packets going through the tunnel into flow
+	// records and export them to FlowCollector, which is
+	// "ipfix://host:port" or "sflow://host:port".
+	FlowSampleRate int    `json:",omitempty"`
+	FlowCollector  string `json:",omitempty"`
+
+	// DSCPPassthrough, if non-empty, is the policy for which DSCP
+	// markings of packets sent into the tunnel are carried onto the
+	// outer UDP packets, as a comma-separated list of codepoints such
+	// as "EF,AF41=AF31". See dscp.ParsePolicy.
+	DSCPPassthrough string `json:",omitempty"`
+
+	// MaintenanceWindow, if non-empty, is the recurring time window
+	// outside of which disruptive operations, such as re-registering
+	// with an auth key or applying route changes from the tailnet
+	// policy, are deferred. See maintwindow.Parse for its format, such
+	// as "Sat,Sun 02:00-04:00".
+	MaintenanceWindow string `json:",omitempty"`
+
+	// LazyPeers, if true, configures peers into WireGuard only once
+	// they have traffic, removing them again after a few idle
+	// minutes, even if the control plane would otherwise turn that
+	// off. It saves memory and handshakes on large tailnets. Peers
+	// routing subnets or exit traffic are always configured.
+	LazyPeers bool `json:",omitempty"`
+
+	// AlwaysOnPeers are peers, by hostname or Tailscale IP, that are
+	// always configured into WireGuard rather than lazily, so the
+	// first packets to them aren't delayed.
+	AlwaysOnPeers []string `json:",omitempty"`
+
+	// SystemDialRules customize how tailscaled connects to
+	// destinations outside the tailnet, such as the control and DERP
+	// servers and those reached through its SOCKS5 and HTTP proxies,
+	// on hosts where the default route isn't the right way to reach
+	// everything. For each destination IP, the first rule whose Dest
+	// contains it applies.
+	SystemDialRules []DialRule `json:",omitempty"`
+
+	// ExitNodeClientApproval, if true, makes each peer that starts
+	// using this node as an exit node wait for approval from a
+	// frontend, with its traffic dropped until then. Frontends are
+	// notified of such peers with ipn.Notify.ExitNodeClient.
+	// Approvals last until tailscaled restarts, or until the peer
+	// has been inactive for a day.
+	ExitNodeClientApproval bool `json:",omitempty"`
+
+	// DiscoKeyRotation, if non-zero, makes the disco key used for
+	// peer-to-peer path discovery persist across restarts, replacing
+	// it once it's this old. Keeping it lets peers keep using their
+	// known paths to this node after tailscaled restarts rather than
+	// rediscovering them. If zero, a new disco key is made every
+	// time tailscaled starts.
+	DiscoKeyRotation time.Duration `json:",omitempty"`
+
+	// EventHooks run a command or POST to a local URL when peers come
+	// online or go offline or their routes change, for triggering
+	// automations. See eventhook.Parse for their format, such as
+	// "peer-online+peer-offline@nas=exec:nas-changed".
+	EventHooks []string `json:",omitempty"`
+
 	// The Persist field is named 'Config' in the file for backward
 	// compatibility with earlier versions.
 	// TODO(apenwarr): We should move this out of here, it's not a pref.
@@ -203,16 +441,24 @@ type MaskedPrefs struct {
 	Prefs
 
 	ControlURLSet             bool `json:",omitempty"`
+	ControlProxySet           bool `json:",omitempty"`
 	RouteAllSet               bool `json:",omitempty"`
 	AllowSingleHostsSet       bool `json:",omitempty"`
 	ExitNodeIDSet             bool `json:",omitempty"`
 	ExitNodeIPSet             bool `json:",omitempty"`
 	ExitNodeAllowLANAccessSet bool `json:",omitempty"`
+	ExitNodeExcludeRoutesSet  bool `json:",omitempty"`
+	ExitNodeRotationSet       bool `json:",omitempty"`
+	ExitNodeRotateEverySet    bool `json:",omitempty"`
 	CorpDNSSet                bool `json:",omitempty"`
+	SyncHostsFileSet          bool `json:",omitempty"`
 	RunSSHSet                 bool `json:",omitempty"`
 	WantRunningSet            bool `json:",omitempty"`
 	LoggedOutSet              bool `json:",omitempty"`
 	ShieldsUpSet              bool `json:",omitempty"`
+	ShieldsSet                bool `json:",omitempty"`
+	ShieldsLANRoutesSet       bool `json:",omitempty"`
+	StealthSet                bool `json:",omitempty"`
 	AdvertiseTagsSet          bool `json:",omitempty"`
 	HostnameSet               bool `json:",omitempty"`
 	NotepadURLsSet            bool `json:",omitempty"`
@@ -221,6 +467,113 @@ type MaskedPrefs struct {
 	NoSNATSet                 bool `json:",omitempty"`
 	NetfilterModeSet          bool `json:",omitempty"`
 	OperatorUserSet           bool `json:",omitempty"`
+	MaxBandwidthKbpsSet       bool `json:",omitempty"`
+	MaxPeerBandwidthKbpsSet   bool `json:",omitempty"`
+	PinnedEndpointsSet        bool `json:",omitempty"`
+	TaildropRulesSet          bool `json:",omitempty"`
+	FlowSampleRateSet         bool `json:",omitempty"`
+	FlowCollectorSet          bool `json:",omitempty"`
+	DSCPPassthroughSet        bool `json:",omitempty"`
+	MaintenanceWindowSet      bool `json:",omitempty"`
+	LazyPeersSet              bool `json:",omitempty"`
+	AlwaysOnPeersSet          bool `json:",omitempty"`
+	SystemDialRulesSet        bool `json:",omitempty"`
+	ExitNodeClientApprovalSet bool `json:",omitempty"`
+	DiscoKeyRotationSet       bool `json:",omitempty"`
+	EventHooksSet             bool `json:",omitempty"`
+}
+
+// PinnedEndpoint is a static endpoint for a peer. See
+// Prefs.PinnedEndpoints.
+type PinnedEndpoint struct {
+	// Peer is one of the peer's Tailscale IPs.
+	Peer netip.Addr
+
+	// Endpoint is the peer's UDP ip:port.
+	Endpoint netip.AddrPort
+}
+
+func (pe PinnedEndpoint) String() string {
+	return pe.Peer.String() + "=" + pe.Endpoint.String()
+}
+
+// DialRule is a rule for connecting to destinations outside the
+// tailnet. See Prefs.SystemDialRules.
+type DialRule struct {
+	// Dest is the destination IPs the rule applies to.
+	Dest netip.Prefix
+
+	// Interface, if non-empty, is the name of the network interface
+	// to connect out of, instead of the default route's.
+	Interface string `json:",omitempty"`
+
+	// Timeout, if non-zero, is how long to wait for each connection
+	// attempt to an IP in Dest.
+	Timeout time.Duration `json:",omitempty"`
+}
+
+func (r DialRule) String() string {
+	s := r.Dest.String()
+	if r.Interface != "" {
+		s += "=" + r.Interface
+	}
+	if r.Timeout > 0 {
+		s += "@" + r.Timeout.String()
+	}
+	return s
+}
+
+// TaildropRule is a rule for accepting files sent over Taildrop. See
+// Prefs.TaildropRules.
+type TaildropRule struct {
+	// From is the sender the rule matches: a user's login name (such
+	// as "alice@example.com"), a node's full MagicDNS name (such as
+	// "laptop.example.ts.net") or stable node ID, or "*" for any
+	// sender.
+	From string
+
+	// Dir, if non-empty, is the directory files from the sender are
+	// accepted into directly, without waiting to be picked up. It's
+	// relative to the directory tailscaled's --taildrop-accept-root
+	// flag names, and may not leave it; without that flag, files go
+	// to the waiting-files directory. Names are sanitized and never
+	// overwrite existing files. If empty, files go to the
+	// waiting-files directory as usual.
+	Dir string `json:",omitempty"`
+
+	// QuotaMB, if positive, is the most megabytes of files that may be
+	// in the rule's directory at once. Files that would exceed it are
+	// rejected.
+	QuotaMB int64 `json:",omitempty"`
+}
+
+// IsTaildropAcceptDir reports whether dir is valid as a
+// TaildropRule.Dir: a clean relative path that doesn't leave the
+// directory it's relative to.
+func IsTaildropAcceptDir(dir string) bool {
+	if dir == "" || filepath.IsAbs(dir) || filepath.VolumeName(dir) != "" || strings.HasPrefix(dir, "/") {
+		return false
+	}
+	if filepath.Clean(dir) != dir {
+		return false
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(dir), "/") {
+		if elem == ".." || elem == "." {
+			return false
+		}
+	}
+	return true
+}
+
+func (r TaildropRule) String() string {
+	s := r.From
+	if r.Dir != "" || r.QuotaMB > 0 {
+		s += "=" + r.Dir
+	}
+	if r.QuotaMB > 0 {
+		s += fmt.Sprintf("=%d", r.QuotaMB)
+	}
+	return s
 }
 
 // ApplyEdits mutates p, assigning fields from m.Prefs for each MaskedPrefs
@@ -294,6 +647,9 @@ func (p *Prefs) pretty(goos string) string {
 		sb.WriteString("mesh=false ")
 	}
 	fmt.Fprintf(&sb, "dns=%v want=%v ", p.CorpDNS, p.WantRunning)
+	if p.SyncHostsFile {
+		sb.WriteString("hostsfile=true ")
+	}
 	if p.RunSSH {
 		sb.WriteString("ssh=true ")
 	}
@@ -309,11 +665,30 @@ func (p *Prefs) pretty(goos string) string {
 	if p.ShieldsUp {
 		sb.WriteString("shields=true ")
 	}
+	if p.Shields != "" {
+		fmt.Fprintf(&sb, "shieldlevel=%s ", p.Shields)
+	}
+	if len(p.ShieldsLANRoutes) > 0 {
+		fmt.Fprintf(&sb, "shieldlan=%v ", p.ShieldsLANRoutes)
+	}
+	if p.Stealth {
+		sb.WriteString("stealth=true ")
+	}
 	if p.ExitNodeIP.IsValid() {
 		fmt.Fprintf(&sb, "exit=%v lan=%t ", p.ExitNodeIP, p.ExitNodeAllowLANAccess)
 	} else if !p.ExitNodeID.IsZero() {
 		fmt.Fprintf(&sb, "exit=%v lan=%t ", p.ExitNodeID, p.ExitNodeAllowLANAccess)
 	}
+	if len(p.ExitNodeRotation) > 0 {
+		if p.ExitNodeRotateEvery != 0 {
+			fmt.Fprintf(&sb, "exitrotate=%v@%v lan=%t ", p.ExitNodeRotation, p.ExitNodeRotateEvery, p.ExitNodeAllowLANAccess)
+		} else {
+			fmt.Fprintf(&sb, "exitrotate=%v lan=%t ", p.ExitNodeRotation, p.ExitNodeAllowLANAccess)
+		}
+	}
+	if len(p.ExitNodeExcludeRoutes) > 0 && (p.ExitNodeIP.IsValid() || !p.ExitNodeID.IsZero() || len(p.ExitNodeRotation) > 0) {
+		fmt.Fprintf(&sb, "exclude=%v ", p.ExitNodeExcludeRoutes)
+	}
 	if len(p.AdvertiseRoutes) > 0 || goos == "linux" {
 		fmt.Fprintf(&sb, "routes=%v ", p.AdvertiseRoutes)
 	}
@@ -329,12 +704,54 @@ func (p *Prefs) pretty(goos string) string {
 	if p.ControlURL != "" && p.ControlURL != DefaultControlURL {
 		fmt.Fprintf(&sb, "url=%q ", p.ControlURL)
 	}
+	if p.ControlProxy != "" {
+		fmt.Fprintf(&sb, "controlproxy=%s ", redactControlProxy(p.ControlProxy))
+	}
 	if p.Hostname != "" {
 		fmt.Fprintf(&sb, "host=%q ", p.Hostname)
 	}
 	if p.OperatorUser != "" {
 		fmt.Fprintf(&sb, "op=%q ", p.OperatorUser)
 	}
+	if p.MaxBandwidthKbps > 0 {
+		fmt.Fprintf(&sb, "maxbw=%dkbps ", p.MaxBandwidthKbps)
+	}
+	if p.MaxPeerBandwidthKbps > 0 {
+		fmt.Fprintf(&sb, "maxpeerbw=%dkbps ", p.MaxPeerBandwidthKbps)
+	}
+	if len(p.PinnedEndpoints) > 0 {
+		fmt.Fprintf(&sb, "pinned=%v ", p.PinnedEndpoints)
+	}
+	if len(p.TaildropRules) > 0 {
+		fmt.Fprintf(&sb, "taildrop=%v ", p.TaildropRules)
+	}
+	if p.FlowSampleRate > 0 && p.FlowCollector != "" {
+		fmt.Fprintf(&sb, "flows=1/%d@%s ", p.FlowSampleRate, p.FlowCollector)
+	}
+	if p.DSCPPassthrough != "" {
+		fmt.Fprintf(&sb, "dscp=%s ", p.DSCPPassthrough)
+	}
+	if p.MaintenanceWindow != "" {
+		fmt.Fprintf(&sb, "maint=%q ", p.MaintenanceWindow)
+	}
+	if p.LazyPeers {
+		sb.WriteString("lazy=true ")
+	}
+	if len(p.AlwaysOnPeers) > 0 {
+		fmt.Fprintf(&sb, "alwayson=%v ", p.AlwaysOnPeers)
+	}
+	if len(p.SystemDialRules) > 0 {
+		fmt.Fprintf(&sb, "dialrules=%v ", p.SystemDialRules)
+	}
+	if p.ExitNodeClientApproval {
+		sb.WriteString("exitapproval=true ")
+	}
+	if p.DiscoKeyRotation != 0 {
+		fmt.Fprintf(&sb, "discorotate=%v ", p.DiscoKeyRotation)
+	}
+	if len(p.EventHooks) > 0 {
+		fmt.Fprintf(&sb, "hooks=%v ", p.EventHooks)
+	}
 	if p.Persist != nil {
 		sb.WriteString(p.Persist.Pretty())
 	} else {
@@ -352,6 +769,24 @@ func (p *Prefs) ToBytes() []byte {
 	return data
 }
 
+// ETag returns an opaque version string for p that changes whenever any
+// user-visible pref changes. It's used to detect conflicting writers by
+// LocalBackend.EditPrefsIfMatch. The Persist field is ignored, as it's
+// modified by the backend itself, not by users.
+func (p *Prefs) ETag() string {
+	if p == nil {
+		return ""
+	}
+	p2 := *p
+	p2.Persist = nil
+	data, err := json.Marshal(&p2)
+	if err != nil {
+		log.Fatalf("Prefs marshal: %v\n", err)
+	}
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
 func (p *Prefs) Equals(p2 *Prefs) bool {
 	if p == nil && p2 == nil {
 		return true
@@ -362,24 +797,46 @@ func (p *Prefs) Equals(p2 *Prefs) bool {
 
 	return p != nil && p2 != nil &&
 		p.ControlURL == p2.ControlURL &&
+		p.ControlProxy == p2.ControlProxy &&
 		p.RouteAll == p2.RouteAll &&
 		p.AllowSingleHosts == p2.AllowSingleHosts &&
 		p.ExitNodeID == p2.ExitNodeID &&
 		p.ExitNodeIP == p2.ExitNodeIP &&
 		p.ExitNodeAllowLANAccess == p2.ExitNodeAllowLANAccess &&
 		p.CorpDNS == p2.CorpDNS &&
+		p.SyncHostsFile == p2.SyncHostsFile &&
 		p.RunSSH == p2.RunSSH &&
 		p.WantRunning == p2.WantRunning &&
 		p.LoggedOut == p2.LoggedOut &&
 		p.NotepadURLs == p2.NotepadURLs &&
 		p.ShieldsUp == p2.ShieldsUp &&
+		p.Shields == p2.Shields &&
+		compareIPNets(p.ShieldsLANRoutes, p2.ShieldsLANRoutes) &&
+		p.Stealth == p2.Stealth &&
 		p.NoSNAT == p2.NoSNAT &&
 		p.NetfilterMode == p2.NetfilterMode &&
 		p.OperatorUser == p2.OperatorUser &&
 		p.Hostname == p2.Hostname &&
 		p.ForceDaemon == p2.ForceDaemon &&
+		p.MaxBandwidthKbps == p2.MaxBandwidthKbps &&
+		p.MaxPeerBandwidthKbps == p2.MaxPeerBandwidthKbps &&
 		compareIPNets(p.AdvertiseRoutes, p2.AdvertiseRoutes) &&
+		compareIPNets(p.ExitNodeExcludeRoutes, p2.ExitNodeExcludeRoutes) &&
+		compareStrings(p.ExitNodeRotation, p2.ExitNodeRotation) &&
+		p.ExitNodeRotateEvery == p2.ExitNodeRotateEvery &&
 		compareStrings(p.AdvertiseTags, p2.AdvertiseTags) &&
+		comparePinnedEndpoints(p.PinnedEndpoints, p2.PinnedEndpoints) &&
+		compareTaildropRules(p.TaildropRules, p2.TaildropRules) &&
+		p.FlowSampleRate == p2.FlowSampleRate &&
+		p.FlowCollector == p2.FlowCollector &&
+		p.DSCPPassthrough == p2.DSCPPassthrough &&
+		p.MaintenanceWindow == p2.MaintenanceWindow &&
+		p.LazyPeers == p2.LazyPeers &&
+		compareStrings(p.AlwaysOnPeers, p2.AlwaysOnPeers) &&
+		compareDialRules(p.SystemDialRules, p2.SystemDialRules) &&
+		p.ExitNodeClientApproval == p2.ExitNodeClientApproval &&
+		p.DiscoKeyRotation == p2.DiscoKeyRotation &&
+		compareStrings(p.EventHooks, p2.EventHooks) &&
 		p.Persist.Equals(p2.Persist)
 }
 
@@ -395,6 +852,42 @@ func compareIPNets(a, b []netip.Prefix) bool {
 	return true
 }
 
+func comparePinnedEndpoints(a, b []PinnedEndpoint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func compareDialRules(a, b []DialRule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func compareTaildropRules(a, b []TaildropRule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func compareStrings(a, b []string) bool {
 	if len(a) != len(b) {
 		return false
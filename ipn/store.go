@@ -38,6 +38,11 @@
 	// NLKeyStateKey is the key under which we store the nodes'
 	// network-lock node key, in its key.NLPrivate.MarshalText representation.
 	NLKeyStateKey = StateKey("_nl-node-key")
+
+	// DiscoKeyStateKey is the key under which we store the disco key
+	// and when it was made, as JSON, when Prefs.DiscoKeyRotation is
+	// set.
+	DiscoKeyStateKey = StateKey("_discokey")
 )
 
 // StateStore persists state, and produces it back on request.
@@ -0,0 +1,249 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"tailscale.com/envknob"
+	"tailscale.com/ipn"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/winutil"
+)
+
+// encryptedStateMagic starts an encrypted state file. It's followed by
+// a random nonce and the XChaCha20-Poly1305 sealed JSON contents.
+const encryptedStateMagic = "tailscale-encrypted-state-v1\n"
+
+// encryptStatePolicy reports whether New should encrypt file stores,
+// as set by the EncryptState policy on Windows or by TS_ENCRYPT_STATE.
+func encryptStatePolicy() bool {
+	return envknob.Bool("TS_ENCRYPT_STATE") || winutil.GetPolicyInteger("EncryptState", 0) != 0
+}
+
+// getStateKey returns the 32-byte key for encrypting the state file at
+// path from the OS keystore. If create is true and there's no key yet,
+// it creates one if the OS keystore allows it. It's a variable for
+// tests.
+var getStateKey = stateKey
+
+// NewEncryptedFileStore returns a new file store that persists to
+// path, encrypted with a key held in the OS keystore, so that the
+// machine and node keys in it can't be read from a copy of the file.
+//
+// On Windows, the key is stored next to the file, protected by DPAPI
+// for the user tailscaled runs as. On Linux, the key is read from the
+// kernel keyring; since keyrings don't survive a reboot, it has to be
+// added to tailscaled's session or user keyring (as a "user" key
+// described "tailscaled:state") before tailscaled starts. Other
+// platforms aren't supported.
+//
+// An existing unencrypted file is encrypted in place.
+func NewEncryptedFileStore(logf logger.Logf, path string) (ipn.StateStore, error) {
+	aead, err := stateAEAD(path, true)
+	if err != nil {
+		return nil, fmt.Errorf("getting state encryption key: %w", err)
+	}
+	return openFileStore(logf, &FileStore{path: path, aead: aead})
+}
+
+// passphraseStateMagic starts a state file encrypted under a
+// passphrase. It's followed by the salt the key was derived with, a
+// random nonce and the XChaCha20-Poly1305 sealed JSON contents.
+const passphraseStateMagic = "tailscale-passphrase-state-v1\n"
+
+// passphraseSaltLen is the length of the salt in a state file
+// encrypted under a passphrase.
+const passphraseSaltLen = 16
+
+// NewPassphraseFileStore returns a new file store that persists to
+// path, encrypted with a key derived from passphrase. It's for
+// machines without an OS keystore for NewEncryptedFileStore to use,
+// where the passphrase is supplied each time tailscaled starts, so
+// that a copy of the disk doesn't yield the machine and node keys.
+//
+// An existing unencrypted file, or one encrypted with a key from the
+// OS keystore, is encrypted in place.
+func NewPassphraseFileStore(logf logger.Logf, path string, passphrase []byte) (ipn.StateStore, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty state passphrase")
+	}
+	// Keep the salt of an existing file, so that it isn't rewritten
+	// on every start.
+	var salt []byte
+	if bs, err := ioutil.ReadFile(path); err == nil {
+		if rest, ok := cutPrefix(bs, passphraseStateMagic); ok && len(rest) >= passphraseSaltLen {
+			salt = rest[:passphraseSaltLen]
+		}
+	}
+	if salt == nil {
+		salt = make([]byte, passphraseSaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+	}
+	aead, err := passphraseAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	return openFileStore(logf, &FileStore{path: path, aead: aead, passphrase: passphrase, salt: salt})
+}
+
+// passphraseAEAD returns the cipher for files encrypted under
+// passphrase with the given salt.
+func passphraseAEAD(passphrase, salt []byte) (cipher.AEAD, error) {
+	return chacha20poly1305.NewX(argon2.IDKey(passphrase, salt, 3, 64*1024, 4, chacha20poly1305.KeySize))
+}
+
+// header returns the start of s's file, before the nonce, or nil if
+// it isn't encrypted.
+func (s *FileStore) header() []byte {
+	switch {
+	case s.aead == nil:
+		return nil
+	case s.passphrase != nil:
+		return append([]byte(passphraseStateMagic), s.salt...)
+	default:
+		return []byte(encryptedStateMagic)
+	}
+}
+
+func stateAEAD(path string, create bool) (cipher.AEAD, error) {
+	key, err := getStateKey(path, create)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.NewX(key)
+}
+
+// encode returns the state file contents for the JSON bs, encrypting
+// it if s is encrypted.
+func (s *FileStore) encode(bs []byte) ([]byte, error) {
+	if s.aead == nil {
+		return bs, nil
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header := s.header()
+	out := append(append([]byte(nil), header...), nonce...)
+	return s.aead.Seal(out, nonce, bs, header), nil
+}
+
+// errStateEncrypted is returned by NewFileStore for an encrypted file,
+// which it won't silently write back unencrypted.
+var errStateEncrypted = errors.New("state file is encrypted; set TS_ENCRYPT_STATE (or the EncryptState policy) or give its passphrase to open it")
+
+// isEncrypted reports whether the state file contents bs are
+// encrypted, either way.
+func isEncrypted(bs []byte) bool {
+	return bytes.HasPrefix(bs, []byte(encryptedStateMagic)) || bytes.HasPrefix(bs, []byte(passphraseStateMagic))
+}
+
+// decode parses the state file contents bs, decrypting them if they're
+// encrypted. A store encrypted under a passphrase can also decode a
+// file encrypted with a key from the OS keystore, as long as the key
+// is still in the keystore. A file encrypted under a passphrase needs
+// s to have it. An unencrypted s can't decode encrypted files.
+func (s *FileStore) decode(bs []byte) (map[ipn.StateKey][]byte, error) {
+	if len(bs) == 0 {
+		return nil, errors.New("file empty")
+	}
+	if rest, ok := cutPrefix(bs, encryptedStateMagic); ok {
+		if s.aead == nil {
+			return nil, errStateEncrypted
+		}
+		aead := s.aead
+		if s.passphrase != nil {
+			var err error
+			if aead, err = stateAEAD(s.path, false); err != nil {
+				return nil, fmt.Errorf("file is encrypted and its key is unavailable: %w", err)
+			}
+		}
+		var err error
+		if bs, err = openSealed(aead, []byte(encryptedStateMagic), rest); err != nil {
+			return nil, err
+		}
+	} else if rest, ok := cutPrefix(bs, passphraseStateMagic); ok {
+		if s.passphrase == nil {
+			return nil, errors.New("file is encrypted under a passphrase and none was given")
+		}
+		if len(rest) < passphraseSaltLen {
+			return nil, errors.New("encrypted file truncated")
+		}
+		salt := rest[:passphraseSaltLen]
+		aead := s.aead
+		if !bytes.Equal(salt, s.salt) {
+			// An older generation, from before the file was
+			// last encrypted anew.
+			var err error
+			if aead, err = passphraseAEAD(s.passphrase, salt); err != nil {
+				return nil, err
+			}
+		}
+		var err error
+		if bs, err = openSealed(aead, bs[:len(passphraseStateMagic)+passphraseSaltLen], rest[passphraseSaltLen:]); err != nil {
+			return nil, err
+		}
+	}
+	var cache map[ipn.StateKey][]byte
+	if err := json.Unmarshal(bs, &cache); err != nil {
+		return nil, err
+	}
+	if cache == nil {
+		cache = map[ipn.StateKey][]byte{}
+	}
+	return cache, nil
+}
+
+// openSealed decrypts rest, the nonce and sealed contents of a state file
+// that starts with header.
+func openSealed(aead cipher.AEAD, header, rest []byte) ([]byte, error) {
+	if len(rest) < aead.NonceSize() {
+		return nil, errors.New("encrypted file truncated")
+	}
+	nonce, sealed := rest[:aead.NonceSize()], rest[aead.NonceSize():]
+	bs, err := aead.Open(nil, nonce, sealed, header)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting: %w", err)
+	}
+	return bs, nil
+}
+
+// encryptIfNeededLocked rewrites the state file if its contents, bs,
+// aren't encrypted the way s is. The old generations are removed too,
+// so no copies encrypted differently, or not at all, are left behind.
+// It does nothing if s isn't encrypted; newFileStore has already
+// refused to open an encrypted file unencrypted.
+func (s *FileStore) encryptIfNeededLocked(logf logger.Logf, bs []byte) error {
+	header := s.header()
+	if header == nil || bytes.HasPrefix(bs, header) {
+		return nil
+	}
+	logf("store.NewFileStore(%q): encrypting state file", s.path)
+	for n := 1; n <= numStateGenerations; n++ {
+		if err := os.Remove(generationPath(s.path, n)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return s.writeLocked()
+}
+
+func cutPrefix(b []byte, prefix string) (after []byte, found bool) {
+	if !bytes.HasPrefix(b, []byte(prefix)) {
+		return b, false
+	}
+	return b[len(prefix):], true
+}
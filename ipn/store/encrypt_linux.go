@@ -0,0 +1,48 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// stateKeyDescription is the description of the kernel keyring key
+// holding the state encryption key.
+const stateKeyDescription = "tailscaled:state"
+
+// stateKey returns the SHA-256 of the "user" key described
+// stateKeyDescription in the session or user keyring. The key can't be
+// created here, as it wouldn't survive a reboot; it has to be added,
+// for instance by "keyctl padd user tailscaled:state @u" from a
+// secret kept in a TPM, before tailscaled starts.
+func stateKey(path string, create bool) ([]byte, error) {
+	var id int
+	var err error
+	for _, ring := range []int{unix.KEY_SPEC_SESSION_KEYRING, unix.KEY_SPEC_USER_KEYRING} {
+		id, err = unix.KeyctlSearch(ring, "user", stateKeyDescription, 0)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("looking up %q in the kernel keyring: %w", stateKeyDescription, err)
+	}
+	buf := make([]byte, 4096)
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, buf, 0)
+	if err != nil {
+		return nil, fmt.Errorf("reading %q from the kernel keyring: %w", stateKeyDescription, err)
+	}
+	if n > len(buf) {
+		return nil, fmt.Errorf("key %q too long", stateKeyDescription)
+	}
+	if n < 32 {
+		return nil, fmt.Errorf("key %q is %d bytes; want at least 32", stateKeyDescription, n)
+	}
+	sum := sha256.Sum256(buf[:n])
+	return sum[:], nil
+}
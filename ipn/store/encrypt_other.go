@@ -0,0 +1,16 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !windows
+
+package store
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func stateKey(path string, create bool) ([]byte, error) {
+	return nil, fmt.Errorf("state encryption not supported on %s", runtime.GOOS)
+}
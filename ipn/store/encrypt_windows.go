@@ -0,0 +1,77 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"tailscale.com/atomicfile"
+)
+
+// stateKeyEntropy is the additional entropy used when protecting
+// state encryption keys with DPAPI, so that they can't be unprotected
+// by accident by other DPAPI users.
+var stateKeyEntropy = []byte("tailscaled state key")
+
+// stateKey returns the key for the state file at path, kept DPAPI
+// protected in path+".key". If create is true and the key file
+// doesn't exist, it generates a new key.
+func stateKey(path string, create bool) ([]byte, error) {
+	keyPath := path + ".key"
+	protected, err := ioutil.ReadFile(keyPath)
+	if os.IsNotExist(err) && create {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		protected, err := dpapi(true, key)
+		if err != nil {
+			return nil, fmt.Errorf("protecting key: %w", err)
+		}
+		if err := atomicfile.WriteFile(keyPath, protected, 0600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := dpapi(false, protected)
+	if err != nil {
+		return nil, fmt.Errorf("unprotecting key: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, errors.New("invalid key length")
+	}
+	return key, nil
+}
+
+// dpapi protects data with DPAPI, or unprotects it if protect is
+// false, for the current user and without UI.
+func dpapi(protect bool, data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("no data")
+	}
+	in := windows.DataBlob{Size: uint32(len(data)), Data: &data[0]}
+	entropy := windows.DataBlob{Size: uint32(len(stateKeyEntropy)), Data: &stateKeyEntropy[0]}
+	var out windows.DataBlob
+	var err error
+	if protect {
+		err = windows.CryptProtectData(&in, nil, &entropy, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out)
+	} else {
+		err = windows.CryptUnprotectData(&in, nil, &entropy, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(out.Data)))
+	return append([]byte(nil), unsafe.Slice(out.Data, out.Size)...), nil
+}
@@ -7,7 +7,11 @@
 
 import (
 	"bytes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -55,11 +59,23 @@ func registerDefaultStores() {
 //     the suffix an AWS ARN for an SSM.
 //   - (Linux-only) if the string begins with "kube:",
 //     the suffix is a Kubernetes secret name
-//   - In all other cases, the path is treated as a filepath.
+//   - In all other cases, the path is treated as a filepath. If
+//     the EncryptState policy or TS_ENCRYPT_STATE is set, the file
+//     is encrypted; see NewEncryptedFileStore.
 func New(logf logger.Logf, path string) (ipn.StateStore, error) {
+	return NewWithPassphrase(logf, path, nil)
+}
+
+// NewWithPassphrase is like New, but if passphrase is non-nil, the
+// state file is encrypted under it; see NewPassphraseFileStore. It's
+// an error to give a passphrase for a path that isn't a file.
+func NewWithPassphrase(logf logger.Logf, path string, passphrase []byte) (ipn.StateStore, error) {
 	regOnce.Do(registerDefaultStores)
 	for prefix, sf := range knownStores {
 		if strings.HasPrefix(path, prefix) {
+			if passphrase != nil {
+				return nil, fmt.Errorf("a state passphrase can't be used with %q state", prefix)
+			}
 			// We can't strip the prefix here as some NewStoreFunc (like arn:)
 			// expect the prefix.
 			return sf(logf, path)
@@ -68,6 +84,12 @@ func New(logf logger.Logf, path string) (ipn.StateStore, error) {
 	if runtime.GOOS == "windows" {
 		path = TryWindowsAppDataMigration(logf, path)
 	}
+	if passphrase != nil {
+		return NewPassphraseFileStore(logf, path, passphrase)
+	}
+	if encryptStatePolicy() {
+		return NewEncryptedFileStore(logf, path)
+	}
 	return NewFileStore(logf, path)
 }
 
@@ -109,58 +131,123 @@ func TryWindowsAppDataMigration(logf logger.Logf, path string) string {
 }
 
 // FileStore is a StateStore that uses a JSON file for persistence.
+//
+// Each write also saves a copy of the file's new contents, with a
+// checksum, as the newest of numStateGenerations generations next to
+// it. If the state file is later found empty or corrupt, as happens
+// when a router loses power mid-write, NewFileStore rolls back to the
+// newest intact generation.
 type FileStore struct {
 	path string
+	aead cipher.AEAD // or nil if the file isn't encrypted
+
+	// For files encrypted under a passphrase, rather than with a key
+	// from the OS keystore, the passphrase and the salt its key was
+	// derived with.
+	passphrase []byte
+	salt       []byte
 
 	mu    sync.RWMutex
 	cache map[ipn.StateKey][]byte
 }
 
+// numStateGenerations is the number of generations of the state file
+// that FileStore keeps.
+const numStateGenerations = 3
+
 // Path returns the path that NewFileStore was called with.
 func (s *FileStore) Path() string { return s.path }
 
 func (s *FileStore) String() string { return fmt.Sprintf("FileStore(%q)", s.path) }
 
 // NewFileStore returns a new file store that persists to path.
+//
+// It returns an error if the file is encrypted, rather than writing
+// the state back unencrypted; use NewEncryptedFileStore or
+// NewPassphraseFileStore to open it.
 func NewFileStore(logf logger.Logf, path string) (ipn.StateStore, error) {
+	return openFileStore(logf, &FileStore{path: path})
+}
+
+// openFileStore is newFileStore for the exported constructors, which
+// return an ipn.StateStore: it returns a nil interface, not a nil
+// *FileStore, on error.
+func openFileStore(logf logger.Logf, fs *FileStore) (ipn.StateStore, error) {
+	fs, err := newFileStore(logf, fs)
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// newFileStore loads the file store ret, which has its path and
+// encryption fields set, from its file.
+func newFileStore(logf logger.Logf, ret *FileStore) (*FileStore, error) {
+	path := ret.path
 	// We unconditionally call this to ensure that our perms are correct
 	if err := paths.MkStateDir(filepath.Dir(path)); err != nil {
 		return nil, fmt.Errorf("creating state directory: %w", err)
 	}
 
+	ret.cache = map[ipn.StateKey][]byte{}
 	bs, err := ioutil.ReadFile(path)
-
-	// Treat an empty file as a missing file.
-	// (https://github.com/tailscale/tailscale/issues/895#issuecomment-723255589)
-	if err == nil && len(bs) == 0 {
-		logf("store.NewFileStore(%q): file empty; treating it like a missing file [warning]", path)
-		err = os.ErrNotExist
+	if os.IsNotExist(err) {
+		// Write out an initial file, to verify that we can write
+		// to the path.
+		if err := ret.writeLocked(); err != nil {
+			return nil, err
+		}
+		return ret, nil
 	}
-
 	if err != nil {
-		if os.IsNotExist(err) {
-			// Write out an initial file, to verify that we can write
-			// to the path.
-			if err = atomicfile.WriteFile(path, []byte("{}"), 0600); err != nil {
-				return nil, err
-			}
-			return &FileStore{
-				path:  path,
-				cache: map[ipn.StateKey][]byte{},
-			}, nil
-		}
 		return nil, err
 	}
 
-	ret := &FileStore{
-		path:  path,
-		cache: map[ipn.StateKey][]byte{},
+	if ret.aead == nil && isEncrypted(bs) {
+		return nil, errStateEncrypted
 	}
-	if err := json.Unmarshal(bs, &ret.cache); err != nil {
-		return nil, err
+	cache, err := ret.decode(bs)
+	if err == nil {
+		ret.cache = cache
+		if err := ret.encryptIfNeededLocked(logf, bs); err != nil {
+			return nil, err
+		}
+		return ret, nil
+	}
+
+	for n := 1; n <= numStateGenerations; n++ {
+		gbs, gerr := readStateGeneration(path, n)
+		var cache map[ipn.StateKey][]byte
+		if gerr == nil {
+			cache, gerr = ret.decode(gbs)
+		}
+		if gerr != nil {
+			if !os.IsNotExist(gerr) {
+				logf("store.NewFileStore(%q): generation %d: %v", path, n, gerr)
+			}
+			continue
+		}
+		logf("store.NewFileStore(%q): %v; rolling back to generation %d [warning]", path, err, n)
+		if err := atomicfile.WriteFile(path, gbs, 0600); err != nil {
+			return nil, err
+		}
+		ret.cache = cache
+		if err := ret.encryptIfNeededLocked(logf, gbs); err != nil {
+			return nil, err
+		}
+		return ret, nil
 	}
 
-	return ret, nil
+	// Treat an empty file as a missing file.
+	// (https://github.com/tailscale/tailscale/issues/895#issuecomment-723255589)
+	if len(bs) == 0 {
+		logf("store.NewFileStore(%q): file empty; treating it like a missing file [warning]", path)
+		if err := ret.writeLocked(); err != nil {
+			return nil, err
+		}
+		return ret, nil
+	}
+	return nil, err
 }
 
 // ReadState implements the StateStore interface.
@@ -182,9 +269,69 @@ func (s *FileStore) WriteState(id ipn.StateKey, bs []byte) error {
 		return nil
 	}
 	s.cache[id] = append([]byte(nil), bs...)
+	return s.writeLocked()
+}
+
+// writeLocked writes s.cache to the state file and saves it as the
+// newest generation.
+func (s *FileStore) writeLocked() error {
 	bs, err := json.MarshalIndent(s.cache, "", "  ")
 	if err != nil {
 		return err
 	}
+	if bs, err = s.encode(bs); err != nil {
+		return err
+	}
+	if err := writeStateGeneration(s.path, bs); err != nil {
+		return fmt.Errorf("saving state generation: %w", err)
+	}
 	return atomicfile.WriteFile(s.path, bs, 0600)
 }
+
+// generationPath returns the path of generation n of the state file
+// at path. Generation 1 is the newest.
+func generationPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// generationChecksumPrefix starts the first line of a generation
+// file, which is followed by the hex SHA-256 of the rest of the file.
+const generationChecksumPrefix = "sha256:"
+
+// writeStateGeneration shifts the existing generations of the state
+// file at path back by one, dropping the oldest, and saves bs as the
+// newest.
+func writeStateGeneration(path string, bs []byte) error {
+	for n := numStateGenerations - 1; n > 0; n-- {
+		err := os.Rename(generationPath(path, n), generationPath(path, n+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	sum := sha256.Sum256(bs)
+	var buf bytes.Buffer
+	buf.WriteString(generationChecksumPrefix)
+	buf.WriteString(hex.EncodeToString(sum[:]))
+	buf.WriteByte('\n')
+	buf.Write(bs)
+	return atomicfile.WriteFile(generationPath(path, 1), buf.Bytes(), 0600)
+}
+
+// readStateGeneration reads generation n of the state file at path,
+// returning the contents as they'd appear in the state file. It
+// returns an error if the generation is missing or fails its checksum.
+func readStateGeneration(path string, n int) ([]byte, error) {
+	b, err := ioutil.ReadFile(generationPath(path, n))
+	if err != nil {
+		return nil, err
+	}
+	line, bs, ok := bytes.Cut(b, []byte("\n"))
+	if !ok || !bytes.HasPrefix(line, []byte(generationChecksumPrefix)) {
+		return nil, errors.New("missing checksum")
+	}
+	sum := sha256.Sum256(bs)
+	if string(line[len(generationChecksumPrefix):]) != hex.EncodeToString(sum[:]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return bs, nil
+}
@@ -5,6 +5,8 @@
 package store
 
 import (
+	"bytes"
+	"os"
 	"path/filepath"
 	"testing"
 
@@ -178,3 +180,220 @@ func TestFileStore(t *testing.T) {
 		}
 	}
 }
+
+func TestFileStoreGenerations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tailscaled.state")
+	store, err := NewFileStore(t.Logf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"v1", "v2", "v3", "v4"} {
+		if err := store.WriteState("foo", []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(generationPath(path, numStateGenerations+1)); !os.IsNotExist(err) {
+		t.Errorf("got generation %d; want at most %d", numStateGenerations+1, numStateGenerations)
+	}
+
+	checkFoo := func(want string) {
+		t.Helper()
+		store, err := NewFileStore(t.Logf, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := store.ReadState("foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("foo = %q; want %q", got, want)
+		}
+	}
+
+	// A truncated state file rolls back to the newest generation,
+	// which has the same contents.
+	truncate := func() {
+		t.Helper()
+		bs, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, bs[:len(bs)/2], 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	truncate()
+	checkFoo("v4")
+
+	// So does an empty one.
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	checkFoo("v4")
+
+	// A generation that fails its checksum is skipped.
+	gen1 := generationPath(path, 1)
+	bs, err := os.ReadFile(gen1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs[len(bs)-3] ^= 1
+	if err := os.WriteFile(gen1, bs, 0600); err != nil {
+		t.Fatal(err)
+	}
+	truncate()
+	checkFoo("v3")
+}
+
+func TestEncryptedFileStore(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	oldGetStateKey := getStateKey
+	t.Cleanup(func() { getStateKey = oldGetStateKey })
+	getStateKey = func(string, bool) ([]byte, error) { return key, nil }
+
+	path := filepath.Join(t.TempDir(), "tailscaled.state")
+	plain, err := NewFileStore(t.Logf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.WriteState("orig", []byte("secret-orig")); err != nil {
+		t.Fatal(err)
+	}
+
+	checkNoPlaintext := func() {
+		t.Helper()
+		for _, f := range []string{path, generationPath(path, 1), generationPath(path, 2)} {
+			bs, err := os.ReadFile(f)
+			if err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			if bytes.Contains(bs, []byte("secret")) || bytes.Contains(bs, []byte("c2VjcmV0")) {
+				t.Errorf("%s contains plaintext", f)
+			}
+		}
+	}
+
+	// Opening an unencrypted file encrypts it, along with its
+	// generations.
+	store, err := NewEncryptedFileStore(t.Logf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNoPlaintext()
+	testStoreSemantics(t, store)
+	if err := store.WriteState("bar", []byte("secret-bar")); err != nil {
+		t.Fatal(err)
+	}
+	checkNoPlaintext()
+
+	// It can be reopened while the key is available.
+	store, err = NewEncryptedFileStore(t.Logf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.ReadState("bar"); err != nil || string(got) != "secret-bar" {
+		t.Errorf("bar = %q, %v; want secret-bar", got, err)
+	}
+
+	// A plain FileStore refuses it, rather than writing it back
+	// unencrypted.
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store, err := NewFileStore(t.Logf, path); err == nil || store != nil {
+		t.Errorf("NewFileStore of encrypted file = %v, %v; want nil store and an error", store, err)
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(before, after) {
+		t.Error("NewFileStore rewrote the encrypted file")
+	}
+	checkNoPlaintext()
+
+	// With the wrong key, opening fails with a nil store.
+	key = bytes.Repeat([]byte{2}, 32)
+	if store, err := NewEncryptedFileStore(t.Logf, path); err == nil || store != nil {
+		t.Errorf("NewEncryptedFileStore with the wrong key = %v, %v; want nil store and an error", store, err)
+	}
+}
+
+func TestPassphraseFileStore(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	oldGetStateKey := getStateKey
+	t.Cleanup(func() { getStateKey = oldGetStateKey })
+	getStateKey = func(string, bool) ([]byte, error) { return key, nil }
+
+	path := filepath.Join(t.TempDir(), "tailscaled.state")
+	checkNoPlaintext := func() {
+		t.Helper()
+		for _, f := range []string{path, generationPath(path, 1), generationPath(path, 2)} {
+			bs, err := os.ReadFile(f)
+			if err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			if bytes.Contains(bs, []byte("secret")) || bytes.Contains(bs, []byte("c2VjcmV0")) {
+				t.Errorf("%s contains plaintext", f)
+			}
+		}
+	}
+	pass := []byte("correct horse battery staple")
+
+	// A file encrypted with a key from the OS keystore is
+	// re-encrypted under the passphrase.
+	ks, err := NewEncryptedFileStore(t.Logf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.WriteState("foo", []byte("secret-foo")); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewPassphraseFileStore(t.Logf, path, pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.ReadState("foo"); err != nil || string(got) != "secret-foo" {
+		t.Errorf("foo = %q, %v; want secret-foo", got, err)
+	}
+	if err := store.WriteState("bar", []byte("secret-bar")); err != nil {
+		t.Fatal(err)
+	}
+	checkNoPlaintext()
+
+	// Reopening it keeps the salt, so the file isn't rewritten.
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err = NewPassphraseFileStore(t.Logf, path, pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.ReadState("bar"); err != nil || string(got) != "secret-bar" {
+		t.Errorf("bar = %q, %v; want secret-bar", got, err)
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(before, after) {
+		t.Error("reopening rewrote the state file")
+	}
+
+	// It can't be opened without the passphrase, or with the wrong one.
+	if _, err := NewFileStore(t.Logf, path); err == nil {
+		t.Error("opened passphrase store without a passphrase")
+	}
+	if _, err := NewEncryptedFileStore(t.Logf, path); err == nil {
+		t.Error("opened passphrase store with the keystore key")
+	}
+	if _, err := NewPassphraseFileStore(t.Logf, path, []byte("wrong")); err == nil {
+		t.Error("opened passphrase store with the wrong passphrase")
+	}
+	if _, err := NewPassphraseFileStore(t.Logf, path, nil); err == nil {
+		t.Error("opened passphrase store with an empty passphrase")
+	}
+
+	// Passphrases only go with state files.
+	if _, err := NewWithPassphrase(t.Logf, "mem:", pass); err == nil {
+		t.Error("NewWithPassphrase(mem:) succeeded")
+	}
+	if _, err := NewWithPassphrase(t.Logf, path, pass); err != nil {
+		t.Errorf("NewWithPassphrase(%q): %v", path, err)
+	}
+}
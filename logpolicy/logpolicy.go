@@ -564,6 +564,14 @@ func New(collection string) *Policy {
 		}
 	}
 
+	// Optionally keep logs that fail to upload on disk, so logs from
+	// an outage aren't lost. It's next to the filch files, which are
+	// moved to tmpfs on NAS devices.
+	if mb, ok := envknob.LookupInt("TS_LOG_SPOOL_MB"); ok && mb > 0 {
+		conf.SpoolDir = filchPrefix + ".logspool"
+		conf.SpoolMaxSize = int64(mb) << 20
+	}
+
 	filchBuf, filchErr := filch.New(filchPrefix, filchOptions)
 	if filchBuf != nil {
 		conf.Buffer = filchBuf
@@ -76,6 +76,18 @@ type Config struct {
 	// being included in the logs. The sequence number is incremented for each
 	// log message sent, but is not peristed across process restarts.
 	IncludeProcSequence bool
+
+	// SpoolDir, if non-empty, is a directory where batches of logs
+	// that fail to upload are kept until they can be, including
+	// across restarts. While it holds any, new batches are added to
+	// it rather than uploaded, and uploads are retried with backoff,
+	// so logs keep being read from Buffer during outages instead of
+	// filling it.
+	SpoolDir string
+
+	// SpoolMaxSize is the most bytes kept in SpoolDir. Beyond it, the
+	// oldest batches are dropped. If zero, DefaultSpoolMaxSize is used.
+	SpoolMaxSize int64
 }
 
 func NewLogger(cfg Config, logf tslogger.Logf) *Logger {
@@ -138,6 +150,18 @@ func NewLogger(cfg Config, logf tslogger.Logf) *Logger {
 	if cfg.NewZstdEncoder != nil {
 		l.zstdEncoder = cfg.NewZstdEncoder()
 	}
+	if cfg.SpoolDir != "" {
+		maxSize := cfg.SpoolMaxSize
+		if maxSize <= 0 {
+			maxSize = DefaultSpoolMaxSize
+		}
+		sp, err := openSpool(cfg.SpoolDir, maxSize)
+		if err != nil {
+			fmt.Fprintf(l.stderr, "logtail: spool: %v\n", err)
+		} else {
+			l.spool = sp
+		}
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	l.uploadCancel = cancel
@@ -168,6 +192,7 @@ type Logger struct {
 	explainedRaw   bool
 	metricsDelta   func() string // or nil
 	privateID      PrivateID
+	spool          *spool // or nil; only accessed by uploading
 
 	procID              uint32
 	includeProcSequence bool
@@ -175,6 +200,9 @@ type Logger struct {
 	writeLock    sync.Mutex // guards increments of procSequence
 	procSequence uint64
 
+	componentLevelMu sync.Mutex                       // serializes SetComponentVerbosityLevel
+	componentLevel   atomic.Pointer[map[string]int64] // per-component overrides of stderrLevel, or nil
+
 	shutdownStart chan struct{} // closed when shutdown begins
 	shutdownDone  chan struct{} // closed when shutdown complete
 }
@@ -186,6 +214,59 @@ func (l *Logger) SetVerbosityLevel(level int) {
 	atomic.StoreInt64(&l.stderrLevel, int64(level))
 }
 
+// SetComponentVerbosityLevel controls the verbosity level written to
+// stderr for the messages of one component, overriding the level set
+// by SetVerbosityLevel. A component is a message prefix like
+// "magicsock" in "magicsock: ..." or "[v1] magicsock: ...". A negative
+// level removes the override.
+//
+// It only affects stderr; messages of all levels are still uploaded.
+func (l *Logger) SetComponentVerbosityLevel(component string, level int) {
+	l.componentLevelMu.Lock()
+	defer l.componentLevelMu.Unlock()
+	m := map[string]int64{}
+	if old := l.componentLevel.Load(); old != nil {
+		for k, v := range *old {
+			m[k] = v
+		}
+	}
+	if level < 0 {
+		delete(m, component)
+	} else {
+		m[component] = int64(level)
+	}
+	if len(m) == 0 {
+		l.componentLevel.Store(nil)
+		return
+	}
+	l.componentLevel.Store(&m)
+}
+
+// ComponentVerbosityLevels returns the per-component verbosity levels
+// set with SetComponentVerbosityLevel.
+func (l *Logger) ComponentVerbosityLevels() map[string]int {
+	ret := map[string]int{}
+	if m := l.componentLevel.Load(); m != nil {
+		for k, v := range *m {
+			ret[k] = int(v)
+		}
+	}
+	return ret
+}
+
+// stderrLevelFor returns the maximum verbosity level of buf, a message
+// with its level removed, to write to stderr.
+func (l *Logger) stderrLevelFor(buf []byte) int64 {
+	if m := l.componentLevel.Load(); m != nil {
+		if i := bytes.Index(buf, colonSpace); i > 0 {
+			if v, ok := (*m)[string(buf[:i])]; ok {
+				return v
+			}
+		}
+	}
+	return atomic.LoadInt64(&l.stderrLevel)
+}
+
 // SetLinkMonitor sets the optional the link monitor.
 //
 // It should not be changed concurrently with log writes and should
@@ -242,17 +323,30 @@ func (l *Logger) Close() {
 //
 // If the caller provides a DrainLogs channel, then unblock-drain-on-Write
 // is disabled, and it is up to the caller to trigger unblock the drain.
-func (l *Logger) drainBlock() (shuttingDown bool) {
+//
+// It reports whether drainPending should stop waiting for logs: when
+// shutting down, or when a spooled batch is due to be retried.
+func (l *Logger) drainBlock() (stop bool) {
+	var spoolRetry <-chan time.Time
+	if l.spool != nil && l.spool.len() > 0 {
+		t := time.NewTimer(time.Until(l.spool.retryAt))
+		defer t.Stop()
+		spoolRetry = t.C
+	}
 	if l.drainLogs == nil {
 		select {
 		case <-l.shutdownStart:
 			return true
+		case <-spoolRetry:
+			return true
 		case <-l.sent:
 		}
 	} else {
 		select {
 		case <-l.shutdownStart:
 			return true
+		case <-spoolRetry:
+			return true
 		case <-l.drainLogs:
 		}
 	}
@@ -325,6 +419,13 @@ func (l *Logger) uploading(ctx context.Context) {
 
 	scratch := make([]byte, 4096) // reusable buffer to write into
 	for {
+		if l.spool != nil && l.spool.due(time.Now()) {
+			l.uploadSpooled(ctx)
+			if l.spool.due(time.Now()) {
+				continue
+			}
+		}
+
 		body := l.drainPending(scratch)
 		origlen := -1 // sentinel value: uncompressed
 		// Don't attempt to compress tiny bodies; not worth the CPU cycles.
@@ -339,6 +440,11 @@ func (l *Logger) uploading(ctx context.Context) {
 			}
 		}
 
+		if l.spool != nil && l.spool.len() > 0 && len(body) > 0 {
+			// Keep batches in order behind the spooled ones.
+			l.spoolBatch(body, origlen)
+			body = nil
+		}
 		for len(body) > 0 {
 			select {
 			case <-ctx.Done():
@@ -346,6 +452,12 @@ func (l *Logger) uploading(ctx context.Context) {
 			default:
 			}
 			uploaded, err := l.upload(ctx, body, origlen)
+			if err != nil && !uploaded && l.spool != nil {
+				fmt.Fprintf(l.stderr, "logtail: upload: %v; spooling\n", err)
+				l.spoolBatch(body, origlen)
+				l.spool.noteUploadResult(time.Now(), err)
+				break
+			}
 			if err != nil {
 				if !l.internetUp() {
 					fmt.Fprintf(l.stderr, "logtail: internet down; waiting\n")
@@ -368,6 +480,39 @@ func (l *Logger) uploading(ctx context.Context) {
 	}
 }
 
+// spoolBatch adds a batch of logs, compressed from origlen bytes or -1
+// if uncompressed, to the spool.
+func (l *Logger) spoolBatch(body []byte, origlen int) {
+	dropped, err := l.spool.add(body, origlen)
+	if err != nil {
+		fmt.Fprintf(l.stderr, "logtail: spool: %v\n", err)
+	}
+	if dropped > 0 {
+		fmt.Fprintf(l.stderr, "logtail: spool full; dropped %d oldest batches\n", dropped)
+	}
+}
+
+// uploadSpooled tries once to upload the oldest spooled batch.
+func (l *Logger) uploadSpooled(ctx context.Context) {
+	body, origlen, err := l.spool.oldest()
+	if err != nil {
+		fmt.Fprintf(l.stderr, "logtail: spool: %v\n", err)
+		l.spool.removeOldest()
+		return
+	}
+	uploaded, err := l.upload(ctx, body, origlen)
+	if uploaded {
+		l.spool.removeOldest()
+	}
+	if err != nil && !uploaded {
+		fmt.Fprintf(l.stderr, "logtail: upload of spooled logs: %v\n", err)
+	}
+	if uploaded {
+		err = nil
+	}
+	l.spool.noteUploadResult(time.Now(), err)
+}
+
 func (l *Logger) internetUp() bool {
 	if l.linkMonitor == nil {
 		// No way to tell, so assume it is.
@@ -654,7 +799,7 @@ func (l *Logger) Write(buf []byte) (int, error) {
 		return 0, nil
 	}
 	level, buf := parseAndRemoveLogLevel(buf)
-	if l.stderr != nil && l.stderr != ioutil.Discard && int64(level) <= atomic.LoadInt64(&l.stderrLevel) {
+	if l.stderr != nil && l.stderr != ioutil.Discard && int64(level) <= l.stderrLevelFor(buf) {
 		if buf[len(buf)-1] == '\n' {
 			l.stderr.Write(buf)
 		} else {
@@ -678,6 +823,7 @@ func (l *Logger) Write(buf []byte) (int, error) {
 	v1           = []byte("[v1] ")
 	v2           = []byte("[v2] ")
 	vJSON        = []byte("[v\x00JSON]") // precedes log level '0'-'9' byte, then JSON value
+	colonSpace   = []byte(": ")
 )
 
 // level 0 is normal (or unknown) level; 1+ are increasingly verbose
@@ -12,6 +12,7 @@
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -241,6 +242,37 @@ func TestLoggerWriteLength(t *testing.T) {
 	}
 }
 
+func TestComponentVerbosityLevel(t *testing.T) {
+	var stderr bytes.Buffer
+	lg := &Logger{
+		timeNow: time.Now,
+		buffer:  NewMemoryBuffer(1024),
+		stderr:  &stderr,
+	}
+	lg.SetComponentVerbosityLevel("magicsock", 2)
+	lg.SetComponentVerbosityLevel("dns", 0)
+	lg.SetComponentVerbosityLevel("control", 1)
+	lg.SetComponentVerbosityLevel("control", -1)
+	if got, want := lg.ComponentVerbosityLevels(), map[string]int{"magicsock": 2, "dns": 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ComponentVerbosityLevels = %v; want %v", got, want)
+	}
+
+	for _, msg := range []string{
+		"[v1] magicsock: shown\n",
+		"magicsock: [v2] shown\n",
+		"[v1] dns: hidden\n",
+		"[v1] control: hidden\n",
+		"control: shown\n",
+		"[v1] magic: hidden\n",
+	} {
+		lg.Write([]byte(msg))
+	}
+	want := "magicsock: shown\nmagicsock: shown\ncontrol: shown\n"
+	if got := stderr.String(); got != want {
+		t.Errorf("stderr = %q; want %q", got, want)
+	}
+}
+
 func TestParseAndRemoveLogLevel(t *testing.T) {
 	tests := []struct {
 		log       string
@@ -0,0 +1,185 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logtail
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultSpoolMaxSize is the default Config.SpoolMaxSize.
+const DefaultSpoolMaxSize = 16 << 20
+
+// spoolMaxRetryDelay is the longest a spool waits between attempts to
+// upload its oldest batch.
+const spoolMaxRetryDelay = 30 * time.Second
+
+// spool is a directory of batches of logs that failed to upload,
+// kept until they can be, oldest first. Batches are in files named
+// "SEQ.json" if uncompressed, or "SEQ-ORIGLEN.zst" if compressed
+// from ORIGLEN bytes. Batches from earlier runs are kept.
+//
+// It's only used by the Logger's uploading goroutine, so needs no
+// locking.
+type spool struct {
+	dir     string
+	maxSize int64
+
+	files   []spoolFile // oldest first
+	size    int64       // sum of files' sizes
+	nextSeq uint64
+
+	failures int       // consecutive failures uploading the oldest batch
+	retryAt  time.Time // when to next try the oldest batch
+}
+
+type spoolFile struct {
+	name    string
+	seq     uint64
+	origlen int // -1 if uncompressed
+	size    int64
+}
+
+// parseSpoolName parses the name of a batch file.
+func parseSpoolName(name string) (seq uint64, origlen int, ok bool) {
+	base, ext, _ := strings.Cut(name, ".")
+	origlen = -1
+	switch ext {
+	case "json":
+	case "zst":
+		var ol string
+		if base, ol, ok = strings.Cut(base, "-"); !ok {
+			return 0, 0, false
+		}
+		n, err := strconv.Atoi(ol)
+		if err != nil || n < 0 {
+			return 0, 0, false
+		}
+		origlen = n
+	default:
+		return 0, 0, false
+	}
+	seq, err := strconv.ParseUint(base, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return seq, origlen, true
+}
+
+// openSpool opens the spool in dir, creating dir if needed, and
+// trims it to maxSize.
+func openSpool(dir string, maxSize int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &spool{dir: dir, maxSize: maxSize}
+	for _, de := range des {
+		seq, origlen, ok := parseSpoolName(de.Name())
+		if !ok || !de.Type().IsRegular() {
+			continue
+		}
+		fi, err := de.Info()
+		if err != nil {
+			continue
+		}
+		s.files = append(s.files, spoolFile{de.Name(), seq, origlen, fi.Size()})
+		s.size += fi.Size()
+		if seq >= s.nextSeq {
+			s.nextSeq = seq + 1
+		}
+	}
+	sort.Slice(s.files, func(i, j int) bool { return s.files[i].seq < s.files[j].seq })
+	s.trim()
+	return s, nil
+}
+
+// len returns the number of batches in s.
+func (s *spool) len() int { return len(s.files) }
+
+// add adds a batch, compressed from origlen bytes or -1 if
+// uncompressed, then drops the oldest batches until s fits in its
+// maximum size. It returns the number of batches dropped.
+func (s *spool) add(body []byte, origlen int) (dropped int, err error) {
+	if int64(len(body)) > s.maxSize {
+		return 1, nil
+	}
+	f := spoolFile{seq: s.nextSeq, origlen: origlen, size: int64(len(body))}
+	if origlen == -1 {
+		f.name = fmt.Sprintf("%020d.json", f.seq)
+	} else {
+		f.name = fmt.Sprintf("%020d-%d.zst", f.seq, origlen)
+	}
+	path := filepath.Join(s.dir, f.name)
+	if err := os.WriteFile(path+".tmp", body, 0600); err != nil {
+		os.Remove(path + ".tmp")
+		return 0, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return 0, err
+	}
+	s.nextSeq++
+	s.files = append(s.files, f)
+	s.size += f.size
+	return s.trim(), nil
+}
+
+// trim drops the oldest batches until s fits in its maximum size,
+// returning the number dropped.
+func (s *spool) trim() (dropped int) {
+	for s.size > s.maxSize && len(s.files) > 0 {
+		s.removeOldest()
+		dropped++
+	}
+	return dropped
+}
+
+// oldest returns the oldest batch and the length it was compressed
+// from, or -1 if uncompressed. s must not be empty.
+func (s *spool) oldest() (body []byte, origlen int, err error) {
+	f := s.files[0]
+	body, err = os.ReadFile(filepath.Join(s.dir, f.name))
+	return body, f.origlen, err
+}
+
+// removeOldest removes the oldest batch.
+func (s *spool) removeOldest() {
+	f := s.files[0]
+	os.Remove(filepath.Join(s.dir, f.name))
+	s.files = s.files[1:]
+	s.size -= f.size
+}
+
+// due reports whether it's time to try uploading the oldest batch.
+func (s *spool) due(now time.Time) bool {
+	return len(s.files) > 0 && !now.Before(s.retryAt)
+}
+
+// noteUploadResult records the result of trying to upload the oldest
+// batch at time now. Failures back off like backoff.Backoff, but by
+// scheduling the next attempt rather than sleeping, so that new logs
+// are spooled meanwhile instead of dropped.
+func (s *spool) noteUploadResult(now time.Time, err error) {
+	if err == nil {
+		s.failures = 0
+		s.retryAt = time.Time{}
+		return
+	}
+	s.failures++
+	d := time.Duration(s.failures*s.failures) * 10 * time.Millisecond
+	if d > spoolMaxRetryDelay || d <= 0 {
+		d = spoolMaxRetryDelay
+	}
+	s.retryAt = now.Add(d)
+}
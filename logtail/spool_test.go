@@ -0,0 +1,143 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logtail
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSpool(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSpool(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []string{"[1]", "[2]", "[3]"} {
+		if dropped, err := s.add([]byte(b), -1); err != nil || dropped != 0 {
+			t.Fatalf("add(%s) = %d, %v", b, dropped, err)
+		}
+	}
+	if dropped, err := s.add([]byte("zst4"), 100); err != nil || dropped != 1 {
+		t.Fatalf("add over max size = %d, %v; want 1 dropped", dropped, err)
+	}
+	if dropped, _ := s.add([]byte("this is too big"), -1); dropped != 1 {
+		t.Fatalf("add of batch bigger than max size dropped %d; want 1", dropped)
+	}
+
+	// Reopening finds the batches that are left, in order.
+	s, err = openSpool(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for s.len() > 0 {
+		body, origlen, err := s.oldest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%s/%d", body, origlen))
+		s.removeOldest()
+	}
+	if want := "[2]/-1 [3]/-1 zst4/100"; strings.Join(got, " ") != want {
+		t.Errorf("got batches %q; want %q", got, want)
+	}
+	if des, _ := os.ReadDir(dir); len(des) != 0 {
+		t.Errorf("spool dir has %d files left; want 0", len(des))
+	}
+}
+
+func TestSpoolRetry(t *testing.T) {
+	s := &spool{files: []spoolFile{{}}}
+	now := time.Now()
+	if !s.due(now) {
+		t.Fatal("not due initially")
+	}
+	s.noteUploadResult(now, fmt.Errorf("down"))
+	s.noteUploadResult(now, fmt.Errorf("down"))
+	if s.due(now) {
+		t.Error("due right after a failure")
+	}
+	if !s.due(now.Add(spoolMaxRetryDelay)) {
+		t.Error("not due after the max retry delay")
+	}
+	s.noteUploadResult(now, nil)
+	if !s.due(now) {
+		t.Error("not due after a success")
+	}
+}
+
+func TestSpoolDuringOutage(t *testing.T) {
+	var down atomic.Bool
+	down.Store(true)
+	var mu sync.Mutex
+	var uploaded strings.Builder
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		uploaded.Write(body)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	l := NewLogger(Config{
+		BaseURL:  srv.URL,
+		Buffer:   NewMemoryBuffer(2),
+		SpoolDir: dir,
+	}, t.Logf)
+	defer l.Shutdown(context.Background())
+
+	// Write more lines than the memory buffer holds, waiting for each
+	// to be read from it, as the outage continues.
+	const lines = 10
+	for i := 0; i < lines; i++ {
+		l.Write([]byte(fmt.Sprintf("line %d", i)))
+		for deadline := time.Now().Add(5 * time.Second); ; {
+			if b, _ := l.buffer.(*memBuffer); len(b.pending) == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("line %d not read from buffer during outage", i)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	down.Store(false)
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		mu.Lock()
+		got := uploaded.String()
+		mu.Unlock()
+		if strings.Contains(got, fmt.Sprintf("line %d", lines-1)) {
+			last := -1
+			for i := 0; i < lines; i++ {
+				j := strings.Index(got, fmt.Sprintf("line %d\"", i))
+				if j < last {
+					t.Fatalf("line %d missing or out of order in %s", i, got)
+				}
+				last = j
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for spooled logs; got %s", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -44,6 +44,13 @@ type Config struct {
 	// OnlyIPv6, if true, uses the IPv6 service IP (for MagicDNS)
 	// instead of the IPv4 version (100.100.100.100).
 	OnlyIPv6 bool
+	// ViaRoutes maps the lowercase first label of subnet routers'
+	// names to the 4via6 routes they serve, for resolving
+	// "<IPv4>.via-<router>" names.
+	ViaRoutes map[string][]netip.Prefix
+	// SyncHostsFile, if true, writes Hosts to a section of the OS's
+	// hosts file, for software that doesn't use the OS resolver.
+	SyncHostsFile bool
 }
 
 func (c *Config) serviceIP() netip.Addr {
@@ -64,6 +71,9 @@ func (c *Config) WriteToBufioWriter(w *bufio.Writer) {
 
 	fmt.Fprintf(w, " SearchDomains:%v", c.SearchDomains)
 	fmt.Fprintf(w, " Hosts:%v", len(c.Hosts))
+	if c.SyncHostsFile {
+		w.WriteString(" SyncHostsFile")
+	}
 	w.WriteString("}")
 }
 
@@ -0,0 +1,162 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+
+	"tailscale.com/atomicfile"
+	"tailscale.com/util/dnsname"
+)
+
+// setTailscaleHosts returns prevHostsFile with its Tailscale section
+// replaced by one containing hosts, or removed if hosts is empty.
+// Lines outside the section are kept byte for byte, including their
+// whitespace, except that on Windows their line endings are normalized
+// to CRLF.
+func setTailscaleHosts(prevHostsFile []byte, hosts []*HostEntry) ([]byte, error) {
+	const (
+		header = "# TailscaleHostsSectionStart"
+		footer = "# TailscaleHostsSectionEnd"
+	)
+	var comments = []string{
+		"# This section contains MagicDNS entries for Tailscale.",
+		"# Do not edit this section manually.",
+	}
+	nl := "\n"
+	if runtime.GOOS == "windows" {
+		nl = "\r\n"
+	}
+	var out bytes.Buffer
+	var inSection bool
+	for rest := prevHostsFile; len(rest) > 0; {
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line, rest = rest[:i+1], rest[i+1:]
+		} else {
+			rest = nil
+		}
+		switch string(bytes.TrimSpace(line)) {
+		case header:
+			inSection = true
+			continue
+		case footer:
+			inSection = false
+			continue
+		}
+		if inSection {
+			continue
+		}
+		if nl == "\r\n" && bytes.HasSuffix(line, []byte("\n")) && !bytes.HasSuffix(line, []byte("\r\n")) {
+			out.Write(line[:len(line)-1])
+			out.WriteString(nl)
+			continue
+		}
+		out.Write(line)
+	}
+	if len(hosts) > 0 {
+		if out.Len() > 0 && !bytes.HasSuffix(out.Bytes(), []byte("\n")) {
+			out.WriteString(nl)
+		}
+		out.WriteString(header + nl)
+		for _, c := range comments {
+			out.WriteString(c + nl)
+		}
+		out.WriteString(nl)
+		for _, he := range hosts {
+			fmt.Fprintf(&out, "%s %s%s", he.Addr, strings.Join(he.Hosts, " "), nl)
+		}
+		out.WriteString(nl)
+		out.WriteString(footer + nl)
+	}
+	return out.Bytes(), nil
+}
+
+// setHostsFile sets the Tailscale section of the OS's hosts file to
+// contain the given host entries, leaving the rest of the file alone.
+// The file isn't rewritten if it wouldn't change.
+func setHostsFile(hosts []*HostEntry) error {
+	path, err := hostsFilePath()
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	outB, err := setTailscaleHosts(b, hosts)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(b, outB) {
+		return nil
+	}
+	return writeHostsFile(path, outB)
+}
+
+// atomicWriteFile is atomicfile.WriteFile. It's a variable for tests.
+var atomicWriteFile = atomicfile.WriteFile
+
+// writeHostsFile replaces the contents of the hosts file at path with
+// b, keeping its permissions. It writes a new file and renames it into
+// place if it can. If it can't, as when the hosts file is a bind mount
+// (as it is in most containers), which can't be renamed over, it
+// writes the file in place instead.
+func writeHostsFile(path string, b []byte) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	err = atomicWriteFile(path, b, fi.Mode().Perm())
+	if err == nil {
+		return nil
+	}
+	if werr := os.WriteFile(path, b, fi.Mode().Perm()); werr != nil {
+		return fmt.Errorf("%v; writing in place: %w", err, werr)
+	}
+	return nil
+}
+
+// hostsFileEntries returns the hosts file entries for cfg.Hosts: a
+// line per address, naming the host by its FQDN and, if it's directly
+// under one of cfg.SearchDomains, by its first label too. Unlike
+// compileHostEntries, it includes every host and writes names without
+// the trailing dot, which resolvers reading the hosts file don't
+// expect.
+func hostsFileEntries(cfg Config) []*HostEntry {
+	names := make([]dnsname.FQDN, 0, len(cfg.Hosts))
+	for h := range cfg.Hosts {
+		names = append(names, h)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+
+	var hosts []*HostEntry
+	didLabel := map[string]bool{}
+	for _, h := range names {
+		hostNames := []string{h.WithoutTrailingDot()}
+		for _, sd := range cfg.SearchDomains {
+			if !sd.Contains(h) || h.NumLabels() != sd.NumLabels()+1 {
+				continue
+			}
+			if label := dnsname.FirstLabel(string(h)); !didLabel[label] {
+				didLabel[label] = true
+				hostNames = append(hostNames, label)
+			}
+			break
+		}
+		for _, ip := range cfg.Hosts[h] {
+			if cfg.OnlyIPv6 && ip.Is4() {
+				continue
+			}
+			hosts = append(hosts, &HostEntry{Addr: ip, Hosts: hostNames})
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,22 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package dns
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// hostsFilePath returns the path of the OS's hosts file.
+func hostsFilePath() (string, error) {
+	switch runtime.GOOS {
+	case "ios", "android", "js":
+		return "", fmt.Errorf("no writable hosts file on %s", runtime.GOOS)
+	}
+	return "/etc/hosts", nil
+}
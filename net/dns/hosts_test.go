@@ -0,0 +1,126 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+
+	"tailscale.com/util/dnsname"
+)
+
+func TestHostsFileEntries(t *testing.T) {
+	cfg := Config{
+		SearchDomains: fqdns("tail-scale.ts.net."),
+		Hosts: map[dnsname.FQDN][]netip.Addr{
+			"b.tail-scale.ts.net.":    {netip.MustParseAddr("100.64.0.2"), netip.MustParseAddr("fd7a:115c:a1e0::2")},
+			"a.tail-scale.ts.net.":    {netip.MustParseAddr("100.64.0.1")},
+			"a.other.tail-scale.com.": {netip.MustParseAddr("100.64.0.3")},
+		},
+	}
+	var got []string
+	for _, he := range hostsFileEntries(cfg) {
+		got = append(got, fmt.Sprintf("%v %s", he.Addr, strings.Join(he.Hosts, " ")))
+	}
+	want := []string{
+		"100.64.0.3 a.other.tail-scale.com",
+		"100.64.0.1 a.tail-scale.ts.net a",
+		"100.64.0.2 b.tail-scale.ts.net b",
+		"fd7a:115c:a1e0::2 b.tail-scale.ts.net b",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestSetTailscaleHosts(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hosts file uses CRLF line endings on Windows")
+	}
+	const orig = "127.0.0.1 localhost\n::1 localhost\n"
+	hosts := []*HostEntry{{Addr: netip.MustParseAddr("100.64.0.1"), Hosts: []string{"a.tail-scale.ts.net", "a"}}}
+	got, err := setTailscaleHosts([]byte(orig), hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(got), orig) || !strings.Contains(string(got), "\n100.64.0.1 a.tail-scale.ts.net a\n") {
+		t.Errorf("got %q; want original contents then entries", got)
+	}
+	got, err = setTailscaleHosts(got, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != orig {
+		t.Errorf("after removing entries, got %q; want %q", got, orig)
+	}
+}
+
+func TestSetTailscaleHostsPreservesLines(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hosts file uses CRLF line endings on Windows")
+	}
+	hosts := []*HostEntry{{Addr: netip.MustParseAddr("100.64.0.1"), Hosts: []string{"a"}}}
+	tests := []string{
+		"",
+		"  127.0.0.1\tlocalhost  \n",
+		"127.0.0.1 localhost\r\n# comment \t\r\n",
+		"127.0.0.1 localhost\n\n\n",
+		"127.0.0.1 localhost", // no final newline
+	}
+	for _, orig := range tests {
+		got, err := setTailscaleHosts([]byte(orig), hosts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(got), orig) {
+			t.Errorf("with entries, got %q; want it to start with %q", got, orig)
+		}
+		got, err = setTailscaleHosts(got, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := orig
+		if want != "" && !strings.HasSuffix(want, "\n") {
+			want += "\n"
+		}
+		if string(got) != want {
+			t.Errorf("after removing entries, got %q; want %q", got, want)
+		}
+		// Removing entries from a file without any leaves it as is.
+		got, err = setTailscaleHosts([]byte(orig), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != orig {
+			t.Errorf("without entries, got %q; want %q", got, orig)
+		}
+	}
+}
+
+func TestWriteHostsFileInPlace(t *testing.T) {
+	old := atomicWriteFile
+	t.Cleanup(func() { atomicWriteFile = old })
+	atomicWriteFile = func(string, []byte, os.FileMode) error {
+		// As renaming over a bind-mounted file fails.
+		return &os.LinkError{Op: "rename", Err: syscall.EBUSY}
+	}
+
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(path, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeHostsFile(path, []byte("new\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(path); err != nil || string(got) != "new\n" {
+		t.Errorf("hosts file = %q, %v; want %q", got, err, "new\n")
+	}
+}
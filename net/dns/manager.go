@@ -89,6 +89,11 @@ type Manager struct {
 
 	resolver *resolver.Resolver
 	os       OSConfigurator
+
+	// hostsFileSynced is whether the last Set wrote peers to the
+	// hosts file, so they need removing if hosts file syncing is
+	// turned off.
+	hostsFileSynced bool
 }
 
 // NewManagers created a new manager from the given config.
@@ -129,11 +134,28 @@ func (m *Manager) Set(cfg Config) error {
 	if err := m.resolver.SetConfig(rcfg); err != nil {
 		return err
 	}
+	// Clear the hosts file section before configuring the OS, as on
+	// Windows the OS configurator may write its own entries there.
+	if !cfg.SyncHostsFile && m.hostsFileSynced {
+		if err := setHostsFile(nil); err != nil {
+			m.logf("clearing hosts file: %v", err)
+		} else {
+			m.hostsFileSynced = false
+		}
+	}
 	if err := m.os.SetDNS(ocfg); err != nil {
 		health.SetDNSOSHealth(err)
 		return err
 	}
 	health.SetDNSOSHealth(nil)
+	if cfg.SyncHostsFile {
+		// Failing to sync the hosts file doesn't break MagicDNS for
+		// anything using the system resolver, so just log it.
+		m.hostsFileSynced = true
+		if err := setHostsFile(hostsFileEntries(cfg)); err != nil {
+			m.logf("syncing hosts file: %v", err)
+		}
+	}
 
 	return nil
 }
@@ -186,6 +208,7 @@ func (m *Manager) compileConfig(cfg Config) (rcfg resolver.Config, ocfg OSConfig
 	// authoritative suffixes, even if we don't propagate MagicDNS to
 	// the OS.
 	rcfg.Hosts = cfg.Hosts
+	rcfg.ViaRoutes = cfg.ViaRoutes
 	routes := map[dnsname.FQDN][]*dnstype.Resolver{} // assigned conditionally to rcfg.Routes below.
 	for suffix, resolvers := range cfg.Routes {
 		if len(resolvers) == 0 {
@@ -519,6 +542,12 @@ func (m *Manager) HandleTCPConn(conn net.Conn, srcAddr netip.AddrPort) {
 
 func (m *Manager) Down() error {
 	m.ctxCancel()
+	if m.hostsFileSynced {
+		if err := setHostsFile(nil); err != nil {
+			m.logf("clearing hosts file: %v", err)
+		}
+		m.hostsFileSynced = false
+	}
 	if err := m.os.Close(); err != nil {
 		return err
 	}
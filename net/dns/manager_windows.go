@@ -5,12 +5,9 @@
 package dns
 
 import (
-	"bufio"
-	"bytes"
 	"errors"
 	"fmt"
 	"net/netip"
-	"os"
 	"os/exec"
 	"path/filepath"
 	"sort"
@@ -21,7 +18,6 @@
 	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/registry"
 	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
-	"tailscale.com/atomicfile"
 	"tailscale.com/envknob"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/dnsname"
@@ -105,69 +101,18 @@ func (m windowsManager) setSplitDNS(resolvers []netip.Addr, domains []dnsname.FQ
 	return m.nrptDB.WriteSplitDNSConfig(servers, domains)
 }
 
-func setTailscaleHosts(prevHostsFile []byte, hosts []*HostEntry) ([]byte, error) {
-	b := bytes.ReplaceAll(prevHostsFile, []byte("\r\n"), []byte("\n"))
-	sc := bufio.NewScanner(bytes.NewReader(b))
-	const (
-		header = "# TailscaleHostsSectionStart"
-		footer = "# TailscaleHostsSectionEnd"
-	)
-	var comments = []string{
-		"# This section contains MagicDNS entries for Tailscale.",
-		"# Do not edit this section manually.",
-	}
-	var out bytes.Buffer
-	var inSection bool
-	for sc.Scan() {
-		line := strings.TrimSpace(sc.Text())
-		if line == header {
-			inSection = true
-			continue
-		}
-		if line == footer {
-			inSection = false
-			continue
-		}
-		if inSection {
-			continue
-		}
-		fmt.Fprintln(&out, line)
-	}
-	if err := sc.Err(); err != nil {
-		return nil, err
-	}
-	if len(hosts) > 0 {
-		fmt.Fprintln(&out, header)
-		for _, c := range comments {
-			fmt.Fprintln(&out, c)
-		}
-		fmt.Fprintln(&out)
-		for _, he := range hosts {
-			fmt.Fprintf(&out, "%s %s\n", he.Addr, strings.Join(he.Hosts, " "))
-		}
-		fmt.Fprintln(&out)
-		fmt.Fprintln(&out, footer)
+// hostsFilePath returns the path of the Windows hosts file.
+func hostsFilePath() (string, error) {
+	systemDir, err := windows.GetSystemDirectory()
+	if err != nil {
+		return "", err
 	}
-	return bytes.ReplaceAll(out.Bytes(), []byte("\n"), []byte("\r\n")), nil
+	return filepath.Join(systemDir, "drivers", "etc", "hosts"), nil
 }
 
 // setHosts sets the hosts file to contain the given host entries.
 func (m windowsManager) setHosts(hosts []*HostEntry) error {
-	systemDir, err := windows.GetSystemDirectory()
-	if err != nil {
-		return err
-	}
-	hostsFile := filepath.Join(systemDir, "drivers", "etc", "hosts")
-	b, err := os.ReadFile(hostsFile)
-	if err != nil {
-		return err
-	}
-	outB, err := setTailscaleHosts(b, hosts)
-	if err != nil {
-		return err
-	}
-	const fileMode = 0 // ignored on windows.
-	return atomicfile.WriteFile(hostsFile, outB, fileMode)
+	return setHostsFile(hosts)
 }
 
 // setPrimaryDNS sets the given resolvers and domains as the Tailscale
@@ -9,6 +9,7 @@
 import (
 	"bufio"
 	"context"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -74,6 +75,10 @@ type Config struct {
 	// LocalDomains is a list of DNS name suffixes that should not be
 	// routed to upstream resolvers.
 	LocalDomains []dnsname.FQDN
+	// ViaRoutes maps the lowercase first label of a subnet router's
+	// name to the 4via6 routes it serves, so that
+	// "<IPv4>.via-<router>" names resolve without knowing site IDs.
+	ViaRoutes map[string][]netip.Prefix
 }
 
 // WriteToBufioWriter write a debug version of c for logs to w, omitting
@@ -194,6 +199,7 @@ type Resolver struct {
 	mu           sync.Mutex
 	localDomains []dnsname.FQDN
 	hostToIP     map[dnsname.FQDN][]netip.Addr
+	viaRoutes    map[string][]netip.Prefix
 	ipToHost     map[netip.Addr]dnsname.FQDN
 }
 
@@ -244,6 +250,7 @@ func (r *Resolver) SetConfig(cfg Config) error {
 	r.localDomains = cfg.LocalDomains
 	r.hostToIP = cfg.Hosts
 	r.ipToHost = reverse
+	r.viaRoutes = cfg.ViaRoutes
 	return nil
 }
 
@@ -550,7 +557,9 @@ func (r *Resolver) resolveLocal(domain dnsname.FQDN, typ dns.Type) (netip.Addr,
 			return tsaddr.TailscaleServiceIPv6(), dns.RCodeSuccess
 		}
 	}
-	// Special-case: 'via-<siteid>.<ipv4>' queries.
+	// Special-case: 'via-<siteid>.<ipv4>' queries. Only AAAA
+	// records exist for them; for other types this is an empty
+	// success, rather than a lookup sent upstream.
 	if ip, ok := r.parseViaDomain(domain, typ); ok {
 		return ip, dns.RCodeSuccess
 	}
@@ -632,6 +641,12 @@ func (r *Resolver) resolveLocal(domain dnsname.FQDN, typ dns.Type) (netip.Addr,
 // parseViaDomain synthesizes an IP address for quad-A DNS requests of the form
 // `<IPv4-address>.via-<X>` and the deprecated form `via-<X>.<IPv4-address>`,
 // where X is a decimal, or hex-encoded number with a '0x' prefix.
+// In the first form, X may instead be the name of a subnet router
+// (see Config.ViaRoutes), which picks the site whose 4via6 route it
+// serves contains the address.
+//
+// It reports whether domain is such a name. For query types other than
+// AAAA, the returned address is the zero value.
 //
 // This exists as a convenient mapping into Tailscales 'Via Range'.
 //
@@ -641,9 +656,6 @@ func (r *Resolver) resolveLocal(domain dnsname.FQDN, typ dns.Type) (netip.Addr,
 // the old format in early 2023.
 func (r *Resolver) parseViaDomain(domain dnsname.FQDN, typ dns.Type) (netip.Addr, bool) {
 	fqdn := string(domain.WithoutTrailingDot())
-	if typ != dns.TypeAAAA {
-		return netip.Addr{}, false
-	}
 	if len(fqdn) < len("via-X.0.0.0.0") {
 		return netip.Addr{}, false // too short to be valid
 	}
@@ -675,9 +687,20 @@ func (r *Resolver) parseViaDomain(domain dnsname.FQDN, typ dns.Type) (netip.Addr
 		return netip.Addr{}, false // badly formed, dont respond
 	}
 
+	if !ip4.Is4() {
+		return netip.Addr{}, false
+	}
 	prefix, err := strconv.ParseUint(siteID, 0, 32)
 	if err != nil {
-		return netip.Addr{}, false // badly formed, dont respond
+		// Not a number; maybe a subnet router's name, in the
+		// non-deprecated form only.
+		if strings.HasPrefix(fqdn, "via-") {
+			return netip.Addr{}, false // badly formed, dont respond
+		}
+		return r.viaRouterAddr(strings.ToLower(siteID), ip4, typ)
+	}
+	if typ != dns.TypeAAAA {
+		return netip.Addr{}, true
 	}
 
 	// MapVia will never error when given an ipv4 netip.Prefix.
@@ -685,6 +708,28 @@ func (r *Resolver) parseViaDomain(domain dnsname.FQDN, typ dns.Type) (netip.Addr
 	return out.Addr(), true
 }
 
+// viaRouterAddr returns the 4via6 address for ip4 behind the subnet
+// router named router, if it serves a 4via6 route containing it, and
+// whether it does.
+func (r *Resolver) viaRouterAddr(router string, ip4 netip.Addr, typ dns.Type) (netip.Addr, bool) {
+	r.mu.Lock()
+	routes := r.viaRoutes[router]
+	r.mu.Unlock()
+	for _, via := range routes {
+		a := via.Addr().As16()
+		siteID := binary.BigEndian.Uint32(a[8:12])
+		out, err := tsaddr.MapVia(siteID, netip.PrefixFrom(ip4, ip4.BitLen()))
+		if err != nil || !via.Contains(out.Addr()) {
+			continue
+		}
+		if typ != dns.TypeAAAA {
+			return netip.Addr{}, true
+		}
+		return out.Addr(), true
+	}
+	return netip.Addr{}, false
+}
+
 // resolveReverse returns the unique domain name that maps to the given address.
 func (r *Resolver) resolveLocalReverse(name dnsname.FQDN) (dnsname.FQDN, dns.RCode) {
 	var ip netip.Addr
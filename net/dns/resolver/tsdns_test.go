@@ -27,6 +27,7 @@
 	"tailscale.com/net/netaddr"
 	"tailscale.com/net/tsdial"
 	"tailscale.com/tstest"
+	"tailscale.com/tstest/memtest"
 	"tailscale.com/types/dnstype"
 	"tailscale.com/util/dnsname"
 	"tailscale.com/wgengine/monitor"
@@ -48,6 +49,9 @@
 		"test2.ipn.dev.": {testipv6},
 	},
 	LocalDomains: []dnsname.FQDN{"ipn.dev.", "3.2.1.in-addr.arpa.", "1.0.0.0.ip6.arpa."},
+	ViaRoutes: map[string][]netip.Prefix{
+		"office": {netip.MustParsePrefix("fd7a:115c:a1e0:b1a:0:7:a00:0/120")}, // 10.0.0.0/24 at site 7
+	},
 }
 
 const noEdns = 0
@@ -350,6 +354,11 @@ func TestResolveLocal(t *testing.T) {
 		{"x_via_dec", dnsname.FQDN("1.0.0.10.via-1."), dns.TypeAAAA, netip.MustParseAddr("fd7a:115c:a1e0:b1a:0:1:1.0.0.10"), dns.RCodeSuccess},
 		{"via_invalid", dnsname.FQDN("via-."), dns.TypeAAAA, netip.Addr{}, dns.RCodeRefused},
 		{"via_invalid_2", dnsname.FQDN("2.3.4.5.via-."), dns.TypeAAAA, netip.Addr{}, dns.RCodeRefused},
+		{"via_a", dnsname.FQDN("1.0.0.10.via-1."), dns.TypeA, netip.Addr{}, dns.RCodeSuccess},
+		{"via_router", dnsname.FQDN("10.0.0.5.via-Office."), dns.TypeAAAA, netip.MustParseAddr("fd7a:115c:a1e0:b1a:0:7:10.0.0.5"), dns.RCodeSuccess},
+		{"via_router_a", dnsname.FQDN("10.0.0.5.via-office."), dns.TypeA, netip.Addr{}, dns.RCodeSuccess},
+		{"via_router_not_routed", dnsname.FQDN("10.0.1.5.via-office."), dns.TypeAAAA, netip.Addr{}, dns.RCodeRefused},
+		{"via_router_unknown", dnsname.FQDN("10.0.0.5.via-home."), dns.TypeAAAA, netip.Addr{}, dns.RCodeRefused},
 	}
 
 	for _, tt := range tests {
@@ -909,14 +918,14 @@ func TestAllocs(t *testing.T) {
 		{"reverse", dnspacket("4.3.2.1.in-addr.arpa.", dns.TypePTR, noEdns), 5},
 	}
 
+	var budgets []memtest.Budget
 	for _, tt := range tests {
-		err := tstest.MinAllocsPerRun(t, tt.want, func() {
+		tt := tt
+		budgets = append(budgets, memtest.Budget{Name: tt.name, Allocs: tt.want, Run: func() {
 			syncRespond(r, tt.query)
-		})
-		if err != nil {
-			t.Errorf("%s: %v", tt.name, err)
-		}
+		}})
 	}
+	memtest.Check(t, budgets)
 }
 
 func TestTrimRDNSBonjourPrefix(t *testing.T) {
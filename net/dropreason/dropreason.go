@@ -0,0 +1,85 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dropreason counts packets dropped by the data plane, by
+// why they were dropped.
+//
+// The counts are exported as client metrics named "packet_drop_"
+// followed by the reason, so "tailscale debug drops" and the metrics
+// endpoint can report them.
+package dropreason
+
+import "tailscale.com/util/clientmetric"
+
+// Reason is why a packet was dropped.
+type Reason uint8
+
+const (
+	// ACL means the packet filter rejected the packet.
+	ACL Reason = iota
+	// NoRoute means there was no path (direct, relayed or DERP) to
+	// the packet's destination peer.
+	NoRoute
+	// MTUExceeded means the packet was larger than the largest
+	// packet the TUN device handles.
+	MTUExceeded
+	// DecryptFailure means a received packet couldn't be opened
+	// with our key, for instance a disco message sealed for an
+	// older disco key.
+	DecryptFailure
+	// QueueOverflow means the queue the packet was to be sent on was
+	// full.
+	QueueOverflow
+	// TTLExceeded means the packet's TTL ran out at this node,
+	// acting as a router.
+	TTLExceeded
+	// RateLimited means the packet would have exceeded a configured
+	// bandwidth limit.
+	RateLimited
+
+	numReasons
+)
+
+var names = [numReasons]string{
+	ACL:            "acl",
+	NoRoute:        "no_route",
+	MTUExceeded:    "mtu_exceeded",
+	DecryptFailure: "decrypt_failure",
+	QueueOverflow:  "queue_overflow",
+	TTLExceeded:    "ttl_exceeded",
+	RateLimited:    "rate_limited",
+}
+
+// MetricPrefix is the prefix of the names of the client metrics that
+// count drops.
+const MetricPrefix = "packet_drop_"
+
+var counters = func() (m [numReasons]*clientmetric.Metric) {
+	for r, name := range names {
+		m[r] = clientmetric.NewCounter(MetricPrefix + name)
+	}
+	return m
+}()
+
+func (r Reason) String() string {
+	if r < numReasons {
+		return names[r]
+	}
+	return "unknown"
+}
+
+// Count records that a packet was dropped for reason r.
+func Count(r Reason) {
+	if r < numReasons {
+		counters[r].Add(1)
+	}
+}
+
+// Value returns the number of packets dropped for reason r.
+func Value(r Reason) int64 {
+	if r < numReasons {
+		return counters[r].Value()
+	}
+	return 0
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dscp contains policies for carrying the Differentiated
+// Services codepoints (DSCP, RFC 2474) of tunneled packets onto the
+// outer packets that carry them, so network QoS keeps applying to
+// traffic inside the tunnel.
+package dscp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Max is the largest DSCP value.
+const Max = 63
+
+// Policy is the set of inner codepoints that may be carried onto outer
+// packets, each with the codepoint to mark the outer packet with.
+type Policy struct {
+	s   string
+	out [Max + 1]int8 // outer codepoint for each inner one, or -1 if not allowed
+}
+
+// ParsePolicy parses a policy from s, a comma-separated list of
+// codepoints allowed through, such as "EF,AF41". An entry of the form
+// "inner=outer", such as "AF41=AF31", remarks the outer packet.
+// Codepoints are given as decimal numbers or by name: "EF", "CS0" to
+// "CS7", or "AF11" to "AF43".
+//
+// An empty s returns a nil Policy, which allows nothing.
+func ParsePolicy(s string) (*Policy, error) {
+	if s == "" {
+		return nil, nil
+	}
+	p := &Policy{s: s}
+	for i := range p.out {
+		p.out[i] = -1
+	}
+	for _, f := range strings.Split(s, ",") {
+		in, out, remark := strings.Cut(strings.TrimSpace(f), "=")
+		inv, err := Parse(in)
+		if err != nil {
+			return nil, err
+		}
+		outv := inv
+		if remark {
+			if outv, err = Parse(out); err != nil {
+				return nil, err
+			}
+		}
+		if p.out[inv] != -1 {
+			return nil, fmt.Errorf("DSCP %s listed more than once", in)
+		}
+		p.out[inv] = int8(outv)
+	}
+	return p, nil
+}
+
+// Parse parses a codepoint, either a decimal number or a name such as
+// "EF" or "AF41".
+func Parse(s string) (uint8, error) {
+	u := strings.ToUpper(s)
+	switch {
+	case u == "EF":
+		return 46, nil
+	case len(u) == 3 && strings.HasPrefix(u, "CS") && u[2] >= '0' && u[2] <= '7':
+		return (u[2] - '0') << 3, nil
+	case len(u) == 4 && strings.HasPrefix(u, "AF") && u[2] >= '1' && u[2] <= '4' && u[3] >= '1' && u[3] <= '3':
+		return (u[2]-'0')<<3 | (u[3]-'0')<<1, nil
+	}
+	v, err := strconv.ParseUint(s, 10, 8)
+	if err != nil || v > Max {
+		return 0, fmt.Errorf("invalid DSCP %q; want 0-%d, EF, CS0-CS7 or AF11-AF43", s, Max)
+	}
+	return uint8(v), nil
+}
+
+// Outer returns the codepoint to mark an outer packet with when it
+// carries a packet marked inner, and whether inner is allowed through
+// at all. A nil Policy allows nothing.
+func (p *Policy) Outer(inner uint8) (outer uint8, ok bool) {
+	if p == nil || inner > Max || p.out[inner] < 0 {
+		return 0, false
+	}
+	return uint8(p.out[inner]), true
+}
+
+// String returns the policy as it was parsed.
+func (p *Policy) String() string {
+	if p == nil {
+		return ""
+	}
+	return p.s
+}
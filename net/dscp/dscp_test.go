@@ -0,0 +1,72 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dscp
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    uint8
+		wantErr bool
+	}{
+		{in: "0", want: 0},
+		{in: "46", want: 46},
+		{in: "ef", want: 46},
+		{in: "CS5", want: 40},
+		{in: "AF41", want: 34},
+		{in: "af13", want: 14},
+		{in: "64", wantErr: true},
+		{in: "AF44", wantErr: true},
+		{in: "CS8", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Parse(%q) error = %v; want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q) = %d; want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	p, err := ParsePolicy("EF, AF41=AF31, 0=CS1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		inner  uint8
+		want   uint8
+		wantOK bool
+	}{
+		{46, 46, true},
+		{34, 26, true},
+		{0, 8, true},
+		{26, 0, false},
+		{200, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := p.Outer(tt.inner)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("Outer(%d) = %d, %v; want %d, %v", tt.inner, got, ok, tt.want, tt.wantOK)
+		}
+	}
+
+	if _, ok := (*Policy)(nil).Outer(46); ok {
+		t.Errorf("nil Policy allowed EF")
+	}
+	if p, err := ParsePolicy(""); p != nil || err != nil {
+		t.Errorf("ParsePolicy(\"\") = %v, %v; want nil, nil", p, err)
+	}
+	for _, bad := range []string{"EF,EF", "EF=", "bogus", "EF,"} {
+		if _, err := ParsePolicy(bad); err == nil {
+			t.Errorf("ParsePolicy(%q) succeeded; want error", bad)
+		}
+	}
+}
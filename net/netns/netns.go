@@ -16,9 +16,12 @@
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"net/netip"
+	"runtime"
 	"sync/atomic"
+	"syscall"
 
 	"tailscale.com/net/netknob"
 	"tailscale.com/types/logger"
@@ -67,6 +70,30 @@ func FromDialer(logf logger.Logf, d *net.Dialer) Dialer {
 	return d
 }
 
+// bindToInterface, if non-nil, binds c to the network interface
+// named ifName. It's set on platforms that support it.
+var bindToInterface func(c syscall.RawConn, network, ifName string) error
+
+// NewDialerForInterface is like NewDialer, but its connections go out
+// of the network interface named ifName rather than the default
+// route's. It's for multi-homed hosts where the default route isn't
+// the way to some destinations.
+func NewDialerForInterface(logf logger.Logf, ifName string) (Dialer, error) {
+	if bindToInterface == nil {
+		return nil, fmt.Errorf("binding to an interface is not supported on %s", runtime.GOOS)
+	}
+	d := &net.Dialer{
+		KeepAlive: netknob.PlatformTCPKeepAlive(),
+		Control: func(network, address string, c syscall.RawConn) error {
+			return bindToInterface(c, network, ifName)
+		},
+	}
+	if wrapDialer != nil {
+		return wrapDialer(d), nil
+	}
+	return d, nil
+}
+
 // IsSOCKSDialer reports whether d is SOCKS-proxying dialer as returned by
 // NewDialer or FromDialer.
 func IsSOCKSDialer(d Dialer) bool {
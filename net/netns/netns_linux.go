@@ -120,6 +120,31 @@ func setBypassMark(fd uintptr) error {
 	return nil
 }
 
+func init() {
+	bindToInterface = bindToNamedDevice
+}
+
+// bindToNamedDevice binds c to the interface named ifName, also
+// setting the bypass mark if in use, so the connection doesn't loop
+// back into Tailscale.
+func bindToNamedDevice(c syscall.RawConn, network, ifName string) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if useSocketMark() {
+			if sockErr = setBypassMark(fd); sockErr != nil {
+				return
+			}
+		}
+		if err := unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, ifName); err != nil {
+			sockErr = fmt.Errorf("setting SO_BINDTODEVICE to %q: %w", ifName, err)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("RawConn.Control on %T: %w", c, err)
+	}
+	return sockErr
+}
+
 func bindToDevice(fd uintptr) error {
 	ifc, err := interfaces.DefaultRouteInterface()
 	if err != nil {
@@ -42,6 +42,23 @@ func SetListenConfigInterfaceIndex(lc *net.ListenConfig, ifIndex int) error {
 	return nil
 }
 
+func init() {
+	bindToInterface = func(c syscall.RawConn, network, ifName string) error {
+		ifc, err := net.InterfaceByName(ifName)
+		if err != nil {
+			return err
+		}
+		var sockErr error
+		err = c.Control(func(fd uintptr) {
+			sockErr = bindInterface(fd, network, "", ifc.Index)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
+
 func bindInterface(fd uintptr, network, address string, ifIndex int) error {
 	v6 := strings.Contains(address, "]:") || strings.HasSuffix(network, "6") // hacky test for v6
 	proto := unix.IPPROTO_IP
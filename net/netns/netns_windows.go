@@ -6,6 +6,7 @@
 
 import (
 	"math/bits"
+	"net"
 	"strings"
 	"syscall"
 
@@ -74,6 +75,26 @@ func controlC(network, address string, c syscall.RawConn) error {
 	return nil
 }
 
+func init() {
+	bindToInterface = func(c syscall.RawConn, network, ifName string) error {
+		ifc, err := net.InterfaceByName(ifName)
+		if err != nil {
+			return err
+		}
+		if !strings.HasSuffix(network, "6") {
+			if err := bindSocket4(c, uint32(ifc.Index)); err != nil {
+				return err
+			}
+		}
+		if !strings.HasSuffix(network, "4") {
+			if err := bindSocket6(c, uint32(ifc.Index)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
 // sockoptBoundInterface is the value of IP_UNICAST_IF and IPV6_UNICAST_IF.
 //
 // See https://docs.microsoft.com/en-us/windows/win32/winsock/ipproto-ip-socket-options
@@ -385,6 +385,33 @@ func (p *Parsed) Transport() []byte {
 	return p.b[p.subofs:]
 }
 
+// TTL returns the IPv4 TTL or IPv6 hop limit of q, or 0 if q isn't an
+// IP packet.
+func (q *Parsed) TTL() uint8 {
+	switch q.IPVersion {
+	case 4:
+		return q.b[8]
+	case 6:
+		return q.b[7]
+	default:
+		return 0
+	}
+}
+
+// DSCP returns the Differentiated Services codepoint of q, the upper
+// six bits of the IPv4 TOS or IPv6 traffic class byte, or 0 if q isn't
+// an IP packet.
+func (q *Parsed) DSCP() uint8 {
+	switch q.IPVersion {
+	case 4:
+		return q.b[1] >> 2
+	case 6:
+		return (q.b[0]<<4 | q.b[1]>>4) >> 2
+	default:
+		return 0
+	}
+}
+
 // IsTCPSyn reports whether q is a TCP SYN packet,
 // without ACK set. (i.e. the first packet in a new connection)
 func (q *Parsed) IsTCPSyn() bool {
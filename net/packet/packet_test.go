@@ -425,6 +425,33 @@ func TestDecode(t *testing.T) {
 	}
 }
 
+func TestDSCP(t *testing.T) {
+	withTOS := func(buf []byte, off int, set func(b []byte)) []byte {
+		b := append([]byte(nil), buf...)
+		set(b[off:])
+		return b
+	}
+	tests := []struct {
+		name string
+		buf  []byte
+		want uint8
+	}{
+		{"unmarked4", udp4RequestBuffer, 0},
+		{"ef4", withTOS(udp4RequestBuffer, 1, func(b []byte) { b[0] = 46 << 2 }), 46},
+		{"af41-ecn4", withTOS(udp4RequestBuffer, 1, func(b []byte) { b[0] = 34<<2 | 1 }), 34},
+		{"unmarked6", tcp6RequestBuffer, 0},
+		{"ef6", withTOS(tcp6RequestBuffer, 0, func(b []byte) { b[0], b[1] = 0x6b, 0x86 }), 46},
+		{"unknown", unknownPacketBuffer, 0},
+	}
+	for _, tt := range tests {
+		var p Parsed
+		p.Decode(tt.buf)
+		if got := p.DSCP(); got != tt.want {
+			t.Errorf("%s: DSCP = %d; want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
 func BenchmarkDecode(b *testing.B) {
 	benches := []struct {
 		name string
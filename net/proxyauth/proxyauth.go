@@ -0,0 +1,206 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package proxyauth checks the credentials of clients of tailscaled's
+// SOCKS5 and HTTP proxies, so that on hosts with many users, each can
+// be given their own credentials, restricted to the addresses they
+// connect from, and their proxied connections attributed to them.
+package proxyauth
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// Credentials is a set of proxy credentials.
+type Credentials struct {
+	users map[string]*credential
+}
+
+type credential struct {
+	password string
+	from     []netip.Prefix // if non-empty, allowed client addresses
+	to       []netip.Prefix // if non-empty, allowed destination addresses
+}
+
+// Load reads credentials from the file at path. See Parse for its
+// format.
+func Load(path string) (*Credentials, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Parse parses credentials, one per line, as
+//
+//	USER:PASSWORD [from=PREFIX[,PREFIX...]] [to=PREFIX[,PREFIX...]]
+//
+// where the optional from PREFIXes are the IP addresses or prefixes the
+// credential may be used from, such as "127.0.0.1" or "10.0.0.0/24",
+// and the to PREFIXes those it may connect to through the proxy.
+// Blank lines and lines starting with "#" are ignored.
+func Parse(r io.Reader) (*Credentials, error) {
+	c := &Credentials{users: map[string]*credential{}}
+	bs := bufio.NewScanner(r)
+	for line := 1; bs.Scan(); line++ {
+		f := strings.Fields(bs.Text())
+		if len(f) == 0 || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		user, pass, ok := strings.Cut(f[0], ":")
+		if !ok || user == "" || pass == "" {
+			return nil, fmt.Errorf("line %d: want USER:PASSWORD", line)
+		}
+		if _, dup := c.users[user]; dup {
+			return nil, fmt.Errorf("line %d: duplicate user %q", line, user)
+		}
+		cred := &credential{password: pass}
+		for _, opt := range f[1:] {
+			name, val, _ := strings.Cut(opt, "=")
+			var dst *[]netip.Prefix
+			switch name {
+			case "from":
+				dst = &cred.from
+			case "to":
+				dst = &cred.to
+			default:
+				return nil, fmt.Errorf("line %d: unknown option %q", line, opt)
+			}
+			for _, s := range strings.Split(val, ",") {
+				p, err := parsePrefix(s)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", line, err)
+				}
+				*dst = append(*dst, p)
+			}
+		}
+		c.users[user] = cred
+	}
+	if err := bs.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+var (
+	errBadCredentials = errors.New("invalid username or password")
+	errBadSource      = errors.New("credential not allowed from this address")
+	errBadDest        = errors.New("credential not allowed to connect to this address")
+)
+
+// Check returns an error unless user and password are valid
+// credentials that may be used from the client address from.
+func (c *Credentials) Check(user, password string, from net.Addr) error {
+	cred, ok := c.users[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(cred.password)) != 1 {
+		return errBadCredentials
+	}
+	if len(cred.from) > 0 && !addrInPrefixes(from, cred.from) {
+		return errBadSource
+	}
+	return nil
+}
+
+// CheckDest returns an error unless user, who has passed Check, may
+// connect to the address dst.
+func (c *Credentials) CheckDest(user string, dst net.Addr) error {
+	cred, ok := c.users[user]
+	if !ok {
+		return errBadCredentials
+	}
+	if len(cred.to) > 0 && !addrInPrefixes(dst, cred.to) {
+		return errBadDest
+	}
+	return nil
+}
+
+// Dialer returns a dialer that dials with dial, on behalf of user, and
+// closes the connections that CheckDest doesn't allow.
+func (c *Credentials) Dialer(user string, dial func(ctx context.Context, netw, addr string) (net.Conn, error)) func(ctx context.Context, netw, addr string) (net.Conn, error) {
+	return func(ctx context.Context, netw, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, netw, addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.CheckDest(user, conn.RemoteAddr()); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("connecting to %s: %w", addr, err)
+		}
+		return conn, nil
+	}
+}
+
+// addrInPrefixes reports whether the IP address of a is in one of ps.
+func addrInPrefixes(a net.Addr, ps []netip.Prefix) bool {
+	ap, err := netip.ParseAddrPort(a.String())
+	if err != nil {
+		return false
+	}
+	ip := ap.Addr().Unmap()
+	for _, p := range ps {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckHTTP checks the Proxy-Authorization header of the HTTP proxy
+// request r, returning the authenticated user.
+func (c *Credentials) CheckHTTP(r *http.Request) (user string, err error) {
+	user, pass, ok := parseBasicAuth(r.Header.Get("Proxy-Authorization"))
+	if !ok {
+		return "", errors.New("missing or malformed Proxy-Authorization")
+	}
+	from, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return "", err
+	}
+	if err := c.Check(user, pass, from); err != nil {
+		return "", err
+	}
+	return user, nil
+}
+
+// parseBasicAuth parses a header value in the form of the
+// Authorization header's Basic scheme.
+func parseBasicAuth(v string) (user, password string, ok bool) {
+	const prefix = "Basic "
+	if len(v) < len(prefix) || !strings.EqualFold(v[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(v[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(b), ":")
+}
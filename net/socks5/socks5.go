@@ -28,8 +28,15 @@
 
 const (
 	noAuthRequired   byte = 0
+	passwordAuth     byte = 2
 	noAcceptableAuth byte = 255
 
+	// passwordAuthVersion is the version of the username/password
+	// subnegotiation, from RFC 1929.
+	passwordAuthVersion byte = 1
+	passwordAuthSuccess byte = 0
+	passwordAuthFailure byte = 1
+
 	// socks5Version is the byte that represents the SOCKS version
 	// in requests.
 	socks5Version byte = 5
@@ -84,6 +91,18 @@ type Server struct {
 	// Dialer optionally specifies the dialer to use for outgoing connections.
 	// If nil, the net package's standard dialer is used.
 	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Authenticate, if non-nil, requires clients to authenticate
+	// with a username and password, as in RFC 1929. It's called with
+	// the credentials and the client's address, and returns an error
+	// if they're not allowed to use the proxy.
+	Authenticate func(user, password string, client net.Addr) error
+
+	// CheckDest, if non-nil, is called with the authenticated user and
+	// the address of each connection made for them, and returns an
+	// error if they may not connect there, in which case the
+	// connection is closed.
+	CheckDest func(user string, dst net.Addr) error
 }
 
 func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -131,19 +150,46 @@ type Conn struct {
 	srv        *Server
 	clientConn net.Conn
 	request    *request
+	user       string // authenticated username, if any
 }
 
 // Run starts the new connection.
 func (c *Conn) Run() error {
-	err := parseClientGreeting(c.clientConn)
+	method := noAuthRequired
+	if c.srv.Authenticate != nil {
+		method = passwordAuth
+	}
+	err := parseClientGreeting(c.clientConn, method)
 	if err != nil {
 		c.clientConn.Write([]byte{socks5Version, noAcceptableAuth})
 		return err
 	}
-	c.clientConn.Write([]byte{socks5Version, noAuthRequired})
+	c.clientConn.Write([]byte{socks5Version, method})
+	if method == passwordAuth {
+		if err := c.authenticate(); err != nil {
+			return err
+		}
+	}
 	return c.handleRequest()
 }
 
+// authenticate runs the username/password subnegotiation of RFC 1929
+// with the client.
+func (c *Conn) authenticate() error {
+	user, pass, err := parseClientAuth(c.clientConn)
+	if err != nil {
+		c.clientConn.Write([]byte{passwordAuthVersion, passwordAuthFailure})
+		return err
+	}
+	if err := c.srv.Authenticate(user, pass, c.clientConn.RemoteAddr()); err != nil {
+		c.clientConn.Write([]byte{passwordAuthVersion, passwordAuthFailure})
+		return fmt.Errorf("authenticating %q: %w", user, err)
+	}
+	c.user = user
+	_, err = c.clientConn.Write([]byte{passwordAuthVersion, passwordAuthSuccess})
+	return err
+}
+
 func (c *Conn) handleRequest() error {
 	req, err := parseClientRequest(c.clientConn)
 	if err != nil {
@@ -174,6 +220,17 @@ func (c *Conn) handleRequest() error {
 		return err
 	}
 	defer srv.Close()
+	if c.srv.CheckDest != nil {
+		if err := c.srv.CheckDest(c.user, srv.RemoteAddr()); err != nil {
+			res := &response{reply: connectionNotAllowed}
+			buf, _ := res.marshal()
+			c.clientConn.Write(buf)
+			return fmt.Errorf("user %q connecting to %v: %w", c.user, srv.RemoteAddr(), err)
+		}
+	}
+	if c.user != "" {
+		c.srv.logf("user %q from %v connected to %v", c.user, c.clientConn.RemoteAddr(), srv.RemoteAddr())
+	}
 	serverAddr, serverPortStr, err := net.SplitHostPort(srv.LocalAddr().String())
 	if err != nil {
 		return err
@@ -221,10 +278,9 @@ func (c *Conn) handleRequest() error {
 	return <-errc
 }
 
-// parseClientGreeting parses a request initiation packet
-// and returns a slice that contains the acceptable auth methods
-// for the client.
-func parseClientGreeting(r io.Reader) error {
+// parseClientGreeting parses a request initiation packet and
+// returns an error if the client doesn't offer authMethod.
+func parseClientGreeting(r io.Reader, authMethod byte) error {
 	var hdr [2]byte
 	_, err := io.ReadFull(r, hdr[:])
 	if err != nil {
@@ -240,13 +296,34 @@ func parseClientGreeting(r io.Reader) error {
 		return fmt.Errorf("could not read methods")
 	}
 	for _, m := range methods {
-		if m == noAuthRequired {
+		if m == authMethod {
 			return nil
 		}
 	}
 	return fmt.Errorf("no acceptable auth methods")
 }
 
+// parseClientAuth parses a username/password authentication request
+// from RFC 1929.
+func parseClientAuth(r io.Reader) (user, password string, err error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return "", "", fmt.Errorf("could not read auth header")
+	}
+	if hdr[0] != passwordAuthVersion {
+		return "", "", fmt.Errorf("bad auth version %d", hdr[0])
+	}
+	ubuf := make([]byte, int(hdr[1])+1) // with the password length
+	if _, err := io.ReadFull(r, ubuf); err != nil {
+		return "", "", fmt.Errorf("could not read username")
+	}
+	pbuf := make([]byte, int(ubuf[len(ubuf)-1]))
+	if _, err := io.ReadFull(r, pbuf); err != nil {
+		return "", "", fmt.Errorf("could not read password")
+	}
+	return string(ubuf[:len(ubuf)-1]), string(pbuf), nil
+}
+
 // request represents data contained within a SOCKS5
 // connection request packet.
 type request struct {
@@ -5,6 +5,7 @@
 package socks5
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -75,3 +76,75 @@ func TestRead(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestAuthenticate(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte("Test"))
+			c.Close()
+		}
+	}()
+	defer backend.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{
+		Logf: t.Logf,
+		Authenticate: func(user, password string, client net.Addr) error {
+			if (user != "alice" && user != "bob") || password != "hunter2" {
+				return errors.New("bad credentials")
+			}
+			return nil
+		},
+		CheckDest: func(user string, dst net.Addr) error {
+			if user != "alice" {
+				return errors.New("not allowed")
+			}
+			return nil
+		},
+	}
+	go srv.Serve(ln)
+	defer ln.Close()
+
+	dial := func(auth *proxy.Auth) error {
+		d, err := proxy.SOCKS5("tcp", ln.Addr().String(), auth, proxy.Direct)
+		if err != nil {
+			return err
+		}
+		c, err := d.Dial("tcp", backend.Addr().String())
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return err
+		}
+		if string(buf) != "Test" {
+			return fmt.Errorf("got %q; want Test", buf)
+		}
+		return nil
+	}
+	if err := dial(&proxy.Auth{User: "alice", Password: "hunter2"}); err != nil {
+		t.Errorf("with valid credentials: %v", err)
+	}
+	if err := dial(&proxy.Auth{User: "alice", Password: "wrong"}); err == nil {
+		t.Error("with wrong password: connected")
+	}
+	if err := dial(nil); err == nil {
+		t.Error("without credentials: connected")
+	}
+	if err := dial(&proxy.Auth{User: "bob", Password: "hunter2"}); err == nil {
+		t.Error("to a disallowed destination: connected")
+	}
+}
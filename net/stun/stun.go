@@ -25,6 +25,8 @@
 	// like an easy mistake for a server to make.
 	// And servers appear to send it.
 	attrXorMappedAddressAlt = 0x8020
+	attrErrorCode           = 0x0009
+	attrAlternateServer     = 0x8023
 
 	software       = "tailnode" // notably: 8 bytes long, so no padding
 	bindingRequest = "\x00\x01"
@@ -129,6 +131,7 @@ func ParseBindingRequest(b []byte) (TxID, error) {
 	ErrWrongSoftware      = errors.New("STUN request came from non-Tailscale software")
 	ErrNoFingerprint      = errors.New("STUN request didn't end in fingerprint")
 	ErrWrongFingerprint   = errors.New("STUN request had bogus fingerprint")
+	ErrNotTryAlternate    = errors.New("STUN packet is not a Try Alternate response")
 )
 
 func foreachAttr(b []byte, fn func(attrType uint16, a []byte) error) error {
@@ -190,6 +193,94 @@ func Response(txID TxID, addrPort netip.AddrPort) []byte {
 	return b
 }
 
+// tryAlternate is the ERROR-CODE attribute value for error 300 (Try
+// Alternate), RFC 5389 Section 15.6: two reserved bytes, the class and
+// number, and the reason phrase.
+const tryAlternate = "\x00\x00\x03\x00Try Alternate"
+
+// TryAlternateResponse generates a binding error response redirecting
+// the client to the STUN server at alt, with error 300 (Try Alternate)
+// and an ALTERNATE-SERVER attribute, per RFC 5389 Section 11.
+func TryAlternateResponse(txID TxID, alt netip.AddrPort) []byte {
+	addr := alt.Addr()
+	var fam byte
+	if addr.Is4() {
+		fam = 1
+	} else if addr.Is6() {
+		fam = 2
+	} else {
+		return nil
+	}
+	errLenWithPad := (len(tryAlternate) + 3) &^ 3
+	attrsLen := 4 + errLenWithPad + 8 + addr.BitLen()/8
+	b := make([]byte, 0, headerLen+attrsLen)
+
+	// Header
+	b = append(b, 0x01, 0x11) // error
+	b = appendU16(b, uint16(attrsLen))
+	b = append(b, magicCookie...)
+	b = append(b, txID[:]...)
+
+	b = appendU16(b, attrErrorCode)
+	b = appendU16(b, uint16(len(tryAlternate)))
+	b = append(b, tryAlternate...)
+	for i := len(tryAlternate); i < errLenWithPad; i++ {
+		b = append(b, 0)
+	}
+
+	// ALTERNATE-SERVER has the same format as MAPPED-ADDRESS.
+	b = appendU16(b, attrAlternateServer)
+	b = appendU16(b, uint16(4+addr.BitLen()/8))
+	b = append(b, 0, fam)
+	b = appendU16(b, alt.Port())
+	ipa := addr.As16()
+	b = append(b, ipa[16-addr.BitLen()/8:]...)
+	return b
+}
+
+// ParseTryAlternateResponse parses a binding error response with error
+// 300 (Try Alternate), returning the ALTERNATE-SERVER address.
+func ParseTryAlternateResponse(b []byte) (tID TxID, alt netip.AddrPort, err error) {
+	if !Is(b) {
+		return tID, netip.AddrPort{}, ErrNotSTUN
+	}
+	copy(tID[:], b[8:8+len(tID)])
+	if b[0] != 0x01 || b[1] != 0x11 {
+		return tID, netip.AddrPort{}, ErrNotTryAlternate
+	}
+	attrsLen := int(binary.BigEndian.Uint16(b[2:4]))
+	b = b[headerLen:]
+	if attrsLen > len(b) {
+		return tID, netip.AddrPort{}, ErrMalformedAttrs
+	}
+	b = b[:attrsLen]
+
+	var code int
+	if err := foreachAttr(b, func(attrType uint16, attr []byte) error {
+		switch attrType {
+		case attrErrorCode:
+			if len(attr) < 4 {
+				return ErrMalformedAttrs
+			}
+			code = int(attr[2]&0x7)*100 + int(attr[3])
+		case attrAlternateServer:
+			a, p, err := mappedAddress(attr)
+			if err != nil {
+				return ErrMalformedAttrs
+			}
+			ip, _ := netip.AddrFromSlice(a)
+			alt = netip.AddrPortFrom(ip, p)
+		}
+		return nil
+	}); err != nil {
+		return tID, netip.AddrPort{}, err
+	}
+	if code != 300 || !alt.IsValid() {
+		return tID, netip.AddrPort{}, ErrNotTryAlternate
+	}
+	return tID, alt, nil
+}
+
 // ParseResponse parses a successful binding response STUN packet.
 // The IP address is extracted from the XOR-MAPPED-ADDRESS attribute.
 func ParseResponse(b []byte) (tID TxID, addr netip.AddrPort, err error) {
@@ -275,3 +275,31 @@ func TestResponse(t *testing.T) {
 		}
 	}
 }
+
+func TestTryAlternateResponse(t *testing.T) {
+	tx := stun.NewTxID()
+	for _, alt := range []netip.AddrPort{
+		netip.MustParseAddrPort("1.2.3.4:3478"),
+		netip.MustParseAddrPort("[2001:db8::1]:3478"),
+	} {
+		res := stun.TryAlternateResponse(tx, alt)
+		if !stun.Is(res) {
+			t.Fatalf("%v: response isn't STUN", alt)
+		}
+		tx2, alt2, err := stun.ParseTryAlternateResponse(res)
+		if err != nil {
+			t.Fatalf("%v: %v", alt, err)
+		}
+		if tx2 != tx || alt2 != alt {
+			t.Errorf("got %x, %v; want %x, %v", tx2, alt2, tx, alt)
+		}
+		if _, _, err := stun.ParseResponse(res); err != stun.ErrNotSuccessResponse {
+			t.Errorf("%v: ParseResponse error = %v; want ErrNotSuccessResponse", alt, err)
+		}
+	}
+
+	res := stun.Response(tx, netip.MustParseAddrPort("1.2.3.4:3478"))
+	if _, _, err := stun.ParseTryAlternateResponse(res); err != stun.ErrNotTryAlternate {
+		t.Errorf("success response: error = %v; want ErrNotTryAlternate", err)
+	}
+}
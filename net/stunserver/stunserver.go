@@ -0,0 +1,237 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package stunserver implements a STUN server answering Tailscale
+// clients' binding requests, as run alongside derper and other relays.
+package stunserver
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"tailscale.com/metrics"
+	"tailscale.com/net/stun"
+	"tailscale.com/tstime/mono"
+	"tailscale.com/tstime/rate"
+	"tailscale.com/types/logger"
+)
+
+const (
+	// sourceIdleTimeout is how long a source's rate limiter is kept
+	// after its last request.
+	sourceIdleTimeout = time.Minute
+
+	// maxSources is the most sources whose rate limiters are kept
+	// at once. Requests from new sources are allowed without rate
+	// limiting while the table is full.
+	maxSources = 100000
+)
+
+// Server is a STUN server. Its exported fields must be set, if at
+// all, before Serve is called.
+type Server struct {
+	// RateLimit, if positive, is the number of requests per second
+	// answered from each source IP. Requests over it are dropped, or
+	// redirected to AlternateServer.
+	RateLimit float64
+
+	// RateBurst is the burst of requests allowed from each source
+	// IP on top of RateLimit. If zero, 1 is used.
+	RateBurst int
+
+	// AlternateServer, if valid, is the STUN server that requests
+	// over RateLimit are redirected to, with a 300 (Try Alternate)
+	// error response, rather than being dropped.
+	AlternateServer netip.AddrPort
+
+	logf logger.Logf
+
+	disposition *metrics.LabelMap
+	addrFamily  *metrics.LabelMap
+	readError   *expvar.Int
+	notSTUN     *expvar.Int
+	writeError  *expvar.Int
+	success     *expvar.Int
+	rateLimited *expvar.Int
+	redirected  *expvar.Int
+	ipv4        *expvar.Int
+	ipv6        *expvar.Int
+
+	mu          sync.Mutex // guards following
+	sources     map[netip.Addr]*sourceLimiter
+	lastPruneAt mono.Time
+}
+
+// sourceLimiter is the rate limiter for a source IP.
+type sourceLimiter struct {
+	lim      *rate.Limiter
+	lastSeen mono.Time
+}
+
+// New returns a new Server that logs to logf.
+func New(logf logger.Logf) *Server {
+	s := &Server{
+		logf:        logf,
+		disposition: &metrics.LabelMap{Label: "disposition"},
+		addrFamily:  &metrics.LabelMap{Label: "family"},
+	}
+	s.readError = s.disposition.Get("read_error")
+	s.notSTUN = s.disposition.Get("not_stun")
+	s.writeError = s.disposition.Get("write_error")
+	s.success = s.disposition.Get("success")
+	s.rateLimited = s.disposition.Get("rate_limited")
+	s.redirected = s.disposition.Get("redirected")
+	s.ipv4 = s.addrFamily.Get("ipv4")
+	s.ipv6 = s.addrFamily.Get("ipv6")
+	return s
+}
+
+// ExpVar returns the server's metrics, for publishing with
+// expvar.Publish. With tsweb's /debug/varz, the counters are exported
+// in Prometheus format.
+func (s *Server) ExpVar() expvar.Var {
+	m := new(metrics.Set)
+	m.Set("counter_requests", s.disposition)
+	m.Set("counter_addrfamily", s.addrFamily)
+	return m
+}
+
+// ListenAndServe listens on the UDP address addr and serves STUN
+// requests until ctx is done.
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	s.logf("running STUN server on %v", pc.LocalAddr())
+	return s.Serve(ctx, pc)
+}
+
+// Serve serves STUN requests on pc until ctx is done, closing pc when
+// it returns. It always returns a non-nil error.
+func (s *Server) Serve(ctx context.Context, pc net.PacketConn) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			pc.Close()
+		case <-done:
+		}
+	}()
+	defer pc.Close()
+
+	var buf [64 << 10]byte
+	for {
+		n, ua, err := pc.ReadFrom(buf[:])
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			s.logf("STUN ReadFrom: %v", err)
+			time.Sleep(time.Second)
+			s.readError.Add(1)
+			continue
+		}
+		src := addrPortOf(ua)
+		res, disposition := s.handle(buf[:n], src)
+		if res == nil {
+			continue
+		}
+		if _, err := pc.WriteTo(res, ua); err != nil {
+			s.writeError.Add(1)
+		} else {
+			disposition.Add(1)
+		}
+	}
+}
+
+// handle returns the response to the packet pkt from src, or nil if
+// there's none to send. If there is one, it also returns the counter
+// to increment once it's sent.
+func (s *Server) handle(pkt []byte, src netip.AddrPort) (res []byte, disposition *expvar.Int) {
+	if !stun.Is(pkt) {
+		s.notSTUN.Add(1)
+		return nil, nil
+	}
+	txid, err := stun.ParseBindingRequest(pkt)
+	if err != nil {
+		s.notSTUN.Add(1)
+		return nil, nil
+	}
+	if src.Addr().Is4() {
+		s.ipv4.Add(1)
+	} else {
+		s.ipv6.Add(1)
+	}
+	if !s.allow(src.Addr(), mono.Now()) {
+		if s.AlternateServer.IsValid() {
+			return stun.TryAlternateResponse(txid, s.AlternateServer), s.redirected
+		}
+		s.rateLimited.Add(1)
+		return nil, nil
+	}
+	return stun.Response(txid, src), s.success
+}
+
+// allow reports whether a request from ip at now is within
+// s.RateLimit.
+func (s *Server) allow(ip netip.Addr, now mono.Time) bool {
+	if s.RateLimit <= 0 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.lastPruneAt) > sourceIdleTimeout {
+		s.pruneLocked(now)
+	}
+	sl, ok := s.sources[ip]
+	if !ok {
+		if len(s.sources) >= maxSources {
+			return true
+		}
+		burst := s.RateBurst
+		if burst < 1 {
+			burst = 1
+		}
+		sl = &sourceLimiter{lim: rate.NewLimiter(rate.Limit(s.RateLimit), burst)}
+		if s.sources == nil {
+			s.sources = map[netip.Addr]*sourceLimiter{}
+		}
+		s.sources[ip] = sl
+	}
+	sl.lastSeen = now
+	return sl.lim.Allow()
+}
+
+// pruneLocked removes the rate limiters of sources that have been idle
+// for sourceIdleTimeout.
+//
+// s.mu must be held.
+func (s *Server) pruneLocked(now mono.Time) {
+	s.lastPruneAt = now
+	for ip, sl := range s.sources {
+		if now.Sub(sl.lastSeen) > sourceIdleTimeout {
+			delete(s.sources, ip)
+		}
+	}
+}
+
+func addrPortOf(a net.Addr) netip.AddrPort {
+	var ap netip.AddrPort
+	if ua, ok := a.(*net.UDPAddr); ok {
+		ap = ua.AddrPort()
+	} else {
+		ap, _ = netip.ParseAddrPort(a.String())
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stunserver
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"tailscale.com/net/stun"
+)
+
+func TestServer(t *testing.T) {
+	src := netip.MustParseAddrPort("1.2.3.4:5678")
+	tx := stun.NewTxID()
+	req := stun.Request(tx)
+
+	s := New(t.Logf)
+	res, disp := s.handle(req, src)
+	if disp != s.success {
+		t.Fatalf("disposition = %v; want success", disp)
+	}
+	tx2, addr, err := stun.ParseResponse(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx2 != tx || addr != src {
+		t.Errorf("response = %x, %v; want %x, %v", tx2, addr, tx, src)
+	}
+
+	if res, _ := s.handle([]byte("not stun"), src); res != nil || s.notSTUN.Value() != 1 {
+		t.Errorf("non-STUN packet: response %q, not_stun = %v", res, s.notSTUN.Value())
+	}
+}
+
+func TestServerRateLimit(t *testing.T) {
+	src := netip.MustParseAddrPort("1.2.3.4:5678")
+	other := netip.MustParseAddrPort("5.6.7.8:5678")
+	req := stun.Request(stun.NewTxID())
+
+	s := New(t.Logf)
+	s.RateLimit = 1.0 / 3600
+	s.RateBurst = 2
+	for i := 0; i < 2; i++ {
+		if res, _ := s.handle(req, src); res == nil {
+			t.Fatalf("request %d dropped within burst", i)
+		}
+	}
+	if res, _ := s.handle(req, src); res != nil {
+		t.Fatalf("request over limit answered")
+	}
+	if got := s.rateLimited.Value(); got != 1 {
+		t.Errorf("rate_limited = %v; want 1", got)
+	}
+	if res, _ := s.handle(req, other); res == nil {
+		t.Errorf("request from other source dropped")
+	}
+
+	alt := netip.MustParseAddrPort("9.9.9.9:3478")
+	s.AlternateServer = alt
+	res, disp := s.handle(req, src)
+	if disp != s.redirected {
+		t.Fatalf("disposition = %v; want redirected", disp)
+	}
+	if _, got, err := stun.ParseTryAlternateResponse(res); err != nil || got != alt {
+		t.Errorf("ParseTryAlternateResponse = %v, %v; want %v", got, err, alt)
+	}
+}
+
+func TestServe(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := New(t.Logf)
+	errc := make(chan error, 1)
+	go func() { errc <- s.Serve(ctx, pc) }()
+
+	c, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	tx := stun.NewTxID()
+	if _, err := c.Write(stun.Request(tx)); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var buf [1500]byte
+	n, err := c.Read(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx2, addr, err := stun.ParseResponse(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx2 != tx || addr.String() != c.LocalAddr().String() {
+		t.Errorf("response = %x, %v; want %x, %v", tx2, addr, tx, c.LocalAddr())
+	}
+
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("Serve = %v; want context.Canceled", err)
+	}
+}
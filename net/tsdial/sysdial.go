@@ -0,0 +1,272 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdial
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"tailscale.com/net/dnscache"
+	"tailscale.com/net/netns"
+	"tailscale.com/types/logger"
+)
+
+// SystemDialRule customizes how SystemDial, and UserDial for
+// destinations outside the tailnet, connect to the destinations in a
+// prefix, for hosts where the default route isn't the right way to
+// reach everything. See Dialer.SetSystemDialRules.
+type SystemDialRule struct {
+	// Dest is the destination IPs the rule applies to.
+	Dest netip.Prefix
+
+	// Timeout, if non-zero, is how long to wait for each connection
+	// attempt to an IP in Dest.
+	Timeout time.Duration
+
+	// Interface, if non-empty, is the name of the network interface
+	// to connect out of, instead of the default route's.
+	Interface string
+}
+
+// connAttemptDelay is how long to wait for a connection attempt to
+// one of a host's IPs before also trying the next, as recommended by
+// RFC 8305 section 5.
+const connAttemptDelay = 250 * time.Millisecond
+
+// SetSystemDialRules sets the rules for SystemDial, and for UserDial
+// to destinations outside the tailnet. For each IP dialed, the first
+// rule whose Dest contains it applies.
+func (d *Dialer) SetSystemDialRules(rules []SystemDialRule) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sysDialRules = append([]SystemDialRule(nil), rules...)
+}
+
+// sysDialRuleFor returns the rule for dialing ip, or the zero rule if
+// none applies.
+func (d *Dialer) sysDialRuleFor(ip netip.Addr) SystemDialRule {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, r := range d.sysDialRules {
+		if r.Dest.Contains(ip) {
+			return r
+		}
+	}
+	return SystemDialRule{}
+}
+
+func (d *Dialer) logf(format string, args ...any) {
+	if d.Logf != nil {
+		d.Logf(format, args...)
+	}
+}
+
+// netnsDialerFor returns the netns dialer to connect out of the named
+// interface, or the default route's if ifName is empty.
+func (d *Dialer) netnsDialerFor(ifName string) (netns.Dialer, error) {
+	if ifName == "" {
+		d.netnsDialerOnce.Do(func() {
+			logf := d.Logf
+			if logf == nil {
+				logf = logger.Discard
+			}
+			d.netnsDialer = netns.NewDialer(logf)
+		})
+		return d.netnsDialer, nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if nd, ok := d.ifDialers[ifName]; ok {
+		return nd, nil
+	}
+	nd, err := netns.NewDialerForInterface(d.logf, ifName)
+	if err != nil {
+		return nil, err
+	}
+	if d.ifDialers == nil {
+		d.ifDialers = map[string]netns.Dialer{}
+	}
+	d.ifDialers[ifName] = nd
+	return nd, nil
+}
+
+// sysDial dials addr for SystemDial.
+func (d *Dialer) sysDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.LookupPort(network, portStr)
+	if err != nil {
+		return nil, err
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return d.sysDialIP(ctx, network, netip.AddrPortFrom(ip, uint16(port)))
+	}
+	if nd, err := d.netnsDialerFor(""); err == nil && netns.IsSOCKSDialer(nd) {
+		// Let the proxy resolve the name.
+		return nd.DialContext(ctx, network, addr)
+	}
+	return d.sysDialHost(ctx, network, host, uint16(port))
+}
+
+// sysDialIP dials ipp, which must be an IP literal, per the rule for
+// its IP.
+func (d *Dialer) sysDialIP(ctx context.Context, network string, ipp netip.AddrPort) (net.Conn, error) {
+	r := d.sysDialRuleFor(ipp.Addr())
+	nd, err := d.netnsDialerFor(r.Interface)
+	if err != nil {
+		return nil, err
+	}
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	return nd.DialContext(ctx, network, ipp.String())
+}
+
+// sysDialHost dials host, a name, at port, racing connection attempts
+// to its IPs as in RFC 8305: IPv6 and IPv4 IPs are interleaved,
+// starting with IPv6, and a connection to each is attempted
+// connAttemptDelay after the last, or as soon as it fails.
+func (d *Dialer) sysDialHost(ctx context.Context, network, host string, port uint16) (net.Conn, error) {
+	_, _, allIPs, err := dnscache.Get().LookupIP(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %q: %w", host, err)
+	}
+	var ips []netip.Addr
+	for _, a := range allIPs {
+		ip, ok := netip.AddrFromSlice(a.IP)
+		if !ok {
+			continue
+		}
+		ip = ip.Unmap()
+		switch {
+		case ip.Is4() && network != "tcp6" && network != "udp6",
+			ip.Is6() && network != "tcp4" && network != "udp4":
+			ips = append(ips, ip)
+		}
+	}
+	ips = raceOrder(ips)
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no usable IPs for %q", host)
+	}
+	return raceDial(ctx, ips, connAttemptDelay, func(ctx context.Context, ip netip.Addr) (net.Conn, error) {
+		return d.sysDialIP(ctx, network, netip.AddrPortFrom(ip, port))
+	})
+}
+
+// raceDial dials each of ips in order, starting each attempt delay
+// after the previous one or as soon as it fails, and returns the
+// first connection made.
+func raceDial(ctx context.Context, ips []netip.Addr, delay time.Duration, dial func(context.Context, netip.Addr) (net.Conn, error)) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type res struct {
+		c   net.Conn
+		err error
+	}
+	resc := make(chan res, len(ips))
+	started, done := 0, 0
+	start := func() {
+		ip := ips[started]
+		started++
+		go func() {
+			c, err := dial(ctx, ip)
+			if err != nil {
+				// Don't keep a typed nil, as from netstack.
+				c = nil
+			}
+			resc <- res{c, err}
+		}()
+	}
+	start()
+
+	// closeLate closes the connections of the n attempts still
+	// running, if they succeed.
+	closeLate := func(n int) {
+		for i := 0; i < n; i++ {
+			if r := <-resc; r.c != nil {
+				r.c.Close()
+			}
+		}
+	}
+
+	var firstErr error
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		var next <-chan time.Time
+		if started < len(ips) {
+			next = timer.C
+		}
+		select {
+		case r := <-resc:
+			done++
+			if r.err == nil {
+				go closeLate(started - done)
+				return r.c, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if started < len(ips) {
+				// Fail fast to the next IP.
+				if !timer.Stop() {
+					<-timer.C
+				}
+				start()
+				timer.Reset(delay)
+			} else if done == started {
+				return nil, firstErr
+			}
+		case <-next:
+			start()
+			timer.Reset(delay)
+		case <-ctx.Done():
+			go closeLate(started - done)
+			if firstErr != nil {
+				return nil, firstErr
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// raceOrder returns ips in the order raceDial should try them, per
+// RFC 8305: IPv6 and IPv4 IPs interleaved, starting with IPv6.
+func raceOrder(ips []netip.Addr) []netip.Addr {
+	var v4, v6 []netip.Addr
+	for _, ip := range ips {
+		if ip.Is4() {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	return interleave(v6, v4)
+}
+
+// interleave returns the elements of a and b alternately, starting
+// with a's.
+func interleave[T any](a, b []T) []T {
+	ret := make([]T, 0, len(a)+len(b))
+	for len(a) > 0 || len(b) > 0 {
+		if len(a) > 0 {
+			ret = append(ret, a[0])
+			a = a[1:]
+		}
+		if len(b) > 0 {
+			ret = append(ret, b[0])
+			b = b[1:]
+		}
+	}
+	return ret
+}
@@ -0,0 +1,203 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdial
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRaceDial(t *testing.T) {
+	ips := []netip.Addr{
+		netip.MustParseAddr("2001:db8::1"),
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("2001:db8::2"),
+	}
+	errRefused := errors.New("refused")
+
+	tests := []struct {
+		name     string
+		behavior map[netip.Addr]string // "hang", "fail" or "ok"
+		want     netip.Addr            // or zero for an error
+	}{
+		{
+			name:     "first_ok",
+			behavior: map[netip.Addr]string{ips[0]: "ok", ips[1]: "ok", ips[2]: "ok"},
+			want:     ips[0],
+		},
+		{
+			name:     "first_hangs",
+			behavior: map[netip.Addr]string{ips[0]: "hang", ips[1]: "ok", ips[2]: "ok"},
+			want:     ips[1],
+		},
+		{
+			name:     "fail_fast",
+			behavior: map[netip.Addr]string{ips[0]: "fail", ips[1]: "fail", ips[2]: "ok"},
+			want:     ips[2],
+		},
+		{
+			name:     "all_fail",
+			behavior: map[netip.Addr]string{ips[0]: "fail", ips[1]: "fail", ips[2]: "fail"},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt // late attempts can outlive the subtest
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var tried []netip.Addr
+			dial := func(ctx context.Context, ip netip.Addr) (net.Conn, error) {
+				mu.Lock()
+				tried = append(tried, ip)
+				mu.Unlock()
+				switch tt.behavior[ip] {
+				case "hang":
+					<-ctx.Done()
+					return nil, ctx.Err()
+				case "fail":
+					return nil, errRefused
+				}
+				c1, c2 := net.Pipe()
+				c2.Close()
+				return &addrConn{c1, ip}, nil
+			}
+			// With a long delay, only failures can start the next
+			// attempt quickly; with a short one, hangs can too.
+			delay := time.Hour
+			if tt.name == "first_hangs" {
+				delay = 10 * time.Millisecond
+			}
+			c, err := raceDial(context.Background(), ips, delay, dial)
+			if !tt.want.IsValid() {
+				if err != errRefused {
+					t.Fatalf("err = %v; want %v", err, errRefused)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if got := c.(*addrConn).ip; got != tt.want {
+				t.Errorf("connected to %v; want %v", got, tt.want)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for i, ip := range tried {
+				if ip != ips[i] {
+					t.Errorf("tried %v; want in order %v", tried, ips)
+					break
+				}
+			}
+		})
+	}
+}
+
+type addrConn struct {
+	net.Conn
+	ip netip.Addr
+}
+
+func TestSystemDialRuleFor(t *testing.T) {
+	d := new(Dialer)
+	d.SetSystemDialRules([]SystemDialRule{
+		{Dest: netip.MustParsePrefix("10.1.0.0/16"), Interface: "eth1"},
+		{Dest: netip.MustParsePrefix("10.0.0.0/8"), Timeout: 5 * time.Second},
+	})
+	tests := []struct {
+		ip   string
+		want SystemDialRule
+	}{
+		{"10.1.2.3", SystemDialRule{Dest: netip.MustParsePrefix("10.1.0.0/16"), Interface: "eth1"}},
+		{"10.2.3.4", SystemDialRule{Dest: netip.MustParsePrefix("10.0.0.0/8"), Timeout: 5 * time.Second}},
+		{"192.0.2.1", SystemDialRule{}},
+	}
+	for _, tt := range tests {
+		if got := d.sysDialRuleFor(netip.MustParseAddr(tt.ip)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("rule for %s = %+v; want %+v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestInterleave(t *testing.T) {
+	got := interleave([]int{1, 3, 5, 7}, []int{2, 4})
+	want := []int{1, 2, 3, 4, 5, 7}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestRaceOrder(t *testing.T) {
+	ips := []netip.Addr{
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("192.0.2.2"),
+		netip.MustParseAddr("2001:db8::1"),
+	}
+	got := raceOrder(ips)
+	want := []netip.Addr{ips[2], ips[0], ips[1]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestUserDialRace(t *testing.T) {
+	var mu sync.Mutex
+	var tried []netip.Addr
+	d := &Dialer{
+		UseNetstackForIP: func(netip.Addr) bool { return true },
+		NetstackDialTCP: func(ctx context.Context, ipp netip.AddrPort) (net.Conn, error) {
+			mu.Lock()
+			tried = append(tried, ipp.Addr())
+			mu.Unlock()
+			if ipp.Addr().Is6() {
+				return nil, errors.New("refused")
+			}
+			c1, c2 := net.Pipe()
+			c2.Close()
+			return addrConn{c1, ipp.Addr()}, nil
+		},
+	}
+	ips := raceOrder([]netip.Addr{
+		netip.MustParseAddr("100.64.0.1"),
+		netip.MustParseAddr("fd7a:115c:a1e0::1"),
+	})
+	c, err := d.userDialIPs(context.Background(), "tcp", ips, 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if got := c.(addrConn).ip; got != ips[1] {
+		t.Errorf("connected to %v; want %v", got, ips[1])
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(tried, ips) {
+		t.Errorf("tried %v; want %v", tried, ips)
+	}
+}
+
+func TestUserDialRules(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("binding to an interface is tested on Linux")
+	}
+	d := new(Dialer)
+	d.SetSystemDialRules([]SystemDialRule{
+		{Dest: netip.MustParsePrefix("192.0.2.0/24"), Interface: "no-such-if0"},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// Without the rule, the dial would hang until ctx expires. With
+	// it, binding to the missing interface fails right away.
+	_, err := d.UserDial(ctx, "tcp", "192.0.2.1:80")
+	if err == nil || errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil {
+		t.Errorf("UserDial = %v; want an error from binding to no-such-if0", err)
+	}
+}
@@ -61,6 +61,8 @@ type Dialer struct {
 	dnsCache          *dnscache.MessageCache // nil until first first non-empty SetExitDNSDoH
 	nextSysConnID     int
 	activeSysConns    map[int]net.Conn // active connections not yet closed
+	sysDialRules      []SystemDialRule
+	ifDialers         map[string]netns.Dialer // by interface name; for sysDialRules
 }
 
 // sysConn wraps a net.Conn that was created using d.SystemDial.
@@ -204,7 +206,7 @@ func (d *Dialer) SetNetMap(nm *netmap.NetworkMap) {
 	d.dns = m
 }
 
-func (d *Dialer) userDialResolve(ctx context.Context, network, addr string) (netip.AddrPort, error) {
+func (d *Dialer) userDialResolve(ctx context.Context, network, addr string) (ips []netip.Addr, port uint16, err error) {
 	d.mu.Lock()
 	dns := d.dns
 	exitDNSDoH := d.exitDNSDoHBase
@@ -213,7 +215,10 @@ func (d *Dialer) userDialResolve(ctx context.Context, network, addr string) (net
 	// MagicDNS or otherwise baked in to the NetworkMap? Try that first.
 	ipp, err := dns.resolveMemory(ctx, network, addr)
 	if err != errUnresolved {
-		return ipp, err
+		if err != nil {
+			return nil, 0, err
+		}
+		return []netip.Addr{ipp.Addr()}, ipp.Port(), nil
 	}
 
 	// Otherwise, hit the network.
@@ -223,7 +228,7 @@ func (d *Dialer) userDialResolve(ctx context.Context, network, addr string) (net
 	host, port, err := splitHostPort(addr)
 	if err != nil {
 		// addr is malformed.
-		return netip.AddrPort{}, err
+		return nil, 0, err
 	}
 
 	var r net.Resolver
@@ -239,15 +244,19 @@ func (d *Dialer) userDialResolve(ctx context.Context, network, addr string) (net
 		}
 	}
 
-	ips, err := r.LookupIP(ctx, ipNetOfNetwork(network), host)
+	netIPs, err := r.LookupIP(ctx, ipNetOfNetwork(network), host)
 	if err != nil {
-		return netip.AddrPort{}, err
+		return nil, 0, err
+	}
+	for _, a := range netIPs {
+		if ip, ok := netip.AddrFromSlice(a); ok {
+			ips = append(ips, ip.Unmap())
+		}
 	}
 	if len(ips) == 0 {
-		return netip.AddrPort{}, fmt.Errorf("DNS lookup returned no results for %q", host)
+		return nil, 0, fmt.Errorf("DNS lookup returned no results for %q", host)
 	}
-	ip, _ := netip.AddrFromSlice(ips[0])
-	return netip.AddrPortFrom(ip.Unmap(), port), nil
+	return raceOrder(ips), port, nil
 }
 
 // ipNetOfNetwork returns "ip", "ip4", or "ip6" corresponding
@@ -266,7 +275,11 @@ func ipNetOfNetwork(n string) string {
 // SystemDial connects to the provided network address without going over
 // Tailscale. It prefers going over the default interface and closes existing
 // connections if the default interface changes. It is used to connect to
-// Control and (in the future, as of 2022-04-27) DERPs..
+// Control and DERPs.
+//
+// Host names are resolved and their IPs raced as in RFC 8305. The
+// interface and timeout used for each IP can be set with
+// SetSystemDialRules.
 func (d *Dialer) SystemDial(ctx context.Context, network, addr string) (net.Conn, error) {
 	d.mu.Lock()
 	closed := d.closed
@@ -275,14 +288,7 @@ func (d *Dialer) SystemDial(ctx context.Context, network, addr string) (net.Conn
 		return nil, net.ErrClosed
 	}
 
-	d.netnsDialerOnce.Do(func() {
-		logf := d.Logf
-		if logf == nil {
-			logf = logger.Discard
-		}
-		d.netnsDialer = netns.NewDialer(logf)
-	})
-	c, err := d.netnsDialer.DialContext(ctx, network, addr)
+	c, err := d.sysDial(ctx, network, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -301,17 +307,48 @@ func (d *Dialer) SystemDial(ctx context.Context, network, addr string) (net.Conn
 
 // UserDial connects to the provided network address as if a user were initiating the dial.
 // (e.g. from a SOCKS or HTTP outbound proxy)
+//
+// Host names with several IPs have connections to them raced as in
+// RFC 8305, and dials outside the tailnet follow the rules set with
+// SetSystemDialRules.
 func (d *Dialer) UserDial(ctx context.Context, network, addr string) (net.Conn, error) {
-	ipp, err := d.userDialResolve(ctx, network, addr)
+	ips, port, err := d.userDialResolve(ctx, network, addr)
 	if err != nil {
 		return nil, err
 	}
+	return d.userDialIPs(ctx, network, ips, port)
+}
+
+// userDialIPs races connections to port on ips, in order, for
+// UserDial.
+func (d *Dialer) userDialIPs(ctx context.Context, network string, ips []netip.Addr, port uint16) (net.Conn, error) {
+	return raceDial(ctx, ips, connAttemptDelay, func(ctx context.Context, ip netip.Addr) (net.Conn, error) {
+		return d.userDialIP(ctx, network, netip.AddrPortFrom(ip, port))
+	})
+}
+
+// userDialIP dials ipp for UserDial, over netstack if it's reached
+// over Tailscale and otherwise per the system dial rule for its IP.
+func (d *Dialer) userDialIP(ctx context.Context, network string, ipp netip.AddrPort) (net.Conn, error) {
 	if d.UseNetstackForIP != nil && d.UseNetstackForIP(ipp.Addr()) {
 		if d.NetstackDialTCP == nil {
 			return nil, errors.New("Dialer not initialized correctly")
 		}
 		return d.NetstackDialTCP(ctx, ipp)
 	}
+	r := d.sysDialRuleFor(ipp.Addr())
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	if r.Interface != "" {
+		nd, err := d.netnsDialerFor(r.Interface)
+		if err != nil {
+			return nil, err
+		}
+		return nd.DialContext(ctx, network, ipp.String())
+	}
 	// TODO(bradfitz): netns, etc
 	var stdDialer net.Dialer
 	return stdDialer.DialContext(ctx, network, ipp.String())
@@ -0,0 +1,201 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"fmt"
+
+	"tailscale.com/net/packet"
+	"tailscale.com/wgengine/filter"
+)
+
+// PacketHookVersion is the version of the packet hook contract
+// documented on PacketHook. It's incremented whenever the contract
+// changes incompatibly, such as hooks being called at a different
+// stage, so that hooks written against an older contract fail to
+// register rather than misbehave.
+const PacketHookVersion = 1
+
+// HookStage is where in a Wrapper's packet processing a PacketHook
+// runs.
+type HookStage uint8
+
+const (
+	// HookPreFilter hooks run before the packet filter, so they see
+	// packets the filter then drops. They don't see packets handled
+	// by tstun itself, such as TSMP pings and MagicDNS echo
+	// requests, or injected packets.
+	HookPreFilter HookStage = iota
+
+	// HookPostFilter hooks run after the packet filter, so they only
+	// see packets it accepts. Inbound, that includes packets then
+	// handled by netstack.
+	HookPostFilter
+)
+
+func (s HookStage) String() string {
+	switch s {
+	case HookPreFilter:
+		return "pre-filter"
+	case HookPostFilter:
+		return "post-filter"
+	}
+	return fmt.Sprintf("HookStage(%d)", uint8(s))
+}
+
+// PacketHook observes, and optionally modifies or drops, the packets
+// going through a Wrapper. See Wrapper.AddPacketHook.
+//
+// Hooks run on the packet path of every packet, so they must:
+//
+//   - return quickly, without blocking or doing I/O: anything slow
+//     must be handed off to another goroutine;
+//   - not allocate in the common case;
+//   - not retain the *packet.Parsed or its buffer after returning;
+//   - be safe for concurrent use, as inbound and outbound packets are
+//     processed concurrently.
+//
+// Hooks that do more than look at the packet and update counters
+// should be benchmarked against BenchmarkPacketHooks.
+type PacketHook struct {
+	// Version is the PacketHookVersion the hook was written for.
+	Version int
+
+	// Name identifies the hook in logs. It must be non-empty and
+	// unique among the Wrapper's hooks.
+	Name string
+
+	// Stage is where the hook runs.
+	Stage HookStage
+
+	// In and Out, if non-nil, are called for each inbound (from
+	// WireGuard) and outbound (from the OS) packet respectively.
+	// If either returns a drop response, the packet is dropped and
+	// no later hooks see it.
+	In  FilterFunc
+	Out FilterFunc
+
+	// Mutates is whether In or Out may modify the packet's bytes in
+	// place, via its Buffer. They can't change its length. Packets
+	// are parsed again after each mutating hook, which costs about
+	// as much as a hook itself, so observers should leave it false.
+	Mutates bool
+}
+
+// hookList is an immutable set of a Wrapper's packet hooks, by stage.
+type hookList struct {
+	pre, post []*PacketHook
+}
+
+// AddPacketHook registers h to be called for packets going through t,
+// after any hooks already registered at the same stage. It returns a
+// func that unregisters it.
+//
+// It's an error for h.Version not to be the current PacketHookVersion.
+func (t *Wrapper) AddPacketHook(h PacketHook) (remove func(), err error) {
+	t.hooksMu.Lock()
+	defer t.hooksMu.Unlock()
+	hp, err := t.replacePacketHookLocked(nil, h)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		t.hooksMu.Lock()
+		defer t.hooksMu.Unlock()
+		t.removePacketHookLocked(hp)
+	}, nil
+}
+
+// replacePacketHookLocked registers h in place of the registered hook
+// old, if non-nil, and returns the registered copy of h. The packet
+// path sees the change in a single swap of t.hooks, so each packet
+// sees either old or h, never both or neither.
+//
+// t.hooksMu must be held.
+func (t *Wrapper) replacePacketHookLocked(old *PacketHook, h PacketHook) (*PacketHook, error) {
+	if h.Version != PacketHookVersion {
+		return nil, fmt.Errorf("tstun: packet hook %q written for version %d; want %d", h.Name, h.Version, PacketHookVersion)
+	}
+	if h.Name == "" {
+		return nil, fmt.Errorf("tstun: packet hook has no name")
+	}
+	if h.Stage != HookPreFilter && h.Stage != HookPostFilter {
+		return nil, fmt.Errorf("tstun: packet hook %q has invalid stage %v", h.Name, h.Stage)
+	}
+	cur := t.hooks.Load()
+	if cur == nil {
+		cur = new(hookList)
+	}
+	for _, l := range [][]*PacketHook{cur.pre, cur.post} {
+		for _, o := range l {
+			if o != old && o.Name == h.Name {
+				return nil, fmt.Errorf("tstun: packet hook %q already registered", h.Name)
+			}
+		}
+	}
+	hp := &h
+	// Copy, as the current list may be in use by the packet path.
+	nl := &hookList{pre: without(cur.pre, old), post: without(cur.post, old)}
+	if h.Stage == HookPreFilter {
+		nl.pre = append(nl.pre, hp)
+	} else {
+		nl.post = append(nl.post, hp)
+	}
+	t.hooks.Store(nl)
+	return hp, nil
+}
+
+// removePacketHookLocked unregisters the hook h.
+//
+// t.hooksMu must be held.
+func (t *Wrapper) removePacketHookLocked(h *PacketHook) {
+	cur := t.hooks.Load()
+	if cur == nil {
+		return
+	}
+	nl := &hookList{pre: without(cur.pre, h), post: without(cur.post, h)}
+	if len(nl.pre) == 0 && len(nl.post) == 0 {
+		nl = nil
+	}
+	t.hooks.Store(nl)
+}
+
+// without returns a copy of l without h.
+func without(l []*PacketHook, h *PacketHook) []*PacketHook {
+	var ret []*PacketHook
+	for _, o := range l {
+		if o != h {
+			ret = append(ret, o)
+		}
+	}
+	return ret
+}
+
+// runHooks runs the In or Out funcs of hooks on p, stopping at the
+// first that drops it.
+func (t *Wrapper) runHooks(hooks []*PacketHook, p *packet.Parsed, out bool) filter.Response {
+	for _, h := range hooks {
+		f := h.In
+		if out {
+			f = h.Out
+		}
+		if f == nil {
+			continue
+		}
+		res := f(p, t)
+		if h.Mutates {
+			p.Decode(p.Buffer())
+		}
+		if res.IsDrop() {
+			if out {
+				metricPacketOutDropHook.Add(1)
+			} else {
+				metricPacketInDropHook.Add(1)
+			}
+			return res
+		}
+	}
+	return filter.Accept
+}
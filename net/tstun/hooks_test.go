@@ -0,0 +1,195 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"tailscale.com/net/packet"
+	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/flowsample"
+)
+
+func TestPacketHooks(t *testing.T) {
+	_, tun := newFakeTUN(t.Logf, true)
+	defer tun.Close()
+
+	var pre, post atomic.Int64
+	count := func(n *atomic.Int64) FilterFunc {
+		return func(*packet.Parsed, *Wrapper) filter.Response {
+			n.Add(1)
+			return filter.Accept
+		}
+	}
+	removePre, err := tun.AddPacketHook(PacketHook{Version: PacketHookVersion, Name: "pre", Stage: HookPreFilter, In: count(&pre)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tun.AddPacketHook(PacketHook{Version: PacketHookVersion, Name: "post", Stage: HookPostFilter, In: count(&post)}); err != nil {
+		t.Fatal(err)
+	}
+
+	accepted := udp4("5.6.7.8", "1.2.3.4", 89, 89)
+	denied := udp4("5.6.7.8", "1.2.3.4", 98, 98)
+	if res := tun.filterIn(accepted); res != filter.Accept {
+		t.Fatalf("accepted packet got %v", res)
+	}
+	if res := tun.filterIn(denied); res != filter.Drop {
+		t.Fatalf("denied packet got %v", res)
+	}
+	if pre.Load() != 2 || post.Load() != 1 {
+		t.Errorf("pre-filter hook saw %d packets, post-filter hook %d; want 2, 1", pre.Load(), post.Load())
+	}
+
+	// A mutating hook's changes are seen by the filter.
+	if _, err := tun.AddPacketHook(PacketHook{
+		Version: PacketHookVersion,
+		Name:    "redirect",
+		Stage:   HookPreFilter,
+		Mutates: true,
+		In: func(p *packet.Parsed, _ *Wrapper) filter.Response {
+			if p.Dst.Port() == 98 {
+				binary.BigEndian.PutUint16(p.Buffer()[22:], 89)
+			}
+			return filter.Accept
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if res := tun.filterIn(udp4("5.6.7.8", "1.2.3.4", 98, 98)); res != filter.Accept {
+		t.Errorf("redirected packet got %v; want accept", res)
+	}
+
+	// A dropping hook stops later hooks from seeing the packet.
+	removeDrop, err := tun.AddPacketHook(PacketHook{
+		Version: PacketHookVersion,
+		Name:    "drop",
+		Stage:   HookPreFilter,
+		In: func(*packet.Parsed, *Wrapper) filter.Response {
+			return filter.DropSilently
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pre.Store(0)
+	post.Store(0)
+	if res := tun.filterIn(accepted); res != filter.DropSilently {
+		t.Errorf("with dropping hook, got %v; want DropSilently", res)
+	}
+	if pre.Load() != 1 || post.Load() != 0 {
+		t.Errorf("pre-filter hook saw %d packets, post-filter hook %d; want 1, 0", pre.Load(), post.Load())
+	}
+
+	removeDrop()
+	removePre()
+	pre.Store(0)
+	if res := tun.filterIn(accepted); res != filter.Accept {
+		t.Errorf("after removing dropping hook, got %v; want accept", res)
+	}
+	if pre.Load() != 0 || post.Load() != 1 {
+		t.Errorf("after removing hooks, pre saw %d packets, post %d; want 0, 1", pre.Load(), post.Load())
+	}
+}
+
+func TestAddPacketHookErrors(t *testing.T) {
+	_, tun := newFakeTUN(t.Logf, true)
+	defer tun.Close()
+
+	if _, err := tun.AddPacketHook(PacketHook{Name: "old"}); err == nil {
+		t.Error("hook without version registered")
+	}
+	if _, err := tun.AddPacketHook(PacketHook{Version: PacketHookVersion}); err == nil {
+		t.Error("hook without name registered")
+	}
+	if _, err := tun.AddPacketHook(PacketHook{Version: PacketHookVersion, Name: "x", Stage: 9}); err == nil {
+		t.Error("hook with invalid stage registered")
+	}
+	if _, err := tun.AddPacketHook(PacketHook{Version: PacketHookVersion, Name: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tun.AddPacketHook(PacketHook{Version: PacketHookVersion, Name: "x", Stage: HookPostFilter}); err == nil {
+		t.Error("hook with duplicate name registered")
+	}
+}
+
+func TestSetFlowSamplerSwap(t *testing.T) {
+	_, tun := newFakeTUN(t.Logf, true)
+	defer tun.Close()
+
+	// flowHooks returns the number of flow sampler hooks registered.
+	flowHooks := func() int {
+		n := 0
+		if l := tun.hooks.Load(); l != nil {
+			for _, h := range l.post {
+				if h.Name == "flowsample" {
+					n++
+				}
+			}
+		}
+		return n
+	}
+
+	tun.SetFlowSampler(new(flowsample.Sampler))
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			tun.SetFlowSampler(new(flowsample.Sampler))
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		if n := flowHooks(); n != 1 {
+			t.Fatalf("%d flow sampler hooks registered while swapping samplers; want 1", n)
+		}
+	}
+
+	tun.SetFlowSampler(nil)
+	if n := flowHooks(); n != 0 {
+		t.Errorf("%d flow sampler hooks registered after turning sampling off; want 0", n)
+	}
+}
+
+// BenchmarkPacketHooks measures the cost that packet hooks add to an
+// inbound packet. Each observer hook should add only a few ns.
+func BenchmarkPacketHooks(b *testing.B) {
+	for _, n := range []int{0, 1, 4} {
+		b.Run(fmt.Sprintf("observers=%d", n), func(b *testing.B) {
+			_, tun := newFakeTUN(b.Logf, true)
+			defer tun.Close()
+			var seen atomic.Int64
+			for i := 0; i < n; i++ {
+				_, err := tun.AddPacketHook(PacketHook{
+					Version: PacketHookVersion,
+					Name:    fmt.Sprint("observer", i),
+					Stage:   HookPostFilter,
+					In: func(*packet.Parsed, *Wrapper) filter.Response {
+						seen.Add(1)
+						return filter.Accept
+					},
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			pkt := udp4("5.6.7.8", "1.2.3.4", 89, 89)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := tun.Write(pkt, 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -22,6 +22,8 @@
 	"golang.zx2c4.com/wireguard/tun"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"tailscale.com/disco"
+	"tailscale.com/net/dropreason"
+	"tailscale.com/net/dscp"
 	"tailscale.com/net/packet"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/syncs"
@@ -31,6 +33,7 @@
 	"tailscale.com/types/logger"
 	"tailscale.com/util/clientmetric"
 	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/flowsample"
 )
 
 const maxBufferSize = device.MaxMessageSize
@@ -130,6 +133,16 @@ type Wrapper struct {
 	filter atomic.Pointer[filter.Filter]
 	// filterFlags control the verbosity of logging packet drops/accepts.
 	filterFlags filter.RunFlags
+	// hooks, if non-nil, are the registered packet hooks.
+	// hooksMu serializes changes to it.
+	hooks   atomic.Pointer[hookList]
+	hooksMu sync.Mutex
+	// flowHook, if non-nil, is the registered packet hook of the
+	// current flow sampler. It's guarded by hooksMu.
+	flowHook *PacketHook
+	// dscpPolicy, if non-nil, says which DSCP markings of accepted
+	// outbound packets are reported to OnOutboundDSCP.
+	dscpPolicy atomic.Pointer[dscp.Policy]
 
 	// PreFilterIn is the inbound filter function that runs before the main filter
 	// and therefore sees the packets that may be later dropped by it.
@@ -149,6 +162,11 @@ type Wrapper struct {
 	// PostFilterOut is the outbound filter function that runs after the main filter.
 	PostFilterOut FilterFunc
 
+	// OnOutboundDSCP, if non-nil, is called for each outbound packet
+	// to dst whose DSCP marking the policy set by SetDSCPPolicy allows,
+	// with the codepoint to mark the outer packets to dst with.
+	OnOutboundDSCP func(dst netip.Addr, outer uint8)
+
 	// OnTSMPPongReceived, if non-nil, is called whenever a TSMP pong arrives.
 	OnTSMPPongReceived func(packet.TSMPPongReply)
 
@@ -478,13 +496,22 @@ func (t *Wrapper) filterOut(p *packet.Parsed) filter.Response {
 		}
 	}
 
+	hooks := t.hooks.Load()
+	if hooks != nil {
+		if res := t.runHooks(hooks.pre, p, true); res.IsDrop() {
+			return res
+		}
+	}
+
 	filt := t.filter.Load()
 	if filt == nil {
+		dropreason.Count(dropreason.ACL)
 		return filter.Drop
 	}
 
 	if filt.RunOut(p, t.filterFlags) != filter.Accept {
 		metricPacketOutDropFilter.Add(1)
+		dropreason.Count(dropreason.ACL)
 		return filter.Drop
 	}
 
@@ -494,6 +521,16 @@ func (t *Wrapper) filterOut(p *packet.Parsed) filter.Response {
 		}
 	}
 
+	if hooks != nil {
+		if res := t.runHooks(hooks.post, p, true); res.IsDrop() {
+			return res
+		}
+	}
+	if pol := t.dscpPolicy.Load(); pol != nil && t.OnOutboundDSCP != nil {
+		if outer, ok := pol.Outer(p.DSCP()); ok {
+			t.OnOutboundDSCP(p.Dst.Addr(), outer)
+		}
+	}
 	return filter.Accept
 }
 
@@ -606,8 +643,16 @@ func (t *Wrapper) filterIn(buf []byte) filter.Response {
 		}
 	}
 
+	hooks := t.hooks.Load()
+	if hooks != nil {
+		if res := t.runHooks(hooks.pre, p, false); res.IsDrop() {
+			return res
+		}
+	}
+
 	filt := t.filter.Load()
 	if filt == nil {
+		dropreason.Count(dropreason.ACL)
 		return filter.Drop
 	}
 
@@ -626,6 +671,7 @@ func (t *Wrapper) filterIn(buf []byte) filter.Response {
 
 	if outcome != filter.Accept {
 		metricPacketInDropFilter.Add(1)
+		dropreason.Count(dropreason.ACL)
 
 		// Tell them, via TSMP, we're dropping them due to the ACL.
 		// Their host networking stack can translate this into ICMP
@@ -652,12 +698,19 @@ func (t *Wrapper) filterIn(buf []byte) filter.Response {
 		return filter.Drop
 	}
 
+	// Run the hooks before PostFilterIn, which netstack uses to take
+	// the packets it handles.
+	if hooks != nil {
+		if res := t.runHooks(hooks.post, p, false); res.IsDrop() {
+			return res
+		}
+	}
+
 	if t.PostFilterIn != nil {
 		if res := t.PostFilterIn(p, t); res.IsDrop() {
 			return res
 		}
 	}
-
 	return filter.Accept
 }
 
@@ -696,6 +749,45 @@ func (t *Wrapper) tdevWrite(buf []byte, offset int) (int, error) {
 	return t.tdev.Write(buf, offset)
 }
 
+// SetFlowSampler sets the sampler that packets accepted by the filter
+// are offered to, or turns sampling off if fs is nil.
+func (t *Wrapper) SetFlowSampler(fs *flowsample.Sampler) {
+	t.hooksMu.Lock()
+	defer t.hooksMu.Unlock()
+	if fs == nil {
+		if t.flowHook != nil {
+			t.removePacketHookLocked(t.flowHook)
+			t.flowHook = nil
+		}
+		return
+	}
+	hp, err := t.replacePacketHookLocked(t.flowHook, PacketHook{
+		Version: PacketHookVersion,
+		Name:    "flowsample",
+		Stage:   HookPostFilter,
+		In: func(p *packet.Parsed, _ *Wrapper) filter.Response {
+			fs.Sample(p, flowsample.In)
+			return filter.Accept
+		},
+		Out: func(p *packet.Parsed, _ *Wrapper) filter.Response {
+			fs.Sample(p, flowsample.Out)
+			return filter.Accept
+		},
+	})
+	if err != nil {
+		t.logf("flow sampling: %v", err)
+		return
+	}
+	t.flowHook = hp
+}
+
+// SetDSCPPolicy sets the policy for which DSCP markings of outbound
+// packets are passed to OnOutboundDSCP, or stops passing them if pol
+// is nil.
+func (t *Wrapper) SetDSCPPolicy(pol *dscp.Policy) {
+	t.dscpPolicy.Store(pol)
+}
+
 func (t *Wrapper) GetFilter() *filter.Filter {
 	return t.filter.Load()
 }
@@ -735,6 +827,7 @@ func (t *Wrapper) InjectInboundPacketBuffer(pkt *stack.PacketBuffer) error {
 // The space before &buf[offset] will be used by WireGuard.
 func (t *Wrapper) InjectInboundDirect(buf []byte, offset int) error {
 	if len(buf) > MaxPacketSize {
+		dropreason.Count(dropreason.MTUExceeded)
 		return errPacketTooBig
 	}
 	if len(buf) < offset {
@@ -756,6 +849,7 @@ func (t *Wrapper) InjectInboundCopy(packet []byte) error {
 	// We duplicate this check from InjectInboundDirect here
 	// to avoid wasting an allocation on an oversized packet.
 	if len(packet) > MaxPacketSize {
+		dropreason.Count(dropreason.MTUExceeded)
 		return errPacketTooBig
 	}
 	if len(packet) == 0 {
@@ -798,6 +892,7 @@ func (t *Wrapper) injectOutboundPong(pp *packet.Parsed, req packet.TSMPPingReque
 // Injecting an empty packet is a no-op.
 func (t *Wrapper) InjectOutbound(packet []byte) error {
 	if len(packet) > MaxPacketSize {
+		dropreason.Count(dropreason.MTUExceeded)
 		return errPacketTooBig
 	}
 	if len(packet) == 0 {
@@ -813,6 +908,7 @@ func (t *Wrapper) InjectOutbound(packet []byte) error {
 func (t *Wrapper) InjectOutboundPacketBuffer(packet *stack.PacketBuffer) error {
 	size := packet.Size()
 	if size > MaxPacketSize {
+		dropreason.Count(dropreason.MTUExceeded)
 		packet.DecRef()
 		return errPacketTooBig
 	}
@@ -834,9 +930,11 @@ func (t *Wrapper) Unwrap() tun.Device {
 	metricPacketInDrop          = clientmetric.NewCounter("tstun_in_from_wg_drop")
 	metricPacketInDropFilter    = clientmetric.NewCounter("tstun_in_from_wg_drop_filter")
 	metricPacketInDropSelfDisco = clientmetric.NewCounter("tstun_in_from_wg_drop_self_disco")
+	metricPacketInDropHook      = clientmetric.NewCounter("tstun_in_from_wg_drop_hook")
 
 	metricPacketOut              = clientmetric.NewCounter("tstun_out_to_wg")
 	metricPacketOutDrop          = clientmetric.NewCounter("tstun_out_to_wg_drop")
 	metricPacketOutDropFilter    = clientmetric.NewCounter("tstun_out_to_wg_drop_filter")
 	metricPacketOutDropSelfDisco = clientmetric.NewCounter("tstun_out_to_wg_drop_self_disco")
+	metricPacketOutDropHook      = clientmetric.NewCounter("tstun_out_to_wg_drop_hook")
 )
@@ -9,6 +9,7 @@
 	"encoding/binary"
 	"fmt"
 	"net/netip"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
@@ -18,9 +19,12 @@
 	"go4.org/netipx"
 	"golang.zx2c4.com/wireguard/tun/tuntest"
 	"tailscale.com/disco"
+	"tailscale.com/net/dropreason"
+	"tailscale.com/net/dscp"
 	"tailscale.com/net/netaddr"
 	"tailscale.com/net/packet"
 	"tailscale.com/tstest"
+	"tailscale.com/tstest/memtest"
 	"tailscale.com/tstime/mono"
 	"tailscale.com/types/ipproto"
 	"tailscale.com/types/key"
@@ -334,6 +338,7 @@ func TestFilter(t *testing.T) {
 			var n int
 			var err error
 			var filtered bool
+			aclDrops := dropreason.Value(dropreason.ACL)
 
 			if tt.dir == in {
 				// Use the side effect of updating the last
@@ -364,26 +369,78 @@ func TestFilter(t *testing.T) {
 					t.Errorf("got accept; want drop")
 				}
 			}
+			if got := dropreason.Value(dropreason.ACL) - aclDrops; filtered && got != 1 {
+				t.Errorf("ACL drops counted = %d; want 1", got)
+			}
 		})
 	}
 }
 
+func TestOutboundDSCP(t *testing.T) {
+	chtun, tun := newChannelTUN(t.Logf, true)
+	defer tun.Close()
+
+	pol, err := dscp.ParsePolicy("EF,AF41=AF31")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun.SetDSCPPolicy(pol)
+	type mark struct {
+		dst   netip.Addr
+		outer uint8
+	}
+	var got []mark
+	tun.OnOutboundDSCP = func(dst netip.Addr, outer uint8) {
+		got = append(got, mark{dst, outer})
+	}
+
+	withDSCP := func(b []byte, v uint8) []byte {
+		b[1] = v << 2
+		return b
+	}
+	var buf [MaxPacketSize]byte
+	for _, pkt := range [][]byte{
+		withDSCP(udp4("1.2.3.4", "5.6.7.8", 98, 98), 46),
+		withDSCP(udp4("1.2.3.4", "5.6.7.9", 98, 98), 34),
+		withDSCP(udp4("1.2.3.4", "5.6.7.8", 98, 98), 26), // not allowed
+		udp4("1.2.3.4", "5.6.7.8", 98, 98),               // unmarked
+	} {
+		chtun.Outbound <- pkt
+		if _, err := tun.Read(buf[:], 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []mark{
+		{netip.MustParseAddr("5.6.7.8"), 46},
+		{netip.MustParseAddr("5.6.7.9"), 26},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got marks %v; want %v", got, want)
+	}
+
+	got = nil
+	tun.SetDSCPPolicy(nil)
+	chtun.Outbound <- withDSCP(udp4("1.2.3.4", "5.6.7.8", 98, 98), 46)
+	if _, err := tun.Read(buf[:], 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("with no policy, got marks %v; want none", got)
+	}
+}
+
 func TestAllocs(t *testing.T) {
 	ftun, tun := newFakeTUN(t.Logf, false)
 	defer tun.Close()
 
 	buf := []byte{0x00}
-	err := tstest.MinAllocsPerRun(t, 0, func() {
-		_, err := ftun.Write(buf, 0)
-		if err != nil {
-			t.Errorf("write: error: %v", err)
-			return
-		}
+	memtest.Check(t, []memtest.Budget{
+		{Name: "write", Allocs: 0, Run: func() {
+			if _, err := ftun.Write(buf, 0); err != nil {
+				t.Errorf("write: error: %v", err)
+			}
+		}},
 	})
-
-	if err != nil {
-		t.Error(err)
-	}
 }
 
 func TestClose(t *testing.T) {
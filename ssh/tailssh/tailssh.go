@@ -32,8 +32,10 @@
 	"sync"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	gossh "github.com/tailscale/golang-x-crypto/ssh"
+	"golang.org/x/exp/slices"
 	"tailscale.com/envknob"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/logtail/backoff"
@@ -609,6 +611,11 @@ func (c *conn) handleSessionPostSSHAuth(s ssh.Session) {
 		s.Exit(1)
 		return
 	}
+	if !c.commandAllowedByGrants(s) {
+		io.WriteString(s.Stderr(), "Access Denied: command not permitted by tailnet policy.\r\n")
+		s.Exit(1)
+		return
+	}
 
 	ss := c.newSSHSession(s)
 	c.mu.Lock()
@@ -618,6 +625,122 @@ func (c *conn) handleSessionPostSSHAuth(s ssh.Session) {
 	ss.run()
 }
 
+// commandAllowedByGrants reports whether the peer's application
+// capabilities permit the command requested in s. Peers without the
+// tailcfg.CapabilitySSHCommands capability are only subject to the SSH
+// policy.
+func (c *conn) commandAllowedByGrants(s ssh.Session) bool {
+	cmd := s.RawCommand()
+	if s.Subsystem() == "sftp" {
+		cmd = "sftp"
+	}
+	cm := c.srv.lb.PeerCapMap(c.info.src.Addr())
+	ok, err := sshCommandAllowed(cm, c.localUser.Username, cmd)
+	if err != nil {
+		c.logf("ssh: checking %s grants: %v", tailcfg.CapabilitySSHCommands, err)
+		return false
+	}
+	if !ok {
+		c.logf("ssh: command %q as %q not granted to %v", cmd, c.localUser.Username, c.info.uprof.LoginName)
+	}
+	return ok
+}
+
+// sshCommandAllowed reports whether cm permits running the command line
+// cmd as localUser. It returns true if cm doesn't grant
+// tailcfg.CapabilitySSHCommands at all.
+func sshCommandAllowed(cm tailcfg.PeerCapMap, localUser, cmd string) (bool, error) {
+	if !cm.HasCapability(tailcfg.CapabilitySSHCommands) {
+		return true, nil
+	}
+	return tailcfg.SSHCommandsCap.Allows(cm, func(v tailcfg.SSHCommandsCapValue) bool {
+		if len(v.Users) > 0 && !slices.Contains(v.Users, localUser) {
+			return false
+		}
+		for _, pat := range v.Commands {
+			if matchCommand(pat, cmd) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// shellMetachars are the characters that can make the shell run a
+// command line as more than one command with the arguments the line
+// shows, through separators, substitutions, redirections, expansions or
+// quoting. Command lines containing them never match a pattern.
+const shellMetachars = "`$;&|<>(){}[]*?~!#\\\"'\n\r"
+
+// matchCommand reports whether the command line cmd matches pat, a
+// tailcfg.SSHCommandsCapValue pattern. Both are split into arguments
+// on whitespace, and each argument of cmd must match the pattern's
+// argument in the same position. Within an argument, "*" matches across
+// "/", so that "cat /var/log/*" allows "cat /var/log/nginx/access.log",
+// but never across arguments.
+//
+// Command lines containing shellMetachars don't match any pattern, as
+// the shell wouldn't run them as the plain argument list matched.
+func matchCommand(pat, cmd string) bool {
+	if strings.ContainsAny(cmd, shellMetachars) {
+		return false
+	}
+	pats, args := strings.Fields(pat), strings.Fields(cmd)
+	if len(pats) != len(args) {
+		return false
+	}
+	for i := range pats {
+		if !matchCommandArg(pats[i], args[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchCommandArg reports whether the command line argument arg matches
+// the pattern argument pat. "*" matches any run of characters, "?"
+// matches any single character, and "\" makes the character after it
+// literal.
+func matchCommandArg(pat, arg string) bool {
+	p, c := 0, 0
+	starP, starC := -1, 0 // positions after the last "*", to backtrack to
+	for c < len(arg) {
+		if p < len(pat) {
+			switch pat[p] {
+			case '*':
+				p++
+				starP, starC = p, c
+				continue
+			case '?':
+				_, n := utf8.DecodeRuneInString(arg[c:])
+				p, c = p+1, c+n
+				continue
+			case '\\':
+				if p+1 < len(pat) && pat[p+1] == arg[c] {
+					p, c = p+2, c+1
+					continue
+				}
+			default:
+				if pat[p] == arg[c] {
+					p, c = p+1, c+1
+					continue
+				}
+			}
+		}
+		if starP < 0 {
+			return false
+		}
+		// Let the last "*" match one more character and retry.
+		_, n := utf8.DecodeRuneInString(arg[starC:])
+		starC += n
+		p, c = starP, starC
+	}
+	for p < len(pat) && pat[p] == '*' {
+		p++
+	}
+	return p == len(pat)
+}
+
 // resolveTerminalActionLocked either returns action0 (if it's Accept or Reject) or
 // else loops, fetching new SSHActions from the control plane.
 //
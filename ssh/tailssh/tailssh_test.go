@@ -466,3 +466,88 @@ func TestAcceptEnvPair(t *testing.T) {
 		}
 	}
 }
+
+func TestMatchCommand(t *testing.T) {
+	tests := []struct {
+		pat, cmd string
+		want     bool
+	}{
+		{"", "", true},
+		{"", "x", false},
+		{"*", "", false},
+		{"*", "a", true},
+		{"*", "a b/c", false},
+		{"* *", "a b/c", true},
+		{"a  b", "a\tb", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abbbd", false},
+		{"a*c", "ab c", false},
+		{"a*b*c", "a/x/b/y/c", true},
+		{"?", "é", true},
+		{"??", "é", false},
+		{`a\b`, "ab", true},
+		{`a\?`, "ab", false},
+		{"*", "*", false},
+		{"a *", "a b;c", false},
+		{"a *", "a $(b)", false},
+		{"a *", "a `b`", false},
+		{"a *", "a 'b c'", false},
+		{"a *", "a b|c", false},
+		{"a *", "a b>c", false},
+		{"a *", "a b\nc", false},
+	}
+	for _, tt := range tests {
+		if got := matchCommand(tt.pat, tt.cmd); got != tt.want {
+			t.Errorf("matchCommand(%q, %q) = %v; want %v", tt.pat, tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestSSHCommandAllowed(t *testing.T) {
+	cm := tailcfg.PeerCapMap{
+		tailcfg.CapabilitySSHCommands: {
+			`{"commands":["uptime","systemctl status *","cat /var/log/*","ls -?"]}`,
+			`{"users":["root"],"commands":["","*","rm -rf /tmp/*"]}`,
+		},
+	}
+	tests := []struct {
+		name string
+		cm   tailcfg.PeerCapMap
+		user string
+		cmd  string
+		want bool
+	}{
+		{"no_cap", nil, "alice", "rm -rf /", true},
+		{"exact", cm, "alice", "uptime", true},
+		{"pattern", cm, "alice", "systemctl status sshd", true},
+		{"denied", cm, "alice", "reboot", false},
+		{"star_matches_slash", cm, "alice", "cat /var/log/nginx/access.log", true},
+		{"star_is_anchored", cm, "alice", "cat /etc/shadow /var/log/x", false},
+		{"question_mark", cm, "alice", "ls -l", true},
+		{"question_mark_one_char", cm, "alice", "ls -la", false},
+		{"user_scoped_slash", cm, "root", "rm -rf /tmp/x", true},
+		{"star_one_arg", cm, "alice", "systemctl status sshd; reboot", false},
+		{"star_not_across_args", cm, "alice", "systemctl status sshd reboot", false},
+		{"substitution", cm, "alice", "systemctl status $(reboot)", false},
+		{"user_scoped_args", cm, "root", "reboot now", false},
+		{"shell_denied", cm, "alice", "", false},
+		{"user_scoped", cm, "root", "reboot", true},
+		{"user_scoped_shell", cm, "root", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sshCommandAllowed(tt.cm, tt.user, tt.cmd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+
+	bad := tailcfg.PeerCapMap{tailcfg.CapabilitySSHCommands: {`{"commands":"uptime"}`}}
+	if ok, err := sshCommandAllowed(bad, "alice", "uptime"); ok || err == nil {
+		t.Errorf("malformed cap value: got (%v, %v); want (false, error)", ok, err)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tailcfg
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var (
+	peerCapsMu sync.Mutex
+	peerCaps   = map[string]peerCapValidator{}
+)
+
+// peerCapValidator decodes and validates one raw value of a registered
+// capability.
+type peerCapValidator func(RawMessage) error
+
+// PeerCapType is a capability whose values in a PeerCapMap are of
+// the Go type T. It's returned by RegisterPeerCap.
+type PeerCapType[T any] struct {
+	name     string
+	validate func(T) error // or nil
+}
+
+// RegisterPeerCap registers T as the type of the values granted for
+// the capability name, typically at init time by the application that
+// defines the capability. Values are decoded from JSON using
+// encoding/json and, if validate is non-nil, checked with it.
+//
+// It panics if name is empty or already registered.
+func RegisterPeerCap[T any](name string, validate func(T) error) *PeerCapType[T] {
+	if name == "" {
+		panic("tailcfg: RegisterPeerCap with empty name")
+	}
+	c := &PeerCapType[T]{name: name, validate: validate}
+	peerCapsMu.Lock()
+	defer peerCapsMu.Unlock()
+	if _, dup := peerCaps[name]; dup {
+		panic(fmt.Sprintf("tailcfg: peer capability %q registered twice", name))
+	}
+	peerCaps[name] = func(raw RawMessage) error {
+		_, err := c.decode(raw)
+		return err
+	}
+	return c
+}
+
+// Name returns the capability name.
+func (c *PeerCapType[T]) Name() string { return c.name }
+
+func (c *PeerCapType[T]) decode(raw RawMessage) (T, error) {
+	var v T
+	if err := json.Unmarshal([]byte(raw), &v); err != nil {
+		return v, fmt.Errorf("decoding value of capability %q: %w", c.name, err)
+	}
+	if c.validate != nil {
+		if err := c.validate(v); err != nil {
+			return v, fmt.Errorf("invalid value of capability %q: %w", c.name, err)
+		}
+	}
+	return v, nil
+}
+
+// Values returns the decoded and validated values of the capability in
+// cm. It returns (nil, nil) if cm doesn't grant the capability.
+func (c *PeerCapType[T]) Values(cm PeerCapMap) ([]T, error) {
+	raws, ok := cm[c.name]
+	if !ok || len(raws) == 0 {
+		return nil, nil
+	}
+	ret := make([]T, 0, len(raws))
+	for _, raw := range raws {
+		v, err := c.decode(raw)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, v)
+	}
+	return ret, nil
+}
+
+// Allows reports whether cm grants the capability with at least one
+// value for which allow returns true. It returns an error if any value
+// fails to decode or validate, in which case callers should deny.
+func (c *PeerCapType[T]) Allows(cm PeerCapMap, allow func(T) bool) (bool, error) {
+	vals, err := c.Values(cm)
+	if err != nil {
+		return false, err
+	}
+	for _, v := range vals {
+		if allow(v) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// UnmarshalCapJSON decodes the values of the capability cap in cm as
+// JSON values of type T, without requiring T to be registered.
+func UnmarshalCapJSON[T any](cm PeerCapMap, cap string) ([]T, error) {
+	return (&PeerCapType[T]{name: cap}).Values(cm)
+}
+
+// ValidatePeerCapMap checks that every value in cm of a registered
+// capability decodes into its registered type and passes its
+// validation func. Unregistered capabilities are ignored.
+func ValidatePeerCapMap(cm PeerCapMap) error {
+	names := make([]string, 0, len(cm))
+	for name := range cm {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	peerCapsMu.Lock()
+	defer peerCapsMu.Unlock()
+	for _, name := range names {
+		validate, ok := peerCaps[name]
+		if !ok {
+			continue
+		}
+		for _, raw := range cm[name] {
+			if err := validate(raw); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tailcfg
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type testPathCap struct {
+	Path string `json:"path"`
+}
+
+var testPathCapType = RegisterPeerCap("tailscale.com/test/cap/paths", func(v testPathCap) error {
+	if v.Path == "" {
+		return errors.New("empty path")
+	}
+	return nil
+})
+
+func TestPeerCapType(t *testing.T) {
+	var cm PeerCapMap
+	if err := json.Unmarshal([]byte(`{
+		"tailscale.com/test/cap/paths": [{"path": "/a"}, {"path": "/b"}],
+		"tailscale.com/test/cap/other": null
+	}`), &cm); err != nil {
+		t.Fatal(err)
+	}
+	if !cm.HasCapability("tailscale.com/test/cap/other") {
+		t.Error("missing valueless capability")
+	}
+
+	got, err := testPathCapType.Values(cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []testPathCap{{"/a"}, {"/b"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Values = %v; want %v", got, want)
+	}
+	if err := ValidatePeerCapMap(cm); err != nil {
+		t.Errorf("ValidatePeerCapMap: %v", err)
+	}
+
+	got, err = UnmarshalCapJSON[testPathCap](cm, "tailscale.com/test/cap/other")
+	if err != nil || got != nil {
+		t.Errorf("UnmarshalCapJSON of valueless cap = %v, %v; want nil, nil", got, err)
+	}
+
+	bad := PeerCapMap{"tailscale.com/test/cap/paths": {`{"path": ""}`}}
+	if _, err := testPathCapType.Values(bad); err == nil {
+		t.Error("Values of invalid value succeeded")
+	}
+	if err := ValidatePeerCapMap(bad); err == nil {
+		t.Error("ValidatePeerCapMap of invalid value succeeded")
+	}
+	if err := ValidatePeerCapMap(PeerCapMap{"tailscale.com/test/cap/paths": {`[1]`}}); err == nil {
+		t.Error("ValidatePeerCapMap of mistyped value succeeded")
+	}
+}
+
+func TestRawMessageRoundTrip(t *testing.T) {
+	in := CapGrant{CapMap: PeerCapMap{"c": {`{"a":1}`, `"s"`}}}
+	j, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"Dsts":null,"CapMap":{"c":[{"a":1},"s"]}}`; string(j) != want {
+		t.Errorf("got %s; want %s", j, want)
+	}
+	var out CapGrant
+	if err := json.Unmarshal(j, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip = %+v; want %+v", out, in)
+	}
+}
+
+func TestSSHCommandsCapValidation(t *testing.T) {
+	for _, tt := range []struct {
+		pat  string
+		good bool
+	}{
+		{`cat /var/log/*`, true},
+		{`echo \*`, true},
+		{`echo \\`, true},
+		{`echo \`, false},
+		{`echo \\\`, false},
+	} {
+		v, err := json.Marshal(SSHCommandsCapValue{Commands: []string{tt.pat}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ValidatePeerCapMap(PeerCapMap{CapabilitySSHCommands: {RawMessage(v)}})
+		if (err == nil) != tt.good {
+			t.Errorf("pattern %q: ValidatePeerCapMap = %v; want valid: %v", tt.pat, err, tt.good)
+		}
+	}
+}
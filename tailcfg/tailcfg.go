@@ -78,7 +78,10 @@
 //	39: 2022-08-15: clients can talk Noise over arbitrary HTTPS port
 //	40: 2022-08-22: added Node.KeySignature, PeersChangedPatch.KeySignature
 //	41: 2022-08-30: uses 100.100.100.100 for route-less ExtraRecords if global nameservers is set
-const CurrentCapabilityVersion CapabilityVersion = 41
+//	42: 2022-09-01: supports CapGrant.CapMap
+//	43: 2022-09-01: selects among subnet routers using Node.{StandbyRoutes,RoutePriority}
+//	44: 2022-09-01: sends HealthReportRequest when it has CapabilityHealthReport
+const CurrentCapabilityVersion CapabilityVersion = 44
 
 type StableID string
 
@@ -203,6 +206,19 @@ type Node struct {
 	// values from Addresses that are in AllowedIPs.
 	PrimaryRoutes []netip.Prefix `json:",omitempty"`
 
+	// StandbyRoutes are the subnet routes this node is approved to
+	// serve but isn't the primary subnet router for. Unlike
+	// PrimaryRoutes, they're not in AllowedIPs. Clients may route
+	// them via this node instead of the primary when it's the better
+	// path.
+	StandbyRoutes []netip.Prefix `json:",omitempty"`
+
+	// RoutePriority is a hint of how much to prefer this node as a
+	// subnet router over other nodes serving the same routes, with
+	// higher preferred. Clients use it to choose between healthy
+	// routers whose latencies are about the same.
+	RoutePriority int `json:",omitempty"`
+
 	// LastSeen is when the node was last online. It is not
 	// updated when Online is true. It is nil if the current
 	// node doesn't have permission to know, or the node
@@ -487,6 +503,12 @@ type Hostinfo struct {
 	Userspace       opt.Bool       `json:",omitempty"` // if the client is running in userspace (netstack) mode
 	UserspaceRouter opt.Bool       `json:",omitempty"` // if the client's subnet router is running in userspace (netstack) mode
 
+	// PeerRelay is whether the node offers to relay packets between
+	// peers that can't reach each other directly (true), or only
+	// understands packets relayed to it through such a peer (false).
+	// It's empty for nodes that don't support peer relays.
+	PeerRelay opt.Bool `json:",omitempty"`
+
 	// NOTE: any new fields containing pointers in this type
 	//       require changes to Hostinfo.Equal.
 }
@@ -979,6 +1001,46 @@ type CapGrant struct {
 	// FilterRule.SrcIPs are granted to the destination IP,
 	// matched by Dsts.
 	Caps []string `json:",omitempty"`
+
+	// CapMap is like Caps, but each capability can also carry
+	// application-defined JSON values (for example, the paths or
+	// commands a peer may use). The keys of CapMap are granted
+	// in addition to Caps.
+	//
+	// See RegisterPeerCap for decoding the values into Go types.
+	CapMap PeerCapMap `json:",omitempty"`
+}
+
+// PeerCapMap is a map of capability names to the values granted for
+// them. A capability with no values is present with a nil or empty
+// slice.
+type PeerCapMap map[string][]RawMessage
+
+// HasCapability reports whether cm contains the capability cap.
+func (cm PeerCapMap) HasCapability(cap string) bool {
+	_, ok := cm[cap]
+	return ok
+}
+
+// RawMessage is a raw encoded JSON value. It's like json.RawMessage,
+// but is a string so that it's immutable and can be held in views.
+type RawMessage string
+
+// MarshalJSON returns r as its raw JSON encoding.
+func (r RawMessage) MarshalJSON() ([]byte, error) {
+	if r == "" {
+		return []byte("null"), nil
+	}
+	return []byte(r), nil
+}
+
+// UnmarshalJSON sets *r to a copy of data.
+func (r *RawMessage) UnmarshalJSON(data []byte) error {
+	if r == nil {
+		return errors.New("RawMessage: UnmarshalJSON on nil pointer")
+	}
+	*r = RawMessage(data)
+	return nil
 }
 
 // FilterRule represents one rule in a packet filter.
@@ -1477,6 +1539,8 @@ func (n *Node) Equal(n2 *Node) bool {
 		eqCIDRs(n.Addresses, n2.Addresses) &&
 		eqCIDRs(n.AllowedIPs, n2.AllowedIPs) &&
 		eqCIDRs(n.PrimaryRoutes, n2.PrimaryRoutes) &&
+		eqCIDRs(n.StandbyRoutes, n2.StandbyRoutes) &&
+		n.RoutePriority == n2.RoutePriority &&
 		eqStrings(n.Endpoints, n2.Endpoints) &&
 		n.DERP == n2.DERP &&
 		n.Hostinfo.Equal(n2.Hostinfo) &&
@@ -1563,6 +1627,7 @@ type Oauth2Token struct {
 	CapabilitySSH                = "https://tailscale.com/cap/ssh"                   // feature enabled/available
 	CapabilitySSHRuleIn          = "https://tailscale.com/cap/ssh-rule-in"           // some SSH rule reach this node
 	CapabilityDataPlaneAuditLogs = "https://tailscale.com/cap/data-plane-audit-logs" // feature enabled
+	CapabilityHealthReport       = "https://tailscale.com/cap/health-report"         // tailnet opted in to HealthReportRequests
 
 	// These are the capabilities that the peer nodes have as listed in
 	// MapResponse.Peers[].Capabilities.
@@ -1581,8 +1646,46 @@ type Oauth2Token struct {
 	CapabilityDebugPeer = "https://tailscale.com/cap/debug-peer"
 	// CapabilityWakeOnLAN grants the ability to send a Wake-On-LAN packet.
 	CapabilityWakeOnLAN = "https://tailscale.com/cap/wake-on-lan"
+	// CapabilitySSHCommands, when granted with values in a
+	// CapGrant.CapMap, restricts which commands the peer may run over
+	// Tailscale SSH on this node. Its values are SSHCommandsCapValue.
+	// Without it, Tailscale SSH policy alone decides.
+	CapabilitySSHCommands = "https://tailscale.com/cap/ssh-commands"
+	// CapabilityPeerRelay, in a node's own capabilities, is the
+	// tailnet policy's consent for the node to relay packets between
+	// its peers when it advertises Hostinfo.PeerRelay.
+	CapabilityPeerRelay = "https://tailscale.com/cap/peer-relay"
 )
 
+// SSHCommandsCapValue is a value of the CapabilitySSHCommands capability.
+type SSHCommandsCapValue struct {
+	// Users optionally limits this value to sessions as these local
+	// users. Empty means any user.
+	Users []string `json:"users,omitempty"`
+
+	// Commands are patterns of the full command lines the peer may
+	// run. Patterns and command lines are split into arguments on
+	// whitespace, and each argument must match the pattern's
+	// argument in the same position, in which "*" matches any run of
+	// characters, including "/" but not whitespace, "?" matches any
+	// single character, and "\" makes the character after it
+	// literal. Command lines containing shell metacharacters, such
+	// as ";", "|", "$" or quotes, never match. Interactive sessions
+	// have an empty command line, and SFTP sessions have the command
+	// line "sftp".
+	Commands []string `json:"commands"`
+}
+
+// SSHCommandsCap is the registered type of CapabilitySSHCommands.
+var SSHCommandsCap = RegisterPeerCap(CapabilitySSHCommands, func(v SSHCommandsCapValue) error {
+	for _, pat := range v.Commands {
+		if n := len(pat) - len(strings.TrimRight(pat, `\`)); n%2 == 1 {
+			return fmt.Errorf("bad command pattern %q: trailing backslash", pat)
+		}
+	}
+	return nil
+})
+
 // SetDNSRequest is a request to add a DNS record.
 //
 // This is used for ACME DNS-01 challenges (so people can use
@@ -1620,6 +1723,47 @@ type SetDNSRequest struct {
 // SetDNSResponse is the response to a SetDNSRequest.
 type SetDNSResponse struct{}
 
+// HealthReportRequest is a node's summary of its health, for the
+// control plane to show the tailnet's degraded nodes in one place.
+//
+// Nodes with CapabilityHealthReport send one every so often, and
+// sooner when their warnings change, over Noise to:
+//
+//	https://login.tailscale.com/machine/health-report
+type HealthReportRequest struct {
+	// Version is the client's capabilities (CurrentCapabilityVersion).
+	Version CapabilityVersion
+
+	// NodeKey is the client's current node key.
+	NodeKey key.NodePublic
+
+	// Healthy is whether the node has no health warnings.
+	Healthy bool
+
+	// Warnings are the node's current health warnings, sorted by
+	// code.
+	Warnings []HealthReportWarning `json:",omitempty"`
+
+	// Metrics are the values of a few of the node's client metrics
+	// that indicate connectivity trouble, by metric name.
+	Metrics map[string]int64 `json:",omitempty"`
+}
+
+// HealthReportWarning is a health warning in a HealthReportRequest.
+type HealthReportWarning struct {
+	Code      string // stable, machine-readable kind, such as "derp-home-disconnected"
+	Subsystem string // such as "derp" or "dns"
+	Severity  string // "low", "medium" or "high"
+	Text      string // human-readable description
+
+	// RootCause is whether the warning isn't known to be a
+	// consequence of another in the same report.
+	RootCause bool `json:",omitempty"`
+}
+
+// HealthReportResponse is the response to a HealthReportRequest.
+type HealthReportResponse struct{}
+
 // SSHPolicy is the policy for how to handle incoming SSH connections
 // over Tailscale.
 type SSHPolicy struct {
@@ -1897,6 +2041,37 @@ type TKAInitFinishRequest struct {
 // key authority.
 type TKAInitFinishResponse struct{}
 
+// TKASubmitSignatureRequest transmits a node-key signature to the
+// control plane, to be distributed with the signed node.
+type TKASubmitSignatureRequest struct {
+	NodeID NodeID // NodeID of the signing node
+
+	// Signature is the node-key signature being submitted.
+	Signature tkatype.MarshaledSignature
+}
+
+// TKASubmitSignatureResponse is the response to a
+// TKASubmitSignatureRequest.
+type TKASubmitSignatureResponse struct{}
+
+// TKASyncSendRequest submits AUMs made by the node, such as a
+// checkpoint, for control to add to the tailnet key authority.
+type TKASyncSendRequest struct {
+	NodeID NodeID // NodeID of the node submitting the AUMs
+
+	// Head is the AUMHash of the node's head before the AUMs in
+	// MissingAUMs, which build on it.
+	Head string // tka.AUMHash.String
+
+	MissingAUMs []tkatype.MarshaledAUM
+}
+
+// TKASyncSendResponse is the response to a TKASyncSendRequest.
+type TKASyncSendResponse struct {
+	// Head is control's head after applying the AUMs.
+	Head string // tka.AUMHash.String
+}
+
 // TKAMapRequest describes request parameters relating to the tailnet key
 // authority instance on this node. This information is transmitted as
 // part of the MapRequest.
@@ -1930,6 +2105,25 @@ type TKAMapResponse struct {
 	// TODO(tom): Implement AUM synchronization, probably as noise endpoints
 	// /machine/tka/sync/offer & /machine/tka/sync/send.
 	WantSync bool `json:",omitempty"`
+
+	// Checkpoint, if non-nil, asks the node (which must hold a trusted
+	// key) to add a checkpoint AUM whenever the policy calls for one.
+	// Control sends it to at most one node of the tailnet at a time.
+	// A TKAMapResponse without it withdraws the request. The node
+	// submits the checkpoints it makes with a TKASyncSendRequest.
+	Checkpoint *TKACheckpointPolicy `json:",omitempty"`
+}
+
+// TKACheckpointPolicy describes when a node should add a checkpoint AUM
+// to the tailnet key authority. See tka.CheckpointPolicy.
+type TKACheckpointPolicy struct {
+	// MaxUpdates, if positive, is the number of AUMs since the last
+	// checkpoint after which a new checkpoint is due.
+	MaxUpdates int `json:",omitempty"`
+
+	// MaxAge, if positive, is how long after the last checkpoint a
+	// new one is due, if there have been updates since.
+	MaxAge time.Duration `json:",omitempty"`
 }
 
 // DerpMagicIP is a fake WireGuard endpoint IP address that means to
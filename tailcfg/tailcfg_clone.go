@@ -55,6 +55,7 @@ func (src *Node) Clone() *Node {
 	dst.Hostinfo = src.Hostinfo
 	dst.Tags = append(src.Tags[:0:0], src.Tags...)
 	dst.PrimaryRoutes = append(src.PrimaryRoutes[:0:0], src.PrimaryRoutes...)
+	dst.StandbyRoutes = append(src.StandbyRoutes[:0:0], src.StandbyRoutes...)
 	if dst.LastSeen != nil {
 		dst.LastSeen = new(time.Time)
 		*dst.LastSeen = *src.LastSeen
@@ -87,6 +88,8 @@ func (src *Node) Clone() *Node {
 	Created                 time.Time
 	Tags                    []string
 	PrimaryRoutes           []netip.Prefix
+	StandbyRoutes           []netip.Prefix
+	RoutePriority           int
 	LastSeen                *time.Time
 	Online                  *bool
 	KeepAlive               bool
@@ -136,6 +139,7 @@ func (src *Hostinfo) Clone() *Hostinfo {
 	Cloud           string
 	Userspace       opt.Bool
 	UserspaceRouter opt.Bool
+	PeerRelay       opt.Bool
 }{})
 
 // Clone makes a deep copy of NetInfo.
@@ -152,6 +152,10 @@ func (v NodeView) Tags() views.Slice[string]       { return views.SliceOf(v.ж.T
 func (v NodeView) PrimaryRoutes() views.IPPrefixSlice {
 	return views.IPPrefixSliceOf(v.ж.PrimaryRoutes)
 }
+func (v NodeView) StandbyRoutes() views.IPPrefixSlice {
+	return views.IPPrefixSliceOf(v.ж.StandbyRoutes)
+}
+func (v NodeView) RoutePriority() int { return v.ж.RoutePriority }
 func (v NodeView) LastSeen() *time.Time {
 	if v.ж.LastSeen == nil {
 		return nil
@@ -195,6 +199,8 @@ func (v NodeView) Equal(v2 NodeView) bool            { return v.ж.Equal(v2.ж)
 	Created                 time.Time
 	Tags                    []string
 	PrimaryRoutes           []netip.Prefix
+	StandbyRoutes           []netip.Prefix
+	RoutePriority           int
 	LastSeen                *time.Time
 	Online                  *bool
 	KeepAlive               bool
@@ -273,6 +279,7 @@ func (v HostinfoView) SSH_HostKeys() views.Slice[string] { return views.SliceOf(
 func (v HostinfoView) Cloud() string                     { return v.ж.Cloud }
 func (v HostinfoView) Userspace() opt.Bool               { return v.ж.Userspace }
 func (v HostinfoView) UserspaceRouter() opt.Bool         { return v.ж.UserspaceRouter }
+func (v HostinfoView) PeerRelay() opt.Bool               { return v.ж.PeerRelay }
 func (v HostinfoView) Equal(v2 HostinfoView) bool        { return v.ж.Equal(v2.ж) }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
@@ -298,6 +305,7 @@ func (v HostinfoView) Equal(v2 HostinfoView) bool        { return v.ж.Equal(v2.
 	Cloud           string
 	Userspace       opt.Bool
 	UserspaceRouter opt.Bool
+	PeerRelay       opt.Bool
 }{})
 
 // View returns a readonly view of NetInfo.
@@ -92,6 +92,15 @@ func (b *UpdateBuilder) SetKeyMeta(keyID tkatype.KeyID, meta map[string]string)
 	return b.mkUpdate(AUM{MessageKind: AUMUpdateKey, Meta: meta, KeyID: keyID})
 }
 
+// Checkpoint adds a checkpoint AUM, which records the full state of
+// the authority so that it can be computed without earlier AUMs.
+// See CheckpointPolicy.
+func (b *UpdateBuilder) Checkpoint() error {
+	state := b.state.Clone()
+	state.LastAUMHash = nil
+	return b.mkUpdate(AUM{MessageKind: AUMCheckpoint, State: &state})
+}
+
 // Finalize returns the set of update message to actuate the update.
 func (b *UpdateBuilder) Finalize() ([]AUM, error) {
 	if len(b.out) > 0 {
@@ -0,0 +1,91 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tka
+
+import (
+	"fmt"
+	"time"
+)
+
+// CheckpointPolicy describes when a checkpoint AUM should be added to
+// the authority, so that computing the state from storage (which walks
+// back to the most recent checkpoint) stays fast and older AUMs can be
+// compacted away.
+//
+// The policy is distributed by control, which is expected to give it
+// to a single node holding a trusted key at a time, so that nodes
+// don't race to generate competing checkpoints.
+type CheckpointPolicy struct {
+	// MaxUpdates, if positive, is the number of AUMs since the last
+	// checkpoint after which a new checkpoint is due.
+	MaxUpdates int
+
+	// MaxAge, if positive, is how long after the last checkpoint
+	// was stored a new one is due, provided there have been updates
+	// since. The age is measured from when this node stored the
+	// checkpoint, as AUMs don't carry timestamps.
+	MaxAge time.Duration
+}
+
+// maxCheckpointScan bounds how far back CheckpointDue looks for the
+// most recent checkpoint. It's a var for tests.
+var maxCheckpointScan = 2000
+
+// CheckpointDue reports whether the policy p calls for a checkpoint
+// to be added after the authority's current head, at time now.
+func (a *Authority) CheckpointDue(storage Chonk, p CheckpointPolicy, now time.Time) (bool, error) {
+	if p.MaxUpdates <= 0 && p.MaxAge <= 0 {
+		return false, nil
+	}
+	n, last, err := a.updatesSinceCheckpoint(storage)
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		return false, nil
+	}
+	if n >= maxCheckpointScan {
+		// Too far from the last checkpoint to even find it.
+		return true, nil
+	}
+	if p.MaxUpdates > 0 && n >= p.MaxUpdates {
+		return true, nil
+	}
+	if p.MaxAge > 0 {
+		at, err := storage.CommitTime(last)
+		if err != nil {
+			return false, fmt.Errorf("reading commit time of %x: %v", last, err)
+		}
+		if !at.IsZero() && now.Sub(at) >= p.MaxAge {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// updatesSinceCheckpoint returns the number of AUMs after the most
+// recent checkpoint in the active chain, and the hash of that
+// checkpoint. If the oldest known AUM is reached first, it's treated
+// as the checkpoint. If there's no checkpoint within maxCheckpointScan
+// AUMs, n is maxCheckpointScan and checkpoint is zero.
+func (a *Authority) updatesSinceCheckpoint(storage Chonk) (n int, checkpoint AUMHash, err error) {
+	cur := a.head
+	oldest := a.oldestAncestor.Hash()
+	for i := 0; i < maxCheckpointScan; i++ {
+		h := cur.Hash()
+		if cur.MessageKind == AUMCheckpoint || h == oldest {
+			return n, h, nil
+		}
+		parent, ok := cur.Parent()
+		if !ok {
+			return n, h, nil
+		}
+		if cur, err = storage.AUM(parent); err != nil {
+			return 0, AUMHash{}, fmt.Errorf("reading AUM %x: %v", parent, err)
+		}
+		n++
+	}
+	return maxCheckpointScan, AUMHash{}, nil
+}
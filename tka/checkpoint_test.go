@@ -0,0 +1,97 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tka
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckpointPolicy(t *testing.T) {
+	pub, priv := testingKey25519(t, 1)
+	key := Key{Kind: Key25519, Public: pub, Votes: 2}
+
+	storage := &Mem{}
+	a, _, err := Create(storage, State{
+		Keys:               []Key{key},
+		DisablementSecrets: [][]byte{disablementKDF([]byte{1, 2, 3})},
+	}, signer25519(priv))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+
+	update := func(fn func(b *UpdateBuilder) error) {
+		t.Helper()
+		b := a.NewUpdater(signer25519(priv))
+		if err := fn(b); err != nil {
+			t.Fatal(err)
+		}
+		updates, err := b.Finalize()
+		if err != nil {
+			t.Fatalf("Finalize() failed: %v", err)
+		}
+		if err := a.Inform(storage, updates); err != nil {
+			t.Fatalf("could not apply generated updates: %v", err)
+		}
+	}
+	setVotes := func(votes uint) {
+		update(func(b *UpdateBuilder) error { return b.SetKeyVote(key.ID(), votes) })
+	}
+	now := time.Now()
+	checkDue := func(p CheckpointPolicy, at time.Time, want bool) {
+		t.Helper()
+		got, err := a.CheckpointDue(storage, p, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("CheckpointDue(%+v) = %v; want %v", p, got, want)
+		}
+	}
+
+	byCount := CheckpointPolicy{MaxUpdates: 3}
+	byAge := CheckpointPolicy{MaxAge: 24 * time.Hour}
+	checkDue(byCount, now, false)
+	checkDue(byAge, now.Add(48*time.Hour), false) // no updates since genesis
+
+	setVotes(3)
+	setVotes(4)
+	checkDue(byCount, now, false)
+	checkDue(byAge, now, false)
+	checkDue(byAge, now.Add(48*time.Hour), true)
+	checkDue(CheckpointPolicy{}, now.Add(48*time.Hour), false)
+
+	setVotes(5)
+	checkDue(byCount, now, true)
+
+	// A checkpoint too far back to find is due, whatever the policy.
+	defer func(old int) { maxCheckpointScan = old }(maxCheckpointScan)
+	maxCheckpointScan = 2
+	checkDue(byAge, now, true)
+	maxCheckpointScan = 2000
+
+	update(func(b *UpdateBuilder) error { return b.Checkpoint() })
+	checkDue(byCount, now, false)
+	checkDue(byAge, now.Add(48*time.Hour), false)
+	if got := a.head.MessageKind; got != AUMCheckpoint {
+		t.Fatalf("head is %v; want checkpoint", got)
+	}
+	k, err := a.state.GetKey(key.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Votes != 5 {
+		t.Errorf("key.Votes after checkpoint = %d; want 5", k.Votes)
+	}
+
+	// The state must still be computable from storage.
+	a2, err := Open(storage)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	if a2.Head() != a.Head() {
+		t.Errorf("reopened head = %x; want %x", a2.Head(), a.Head())
+	}
+}
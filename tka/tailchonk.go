@@ -10,7 +10,9 @@
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/fxamacker/cbor/v2"
 	"tailscale.com/atomicfile"
@@ -53,6 +55,13 @@ type Chonk interface {
 	// as a hint to pick the correct chain in the event that the Chonk stores
 	// multiple distinct chains.
 	LastActiveAncestor() (*AUMHash, error)
+
+	// CommitTime returns when the AUM with the specified digest was
+	// first stored. The zero time is returned if that's not known,
+	// such as for AUMs stored by older versions.
+	//
+	// If the AUM does not exist, then os.ErrNotExist is returned.
+	CommitTime(hash AUMHash) (time.Time, error)
 }
 
 // Mem implements in-memory storage of TKA state, suitable for
@@ -63,6 +72,7 @@ type Mem struct {
 	l           sync.RWMutex
 	aums        map[AUMHash]AUM
 	parentIndex map[AUMHash][]AUMHash
+	commitTimes map[AUMHash]time.Time
 
 	lastActiveAncestor *AUMHash
 }
@@ -143,12 +153,17 @@ func (c *Mem) CommitVerifiedAUMs(updates []AUM) error {
 	if c.aums == nil {
 		c.parentIndex = make(map[AUMHash][]AUMHash, 64)
 		c.aums = make(map[AUMHash]AUM, 64)
+		c.commitTimes = make(map[AUMHash]time.Time, 64)
 	}
 
+	now := time.Now()
 updateLoop:
 	for _, aum := range updates {
 		aumHash := aum.Hash()
 		c.aums[aumHash] = aum
+		if _, ok := c.commitTimes[aumHash]; !ok {
+			c.commitTimes[aumHash] = now
+		}
 
 		parent, ok := aum.Parent()
 		if ok {
@@ -164,6 +179,18 @@ func (c *Mem) CommitVerifiedAUMs(updates []AUM) error {
 	return nil
 }
 
+// CommitTime returns when the AUM with the specified digest was
+// first stored.
+func (c *Mem) CommitTime(hash AUMHash) (time.Time, error) {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	t, ok := c.commitTimes[hash]
+	if !ok {
+		return time.Time{}, os.ErrNotExist
+	}
+	return t, nil
+}
+
 // FS implements filesystem storage of TKA state.
 //
 // FS implements the Chonk interface.
@@ -182,7 +209,11 @@ func ChonkDir(dir string) (*FS, error) {
 	if !stat.IsDir() {
 		return nil, fmt.Errorf("chonk directory %q is a file", dir)
 	}
-	return &FS{base: dir}, nil
+	c := &FS{base: dir}
+	if err := c.recover(); err != nil {
+		return nil, fmt.Errorf("recovering chonk %q: %v", dir, err)
+	}
+	return c, nil
 }
 
 // fsHashInfo describes how information about an AUMHash is represented
@@ -197,6 +228,10 @@ func ChonkDir(dir string) (*FS, error) {
 type fsHashInfo struct {
 	Children []AUMHash `cbor:"1,keyasint"`
 	AUM      *AUM      `cbor:"2,keyasint"`
+
+	// CommittedAt is when AUM was first stored, in Unix seconds.
+	// It's zero for AUMs stored by older versions.
+	CommittedAt int64 `cbor:"3,keyasint,omitempty"`
 }
 
 // aumDir returns the directory an AUM is stored in, and its filename
@@ -223,6 +258,27 @@ func (c *FS) AUM(hash AUMHash) (AUM, error) {
 	return *info.AUM, nil
 }
 
+// CommitTime returns when the AUM with the specified digest was
+// first stored.
+//
+// If the AUM does not exist, then os.ErrNotExist is returned.
+func (c *FS) CommitTime(hash AUMHash) (time.Time, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	info, err := c.get(hash)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if info.AUM == nil {
+		return time.Time{}, os.ErrNotExist
+	}
+	if info.CommittedAt == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(info.CommittedAt, 0), nil
+}
+
 // AUM returns any known AUMs with a specific parent hash.
 func (c *FS) ChildAUMs(prevAUMHash AUMHash) ([]AUM, error) {
 	c.mu.RLock()
@@ -369,6 +425,26 @@ func (c *FS) CommitVerifiedAUMs(updates []AUM) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	// A batch whose apply failed leaves its intent record behind.
+	// Finish it before the record is overwritten by this one.
+	if err := c.replayWALLocked(); err != nil {
+		return err
+	}
+	now := time.Now()
+	// The per-hash files are updated one at a time, so record the
+	// whole batch first: if we're interrupted, recover finishes it.
+	if err := c.writeWAL(fsWALRecord{CommittedAt: now.Unix(), AUMs: updates}); err != nil {
+		return fmt.Errorf("writing commit log: %v", err)
+	}
+	if err := c.apply(updates, now); err != nil {
+		return err
+	}
+	return c.clearWAL()
+}
+
+// apply stores updates in the per-hash files, recording now as their
+// commit time if they're not already stored.
+func (c *FS) apply(updates []AUM, now time.Time) error {
 	for i, aum := range updates {
 		h := aum.Hash()
 		// We keep track of children against their parent so that
@@ -390,6 +466,9 @@ func (c *FS) CommitVerifiedAUMs(updates []AUM) error {
 		}
 
 		err := c.commit(h, func(info *fsHashInfo) {
+			if info.AUM == nil {
+				info.CommittedAt = now.Unix()
+			}
 			info.AUM = &aum
 		})
 		if err != nil {
@@ -436,3 +515,109 @@ func (c *FS) commit(h AUMHash, updater func(*fsHashInfo)) error {
 	}
 	return atomicfile.WriteFile(filepath.Join(dir, base), buff.Bytes(), 0644)
 }
+
+// fsWALRecord is the CBOR-serialized intent record for a batch of
+// AUMs being committed, stored at base/commit_wal until every
+// per-hash file for the batch has been written.
+type fsWALRecord struct {
+	CommittedAt int64 `cbor:"1,keyasint"`
+	AUMs        []AUM `cbor:"2,keyasint"`
+}
+
+func (c *FS) walPath() string {
+	return filepath.Join(c.base, "commit_wal")
+}
+
+func (c *FS) writeWAL(rec fsWALRecord) error {
+	m, err := cbor.CTAP2EncOptions().EncMode()
+	if err != nil {
+		return fmt.Errorf("cbor EncMode: %v", err)
+	}
+	var buff bytes.Buffer
+	if err := m.NewEncoder(&buff).Encode(rec); err != nil {
+		return fmt.Errorf("encoding: %v", err)
+	}
+	return atomicfile.WriteFile(c.walPath(), buff.Bytes(), 0644)
+}
+
+func (c *FS) clearWAL() error {
+	if err := os.Remove(c.walPath()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing commit log: %v", err)
+	}
+	return nil
+}
+
+// recover completes any CommitVerifiedAUMs that was interrupted, for
+// instance by a crash or power loss, and removes the temporary files
+// left behind by interrupted writes.
+//
+// The intent record is written atomically before any per-hash file is
+// touched, so a record that can't be decoded means no per-hash files
+// were changed, and it's discarded. A complete record is replayed;
+// this is safe as applying its AUMs is idempotent.
+func (c *FS) recover() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.removeTempFiles(); err != nil {
+		return err
+	}
+	return c.replayWALLocked()
+}
+
+// replayWALLocked applies the batch in the intent record, if there is
+// one, and removes the record.
+//
+// c.mu must be held.
+func (c *FS) replayWALLocked() error {
+	b, err := ioutil.ReadFile(c.walPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	m, err := cborDecOpts.DecMode()
+	if err != nil {
+		return err
+	}
+	var rec fsWALRecord
+	if err := m.Unmarshal(b, &rec); err != nil {
+		return c.clearWAL()
+	}
+	if err := c.apply(rec.AUMs, time.Unix(rec.CommittedAt, 0)); err != nil {
+		return fmt.Errorf("replaying commit log: %v", err)
+	}
+	return c.clearWAL()
+}
+
+// removeTempFiles removes the temporary files atomicfile.WriteFile
+// leaves behind if interrupted, which would otherwise fail the
+// filename checks in scanHashes.
+func (c *FS) removeTempFiles() error {
+	dirs := []string{c.base}
+	prefixDirs, err := os.ReadDir(c.base)
+	if err != nil {
+		return fmt.Errorf("reading prefix dirs: %v", err)
+	}
+	for _, prefix := range prefixDirs {
+		if prefix.IsDir() {
+			dirs = append(dirs, filepath.Join(c.base, prefix.Name()))
+		}
+	}
+	for _, dir := range dirs {
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			return fmt.Errorf("reading %s: %v", dir, err)
+		}
+		for _, file := range files {
+			if file.IsDir() || !strings.Contains(file.Name(), ".tmp") {
+				continue
+			}
+			if err := os.Remove(filepath.Join(dir, file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
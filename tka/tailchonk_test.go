@@ -5,6 +5,7 @@
 package tka
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -137,6 +138,54 @@ func TestTailchonk_ReadChainFromHead(t *testing.T) {
 	}
 }
 
+func TestIterAUMs(t *testing.T) {
+	genesis := AUM{MessageKind: AUMRemoveKey, KeyID: []byte{1, 2}}
+	gHash := genesis.Hash()
+	intermediate := AUM{PrevAUMHash: gHash[:]}
+	iHash := intermediate.Hash()
+	leaf := AUM{PrevAUMHash: iHash[:]}
+	lHash := leaf.Hash()
+
+	walk := func(c Chonk, from AUMHash, max int) []AUMHash {
+		t.Helper()
+		var got []AUMHash
+		err := IterAUMs(c, from, func(h AUMHash, aum AUM) bool {
+			if aum.Hash() != h {
+				t.Errorf("AUM %v has hash %v", h, aum.Hash())
+			}
+			got = append(got, h)
+			return len(got) < max
+		})
+		if err != nil {
+			t.Fatalf("IterAUMs: %v", err)
+		}
+		return got
+	}
+
+	c := &Mem{}
+	if err := c.CommitVerifiedAUMs([]AUM{genesis, intermediate, leaf}); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]AUMHash{lHash, iHash, gHash}, walk(c, lHash, 10)); diff != "" {
+		t.Errorf("full walk differs (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]AUMHash{iHash}, walk(c, iHash, 1)); diff != "" {
+		t.Errorf("stopped walk differs (-want, +got):\n%s", diff)
+	}
+
+	// History from before the oldest stored AUM ends the walk.
+	c = &Mem{}
+	if err := c.CommitVerifiedAUMs([]AUM{intermediate, leaf}); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]AUMHash{lHash, iHash}, walk(c, lHash, 10)); diff != "" {
+		t.Errorf("truncated walk differs (-want, +got):\n%s", diff)
+	}
+	if err := IterAUMs(c, gHash, func(AUMHash, AUM) bool { return true }); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("IterAUMs from missing AUM = %v; want os.ErrNotExist", err)
+	}
+}
+
 func TestTailchonkFS_Commit(t *testing.T) {
 	chonk := &FS{base: t.TempDir()}
 	parentHash := randHash(t, 1)
@@ -160,3 +209,85 @@ func TestTailchonkFS_Commit(t *testing.T) {
 		t.Errorf("stat of AUM parent failed: %v", err)
 	}
 }
+
+func TestTailchonkFS_Recover(t *testing.T) {
+	dir := t.TempDir()
+	chonk := &FS{base: dir}
+	parentHash := randHash(t, 1)
+	aum := AUM{MessageKind: AUMNoOp, PrevAUMHash: parentHash[:]}
+
+	// Simulate a crash after the intent record (and a temporary file)
+	// was written, but before the per-hash files were.
+	if err := chonk.writeWAL(fsWALRecord{CommittedAt: 1234, AUMs: []AUM{aum}}); err != nil {
+		t.Fatal(err)
+	}
+	tmpDir, base := chonk.aumDir(aum.Hash())
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, base+".tmp123"), []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	chonk, err := ChonkDir(dir)
+	if err != nil {
+		t.Fatalf("ChonkDir() failed: %v", err)
+	}
+	got, err := chonk.AUM(aum.Hash())
+	if err != nil {
+		t.Fatalf("AUM() after recovery failed: %v", err)
+	}
+	if diff := cmp.Diff(aum, got); diff != "" {
+		t.Errorf("recovered AUM differs (-want, +got):\n%s", diff)
+	}
+	if at, err := chonk.CommitTime(aum.Hash()); err != nil || at.Unix() != 1234 {
+		t.Errorf("CommitTime() = %v, %v; want 1234", at.Unix(), err)
+	}
+	children, err := chonk.ChildAUMs(parentHash)
+	if err != nil || len(children) != 1 {
+		t.Errorf("ChildAUMs(parent) = %v, %v; want 1 child", children, err)
+	}
+	if _, err := chonk.Heads(); err != nil {
+		t.Errorf("Heads() failed: %v", err)
+	}
+	if _, err := os.Stat(chonk.walPath()); !os.IsNotExist(err) {
+		t.Errorf("commit log not removed: %v", err)
+	}
+
+	// A record that can't be decoded is discarded.
+	if err := os.WriteFile(chonk.walPath(), []byte{0xff, 0x01}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ChonkDir(dir); err != nil {
+		t.Fatalf("ChonkDir() with bad commit log failed: %v", err)
+	}
+	if _, err := os.Stat(chonk.walPath()); !os.IsNotExist(err) {
+		t.Errorf("bad commit log not removed: %v", err)
+	}
+}
+
+func TestTailchonkFS_CommitAfterFailedApply(t *testing.T) {
+	chonk, err := ChonkDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parentHash := randHash(t, 1)
+	left := AUM{MessageKind: AUMNoOp, PrevAUMHash: parentHash[:]}
+	next := AUM{MessageKind: AUMNoOp, PrevAUMHash: parentHash[:], KeyID: []byte{1}}
+
+	// Simulate a batch whose apply failed, leaving its intent record.
+	if err := chonk.writeWAL(fsWALRecord{CommittedAt: 1234, AUMs: []AUM{left}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := chonk.CommitVerifiedAUMs([]AUM{next}); err != nil {
+		t.Fatal(err)
+	}
+	for _, aum := range []AUM{left, next} {
+		if _, err := chonk.AUM(aum.Hash()); err != nil {
+			t.Errorf("AUM(%x) failed: %v", aum.Hash(), err)
+		}
+	}
+	if _, err := os.Stat(chonk.walPath()); !os.IsNotExist(err) {
+		t.Errorf("commit log not removed: %v", err)
+	}
+}
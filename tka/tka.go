@@ -11,6 +11,7 @@
 	"fmt"
 	"os"
 	"sort"
+	"sync"
 
 	"github.com/fxamacker/cbor/v2"
 	"tailscale.com/types/key"
@@ -39,6 +40,10 @@ type Authority struct {
 	head           AUM
 	oldestAncestor AUM
 	state          State
+
+	// verified, if non-nil, remembers AUM signatures already verified,
+	// shared with the Authorities derived from this one.
+	verified *verifyCache
 }
 
 // Clone duplicates the Authority structure.
@@ -47,6 +52,7 @@ func (a *Authority) Clone() *Authority {
 		head:           a.head,
 		oldestAncestor: a.oldestAncestor,
 		state:          a.state.Clone(),
+		verified:       a.verified,
 	}
 }
 
@@ -417,8 +423,9 @@ func computeActiveChain(storage Chonk, lastKnownOldest *AUMHash, maxIter int) (c
 }
 
 // aumVerify verifies if an AUM is well-formed, correctly signed, and
-// can be accepted for storage.
-func aumVerify(aum AUM, state State, isGenesisAUM bool) error {
+// can be accepted for storage. Signatures found in cache, which may be
+// nil, aren't verified again, and those verified are added to it.
+func aumVerify(aum AUM, state State, isGenesisAUM bool, cache *verifyCache) error {
 	if err := aum.StaticValidate(); err != nil {
 		return fmt.Errorf("invalid: %v", err)
 	}
@@ -432,18 +439,105 @@ func aumVerify(aum AUM, state State, isGenesisAUM bool) error {
 		return errors.New("unsigned AUM")
 	}
 	sigHash := aum.SigHash()
+	var hash AUMHash
+	if cache != nil {
+		hash = aum.Hash()
+	}
 	for i, sig := range aum.Signatures {
 		key, err := state.GetKey(sig.KeyID)
 		if err != nil {
 			return fmt.Errorf("bad keyID on signature %d: %v", i, err)
 		}
+		if cache.has(hash, sig.KeyID) {
+			continue
+		}
 		if err := signatureVerify(&sig, sigHash, key); err != nil {
 			return fmt.Errorf("signature %d: %v", i, err)
 		}
+		cache.add(hash, sig.KeyID)
 	}
 	return nil
 }
 
+// verifyCacheSize is the most signatures a verifyCache remembers.
+const verifyCacheSize = 1024
+
+// verifyCache remembers which AUM signatures have verified, so that
+// AUMs offered again, such as when a sync with control that failed
+// partway through is retried, aren't verified again.
+//
+// Signatures are identified by the AUM's hash, which covers the
+// signatures as well as what they sign, and the signing key's ID. It's
+// reset whenever the trusted keys change, so a cached signature is
+// never taken as verified by a key it wasn't verified with.
+//
+// A nil verifyCache remembers nothing.
+type verifyCache struct {
+	mu       sync.Mutex
+	verified map[verifyCacheKey]bool
+}
+
+type verifyCacheKey struct {
+	aum   AUMHash
+	keyID string
+}
+
+func newVerifyCache() *verifyCache {
+	return &verifyCache{verified: make(map[verifyCacheKey]bool)}
+}
+
+// has reports whether the signature by keyID on the AUM with hash aum
+// has been verified.
+func (c *verifyCache) has(aum AUMHash, keyID tkatype.KeyID) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.verified[verifyCacheKey{aum, string(keyID)}]
+}
+
+// add records that the signature by keyID on the AUM with hash aum has
+// been verified. Once full, the cache is emptied to make room.
+func (c *verifyCache) add(aum AUMHash, keyID tkatype.KeyID) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.verified) >= verifyCacheSize {
+		c.verified = make(map[verifyCacheKey]bool)
+	}
+	c.verified[verifyCacheKey{aum, string(keyID)}] = true
+}
+
+// reset forgets all verified signatures.
+func (c *verifyCache) reset() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.verified = make(map[verifyCacheKey]bool)
+}
+
+// sameKeys reports whether a and b trust the same keys.
+func sameKeys(a, b State) bool {
+	if len(a.Keys) != len(b.Keys) {
+		return false
+	}
+	ids := make(map[string]bool, len(a.Keys))
+	for _, k := range a.Keys {
+		ids[string(k.ID())] = true
+	}
+	for _, k := range b.Keys {
+		if !ids[string(k.ID())] {
+			return false
+		}
+	}
+	return true
+}
+
 func checkParent(aum AUM, state State) error {
 	parent, hasParent := aum.Parent()
 	if !hasParent {
@@ -464,6 +558,30 @@ func (a *Authority) Head() AUMHash {
 	return *a.state.LastAUMHash
 }
 
+// IterAUMs calls fn with the AUM with hash from and then each of its
+// ancestors in storage, newest first, until fn returns false or the
+// chain ends. Ancestors no longer in storage end the chain as though
+// it began there.
+func IterAUMs(storage Chonk, from AUMHash, fn func(AUMHash, AUM) bool) error {
+	for h := from; ; {
+		aum, err := storage.AUM(h)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) && h != from {
+				return nil
+			}
+			return err
+		}
+		if !fn(h, aum) {
+			return nil
+		}
+		parent, ok := aum.Parent()
+		if !ok {
+			return nil
+		}
+		h = parent
+	}
+}
+
 // Open initializes an existing TKA from the given tailchonk.
 //
 // Only use this if the current node has initialized an Authority before.
@@ -485,6 +603,7 @@ func Open(storage Chonk) (*Authority, error) {
 		head:           c.Head,
 		oldestAncestor: c.Oldest,
 		state:          c.state,
+		verified:       newVerifyCache(),
 	}, nil
 }
 
@@ -540,7 +659,7 @@ func Bootstrap(storage Chonk, bootstrap AUM) (*Authority, error) {
 	if bootstrap.State == nil {
 		return nil, errors.New("bootstrap AUM is missing state")
 	}
-	if err := aumVerify(bootstrap, *bootstrap.State, true); err != nil {
+	if err := aumVerify(bootstrap, *bootstrap.State, true, nil); err != nil {
 		return nil, fmt.Errorf("invalid bootstrap: %v", err)
 	}
 
@@ -615,7 +734,7 @@ func (a *Authority) InformIdempotent(storage Chonk, updates []AUM) (Authority, e
 			stateAt[parent] = state
 		}
 
-		if err := aumVerify(update, state, false); err != nil {
+		if err := aumVerify(update, state, false, a.verified); err != nil {
 			return Authority{}, fmt.Errorf("update %d invalid: %v", i, err)
 		}
 		if stateAt[hash], err = state.applyVerifiedAUM(update); err != nil {
@@ -633,26 +752,32 @@ func (a *Authority) InformIdempotent(storage Chonk, updates []AUM) (Authority, e
 		return Authority{}, fmt.Errorf("commit: %v", err)
 	}
 
+	var out Authority
 	if isHeadChain {
 		// Head-chain fastpath: We can use the state we computed
 		// in the last iteration.
-		return Authority{
+		out = Authority{
 			head:           updates[len(updates)-1],
 			oldestAncestor: a.oldestAncestor,
 			state:          stateAt[prevHash],
-		}, nil
+		}
+	} else {
+		oldestAncestor := a.oldestAncestor.Hash()
+		c, err := computeActiveChain(storage, &oldestAncestor, 2000)
+		if err != nil {
+			return Authority{}, fmt.Errorf("recomputing active chain: %v", err)
+		}
+		out = Authority{
+			head:           c.Head,
+			oldestAncestor: c.Oldest,
+			state:          c.state,
+		}
 	}
-
-	oldestAncestor := a.oldestAncestor.Hash()
-	c, err := computeActiveChain(storage, &oldestAncestor, 2000)
-	if err != nil {
-		return Authority{}, fmt.Errorf("recomputing active chain: %v", err)
+	out.verified = a.verified
+	if !sameKeys(a.state, out.state) {
+		out.verified.reset()
 	}
-	return Authority{
-		head:           c.Head,
-		oldestAncestor: c.Oldest,
-		state:          c.state,
-	}, nil
+	return out, nil
 }
 
 // Inform is the same as InformIdempotent, except the state of the Authority
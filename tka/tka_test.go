@@ -6,6 +6,7 @@
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -437,3 +438,75 @@ func TestAuthorityInformLinear(t *testing.T) {
 		t.Fatal("authority did not converge to correct AUM")
 	}
 }
+
+func TestAuthorityVerifyCache(t *testing.T) {
+	pub, priv := testingKey25519(t, 1)
+	key := Key{Kind: Key25519, Public: pub, Votes: 2}
+
+	storage := &Mem{}
+	a, _, err := Create(storage, State{
+		Keys:               []Key{key},
+		DisablementSecrets: [][]byte{disablementKDF([]byte{1, 2, 3})},
+	}, signer25519(priv))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+
+	b := a.NewUpdater(signer25519(priv))
+	if err := b.SetKeyVote(key.ID(), 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetKeyMeta(key.ID(), map[string]string{"a": "b"}); err != nil {
+		t.Fatal(err)
+	}
+	updates, err := b.Finalize()
+	if err != nil {
+		t.Fatalf("Finalize() failed: %v", err)
+	}
+
+	// A batch that fails partway through still remembers the
+	// signatures verified before the failure, for when it's retried.
+	bad := append([]AUM(nil), updates...)
+	bad[1].Signatures = []tkatype.Signature{{KeyID: key.ID(), Signature: make([]byte, ed25519.SignatureSize)}}
+	if err := a.Inform(storage, bad); err == nil {
+		t.Fatal("Inform() with bad signature succeeded")
+	}
+	if !a.verified.has(updates[0].Hash(), key.ID()) {
+		t.Error("verified signature not cached")
+	}
+	if a.verified.has(bad[1].Hash(), key.ID()) {
+		t.Error("bad signature cached")
+	}
+
+	if err := a.Inform(storage, updates); err != nil {
+		t.Fatalf("Inform() failed: %v", err)
+	}
+	if !a.verified.has(updates[1].Hash(), key.ID()) {
+		t.Error("verified signature not cached")
+	}
+
+	// Changing the trusted keys empties the cache.
+	pub2, _ := testingKey25519(t, 2)
+	b = a.NewUpdater(signer25519(priv))
+	if err := b.AddKey(Key{Kind: Key25519, Public: pub2, Votes: 1}); err != nil {
+		t.Fatal(err)
+	}
+	updates2, err := b.Finalize()
+	if err != nil {
+		t.Fatalf("Finalize() failed: %v", err)
+	}
+	if err := a.Inform(storage, updates2); err != nil {
+		t.Fatalf("Inform() failed: %v", err)
+	}
+	if a.verified.has(updates[1].Hash(), key.ID()) {
+		t.Error("cache not reset after key change")
+	}
+
+	c := newVerifyCache()
+	for i := 0; i <= verifyCacheSize; i++ {
+		c.add(AUMHash{byte(i), byte(i >> 8)}, key.ID())
+	}
+	if n := len(c.verified); n > verifyCacheSize {
+		t.Errorf("cache has %d entries; want at most %d", n, verifyCacheSize)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsnet
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/netip"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// IdentityConn is implemented by the net.Conns returned by listeners
+// wrapped with Server.IdentityListener.
+type IdentityConn interface {
+	net.Conn
+
+	// WhoIs returns the identity of the remote peer, resolved once
+	// when the connection was accepted. It returns nil if the remote
+	// address didn't belong to a known tailnet node at that time.
+	WhoIs() *apitype.WhoIsResponse
+}
+
+// IdentityListener wraps ln, which must be a listener returned by
+// s.Listen, so that each accepted net.Conn is an IdentityConn. The
+// remote peer's identity (node, user, tags and capabilities) is looked
+// up once per connection, in-process, so handlers can do authorization
+// checks without a LocalClient.WhoIs call per request.
+//
+// Connections from addresses that aren't tailnet peers are still
+// returned, with a nil WhoIs; rejecting them is up to the caller.
+func (s *Server) IdentityListener(ln net.Listener) net.Listener {
+	return &identityListener{Listener: ln, s: s}
+}
+
+type identityListener struct {
+	net.Listener
+	s *Server
+}
+
+func (ln *identityListener) Accept() (net.Conn, error) {
+	c, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &identityConn{Conn: c, who: ln.s.whoIs(c.RemoteAddr())}, nil
+}
+
+type identityConn struct {
+	net.Conn
+	who *apitype.WhoIsResponse // or nil
+}
+
+func (c *identityConn) WhoIs() *apitype.WhoIsResponse { return c.who }
+
+// whoIs returns the identity of the tailnet node at remote, or nil if
+// it's unknown.
+func (s *Server) whoIs(remote net.Addr) *apitype.WhoIsResponse {
+	ipp, err := netip.ParseAddrPort(remote.String())
+	if err != nil || s.lb == nil {
+		return nil
+	}
+	n, u, ok := s.lb.WhoIs(ipp)
+	if !ok {
+		return nil
+	}
+	return &apitype.WhoIsResponse{
+		Node:        n,
+		UserProfile: &u,
+		Caps:        s.lb.PeerCaps(ipp.Addr()),
+		CapMap:      s.lb.PeerCapMap(ipp.Addr()),
+	}
+}
+
+type whoIsContextKey struct{}
+
+// ConnContext is an http.Server.ConnContext func that makes the
+// identity of IdentityConn connections (including ones wrapped by
+// crypto/tls) available to HTTP handlers via WhoIsFromContext.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if ic, ok := c.(IdentityConn); ok {
+		if who := ic.WhoIs(); who != nil {
+			ctx = context.WithValue(ctx, whoIsContextKey{}, who)
+		}
+	}
+	return ctx
+}
+
+// WhoIsFromContext returns the remote peer identity stored in ctx by
+// ConnContext, if any.
+func WhoIsFromContext(ctx context.Context) (*apitype.WhoIsResponse, bool) {
+	who, ok := ctx.Value(whoIsContextKey{}).(*apitype.WhoIsResponse)
+	return who, ok
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsnet_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tsnet"
+	"tailscale.com/tstest/tailnettest"
+)
+
+func TestIdentityListener(t *testing.T) {
+	tn := tailnettest.New(t)
+	nodes := tn.NewNodes(2)
+	srv, client := nodes[0], nodes[1]
+
+	ln, err := srv.Listen("tcp", ":80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln = srv.IdentityListener(ln)
+	defer ln.Close()
+
+	whoc := make(chan *apitype.WhoIsResponse, 1)
+	hs := &http.Server{
+		ConnContext: tsnet.ConnContext,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			who, _ := tsnet.WhoIsFromContext(r.Context())
+			whoc <- who
+		}),
+	}
+	go hs.Serve(ln)
+	defer hs.Close()
+
+	lc, err := client.LocalClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := lc.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvLC, err := srv.LocalClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvSt, err := srvLC.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hc := &http.Client{
+		Transport: &http.Transport{DialContext: client.Dial},
+		Timeout:   10 * time.Second,
+	}
+	res, err := hc.Get("http://" + srvSt.TailscaleIPs[0].String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+
+	who := <-whoc
+	if who == nil {
+		t.Fatal("handler saw no identity")
+	}
+	if who.Node == nil || who.Node.StableID != st.Self.ID {
+		t.Errorf("WhoIs node = %+v; want %v", who.Node, st.Self.ID)
+	}
+	if who.UserProfile == nil || who.UserProfile.ID != st.Self.UserID {
+		t.Errorf("WhoIs user = %+v; want %v", who.UserProfile, st.Self.UserID)
+	}
+}
+
+// fakeIdentityConn is an IdentityConn with a fixed identity.
+type fakeIdentityConn struct {
+	net.Conn
+	who *apitype.WhoIsResponse
+}
+
+func (c fakeIdentityConn) WhoIs() *apitype.WhoIsResponse { return c.who }
+
+func TestConnContext(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	who := &apitype.WhoIsResponse{Node: &tailcfg.Node{Name: "peer."}}
+
+	tests := []struct {
+		name string
+		c    net.Conn
+		want *apitype.WhoIsResponse
+	}{
+		{"plain", c1, nil},
+		{"identity", fakeIdentityConn{c1, who}, who},
+		{"unknown_peer", fakeIdentityConn{c1, nil}, nil},
+		{"tls", tls.Server(fakeIdentityConn{c1, who}, &tls.Config{}), who},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tsnet.WhoIsFromContext(tsnet.ConnContext(context.Background(), tt.c))
+			if got != tt.want || ok != (tt.want != nil) {
+				t.Errorf("WhoIsFromContext = %v, %v; want %v, %v", got, ok, tt.want, tt.want != nil)
+			}
+		})
+	}
+}
@@ -5,6 +5,25 @@
 // Package tsnet provides Tailscale as a library.
 //
 // It is an experimental work in progress.
+//
+// # Multiple Servers
+//
+// A process may run several Servers at once, each of which is its own
+// node with its own state directory, WireGuard engine, netstack,
+// LocalBackend, and log stream. Each Server needs a distinct Dir: two
+// Servers can't share a state directory, and Start returns an error if
+// another running Server in the process is already using it. Leaving
+// Dir empty selects the same directory for every Server in the binary,
+// so set Dir explicitly when running more than one.
+//
+// Some state is per process rather than per Server and is shared by
+// all of them: the client metrics (tailscale.com/util/clientmetric),
+// which count events across all Servers and are what each Server's
+// LocalClient reports; the health subsystem (tailscale.com/health);
+// environment knobs (tailscale.com/envknob); and the hostinfo reported
+// about the host and process. Each Server's log stream does carry the
+// full metric values, encoded with its own clientmetric.DeltaEncoder,
+// so no stream's metrics depend on how often the others upload.
 package tsnet
 
 import (
@@ -16,6 +35,7 @@
 	"net"
 	"net/http"
 	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -38,6 +58,7 @@
 	"tailscale.com/net/tsdial"
 	"tailscale.com/smallzstd"
 	"tailscale.com/types/logger"
+	"tailscale.com/util/clientmetric"
 	"tailscale.com/wgengine"
 	"tailscale.com/wgengine/monitor"
 	"tailscale.com/wgengine/netstack"
@@ -51,6 +72,8 @@ type Server struct {
 	// state. If empty, a directory is selected automatically
 	// under os.UserConfigDir (https://golang.org/pkg/os/#UserConfigDir).
 	// based on the name of the binary.
+	//
+	// Each Server running in a process must have its own Dir.
 	Dir string
 
 	// Store specifies the state store to use.
@@ -75,6 +98,18 @@ type Server struct {
 	// as an Ephemeral node (https://tailscale.com/kb/1111/ephemeral-nodes/).
 	Ephemeral bool
 
+	// EphemeralLogoutTimeout is how long Close keeps trying to log
+	// out an Ephemeral node, retrying with backoff while the control
+	// server is unreachable, so that the node is deleted right away
+	// rather than lingering until it's removed for inactivity.
+	// If zero, 5 seconds is used. If negative, Close doesn't log out.
+	EphemeralLogoutTimeout time.Duration
+
+	// LowMemory, if true, configures the engine and netstack to use
+	// smaller queues and buffers, at some cost in throughput. It's
+	// meant for memory-constrained devices. See wgengine.Config.LowMemory.
+	LowMemory bool
+
 	// AuthKey, if non-empty, is the auth key to create the node
 	// and will be preferred over the TS_AUTHKEY environment
 	// variable. If the node is already created (from state
@@ -82,12 +117,23 @@ type Server struct {
 	// used.
 	AuthKey string
 
+	// ControlURL optionally specifies the coordination server URL.
+	// If empty, the Tailscale default is used.
+	ControlURL string
+
+	// ControlDial, if non-nil, makes the TCP connections to the
+	// coordination server in place of the system dialer, such as
+	// over a tunnel the program already has, for networks where it
+	// can't be reached directly.
+	ControlDial func(ctx context.Context, network, addr string) (net.Conn, error)
+
 	initOnce         sync.Once
 	initErr          error
 	lb               *ipnlocal.LocalBackend
 	linkMon          *monitor.Mon
 	localAPIListener net.Listener
 	rootPath         string // the state directory
+	claimedRoot      string // absolute rootPath claimed by claimRootPath, or empty
 	hostname         string
 	shutdownCtx      context.Context
 	shutdownCancel   context.CancelFunc
@@ -120,6 +166,22 @@ func (s *Server) LocalClient() (*tailscale.LocalClient, error) {
 	return s.localClient, nil
 }
 
+// HandlePeerAPI mounts h on the node's peerapi server at
+// "/v0/x/<name>/", for other nodes to reach without s listening on a
+// port of its own. If capability is non-empty, only peers granted it
+// may use h. Requests identify the peer in Tailscale-User-Login,
+// Tailscale-User-Name, Tailscale-Node-Name and Tailscale-Node-ID
+// headers.
+//
+// It will start the server if it has not been started yet. The
+// returned func unregisters h.
+func (s *Server) HandlePeerAPI(name, capability string, h http.Handler) (unregister func(), err error) {
+	if err := s.Start(); err != nil {
+		return nil, err
+	}
+	return s.lb.RegisterPeerAPIHandler(name, capability, h)
+}
+
 // Start connects the server to the tailnet.
 // Optional: any calls to Dial/Listen will also call Start.
 func (s *Server) Start() error {
@@ -130,8 +192,17 @@ func (s *Server) Start() error {
 
 // Close stops the server.
 //
-// It must not be called before or concurrently with Start.
+// It must not be called concurrently with Start. Closing a Server
+// that was never started, or whose Start failed, does nothing.
 func (s *Server) Close() error {
+	if s.shutdownCancel == nil {
+		return nil
+	}
+	if s.initErr != nil {
+		// start already closed what it had opened.
+		s.shutdownCancel()
+		return nil
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	var wg sync.WaitGroup
@@ -143,15 +214,7 @@ func (s *Server) Close() error {
 		s.logbuffer.Close()
 	}()
 
-	if _, isMemStore := s.Store.(*mem.Store); isMemStore && s.Ephemeral {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			// Perform a best-effort logout.
-			s.lb.LogoutSync(ctx)
-		}()
-	}
-
+	// For Ephemeral nodes, lb.Shutdown logs out, deleting the node.
 	s.shutdownCancel()
 	s.lb.Shutdown()
 	s.linkMon.Close()
@@ -161,11 +224,14 @@ func (s *Server) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	for _, ln := range s.listeners {
-		ln.Close()
+		// Not ln.Close, which would need s.mu.
+		close(ln.conn)
 	}
 	s.listeners = nil
 
 	wg.Wait()
+	releaseRootPath(s.claimedRoot)
+	s.claimedRoot = ""
 	return nil
 }
 
@@ -226,6 +292,15 @@ func (s *Server) start() (reterr error) {
 	} else if !fi.IsDir() {
 		return fmt.Errorf("%v is not a directory", s.rootPath)
 	}
+	claimed, err := claimRootPath(s.rootPath)
+	if err != nil {
+		return err
+	}
+	s.claimedRoot = claimed
+	closePool.addFunc(func() {
+		releaseRootPath(s.claimedRoot)
+		s.claimedRoot = ""
+	})
 
 	cfgPath := filepath.Join(s.rootPath, "tailscaled.log.conf")
 
@@ -262,6 +337,20 @@ func (s *Server) start() (reterr error) {
 			return w
 		},
 		HTTPC: &http.Client{Transport: logpolicy.NewLogtailTransport(logtail.DefaultHost)},
+		// Each Server's log stream gets its own delta encoder, so that
+		// every stream carries complete metric values rather than the
+		// streams splitting the deltas among themselves.
+		MetricsDelta: clientmetric.NewDeltaEncoder().Encode,
+	}
+	if target := envknob.String("TS_LOG_TARGET"); target != "" {
+		// As with tailscaled, let logs go somewhere other than
+		// log.tailscale.io, such as a test's log catcher.
+		u, err := url.Parse(target)
+		if err != nil {
+			return fmt.Errorf("invalid TS_LOG_TARGET: %w", err)
+		}
+		c.BaseURL = target
+		c.HTTPC = &http.Client{Transport: logpolicy.NewLogtailTransport(u.Host)}
 	}
 	s.logtail = logtail.NewLogger(c, logf)
 	closePool.addFunc(func() { s.logtail.Shutdown(context.Background()) })
@@ -277,6 +366,7 @@ func (s *Server) start() (reterr error) {
 		ListenPort:  0,
 		LinkMonitor: s.linkMon,
 		Dialer:      s.dialer,
+		LowMemory:   s.LowMemory,
 	})
 	if err != nil {
 		return err
@@ -323,6 +413,10 @@ func (s *Server) start() (reterr error) {
 		return fmt.Errorf("NewLocalBackend: %v", err)
 	}
 	lb.SetVarRoot(s.rootPath)
+	lb.SetEphemeralLogoutTimeout(s.EphemeralLogoutTimeout)
+	if s.ControlDial != nil {
+		lb.SetControlDialer(s.ControlDial)
+	}
 	logf("tsnet starting with hostname %q, varRoot %q", s.hostname, s.rootPath)
 	s.lb = lb
 	closePool.addFunc(func() { s.lb.Shutdown() })
@@ -332,6 +426,9 @@ func (s *Server) start() (reterr error) {
 	prefs := ipn.NewPrefs()
 	prefs.Hostname = s.hostname
 	prefs.WantRunning = true
+	if s.ControlURL != "" {
+		prefs.ControlURL = s.ControlURL
+	}
 	authKey := s.getAuthKey()
 	err = lb.Start(ipn.Options{
 		StateKey:    ipn.GlobalDaemonStateKey,
@@ -433,6 +530,40 @@ func (s *Server) forwardTCP(c net.Conn, port uint16) {
 	}
 }
 
+var (
+	rootPathsMu sync.Mutex
+	rootPaths   = map[string]bool{} // state directories of running Servers
+)
+
+// claimRootPath records that dir is in use as a Server's state
+// directory, returning an error if another Server in the process is
+// already using it. On success it returns the absolute path claimed,
+// which is what releaseRootPath takes.
+func claimRootPath(dir string) (abs string, err error) {
+	abs, err = filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	rootPathsMu.Lock()
+	defer rootPathsMu.Unlock()
+	if rootPaths[abs] {
+		return "", fmt.Errorf("state directory %q is already in use by another Server in this process; set a distinct Server.Dir for each", abs)
+	}
+	rootPaths[abs] = true
+	return abs, nil
+}
+
+// releaseRootPath undoes claimRootPath. The abs path must be one
+// returned by claimRootPath; it does nothing if abs is empty.
+func releaseRootPath(abs string) {
+	if abs == "" {
+		return
+	}
+	rootPathsMu.Lock()
+	defer rootPathsMu.Unlock()
+	delete(rootPaths, abs)
+}
+
 // getTSNetDir usually just returns filepath.Join(confDir, "tsnet-"+prog)
 // with no error.
 //
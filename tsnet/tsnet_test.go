@@ -0,0 +1,85 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsnet
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"tailscale.com/ipn/store/mem"
+)
+
+func TestClaimRootPath(t *testing.T) {
+	dir := t.TempDir()
+
+	abs, err := claimRootPath(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releaseRootPath(abs)
+
+	// The same directory, spelled differently, is still taken.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := filepath.Rel(wd, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := claimRootPath(rel); err == nil {
+		t.Errorf("second claim of %q succeeded", rel)
+	}
+
+	other := t.TempDir()
+	otherAbs, err := claimRootPath(other)
+	if err != nil {
+		t.Fatalf("claim of distinct dir: %v", err)
+	}
+	releaseRootPath(otherAbs)
+
+	releaseRootPath(abs)
+	abs, err = claimRootPath(dir)
+	if err != nil {
+		t.Fatalf("claim after release: %v", err)
+	}
+}
+
+func TestCloseNeverStarted(t *testing.T) {
+	// A running Server whose state directory is the current
+	// directory, which is what filepath.Abs("") resolves to.
+	abs, err := claimRootPath(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releaseRootPath(abs)
+
+	s := new(Server)
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close = %v", err)
+	}
+	if _, err := claimRootPath("."); err == nil {
+		t.Fatal("Close of never-started Server released another Server's state directory")
+	}
+}
+
+func TestCloseAfterFailedStart(t *testing.T) {
+	s := &Server{
+		Dir:   t.TempDir(),
+		Store: new(mem.Store), // only allowed for Ephemeral nodes
+	}
+	if err := s.Start(); err == nil {
+		t.Fatal("Start succeeded; want error")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close = %v", err)
+	}
+	abs, err := claimRootPath(s.Dir)
+	if err != nil {
+		t.Fatalf("state directory still claimed after failed Start: %v", err)
+	}
+	releaseRootPath(abs)
+}
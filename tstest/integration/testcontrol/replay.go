@@ -0,0 +1,126 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testcontrol
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"tailscale.com/control/controlclient"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// LoadRecording loads a recording of map polls written by a
+// controlclient with Options.RecordPath set, to replay to the next
+// nodes that poll s instead of the netmaps s would generate.
+//
+// Each map poll to s gets the responses of the next recorded poll, in
+// order, with the node's own keys in place of the recorded node's.
+// Once all have been replayed, further polls get the last recorded
+// poll's responses again. Registration is unchanged.
+func (s *Server) LoadRecording(r io.Reader) error {
+	// Poll numbers restart in each process appending to a recording,
+	// so each Request starts a new poll, and responses belong to the
+	// latest poll with their number.
+	var polls [][]*tailcfg.MapResponse
+	latest := map[int]int{} // poll number => index in polls
+	br := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		b, err := br.ReadBytes('\n')
+		if err == io.EOF && len(b) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		var m controlclient.RecordedMessage
+		if err := json.Unmarshal(b, &m); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		i, ok := latest[m.Poll]
+		if m.Request != nil || !ok {
+			polls = append(polls, nil)
+			i = len(polls) - 1
+			latest[m.Poll] = i
+		}
+		if m.Response != nil && !m.Response.KeepAlive {
+			polls[i] = append(polls[i], m.Response)
+		}
+	}
+	var replay [][]*tailcfg.MapResponse
+	for _, resps := range polls {
+		if len(resps) > 0 {
+			replay = append(replay, resps)
+		}
+	}
+	if len(replay) == 0 {
+		return fmt.Errorf("recording has no map responses")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replay = replay
+	return nil
+}
+
+// nextReplayLocked returns the responses to replay to the next map
+// poll, or nil if not replaying a recording.
+//
+// s.mu must be held.
+func (s *Server) nextReplayLocked() []*tailcfg.MapResponse {
+	if len(s.replay) == 0 {
+		return nil
+	}
+	resps := s.replay[0]
+	if len(s.replay) > 1 {
+		s.replay = s.replay[1:]
+	}
+	return resps
+}
+
+// serveReplay sends the recorded resps as the responses to the map
+// poll req from the node with machine key mkey and, if streaming,
+// then sends keep-alives until ctx is done.
+func (s *Server) serveReplay(ctx context.Context, w http.ResponseWriter, mkey key.MachinePublic, req *tailcfg.MapRequest, compress, streaming bool, resps []*tailcfg.MapResponse) {
+	w.WriteHeader(200)
+	for _, res := range resps {
+		res2 := *res
+		if res.Node != nil {
+			res2.Node = res.Node.Clone()
+			res2.Node.Key = req.NodeKey
+			res2.Node.Machine = mkey
+			res2.Node.DiscoKey = req.DiscoKey
+		}
+		resBytes, err := json.Marshal(&res2)
+		if err != nil {
+			s.logf("json.Marshal: %v", err)
+			return
+		}
+		if err := s.sendMapMsg(w, mkey, compress, resBytes); err != nil {
+			return
+		}
+		if !streaming {
+			return
+		}
+	}
+	t := time.NewTicker(50 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := s.sendMapMsg(w, mkey, compress, keepAliveMsg); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -71,6 +71,10 @@ type Server struct {
 	nodeKeyAuthed map[key.NodePublic]bool // key => true once authenticated
 	pingReqsToAdd map[key.NodePublic]*tailcfg.PingRequest
 	allExpired    bool // All nodes will be told their node key is expired.
+
+	packetFilter []tailcfg.FilterRule       // nil means tailcfg.FilterAllowAll
+	mapHook      func(*tailcfg.MapResponse) // or nil; see SetMapResponseHook
+	replay       [][]*tailcfg.MapResponse   // recorded polls to replay; see LoadRecording
 }
 
 // BaseURL returns the server's base URL, without trailing slash.
@@ -171,6 +175,32 @@ func (s *Server) SetExpireAllNodes(expired bool) {
 	}
 }
 
+// SetPacketFilter sets the packet filter sent to every node, in place
+// of the default of allowing all traffic, and sends it to the nodes
+// currently polling. A nil rules restores the default.
+//
+// An empty, non-nil rules isn't sent to nodes, which keep their old
+// filter; to deny all traffic, use a rule that matches nothing.
+func (s *Server) SetPacketFilter(rules []tailcfg.FilterRule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.packetFilter = rules
+	s.updateAllLocked("SetPacketFilter")
+}
+
+// SetMapResponseHook sets a func to modify each MapResponse before
+// it's sent to a node, which is in res.Node, letting tests program the
+// netmap nodes see. The new hook applies right away to the nodes
+// currently polling. A nil fn removes the hook.
+//
+// fn is called without any locks held and must not modify s.
+func (s *Server) SetMapResponseHook(fn func(res *tailcfg.MapResponse)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mapHook = fn
+	s.updateAllLocked("SetMapResponseHook")
+}
+
 type AuthPath struct {
 	nodeKey key.NodePublic
 
@@ -547,6 +577,13 @@ func (s *Server) updateLocked(source string, peers []tailcfg.NodeID) {
 	}
 }
 
+// updateAllLocked sends a new MapResponse to every node that's polling.
+func (s *Server) updateAllLocked(source string) {
+	for _, ch := range s.updates {
+		sendUpdate(ch, updatePeerChanged)
+	}
+}
+
 // sendUpdate sends updateType to dst if dst is non-nil and
 // has capacity. It reports whether a value was sent.
 func sendUpdate(dst chan<- updateType, updateType updateType) bool {
@@ -664,6 +701,14 @@ func (s *Server) serveMap(w http.ResponseWriter, r *http.Request, mkey key.Machi
 	streaming := req.Stream && !req.ReadOnly
 	compress := req.Compress != ""
 
+	s.mu.Lock()
+	replay := s.nextReplayLocked()
+	s.mu.Unlock()
+	if replay != nil {
+		s.serveReplay(ctx, w, mkey, req, compress, streaming, replay)
+		return
+	}
+
 	w.WriteHeader(200)
 	for {
 		res, err := s.MapResponse(req)
@@ -760,6 +805,13 @@ func (s *Server) MapResponse(req *tailcfg.MapRequest) (res *tailcfg.MapResponse,
 	sort.Slice(res.Peers, func(i, j int) bool {
 		return res.Peers[i].ID < res.Peers[j].ID
 	})
+	res.UserProfiles = []tailcfg.UserProfile{userProfile(user)}
+	for _, p := range res.Peers {
+		pu, _ := s.getUser(p.Key)
+		if pu.ID != user.ID {
+			res.UserProfiles = append(res.UserProfiles, userProfile(pu))
+		}
+	}
 
 	v4Prefix := netip.PrefixFrom(netaddr.IPv4(100, 64, uint8(tailcfg.NodeID(user.ID)>>8), uint8(tailcfg.NodeID(user.ID))), 32)
 	v6Prefix := netip.PrefixFrom(tsaddr.Tailscale4To6(v4Prefix.Addr()), 128)
@@ -776,10 +828,26 @@ func (s *Server) MapResponse(req *tailcfg.MapRequest) (res *tailcfg.MapResponse,
 		res.PingRequest = pr
 		delete(s.pingReqsToAdd, nk)
 	}
+	if s.packetFilter != nil {
+		res.PacketFilter = s.packetFilter
+	}
+	mapHook := s.mapHook
 	s.mu.Unlock()
+	if mapHook != nil {
+		mapHook(res)
+	}
 	return res, nil
 }
 
+// userProfile returns the profile of u that map responses carry.
+func userProfile(u *tailcfg.User) tailcfg.UserProfile {
+	return tailcfg.UserProfile{
+		ID:          u.ID,
+		LoginName:   u.LoginName,
+		DisplayName: u.DisplayName,
+	}
+}
+
 func (s *Server) sendMapMsg(w http.ResponseWriter, mkey key.MachinePublic, compress bool, msg any) error {
 	resBytes, err := s.encode(mkey, compress, msg)
 	if err != nil {
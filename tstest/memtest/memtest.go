@@ -0,0 +1,64 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package memtest asserts allocation budgets for hot paths, such as
+// packet receive and filter evaluation, so that allocation creep, which
+// shows up as lost throughput on small devices, fails tests rather
+// than going unnoticed.
+//
+// Each package with a hot path declares its budgets in its tests:
+//
+//	func TestAllocBudgets(t *testing.T) {
+//		memtest.Check(t, []memtest.Budget{
+//			{Name: "tcp4_in", Allocs: 0, Run: func() { f.RunIn(tcp4, 0) }},
+//		})
+//	}
+package memtest
+
+import (
+	"testing"
+
+	"tailscale.com/tstest"
+	"tailscale.com/util/racebuild"
+)
+
+// Budget is the most allocations an operation may make.
+type Budget struct {
+	// Name names the operation, as a subtest.
+	Name string
+
+	// Allocs is the most allocations one call of Run may make.
+	Allocs uint64
+
+	// Run performs the operation once.
+	Run func()
+}
+
+// Check runs each of budgets as a subtest that fails if its Run makes
+// more allocations than its budget allows, as measured by
+// tstest.MinAllocsPerRun.
+//
+// Check also logs when a Run can make fewer allocations than its
+// budget, so that the budget can be lowered to lock in the improvement.
+//
+// Budgets are skipped in race-enabled builds, whose instrumentation
+// allocates.
+func Check(t *testing.T, budgets []Budget) {
+	t.Helper()
+	if racebuild.On {
+		t.Skip("allocation budgets don't apply with -race")
+	}
+	for _, b := range budgets {
+		b := b
+		t.Run(b.Name, func(t *testing.T) {
+			if err := tstest.MinAllocsPerRun(t, b.Allocs, b.Run); err != nil {
+				t.Errorf("over budget of %d allocs/op: %v", b.Allocs, err)
+				return
+			}
+			if b.Allocs > 0 && tstest.MinAllocsPerRun(t, b.Allocs-1, b.Run) == nil {
+				t.Logf("under budget of %d allocs/op, which can be lowered", b.Allocs)
+			}
+		})
+	}
+}
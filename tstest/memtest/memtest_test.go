@@ -0,0 +1,19 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package memtest
+
+import (
+	"testing"
+)
+
+var sink []byte
+
+func TestCheck(t *testing.T) {
+	Check(t, []Budget{
+		{Name: "none", Allocs: 0, Run: func() {}},
+		{Name: "exact", Allocs: 1, Run: func() { sink = make([]byte, 64) }},
+		{Name: "under", Allocs: 2, Run: func() { sink = make([]byte, 64) }},
+	})
+}
@@ -48,6 +48,41 @@ type mapping struct {
 	AddressAndPortDependentNAT
 )
 
+var natTypeNames = map[NATType]string{
+	EndpointIndependentNAT:     "endpoint-independent",
+	AddressDependentNAT:        "address-dependent",
+	AddressAndPortDependentNAT: "address-and-port-dependent",
+}
+
+func (t NATType) String() string {
+	if s, ok := natTypeNames[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("NATType(%d)", int(t))
+}
+
+// UnmarshalText parses t from its String form. It also accepts "cone"
+// for EndpointIndependentNAT and "symmetric" for
+// AddressAndPortDependentNAT.
+func (t *NATType) UnmarshalText(b []byte) error {
+	switch s := string(b); s {
+	case "cone":
+		*t = EndpointIndependentNAT
+		return nil
+	case "symmetric":
+		*t = AddressAndPortDependentNAT
+		return nil
+	default:
+		for v, name := range natTypeNames {
+			if s == name {
+				*t = v
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown NAT type %q", s)
+	}
+}
+
 // natKey is the lookup key for a NAT session. While it contains a
 // 4-tuple ({src,dst} {ip,port}), some NATTypes will zero out some
 // fields, so in practice the key is either a 2-tuple (src only),
@@ -97,6 +132,11 @@ type SNAT44 struct {
 	// TimeNow is a function that returns the current time. If
 	// nil, time.Now is used.
 	TimeNow func() time.Time
+	// Hairpin specifies whether the NAT supports hairpinning: LAN
+	// packets sent to one of its mapped WAN ip:ports are translated
+	// and sent back into the LAN, as if they'd gone out to the
+	// internet and come back. Without it, such packets are dropped.
+	Hairpin bool
 
 	mu    sync.Mutex
 	byLAN map[natKey]*mapping         // lookup by outbound packet tuple
@@ -136,6 +176,11 @@ func (n *SNAT44) HandleOut(p *Packet, oif *Interface) *Packet {
 }
 
 func (n *SNAT44) HandleIn(p *Packet, iif *Interface) *Packet {
+	if n.Hairpin && iif != n.ExternalInterface && p.Dst.Addr() == n.ExternalInterface.V4() {
+		if p2 := n.hairpin(p); p2 != nil {
+			return p2
+		}
+	}
 	if iif != n.ExternalInterface {
 		// NAT can't apply, defer to firewall.
 		if n.Firewall != nil {
@@ -192,22 +237,7 @@ func (n *SNAT44) HandleForward(p *Packet, iif, oif *Interface) *Packet {
 		defer n.mu.Unlock()
 		n.initLocked()
 
-		k := n.Type.key(p.Src, p.Dst)
-		now := n.timeNow()
-		m := n.byLAN[k]
-		if m == nil || now.After(m.deadline) {
-			pc, wanAddr := n.allocateMappedPort()
-			m = &mapping{
-				lanSrc: p.Src,
-				lanDst: p.Dst,
-				wanSrc: wanAddr,
-				pc:     pc,
-			}
-			n.byLAN[k] = m
-			n.byWAN[wanAddr] = m
-		}
-		m.deadline = now.Add(n.mappingTimeout())
-		p.Src = m.wanSrc
+		p.Src = n.outboundMappingLocked(p.Src, p.Dst).wanSrc
 		p.Trace("snat from %v", p.Src)
 		return p
 	case iif == n.ExternalInterface:
@@ -217,6 +247,9 @@ func (n *SNAT44) HandleForward(p *Packet, iif, oif *Interface) *Packet {
 			return n.Firewall.HandleForward(p, iif, oif)
 		}
 		return p
+	case n.Hairpin && iif == oif:
+		// Hairpinned packet going back into the LAN it came from.
+		return p
 	default:
 		// No NAT applies, invoke firewall or drop.
 		if n.Firewall != nil {
@@ -226,6 +259,45 @@ func (n *SNAT44) HandleForward(p *Packet, iif, oif *Interface) *Packet {
 	}
 }
 
+// outboundMappingLocked returns the mapping for a packet from src on
+// the LAN to dst, creating one if needed, and extends its lifetime.
+func (n *SNAT44) outboundMappingLocked(src, dst netip.AddrPort) *mapping {
+	k := n.Type.key(src, dst)
+	now := n.timeNow()
+	m := n.byLAN[k]
+	if m == nil || now.After(m.deadline) {
+		pc, wanAddr := n.allocateMappedPort()
+		m = &mapping{
+			lanSrc: src,
+			lanDst: dst,
+			wanSrc: wanAddr,
+			pc:     pc,
+		}
+		n.byLAN[k] = m
+		n.byWAN[wanAddr] = m
+	}
+	m.deadline = now.Add(n.mappingTimeout())
+	return m
+}
+
+// hairpin translates p, which arrived from the LAN destined to the
+// NAT's WAN address, to go back into the LAN to the owner of the
+// destination mapping. It returns nil if there's no such mapping.
+func (n *SNAT44) hairpin(p *Packet) *Packet {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.initLocked()
+
+	dm := n.byWAN[p.Dst]
+	if dm == nil || n.timeNow().After(dm.deadline) {
+		return nil
+	}
+	p.Src = n.outboundMappingLocked(p.Src, p.Dst).wanSrc
+	p.Dst = dm.lanSrc
+	p.Trace("hairpin from %v to %v", p.Src, p.Dst)
+	return p
+}
+
 func (n *SNAT44) allocateMappedPort() (net.PacketConn, netip.AddrPort) {
 	// Clean up old entries before trying to allocate, to free up any
 	// expired ports.
@@ -458,16 +458,26 @@ func unspecOf(ip netip.Addr) netip.Addr {
 // The first interface added to a Machine becomes that machine's
 // default route.
 func (m *Machine) Attach(interfaceName string, n *Network) *Interface {
+	return m.attach(interfaceName, n, true, true)
+}
+
+// attach is Attach, but only allocates addresses of the families
+// requested.
+func (m *Machine) attach(interfaceName string, n *Network, v4, v6 bool) *Interface {
 	f := &Interface{
 		machine: m,
 		net:     n,
 		name:    interfaceName,
 	}
-	if ip := n.allocIPv4(f); ip.IsValid() {
-		f.ips = append(f.ips, ip)
+	if v4 {
+		if ip := n.allocIPv4(f); ip.IsValid() {
+			f.ips = append(f.ips, ip)
+		}
 	}
-	if ip := n.allocIPv6(f); ip.IsValid() {
-		f.ips = append(f.ips, ip)
+	if v6 {
+		if ip := n.allocIPv6(f); ip.IsValid() {
+			f.ips = append(f.ips, ip)
+		}
 	}
 
 	m.mu.Lock()
@@ -508,3 +508,115 @@ func testNAT(t *testing.T, n *SNAT44, lanIf, wanIf *Interface, tests []natTest)
 		}
 	}
 }
+
+func TestParseTopology(t *testing.T) {
+	topo, err := ParseTopology([]byte(`{
+		"LANs": [{"Name": "home", "NAT": "symmetric", "Firewall": "address-dependent"}],
+		"Peers": [{"Name": "a", "LAN": "home"}, {"Name": "b", "IPv6Only": true}],
+		"WantPath": "derp"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := topo.LANs[0].NAT; got != AddressAndPortDependentNAT {
+		t.Errorf("NAT = %v; want %v", got, AddressAndPortDependentNAT)
+	}
+	if got := topo.LANs[0].Firewall; got == nil || *got != AddressDependentFirewall {
+		t.Errorf("Firewall = %v; want %v", got, AddressDependentFirewall)
+	}
+	lab, err := topo.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := lab.Peers[0].IP; !mustPrefix("192.168.0.0/24").Contains(ip) {
+		t.Errorf("peer a IP = %v; want on LAN", ip)
+	}
+	if ip := lab.Peers[1].IP; !ip.Is6() {
+		t.Errorf("peer b IP = %v; want IPv6", ip)
+	}
+
+	for _, bad := range []string{
+		`{"LANs": [{"Name": "home", "NAT": "full-cone"}]}`,
+		`{"Peers": [{"Name": "a"}], "WantPath": "relay"}`,
+		`{"Peers": [{"Name": "a", "Bogus": true}]}`,
+	} {
+		if _, err := ParseTopology([]byte(bad)); err == nil {
+			t.Errorf("ParseTopology(%s) succeeded; want error", bad)
+		}
+	}
+	topo, err = ParseTopology([]byte(`{"Peers": [{"Name": "a", "LAN": "nowhere"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := topo.Build(); err == nil {
+		t.Error("Build with unknown LAN succeeded; want error")
+	}
+}
+
+func TestTopologyHairpin(t *testing.T) {
+	for _, hairpin := range []bool{true, false} {
+		t.Run(fmt.Sprintf("hairpin=%v", hairpin), func(t *testing.T) {
+			topo, err := ParseTopology([]byte(fmt.Sprintf(`{
+				"LANs": [{"Name": "home", "NAT": "cone", "Hairpin": %v}],
+				"Peers": [{"Name": "a", "LAN": "home"}, {"Name": "b", "LAN": "home"}]
+			}`, hairpin)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			lab, err := topo.Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			stun, err := lab.STUN.ListenPacket(ctx, "udp4", ":3478")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stun.Close()
+			a, err := lab.Peers[0].ListenPacket(ctx, "udp4", ":123")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer a.Close()
+			b, err := lab.Peers[1].ListenPacket(ctx, "udp4", ":456")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Close()
+
+			// Learn a's WAN ip:port, as STUN would.
+			stunAddr := net.UDPAddrFromAddrPort(netip.AddrPortFrom(lab.STUNIP, 3478))
+			if _, err := a.WriteTo([]byte("stun"), stunAddr); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 1500)
+			_, aWAN, err := stun.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := b.WriteTo([]byte("hairpin"), aWAN); err != nil {
+				t.Fatal(err)
+			}
+			got := make(chan string, 1)
+			go func() {
+				buf := make([]byte, 1500)
+				if n, _, err := a.ReadFrom(buf); err == nil {
+					got <- string(buf[:n])
+				}
+			}()
+			select {
+			case msg := <-got:
+				if !hairpin {
+					t.Errorf("got %q without hairpinning", msg)
+				} else if msg != "hairpin" {
+					t.Errorf("got %q; want %q", msg, "hairpin")
+				}
+			case <-time.After(time.Second):
+				if hairpin {
+					t.Error("hairpinned packet not received")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package natlab
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PathType is the kind of path two peers use to talk to each other.
+type PathType string
+
+const (
+	// PathDirect is a direct UDP path between the peers, possibly
+	// through NATs.
+	PathDirect PathType = "direct"
+	// PathDERP is a path relayed through a DERP server.
+	PathDERP PathType = "derp"
+)
+
+// A Topology is a declarative description of a test network: a
+// simulated internet with a STUN server, private LANs behind NAT
+// routers, and peers on the internet or on those LANs. Topologies can
+// be written as JSON, for loading from test data with ParseTopology or
+// LoadTopologies. Build constructs the network.
+type Topology struct {
+	// Name identifies the topology in test output. LoadTopologies
+	// defaults it to the file's base name.
+	Name string
+
+	// LANs are the private networks, each behind its own NAT router.
+	LANs []LAN
+
+	// Peers are the machines being tested.
+	Peers []Peer
+
+	// WantPath, if non-empty, is the kind of path the peers are
+	// expected to end up using with each other.
+	WantPath PathType
+}
+
+// A LAN is a private IPv4 network behind a NAT router.
+type LAN struct {
+	// Name identifies the LAN, for Peer.LAN.
+	Name string
+
+	// NAT is the router's mapping behavior. In JSON, it's one of
+	// "endpoint-independent" (or "cone"), "address-dependent", or
+	// "address-and-port-dependent" (or "symmetric").
+	NAT NATType
+
+	// Firewall, if non-nil, is the filtering behavior of a stateful
+	// firewall on the router. Without one, traffic to a mapped port is
+	// let in from anywhere.
+	Firewall *FirewallType
+
+	// Hairpin is whether the NAT supports hairpinning, letting peers
+	// on the LAN reach each other by their WAN ip:ports.
+	Hairpin bool
+
+	// BlockUDP is whether the router drops all traffic between the
+	// LAN and the internet. natlab only carries UDP, so this models a
+	// network where UDP is blocked and only TCP (DERP) gets out.
+	BlockUDP bool
+}
+
+// A Peer is a machine under test.
+type Peer struct {
+	// Name identifies the peer in test output.
+	Name string
+
+	// LAN is the name of the LAN the peer is on, or empty if it's
+	// directly on the internet.
+	LAN string
+
+	// Firewall, if non-nil, is the filtering behavior of a stateful
+	// firewall on the peer itself.
+	Firewall *FirewallType
+
+	// BlockUDP is whether the peer's UDP traffic is blocked entirely.
+	BlockUDP bool
+
+	// IPv6Only is whether the peer has only an IPv6 address. Only
+	// peers on the internet can be IPv6-only, as LANs are IPv4.
+	IPv6Only bool
+}
+
+// A Lab is a network built from a Topology.
+type Lab struct {
+	Topology *Topology
+	Internet *Network
+
+	// STUN is a machine on the internet to run a STUN server on, at
+	// STUNIP.
+	STUN   *Machine
+	STUNIP netip.Addr
+
+	// Peers are the machines for Topology.Peers, in the same order.
+	Peers []*LabPeer
+}
+
+// A LabPeer is a machine built for a Peer.
+type LabPeer struct {
+	*Machine
+	IP netip.Addr // the peer's (v4, unless IPv6Only) address
+}
+
+// ParseTopology parses a JSON topology.
+func ParseTopology(b []byte) (*Topology, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	t := new(Topology)
+	if err := d.Decode(t); err != nil {
+		return nil, err
+	}
+	switch t.WantPath {
+	case "", PathDirect, PathDERP:
+	default:
+		return nil, fmt.Errorf("unknown WantPath %q", t.WantPath)
+	}
+	return t, nil
+}
+
+// LoadTopologies parses the topologies in the *.json files in dir, in
+// file name order.
+func LoadTopologies(dir string) ([]*Topology, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var ts []*Topology
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		t, err := ParseTopology(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+		if t.Name == "" {
+			t.Name = strings.TrimSuffix(filepath.Base(f), ".json")
+		}
+		ts = append(ts, t)
+	}
+	return ts, nil
+}
+
+// Build constructs the network described by t.
+func (t *Topology) Build() (*Lab, error) {
+	if len(t.LANs) > 255 {
+		return nil, fmt.Errorf("too many LANs")
+	}
+	lab := &Lab{
+		Topology: t,
+		Internet: NewInternet(),
+		STUN:     &Machine{Name: "stun"},
+	}
+	lab.STUNIP = lab.STUN.Attach("eth0", lab.Internet).V4()
+
+	lans := map[string]*Network{}
+	for i, l := range t.LANs {
+		if l.Name == "" {
+			return nil, fmt.Errorf("LAN %d has no name", i)
+		}
+		if lans[l.Name] != nil {
+			return nil, fmt.Errorf("duplicate LAN %q", l.Name)
+		}
+		lan := &Network{
+			Name:    l.Name,
+			Prefix4: netip.PrefixFrom(netip.AddrFrom4([4]byte{192, 168, byte(i), 0}), 24),
+		}
+		lans[l.Name] = lan
+
+		router := &Machine{Name: l.Name + "-nat"}
+		wanIf := router.Attach("wan", lab.Internet)
+		lanIf := router.Attach("lan", lan)
+		lan.SetDefaultGateway(lanIf)
+		if l.BlockUDP {
+			router.PacketHandler = blackhole{}
+			continue
+		}
+		nat := &SNAT44{
+			Machine:           router,
+			ExternalInterface: wanIf,
+			Type:              l.NAT,
+			Hairpin:           l.Hairpin,
+		}
+		if l.Firewall != nil {
+			nat.Firewall = &Firewall{
+				Type:             *l.Firewall,
+				TrustedInterface: lanIf,
+			}
+		}
+		router.PacketHandler = nat
+	}
+
+	for i, p := range t.Peers {
+		if p.Name == "" {
+			p.Name = fmt.Sprintf("peer%d", i+1)
+		}
+		net := lab.Internet
+		if p.LAN != "" {
+			net = lans[p.LAN]
+			if net == nil {
+				return nil, fmt.Errorf("peer %q is on unknown LAN %q", p.Name, p.LAN)
+			}
+			if p.IPv6Only {
+				return nil, fmt.Errorf("peer %q is IPv6-only on a LAN", p.Name)
+			}
+		}
+		m := &Machine{Name: p.Name}
+		switch {
+		case p.BlockUDP:
+			m.PacketHandler = blackhole{}
+		case p.Firewall != nil:
+			m.PacketHandler = &Firewall{Type: *p.Firewall}
+		}
+		ifc := m.attach("eth0", net, !p.IPv6Only, true)
+		lp := &LabPeer{Machine: m, IP: ifc.V4()}
+		if p.IPv6Only {
+			lp.IP = ifc.V6()
+		}
+		lab.Peers = append(lab.Peers, lp)
+	}
+	return lab, nil
+}
+
+// blackhole is a PacketHandler that drops every packet.
+type blackhole struct{}
+
+func (blackhole) HandleIn(p *Packet, iif *Interface) *Packet {
+	p.Trace("blackholed")
+	return nil
+}
+
+func (blackhole) HandleOut(p *Packet, oif *Interface) *Packet {
+	p.Trace("blackholed")
+	return nil
+}
+
+func (blackhole) HandleForward(p *Packet, iif, oif *Interface) *Packet {
+	p.Trace("blackholed")
+	return nil
+}
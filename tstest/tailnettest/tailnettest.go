@@ -0,0 +1,217 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package tailnettest runs an in-memory tailnet for integration tests:
+// a testcontrol coordination server, a local DERP and STUN server, and
+// any number of tsnet nodes, all in the test's process and all on
+// localhost.
+//
+// The control server is exposed as Tailnet.Control, so tests can
+// program the tailnet with its methods: SetPacketFilter for ACLs,
+// SetMapResponseHook to change the netmaps nodes get, and so on.
+//
+// Node logs, which tsnet normally uploads to log.tailscale.io, are sent
+// to a local server and discarded. This is done with the TS_LOG_TARGET
+// environment variable, so tests using New can't be parallel.
+package tailnettest
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"tailscale.com/derp"
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/stun/stuntest"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tsnet"
+	"tailscale.com/tstest/integration/testcontrol"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/nettype"
+)
+
+// Tailnet is an in-memory tailnet for a test. Create one with New.
+type Tailnet struct {
+	// Control is the tailnet's coordination server.
+	Control *testcontrol.Server
+
+	// DERPMap is the map of the tailnet's single, local DERP region.
+	DERPMap *tailcfg.DERPMap
+
+	tb testing.TB
+
+	logMu   sync.Mutex
+	logDone bool // test finished; drop logs
+}
+
+// New returns a new Tailnet with no nodes. The Tailnet and all its
+// nodes are shut down when tb's test finishes.
+func New(tb testing.TB) *Tailnet {
+	tb.Helper()
+	tn := &Tailnet{tb: tb}
+	tb.Cleanup(func() {
+		// Registered first, so this runs after the nodes are
+		// closed. Nodes may still log from background goroutines,
+		// which testing doesn't allow after the test is done.
+		tn.logMu.Lock()
+		defer tn.logMu.Unlock()
+		tn.logDone = true
+	})
+
+	logSink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	}))
+	tb.Cleanup(logSink.Close)
+	tb.Setenv("TS_LOG_TARGET", logSink.URL)
+
+	tn.DERPMap = runDERPAndSTUN(tb, logger.WithPrefix(tn.logf, "derp: "), "127.0.0.1")
+
+	tn.Control = &testcontrol.Server{
+		DERPMap: tn.DERPMap,
+		Logf:    logger.WithPrefix(tn.logf, "control: "),
+	}
+	tn.Control.HTTPTestServer = httptest.NewUnstartedServer(tn.Control)
+	tn.Control.HTTPTestServer.Start()
+	tb.Cleanup(tn.Control.HTTPTestServer.Close)
+	return tn
+}
+
+func (tn *Tailnet) logf(format string, args ...any) {
+	tn.logMu.Lock()
+	defer tn.logMu.Unlock()
+	if !tn.logDone {
+		tn.tb.Logf(format, args...)
+	}
+}
+
+// NewNode starts a new tsnet node on the tailnet with the given
+// hostname and returns it once it's Running. The node is closed when
+// the test finishes.
+func (tn *Tailnet) NewNode(hostname string) *tsnet.Server {
+	tn.tb.Helper()
+	s := &tsnet.Server{
+		Dir:        tn.tb.TempDir(),
+		Hostname:   hostname,
+		ControlURL: tn.Control.BaseURL(),
+		Logf:       logger.WithPrefix(tn.logf, hostname+": "),
+	}
+	if err := s.Start(); err != nil {
+		tn.tb.Fatalf("starting node %q: %v", hostname, err)
+	}
+	tn.tb.Cleanup(func() { s.Close() })
+
+	if err := tn.await(s, func(st *ipnstate.Status) bool {
+		return st.BackendState == "Running" && len(st.TailscaleIPs) > 0
+	}); err != nil {
+		tn.tb.Fatalf("node %q didn't start: %v", hostname, err)
+	}
+	return s
+}
+
+// NewNodes starts n nodes named node1 through nodeN, returning once
+// each one is Running and knows about all the others.
+func (tn *Tailnet) NewNodes(n int) []*tsnet.Server {
+	tn.tb.Helper()
+	nodes := make([]*tsnet.Server, n)
+	for i := range nodes {
+		nodes[i] = tn.NewNode(fmt.Sprintf("node%d", i+1))
+	}
+	for i, s := range nodes {
+		if err := tn.await(s, func(st *ipnstate.Status) bool {
+			return len(st.Peer) >= n-1
+		}); err != nil {
+			tn.tb.Fatalf("node%d didn't see its %d peers: %v", i+1, n-1, err)
+		}
+	}
+	return nodes
+}
+
+// AwaitStatus waits for the status of s to satisfy cond, failing the
+// test if it doesn't within 30 seconds.
+func (tn *Tailnet) AwaitStatus(s *tsnet.Server, cond func(*ipnstate.Status) bool) {
+	tn.tb.Helper()
+	if err := tn.await(s, cond); err != nil {
+		tn.tb.Fatal(err)
+	}
+}
+
+func (tn *Tailnet) await(s *tsnet.Server, cond func(*ipnstate.Status) bool) error {
+	lc, err := s.LocalClient()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for {
+		st, err := lc.Status(ctx)
+		if err == nil && cond(st) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("timed out; last state %v", st.BackendState)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// runDERPAndSTUN runs a DERP and STUN server on ipAddress until the
+// test finishes, returning the DERP map for them.
+func runDERPAndSTUN(tb testing.TB, logf logger.Logf, ipAddress string) *tailcfg.DERPMap {
+	d := derp.NewServer(key.NewNode(), logf)
+
+	ln, err := net.Listen("tcp", net.JoinHostPort(ipAddress, "0"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	httpsrv := httptest.NewUnstartedServer(derphttp.Handler(d))
+	httpsrv.Listener = ln
+	httpsrv.Config.ErrorLog = logger.StdLogger(logf)
+	httpsrv.Config.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	httpsrv.StartTLS()
+
+	stunAddr, stunCleanup := stuntest.ServeWithPacketListener(tb, nettype.Std{})
+
+	tb.Cleanup(func() {
+		httpsrv.CloseClientConnections()
+		httpsrv.Close()
+		d.Close()
+		stunCleanup()
+	})
+
+	return &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {
+				RegionID:   1,
+				RegionCode: "test",
+				Nodes: []*tailcfg.DERPNode{
+					{
+						Name:             "t1",
+						RegionID:         1,
+						HostName:         ipAddress,
+						IPv4:             ipAddress,
+						IPv6:             "none",
+						STUNPort:         stunAddr.Port,
+						DERPPort:         ln.Addr().(*net.TCPAddr).Port,
+						InsecureForTests: true,
+						STUNTestIP:       ipAddress,
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tailnettest
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestTailnet(t *testing.T) {
+	tn := New(t)
+	nodes := tn.NewNodes(2)
+
+	ln, err := nodes[0].Listen("tcp", ":81")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(c, "hello")
+			c.Close()
+		}
+	}()
+
+	lc, err := nodes[0].LocalClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := lc.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := net.JoinHostPort(st.TailscaleIPs[0].String(), "81")
+
+	dial := func(timeout time.Duration) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		c, err := nodes[1].Dial(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		_, err = io.ReadAll(c)
+		return err
+	}
+	if err := dial(5 * time.Second); err != nil {
+		t.Fatalf("dial with default ACLs: %v", err)
+	}
+
+	// Only allow a port nothing's listening on.
+	tn.Control.SetPacketFilter([]tailcfg.FilterRule{{
+		SrcIPs:   []string{"*"},
+		DstPorts: []tailcfg.NetPortRange{{IP: "*", Ports: tailcfg.PortRange{First: 82, Last: 82}}},
+	}})
+	// Wait for the new filter to reach the nodes.
+	for deadline := time.Now().Add(10 * time.Second); dial(time.Second) == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("dial still succeeds to port blocked by packet filter")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
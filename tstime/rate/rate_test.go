@@ -112,6 +112,25 @@ func TestLimiterJumpBackwards(t *testing.T) {
 	})
 }
 
+func TestLimiterAllowN(t *testing.T) {
+	lim := NewLimiter(10, 5)
+	if !lim.allowN(t0, 3) {
+		t.Fatal("allowN(3) of a full bucket = false")
+	}
+	if lim.allowN(t0, 3) {
+		t.Fatal("allowN(3) of 2 tokens = true")
+	}
+	if !lim.allowN(t0, 2) {
+		t.Fatal("allowN(2) of 2 tokens = false; a denied allowN must not consume tokens")
+	}
+	if lim.allowN(t0, 1) {
+		t.Fatal("allowN(1) of an empty bucket = true")
+	}
+	if !lim.allowN(t1, 1) {
+		t.Fatal("allowN(1) after refill = false")
+	}
+}
+
 // Ensure that tokensFromDuration doesn't produce
 // rounding errors by truncating nanoseconds.
 // See golang.org/issues/34861.
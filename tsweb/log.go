@@ -46,6 +46,9 @@ type AccessLogRecord struct {
 	Bytes int `json:"bytes,omitempty"`
 	// Error encountered during request processing.
 	Err string `json:"err,omitempty"`
+
+	// The request's trace ID, from its tracing.Header or generated.
+	TraceID string `json:"trace_id,omitempty"`
 }
 
 // String returns m as a JSON string.
@@ -0,0 +1,112 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package tracing propagates trace IDs through HTTP requests, such as
+// from the CLI to the LocalAPI to a peer's PeerAPI, so the log lines
+// of one slow request can be found in the logs of each of them.
+//
+// It's separate from package tsweb so that clients can use it without
+// depending on all of tsweb.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"tailscale.com/types/logger"
+)
+
+// Header is the HTTP header carrying a request's trace ID, on both
+// requests and responses.
+const Header = "Tailscale-Trace-Id"
+
+// maxIDLen is the longest trace ID accepted from a request.
+const maxIDLen = 64
+
+type contextKey struct{}
+
+// NewID returns a new random trace ID.
+func NewID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Valid reports whether id is a valid trace ID: 1 to 64 letters,
+// digits, hyphens or underscores. IDs from requests that aren't valid
+// are replaced, so they can't inject anything into logs.
+func Valid(id string) bool {
+	if id == "" || len(id) > maxIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// WithID returns a copy of ctx carrying the trace ID id.
+func WithID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the trace ID carried by ctx, or the empty string
+// if it has none.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Request returns r with a trace ID in its context: the one in r's
+// Header if valid, or else a new one. It also sets the Header on w so
+// the client learns the ID.
+func Request(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get(Header)
+	if !Valid(id) {
+		id = NewID()
+	}
+	w.Header().Set(Header, id)
+	return r.WithContext(WithID(r.Context(), id))
+}
+
+// Handler returns an http.Handler that calls Request before passing
+// requests to h.
+func Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, Request(w, r))
+	})
+}
+
+// SetHeader sets the Header of the outgoing request req to the trace
+// ID of its context, or to a new ID if its context has none. If req
+// already has the Header, it's left alone.
+func SetHeader(req *http.Request) {
+	if req.Header.Get(Header) != "" {
+		return
+	}
+	id := FromContext(req.Context())
+	if id == "" {
+		id = NewID()
+	}
+	req.Header.Set(Header, id)
+}
+
+// Logf returns logf with the trace ID of ctx, if any, added to the
+// end of each message.
+func Logf(ctx context.Context, logf logger.Logf) logger.Logf {
+	id := FromContext(ctx)
+	if id == "" {
+		return logf
+	}
+	return func(format string, args ...any) {
+		args = append(args[:len(args):len(args)], id)
+		logf(strings.TrimSuffix(format, "\n")+" (trace %s)", args...)
+	}
+}
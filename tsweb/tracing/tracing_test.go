@@ -0,0 +1,75 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequest(t *testing.T) {
+	var gotID string
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotID = FromContext(r.Context())
+	}))
+
+	tests := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{"none", "", false},
+		{"valid", "cli-0123abcd", true},
+		{"invalid", "bad id\nwith newline", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tt.header != "" {
+			req.Header.Set(Header, tt.header)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if !Valid(gotID) {
+			t.Errorf("%s: handler got invalid ID %q", tt.name, gotID)
+		}
+		if tt.keep && gotID != tt.header {
+			t.Errorf("%s: handler got ID %q; want %q", tt.name, gotID, tt.header)
+		}
+		if got := rec.Header().Get(Header); got != gotID {
+			t.Errorf("%s: response header %q; want %q", tt.name, got, gotID)
+		}
+	}
+}
+
+func TestSetHeader(t *testing.T) {
+	req, _ := http.NewRequestWithContext(WithID(context.Background(), "abc"), "GET", "http://foo/", nil)
+	SetHeader(req)
+	if got := req.Header.Get(Header); got != "abc" {
+		t.Errorf("header = %q; want abc", got)
+	}
+
+	req, _ = http.NewRequest("GET", "http://foo/", nil)
+	SetHeader(req)
+	if got := req.Header.Get(Header); !Valid(got) {
+		t.Errorf("header = %q; want a new ID", got)
+	}
+}
+
+func TestLogf(t *testing.T) {
+	var got string
+	logf := func(format string, args ...any) { got = fmt.Sprintf(format, args...) }
+
+	Logf(context.Background(), logf)("hello %d", 1)
+	if got != "hello 1" {
+		t.Errorf("without ID, got %q", got)
+	}
+	Logf(WithID(context.Background(), "abc"), logf)("hello %d\n", 2)
+	if want := "hello 2 (trace abc)"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
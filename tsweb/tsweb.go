@@ -31,6 +31,7 @@
 	"tailscale.com/envknob"
 	"tailscale.com/metrics"
 	"tailscale.com/net/tsaddr"
+	"tailscale.com/tsweb/tracing"
 	"tailscale.com/types/logger"
 	"tailscale.com/version"
 )
@@ -239,6 +240,7 @@ type retHandler struct {
 
 // ServeHTTP implements the http.Handler interface.
 func (h retHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = tracing.Request(w, r)
 	msg := AccessLogRecord{
 		When:       h.opts.Now(),
 		RemoteAddr: r.RemoteAddr,
@@ -249,6 +251,7 @@ func (h retHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		RequestURI: r.URL.RequestURI(),
 		UserAgent:  r.UserAgent(),
 		Referer:    r.Referer(),
+		TraceID:    tracing.FromContext(r.Context()),
 	}
 
 	lw := &loggingResponseWriter{ResponseWriter: w, logf: h.opts.Logf}
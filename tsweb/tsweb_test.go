@@ -21,6 +21,7 @@
 	"github.com/google/go-cmp/cmp"
 	"tailscale.com/metrics"
 	"tailscale.com/tstest"
+	"tailscale.com/tsweb/tracing"
 )
 
 type noopHijacker struct {
@@ -284,6 +285,10 @@ func TestStdHandler(t *testing.T) {
 				t.Errorf("handler didn't write a request log")
 				return
 			}
+			if id := res.Header.Get(tracing.Header); logs[0].TraceID == "" || logs[0].TraceID != id {
+				t.Errorf("logged trace ID %q; want non-empty and equal to response header %q", logs[0].TraceID, id)
+			}
+			logs[0].TraceID = ""
 			errTransform := cmp.Transformer("err", func(e error) string {
 				if e == nil {
 					return ""
@@ -15,6 +15,10 @@
 )
 
 const (
+	// discoPrivateHexPrefix is the prefix used to identify a
+	// hex-encoded disco private key.
+	discoPrivateHexPrefix = "discopriv:"
+
 	// discoPublicHexPrefix is the prefix used to identify a
 	// hex-encoded disco public key.
 	//
@@ -63,6 +67,16 @@ func (k DiscoPrivate) Public() DiscoPublic {
 	return ret
 }
 
+// MarshalText implements encoding.TextMarshaler.
+func (k DiscoPrivate) MarshalText() ([]byte, error) {
+	return toHex(k.k[:], discoPrivateHexPrefix), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (k *DiscoPrivate) UnmarshalText(b []byte) error {
+	return parseHex(k.k[:], mem.B(b), mem.S(discoPrivateHexPrefix))
+}
+
 // Shared returns the DiscoShared for communication betweek k and p.
 func (k DiscoPrivate) Shared(p DiscoPublic) DiscoShared {
 	if k.IsZero() || p.IsZero() {
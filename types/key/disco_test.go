@@ -75,6 +75,24 @@ type key struct {
 	}
 }
 
+func TestDiscoPrivateSerialization(t *testing.T) {
+	k := NewDisco()
+	bs, err := k.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(bs, []byte("discopriv:")) {
+		t.Fatalf("serialization of private disco key %q has wrong prefix", bs)
+	}
+	var k2 DiscoPrivate
+	if err := k2.UnmarshalText(bs); err != nil {
+		t.Fatal(err)
+	}
+	if !k2.Equal(k) {
+		t.Error("private disco key doesn't roundtrip")
+	}
+}
+
 func TestDiscoShared(t *testing.T) {
 	k1, k2 := NewDisco(), NewDisco()
 	s1, s2 := k1.Shared(k2.Public()), k2.Shared(k1.Public())
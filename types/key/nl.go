@@ -100,6 +100,18 @@ type NLPublic struct {
 	k [ed25519.PublicKeySize]byte
 }
 
+// NLPublicFromEd25519Unsafe converts an ed25519 public key into
+// an NLPublic.
+//
+// It's unsafe in that nothing checks that public is a network-lock
+// key, such as the ID of a key trusted by a tailnet key authority,
+// rather than some other ed25519 key.
+func NLPublicFromEd25519Unsafe(public ed25519.PublicKey) NLPublic {
+	var out NLPublic
+	copy(out.k[:], public)
+	return out
+}
+
 // MarshalText implements encoding.TextUnmarshaler.
 func (k *NLPublic) UnmarshalText(b []byte) error {
 	return parseHex(k.k[:], mem.B(b), mem.S(nlPublicHexPrefix))
@@ -61,6 +61,11 @@ type NetworkMap struct {
 	// check problems.
 	ControlHealth []string
 
+	// TKACheckpoint, if non-nil, is the policy by which this node
+	// should add checkpoints to the tailnet key authority, as last
+	// sent by control in tailcfg.TKAMapResponse.Checkpoint.
+	TKACheckpoint *tailcfg.TKACheckpointPolicy
+
 	// ACLs
 
 	User tailcfg.UserID
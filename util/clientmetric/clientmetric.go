@@ -20,14 +20,13 @@
 )
 
 var (
-	mu          sync.Mutex // guards vars in this block
-	metrics     = map[string]*Metric{}
-	numWireID   int         // how many wireIDs have been allocated
-	lastDelta   time.Time   // time of last call to EncodeLogTailMetricsDelta
-	sortedDirty bool        // whether sorted needs to be rebuilt
-	sorted      []*Metric   // by name
-	lastLogVal  []scanEntry // by Metric.regIdx
-	unsorted    []*Metric   // by Metric.regIdx
+	mu          sync.Mutex                    // guards vars in this block
+	metrics     = map[string]*Metric{}        // by Metric.key
+	families    = map[string]*LabeledMetric{} // by name
+	sortedDirty bool                          // whether sorted needs to be rebuilt
+	sorted      []*Metric                     // by name
+	unsorted    []*Metric                     // by Metric.regIdx
+	defaultEnc  = new(DeltaEncoder)           // used by EncodeLogTailMetricsDelta
 
 	// valFreeList is a set of free contiguous int64s whose
 	// element addresses get assigned to Metric.v.
@@ -37,13 +36,6 @@
 	valFreeList []int64
 )
 
-// scanEntry contains the minimal data needed for quickly scanning
-// memory for changed values. It's small to reduce memory pressure.
-type scanEntry struct {
-	v          *int64 // Metric.v
-	lastLogged int64  // last logged value
-}
-
 // Type is a metric type: counter or gauge.
 type Type uint8
 
@@ -57,27 +49,28 @@ type scanEntry struct {
 // It's safe for concurrent use.
 type Metric struct {
 	v      *int64 // atomic; the metric value
-	regIdx int    // index into lastLogVal and unsorted
+	regIdx int    // index into unsorted and DeltaEncoder.ents
 	name   string
 	typ    Type
-
-	// The following fields are owned by the package-level 'mu':
-
-	// wireID is the lazily-allocated "wire ID". Until a metric is encoded
-	// in the logs (by EncodeLogTailMetricsDelta), it has no wireID. This
-	// ensures that unused metrics don't waste valuable low numbers, which
-	// encode with varints with fewer bytes.
-	wireID int
-
-	// lastNamed is the last time the name of this metric was
-	// written on the wire.
-	lastNamed time.Time
+	label  string // "key=value" if part of a LabeledMetric, else empty
 }
 
 func (m *Metric) Name() string { return m.name }
 func (m *Metric) Value() int64 { return atomic.LoadInt64(m.v) }
 func (m *Metric) Type() Type   { return m.typ }
 
+// Label returns the label of a metric in a LabeledMetric, as
+// "key=value", or the empty string if m isn't labeled.
+func (m *Metric) Label() string { return m.label }
+
+// key returns the key of m in the metrics map.
+func (m *Metric) key() string {
+	if m.label == "" {
+		return m.name
+	}
+	return m.name + "{" + m.label + "}"
+}
+
 // Add increments m's value by n.
 //
 // If m is of type counter, n should not be negative.
@@ -100,10 +93,13 @@ func (m *Metric) Publish() {
 	if m.name == "" {
 		panic("unnamed Metric")
 	}
-	if _, dup := metrics[m.name]; dup {
+	if _, dup := metrics[m.key()]; dup {
+		panic("duplicate metric " + m.key())
+	}
+	if _, dup := families[m.name]; dup && m.label == "" {
 		panic("duplicate metric " + m.name)
 	}
-	metrics[m.name] = m
+	metrics[m.key()] = m
 	sortedDirty = true
 
 	if len(valFreeList) == 0 {
@@ -114,7 +110,6 @@ func (m *Metric) Publish() {
 
 	m.regIdx = len(unsorted)
 	unsorted = append(unsorted, m)
-	lastLogVal = append(lastLogVal, scanEntry{v: m.v})
 }
 
 // Metrics returns the sorted list of metrics.
@@ -130,19 +125,23 @@ func Metrics() []*Metric {
 			sorted = append(sorted, m)
 		}
 		sort.Slice(sorted, func(i, j int) bool {
-			return sorted[i].name < sorted[j].name
+			if sorted[i].name != sorted[j].name {
+				return sorted[i].name < sorted[j].name
+			}
+			return sorted[i].label < sorted[j].label
 		})
 	}
 	return sorted
 }
 
-// HasPublished reports whether a metric with the given name has already been
-// published.
+// HasPublished reports whether a metric or LabeledMetric with the given
+// name has already been published.
 func HasPublished(name string) bool {
 	mu.Lock()
 	defer mu.Unlock()
 	_, ok := metrics[name]
-	return ok
+	_, fok := families[name]
+	return ok || fok
 }
 
 // NewUnpublished initializes a new Metric without calling Publish on
@@ -183,14 +182,22 @@ func NewGauge(name string) *Metric {
 //
 // See https://github.com/prometheus/docs/blob/main/content/docs/instrumenting/exposition_formats.md
 func WritePrometheusExpositionFormat(w io.Writer) {
+	var last string
 	for _, m := range Metrics() {
-		switch m.Type() {
-		case TypeGauge:
-			fmt.Fprintf(w, "# TYPE %s gauge\n", m.Name())
-		case TypeCounter:
-			fmt.Fprintf(w, "# TYPE %s counter\n", m.Name())
+		if m.Name() != last {
+			last = m.Name()
+			switch m.Type() {
+			case TypeGauge:
+				fmt.Fprintf(w, "# TYPE %s gauge\n", m.Name())
+			case TypeCounter:
+				fmt.Fprintf(w, "# TYPE %s counter\n", m.Name())
+			}
+		}
+		if k, v, ok := strings.Cut(m.Label(), "="); ok {
+			fmt.Fprintf(w, "%s{%s=%q} %v\n", m.Name(), k, v, m.Value())
+		} else {
+			fmt.Fprintf(w, "%s %v\n", m.Name(), m.Value())
 		}
-		fmt.Fprintf(w, "%s %v\n", m.Name(), m.Value())
 	}
 }
 
@@ -218,43 +225,95 @@ func WritePrometheusExpositionFormat(w io.Writer) {
 // The current encoding is:
 //   - name immediately following metric:
 //     'N' + hex(varint(len(name))) + name
+//   - label of the metric named by the immediately preceding name
+//     record, for metrics in a LabeledMetric:
+//     'L' + hex(varint(len(label))) + label, where label is "key=value"
 //   - set value of a metric:
 //     'S' + hex(varint(wireid)) + hex(varint(value))
 //   - increment a metric: (decrements if negative)
 //     'I' + hex(varint(wireid)) + hex(varint(value))
 func EncodeLogTailMetricsDelta() string {
+	return defaultEnc.Encode()
+}
+
+// DeltaEncoder encodes metrics differences for one log stream, in the
+// format described on EncodeLogTailMetricsDelta. Each stream needs its
+// own DeltaEncoder: sharing one (or sharing EncodeLogTailMetricsDelta)
+// between streams splits the deltas among them, so that no stream sees
+// the complete values.
+//
+// The zero value is ready for use. It's safe for concurrent use.
+type DeltaEncoder struct {
+	// The following fields are owned by the package-level 'mu':
+
+	last      time.Time    // time of last call to Encode
+	numWireID int          // how many wireIDs have been allocated
+	ents      []deltaEntry // by Metric.regIdx
+}
+
+// deltaEntry is a DeltaEncoder's state for one Metric.
+type deltaEntry struct {
+	lastLogged int64 // last logged value
+
+	// wireID is the lazily-allocated "wire ID". Until a metric is encoded
+	// in the stream, it has no wireID. This ensures that unused metrics
+	// don't waste valuable low numbers, which encode with varints with
+	// fewer bytes.
+	wireID int
+
+	// lastNamed is the last time the name of this metric was
+	// written on the wire.
+	lastNamed time.Time
+}
+
+// NewDeltaEncoder returns a new DeltaEncoder. Its first Encode
+// reports the current value of every metric that's non-zero.
+func NewDeltaEncoder() *DeltaEncoder {
+	return new(DeltaEncoder)
+}
+
+// Encode returns an encoded string representing the metrics
+// differences since the previous call. It implements the requirements
+// of a logtail.Config.MetricsDelta func.
+func (e *DeltaEncoder) Encode() string {
 	mu.Lock()
 	defer mu.Unlock()
 
 	now := time.Now()
-	if !lastDelta.IsZero() && now.Sub(lastDelta) < minMetricEncodeInterval {
+	if !e.last.IsZero() && now.Sub(e.last) < minMetricEncodeInterval {
 		return ""
 	}
-	lastDelta = now
+	e.last = now
+	if n := len(unsorted); len(e.ents) < n {
+		e.ents = append(e.ents, make([]deltaEntry, n-len(e.ents))...)
+	}
 
 	var enc *deltaEncBuf // lazy
-	for i, ent := range lastLogVal {
-		val := atomic.LoadInt64(ent.v)
+	for i, m := range unsorted {
+		ent := &e.ents[i]
+		val := atomic.LoadInt64(m.v)
 		delta := val - ent.lastLogged
 		if delta == 0 {
 			continue
 		}
-		lastLogVal[i].lastLogged = val
-		m := unsorted[i]
+		ent.lastLogged = val
 		if enc == nil {
 			enc = deltaPool.Get().(*deltaEncBuf)
 			enc.buf.Reset()
 		}
-		if m.wireID == 0 {
-			numWireID++
-			m.wireID = numWireID
+		if ent.wireID == 0 {
+			e.numWireID++
+			ent.wireID = e.numWireID
 		}
-		if m.lastNamed.IsZero() || now.Sub(m.lastNamed) > metricLogNameFrequency {
+		if ent.lastNamed.IsZero() || now.Sub(ent.lastNamed) > metricLogNameFrequency {
 			enc.writeName(m.Name(), m.Type())
-			m.lastNamed = now
-			enc.writeValue(m.wireID, val)
+			if m.label != "" {
+				enc.writeLabel(m.label)
+			}
+			ent.lastNamed = now
+			enc.writeValue(ent.wireID, val)
 		} else {
-			enc.writeDelta(m.wireID, delta)
+			enc.writeDelta(ent.wireID, delta)
 		}
 	}
 	if enc == nil {
@@ -293,6 +352,15 @@ func (b *deltaEncBuf) writeName(name string, typ Type) {
 	b.buf.WriteString(name)
 }
 
+// writeLabel writes a "label" (L) record to the buffer, which notes
+// that the metric named by the immediately preceding name record has
+// the provided label.
+func (b *deltaEncBuf) writeLabel(label string) {
+	b.buf.WriteByte('L')
+	b.writeHexVarint(int64(len(label)))
+	b.buf.WriteString(label)
+}
+
 // writeDelta writes a "set" (S) record to the buffer, noting that the
 // metric with the given wireID now has value v.
 func (b *deltaEncBuf) writeValue(wireID int, v int64) {
@@ -326,5 +394,7 @@ func (b *deltaEncBuf) writeHexVarint(v int64) {
 type testHooks struct{}
 
 func (testHooks) ResetLastDelta() {
-	lastDelta = time.Time{}
+	mu.Lock()
+	defer mu.Unlock()
+	defaultEnc.last = time.Time{}
 }
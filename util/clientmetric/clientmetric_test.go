@@ -5,6 +5,9 @@
 package clientmetric
 
 import (
+	"bytes"
+	"fmt"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -32,17 +35,16 @@ func clearMetrics() {
 	mu.Lock()
 	defer mu.Unlock()
 	metrics = map[string]*Metric{}
-	numWireID = 0
-	lastDelta = time.Time{}
+	families = map[string]*LabeledMetric{}
+	defaultEnc = new(DeltaEncoder)
 	sorted = nil
-	lastLogVal = nil
 	unsorted = nil
 }
 
 func advanceTime() {
 	mu.Lock()
 	defer mu.Unlock()
-	lastDelta = time.Time{}
+	defaultEnc.last = time.Time{}
 }
 
 func TestEncodeLogTailMetricsDelta(t *testing.T) {
@@ -73,3 +75,126 @@ func TestEncodeLogTailMetricsDelta(t *testing.T) {
 		t.Errorf("with increments = %q; want %q", got, want)
 	}
 }
+
+func TestDeltaEncoderStreams(t *testing.T) {
+	clearMetrics()
+
+	c := NewCounter("foo")
+	c.Add(1)
+	if got, want := EncodeLogTailMetricsDelta(), "N06fooS0202"; got != want {
+		t.Errorf("default = %q; want %q", got, want)
+	}
+
+	// A second stream gets the complete value, not what's left
+	// after the default stream took its delta.
+	e := NewDeltaEncoder()
+	c.Add(1)
+	if got, want := e.Encode(), "N06fooS0204"; got != want {
+		t.Errorf("second stream = %q; want %q", got, want)
+	}
+	advanceTime()
+	if got, want := EncodeLogTailMetricsDelta(), "I0202"; got != want {
+		t.Errorf("default after second stream = %q; want %q", got, want)
+	}
+}
+
+func TestLabeledMetric(t *testing.T) {
+	clearMetrics()
+
+	lm := NewCounterLabeled("derp_recv", "region", 2)
+	lm.Add("nyc", 1)
+	lm.Add("nyc", 2)
+	lm.Add("sfo", 5)
+	lm.Add("fra", 7) // over the max; goes to _other
+	lm.Add("ams", 1) // also _other
+	lm.Add("bad region!", 0)
+
+	var got []string
+	for _, m := range Metrics() {
+		got = append(got, m.Label())
+	}
+	want := []string{"region=_other", "region=nyc", "region=sfo"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("labels = %q; want %q", got, want)
+	}
+	if v := lm.Get("nyc").Value(); v != 3 {
+		t.Errorf("nyc = %d; want 3", v)
+	}
+	if v := lm.Get(OtherLabelValue).Value(); v != 8 {
+		t.Errorf("_other = %d; want 8", v)
+	}
+	if v := sanitizeLabelValue("bad region!"); v != "bad_region_" {
+		t.Errorf("sanitized = %q; want bad_region_", v)
+	}
+	if m := lm.Get("bad region!"); m != lm.Get(OtherLabelValue) {
+		t.Errorf("bad region = %v; want the _other metric", m.Label())
+	}
+	if _, ok := lm.children.Load("bad region!"); !ok {
+		t.Error("unsanitized label value not cached")
+	}
+	for i := 0; i < 100; i++ {
+		lm.Get(fmt.Sprint(i))
+	}
+	if lm.cached != maxCachedValues(lm.max) {
+		t.Errorf("cached %d label values; want %d", lm.cached, maxCachedValues(lm.max))
+	}
+	if !HasPublished("derp_recv") {
+		t.Error("HasPublished = false for a labeled metric")
+	}
+
+	var buf bytes.Buffer
+	WritePrometheusExpositionFormat(&buf)
+	const wantProm = `# TYPE derp_recv counter
+derp_recv{region="_other"} 8
+derp_recv{region="nyc"} 3
+derp_recv{region="sfo"} 5
+`
+	if buf.String() != wantProm {
+		t.Errorf("prometheus format:\n%s\nwant:\n%s", buf.String(), wantProm)
+	}
+}
+
+func TestEncodeLabeledDelta(t *testing.T) {
+	clearMetrics()
+
+	c := NewCounter("foo")
+	lm := NewGaugeLabeled("paths", "kind", 4)
+	c.Add(1)
+	lm.Set("direct", 2)
+	lm.Set("derp", 3)
+
+	first := EncodeLogTailMetricsDelta()
+	const want = "N06fooS0202N16gauge_pathsL16kind=directS0404N16gauge_pathsL12kind=derpS0606"
+	if first != want {
+		t.Errorf("first = %q; want %q", first, want)
+	}
+
+	lm.Add("derp", 1)
+	advanceTime()
+	second := EncodeLogTailMetricsDelta()
+	if second != "I0602" {
+		t.Errorf("second = %q; want %q", second, "I0602")
+	}
+
+	var d DeltaDecoder
+	for _, s := range []string{first, second} {
+		if err := d.Decode(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantVals := map[string]int64{
+		"foo":                      1,
+		"gauge_paths{kind=direct}": 2,
+		"gauge_paths{kind=derp}":   4,
+	}
+	if !reflect.DeepEqual(d.Values(), wantVals) {
+		t.Errorf("decoded %v; want %v", d.Values(), wantVals)
+	}
+
+	for _, bad := range []string{"X", "S02", "I0202", "N10foo", "L02ab"} {
+		var d DeltaDecoder
+		if err := d.Decode(bad); err == nil {
+			t.Errorf("Decode(%q) succeeded; want error", bad)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clientmetric
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// DeltaDecoder decodes the successive outputs of
+// EncodeLogTailMetricsDelta back into metric values.
+//
+// The zero value is ready for use.
+type DeltaDecoder struct {
+	byWireID map[int64]string // wire ID => key in values
+	values   map[string]int64
+}
+
+// Decode applies the records in s, one output of
+// EncodeLogTailMetricsDelta, to d's values.
+func (d *DeltaDecoder) Decode(s string) error {
+	if d.byWireID == nil {
+		d.byWireID = map[int64]string{}
+		d.values = map[string]int64{}
+	}
+	var pendingName string // from an N record and any L record, for the next S record
+	for len(s) > 0 {
+		rec := s[0]
+		s = s[1:]
+		switch rec {
+		case 'N', 'L':
+			n, rest, err := readHexVarint(s)
+			if err != nil {
+				return err
+			}
+			if n < 0 || n > int64(len(rest)) {
+				return fmt.Errorf("bad %c record length %d", rec, n)
+			}
+			v := rest[:n]
+			s = rest[n:]
+			if rec == 'N' {
+				pendingName = v
+			} else if pendingName == "" {
+				return errors.New("L record without N record")
+			} else {
+				pendingName += "{" + v + "}"
+			}
+		case 'S', 'I':
+			wireID, rest, err := readHexVarint(s)
+			if err != nil {
+				return err
+			}
+			v, rest, err := readHexVarint(rest)
+			if err != nil {
+				return err
+			}
+			s = rest
+			if pendingName != "" {
+				d.byWireID[wireID] = pendingName
+				pendingName = ""
+			}
+			key, ok := d.byWireID[wireID]
+			if !ok {
+				return fmt.Errorf("unknown metric wire ID %d", wireID)
+			}
+			if rec == 'S' {
+				d.values[key] = v
+			} else {
+				d.values[key] += v
+			}
+		default:
+			return fmt.Errorf("unknown record type %q", rec)
+		}
+	}
+	return nil
+}
+
+// Values returns the current values, keyed by metric name, with
+// the "gauge_" prefix for gauges, followed by "{key=value}" for metrics
+// in a LabeledMetric. The returned map must not be modified.
+func (d *DeltaDecoder) Values() map[string]int64 {
+	return d.values
+}
+
+// readHexVarint reads a hex-encoded varint written by
+// deltaEncBuf.writeHexVarint from the start of s.
+func readHexVarint(s string) (v int64, rest string, err error) {
+	var buf [binary.MaxVarintLen64]byte
+	for i := 0; i < len(buf); i++ {
+		if len(s) < 2*(i+1) {
+			break
+		}
+		if _, err := hex.Decode(buf[i:i+1], []byte(s[2*i:2*i+2])); err != nil {
+			return 0, "", err
+		}
+		if buf[i] < 0x80 {
+			v, n := binary.Varint(buf[:i+1])
+			if n <= 0 {
+				break
+			}
+			return v, s[2*(i+1):], nil
+		}
+	}
+	return 0, "", errors.New("bad hex varint")
+}
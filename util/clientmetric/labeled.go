@@ -0,0 +1,174 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clientmetric
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	// OtherLabelValue is the label value shared by the values of a
+	// LabeledMetric beyond its maximum number.
+	OtherLabelValue = "_other"
+
+	// maxLabelValueLen is the longest label value kept. Longer values
+	// are truncated.
+	maxLabelValueLen = 64
+)
+
+// LabeledMetric is a family of metrics with the same name and type,
+// told apart by the value of one label, such as per-DERP-region
+// counters. To keep the number of metrics bounded, it has at most a
+// fixed number of label values; further values all share the metric
+// labeled OtherLabelValue.
+//
+// It's safe for concurrent use.
+type LabeledMetric struct {
+	name     string
+	labelKey string
+	typ      Type
+	max      int
+
+	// children caches the metric for each label value passed to Get,
+	// so each value is only sanitized and bounded once. It holds at
+	// most maxCachedValues(max) values; Get looks others up afresh.
+	children sync.Map // label value string as passed to Get => *Metric
+
+	mu      sync.Mutex         // guards the fields below and serializes creating metrics
+	byLabel map[string]*Metric // by sanitized label value
+	n       int                // number of metrics in byLabel, not counting OtherLabelValue
+	cached  int                // number of values in children
+}
+
+// maxCachedValues is the most label values a LabeledMetric with at most
+// max distinct values caches. Values needing sanitizing, or beyond max,
+// can be arbitrarily many, so the cache of them is bounded too.
+func maxCachedValues(max int) int { return 4 * max }
+
+// NewCounterLabeled returns a new family of counters named name,
+// labeled by labelKey with at most maxValues distinct values.
+func NewCounterLabeled(name, labelKey string, maxValues int) *LabeledMetric {
+	return newLabeled(name, labelKey, TypeCounter, maxValues)
+}
+
+// NewGaugeLabeled returns a new family of gauges named name, labeled
+// by labelKey with at most maxValues distinct values.
+func NewGaugeLabeled(name, labelKey string, maxValues int) *LabeledMetric {
+	return newLabeled(name, labelKey, TypeGauge, maxValues)
+}
+
+func newLabeled(name, labelKey string, typ Type, maxValues int) *LabeledMetric {
+	NewUnpublished(name, typ) // for its name validation
+	if i := strings.IndexFunc(labelKey, isIllegalMetricRune); labelKey == "" || i != -1 {
+		panic(fmt.Sprintf("illegal metric label key %q (index %v)", labelKey, i))
+	}
+	if maxValues <= 0 {
+		panic(fmt.Sprintf("metric %q: maxValues must be positive", name))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := families[name]; dup {
+		panic("duplicate metric " + name)
+	}
+	if _, dup := metrics[name]; dup {
+		panic("duplicate metric " + name)
+	}
+	lm := &LabeledMetric{
+		name:     name,
+		labelKey: labelKey,
+		typ:      typ,
+		max:      maxValues,
+		byLabel:  map[string]*Metric{},
+	}
+	families[name] = lm
+	return lm
+}
+
+func (lm *LabeledMetric) Name() string     { return lm.name }
+func (lm *LabeledMetric) LabelKey() string { return lm.labelKey }
+func (lm *LabeledMetric) Type() Type       { return lm.typ }
+
+// Get returns the metric in lm with the label value, creating it if
+// needed. Characters other than letters, digits and "_-.:" in value
+// are replaced with underscores. If lm already has its maximum number
+// of values, the metric for OtherLabelValue is returned instead.
+func (lm *LabeledMetric) Get(value string) *Metric {
+	if m, ok := lm.children.Load(value); ok {
+		return m.(*Metric)
+	}
+
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if m, ok := lm.children.Load(value); ok {
+		return m.(*Metric)
+	}
+	m := lm.getLocked(sanitizeLabelValue(value))
+	if lm.cached < maxCachedValues(lm.max) {
+		lm.children.Store(value, m)
+		lm.cached++
+	}
+	return m
+}
+
+// getLocked returns the metric in lm with the sanitized label value,
+// creating it if needed.
+//
+// lm.mu must be held.
+func (lm *LabeledMetric) getLocked(label string) *Metric {
+	if m, ok := lm.byLabel[label]; ok {
+		return m
+	}
+	if label != OtherLabelValue && lm.n >= lm.max {
+		label = OtherLabelValue
+		if m, ok := lm.byLabel[label]; ok {
+			return m
+		}
+	}
+	m := &Metric{
+		name:  lm.name,
+		typ:   lm.typ,
+		label: lm.labelKey + "=" + label,
+	}
+	m.Publish()
+	lm.byLabel[label] = m
+	if label != OtherLabelValue {
+		lm.n++
+	}
+	return m
+}
+
+// Add increments the value of the metric with the label value by n.
+func (lm *LabeledMetric) Add(value string, n int64) {
+	lm.Get(value).Add(n)
+}
+
+// Set sets the value of the metric with the label value to v.
+func (lm *LabeledMetric) Set(value string, v int64) {
+	lm.Get(value).Set(v)
+}
+
+func isIllegalLabelRune(r rune) bool {
+	return isIllegalMetricRune(r) && r != '-' && r != '.' && r != ':'
+}
+
+func sanitizeLabelValue(v string) string {
+	if len(v) > maxLabelValueLen {
+		v = v[:maxLabelValueLen]
+	}
+	if v == "" {
+		return "_"
+	}
+	if strings.IndexFunc(v, isIllegalLabelRune) == -1 {
+		return v
+	}
+	return strings.Map(func(r rune) rune {
+		if isIllegalLabelRune(r) {
+			return '_'
+		}
+		return r
+	}, v)
+}
@@ -12,8 +12,11 @@
 	"go/token"
 	"go/types"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
 	"time"
 
@@ -263,3 +266,123 @@ func IsViewType(typ types.Type) bool {
 	}
 	return t.Field(0).Name() == "ж"
 }
+
+// ReferencedTypes returns the names of the struct types in pkg, other than
+// those in typeNames, that the generated code for typeNames depends on:
+// those containing pointers that are reachable from the fields of
+// typeNames, directly or through each other, and that don't already have a
+// hand-written Clone method. Fields tagged `codegen:noclone` are not
+// followed. The generated file in pkg that holds the Clone methods, if any,
+// is given by cloneFile so that methods in it are not mistaken for
+// hand-written ones.
+//
+// The returned names are sorted.
+func ReferencedTypes(pkg *packages.Package, namedTypes map[string]*types.Named, typeNames []string, cloneFile string) []string {
+	seen := map[string]bool{}
+	for _, n := range typeNames {
+		seen[n] = true
+	}
+	var ret []string
+	var visit func(t types.Type)
+	visitFields := func(named *types.Named) {
+		st, ok := named.Underlying().(*types.Struct)
+		if !ok {
+			return
+		}
+		for i := 0; i < st.NumFields(); i++ {
+			if HasNoClone(st.Tag(i)) {
+				continue
+			}
+			visit(st.Field(i).Type())
+		}
+	}
+	visit = func(t types.Type) {
+		switch t := t.(type) {
+		case *types.Pointer:
+			visit(t.Elem())
+		case *types.Slice:
+			visit(t.Elem())
+		case *types.Array:
+			visit(t.Elem())
+		case *types.Map:
+			visit(t.Key())
+			visit(t.Elem())
+		case *types.Named:
+			obj := t.Obj()
+			if obj.Pkg() != pkg.Types || seen[obj.Name()] || namedTypes[obj.Name()] != t {
+				return
+			}
+			seen[obj.Name()] = true
+			if _, ok := t.Underlying().(*types.Struct); !ok || !ContainsPointers(t) || IsViewType(t) {
+				return
+			}
+			if hasHandWrittenClone(pkg, t, cloneFile) {
+				return
+			}
+			ret = append(ret, obj.Name())
+			visitFields(t)
+		}
+	}
+	for _, n := range typeNames {
+		if named, ok := namedTypes[n]; ok {
+			visitFields(named)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// hasHandWrittenClone reports whether t has a Clone method declared
+// outside of the generated file cloneFile.
+func hasHandWrittenClone(pkg *packages.Package, t *types.Named, cloneFile string) bool {
+	for i := 0; i < t.NumMethods(); i++ {
+		m := t.Method(i)
+		if m.Name() != "Clone" {
+			continue
+		}
+		return filepath.Base(pkg.Fset.Position(m.Pos()).Filename) != cloneFile
+	}
+	return false
+}
+
+// GenerateCommand is a go:generate directive that runs a code generator.
+type GenerateCommand struct {
+	Dir  string   // directory of the file containing the directive
+	Args []string // arguments to the generator
+}
+
+// FindGenerateCommands returns the go:generate directives in the Go files
+// under root that run the generator with the given package path using
+// "go run".
+func FindGenerateCommands(root, tool string) ([]GenerateCommand, error) {
+	prefix := "//go:generate go run " + tool + " "
+	var ret []GenerateCommand
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if name := d.Name(); path != root && (name == "testdata" || strings.HasPrefix(name, ".")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".go") {
+			return nil
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			if strings.HasPrefix(line, prefix) {
+				ret = append(ret, GenerateCommand{
+					Dir:  filepath.Dir(path),
+					Args: strings.Fields(strings.TrimPrefix(line, prefix)),
+				})
+			}
+		}
+		return nil
+	})
+	return ret, err
+}
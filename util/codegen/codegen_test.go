@@ -0,0 +1,35 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codegen
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReferencedTypes(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode; loads packages")
+	}
+	pkg, namedTypes, err := LoadTypes("", "tailscale.com/tailcfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		types []string
+		want  []string
+	}{
+		{[]string{"DERPMap"}, []string{"DERPRegion"}}, // DERPNode has no pointers
+		{[]string{"DERPMap", "DERPRegion"}, nil},
+		{[]string{"SSHRule"}, []string{"SSHPrincipal"}},
+		{[]string{"Node"}, nil}, // Hostinfo is held as a HostinfoView
+	}
+	for _, tt := range tests {
+		got := ReferencedTypes(pkg, namedTypes, tt.types, "tailcfg_clone.go")
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ReferencedTypes(%q) = %q; want %q", tt.types, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package maintwindow parses and evaluates recurring maintenance
+// windows, the times of the week when disruptive operations may run.
+package maintwindow
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Window is a recurring daily period, on some or all days of the week.
+type Window struct {
+	days       [7]bool // indexed by time.Weekday; days on which the window starts
+	start, end int     // minutes after midnight; end <= start wraps past midnight
+	loc        *time.Location
+	zone       string // as parsed; empty for local time
+}
+
+var dayNames = [7]string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+
+// Parse parses a window of the form "[DAYS ]HH:MM-HH:MM[ ZONE]", such
+// as "02:00-04:00" or "Sat,Sun 23:00-01:00 UTC". DAYS is a
+// comma-separated list of three-letter day names, defaulting to every
+// day; they're the days on which the window starts. A window whose end
+// is not after its start runs past midnight. ZONE is an IANA time zone
+// name, defaulting to the local time zone.
+//
+// An empty s returns a nil Window.
+func Parse(s string) (*Window, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	w := &Window{loc: time.Local}
+	i := 0
+	if !strings.Contains(fields[0], ":") {
+		for _, d := range strings.Split(fields[0], ",") {
+			wd, ok := parseDay(d)
+			if !ok {
+				return nil, fmt.Errorf("invalid maintenance window day %q", d)
+			}
+			w.days[wd] = true
+		}
+		i++
+	} else {
+		for d := range w.days {
+			w.days[d] = true
+		}
+	}
+	if i >= len(fields) {
+		return nil, fmt.Errorf("maintenance window %q has no times", s)
+	}
+	start, end, ok := strings.Cut(fields[i], "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid maintenance window times %q; want HH:MM-HH:MM", fields[i])
+	}
+	var err error
+	if w.start, err = parseClock(start); err != nil {
+		return nil, err
+	}
+	if w.end, err = parseClock(end); err != nil {
+		return nil, err
+	}
+	i++
+	if i < len(fields) {
+		if w.loc, err = time.LoadLocation(fields[i]); err != nil {
+			return nil, fmt.Errorf("invalid maintenance window time zone: %w", err)
+		}
+		w.zone = fields[i]
+		i++
+	}
+	if i < len(fields) {
+		return nil, fmt.Errorf("unexpected %q in maintenance window", fields[i])
+	}
+	return w, nil
+}
+
+func parseDay(s string) (time.Weekday, bool) {
+	for i, n := range dayNames {
+		if strings.EqualFold(s, n) {
+			return time.Weekday(i), true
+		}
+	}
+	return 0, false
+}
+
+// parseClock parses "HH:MM" into minutes after midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid maintenance window time %q; want HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// String returns w in the form accepted by Parse.
+func (w *Window) String() string {
+	var sb strings.Builder
+	var days []string
+	for d, ok := range w.days {
+		if ok {
+			days = append(days, dayNames[d])
+		}
+	}
+	if len(days) < 7 {
+		sb.WriteString(strings.Join(days, ","))
+		sb.WriteByte(' ')
+	}
+	fmt.Fprintf(&sb, "%02d:%02d-%02d:%02d", w.start/60, w.start%60, w.end/60, w.end%60)
+	if w.zone != "" {
+		sb.WriteByte(' ')
+		sb.WriteString(w.zone)
+	}
+	return sb.String()
+}
+
+// length returns how long the window lasts.
+func (w *Window) length() time.Duration {
+	m := w.end - w.start
+	if m <= 0 {
+		m += 24 * 60
+	}
+	return time.Duration(m) * time.Minute
+}
+
+// startOn returns when the window starts on the day of t, in w's
+// time zone.
+func (w *Window) startOn(t time.Time) time.Time {
+	y, mo, d := t.Date()
+	return time.Date(y, mo, d, w.start/60, w.start%60, 0, 0, w.loc)
+}
+
+// Contains reports whether t is within the window.
+func (w *Window) Contains(t time.Time) bool {
+	lt := t.In(w.loc)
+	// The window can have started today, or yesterday if it runs
+	// past midnight.
+	for _, day := range []time.Time{lt, lt.AddDate(0, 0, -1)} {
+		if !w.days[day.Weekday()] {
+			continue
+		}
+		start := w.startOn(day)
+		if !t.Before(start) && t.Before(start.Add(w.length())) {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns t if it's within the window, or else when the window
+// next starts after t.
+func (w *Window) Next(t time.Time) time.Time {
+	if w.Contains(t) {
+		return t
+	}
+	lt := t.In(w.loc)
+	for i := 0; i <= 7; i++ {
+		day := lt.AddDate(0, 0, i)
+		if !w.days[day.Weekday()] {
+			continue
+		}
+		if start := w.startOn(day); start.After(t) {
+			return start
+		}
+	}
+	panic("unreachable") // at least one day is set
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package maintwindow
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // String of result, or "" for error
+	}{
+		{"02:00-04:00", "02:00-04:00"},
+		{"sat,Sun 23:00-01:30 UTC", "Sun,Sat 23:00-01:30 UTC"},
+		{"Mon 2:00-3:00", "Mon 02:00-03:00"},
+		{"Mon 25:00-03:00", ""},
+		{"Mon", ""},
+		{"Xyz 02:00-03:00", ""},
+		{"02:00", ""},
+		{"02:00-03:00 Not/AZone", ""},
+		{"02:00-03:00 UTC extra", ""},
+	}
+	for _, tt := range tests {
+		w, err := Parse(tt.in)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("Parse(%q) = %v; want error", tt.in, w)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.in, err)
+			continue
+		}
+		if got := w.String(); got != tt.want {
+			t.Errorf("Parse(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+	if w, err := Parse(" "); w != nil || err != nil {
+		t.Errorf("Parse of empty = %v, %v; want nil, nil", w, err)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	w, err := Parse("Sat 23:00-01:00 UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(s string) time.Time {
+		t.Helper()
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	// 2022-10-15 was a Saturday.
+	tests := []struct {
+		now      string
+		contains bool
+		next     string
+	}{
+		{"2022-10-15T22:59:00Z", false, "2022-10-15T23:00:00Z"},
+		{"2022-10-15T23:00:00Z", true, "2022-10-15T23:00:00Z"},
+		{"2022-10-16T00:59:00Z", true, "2022-10-16T00:59:00Z"},
+		{"2022-10-16T01:00:00Z", false, "2022-10-22T23:00:00Z"},
+		{"2022-10-17T00:30:00Z", false, "2022-10-22T23:00:00Z"},
+		{"2022-10-15T23:30:00-04:00", false, "2022-10-22T23:00:00Z"},
+	}
+	for _, tt := range tests {
+		now := at(tt.now)
+		if got := w.Contains(now); got != tt.contains {
+			t.Errorf("Contains(%v) = %v; want %v", tt.now, got, tt.contains)
+		}
+		if got := w.Next(now); !got.Equal(at(tt.next)) {
+			t.Errorf("Next(%v) = %v; want %v", tt.now, got, tt.next)
+		}
+	}
+}
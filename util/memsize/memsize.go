@@ -0,0 +1,160 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package memsize estimates the memory used by Go values, for
+// diagnosing what large data structures spend their memory on.
+package memsize
+
+import (
+	"reflect"
+	"sync"
+)
+
+// Counter estimates the memory reachable from values, counting memory
+// shared between values only once across all calls to Add.
+//
+// The estimates follow pointers, slices, maps, strings and interfaces.
+// They include slices' unused capacity but not allocator rounding,
+// and approximate maps' overhead. Strings' bytes are counted for each
+// string, as their sharing isn't visible to reflection. Funcs and
+// channels count only their own word.
+//
+// A Counter is not safe for concurrent use.
+type Counter struct {
+	seen map[seenKey]bool
+}
+
+type seenKey struct {
+	p uintptr
+	t reflect.Type // so a struct and its first field are counted apart
+}
+
+// NewCounter returns a new Counter.
+func NewCounter() *Counter {
+	return &Counter{seen: map[seenKey]bool{}}
+}
+
+// Add returns the memory newly reachable from v that wasn't already
+// counted by c. If v is a pointer, that's the memory it points to;
+// otherwise it's the memory to box v and what v references.
+func (c *Counter) Add(v any) int64 {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return 0
+	}
+	if rv.Kind() == reflect.Pointer {
+		return c.indirect(rv)
+	}
+	return int64(rv.Type().Size()) + c.indirect(rv)
+}
+
+// indirect returns the memory reachable from v, not counting v's own
+// inline size.
+func (c *Counter) indirect(v reflect.Value) int64 {
+	if !hasPointers(v.Type()) {
+		return 0
+	}
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() || !c.visit(v.Pointer(), v.Type()) {
+			return 0
+		}
+		e := v.Elem()
+		return int64(e.Type().Size()) + c.indirect(e)
+	case reflect.Slice:
+		if v.IsNil() || !c.visit(v.Pointer(), v.Type()) {
+			return 0
+		}
+		n := int64(v.Cap()) * int64(v.Type().Elem().Size())
+		if hasPointers(v.Type().Elem()) {
+			for i := 0; i < v.Len(); i++ {
+				n += c.indirect(v.Index(i))
+			}
+		}
+		return n
+	case reflect.String:
+		return int64(v.Len())
+	case reflect.Map:
+		if v.IsNil() || !c.visit(v.Pointer(), v.Type()) {
+			return 0
+		}
+		kt, et := v.Type().Key(), v.Type().Elem()
+		// Buckets hold 8 entries plus 8 bytes of hash bits and an
+		// overflow pointer, and are on average 80% full when
+		// the map grows.
+		const bucketOverhead = 8 + 8
+		perEntry := int64(kt.Size()+et.Size()) + bucketOverhead/8
+		n := perEntry * int64(v.Len()) * 5 / 4
+		if hasPointers(kt) || hasPointers(et) {
+			iter := v.MapRange()
+			for iter.Next() {
+				n += c.indirect(iter.Key()) + c.indirect(iter.Value())
+			}
+		}
+		return n
+	case reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		e := v.Elem()
+		if e.Kind() == reflect.Pointer {
+			return c.indirect(e)
+		}
+		// Non-pointer values are boxed. Their boxes can't be told
+		// apart, so each is counted.
+		return int64(e.Type().Size()) + c.indirect(e)
+	case reflect.Struct:
+		var n int64
+		for i := 0; i < v.NumField(); i++ {
+			n += c.indirect(v.Field(i))
+		}
+		return n
+	case reflect.Array:
+		var n int64
+		for i := 0; i < v.Len(); i++ {
+			n += c.indirect(v.Index(i))
+		}
+		return n
+	}
+	return 0
+}
+
+// visit reports whether the object of type t at p is new, marking it
+// seen.
+func (c *Counter) visit(p uintptr, t reflect.Type) bool {
+	k := seenKey{p, t}
+	if c.seen[k] {
+		return false
+	}
+	c.seen[k] = true
+	return true
+}
+
+var hasPointersCache sync.Map // reflect.Type => bool
+
+// hasPointers reports whether values of type t can reference other
+// memory.
+func hasPointers(t reflect.Type) bool {
+	if v, ok := hasPointersCache.Load(t); ok {
+		return v.(bool)
+	}
+	// Recursive types recurse through kinds that are handled
+	// without recursing here, so this terminates.
+	var has bool
+	switch t.Kind() {
+	case reflect.Pointer, reflect.Slice, reflect.String, reflect.Map, reflect.Interface:
+		has = true
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if hasPointers(t.Field(i).Type) {
+				has = true
+				break
+			}
+		}
+	case reflect.Array:
+		has = t.Len() > 0 && hasPointers(t.Elem())
+	}
+	hasPointersCache.Store(t, has)
+	return has
+}
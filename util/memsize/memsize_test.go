@@ -0,0 +1,70 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package memsize
+
+import (
+	"testing"
+	"unsafe"
+)
+
+type node struct {
+	Name  string
+	Next  *node
+	Tags  []string
+	Attrs map[string]int64
+}
+
+func TestCounter(t *testing.T) {
+	const ptrSize = int64(unsafe.Sizeof(uintptr(0)))
+	nodeSize := int64(unsafe.Sizeof(node{}))
+
+	tests := []struct {
+		name string
+		v    any
+		want int64
+	}{
+		{"nil", nil, 0},
+		{"int", 1, 8},
+		{"string", "hello", 2*ptrSize + 5},
+		{"slice", make([]int32, 2, 4), 3*ptrSize + 16},
+		{"ptr_to_empty_node", &node{}, nodeSize},
+		{"ptr_to_node", &node{Name: "abc", Tags: []string{"x"}}, nodeSize + 3 + 2*ptrSize + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NewCounter().Add(tt.v); got != tt.want {
+				t.Errorf("Add = %d; want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCounterShared(t *testing.T) {
+	shared := &node{Name: "shared"}
+	a := &node{Next: shared}
+	b := &node{Next: shared}
+	a.Next.Next = a // cycle
+
+	c := NewCounter()
+	na := c.Add(a)
+	nb := c.Add(b)
+	if na <= nb {
+		t.Errorf("first Add = %d, second = %d; want shared node counted only in first", na, nb)
+	}
+	if want := int64(unsafe.Sizeof(node{})); nb != want {
+		t.Errorf("second Add = %d; want %d", nb, want)
+	}
+	if n := c.Add(a); n != 0 {
+		t.Errorf("re-Add = %d; want 0", n)
+	}
+}
+
+func TestCounterMap(t *testing.T) {
+	m := map[string]int64{"a": 1, "b": 2}
+	n := NewCounter().Add(&node{Attrs: m})
+	if min := int64(unsafe.Sizeof(node{})) + 2*(16+8) + 2; n < min {
+		t.Errorf("Add = %d; want at least %d", n, min)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"net/netip"
+	"sort"
+
+	"tailscale.com/types/key"
+	"tailscale.com/wgengine/wgcfg"
+)
+
+// dscpPeerTable maps the destination IPs of outbound packets to the
+// peers they're sent to, so that the DSCP marking of an inner packet
+// can be applied to the outer packets to its peer.
+type dscpPeerTable struct {
+	exact  map[netip.Addr]key.NodePublic // single-IP AllowedIPs
+	routes []dscpRoute                   // other AllowedIPs, longest first
+}
+
+type dscpRoute struct {
+	pfx  netip.Prefix
+	peer key.NodePublic
+}
+
+func newDSCPPeerTable(peers []wgcfg.Peer) *dscpPeerTable {
+	t := &dscpPeerTable{exact: make(map[netip.Addr]key.NodePublic, len(peers))}
+	for _, p := range peers {
+		for _, pfx := range p.AllowedIPs {
+			if pfx.IsSingleIP() {
+				t.exact[pfx.Addr()] = p.PublicKey
+			} else {
+				t.routes = append(t.routes, dscpRoute{pfx, p.PublicKey})
+			}
+		}
+	}
+	sort.SliceStable(t.routes, func(i, j int) bool {
+		return t.routes[i].pfx.Bits() > t.routes[j].pfx.Bits()
+	})
+	return t
+}
+
+// peerForIP returns the peer that packets to ip are sent to.
+func (t *dscpPeerTable) peerForIP(ip netip.Addr) (key.NodePublic, bool) {
+	if t == nil {
+		return key.NodePublic{}, false
+	}
+	if k, ok := t.exact[ip]; ok {
+		return k, true
+	}
+	for _, r := range t.routes {
+		if r.pfx.Contains(ip) {
+			return r.peer, true
+		}
+	}
+	return key.NodePublic{}, false
+}
+
+// noteOutboundDSCP is the tstun.Wrapper.OnOutboundDSCP hook. It marks
+// the outer packets to the peer that dst is routed to with outer.
+func (e *userspaceEngine) noteOutboundDSCP(dst netip.Addr, outer uint8) {
+	if k, ok := e.dscpPeers.Load().peerForIP(dst); ok {
+		e.magicConn.SetPeerDSCP(k, outer)
+	}
+}
@@ -16,9 +16,11 @@
 	"tailscale.com/net/flowtrack"
 	"tailscale.com/net/netaddr"
 	"tailscale.com/net/packet"
+	"tailscale.com/tailcfg"
 	"tailscale.com/tstime/rate"
 	"tailscale.com/types/ipproto"
 	"tailscale.com/types/logger"
+	"tailscale.com/util/mak"
 )
 
 // Filter is a stateful packet filter.
@@ -40,8 +42,8 @@ type Filter struct {
 	// tunnels. Matches are checked in order, and processing stops
 	// at the first matching rule. The default policy if no rules
 	// match is to drop the packet.
-	matches4 matches
-	matches6 matches
+	matches4 matchIndex
+	matches6 matchIndex
 
 	// cap4 and cap6 are the subsets of the matches that are about
 	// capability grants, partitioned by source IP address family.
@@ -62,7 +64,7 @@ type filterState struct {
 	lru *flowtrack.Cache // from flowtrack.Tuple -> nil
 }
 
-// lruMax is the size of the LRU cache in filterState.
+// lruMax is the default size of the LRU cache in filterState.
 const lruMax = 512
 
 // Response is a verdict from the packet filter.
@@ -181,8 +183,8 @@ func New(matches []Match, localNets *netipx.IPSet, logIPs *netipx.IPSet, shareSt
 	}
 	f := &Filter{
 		logf:     logf,
-		matches4: matchesFamily(matches, netip.Addr.Is4),
-		matches6: matchesFamily(matches, netip.Addr.Is6),
+		matches4: newMatchIndex(matchesFamily(matches, netip.Addr.Is4)),
+		matches6: newMatchIndex(matchesFamily(matches, netip.Addr.Is6)),
 		cap4:     capMatchesFunc(matches, netip.Addr.Is4),
 		cap6:     capMatchesFunc(matches, netip.Addr.Is6),
 		local:    localNets,
@@ -192,6 +194,18 @@ func New(matches []Match, localNets *netipx.IPSet, logIPs *netipx.IPSet, shareSt
 	return f
 }
 
+// SetMaxFlows sets how many flows the connection tracking state of f,
+// which is shared with the filters made from it, remembers. The least
+// recently used flows beyond that are forgotten. The default is 512.
+func (f *Filter) SetMaxFlows(n int) {
+	f.state.mu.Lock()
+	defer f.state.mu.Unlock()
+	f.state.lru.MaxEntries = n
+	for f.state.lru.Len() > n {
+		f.state.lru.RemoveOldest()
+	}
+}
+
 // matchesFamily returns the subset of ms for which keep(srcNet.IP)
 // and keep(dstNet.IP) are both true.
 func matchesFamily(ms matches, keep func(netip.Addr) bool) matches {
@@ -347,6 +361,31 @@ func (f *Filter) AppendCaps(base []string, srcIP, dstIP netip.Addr) []string {
 	return ret
 }
 
+// CapsWithValues returns the capabilities, and any values granted with
+// them, that srcIP has talking to dstIP. Capabilities granted without
+// values are present in the map with no values.
+func (f *Filter) CapsWithValues(srcIP, dstIP netip.Addr) tailcfg.PeerCapMap {
+	var mm matches
+	switch {
+	case srcIP.Is4():
+		mm = f.cap4
+	case srcIP.Is6():
+		mm = f.cap6
+	}
+	var ret tailcfg.PeerCapMap
+	for _, m := range mm {
+		if !ipInList(srcIP, m.Srcs) {
+			continue
+		}
+		for _, cm := range m.Caps {
+			if cm.Cap != "" && cm.Dst.Contains(dstIP) {
+				mak.Set(&ret, cm.Cap, append(ret[cm.Cap], cm.Values...))
+			}
+		}
+	}
+	return ret
+}
+
 // ShieldsUp reports whether this is a "shields up" (block everything
 // incoming) filter.
 func (f *Filter) ShieldsUp() bool { return f.shieldsUp }
@@ -18,7 +18,7 @@
 	"tailscale.com/net/packet"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/tailcfg"
-	"tailscale.com/tstest"
+	"tailscale.com/tstest/memtest"
 	"tailscale.com/tstime/rate"
 	"tailscale.com/types/ipproto"
 	"tailscale.com/types/logger"
@@ -196,6 +196,25 @@ func TestUDPState(t *testing.T) {
 	}
 }
 
+func TestSetMaxFlows(t *testing.T) {
+	acl := newFilter(t.Logf)
+	flags := LogDrops | LogAccepts
+
+	a4 := parsed(ipproto.UDP, "119.119.119.119", "102.102.102.102", 4242, 4343)
+	b4 := parsed(ipproto.UDP, "102.102.102.102", "119.119.119.119", 4343, 4242)
+	c4 := parsed(ipproto.UDP, "102.102.102.102", "119.119.119.120", 4343, 4242)
+
+	acl.RunOut(&b4, flags)
+	acl.SetMaxFlows(1)
+	acl.RunOut(&c4, flags)
+	if got := acl.RunIn(&a4, flags); got != Drop {
+		t.Fatalf("response to evicted flow not dropped, got=%v: %v", got, a4)
+	}
+	if n := acl.state.lru.Len(); n != 1 {
+		t.Errorf("tracking %d flows; want 1", n)
+	}
+}
+
 func TestNoAllocs(t *testing.T) {
 	acl := newFilter(t.Logf)
 
@@ -204,38 +223,28 @@ func TestNoAllocs(t *testing.T) {
 	tcp6Packet := raw6(ipproto.TCP, "2001::1", "2001::2", 999, 22, 0)
 	udp6Packet := raw6(ipproto.UDP, "2001::1", "2001::2", 999, 22, 0)
 
-	tests := []struct {
-		name   string
-		dir    direction
-		packet []byte
-	}{
-		{"tcp4_in", in, tcp4Packet},
-		{"tcp6_in", in, tcp6Packet},
-		{"tcp4_out", out, tcp4Packet},
-		{"tcp6_out", out, tcp6Packet},
-		{"udp4_in", in, udp4Packet},
-		{"udp6_in", in, udp6Packet},
-		{"udp4_out", out, udp4Packet},
-		{"udp6_out", out, udp6Packet},
-	}
-
-	for _, test := range tests {
-		t.Run(test.name, func(t *testing.T) {
-			err := tstest.MinAllocsPerRun(t, 0, func() {
-				q := &packet.Parsed{}
-				q.Decode(test.packet)
-				switch test.dir {
-				case in:
-					acl.RunIn(q, 0)
-				case out:
-					acl.RunOut(q, 0)
-				}
-			})
-			if err != nil {
-				t.Error(err)
+	run := func(dir direction, pkt []byte) func() {
+		return func() {
+			q := &packet.Parsed{}
+			q.Decode(pkt)
+			switch dir {
+			case in:
+				acl.RunIn(q, 0)
+			case out:
+				acl.RunOut(q, 0)
 			}
-		})
+		}
 	}
+	memtest.Check(t, []memtest.Budget{
+		{Name: "tcp4_in", Allocs: 0, Run: run(in, tcp4Packet)},
+		{Name: "tcp6_in", Allocs: 0, Run: run(in, tcp6Packet)},
+		{Name: "tcp4_out", Allocs: 0, Run: run(out, tcp4Packet)},
+		{Name: "tcp6_out", Allocs: 0, Run: run(out, tcp6Packet)},
+		{Name: "udp4_in", Allocs: 0, Run: run(in, udp4Packet)},
+		{Name: "udp6_in", Allocs: 0, Run: run(in, udp6Packet)},
+		{Name: "udp4_out", Allocs: 0, Run: run(out, udp4Packet)},
+		{Name: "udp6_out", Allocs: 0, Run: run(out, udp6Packet)},
+	})
 }
 
 func TestParseIPSet(t *testing.T) {
@@ -958,3 +967,81 @@ func TestCaps(t *testing.T) {
 		})
 	}
 }
+
+func TestCapsWithValues(t *testing.T) {
+	mm, err := MatchesFromFilterRules([]tailcfg.FilterRule{
+		{
+			SrcIPs: []string{"100.199.0.0/16"},
+			CapGrant: []tailcfg.CapGrant{{
+				Dsts: []netip.Prefix{
+					netip.MustParsePrefix("100.200.0.0/16"),
+				},
+				Caps: []string{"plain"},
+				CapMap: tailcfg.PeerCapMap{
+					"example.com/cap/paths": {`{"path":"/a"}`},
+				},
+			}},
+		},
+		{
+			SrcIPs: []string{"*"},
+			CapGrant: []tailcfg.CapGrant{{
+				Dsts: []netip.Prefix{
+					netip.MustParsePrefix("0.0.0.0/0"),
+				},
+				CapMap: tailcfg.PeerCapMap{
+					"example.com/cap/paths": {`{"path":"/b"}`},
+				},
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filt := New(mm, nil, nil, nil, t.Logf)
+
+	got := filt.CapsWithValues(netip.MustParseAddr("100.199.1.2"), netip.MustParseAddr("100.200.3.4"))
+	want := tailcfg.PeerCapMap{
+		"plain":                 nil,
+		"example.com/cap/paths": {`{"path":"/a"}`, `{"path":"/b"}`},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	got = filt.CapsWithValues(netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("100.200.3.4"))
+	want = tailcfg.PeerCapMap{
+		"example.com/cap/paths": {`{"path":"/b"}`},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestCapMapMatchOrder(t *testing.T) {
+	rules := []tailcfg.FilterRule{{
+		SrcIPs: []string{"*"},
+		CapGrant: []tailcfg.CapGrant{{
+			Dsts: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")},
+			CapMap: tailcfg.PeerCapMap{
+				"example.com/cap/c": nil,
+				"example.com/cap/a": nil,
+				"example.com/cap/d": nil,
+				"example.com/cap/b": nil,
+			},
+		}},
+	}}
+	want := []string{"example.com/cap/a", "example.com/cap/b", "example.com/cap/c", "example.com/cap/d"}
+	for i := 0; i < 10; i++ {
+		mm, err := MatchesFromFilterRules(rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, c := range mm[0].Caps {
+			got = append(got, c.Cap)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("caps = %q; want %q", got, want)
+		}
+	}
+}
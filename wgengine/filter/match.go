@@ -10,10 +10,11 @@
 	"strings"
 
 	"tailscale.com/net/packet"
+	"tailscale.com/tailcfg"
 	"tailscale.com/types/ipproto"
 )
 
-//go:generate go run tailscale.com/cmd/cloner --type=Match
+//go:generate go run tailscale.com/cmd/cloner --type=Match,CapMatch
 
 // PortRange is a range of TCP and UDP ports.
 type PortRange struct {
@@ -56,6 +57,10 @@ type CapMatch struct {
 	// Cap is the capability that's granted if the destination IP addresses
 	// matches Dst.
 	Cap string
+
+	// Values are the optional values granted along with Cap, from
+	// tailcfg.CapGrant.CapMap.
+	Values []tailcfg.RawMessage
 }
 
 // Match matches packets from any IP address in Srcs to any ip:port in
@@ -95,20 +100,8 @@ func (m Match) String() string {
 type matches []Match
 
 func (ms matches) match(q *packet.Parsed) bool {
-	for _, m := range ms {
-		if !protoInList(q.IPProto, m.IPProto) {
-			continue
-		}
-		if !ipInList(q.Src.Addr(), m.Srcs) {
-			continue
-		}
-		for _, dst := range m.Dsts {
-			if !dst.Net.Contains(q.Dst.Addr()) {
-				continue
-			}
-			if !dst.Ports.contains(q.Dst.Port()) {
-				continue
-			}
+	for i := range ms {
+		if ipInList(q.Src.Addr(), ms[i].Srcs) && matchProtoAndDst(&ms[i], q) {
 			return true
 		}
 	}
@@ -116,14 +109,9 @@ func (ms matches) match(q *packet.Parsed) bool {
 }
 
 func (ms matches) matchIPsOnly(q *packet.Parsed) bool {
-	for _, m := range ms {
-		if !ipInList(q.Src.Addr(), m.Srcs) {
-			continue
-		}
-		for _, dst := range m.Dsts {
-			if dst.Net.Contains(q.Dst.Addr()) {
-				return true
-			}
+	for i := range ms {
+		if ipInList(q.Src.Addr(), ms[i].Srcs) && matchDstIPOnly(&ms[i], q) {
+			return true
 		}
 	}
 	return false
@@ -133,20 +121,49 @@ func (ms matches) matchIPsOnly(q *packet.Parsed) bool {
 // Match if for the right IP Protocol and IP address, but ports are
 // ignored, as long as the match is for the entire uint16 port range.
 func (ms matches) matchProtoAndIPsOnlyIfAllPorts(q *packet.Parsed) bool {
-	for _, m := range ms {
-		if !protoInList(q.IPProto, m.IPProto) {
-			continue
+	for i := range ms {
+		if ipInList(q.Src.Addr(), ms[i].Srcs) && matchProtoAndDstIPIfAllPorts(&ms[i], q) {
+			return true
 		}
-		if !ipInList(q.Src.Addr(), m.Srcs) {
-			continue
+	}
+	return false
+}
+
+// matchProtoAndDst reports whether q's protocol and destination are
+// matched by m, ignoring m.Srcs.
+func matchProtoAndDst(m *Match, q *packet.Parsed) bool {
+	if !protoInList(q.IPProto, m.IPProto) {
+		return false
+	}
+	for _, dst := range m.Dsts {
+		if dst.Net.Contains(q.Dst.Addr()) && dst.Ports.contains(q.Dst.Port()) {
+			return true
 		}
-		for _, dst := range m.Dsts {
-			if dst.Ports != allPorts {
-				continue
-			}
-			if dst.Net.Contains(q.Dst.Addr()) {
-				return true
-			}
+	}
+	return false
+}
+
+// matchDstIPOnly reports whether q's destination IP is matched by m,
+// ignoring m.Srcs, the protocol and ports.
+func matchDstIPOnly(m *Match, q *packet.Parsed) bool {
+	for _, dst := range m.Dsts {
+		if dst.Net.Contains(q.Dst.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchProtoAndDstIPIfAllPorts reports whether q's protocol and
+// destination IP are matched by m, ignoring m.Srcs, by a destination
+// for all ports.
+func matchProtoAndDstIPIfAllPorts(m *Match, q *packet.Parsed) bool {
+	if !protoInList(q.IPProto, m.IPProto) {
+		return false
+	}
+	for _, dst := range m.Dsts {
+		if dst.Ports == allPorts && dst.Net.Contains(q.Dst.Addr()) {
+			return true
 		}
 	}
 	return false
@@ -0,0 +1,127 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"net/netip"
+	"sort"
+
+	"tailscale.com/net/packet"
+)
+
+// minIndexedMatches is the smallest number of matches for which a
+// matchIndex is built. Scanning fewer linearly is as fast.
+const minIndexedMatches = 16
+
+// matchIndex is a set of matches compiled for lookup by source IP, so
+// that evaluating a packet against thousands of ACL-derived rules only
+// considers the few whose Srcs contain the packet's source.
+//
+// Source prefixes are grouped by length. A lookup masks the source IP
+// to each length present and looks up the matches for the resulting
+// prefix, so it costs one map lookup per distinct prefix length
+// (typically a handful: /32 or /128 for nodes, a few for subnets, and
+// /0 for "*"), independent of the number of matches.
+//
+// The zero value matches nothing.
+type matchIndex struct {
+	ms matches
+
+	// If bySrc is nil, ms is small and is scanned linearly.
+	bits  []int                    // distinct prefix lengths in bySrc
+	bySrc map[netip.Prefix][]int32 // masked source prefix -> indexes into ms
+}
+
+// newMatchIndex returns a matchIndex of ms, which must all be of one
+// address family.
+func newMatchIndex(ms matches) matchIndex {
+	x := matchIndex{ms: ms}
+	if len(ms) < minIndexedMatches {
+		return x
+	}
+	x.bySrc = make(map[netip.Prefix][]int32)
+	for i, m := range ms {
+		for _, src := range m.Srcs {
+			src = src.Masked()
+			if s := x.bySrc[src]; len(s) > 0 && s[len(s)-1] == int32(i) {
+				continue // duplicate in m.Srcs
+			}
+			x.bySrc[src] = append(x.bySrc[src], int32(i))
+		}
+	}
+	seen := map[int]bool{}
+	for p := range x.bySrc {
+		if !seen[p.Bits()] {
+			seen[p.Bits()] = true
+			x.bits = append(x.bits, p.Bits())
+		}
+	}
+	sort.Ints(x.bits)
+	return x
+}
+
+// matchFunc identifies which of matchProtoAndDst, matchDstIPOnly and
+// matchProtoAndDstIPIfAllPorts to apply. It's used rather than func
+// values so that the packet doesn't escape to the heap.
+type matchFunc uint8
+
+const (
+	matchFuncProtoAndDst matchFunc = iota
+	matchFuncDstIPOnly
+	matchFuncProtoAndDstIPIfAllPorts
+)
+
+func (fn matchFunc) match(m *Match, q *packet.Parsed) bool {
+	switch fn {
+	case matchFuncProtoAndDst:
+		return matchProtoAndDst(m, q)
+	case matchFuncDstIPOnly:
+		return matchDstIPOnly(m, q)
+	default:
+		return matchProtoAndDstIPIfAllPorts(m, q)
+	}
+}
+
+// any reports whether fn matches q for any match in x whose Srcs
+// contain q's source IP.
+func (x *matchIndex) any(q *packet.Parsed, fn matchFunc) bool {
+	src := q.Src.Addr()
+	if x.bySrc == nil {
+		for i := range x.ms {
+			if ipInList(src, x.ms[i].Srcs) && fn.match(&x.ms[i], q) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, bits := range x.bits {
+		p, err := src.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		for _, i := range x.bySrc[p] {
+			if fn.match(&x.ms[i], q) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// match is like matches.match.
+func (x *matchIndex) match(q *packet.Parsed) bool {
+	return x.any(q, matchFuncProtoAndDst)
+}
+
+// matchIPsOnly is like matches.matchIPsOnly.
+func (x *matchIndex) matchIPsOnly(q *packet.Parsed) bool {
+	return x.any(q, matchFuncDstIPOnly)
+}
+
+// matchProtoAndIPsOnlyIfAllPorts is like
+// matches.matchProtoAndIPsOnlyIfAllPorts.
+func (x *matchIndex) matchProtoAndIPsOnlyIfAllPorts(q *packet.Parsed) bool {
+	return x.any(q, matchFuncProtoAndDstIPIfAllPorts)
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"testing"
+
+	"tailscale.com/types/ipproto"
+)
+
+// randomMatches returns n matches from sources in 10.0.0.0/16 to
+// destinations in 100.64.0.0/24, including some prefixes that
+// contain others.
+func randomMatches(rnd *rand.Rand, n int) matches {
+	randSrc := func() netip.Prefix {
+		ip := netip.AddrFrom4([4]byte{10, 0, byte(rnd.Intn(4)), byte(rnd.Intn(256))})
+		switch rnd.Intn(20) {
+		case 0:
+			return netip.MustParsePrefix("0.0.0.0/0")
+		case 1, 2:
+			return netip.PrefixFrom(ip, 24)
+		}
+		return netip.PrefixFrom(ip, 32)
+	}
+	ms := make(matches, n)
+	for i := range ms {
+		m := &ms[i]
+		m.IPProto = []ipproto.Proto{ipproto.TCP}
+		if rnd.Intn(2) == 0 {
+			m.IPProto = append(m.IPProto, ipproto.UDP)
+		}
+		for j := rnd.Intn(3) + 1; j > 0; j-- {
+			m.Srcs = append(m.Srcs, randSrc())
+		}
+		for j := rnd.Intn(2) + 1; j > 0; j-- {
+			dst := netip.AddrFrom4([4]byte{100, 64, 0, byte(rnd.Intn(8))})
+			ports := allPorts
+			if rnd.Intn(3) != 0 {
+				first := uint16(rnd.Intn(100))
+				ports = PortRange{first, first + uint16(rnd.Intn(5))}
+			}
+			m.Dsts = append(m.Dsts, NetPortRange{netip.PrefixFrom(dst, 32), ports})
+		}
+	}
+	return ms
+}
+
+func TestMatchIndex(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, n := range []int{0, 1, minIndexedMatches, 500} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			ms := randomMatches(rnd, n)
+			x := newMatchIndex(ms)
+			if indexed := x.bySrc != nil; indexed != (n >= minIndexedMatches) {
+				t.Errorf("indexed = %v; want %v", indexed, !indexed)
+			}
+			var hits int
+			for i := 0; i < 5000; i++ {
+				proto := []ipproto.Proto{ipproto.TCP, ipproto.UDP, ipproto.SCTP}[rnd.Intn(3)]
+				src := fmt.Sprintf("10.0.%d.%d", rnd.Intn(5), rnd.Intn(256))
+				dst := fmt.Sprintf("100.64.0.%d", rnd.Intn(9))
+				q := parsed(proto, src, dst, 1234, uint16(rnd.Intn(110)))
+				if got, want := x.match(&q), ms.match(&q); got != want {
+					t.Fatalf("match(%v) = %v; want %v", q, got, want)
+				} else if got {
+					hits++
+				}
+				if got, want := x.matchIPsOnly(&q), ms.matchIPsOnly(&q); got != want {
+					t.Fatalf("matchIPsOnly(%v) = %v; want %v", q, got, want)
+				}
+				if got, want := x.matchProtoAndIPsOnlyIfAllPorts(&q), ms.matchProtoAndIPsOnlyIfAllPorts(&q); got != want {
+					t.Fatalf("matchProtoAndIPsOnlyIfAllPorts(%v) = %v; want %v", q, got, want)
+				}
+			}
+			if n >= minIndexedMatches && hits == 0 {
+				t.Errorf("no packets matched; test isn't exercising matches")
+			}
+		})
+	}
+}
+
+func BenchmarkMatchLargeACL(b *testing.B) {
+	for _, n := range []int{10, 100, 1000, 10000} {
+		ms := randomMatches(rand.New(rand.NewSource(1)), n)
+		// A destination no rule allows, so every rule has to be ruled out.
+		q := parsed(ipproto.TCP, "10.0.1.1", "100.64.0.200", 1234, 22)
+		b.Run(fmt.Sprintf("linear/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				ms.match(&q)
+			}
+		})
+		x := newMatchIndex(ms)
+		b.Run(fmt.Sprintf("indexed/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				x.match(&q)
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@
 import (
 	"fmt"
 	"net/netip"
+	"sort"
 	"strings"
 
 	"go4.org/netipx"
@@ -87,6 +88,20 @@ func MatchesFromFilterRules(pf []tailcfg.FilterRule) ([]Match, error) {
 						Cap: cap,
 					})
 				}
+				// In key order, so the same packet filter always
+				// gives the same matches.
+				caps := make([]string, 0, len(cm.CapMap))
+				for cap := range cm.CapMap {
+					caps = append(caps, cap)
+				}
+				sort.Strings(caps)
+				for _, cap := range caps {
+					m.Caps = append(m.Caps, CapMatch{
+						Dst:    dstNet,
+						Cap:    cap,
+						Values: cm.CapMap[cap],
+					})
+				}
 			}
 		}
 
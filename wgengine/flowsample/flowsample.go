@@ -0,0 +1,195 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package flowsample samples packets going through the tunnel into
+// flow records and exports them to an IPFIX or sFlow collector, so
+// subnet routers can be watched with existing network monitoring.
+package flowsample
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/net/packet"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/clientmetric"
+	"tailscale.com/util/ringbuffer"
+)
+
+const (
+	// maxPending is the most records held between exports. If the
+	// collector can't keep up, the oldest are dropped.
+	maxPending = 4096
+
+	// exportInterval is how often pending records are exported.
+	exportInterval = time.Second
+)
+
+var (
+	metricRecordsExported = clientmetric.NewCounter("flowsample_records_exported")
+	metricExportErrors    = clientmetric.NewCounter("flowsample_export_errors")
+)
+
+// Direction is the direction of a sampled packet, relative to the
+// tailnet.
+type Direction uint8
+
+const (
+	// In is a packet that arrived from a peer.
+	In Direction = iota
+	// Out is a packet sent to a peer.
+	Out
+)
+
+// Record is a sampled packet.
+type Record struct {
+	Time     time.Time
+	Dir      Direction
+	Proto    ipproto.Proto
+	Src      netip.AddrPort // port is zero if Proto has none
+	Dst      netip.AddrPort
+	Length   int // of the IP packet
+	TCPFlags packet.TCPFlag
+}
+
+// exporter sends records to a collector.
+type exporter interface {
+	// export sends recs, sampled 1-in-rate from pool packets seen so
+	// far.
+	export(recs []Record, rate int, pool uint64) error
+	Close() error
+}
+
+// Sampler samples 1 in Rate packets into Records and periodically
+// exports them. Its Sample method is safe for concurrent use.
+type Sampler struct {
+	logf      logger.Logf
+	rate      int
+	collector string
+	exp       exporter
+	pending   *ringbuffer.RingBuffer[Record]
+
+	seen atomic.Uint64 // packets offered to Sample
+
+	closeOnce sync.Once
+	done      chan struct{}
+	exited    chan struct{}
+}
+
+// New returns a Sampler sampling 1 in rate packets and exporting them
+// to collector, which is "ipfix://host:port" or "sflow://host:port".
+func New(logf logger.Logf, rate int, collector string) (*Sampler, error) {
+	if rate <= 0 {
+		return nil, fmt.Errorf("invalid flow sample rate %d", rate)
+	}
+	scheme, addr, err := ParseCollector(collector)
+	if err != nil {
+		return nil, err
+	}
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	var exp exporter
+	switch scheme {
+	case "ipfix":
+		exp = newIPFIXExporter(c)
+	case "sflow":
+		exp = newSFlowExporter(c)
+	}
+	s := &Sampler{
+		logf:      logger.WithPrefix(logf, "flowsample: "),
+		rate:      rate,
+		collector: collector,
+		exp:       exp,
+		pending:   ringbuffer.New[Record](maxPending),
+		done:      make(chan struct{}),
+		exited:    make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// ParseCollector splits a collector, "ipfix://host:port" or
+// "sflow://host:port", into its scheme and address.
+func ParseCollector(collector string) (scheme, addr string, err error) {
+	scheme, addr, ok := strings.Cut(collector, "://")
+	if !ok || (scheme != "ipfix" && scheme != "sflow") {
+		return "", "", fmt.Errorf("invalid flow collector %q; want ipfix://host:port or sflow://host:port", collector)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", "", fmt.Errorf("invalid flow collector %q: %v", collector, err)
+	}
+	return scheme, addr, nil
+}
+
+// Rate returns the N in the 1-in-N sampling rate s was created with.
+func (s *Sampler) Rate() int { return s.rate }
+
+// Collector returns the collector s was created with.
+func (s *Sampler) Collector() string { return s.collector }
+
+// Sample considers p, which is going in direction dir, for sampling.
+func (s *Sampler) Sample(p *packet.Parsed, dir Direction) {
+	if p.IPVersion != 4 && p.IPVersion != 6 {
+		return
+	}
+	if s.seen.Add(1)%uint64(s.rate) != 0 {
+		return
+	}
+	s.pending.Add(Record{
+		Time:     time.Now(),
+		Dir:      dir,
+		Proto:    p.IPProto,
+		Src:      p.Src,
+		Dst:      p.Dst,
+		Length:   len(p.Buffer()),
+		TCPFlags: p.TCPFlags,
+	})
+}
+
+func (s *Sampler) run() {
+	defer close(s.exited)
+	t := time.NewTicker(exportInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			s.flush()
+			return
+		case <-t.C:
+			s.flush()
+		}
+	}
+}
+
+func (s *Sampler) flush() {
+	recs := s.pending.TakeAll()
+	if len(recs) == 0 {
+		return
+	}
+	if err := s.exp.export(recs, s.rate, s.seen.Load()); err != nil {
+		metricExportErrors.Add(1)
+		s.logf("export: %v", err)
+		return
+	}
+	metricRecordsExported.Add(int64(len(recs)))
+}
+
+// Close exports any pending records and stops s.
+func (s *Sampler) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		<-s.exited
+		err = s.exp.Close()
+	})
+	return err
+}
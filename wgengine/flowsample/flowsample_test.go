@@ -0,0 +1,152 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package flowsample
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"tailscale.com/net/packet"
+	"tailscale.com/types/ipproto"
+)
+
+func TestParseCollector(t *testing.T) {
+	tests := []struct {
+		in         string
+		wantScheme string
+		wantAddr   string
+		wantErr    bool
+	}{
+		{in: "ipfix://10.0.0.5:4739", wantScheme: "ipfix", wantAddr: "10.0.0.5:4739"},
+		{in: "sflow://[fd00::1]:6343", wantScheme: "sflow", wantAddr: "[fd00::1]:6343"},
+		{in: "netflow://10.0.0.5:2055", wantErr: true},
+		{in: "10.0.0.5:4739", wantErr: true},
+		{in: "ipfix://10.0.0.5", wantErr: true},
+	}
+	for _, tt := range tests {
+		scheme, addr, err := ParseCollector(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseCollector(%q) error = %v; want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if scheme != tt.wantScheme || addr != tt.wantAddr {
+			t.Errorf("ParseCollector(%q) = %q, %q; want %q, %q", tt.in, scheme, addr, tt.wantScheme, tt.wantAddr)
+		}
+	}
+}
+
+func udp4Packet(t *testing.T, src, dst string) *packet.Parsed {
+	t.Helper()
+	h := packet.UDP4Header{
+		IP4Header: packet.IP4Header{
+			IPProto: ipproto.UDP,
+			Src:     netip.MustParseAddr(src),
+			Dst:     netip.MustParseAddr(dst),
+		},
+		SrcPort: 1234,
+		DstPort: 53,
+	}
+	p := new(packet.Parsed)
+	p.Decode(packet.Generate(h, []byte("payload")))
+	return p
+}
+
+// sampleToCollector samples n packets at 1 in rate to a local
+// collector of scheme, and returns the datagram it receives.
+func sampleToCollector(t *testing.T, scheme string, rate, n int) []byte {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	s, err := New(t.Logf, rate, scheme+"://"+pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := udp4Packet(t, "100.64.0.1", "10.0.0.1")
+	for i := 0; i < n; i++ {
+		s.Sample(p, Out)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	nr, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:nr]
+}
+
+func TestIPFIXExport(t *testing.T) {
+	b := sampleToCollector(t, "ipfix", 2, 4)
+	if v := binary.BigEndian.Uint16(b); v != ipfixVersion {
+		t.Fatalf("version = %d; want %d", v, ipfixVersion)
+	}
+	if l := int(binary.BigEndian.Uint16(b[2:])); l != len(b) {
+		t.Fatalf("message length = %d; want %d", l, len(b))
+	}
+	// Walk the sets, counting the IPv4 data records.
+	recLen := 0
+	for _, f := range ipfixFields(4) {
+		recLen += int(f.length)
+	}
+	var records int
+	for off := ipfixHeaderLen; off < len(b); {
+		id := binary.BigEndian.Uint16(b[off:])
+		l := int(binary.BigEndian.Uint16(b[off+2:]))
+		if id == ipfixTemplate4 {
+			records += (l - ipfixSetHeaderLen) / recLen
+			rec := b[off+ipfixSetHeaderLen:]
+			if src := netip.AddrFrom4(*(*[4]byte)(rec[8:12])); src != netip.MustParseAddr("100.64.0.1") {
+				t.Errorf("record source = %v; want 100.64.0.1", src)
+			}
+			if rate := binary.BigEndian.Uint32(rec[recLen-4:]); rate != 2 {
+				t.Errorf("record sampling interval = %d; want 2", rate)
+			}
+		}
+		off += l
+	}
+	if records != 2 {
+		t.Errorf("got %d data records; want 2", records)
+	}
+}
+
+func TestSFlowExport(t *testing.T) {
+	b := sampleToCollector(t, "sflow", 3, 6)
+	if v := binary.BigEndian.Uint32(b); v != sflowVersion {
+		t.Fatalf("version = %d; want %d", v, sflowVersion)
+	}
+	if at := binary.BigEndian.Uint32(b[4:]); at != 1 {
+		t.Fatalf("agent address type = %d; want 1 (IPv4)", at)
+	}
+	if n := binary.BigEndian.Uint32(b[24:]); n != 2 {
+		t.Fatalf("got %d samples; want 2", n)
+	}
+	sample := b[28:]
+	if f := binary.BigEndian.Uint32(sample); f != sflowFlowSample {
+		t.Fatalf("sample format = %d; want %d", f, sflowFlowSample)
+	}
+	if rate := binary.BigEndian.Uint32(sample[16:]); rate != 3 {
+		t.Errorf("sampling rate = %d; want 3", rate)
+	}
+	if pool := binary.BigEndian.Uint32(sample[20:]); pool != 6 {
+		t.Errorf("sample pool = %d; want 6", pool)
+	}
+	rec := sample[40:]
+	if f := binary.BigEndian.Uint32(rec); f != sflowSampledIPv4 {
+		t.Fatalf("record format = %d; want %d", f, sflowSampledIPv4)
+	}
+	if dst := netip.AddrFrom4(*(*[4]byte)(rec[20:24])); dst != netip.MustParseAddr("10.0.0.1") {
+		t.Errorf("record destination = %v; want 10.0.0.1", dst)
+	}
+	if port := binary.BigEndian.Uint32(rec[28:]); port != 53 {
+		t.Errorf("record destination port = %d; want 53", port)
+	}
+}
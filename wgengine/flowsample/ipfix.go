@@ -0,0 +1,158 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package flowsample
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// IPFIX (RFC 7011) constants.
+const (
+	ipfixVersion      = 10
+	ipfixTemplateSet  = 2
+	ipfixTemplate4    = 256 // template ID for IPv4 records
+	ipfixTemplate6    = 257 // template ID for IPv6 records
+	ipfixHeaderLen    = 16
+	ipfixSetHeaderLen = 4
+
+	// ipfixMaxRecords is the most data records put in one message,
+	// to keep it within a typical path MTU.
+	ipfixMaxRecords = 20
+)
+
+// ipfixField is an IPFIX information element in a template.
+type ipfixField struct {
+	id, length uint16
+}
+
+// ipfixFields returns the fields of the template for addresses of
+// addrLen bytes. Records are encoded in this order by appendIPFIXRecord.
+func ipfixFields(addrLen uint16) []ipfixField {
+	src, dst := uint16(8), uint16(12) // sourceIPv4Address, destinationIPv4Address
+	if addrLen == 16 {
+		src, dst = 27, 28 // sourceIPv6Address, destinationIPv6Address
+	}
+	return []ipfixField{
+		{152, 8},       // flowStartMilliseconds
+		{src, addrLen}, // source address
+		{dst, addrLen}, // destination address
+		{7, 2},         // sourceTransportPort
+		{11, 2},        // destinationTransportPort
+		{4, 1},         // protocolIdentifier
+		{6, 2},         // tcpControlBits
+		{61, 1},        // flowDirection
+		{1, 8},         // octetDeltaCount
+		{2, 8},         // packetDeltaCount
+		{305, 4},       // samplingPacketInterval
+	}
+}
+
+// appendIPFIXMessage appends to b an IPFIX message with the templates
+// and recs, which are sampled 1 in rate. seq is the number of data
+// records sent before recs.
+func appendIPFIXMessage(b []byte, recs []Record, rate int, seq uint32, now time.Time) []byte {
+	start := len(b)
+	b = binary.BigEndian.AppendUint16(b, ipfixVersion)
+	b = binary.BigEndian.AppendUint16(b, 0) // length, set below
+	b = binary.BigEndian.AppendUint32(b, uint32(now.Unix()))
+	b = binary.BigEndian.AppendUint32(b, seq)
+	b = binary.BigEndian.AppendUint32(b, 0) // observation domain
+
+	// Templates go in every message, as UDP may lose any of them.
+	set := len(b)
+	b = appendSetHeader(b, ipfixTemplateSet)
+	for _, t := range []struct {
+		id      uint16
+		addrLen uint16
+	}{{ipfixTemplate4, 4}, {ipfixTemplate6, 16}} {
+		fields := ipfixFields(t.addrLen)
+		b = binary.BigEndian.AppendUint16(b, t.id)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(fields)))
+		for _, f := range fields {
+			b = binary.BigEndian.AppendUint16(b, f.id)
+			b = binary.BigEndian.AppendUint16(b, f.length)
+		}
+	}
+	binary.BigEndian.PutUint16(b[set+2:], uint16(len(b)-set))
+
+	for _, is4 := range []bool{true, false} {
+		set := -1
+		for _, r := range recs {
+			if r.Src.Addr().Is4() != is4 {
+				continue
+			}
+			if set == -1 {
+				set = len(b)
+				id := uint16(ipfixTemplate6)
+				if is4 {
+					id = ipfixTemplate4
+				}
+				b = appendSetHeader(b, id)
+			}
+			b = appendIPFIXRecord(b, r, rate)
+		}
+		if set != -1 {
+			binary.BigEndian.PutUint16(b[set+2:], uint16(len(b)-set))
+		}
+	}
+	binary.BigEndian.PutUint16(b[start+2:], uint16(len(b)-start))
+	return b
+}
+
+func appendSetHeader(b []byte, id uint16) []byte {
+	b = binary.BigEndian.AppendUint16(b, id)
+	return binary.BigEndian.AppendUint16(b, 0) // length, set by caller
+}
+
+// appendIPFIXRecord appends r, in the field order of ipfixFields.
+func appendIPFIXRecord(b []byte, r Record, rate int) []byte {
+	b = binary.BigEndian.AppendUint64(b, uint64(r.Time.UnixMilli()))
+	b = append(b, r.Src.Addr().AsSlice()...)
+	b = append(b, r.Dst.Addr().AsSlice()...)
+	b = binary.BigEndian.AppendUint16(b, r.Src.Port())
+	b = binary.BigEndian.AppendUint16(b, r.Dst.Port())
+	b = append(b, byte(r.Proto))
+	b = binary.BigEndian.AppendUint16(b, uint16(r.TCPFlags))
+	dir := byte(0) // ingress
+	if r.Dir == Out {
+		dir = 1 // egress
+	}
+	b = append(b, dir)
+	b = binary.BigEndian.AppendUint64(b, uint64(r.Length))
+	b = binary.BigEndian.AppendUint64(b, 1)
+	return binary.BigEndian.AppendUint32(b, uint32(rate))
+}
+
+// ipfixExporter exports records as IPFIX messages over UDP.
+type ipfixExporter struct {
+	c   net.Conn
+	seq uint32 // data records sent; only accessed by export
+	buf []byte
+}
+
+func newIPFIXExporter(c net.Conn) *ipfixExporter {
+	return &ipfixExporter{c: c}
+}
+
+func (e *ipfixExporter) export(recs []Record, rate int, pool uint64) error {
+	now := time.Now()
+	for len(recs) > 0 {
+		n := len(recs)
+		if n > ipfixMaxRecords {
+			n = ipfixMaxRecords
+		}
+		e.buf = appendIPFIXMessage(e.buf[:0], recs[:n], rate, e.seq, now)
+		if _, err := e.c.Write(e.buf); err != nil {
+			return err
+		}
+		e.seq += uint32(n)
+		recs = recs[n:]
+	}
+	return nil
+}
+
+func (e *ipfixExporter) Close() error { return e.c.Close() }
@@ -0,0 +1,113 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package flowsample
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// sFlow version 5 constants.
+const (
+	sflowVersion     = 5
+	sflowFlowSample  = 1 // enterprise 0, format 1
+	sflowSampledIPv4 = 3
+	sflowSampledIPv6 = 4
+
+	// sflowMaxSamples is the most samples put in one datagram, to
+	// keep it within a typical path MTU.
+	sflowMaxSamples = 12
+)
+
+// appendSFlowDatagram appends to b an sFlow v5 datagram from agent
+// with a flow sample for each of recs, which are sampled 1 in rate
+// from pool packets. seq is the datagram's sequence number, and
+// sampleSeq that of its first sample.
+func appendSFlowDatagram(b []byte, agent netip.Addr, seq, sampleSeq uint32, uptime time.Duration, recs []Record, rate int, pool uint64) []byte {
+	b = binary.BigEndian.AppendUint32(b, sflowVersion)
+	if agent.Is4() {
+		b = binary.BigEndian.AppendUint32(b, 1)
+	} else {
+		b = binary.BigEndian.AppendUint32(b, 2)
+	}
+	b = append(b, agent.AsSlice()...)
+	b = binary.BigEndian.AppendUint32(b, 0) // sub-agent ID
+	b = binary.BigEndian.AppendUint32(b, seq)
+	b = binary.BigEndian.AppendUint32(b, uint32(uptime.Milliseconds()))
+	b = binary.BigEndian.AppendUint32(b, uint32(len(recs)))
+	for i, r := range recs {
+		b = binary.BigEndian.AppendUint32(b, sflowFlowSample)
+		sample := len(b)
+		b = binary.BigEndian.AppendUint32(b, 0) // length, set below
+		b = binary.BigEndian.AppendUint32(b, sampleSeq+uint32(i))
+		b = binary.BigEndian.AppendUint32(b, 0) // source ID
+		b = binary.BigEndian.AppendUint32(b, uint32(rate))
+		b = binary.BigEndian.AppendUint32(b, uint32(pool))
+		b = binary.BigEndian.AppendUint32(b, 0) // drops
+		b = binary.BigEndian.AppendUint32(b, 0) // input interface, unknown
+		b = binary.BigEndian.AppendUint32(b, 0) // output interface, unknown
+		b = binary.BigEndian.AppendUint32(b, 1) // number of flow records
+		if r.Src.Addr().Is4() {
+			b = binary.BigEndian.AppendUint32(b, sflowSampledIPv4)
+			b = binary.BigEndian.AppendUint32(b, 32)
+		} else {
+			b = binary.BigEndian.AppendUint32(b, sflowSampledIPv6)
+			b = binary.BigEndian.AppendUint32(b, 56)
+		}
+		b = binary.BigEndian.AppendUint32(b, uint32(r.Length))
+		b = binary.BigEndian.AppendUint32(b, uint32(r.Proto))
+		b = append(b, r.Src.Addr().AsSlice()...)
+		b = append(b, r.Dst.Addr().AsSlice()...)
+		b = binary.BigEndian.AppendUint32(b, uint32(r.Src.Port()))
+		b = binary.BigEndian.AppendUint32(b, uint32(r.Dst.Port()))
+		b = binary.BigEndian.AppendUint32(b, uint32(r.TCPFlags))
+		b = binary.BigEndian.AppendUint32(b, 0) // TOS or priority
+		binary.BigEndian.PutUint32(b[sample:], uint32(len(b)-sample-4))
+	}
+	return b
+}
+
+// sflowExporter exports records as sFlow v5 datagrams over UDP.
+type sflowExporter struct {
+	c     net.Conn
+	agent netip.Addr
+	start time.Time
+
+	// The following are only accessed by export.
+	seq       uint32 // datagrams sent
+	sampleSeq uint32 // samples sent
+	buf       []byte
+}
+
+func newSFlowExporter(c net.Conn) *sflowExporter {
+	e := &sflowExporter{c: c, start: time.Now(), agent: netip.IPv4Unspecified()}
+	if ua, ok := c.LocalAddr().(*net.UDPAddr); ok {
+		if ip, ok := netip.AddrFromSlice(ua.IP); ok {
+			e.agent = ip.Unmap()
+		}
+	}
+	return e
+}
+
+func (e *sflowExporter) export(recs []Record, rate int, pool uint64) error {
+	for len(recs) > 0 {
+		n := len(recs)
+		if n > sflowMaxSamples {
+			n = sflowMaxSamples
+		}
+		e.seq++
+		e.buf = appendSFlowDatagram(e.buf[:0], e.agent, e.seq, e.sampleSeq+1, time.Since(e.start), recs[:n], rate, pool)
+		if _, err := e.c.Write(e.buf); err != nil {
+			return err
+		}
+		e.sampleSeq += uint32(n)
+		recs = recs[n:]
+	}
+	return nil
+}
+
+func (e *sflowExporter) Close() error { return e.c.Close() }
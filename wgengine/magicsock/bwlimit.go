@@ -0,0 +1,116 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"golang.zx2c4.com/wireguard/device"
+	"tailscale.com/net/dropreason"
+	"tailscale.com/tstime/rate"
+)
+
+// minBandwidthBurst is the smallest burst, in bytes, that a bandwidth
+// limiter allows, so that a full-sized packet always fits.
+const minBandwidthBurst = 16 << 10
+
+// BandwidthLimits are limits on the rate of WireGuard data that a Conn
+// sends and receives. Each direction is limited separately. Zero
+// values mean unlimited.
+type BandwidthLimits struct {
+	// Total is the limit for all peers combined, in bytes per second.
+	Total int64
+
+	// PerPeer is the limit for each peer, in bytes per second.
+	PerPeer int64
+}
+
+// bandwidthLimiter is a pair of token buckets counting bytes sent and
+// received. A nil *bandwidthLimiter is unlimited.
+type bandwidthLimiter struct {
+	tx, rx *rate.Limiter
+}
+
+// newBandwidthLimiter returns a limiter for bytesPerSec in each
+// direction, or nil if bytesPerSec isn't positive.
+func newBandwidthLimiter(bytesPerSec int64) *bandwidthLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	burst := bytesPerSec / 10 // 100ms worth
+	if burst < minBandwidthBurst {
+		burst = minBandwidthBurst
+	}
+	return &bandwidthLimiter{
+		tx: rate.NewLimiter(rate.Limit(bytesPerSec), int(burst)),
+		rx: rate.NewLimiter(rate.Limit(bytesPerSec), int(burst)),
+	}
+}
+
+func (l *bandwidthLimiter) allow(tx bool, n int) bool {
+	if l == nil {
+		return true
+	}
+	if tx {
+		return l.tx.AllowN(n)
+	}
+	return l.rx.AllowN(n)
+}
+
+// bandwidthLimits is the state for the BandwidthLimits set on a Conn.
+type bandwidthLimits struct {
+	BandwidthLimits
+	total *bandwidthLimiter
+}
+
+// peerBandwidth is an endpoint's per-peer limiter, along with the
+// Conn's bandwidthLimits it was made for.
+type peerBandwidth struct {
+	limits *bandwidthLimits
+	lim    *bandwidthLimiter
+}
+
+// SetBandwidthLimits sets the limits on the WireGuard data sent to and
+// received from peers. Packets over the limits are dropped.
+func (c *Conn) SetBandwidthLimits(l BandwidthLimits) {
+	if l == (BandwidthLimits{}) {
+		c.bwLimits.Store(nil)
+		return
+	}
+	c.bwLimits.Store(&bandwidthLimits{
+		BandwidthLimits: l,
+		total:           newBandwidthLimiter(l.Total),
+	})
+}
+
+// allowBandwidth reports whether the WireGuard packet b, sent to (if
+// tx) or received from de, is within the bandwidth limits, counting
+// it against them if so.
+//
+// Only WireGuard data messages are limited. Handshakes are always
+// allowed, so a peer over its limit can still keep its session up.
+func (c *Conn) allowBandwidth(de *endpoint, b []byte, tx bool) bool {
+	bl := c.bwLimits.Load()
+	if bl == nil || len(b) == 0 || b[0] != device.MessageTransportType {
+		return true
+	}
+	if bl.PerPeer > 0 {
+		pb := de.bw.Load()
+		if pb == nil || pb.limits != bl {
+			// Concurrent callers may race to replace a stale
+			// limiter; the loser's packet is counted against a
+			// limiter that's then discarded, which is harmless.
+			pb = &peerBandwidth{limits: bl, lim: newBandwidthLimiter(bl.PerPeer)}
+			de.bw.Store(pb)
+		}
+		if !pb.lim.allow(tx, len(b)) {
+			dropreason.Count(dropreason.RateLimited)
+			return false
+		}
+	}
+	if !bl.total.allow(tx, len(b)) {
+		dropreason.Count(dropreason.RateLimited)
+		return false
+	}
+	return true
+}
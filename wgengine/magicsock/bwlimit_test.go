@@ -0,0 +1,59 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"testing"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+func TestAllowBandwidth(t *testing.T) {
+	c := new(Conn)
+	de1, de2 := new(endpoint), new(endpoint)
+	data := make([]byte, 1000)
+	data[0] = device.MessageTransportType
+	handshake := make([]byte, device.MessageInitiationSize)
+	handshake[0] = device.MessageInitiationType
+
+	// countAllowed reports how many of 100 data packets to de are
+	// allowed.
+	countAllowed := func(de *endpoint, tx bool) (n int) {
+		for i := 0; i < 100; i++ {
+			if c.allowBandwidth(de, data, tx) {
+				n++
+			}
+		}
+		return n
+	}
+
+	if got := countAllowed(de1, true); got != 100 {
+		t.Errorf("unlimited: allowed %d; want 100", got)
+	}
+
+	c.SetBandwidthLimits(BandwidthLimits{PerPeer: 1})
+	if got := countAllowed(de1, true); got != minBandwidthBurst/len(data) {
+		t.Errorf("per-peer tx: allowed %d; want %d", got, minBandwidthBurst/len(data))
+	}
+	if got := countAllowed(de1, false); got != minBandwidthBurst/len(data) {
+		t.Errorf("per-peer rx: allowed %d; want %d", got, minBandwidthBurst/len(data))
+	}
+	if got := countAllowed(de2, true); got != minBandwidthBurst/len(data) {
+		t.Errorf("second peer: allowed %d; want %d", got, minBandwidthBurst/len(data))
+	}
+	if !c.allowBandwidth(de1, handshake, true) {
+		t.Error("handshake over limit was dropped")
+	}
+
+	c.SetBandwidthLimits(BandwidthLimits{Total: 1})
+	if got := countAllowed(de1, true) + countAllowed(de2, true); got != minBandwidthBurst/len(data) {
+		t.Errorf("total: allowed %d; want %d", got, minBandwidthBurst/len(data))
+	}
+
+	c.SetBandwidthLimits(BandwidthLimits{})
+	if got := countAllowed(de1, true); got != 100 {
+		t.Errorf("after removing limits: allowed %d; want 100", got)
+	}
+}
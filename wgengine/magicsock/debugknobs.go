@@ -33,6 +33,13 @@
 	debugReSTUNStopOnIdle = envknob.Bool("TS_DEBUG_RESTUN_STOP_ON_IDLE")
 	// debugAlwaysDERP disables the use of UDP, forcing all peer communication over DERP.
 	debugAlwaysDERP = envknob.Bool("TS_DEBUG_ALWAYS_USE_DERP")
+	// debugDERPProbeInterval, if a valid duration, is how often to
+	// ping DERP servers to check that the connections to them are
+	// alive. See derpProbeInterval.
+	debugDERPProbeInterval = envknob.String("TS_DEBUG_DERP_PROBE_INTERVAL")
+	// debugAllowImpairment permits SetPathImpairment, which adds
+	// artificial latency and loss to peers' paths for testing.
+	debugAllowImpairment = envknob.Bool("TS_DEBUG_ALLOW_IMPAIRMENT")
 )
 
 // inTest reports whether the running program is a test that set the
@@ -19,6 +19,8 @@
 	logDerpVerbose                   = false
 	debugReSTUNStopOnIdle            = false
 	debugAlwaysDERP                  = false
+	debugDERPProbeInterval           = ""
+	debugAllowImpairment             = false
 )
 
 func inTest() bool { return false }
@@ -0,0 +1,55 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"sort"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// derpProbeTimeout is how long to wait for a DERP server to answer a
+// ping, whether a health probe or after a rebind, before reconnecting.
+const derpProbeTimeout = 3 * time.Second
+
+// derpProbeInterval returns how often to ping DERP servers to check
+// their connections are alive, or zero to rely on the server's
+// keepalives.
+func derpProbeInterval() time.Duration {
+	if debugDERPProbeInterval == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(debugDERPProbeInterval)
+	if err != nil || d < 0 {
+		return 0
+	}
+	return d
+}
+
+// DERPHealth returns the health of the connection to each DERP region
+// that c has a client for, sorted by region ID.
+func (c *Conn) DERPHealth() []ipnstate.DERPConnState {
+	c.mu.Lock()
+	ret := make([]ipnstate.DERPConnState, 0, len(c.activeDerp))
+	for regionID, ad := range c.activeDerp {
+		h := ad.c.Health()
+		ret = append(ret, ipnstate.DERPConnState{
+			RegionID:     regionID,
+			RegionCode:   c.derpRegionCodeLocked(regionID),
+			Home:         regionID == c.myDerp,
+			Created:      ad.createTime,
+			Connected:    h.Connected,
+			ConnectedAt:  h.ConnectedAt,
+			Reconnects:   h.Reconnects,
+			LastPong:     h.LastPong,
+			RTT:          h.RTT,
+			PingFailures: h.PingFailures,
+		})
+	}
+	c.mu.Unlock()
+	sort.Slice(ret, func(i, j int) bool { return ret[i].RegionID < ret[j].RegionID })
+	return ret
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"net/netip"
+	"sort"
+	"strconv"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tstime/mono"
+)
+
+// discoEventHistoryCount is how many disco events each endpoint keeps
+// for DiscoDebugState.
+const discoEventHistoryCount = 64
+
+// noteDiscoEventLocked records a disco event for DiscoDebugState.
+//
+// de.mu must be held.
+func (de *endpoint) noteDiscoEventLocked(typ string, addr netip.AddrPort, latency time.Duration, detail string) {
+	ev := ipnstate.DiscoEvent{
+		Time:    time.Now(),
+		Type:    typ,
+		Addr:    addr,
+		Latency: latency,
+		Detail:  detail,
+	}
+	if len(de.discoEvents) < discoEventHistoryCount {
+		de.discoEvents = append(de.discoEvents, ev)
+		return
+	}
+	de.discoEvents[de.discoEventNext] = ev
+	de.discoEventNext = (de.discoEventNext + 1) % discoEventHistoryCount
+}
+
+// noteTrustResetLocked records that de's best address, if any, is no
+// longer trusted, for the given reason.
+//
+// de.mu must be held.
+func (de *endpoint) noteTrustResetLocked(reason string) {
+	if de.bestAddr.IsValid() {
+		de.noteDiscoEventLocked("trust-reset", de.bestAddr.AddrPort, 0, reason)
+	}
+}
+
+// notePingReceived records a disco ping received from src. Heartbeat
+// pings are counted but not recorded as events.
+func (de *endpoint) notePingReceived(src netip.AddrPort, heartbeat bool) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	de.discoCounters.PingsReceived++
+	if !heartbeat {
+		de.noteDiscoEventLocked("ping-received", src, 0, "")
+	}
+}
+
+// noteCallMeMaybeSent records a call-me-maybe sent to de via derpAddr
+// with n endpoints.
+func (de *endpoint) noteCallMeMaybeSent(derpAddr netip.AddrPort, n int) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	de.discoCounters.CallMeMaybeSent++
+	de.noteDiscoEventLocked("call-me-maybe-sent", derpAddr, 0, pluralEndpoints(n))
+}
+
+func pluralEndpoints(n int) string {
+	if n == 1 {
+		return "1 endpoint"
+	}
+	return strconv.Itoa(n) + " endpoints"
+}
+
+// DiscoDebugState returns the state of the disco protocol with each
+// peer, sorted by node key, including recent pings, pongs and
+// call-me-maybe exchanges and changes to the trusted path, so that NAT
+// traversal can be debugged without verbose disco logging.
+func (c *Conn) DiscoDebugState() []ipnstate.PeerDiscoState {
+	var ret []ipnstate.PeerDiscoState
+	c.mu.Lock()
+	c.peerMap.forEachEndpoint(func(de *endpoint) {
+		ret = append(ret, de.discoDebugState())
+	})
+	c.mu.Unlock()
+	sort.Slice(ret, func(i, j int) bool { return ret[i].NodeKey.Less(ret[j].NodeKey) })
+	return ret
+}
+
+func (de *endpoint) discoDebugState() ipnstate.PeerDiscoState {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	now := mono.Now()
+	ps := ipnstate.PeerDiscoState{
+		NodeKey:         de.publicKey,
+		DiscoKey:        de.discoKey,
+		BestAddr:        de.bestAddr.AddrPort,
+		BestAddrLatency: de.bestAddr.latency,
+		Counters:        de.discoCounters,
+	}
+	if de.bestAddr.IsValid() && now.Before(de.trustBestAddrUntil) {
+		ps.TrustedUntil = de.trustBestAddrUntil.WallTime()
+	}
+	for ep, st := range de.endpointState {
+		es := ipnstate.DiscoEndpointState{Addr: ep, Source: "netmap"}
+		switch {
+		case st.pinned:
+			es.Source = "pinned"
+		case de.isCallMeMaybeEP[ep]:
+			es.Source = "call-me-maybe"
+		case !st.lastGotPing.IsZero():
+			es.Source = "ping"
+		}
+		if !st.lastPing.IsZero() {
+			es.LastPing = st.lastPing.WallTime()
+		}
+		if len(st.recentPongs) > 0 {
+			last := st.recentPongs[st.recentPong]
+			es.LastPong = last.pongAt.WallTime()
+			es.Latency = last.latency
+		}
+		ps.Endpoints = append(ps.Endpoints, es)
+	}
+	sort.Slice(ps.Endpoints, func(i, j int) bool {
+		return ps.Endpoints[i].Addr.String() < ps.Endpoints[j].Addr.String()
+	})
+	ps.Events = append(ps.Events, de.discoEvents[de.discoEventNext:]...)
+	ps.Events = append(ps.Events, de.discoEvents[:de.discoEventNext]...)
+	return ps
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+
+	"tailscale.com/tstime/mono"
+)
+
+func TestDiscoDebugState(t *testing.T) {
+	ep := netip.MustParseAddrPort("1.2.3.4:41641")
+	de := &endpoint{
+		bestAddr:           addrLatency{AddrPort: ep, latency: 5 * time.Millisecond},
+		trustBestAddrUntil: mono.Now().Add(time.Minute),
+		endpointState: map[netip.AddrPort]*endpointState{
+			ep: {},
+		},
+	}
+	de.endpointState[ep].addPongReplyLocked(pongReply{latency: 5 * time.Millisecond, pongAt: mono.Now(), from: ep})
+	const n = discoEventHistoryCount + 10
+	for i := 0; i < n; i++ {
+		de.noteDiscoEventLocked("ping-sent", ep, 0, strconv.Itoa(i))
+	}
+
+	ps := de.discoDebugState()
+	if len(ps.Events) != discoEventHistoryCount {
+		t.Fatalf("got %d events; want %d", len(ps.Events), discoEventHistoryCount)
+	}
+	for i, ev := range ps.Events {
+		if want := strconv.Itoa(n - discoEventHistoryCount + i); ev.Detail != want {
+			t.Fatalf("event %d is %q; want %q", i, ev.Detail, want)
+		}
+	}
+	if ps.BestAddr != ep || ps.TrustedUntil.IsZero() {
+		t.Errorf("BestAddr, TrustedUntil = %v, %v; want %v, non-zero", ps.BestAddr, ps.TrustedUntil, ep)
+	}
+	if len(ps.Endpoints) != 1 || ps.Endpoints[0].Source != "netmap" || ps.Endpoints[0].Latency != 5*time.Millisecond {
+		t.Errorf("Endpoints = %+v; want one netmap endpoint with 5ms latency", ps.Endpoints)
+	}
+
+	de.noteConnectivityChange()
+	ps = de.discoDebugState()
+	if !ps.TrustedUntil.IsZero() {
+		t.Errorf("TrustedUntil = %v after connectivity change; want zero", ps.TrustedUntil)
+	}
+	if last := ps.Events[len(ps.Events)-1]; last.Type != "trust-reset" {
+		t.Errorf("last event = %+v; want trust-reset", last)
+	}
+}
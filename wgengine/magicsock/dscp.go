@@ -0,0 +1,55 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/tstime/mono"
+	"tailscale.com/types/key"
+)
+
+// dscpHoldTime is how long a peer's DSCP marking from SetPeerDSCP
+// lasts without being set again.
+const dscpHoldTime = time.Second
+
+// peerDSCP is the DSCP marking for a peer's outer packets.
+type peerDSCP struct {
+	dscp  atomic.Uint32
+	until atomic.Int64 // mono.Time the marking expires
+}
+
+// SetPeerDSCP marks the UDP packets sent directly to the peer with
+// public key k with the DSCP codepoint dscp, for the next second.
+//
+// WireGuard doesn't carry metadata along with the packets it
+// encrypts, so the marking applies to all of the peer's packets, not
+// just those of the inner flow that was marked. Callers set it from
+// marked inner packets as they're sent, so it lasts as long as the
+// marked flow does. Packets sent over DERP aren't marked.
+func (c *Conn) SetPeerDSCP(k key.NodePublic, dscp uint8) {
+	v, ok := c.peerDSCP.Load(k)
+	if !ok {
+		v, _ = c.peerDSCP.LoadOrStore(k, new(peerDSCP))
+	}
+	pd := v.(*peerDSCP)
+	pd.dscp.Store(uint32(dscp))
+	pd.until.Store(int64(mono.Now().Add(dscpHoldTime)))
+}
+
+// dscpForPeer returns the DSCP codepoint to mark UDP packets sent to
+// the peer with public key k at time now with, or 0 if none.
+func (c *Conn) dscpForPeer(k key.NodePublic, now mono.Time) uint8 {
+	v, ok := c.peerDSCP.Load(k)
+	if !ok {
+		return 0
+	}
+	pd := v.(*peerDSCP)
+	if now.After(mono.Time(pd.until.Load())) {
+		return 0
+	}
+	return uint8(pd.dscp.Load())
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"testing"
+
+	"tailscale.com/tstime/mono"
+	"tailscale.com/types/key"
+)
+
+func TestPeerDSCP(t *testing.T) {
+	c := new(Conn)
+	k1, k2 := key.NewNode().Public(), key.NewNode().Public()
+	now := mono.Now()
+
+	if got := c.dscpForPeer(k1, now); got != 0 {
+		t.Errorf("unset: dscp = %d; want 0", got)
+	}
+	c.SetPeerDSCP(k1, 46)
+	if got := c.dscpForPeer(k1, now); got != 46 {
+		t.Errorf("set: dscp = %d; want 46", got)
+	}
+	if got := c.dscpForPeer(k2, now); got != 0 {
+		t.Errorf("other peer: dscp = %d; want 0", got)
+	}
+	if got := c.dscpForPeer(k1, now.Add(2*dscpHoldTime)); got != 0 {
+		t.Errorf("expired: dscp = %d; want 0", got)
+	}
+	c.SetPeerDSCP(k1, 26)
+	if got := c.dscpForPeer(k1, now); got != 26 {
+		t.Errorf("reset: dscp = %d; want 26", got)
+	}
+}
+
+func TestDSCPControlMessageAllocs(t *testing.T) {
+	if got := dscpControlMessage(false, 0); got != nil {
+		t.Errorf("dscp 0: control message = %x; want nil", got)
+	}
+	// Each DSCP codepoint's message is built once, not per send.
+	for _, is6 := range []bool{false, true} {
+		if a, b := dscpControlMessage(is6, 46), dscpControlMessage(is6, 46); len(a) != len(b) || len(a) > 0 && &a[0] != &b[0] {
+			t.Errorf("is6=%v: control messages not shared", is6)
+		}
+	}
+	n := testing.AllocsPerRun(100, func() {
+		dscpControlMessage(true, 46)
+		dscpControlMessage(false, 10)
+	})
+	if n != 0 {
+		t.Errorf("allocs = %v; want 0", n)
+	}
+}
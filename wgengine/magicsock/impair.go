@@ -0,0 +1,172 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"sort"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+)
+
+// maxImpairedInFlight is how many delayed packets a Conn holds at
+// once. Packets beyond it are dropped, as by a full queue.
+const maxImpairedInFlight = 4096
+
+// PathImpairment is artificial latency and loss added to the packets
+// sent to a peer over one of its paths, for testing how the peer's
+// connection and the applications using it cope with a bad path.
+type PathImpairment struct {
+	// Path is the path impaired: "udp" for direct paths, "derp"
+	// for DERP, or empty for both.
+	Path string
+
+	// Latency is how long to hold each packet back before sending
+	// it.
+	Latency time.Duration
+
+	// Jitter is the most extra latency to add, chosen at random for
+	// each packet. Packets may be reordered as a result.
+	Jitter time.Duration
+
+	// Loss is the fraction of packets to drop, from 0 to 1.
+	Loss float64
+}
+
+// impairKey identifies an impaired path.
+type impairKey struct {
+	peer key.NodePublic
+	derp bool
+}
+
+// SetPathImpairment sets the impairment of the packets sent to the
+// peer with public key peer over imp.Path, replacing any already set.
+// A zero Latency, Jitter and Loss removes it.
+//
+// Packets are impaired as they're sent, which includes disco pings,
+// so magicsock's path selection sees the impairment too; packets
+// received from the peer aren't affected. It's a debugging tool, and
+// returns an error unless the TS_DEBUG_ALLOW_IMPAIRMENT environment
+// variable is set.
+func (c *Conn) SetPathImpairment(peer key.NodePublic, imp PathImpairment) error {
+	if !debugAllowImpairment {
+		return errors.New("path impairment requires TS_DEBUG_ALLOW_IMPAIRMENT=1 in tailscaled's environment")
+	}
+	var derp []bool
+	switch imp.Path {
+	case "":
+		derp = []bool{false, true}
+	case "udp":
+		derp = []bool{false}
+	case "derp":
+		derp = []bool{true}
+	default:
+		return fmt.Errorf("unknown path %q; want udp or derp", imp.Path)
+	}
+	if imp.Latency < 0 || imp.Jitter < 0 {
+		return errors.New("latency and jitter can't be negative")
+	}
+	if imp.Loss < 0 || imp.Loss > 1 {
+		return errors.New("loss must be between 0 and 1")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := map[impairKey]PathImpairment{}
+	if old := c.impairments.Load(); old != nil {
+		for k, v := range *old {
+			m[k] = v
+		}
+	}
+	for _, d := range derp {
+		k := impairKey{peer, d}
+		if imp.Latency == 0 && imp.Jitter == 0 && imp.Loss == 0 {
+			delete(m, k)
+			continue
+		}
+		v := imp
+		v.Path = "udp"
+		if d {
+			v.Path = "derp"
+		}
+		m[k] = v
+	}
+	if len(m) == 0 {
+		c.impairments.Store(nil)
+	} else {
+		c.impairments.Store(&m)
+	}
+	c.logf("magicsock: path impairment for %v: %+v", peer.ShortString(), imp)
+	return nil
+}
+
+// PathImpairments returns the impairments set by SetPathImpairment,
+// sorted by peer and path.
+func (c *Conn) PathImpairments() []ipnstate.PathImpairment {
+	var ret []ipnstate.PathImpairment
+	if m := c.impairments.Load(); m != nil {
+		for k, v := range *m {
+			ret = append(ret, ipnstate.PathImpairment{
+				Peer:    k.peer,
+				Path:    v.Path,
+				Latency: v.Latency,
+				Jitter:  v.Jitter,
+				Loss:    v.Loss,
+			})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Peer != ret[j].Peer {
+			return ret[i].Peer.Less(ret[j].Peer)
+		}
+		return ret[i].Path < ret[j].Path
+	})
+	return ret
+}
+
+// impairSend applies any impairment of the path to peer via addr to
+// packet b. It reports whether it took care of b, by dropping it or by
+// arranging for send to be called later with a copy of it. Otherwise,
+// the caller should send b now.
+func (c *Conn) impairSend(peer key.NodePublic, addr netip.AddrPort, b []byte, send func([]byte)) bool {
+	m := c.impairments.Load()
+	if m == nil {
+		return false
+	}
+	imp, ok := (*m)[impairKey{peer, addr.Addr() == derpMagicIPAddr}]
+	if !ok {
+		return false
+	}
+	if imp.Loss > 0 && rand.Float64() < imp.Loss {
+		return true
+	}
+	delay := imp.Latency
+	if imp.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(imp.Jitter)))
+	}
+	if delay <= 0 {
+		return false
+	}
+	if c.impairedInFlight.Add(1) > maxImpairedInFlight {
+		c.impairedInFlight.Add(-1)
+		return true
+	}
+	pkt := make([]byte, len(b))
+	copy(pkt, b)
+	time.AfterFunc(delay, func() {
+		defer c.impairedInFlight.Add(-1)
+		select {
+		case <-c.donec:
+		default:
+			send(pkt)
+		}
+	})
+	return true
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"net/netip"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+)
+
+func TestPathImpairment(t *testing.T) {
+	c := &Conn{logf: t.Logf, donec: make(chan struct{})}
+	peer, other := key.NewNode().Public(), key.NewNode().Public()
+	udp := netip.MustParseAddrPort("1.2.3.4:41641")
+	derp := netip.AddrPortFrom(derpMagicIPAddr, 1)
+
+	if err := c.SetPathImpairment(peer, PathImpairment{Loss: 1}); err == nil {
+		t.Fatal("allowed without TS_DEBUG_ALLOW_IMPAIRMENT")
+	}
+	defer func(old bool) { debugAllowImpairment = old }(debugAllowImpairment)
+	debugAllowImpairment = true
+
+	for _, bad := range []PathImpairment{
+		{Path: "relay", Loss: 1},
+		{Latency: -time.Second},
+		{Loss: 1.5},
+	} {
+		if err := c.SetPathImpairment(peer, bad); err == nil {
+			t.Errorf("SetPathImpairment(%+v) succeeded; want error", bad)
+		}
+	}
+
+	var (
+		mu   sync.Mutex
+		sent [][]byte
+		done = make(chan bool, 1)
+	)
+	send := func(b []byte) {
+		mu.Lock()
+		sent = append(sent, b)
+		mu.Unlock()
+		done <- true
+	}
+
+	if err := c.SetPathImpairment(peer, PathImpairment{Path: "udp", Loss: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if !c.impairSend(peer, udp, []byte("x"), send) {
+		t.Error("packet on lossy path not taken")
+	}
+	if c.impairSend(peer, derp, []byte("x"), send) {
+		t.Error("DERP packet impaired; only UDP should be")
+	}
+	if c.impairSend(other, udp, []byte("x"), send) {
+		t.Error("other peer's packet impaired")
+	}
+
+	if err := c.SetPathImpairment(peer, PathImpairment{Latency: 10 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	want := []ipnstate.PathImpairment{
+		{Peer: peer, Path: "derp", Latency: 10 * time.Millisecond},
+		{Peer: peer, Path: "udp", Latency: 10 * time.Millisecond},
+	}
+	if got := c.PathImpairments(); !reflect.DeepEqual(got, want) {
+		t.Errorf("PathImpairments = %+v; want %+v", got, want)
+	}
+	b := []byte("hello")
+	start := time.Now()
+	if !c.impairSend(peer, derp, b, send) {
+		t.Fatal("delayed packet not taken")
+	}
+	b[0] = 'j' // the caller may reuse its buffer
+	<-done
+	if d := time.Since(start); d < 10*time.Millisecond {
+		t.Errorf("packet sent after %v; want at least 10ms", d)
+	}
+	mu.Lock()
+	if len(sent) != 1 || string(sent[0]) != "hello" {
+		t.Errorf("sent %q; want [hello]", sent)
+	}
+	mu.Unlock()
+
+	if err := c.SetPathImpairment(peer, PathImpairment{}); err != nil {
+		t.Fatal(err)
+	}
+	if c.impairments.Load() != nil {
+		t.Error("impairments remain after clearing")
+	}
+	if c.impairSend(peer, udp, b, send) {
+		t.Error("packet impaired after clearing")
+	}
+}
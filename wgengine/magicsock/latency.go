@@ -0,0 +1,181 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"strconv"
+	"time"
+
+	"tailscale.com/tstime/mono"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+)
+
+const (
+	latencyMin        = 250 * time.Microsecond
+	latencyDoublings  = 14 // up to latencyMin<<latencyDoublings, about 4s
+	latencySubBuckets = 4
+)
+
+// latencyBounds are the inclusive upper bounds of the buckets of a
+// latencyHistogram, in increasing order. Like an HDR histogram, each
+// doubling of latency above latencyMin is split into
+// latencySubBuckets equal-width buckets, so the relative precision is
+// the same at every scale.
+var latencyBounds = func() []time.Duration {
+	bounds := []time.Duration{latencyMin}
+	for i := 0; i < latencyDoublings; i++ {
+		lo := latencyMin << i
+		for j := 1; j <= latencySubBuckets; j++ {
+			bounds = append(bounds, lo+lo*time.Duration(j)/latencySubBuckets)
+		}
+	}
+	return bounds
+}()
+
+// latencyHistogram is a histogram of latencies. Its zero value is
+// empty and ready to use. It's not safe for concurrent use.
+type latencyHistogram struct {
+	counts []uint64 // len(latencyBounds)+1 once non-empty; the last is for larger values
+	sum    time.Duration
+	n      uint64
+}
+
+func (h *latencyHistogram) record(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBounds)+1)
+	}
+	i := sort.Search(len(latencyBounds), func(i int) bool { return d <= latencyBounds[i] })
+	h.counts[i]++
+	h.sum += d
+	h.n++
+}
+
+func (h *latencyHistogram) clone() latencyHistogram {
+	c := *h
+	c.counts = append([]uint64(nil), h.counts...)
+	return c
+}
+
+// writePrometheus writes h as the Prometheus histogram name with the
+// given peer label value. It does nothing if h is empty.
+func (h *latencyHistogram) writePrometheus(w io.Writer, name, peer string) {
+	if h.n == 0 {
+		return
+	}
+	var cum uint64
+	for i, c := range h.counts {
+		cum += c
+		le := "+Inf"
+		if i < len(latencyBounds) {
+			le = strconv.FormatFloat(latencyBounds[i].Seconds(), 'g', -1, 64)
+		}
+		fmt.Fprintf(w, "%s_bucket{peer=%q,le=%q} %d\n", name, peer, le, cum)
+	}
+	fmt.Fprintf(w, "%s_sum{peer=%q} %v\n", name, peer, h.sum.Seconds())
+	fmt.Fprintf(w, "%s_count{peer=%q} %d\n", name, peer, h.n)
+}
+
+// RecordTCPConnectLatency records that a TCP connection to the
+// Tailscale IP ip took d to establish, for the latency histogram of
+// the peer with that IP. It does nothing if ip isn't a peer's.
+func (c *Conn) RecordTCPConnectLatency(ip netip.Addr, d time.Duration) {
+	c.mu.Lock()
+	var ep *endpoint
+	if k, ok := c.nodeOfIP[ip]; ok {
+		ep, _ = c.peerMap.endpointForNodeKey(k)
+	}
+	c.mu.Unlock()
+	if ep == nil {
+		return
+	}
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	ep.tcpConnect.record(d)
+}
+
+// PeerPathLatency returns the round trip time of the trusted direct
+// UDP path to the peer with node key nk, and whether there is one.
+// Peers reached via DERP have none.
+func (c *Conn) PeerPathLatency(nk key.NodePublic) (time.Duration, bool) {
+	c.mu.Lock()
+	ep, ok := c.peerMap.endpointForNodeKey(nk)
+	c.mu.Unlock()
+	if !ok {
+		return 0, false
+	}
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if !ep.bestAddr.IsValid() || mono.Now().After(ep.trustBestAddrUntil) {
+		return 0, false
+	}
+	return ep.bestAddr.latency, true
+}
+
+// updateNodeOfIPLocked rebuilds c.nodeOfIP from nm's peers.
+//
+// c.mu must be held.
+func (c *Conn) updateNodeOfIPLocked(nm *netmap.NetworkMap) {
+	if c.nodeOfIP == nil {
+		c.nodeOfIP = map[netip.Addr]key.NodePublic{}
+	}
+	for ip := range c.nodeOfIP {
+		delete(c.nodeOfIP, ip)
+	}
+	for _, n := range nm.Peers {
+		for _, a := range n.Addresses {
+			if a.IsSingleIP() {
+				c.nodeOfIP[a.Addr()] = n.Key
+			}
+		}
+	}
+}
+
+// WritePeerLatencyMetrics writes per-peer histograms of disco ping
+// round trip times and TCP connect times to w, in the Prometheus text
+// exposition format. Peers are labeled by their short node key.
+func (c *Conn) WritePeerLatencyMetrics(w io.Writer) {
+	type peerHists struct {
+		peer       key.NodePublic
+		discoRTT   latencyHistogram
+		tcpConnect latencyHistogram
+	}
+	var all []peerHists
+	c.mu.Lock()
+	c.peerMap.forEachEndpoint(func(ep *endpoint) {
+		ep.mu.Lock()
+		defer ep.mu.Unlock()
+		if ep.discoRTT.n == 0 && ep.tcpConnect.n == 0 {
+			return
+		}
+		all = append(all, peerHists{
+			peer:       ep.publicKey,
+			discoRTT:   ep.discoRTT.clone(),
+			tcpConnect: ep.tcpConnect.clone(),
+		})
+	})
+	c.mu.Unlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].peer.Less(all[j].peer) })
+
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	for _, m := range []struct {
+		name string
+		get  func(*peerHists) *latencyHistogram
+	}{
+		{"magicsock_peer_disco_rtt_seconds", func(p *peerHists) *latencyHistogram { return &p.discoRTT }},
+		{"magicsock_peer_tcp_connect_seconds", func(p *peerHists) *latencyHistogram { return &p.tcpConnect }},
+	} {
+		fmt.Fprintf(bw, "# TYPE %s histogram\n", m.name)
+		for i := range all {
+			m.get(&all[i]).writePrometheus(bw, m.name, all[i].peer.ShortString())
+		}
+	}
+}
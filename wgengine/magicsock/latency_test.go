@@ -0,0 +1,87 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	for i := 1; i < len(latencyBounds); i++ {
+		if latencyBounds[i] <= latencyBounds[i-1] {
+			t.Fatalf("bounds not increasing at %d: %v", i, latencyBounds)
+		}
+	}
+
+	var h latencyHistogram
+	var sb strings.Builder
+	h.writePrometheus(&sb, "m", "p")
+	if sb.Len() != 0 {
+		t.Errorf("empty histogram wrote %q", sb.String())
+	}
+
+	h.record(100 * time.Microsecond)
+	h.record(250 * time.Microsecond)
+	h.record(300 * time.Microsecond)
+	h.record(time.Minute)
+	h.writePrometheus(&sb, "m", "p")
+	got := sb.String()
+	for _, want := range []string{
+		`m_bucket{peer="p",le="0.00025"} 2` + "\n",
+		`m_bucket{peer="p",le="0.0003125"} 3` + "\n",
+		`m_bucket{peer="p",le="4.096"} 3` + "\n",
+		`m_bucket{peer="p",le="+Inf"} 4` + "\n",
+		`m_count{peer="p"} 4` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+}
+
+func TestRecordTCPConnectLatency(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	c.privateKey = key.NewNode()
+
+	peer := func(k key.NodePublic, ip string) *tailcfg.Node {
+		return &tailcfg.Node{
+			Key:       k,
+			Addresses: []netip.Prefix{netip.MustParsePrefix(ip + "/32")},
+		}
+	}
+	k1, k2 := key.NewNode().Public(), key.NewNode().Public()
+	c.SetNetworkMap(&netmap.NetworkMap{
+		Peers: []*tailcfg.Node{peer(k1, "100.64.0.1"), peer(k2, "100.64.0.2")},
+	})
+	c.RecordTCPConnectLatency(netip.MustParseAddr("100.64.0.2"), time.Millisecond)
+	c.RecordTCPConnectLatency(netip.MustParseAddr("100.64.0.3"), time.Millisecond)
+
+	// k2's address changes; its old one no longer counts for it.
+	c.SetNetworkMap(&netmap.NetworkMap{
+		Peers: []*tailcfg.Node{peer(k1, "100.64.0.1"), peer(k2, "100.64.0.4")},
+	})
+	c.RecordTCPConnectLatency(netip.MustParseAddr("100.64.0.2"), time.Millisecond)
+	c.RecordTCPConnectLatency(netip.MustParseAddr("100.64.0.4"), time.Millisecond)
+
+	var sb strings.Builder
+	c.WritePeerLatencyMetrics(&sb)
+	got := sb.String()
+	want := fmt.Sprintf("magicsock_peer_tcp_connect_seconds_count{peer=%q} 2\n", k2.ShortString())
+	if !strings.Contains(got, want) {
+		t.Errorf("missing %q in:\n%s", want, got)
+	}
+	if strings.Contains(got, k1.ShortString()) {
+		t.Errorf("unexpected metrics for %v in:\n%s", k1.ShortString(), got)
+	}
+}
@@ -38,6 +38,7 @@
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/net/dnscache"
+	"tailscale.com/net/dropreason"
 	"tailscale.com/net/interfaces"
 	"tailscale.com/net/netaddr"
 	"tailscale.com/net/netcheck"
@@ -249,6 +250,8 @@ type Conn struct {
 	testOnlyPacketListener nettype.PacketListener
 	noteRecvActivity       func(key.NodePublic) // or nil, see Options.NoteRecvActivity
 	linkMon                *monitor.Mon         // or nil
+	lowMemory              bool
+	derpDial               func(ctx context.Context, network, addr string) (net.Conn, error) // or nil; see Options.DERPDial
 
 	// ================================================================
 	// No locking required to access these fields, either because
@@ -319,6 +322,10 @@ type Conn struct {
 	havePrivateKey  atomic.Bool
 	publicKeyAtomic syncs.AtomicValue[key.NodePublic] // or NodeKey zero value if !havePrivateKey
 
+	// stealth is whether to drop UDP packets not from peers or STUN
+	// servers; see SetStealth.
+	stealth atomic.Bool
+
 	// derpMapAtomic is the same as derpMap, but without requiring
 	// sync.Mutex. For use with NewRegionClient's callback, to avoid
 	// lock ordering deadlocks. See issue 3726 and mu field docs.
@@ -326,6 +333,20 @@ type Conn struct {
 
 	lastNetCheckReport atomic.Pointer[netcheck.Report]
 
+	// bwLimits are the limits from SetBandwidthLimits, or nil if
+	// unlimited.
+	bwLimits atomic.Pointer[bandwidthLimits]
+
+	// impairments are the path impairments from SetPathImpairment,
+	// or nil if there are none. impairedInFlight is how many
+	// packets they're holding back.
+	impairments      atomic.Pointer[map[impairKey]PathImpairment]
+	impairedInFlight atomic.Int64
+
+	// peerDSCP holds the markings from SetPeerDSCP, keyed by
+	// key.NodePublic with *peerDSCP values.
+	peerDSCP sync.Map
+
 	// port is the preferred port from opts.Port; 0 means auto.
 	port atomic.Uint32
 
@@ -385,6 +406,10 @@ type Conn struct {
 	discoPrivate key.DiscoPrivate
 	discoPublic  key.DiscoPublic // public of discoPrivate
 	discoShort   string          // ShortString of discoPublic (to save logging work later)
+	// oldDiscoPrivate is the disco key discoPrivate was rotated from,
+	// still accepted for incoming discovery traffic until peers learn
+	// the new one. It's zero if there's none.
+	oldDiscoPrivate key.DiscoPrivate
 	// nodeOfDisco tracks the networkmap Node entity for each peer
 	// discovery key.
 	peerMap peerMap
@@ -407,8 +432,18 @@ type Conn struct {
 	// magicsock could do with any complexity reduction it can get.
 	netInfoLast *tailcfg.NetInfo
 
+	// pinnedEndpoints are the static endpoints from
+	// SetPinnedEndpoints, keyed by the peers' Tailscale IPs.
+	pinnedEndpoints map[netip.Addr]netip.AddrPort
+
+	// nodeOfIP maps the Tailscale IPs of netMap's peers to their
+	// node keys. It's rebuilt by SetNetworkMap.
+	nodeOfIP map[netip.Addr]key.NodePublic
+
 	derpMap     *tailcfg.DERPMap // nil (or zero regions/nodes) means DERP is disabled
 	netMap      *netmap.NetworkMap
+	isPeerRelay bool               // whether we relay for peers; see peerrelay.go
+	peerRelays  []key.NodePublic   // peers offering to relay for us
 	privateKey  key.NodePrivate    // WireGuard private key for this node
 	everHadKey  bool               // whether we ever had a non-zero private key
 	myDerp      int                // nearest DERP region ID; 0 means none/unknown
@@ -513,6 +548,15 @@ type Options struct {
 	// LinkMonitor is the link monitor to use.
 	// With one, the portmapper won't be used.
 	LinkMonitor *monitor.Mon
+
+	// LowMemory, if true, uses smaller per-DERP-region write queues,
+	// dropping packets sooner when a DERP connection is slow.
+	LowMemory bool
+
+	// DERPDial, if non-nil, is used to connect to DERP servers
+	// instead of dialing them directly, such as to apply
+	// tsdial.Dialer's system dial rules.
+	DERPDial func(ctx context.Context, network, addr string) (net.Conn, error)
 }
 
 func (o *Options) logf() logger.Logf {
@@ -564,11 +608,13 @@ func NewConn(opts Options) (*Conn, error) {
 	c.idleFunc = opts.IdleFunc
 	c.testOnlyPacketListener = opts.TestOnlyPacketListener
 	c.noteRecvActivity = opts.NoteRecvActivity
+	c.derpDial = opts.DERPDial
 	c.portMapper = portmapper.NewClient(logger.WithPrefix(c.logf, "portmapper: "), c.onPortMapChanged)
 	if opts.LinkMonitor != nil {
 		c.portMapper.SetGatewayLookupFunc(opts.LinkMonitor.GatewayAndSelfIP)
 	}
 	c.linkMon = opts.LinkMonitor
+	c.lowMemory = opts.LowMemory
 
 	if err := c.initialBind(); err != nil {
 		return nil, err
@@ -972,6 +1018,63 @@ func (c *Conn) DiscoPublicKey() key.DiscoPublic {
 	return c.discoPublic
 }
 
+// SetDiscoPrivateKey sets the disco key to k, such as one persisted
+// from a previous run. It should only be used before the current disco
+// public key has been published to peers; see RotateDiscoKey.
+func (c *Conn) SetDiscoPrivateKey(k key.DiscoPrivate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setDiscoPrivateKeyLocked(k, key.DiscoPrivate{})
+}
+
+// RotateDiscoKey replaces the published disco key with k. Discovery
+// messages sealed to the previous key are still accepted until
+// RetireOldDiscoKey is called, so peers that haven't yet learned of
+// k from the control plane keep working.
+func (c *Conn) RotateDiscoKey(k key.DiscoPrivate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setDiscoPrivateKeyLocked(k, c.discoPrivate)
+}
+
+// RetireOldDiscoKey stops accepting discovery messages sealed to the
+// disco key replaced by the last RotateDiscoKey.
+func (c *Conn) RetireOldDiscoKey() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.oldDiscoPrivate.IsZero() {
+		c.logf("magicsock: retired old disco key")
+		c.oldDiscoPrivate = key.DiscoPrivate{}
+	}
+}
+
+// setDiscoPrivateKeyLocked sets the disco key to k, still accepting
+// messages sealed to old if it's non-zero.
+//
+// c.mu must be held.
+func (c *Conn) setDiscoPrivateKeyLocked(k, old key.DiscoPrivate) {
+	if k.IsZero() || k.Equal(c.discoPrivate) {
+		return
+	}
+	c.discoPrivate = k
+	c.discoPublic = k.Public()
+	c.discoShort = c.discoPublic.ShortString()
+	c.oldDiscoPrivate = old
+	c.logf("magicsock: disco key = %v", c.discoShort)
+
+	// The shared keys were computed from the previous key. They're
+	// read without c.mu held once looked up, so replace the
+	// discoInfos rather than updating them in place.
+	for dk, di := range c.discoInfo {
+		n := c.newDiscoInfoLocked(dk)
+		n.lastPingFrom = di.lastPingFrom
+		n.lastPingTime = di.lastPingTime
+		n.lastNodeKey = di.lastNodeKey
+		n.lastNodeKeyTime = di.lastNodeKeyTime
+		c.discoInfo[dk] = n
+	}
+}
+
 // PeerHasDiscoKey reports whether peer k supports discovery keys (client version 0.100.0+).
 func (c *Conn) PeerHasDiscoKey(k key.NodePublic) bool {
 	c.mu.Lock()
@@ -1216,10 +1319,16 @@ func (c *Conn) Send(b []byte, ep conn.Endpoint) error {
 // sendUDP sends UDP packet b to ipp.
 // See sendAddr's docs on the return value meanings.
 func (c *Conn) sendUDP(ipp netip.AddrPort, b []byte) (sent bool, err error) {
+	return c.sendUDPDSCP(ipp, b, 0)
+}
+
+// sendUDPDSCP is like sendUDP, but marks the packet with the DSCP
+// codepoint dscp, if non-zero and the platform supports it.
+func (c *Conn) sendUDPDSCP(ipp netip.AddrPort, b []byte, dscp uint8) (sent bool, err error) {
 	if runtime.GOOS == "js" {
 		return false, errNoUDP
 	}
-	sent, err = c.sendUDPStd(ipp, b)
+	sent, err = c.sendUDPStd(ipp, b, dscp)
 	if err != nil {
 		metricSendUDPError.Add(1)
 	} else {
@@ -1230,12 +1339,12 @@ func (c *Conn) sendUDP(ipp netip.AddrPort, b []byte) (sent bool, err error) {
 	return
 }
 
-// sendUDP sends UDP packet b to addr.
+// sendUDPStd sends UDP packet b to addr, marked with dscp if non-zero.
 // See sendAddr's docs on the return value meanings.
-func (c *Conn) sendUDPStd(addr netip.AddrPort, b []byte) (sent bool, err error) {
+func (c *Conn) sendUDPStd(addr netip.AddrPort, b []byte, dscp uint8) (sent bool, err error) {
 	switch {
 	case addr.Addr().Is4():
-		_, err = c.pconn4.WriteToUDPAddrPort(b, addr)
+		_, err = c.pconn4.writeToUDPAddrPortDSCP(b, addr, dscp)
 		if err != nil && (c.noV4.Load() || neterror.TreatAsLostUDP(err)) {
 			return false, nil
 		}
@@ -1244,7 +1353,7 @@ func (c *Conn) sendUDPStd(addr netip.AddrPort, b []byte) (sent bool, err error)
 			// ignore IPv6 dest if we don't have an IPv6 address.
 			return false, nil
 		}
-		_, err = c.pconn6.WriteToUDPAddrPort(b, addr)
+		_, err = c.pconn6.writeToUDPAddrPortDSCP(b, addr, dscp)
 		if err != nil && (c.noV6.Load() || neterror.TreatAsLostUDP(err)) {
 			return false, nil
 		}
@@ -1265,6 +1374,14 @@ func (c *Conn) sendUDPStd(addr netip.AddrPort, b []byte) (sent bool, err error)
 // IPv6 address when the local machine doesn't have IPv6 support
 // returns (false, nil); it's not an error, but nothing was sent.
 func (c *Conn) sendAddr(addr netip.AddrPort, pubKey key.NodePublic, b []byte) (sent bool, err error) {
+	if c.impairSend(pubKey, addr, b, func(b []byte) { c.sendAddrNow(addr, pubKey, b) }) {
+		return true, nil
+	}
+	return c.sendAddrNow(addr, pubKey, b)
+}
+
+// sendAddrNow is sendAddr without any path impairment.
+func (c *Conn) sendAddrNow(addr netip.AddrPort, pubKey key.NodePublic, b []byte) (sent bool, err error) {
 	if addr.Addr() != derpMagicIPAddr {
 		return c.sendUDP(addr, b)
 	}
@@ -1292,6 +1409,7 @@ func (c *Conn) sendAddr(addr netip.AddrPort, pubKey key.NodePublic, b []byte) (s
 		return true, nil
 	default:
 		metricSendDERPErrorQueue.Add(1)
+		dropreason.Count(dropreason.QueueOverflow)
 		// Too many writes queued. Drop packet.
 		return false, errDropDerpPacket
 	}
@@ -1304,6 +1422,10 @@ func (c *Conn) sendAddr(addr netip.AddrPort, pubKey key.NodePublic, b []byte) (s
 // TODO: this is currently arbitrary. Figure out something better?
 const bufferedDerpWritesBeforeDrop = 32
 
+// bufferedDerpWritesBeforeDropLowMem is bufferedDerpWritesBeforeDrop
+// when Options.LowMemory is set.
+const bufferedDerpWritesBeforeDropLowMem = 8
+
 // derpWriteChanOfAddr returns a DERP client for fake UDP addresses that
 // represent DERP servers, creating them as necessary. For real UDP
 // addresses, it returns nil.
@@ -1397,9 +1519,19 @@ func (c *Conn) derpWriteChanOfAddr(addr netip.AddrPort, peer key.NodePublic) cha
 	dc.NotePreferred(c.myDerp == regionID)
 	dc.SetAddressFamilySelector(derpAddrFamSelector{c})
 	dc.DNSCache = dnscache.Get()
+	if c.derpDial != nil {
+		dc.SetURLDialer(c.derpDial)
+	}
+	if d := derpProbeInterval(); d > 0 {
+		dc.SetHealthProbe(d, derpProbeTimeout)
+	}
 
 	ctx, cancel := context.WithCancel(c.connCtx)
-	ch := make(chan derpWriteRequest, bufferedDerpWritesBeforeDrop)
+	qlen := bufferedDerpWritesBeforeDrop
+	if c.lowMemory {
+		qlen = bufferedDerpWritesBeforeDropLowMem
+	}
+	ch := make(chan derpWriteRequest, qlen)
 
 	ad.c = dc
 	ad.writeCh = ch
@@ -1435,7 +1567,7 @@ func (c *Conn) derpWriteChanOfAddr(addr netip.AddrPort, peer key.NodePublic) cha
 	}
 
 	go c.runDerpReader(ctx, addr, dc, wg, startGate)
-	go c.runDerpWriter(ctx, dc, ch, wg, startGate)
+	go c.runDerpWriter(ctx, regionID, dc, ch, wg, startGate)
 	go c.derpActiveFunc()
 
 	return ad.writeCh
@@ -1509,6 +1641,7 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netip.AddrPort, d
 
 	didCopy := make(chan struct{}, 1)
 	regionID := int(derpFakeAddr.Port())
+	metricRecv := metricRecvDERPRegion.Get(strconv.Itoa(regionID))
 	res := derpReadResult{regionID: regionID}
 	var pkt derp.ReceivedPacket
 	res.copyBuf = func(dst []byte) int {
@@ -1582,6 +1715,7 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netip.AddrPort, d
 			pkt = m
 			res.n = len(m.Data)
 			res.src = m.Source
+			metricRecv.Add(1)
 			if logDerpVerbose {
 				c.logf("magicsock: got derp-%v packet: %q", regionID, m.Data)
 			}
@@ -1635,7 +1769,7 @@ type derpWriteRequest struct {
 
 // runDerpWriter runs in a goroutine for the life of a DERP
 // connection, handling received packets.
-func (c *Conn) runDerpWriter(ctx context.Context, dc *derphttp.Client, ch <-chan derpWriteRequest, wg *syncs.WaitGroupChan, startGate <-chan struct{}) {
+func (c *Conn) runDerpWriter(ctx context.Context, regionID int, dc *derphttp.Client, ch <-chan derpWriteRequest, wg *syncs.WaitGroupChan, startGate <-chan struct{}) {
 	defer wg.Decr()
 	select {
 	case <-startGate:
@@ -1643,6 +1777,8 @@ func (c *Conn) runDerpWriter(ctx context.Context, dc *derphttp.Client, ch <-chan
 		return
 	}
 
+	metricSent := metricSendDERPRegion.Get(strconv.Itoa(regionID))
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -1654,6 +1790,7 @@ func (c *Conn) runDerpWriter(ctx context.Context, dc *derphttp.Client, ch <-chan
 				metricSendDERPError.Add(1)
 			} else {
 				metricSendDERP.Add(1)
+				metricSent.Add(1)
 			}
 		}
 	}
@@ -1668,7 +1805,7 @@ func (c *Conn) receiveIPv6(b []byte) (int, conn.Endpoint, error) {
 		if err != nil {
 			return 0, nil, err
 		}
-		if ep, ok := c.receiveIP(b[:n], ipp, &c.ippEndpoint6, c.closeDisco6 == nil); ok {
+		if n, ep, ok := c.receiveIP(b[:n], ipp, &c.ippEndpoint6, c.closeDisco6 == nil); ok {
 			metricRecvDataIPv6.Add(1)
 			return n, ep, nil
 		}
@@ -1684,7 +1821,7 @@ func (c *Conn) receiveIPv4(b []byte) (n int, ep conn.Endpoint, err error) {
 		if err != nil {
 			return 0, nil, err
 		}
-		if ep, ok := c.receiveIP(b[:n], ipp, &c.ippEndpoint4, c.closeDisco4 == nil); ok {
+		if n, ep, ok := c.receiveIP(b[:n], ipp, &c.ippEndpoint4, c.closeDisco4 == nil); ok {
 			metricRecvDataIPv4.Add(1)
 			return n, ep, nil
 		}
@@ -1694,26 +1831,40 @@ func (c *Conn) receiveIPv4(b []byte) (n int, ep conn.Endpoint, err error) {
 // receiveIP is the shared bits of ReceiveIPv4 and ReceiveIPv6.
 //
 // ok is whether this read should be reported up to wireguard-go (our
-// caller).
-func (c *Conn) receiveIP(b []byte, ipp netip.AddrPort, cache *ippEndpointCache, checkDisco bool) (ep *endpoint, ok bool) {
+// caller), in which case b[:n] holds the WireGuard packet.
+func (c *Conn) receiveIP(b []byte, ipp netip.AddrPort, cache *ippEndpointCache, checkDisco bool) (n int, ep *endpoint, ok bool) {
+	if c.stealth.Load() && !c.stealthAllows(b, ipp, cache) {
+		metricRecvStealthDropped.Add(1)
+		return 0, nil, false
+	}
 	if stun.Is(b) {
 		c.stunReceiveFunc.Load()(b, ipp)
-		return nil, false
+		return 0, nil, false
 	}
 	if checkDisco {
 		if c.handleDiscoMessage(b, ipp, key.NodePublic{}) {
-			return nil, false
+			return 0, nil, false
 		}
 	} else if disco.LooksLikeDiscoWrapper(b) {
 		// Caller told us to ignore disco traffic, don't let it fall
 		// through to wireguard-go.
-		return nil, false
+		return 0, nil, false
 	}
 	if !c.havePrivateKey.Load() {
 		// If we have no private key, we're logged out or
 		// stopped. Don't try to pass these wireguard packets
 		// up to wireguard-go; it'll just complain (issue 1167).
-		return nil, false
+		return 0, nil, false
+	}
+	if isFrame, deliver := looksLikePeerRelayFrame(b); isFrame {
+		n, ep, ok = c.handlePeerRelayFrame(b, ipp, deliver)
+		if ok {
+			if !c.allowBandwidth(ep, b[:n], false) {
+				return 0, nil, false
+			}
+			ep.noteRecvActivity()
+		}
+		return n, ep, ok
 	}
 	if cache.ipp == ipp && cache.de != nil && cache.gen == cache.de.numStopAndReset() {
 		ep = cache.de
@@ -1722,15 +1873,18 @@ func (c *Conn) receiveIP(b []byte, ipp netip.AddrPort, cache *ippEndpointCache,
 		de, ok := c.peerMap.endpointForIPPort(ipp)
 		c.mu.Unlock()
 		if !ok {
-			return nil, false
+			return 0, nil, false
 		}
 		cache.ipp = ipp
 		cache.de = de
 		cache.gen = de.numStopAndReset()
 		ep = de
 	}
+	if !c.allowBandwidth(ep, b, false) {
+		return 0, nil, false
+	}
 	ep.noteRecvActivity()
-	return ep, true
+	return len(b), ep, true
 }
 
 // receiveDERP reads a packet from c.derpRecvCh into b and returns the associated endpoint.
@@ -1783,6 +1937,9 @@ func (c *Conn) processDERPReadResult(dm derpReadResult, b []byte) (n int, ep *en
 		// record or process.
 		return 0, nil
 	}
+	if !c.allowBandwidth(ep, b[:n], false) {
+		return 0, nil
+	}
 
 	ep.noteRecvActivity()
 	return n, ep
@@ -1929,6 +2086,10 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netip.AddrPort, derpNodeSrc ke
 
 	sealedBox := msg[headerLen:]
 	payload, ok := di.sharedKey.Open(sealedBox)
+	if !ok && !c.oldDiscoPrivate.IsZero() && !di.oldSharedKey.IsZero() {
+		// A peer that hasn't learned our rotated key yet.
+		payload, ok = di.oldSharedKey.Open(sealedBox)
+	}
 	if !ok {
 		// This might be have been intended for a previous
 		// disco key.  When we restart we get a new disco key
@@ -1942,6 +2103,7 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netip.AddrPort, derpNodeSrc ke
 			c.logf("magicsock: disco: failed to open naclbox from %v (wrong rcpt?)", sender)
 		}
 		metricRecvDiscoBadKey.Add(1)
+		dropreason.Count(dropreason.DecryptFailure)
 		return
 	}
 
@@ -2079,11 +2241,13 @@ func (c *Conn) handlePingLocked(dm *disco.Ping, src netip.AddrPort, di *discoInf
 	if isDerp {
 		if ep, ok := c.peerMap.endpointForNodeKey(derpNodeSrc); ok {
 			ep.addCandidateEndpoint(src)
+			ep.notePingReceived(src, likelyHeartBeat)
 			numNodes = 1
 		}
 	} else {
 		c.peerMap.forEachEndpointWithDiscoKey(di.discoKey, func(ep *endpoint) {
 			ep.addCandidateEndpoint(src)
+			ep.notePingReceived(src, likelyHeartBeat)
 			numNodes++
 			if numNodes == 1 && dstKey.IsZero() {
 				dstKey = ep.publicKey
@@ -2151,6 +2315,7 @@ func (c *Conn) enqueueCallMeMaybe(derpAddr netip.AddrPort, de *endpoint) {
 	for _, ep := range c.lastEndpoints {
 		eps = append(eps, ep.Addr)
 	}
+	de.noteCallMeMaybeSent(derpAddr, len(eps))
 	go de.c.sendDiscoMessage(derpAddr, de.publicKey, de.discoKey, &disco.CallMeMaybe{MyNumber: eps}, discoLog)
 }
 
@@ -2160,16 +2325,28 @@ func (c *Conn) enqueueCallMeMaybe(derpAddr netip.AddrPort, de *endpoint) {
 func (c *Conn) discoInfoLocked(k key.DiscoPublic) *discoInfo {
 	di, ok := c.discoInfo[k]
 	if !ok {
-		di = &discoInfo{
-			discoKey:   k,
-			discoShort: k.ShortString(),
-			sharedKey:  c.discoPrivate.Shared(k),
-		}
+		di = c.newDiscoInfoLocked(k)
 		c.discoInfo[k] = di
 	}
 	return di
 }
 
+// newDiscoInfoLocked returns a new discoInfo for k with its shared
+// keys computed from the current disco keys.
+//
+// c.mu must be held.
+func (c *Conn) newDiscoInfoLocked(k key.DiscoPublic) *discoInfo {
+	di := &discoInfo{
+		discoKey:   k,
+		discoShort: k.ShortString(),
+		sharedKey:  c.discoPrivate.Shared(k),
+	}
+	if !c.oldDiscoPrivate.IsZero() {
+		di.oldSharedKey = c.oldDiscoPrivate.Shared(k)
+	}
+	return di
+}
+
 func (c *Conn) SetNetworkUp(up bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -2344,6 +2521,8 @@ func (c *Conn) SetNetworkMap(nm *netmap.NetworkMap) {
 		return
 	}
 
+	c.updatePeerRelaysLocked(nm)
+
 	if c.netMap != nil && nodesEqual(c.netMap.Peers, nm.Peers) {
 		return
 	}
@@ -2362,6 +2541,7 @@ func (c *Conn) SetNetworkMap(nm *netmap.NetworkMap) {
 		c.logf("[v1] magicsock: %d DERP-only peers (no discokey)", numNoDisco)
 	}
 	c.netMap = nm
+	c.updateNodeOfIPLocked(nm)
 
 	// Try a pass of just upserting nodes and creating missing
 	// endpoints. If the set of nodes is the same, this is an
@@ -2430,6 +2610,7 @@ func (c *Conn) SetNetworkMap(nm *netmap.NetworkMap) {
 		c.peerMap.forEachEndpoint(func(ep *endpoint) {
 			if !keep[ep.publicKey] {
 				c.peerMap.deleteEndpoint(ep)
+				c.peerDSCP.Delete(ep.publicKey)
 			}
 		})
 	}
@@ -2474,7 +2655,7 @@ func (c *Conn) maybeCloseDERPsOnRebind(okayLocalIPs []netip.Prefix) {
 		regionID := regionID
 		dc := ad.c
 		go func() {
-			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			ctx, cancel := context.WithTimeout(context.Background(), derpProbeTimeout)
 			defer cancel()
 			if err := dc.Ping(ctx); err != nil {
 				c.mu.Lock()
@@ -3144,6 +3325,39 @@ func (c *RebindingUDPConn) WriteToUDPAddrPort(b []byte, addr netip.AddrPort) (in
 	}
 }
 
+// udpMsgWriter is the subset of *net.UDPConn used to send packets with
+// control messages.
+type udpMsgWriter interface {
+	WriteMsgUDPAddrPort(b, oob []byte, addr netip.AddrPort) (n, oobn int, err error)
+}
+
+// writeToUDPAddrPortDSCP is like WriteToUDPAddrPort, but marks the
+// packet with the DSCP codepoint dscp, if non-zero and supported by
+// the platform and underlying conn.
+func (c *RebindingUDPConn) writeToUDPAddrPortDSCP(b []byte, addr netip.AddrPort, dscp uint8) (int, error) {
+	oob := dscpControlMessage(addr.Addr().Is6(), dscp)
+	if oob == nil {
+		return c.WriteToUDPAddrPort(b, addr)
+	}
+	for {
+		pconn := c.pconnAtomic.Load()
+
+		var n int
+		var err error
+		if mw, ok := pconn.(udpMsgWriter); ok {
+			n, _, err = mw.WriteMsgUDPAddrPort(b, oob, addr)
+		} else {
+			n, err = pconn.WriteToUDPAddrPort(b, addr)
+		}
+		if err != nil {
+			if pconn != c.currentConn() {
+				continue
+			}
+		}
+		return n, err
+	}
+}
+
 func newBlockForeverConn() *blockForeverConn {
 	c := new(blockForeverConn)
 	c.cond = sync.NewCond(&c.mu)
@@ -3304,6 +3518,7 @@ type endpoint struct {
 	// atomically accessed; declared first for alignment reasons
 	lastRecv              mono.Time
 	numStopAndResetAtomic int64
+	bw                    atomic.Pointer[peerBandwidth] // per-peer limiter for Conn.allowBandwidth
 
 	// These fields are initialized once and never modified.
 	c          *Conn
@@ -3330,6 +3545,21 @@ type endpoint struct {
 	isCallMeMaybeEP    map[netip.AddrPort]bool
 
 	pendingCLIPings []pendingCLIPing // any outstanding "tailscale ping" commands running
+
+	pinnedAddr netip.AddrPort // static endpoint from Conn.SetPinnedEndpoints; zero if none
+
+	peerRelayCapable bool           // peer understands packets from peer relays
+	relayedVia       key.NodePublic // peer relay that last delivered a packet from this peer
+	relayedRecvAt    mono.Time      // when relayedVia last delivered a packet from this peer
+
+	discoRTT   latencyHistogram // disco ping round trip times
+	tcpConnect latencyHistogram // TCP connect times, from RecordTCPConnectLatency
+
+	heartbeatLoss lossWindow // whether recent heartbeat pings were answered
+
+	discoCounters  ipnstate.DiscoCounters
+	discoEvents    []ipnstate.DiscoEvent // ring buffer up to discoEventHistoryCount entries
+	discoEventNext int                   // index into discoEvents of the oldest, once full
 }
 
 type pendingCLIPing struct {
@@ -3410,6 +3640,10 @@ type endpointState struct {
 	recentPong  uint16      // index into recentPongs of most recent; older before, wrapped
 
 	index int16 // index in nodecfg.Node.Endpoints; meaningless if lastGotPing non-zero
+
+	// pinned is whether this is the peer's endpoint from
+	// Conn.SetPinnedEndpoints. Pinned endpoints are never deleted.
+	pinned bool
 }
 
 // indexSentinelDeleted is the temporary value that endpointState.index takes while
@@ -3419,6 +3653,8 @@ type endpointState struct {
 // shouldDeleteLocked reports whether we should delete this endpoint.
 func (st *endpointState) shouldDeleteLocked() bool {
 	switch {
+	case st.pinned:
+		return false
 	case !st.callMeMaybeTime.IsZero():
 		return false
 	case st.lastGotPing.IsZero():
@@ -3433,7 +3669,9 @@ func (st *endpointState) shouldDeleteLocked() bool {
 func (de *endpoint) deleteEndpointLocked(ep netip.AddrPort) {
 	delete(de.endpointState, ep)
 	if de.bestAddr.AddrPort == ep {
+		de.noteTrustResetLocked("endpoint removed")
 		de.bestAddr = addrLatency{}
+		de.heartbeatLoss = lossWindow{}
 	}
 }
 
@@ -3616,6 +3854,10 @@ func (de *endpoint) cliPing(res *ipnstate.PingResult, cb func(*ipnstate.PingResu
 }
 
 func (de *endpoint) send(b []byte) error {
+	if !de.c.allowBandwidth(de, b, true) {
+		// Drop it, like a full queue would.
+		return nil
+	}
 	now := mono.Now()
 
 	de.mu.Lock()
@@ -3626,12 +3868,25 @@ func (de *endpoint) send(b []byte) error {
 	de.noteActiveLocked()
 	de.mu.Unlock()
 
+	if !udpAddr.IsValid() {
+		// No direct path; try a peer relay before falling back to
+		// DERP alone.
+		if sent, skipDERP := de.c.sendViaPeerRelay(de, b); sent && skipDERP {
+			return nil
+		} else if sent && !derpAddr.IsValid() {
+			return nil
+		}
+	}
 	if !udpAddr.IsValid() && !derpAddr.IsValid() {
+		dropreason.Count(dropreason.NoRoute)
 		return errors.New("no UDP or DERP addr")
 	}
 	var err error
 	if udpAddr.IsValid() {
-		_, err = de.c.sendAddr(udpAddr, de.publicKey, b)
+		dscp := de.c.dscpForPeer(de.publicKey, now)
+		if !de.c.impairSend(de.publicKey, udpAddr, b, func(b []byte) { de.c.sendUDPDSCP(udpAddr, b, dscp) }) {
+			_, err = de.c.sendUDPDSCP(udpAddr, b, dscp)
+		}
 	}
 	if derpAddr.IsValid() {
 		if ok, _ := de.c.sendAddr(derpAddr, de.publicKey, b); ok && err != nil {
@@ -3652,6 +3907,11 @@ func (de *endpoint) pingTimeout(txid stun.TxID) {
 	if debugDisco || !de.bestAddr.IsValid() || mono.Now().After(de.trustBestAddrUntil) {
 		de.c.logf("[v1] magicsock: disco: timeout waiting for pong %x from %v (%v, %v)", txid[:6], sp.to, de.publicKey.ShortString(), de.discoShort)
 	}
+	de.discoCounters.PingTimeouts++
+	if sp.purpose == pingHeartbeat {
+		de.heartbeatLoss.record(true)
+	}
+	de.noteDiscoEventLocked("ping-timeout", sp.to, 0, strings.ToLower(sp.purpose.String()))
 	de.removeSentPingLocked(txid, sp)
 }
 
@@ -3732,9 +3992,12 @@ func (de *endpoint) startPingLocked(ep netip.AddrPort, now mono.Time, purpose di
 		timer:   time.AfterFunc(pingTimeoutDuration, func() { de.pingTimeout(txid) }),
 		purpose: purpose,
 	}
+	de.discoCounters.PingsSent++
 	logLevel := discoLog
 	if purpose == pingHeartbeat {
 		logLevel = discoVerboseLog
+	} else {
+		de.noteDiscoEventLocked("ping-sent", ep, 0, strings.ToLower(purpose.String()))
 	}
 	go de.sendDiscoPing(ep, de.discoKey, txid, logLevel)
 }
@@ -3774,6 +4037,9 @@ func (de *endpoint) sendPingsLocked(now mono.Time, sendCallMeMaybe bool) {
 	}
 }
 
+// updateFromNode updates de from the network map node n.
+//
+// c.mu must be held.
 func (de *endpoint) updateFromNode(n *tailcfg.Node) {
 	if n == nil {
 		panic("nil node when updating disco ep")
@@ -3792,6 +4058,7 @@ func (de *endpoint) updateFromNode(n *tailcfg.Node) {
 	} else {
 		de.derpAddr, _ = netip.ParseAddrPort(n.DERP)
 	}
+	_, de.peerRelayCapable = peerRelayOf(n.Hostinfo).Get()
 
 	for _, st := range de.endpointState {
 		st.index = indexSentinelDeleted // assume deleted until updated in next loop
@@ -3820,6 +4087,8 @@ func (de *endpoint) updateFromNode(n *tailcfg.Node) {
 			de.deleteEndpointLocked(ep)
 		}
 	}
+
+	de.setPinnedAddrLocked(de.c.pinnedEndpointForNodeLocked(n))
 }
 
 // addCandidateEndpoint adds ep as an endpoint to which we should send
@@ -3865,6 +4134,9 @@ func (de *endpoint) noteConnectivityChange() {
 	de.mu.Lock()
 	defer de.mu.Unlock()
 
+	if de.trustBestAddrUntil != 0 {
+		de.noteTrustResetLocked("connectivity change")
+	}
 	de.trustBestAddrUntil = 0
 }
 
@@ -3889,6 +4161,14 @@ func (de *endpoint) handlePongConnLocked(m *disco.Pong, di *discoInfo, src netip
 
 	now := mono.Now()
 	latency := now.Sub(sp.at)
+	de.discoRTT.record(latency)
+	de.discoCounters.PongsReceived++
+	if sp.purpose == pingHeartbeat {
+		de.heartbeatLoss.record(false)
+	}
+	if sp.purpose != pingHeartbeat {
+		de.noteDiscoEventLocked("pong-received", src, latency, "pong.src="+m.Src.String())
+	}
 
 	if !isDerp {
 		st, ok := de.endpointState[sp.to]
@@ -3925,8 +4205,16 @@ func (de *endpoint) handlePongConnLocked(m *disco.Pong, di *discoInfo, src netip
 	// TODO(bradfitz): decide how latency vs. preference order affects decision
 	if !isDerp {
 		thisPong := addrLatency{sp.to, latency}
-		if betterAddr(thisPong, de.bestAddr) {
+		if de.preferAddrLocked(thisPong, now) {
 			de.c.logf("magicsock: disco: node %v %v now using %v", de.publicKey.ShortString(), de.discoShort, sp.to)
+			var detail string
+			if de.bestAddr.IsValid() {
+				detail = "was " + de.bestAddr.AddrPort.String()
+			}
+			de.noteDiscoEventLocked("best-addr", sp.to, latency, detail)
+			if de.bestAddr.AddrPort != thisPong.AddrPort {
+				de.heartbeatLoss = lossWindow{} // losses were on the old path
+			}
 			de.bestAddr = thisPong
 		}
 		if de.bestAddr.AddrPort == thisPong.AddrPort {
@@ -4000,6 +4288,9 @@ func (de *endpoint) handleCallMeMaybe(m *disco.CallMeMaybe) {
 	de.mu.Lock()
 	defer de.mu.Unlock()
 
+	de.discoCounters.CallMeMaybeRecv++
+	de.noteDiscoEventLocked("call-me-maybe-received", netip.AddrPort{}, 0, pluralEndpoints(len(m.MyNumber)))
+
 	now := time.Now()
 	for ep := range de.isCallMeMaybeEP {
 		de.isCallMeMaybeEP[ep] = false // mark for deletion
@@ -4067,6 +4358,9 @@ func (de *endpoint) populatePeerStatus(ps *ipnstate.PeerStatus) {
 	if udpAddr, derpAddr := de.addrForSendLocked(now); udpAddr.IsValid() && !derpAddr.IsValid() {
 		ps.CurAddr = udpAddr.String()
 	}
+	if ps.Active {
+		ps.ConnQuality = de.connQualityLocked(now)
+	}
 }
 
 // stopAndReset stops timers associated with de and resets its state back to zero.
@@ -4092,11 +4386,16 @@ func (de *endpoint) stopAndReset() {
 // DERP-only endpoint. It does not stop the endpoint's heartbeat
 // timer, if one is running.
 func (de *endpoint) resetLocked() {
+	de.noteTrustResetLocked("reset")
 	de.lastSend = 0
 	de.lastFullPing = 0
 	de.bestAddr = addrLatency{}
 	de.bestAddrAt = 0
 	de.trustBestAddrUntil = 0
+	de.heartbeatLoss = lossWindow{}
+	if de.pinnedAddr.IsValid() {
+		de.bestAddr = addrLatency{AddrPort: de.pinnedAddr}
+	}
 	for _, es := range de.endpointState {
 		es.lastPing = 0
 	}
@@ -4143,6 +4442,11 @@ type discoInfo struct {
 	// Not modifed once initialized.
 	sharedKey key.DiscoShared
 
+	// oldSharedKey is like sharedKey, but computed from
+	// Conn.oldDiscoPrivate. It's zero if there was none.
+	// Not modified once initialized.
+	oldSharedKey key.DiscoShared
+
 	// Mutable fields follow, owned by Conn.mu:
 
 	// lastPingFrom is the src of a ping for discoKey.
@@ -4184,6 +4488,10 @@ func (s derpAddrFamSelector) PreferIPv6() bool {
 	return false
 }
 
+// maxDERPRegionMetrics is the most DERP regions with their own
+// per-region metrics.
+const maxDERPRegionMetrics = 32
+
 var (
 	metricNumPeers     = clientmetric.NewGauge("magicsock_netmap_num_peers")
 	metricNumDERPConns = clientmetric.NewGauge("magicsock_num_derp_conns")
@@ -4202,12 +4510,18 @@ func (s derpAddrFamSelector) PreferIPv6() bool {
 	metricSendDERP            = clientmetric.NewCounter("magicsock_send_derp")
 	metricSendDERPError       = clientmetric.NewCounter("magicsock_send_derp_error")
 
+	// Packets (data or disco) per DERP region, for the regions
+	// connected to first.
+	metricSendDERPRegion = clientmetric.NewCounterLabeled("magicsock_send_derp_region", "region", maxDERPRegionMetrics)
+	metricRecvDERPRegion = clientmetric.NewCounterLabeled("magicsock_recv_derp_region", "region", maxDERPRegionMetrics)
+
 	// Data packets (non-disco)
 	metricSendData            = clientmetric.NewCounter("magicsock_send_data")
 	metricSendDataNetworkDown = clientmetric.NewCounter("magicsock_send_data_network_down")
 	metricRecvDataDERP        = clientmetric.NewCounter("magicsock_recv_data_derp")
 	metricRecvDataIPv4        = clientmetric.NewCounter("magicsock_recv_data_ipv4")
 	metricRecvDataIPv6        = clientmetric.NewCounter("magicsock_recv_data_ipv6")
+	metricRecvStealthDropped  = clientmetric.NewCounter("magicsock_recv_stealth_dropped")
 
 	// Disco packets
 	metricSendDiscoUDP         = clientmetric.NewCounter("magicsock_disco_send_udp")
@@ -15,3 +15,9 @@
 func (c *Conn) listenRawDisco(family string) (io.Closer, error) {
 	return nil, errors.New("raw disco listening not supported on this OS")
 }
+
+// dscpControlMessage returns nil, as marking packets with DSCP
+// codepoints isn't implemented on this OS.
+func dscpControlMessage(is6 bool, dscp uint8) []byte {
+	return nil
+}
@@ -258,3 +258,49 @@ func setBPF(conn net.PacketConn, filter []bpf.RawInstruction) error {
 	}
 	return nil
 }
+
+// dscpControlMessages holds the control message for each IPv4
+// ([0]) and IPv6 ([1]) DSCP codepoint, so that sends don't allocate
+// one each. It's read-only after init; callers must not modify the
+// messages.
+var dscpControlMessages [2][64][]byte
+
+func init() {
+	for i := range dscpControlMessages {
+		for dscp := 1; dscp < len(dscpControlMessages[i]); dscp++ {
+			dscpControlMessages[i][dscp] = newDSCPControlMessage(i == 1, uint8(dscp))
+		}
+	}
+}
+
+// dscpControlMessage returns the control message that marks a UDP
+// packet sent over IPv4, or IPv6 if is6, with the DSCP codepoint dscp,
+// or nil if dscp is zero. The returned slice must not be modified.
+func dscpControlMessage(is6 bool, dscp uint8) []byte {
+	if int(dscp) >= len(dscpControlMessages[0]) {
+		return newDSCPControlMessage(is6, dscp)
+	}
+	i := 0
+	if is6 {
+		i = 1
+	}
+	return dscpControlMessages[i][dscp]
+}
+
+// newDSCPControlMessage returns a new control message for
+// dscpControlMessage, or nil if dscp is zero.
+func newDSCPControlMessage(is6 bool, dscp uint8) []byte {
+	if dscp == 0 {
+		return nil
+	}
+	b := make([]byte, unix.CmsgSpace(4))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+	if is6 {
+		h.Level, h.Type = unix.IPPROTO_IPV6, unix.IPV6_TCLASS
+	} else {
+		h.Level, h.Type = unix.IPPROTO_IP, unix.IP_TOS
+	}
+	h.SetLen(unix.CmsgLen(4))
+	*(*int32)(unsafe.Pointer(&b[unix.CmsgLen(0)])) = int32(dscp) << 2
+	return b
+}
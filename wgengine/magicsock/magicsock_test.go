@@ -39,13 +39,13 @@
 	"tailscale.com/net/tstun"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
+	"tailscale.com/tstest/memtest"
 	"tailscale.com/tstest/natlab"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
 	"tailscale.com/types/nettype"
 	"tailscale.com/util/cibuild"
-	"tailscale.com/util/racebuild"
 	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/wgcfg"
 	"tailscale.com/wgengine/wgcfg/nmcfg"
@@ -832,6 +832,81 @@ func TestActiveDiscovery(t *testing.T) {
 	})
 }
 
+// TestNATTopologies checks that two magicStacks in each of the natlab
+// topologies in testdata/topologies end up with the expected kind of
+// path between them.
+func TestNATTopologies(t *testing.T) {
+	topos, err := natlab.LoadTopologies("testdata/topologies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, topo := range topos {
+		topo := topo
+		t.Run(topo.Name, func(t *testing.T) {
+			if len(topo.Peers) != 2 {
+				t.Fatalf("topology has %d peers; want 2", len(topo.Peers))
+			}
+			lab, err := topo.Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			testNATTopology(t, lab)
+		})
+	}
+}
+
+func testNATTopology(t *testing.T, lab *natlab.Lab) {
+	tstest.PanicOnLog()
+	tstest.ResourceCheck(t)
+
+	logf, closeLogf := logger.LogfCloser(t.Logf)
+	defer closeLogf()
+
+	derpMap, cleanup := runDERPAndStun(t, logf, lab.STUN, lab.STUNIP)
+	defer cleanup()
+
+	m1 := newMagicStack(t, logger.WithPrefix(logf, "conn1: "), lab.Peers[0], derpMap)
+	defer m1.Close()
+	m2 := newMagicStack(t, logger.WithPrefix(logf, "conn2: "), lab.Peers[1], derpMap)
+	defer m2.Close()
+
+	cleanup = meshStacks(logf, nil, m1, m2)
+	defer cleanup()
+
+	cleanup = newPinger(t, logf, m1, m2)
+	defer cleanup()
+
+	mustPath(t, logf, m1, m2, lab.Topology.WantPath)
+	mustPath(t, logf, m2, m1, lab.Topology.WantPath)
+}
+
+// mustPath checks that m1 uses the given kind of path to m2. An empty
+// want checks nothing.
+func mustPath(t *testing.T, logf logger.Logf, m1, m2 *magicStack, want natlab.PathType) {
+	switch want {
+	case "":
+	case natlab.PathDirect:
+		mustDirect(t, logf, m1, m2)
+	case natlab.PathDERP:
+		mustDERP(t, logf, m1, m2)
+	default:
+		t.Fatalf("unknown path type %q", want)
+	}
+}
+
+// mustDERP checks that m1 doesn't find a direct path to m2 in the time
+// that discovery normally takes to find one.
+func mustDERP(t *testing.T, logf logger.Logf, m1, m2 *magicStack) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		pst := m1.Status().Peer[m2.Public()]
+		if pst.CurAddr != "" {
+			t.Errorf("magicsock found direct path %s->%s with addr %s; want DERP only", m1, m2, pst.CurAddr)
+			return
+		}
+	}
+	logf("no direct path %s->%s, as expected", m1, m2)
+}
+
 type devices struct {
 	m1   nettype.PacketListener
 	m1IP netip.Addr
@@ -1164,6 +1239,50 @@ func TestDiscoMessage(t *testing.T) {
 	}
 }
 
+func TestDiscoKeyRotation(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	c.privateKey = key.NewNode()
+	oldPub := c.DiscoPublicKey()
+
+	peerPriv := key.NewDisco()
+	c.peerMap.upsertEndpoint(&endpoint{
+		publicKey: key.NewNode().Public(),
+		discoKey:  peerPriv.Public(),
+	}, key.DiscoPublic{})
+	c.discoInfoLocked(peerPriv.Public()) // computed before the rotation
+
+	// opens reports whether c accepts a message from the peer
+	// sealed to to.
+	opens := func(to key.DiscoPublic) bool {
+		pkt := peerPriv.Public().AppendTo([]byte(disco.Magic))
+		pkt = append(pkt, peerPriv.Shared(to).Seal((&disco.CallMeMaybe{}).AppendMarshal(nil))...)
+		bad := metricRecvDiscoBadKey.Value()
+		c.handleDiscoMessage(pkt, netip.AddrPort{}, key.NodePublic{})
+		return metricRecvDiscoBadKey.Value() == bad
+	}
+
+	c.RotateDiscoKey(key.NewDisco())
+	newPub := c.DiscoPublicKey()
+	if newPub == oldPub {
+		t.Fatal("disco key didn't change")
+	}
+	if !opens(newPub) {
+		t.Error("message to new key rejected")
+	}
+	if !opens(oldPub) {
+		t.Error("message to old key rejected before retiring it")
+	}
+
+	c.RetireOldDiscoKey()
+	if opens(oldPub) {
+		t.Error("message to old key accepted after retiring it")
+	}
+	if !opens(newPub) {
+		t.Error("message to new key rejected after retiring old key")
+	}
+}
+
 // tests that having a endpoint.String prevents wireguard-go's
 // log.Printf("%v") of its conn.Endpoint values from using reflect to
 // walk into read mutex while they're being used and then causing data
@@ -1342,9 +1461,6 @@ func TestGoMajorVersion(t *testing.T) {
 }
 
 func TestReceiveFromAllocs(t *testing.T) {
-	if racebuild.On {
-		t.Skip("alloc tests are unreliable with -race")
-	}
 	// Go 1.16 and before: allow 3 allocs.
 	// Go 1.17: allow 2 allocs.
 	// Go 1.17, Tailscale fork: allow 1 alloc.
@@ -1362,10 +1478,9 @@ func TestReceiveFromAllocs(t *testing.T) {
 	}
 	t.Logf("allowing %d allocs for Go version %q", maxAllocs, runtime.Version())
 	roundTrip := setUpReceiveFrom(t)
-	err := tstest.MinAllocsPerRun(t, uint64(maxAllocs), roundTrip)
-	if err != nil {
-		t.Fatal(err)
-	}
+	memtest.Check(t, []memtest.Budget{
+		{Name: "roundtrip", Allocs: uint64(maxAllocs), Run: roundTrip},
+	})
 }
 
 func BenchmarkReceiveFrom(b *testing.B) {
@@ -1818,3 +1933,45 @@ func TestDiscoMagicMatches(t *testing.T) {
 		t.Errorf("last 2 bytes of disco magic don't match, got %v want %v", discoMagic2, m2)
 	}
 }
+
+func TestPeerRelayDeliver(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+
+	relay := &endpoint{c: c, publicKey: key.NewNode().Public()}
+	src := &endpoint{c: c, publicKey: key.NewNode().Public()}
+	for _, ep := range []*endpoint{relay, src} {
+		c.peerMap.upsertEndpoint(ep, key.DiscoPublic{})
+	}
+	relayAddr := netip.MustParseAddrPort("1.2.3.4:41641")
+	c.peerMap.setNodeKeyForIPPort(relayAddr, relay.publicKey)
+
+	const payload = "wireguard packet"
+	frame := func() []byte {
+		return appendPeerRelayFrame(nil, peerRelayDeliverMagic, src.publicKey, []byte(payload))
+	}
+	if ok, deliver := looksLikePeerRelayFrame(frame()); !ok || !deliver {
+		t.Fatalf("looksLikePeerRelayFrame = %v, %v; want true, true", ok, deliver)
+	}
+
+	if _, _, ok := c.handlePeerRelayFrame(frame(), relayAddr, true); ok {
+		t.Fatal("accepted frame from a peer that isn't a relay")
+	}
+
+	c.peerRelays = []key.NodePublic{relay.publicKey}
+	b := frame()
+	n, ep, ok := c.handlePeerRelayFrame(b, relayAddr, true)
+	if !ok || ep != src {
+		t.Fatalf("got (%v, %v); want (%v, true)", ep, ok, src)
+	}
+	if got := string(b[:n]); got != payload {
+		t.Errorf("payload = %q; want %q", got, payload)
+	}
+	if src.relayedVia != relay.publicKey {
+		t.Errorf("relayedVia = %v; want %v", src.relayedVia, relay.publicKey)
+	}
+
+	if _, _, ok := c.handlePeerRelayFrame(frame(), netip.MustParseAddrPort("5.6.7.8:1"), true); ok {
+		t.Error("accepted frame from unknown address")
+	}
+}
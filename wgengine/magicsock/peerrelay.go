@@ -0,0 +1,233 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"net/netip"
+
+	"go4.org/mem"
+	"golang.org/x/exp/slices"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstime/mono"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+	"tailscale.com/types/opt"
+	"tailscale.com/util/clientmetric"
+)
+
+// Peer relays are tailnet nodes that forward WireGuard packets between
+// two of their peers that can't reach each other directly (typically
+// both behind hard NATs), as a last resort before DERP. This lets
+// intra-tailnet traffic stay on the tailnet's own well-connected nodes.
+//
+// A sender wraps the WireGuard packet in a forward frame addressed to
+// the destination's node key and sends it to the relay's direct UDP
+// path. The relay replaces the destination key with the sender's (as
+// known from the relay's own direct path to it) and sends the packet
+// on as a deliver frame over its direct path to the destination.
+// Disco messages are never relayed; the endpoints keep using DERP to
+// discover a direct path.
+const (
+	peerRelayForwardMagic = "TS\xa5F" // sender -> relay
+	peerRelayDeliverMagic = "TS\xa5D" // relay -> destination
+
+	peerRelayHeaderLen = len(peerRelayForwardMagic) + key.NodePublicRawLen
+)
+
+// looksLikePeerRelayFrame reports whether b is a peer relay frame,
+// and whether it's a deliver (rather than forward) frame.
+func looksLikePeerRelayFrame(b []byte) (ok, deliver bool) {
+	if len(b) <= peerRelayHeaderLen {
+		return false, false
+	}
+	switch string(b[:len(peerRelayForwardMagic)]) {
+	case peerRelayForwardMagic:
+		return true, false
+	case peerRelayDeliverMagic:
+		return true, true
+	}
+	return false, false
+}
+
+// appendPeerRelayFrame appends a peer relay frame of payload with the
+// given magic and node key to dst.
+func appendPeerRelayFrame(dst []byte, magic string, k key.NodePublic, payload []byte) []byte {
+	dst = append(dst, magic...)
+	dst = k.AppendTo(dst)
+	return append(dst, payload...)
+}
+
+func peerRelayFrameKey(b []byte) key.NodePublic {
+	return key.NodePublicFromRaw32(mem.B(b[len(peerRelayForwardMagic):peerRelayHeaderLen]))
+}
+
+// updatePeerRelaysLocked updates which peers may be used as relays and
+// whether this node acts as one, from nm.
+//
+// c.mu must be held.
+func (c *Conn) updatePeerRelaysLocked(nm *netmap.NetworkMap) {
+	self := nm.SelfNode
+	c.isPeerRelay = self != nil &&
+		peerRelayOf(self.Hostinfo).EqualBool(true) &&
+		slices.Contains(self.Capabilities, tailcfg.CapabilityPeerRelay)
+	c.peerRelays = c.peerRelays[:0]
+	for _, n := range nm.Peers {
+		if peerRelayOf(n.Hostinfo).EqualBool(true) {
+			c.peerRelays = append(c.peerRelays, n.Key)
+		}
+	}
+}
+
+// peerRelayOf returns hi.PeerRelay, or the empty value if hi isn't
+// valid.
+func peerRelayOf(hi tailcfg.HostinfoView) opt.Bool {
+	if !hi.Valid() {
+		return ""
+	}
+	return hi.PeerRelay()
+}
+
+// handlePeerRelayFrame handles a peer relay frame b received from ipp.
+// If b is a deliver frame from one of our relays, it returns the
+// endpoint of the original sender and the length of the WireGuard
+// packet, which it moves to the start of b. Otherwise it forwards or
+// drops b and returns ok false.
+func (c *Conn) handlePeerRelayFrame(b []byte, ipp netip.AddrPort, deliver bool) (n int, ep *endpoint, ok bool) {
+	k := peerRelayFrameKey(b)
+	c.mu.Lock()
+	from, fromOK := c.peerMap.endpointForIPPort(ipp)
+	if !fromOK {
+		c.mu.Unlock()
+		metricPeerRelayDropUnknownSrc.Add(1)
+		return 0, nil, false
+	}
+	if !deliver {
+		isRelay := c.isPeerRelay
+		to, toOK := c.peerMap.endpointForNodeKey(k)
+		c.mu.Unlock()
+		if !isRelay || !toOK || to == from {
+			metricPeerRelayDropNotAllowed.Add(1)
+			return 0, nil, false
+		}
+		c.forwardPeerRelayFrame(b, from, to)
+		return 0, nil, false
+	}
+	isOurRelay := slices.Contains(c.peerRelays, from.publicKey)
+	src, srcOK := c.peerMap.endpointForNodeKey(k)
+	c.mu.Unlock()
+	if !isOurRelay || !srcOK {
+		metricPeerRelayDropNotAllowed.Add(1)
+		return 0, nil, false
+	}
+	src.noteRelayedRecv(from.publicKey)
+	n = copy(b, b[peerRelayHeaderLen:])
+	metricRecvDataPeerRelay.Add(1)
+	return n, src, true
+}
+
+// forwardPeerRelayFrame sends the forward frame b from peer from on to
+// peer to, over this node's direct path to it.
+func (c *Conn) forwardPeerRelayFrame(b []byte, from, to *endpoint) {
+	to.mu.Lock()
+	dst := to.bestAddr.AddrPort
+	trusted := mono.Now().Before(to.trustBestAddrUntil)
+	capable := to.peerRelayCapable
+	to.mu.Unlock()
+	if !capable {
+		metricPeerRelayDropNotAllowed.Add(1)
+		return
+	}
+	if !dst.IsValid() || !trusted {
+		// We don't do this over DERP: the sender can do that itself.
+		metricPeerRelayDropNoPath.Add(1)
+		return
+	}
+	copy(b, peerRelayDeliverMagic)
+	src := from.publicKey.Raw32()
+	copy(b[len(peerRelayDeliverMagic):], src[:])
+	if _, err := c.sendUDP(dst, b); err != nil {
+		metricPeerRelayDropNoPath.Add(1)
+		return
+	}
+	metricPeerRelayForwarded.Add(1)
+}
+
+// peerRelayAddrFor returns the direct UDP address of a relay to use to
+// reach de, and that relay's node key. It prefers the relay that most
+// recently delivered a packet from de.
+func (c *Conn) peerRelayAddrFor(de *endpoint) (relay key.NodePublic, addr netip.AddrPort, ok bool) {
+	de.mu.Lock()
+	preferred := de.relayedVia
+	capable := de.peerRelayCapable
+	de.mu.Unlock()
+	if !capable {
+		return relay, addr, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := mono.Now()
+	for _, rk := range c.peerRelays {
+		if rk == de.publicKey {
+			continue
+		}
+		rep, ok := c.peerMap.endpointForNodeKey(rk)
+		if !ok {
+			continue
+		}
+		rep.mu.Lock()
+		ra := rep.bestAddr.AddrPort
+		trusted := now.Before(rep.trustBestAddrUntil)
+		rep.mu.Unlock()
+		if !ra.IsValid() || !trusted {
+			continue
+		}
+		if !addr.IsValid() || rk == preferred {
+			relay, addr = rk, ra
+		}
+	}
+	return relay, addr, addr.IsValid()
+}
+
+// sendViaPeerRelay sends the WireGuard packet b to de via a peer relay,
+// if one is available. It reports whether it sent it, and whether de
+// has recently sent us packets the same way, in which case the caller
+// can skip DERP.
+func (c *Conn) sendViaPeerRelay(de *endpoint, b []byte) (sent, skipDERP bool) {
+	relay, addr, ok := c.peerRelayAddrFor(de)
+	if !ok {
+		return false, false
+	}
+	frame := appendPeerRelayFrame(make([]byte, 0, peerRelayHeaderLen+len(b)), peerRelayForwardMagic, de.publicKey, b)
+	if ok, _ := c.sendUDP(addr, frame); !ok {
+		return false, false
+	}
+	metricSendDataPeerRelay.Add(1)
+
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	return true, de.relayedVia == relay && mono.Now().Before(de.relayedRecvAt.Add(trustUDPAddrDuration))
+}
+
+// noteRelayedRecv records that de sent us a packet via relay.
+func (de *endpoint) noteRelayedRecv(relay key.NodePublic) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	if de.relayedVia != relay {
+		de.c.logf("[v1] magicsock: receiving from %v via peer relay %v", de.publicKey.ShortString(), relay.ShortString())
+	}
+	de.relayedVia = relay
+	de.relayedRecvAt = mono.Now()
+}
+
+var (
+	metricSendDataPeerRelay = clientmetric.NewCounter("magicsock_send_data_peer_relay")
+	metricRecvDataPeerRelay = clientmetric.NewCounter("magicsock_recv_data_peer_relay")
+
+	metricPeerRelayForwarded      = clientmetric.NewCounter("magicsock_peer_relay_forwarded")
+	metricPeerRelayDropUnknownSrc = clientmetric.NewCounter("magicsock_peer_relay_drop_unknown_src")
+	metricPeerRelayDropNotAllowed = clientmetric.NewCounter("magicsock_peer_relay_drop_not_allowed")
+	metricPeerRelayDropNoPath     = clientmetric.NewCounter("magicsock_peer_relay_drop_no_path")
+)
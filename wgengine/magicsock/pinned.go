@@ -0,0 +1,124 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"net/netip"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstime/mono"
+)
+
+// SetPinnedEndpoints sets static UDP endpoints for peers, keyed by one
+// of each peer's Tailscale IPs. A pinned endpoint is a direct path
+// candidate from the start, without waiting for the peer's endpoints
+// to be discovered, and is preferred over discovered paths for as long
+// as it answers pings. It's for peers whose public ip:port is known
+// in advance, such as servers in a colo.
+//
+// Until a pinned endpoint answers a ping, packets to the peer are sent
+// both to it and over DERP.
+func (c *Conn) SetPinnedEndpoints(pins map[netip.Addr]netip.AddrPort) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pinnedEndpoints = pins
+	if c.netMap == nil {
+		return
+	}
+	for _, n := range c.netMap.Peers {
+		de, ok := c.peerMap.endpointForNodeKey(n.Key)
+		if !ok {
+			continue
+		}
+		de.mu.Lock()
+		de.setPinnedAddrLocked(c.pinnedEndpointForNodeLocked(n))
+		de.mu.Unlock()
+	}
+}
+
+// pinnedEndpointForNodeLocked returns the pinned endpoint for the peer
+// n, or the zero value if it has none.
+//
+// c.mu must be held.
+func (c *Conn) pinnedEndpointForNodeLocked(n *tailcfg.Node) netip.AddrPort {
+	if len(c.pinnedEndpoints) == 0 {
+		return netip.AddrPort{}
+	}
+	for _, a := range n.Addresses {
+		if !a.IsSingleIP() {
+			continue
+		}
+		if ep, ok := c.pinnedEndpoints[a.Addr()]; ok {
+			return ep
+		}
+	}
+	return netip.AddrPort{}
+}
+
+// setPinnedAddrLocked sets de's pinned endpoint to ep, which may be the
+// zero value to unpin it.
+//
+// de.mu must be held.
+func (de *endpoint) setPinnedAddrLocked(ep netip.AddrPort) {
+	if ep == de.pinnedAddr {
+		return
+	}
+	if old := de.pinnedAddr; old.IsValid() {
+		de.c.logf("[v1] magicsock: disco: unpinning %v for %v (%s)", old, de.discoShort, de.publicKey.ShortString())
+		if st, ok := de.endpointState[old]; ok {
+			st.pinned = false
+			if st.shouldDeleteLocked() {
+				de.deleteEndpointLocked(old)
+			}
+		}
+		if de.bestAddr.AddrPort == old && de.trustBestAddrUntil == 0 {
+			// Never confirmed; let discovery pick a path.
+			de.bestAddr = addrLatency{}
+			de.heartbeatLoss = lossWindow{}
+		}
+	}
+	de.pinnedAddr = ep
+	if !ep.IsValid() {
+		return
+	}
+	de.c.logf("[v1] magicsock: disco: pinning %v for %v (%s)", ep, de.discoShort, de.publicKey.ShortString())
+	st, ok := de.endpointState[ep]
+	if !ok {
+		st = &endpointState{index: indexSentinelDeleted}
+		de.endpointState[ep] = st
+	}
+	st.pinned = true
+	if de.bestAddr.AddrPort != ep {
+		de.noteDiscoEventLocked("best-addr", ep, 0, "pinned")
+		de.bestAddr = addrLatency{AddrPort: ep}
+		de.bestAddrAt = 0
+		de.trustBestAddrUntil = 0
+		de.heartbeatLoss = lossWindow{}
+	}
+}
+
+// preferAddrLocked reports whether a, an address that just answered a
+// ping, should replace de.bestAddr.
+//
+// A pinned endpoint is preferred over any other, regardless of latency,
+// while it's answering pings. Any address that answers beats a pinned
+// one that hasn't, so a stale pin falls back to discovered paths.
+//
+// de.mu must be held.
+func (de *endpoint) preferAddrLocked(a addrLatency, now mono.Time) bool {
+	if a.AddrPort == de.bestAddr.AddrPort {
+		return false
+	}
+	if pin := de.pinnedAddr; pin.IsValid() {
+		if a.AddrPort == pin {
+			return true
+		}
+		if de.bestAddr.AddrPort == pin {
+			return now.After(de.trustBestAddrUntil)
+		}
+	}
+	return betterAddr(a, de.bestAddr)
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"tailscale.com/net/stun"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstime/mono"
+	"tailscale.com/types/key"
+)
+
+func TestPinnedEndpoint(t *testing.T) {
+	pin := netip.MustParseAddrPort("203.0.113.5:41641")
+	other := netip.MustParseAddrPort("198.51.100.7:41641")
+	c := &Conn{
+		logf: t.Logf,
+		pinnedEndpoints: map[netip.Addr]netip.AddrPort{
+			netip.MustParseAddr("100.64.0.1"): pin,
+		},
+	}
+	de := &endpoint{
+		c:             c,
+		publicKey:     key.NewNode().Public(),
+		sentPing:      map[stun.TxID]sentPing{},
+		endpointState: map[netip.AddrPort]*endpointState{},
+	}
+	n := &tailcfg.Node{
+		Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+		Endpoints: []string{other.String()},
+	}
+	de.updateFromNode(n)
+
+	now := mono.Now()
+	if udp, derp := de.addrForSendLocked(now); udp != pin || derp != de.derpAddr {
+		t.Fatalf("addrForSend = %v, %v; want %v and DERP before any pong", udp, derp, pin)
+	}
+
+	// A pin that hasn't answered yields to any path that has.
+	if !de.preferAddrLocked(addrLatency{other, 50 * time.Millisecond}, now) {
+		t.Errorf("unconfirmed pin not replaced by confirmed path")
+	}
+	de.bestAddr = addrLatency{other, 50 * time.Millisecond}
+	if !de.preferAddrLocked(addrLatency{pin, 100 * time.Millisecond}, now) {
+		t.Errorf("slower pin didn't take over once confirmed")
+	}
+	de.bestAddr = addrLatency{pin, 100 * time.Millisecond}
+	de.trustBestAddrUntil = now.Add(trustUDPAddrDuration)
+	if de.preferAddrLocked(addrLatency{other, time.Millisecond}, now) {
+		t.Errorf("confirmed pin replaced by faster discovered path")
+	}
+
+	// Pinned endpoints aren't in the netmap but survive updates.
+	de.updateFromNode(n)
+	if st, ok := de.endpointState[pin]; !ok || !st.pinned {
+		t.Fatalf("pinned endpoint dropped by netmap update")
+	}
+
+	c.pinnedEndpoints = nil
+	de.updateFromNode(n)
+	if _, ok := de.endpointState[pin]; ok {
+		t.Errorf("endpoint still present after unpinning")
+	}
+	if de.pinnedAddr.IsValid() || de.bestAddr.IsValid() {
+		t.Errorf("pinnedAddr, bestAddr = %v, %v after unpinning; want zero", de.pinnedAddr, de.bestAddr)
+	}
+}
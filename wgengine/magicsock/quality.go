@@ -0,0 +1,115 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"math"
+	"math/bits"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tstime/mono"
+)
+
+// lossWindowSize is how many of the most recent heartbeat pings to a
+// peer its loss rate is computed over.
+const lossWindowSize = 32
+
+// lossWindow records whether each of the lossWindowSize most recent
+// heartbeat pings to a peer went unanswered. Discovery pings aren't
+// recorded, as most candidate endpoints are expected not to answer.
+type lossWindow struct {
+	lost uint32 // bit i is set if the i'th most recent ping was lost
+	n    uint8  // number of pings recorded, up to lossWindowSize
+}
+
+func (w *lossWindow) record(lost bool) {
+	w.lost <<= 1
+	if lost {
+		w.lost |= 1
+	}
+	if w.n < lossWindowSize {
+		w.n++
+	}
+}
+
+// fraction returns the fraction of the recorded pings that were lost,
+// or 0 if none were recorded.
+func (w *lossWindow) fraction() float64 {
+	if w.n == 0 {
+		return 0
+	}
+	return float64(bits.OnesCount32(w.lost)) / float64(w.n)
+}
+
+// Scoring parameters for connQualityScore.
+const (
+	// Base scores by path, before penalties.
+	qualityBaseDirect    = 100
+	qualityBasePeerRelay = 75
+	qualityBaseDERP      = 50
+
+	// RTTs at or under qualityGoodRTT aren't penalized; each
+	// qualityRTTStep above it costs a point, up to qualityMaxRTTPenalty.
+	qualityGoodRTT       = 50 * time.Millisecond
+	qualityRTTStep       = 10 * time.Millisecond
+	qualityMaxRTTPenalty = 40
+
+	// Each percent of pings lost costs qualityLossPerPercent points,
+	// up to qualityMaxLossPenalty.
+	qualityLossPerPercent = 2
+	qualityMaxLossPenalty = 60
+)
+
+// connQualityScore returns a score from 1 (worst) to 100 (best) for a
+// peer connection over path ("direct", "peer-relay" or "derp"), with
+// round trip time rtt (zero if unknown) and fraction loss of recent
+// pings lost.
+func connQualityScore(path string, rtt time.Duration, loss float64) int {
+	var score int
+	switch path {
+	case "direct":
+		score = qualityBaseDirect
+	case "peer-relay":
+		score = qualityBasePeerRelay
+	default:
+		score = qualityBaseDERP
+	}
+	if rtt > qualityGoodRTT {
+		penalty := int((rtt - qualityGoodRTT) / qualityRTTStep)
+		if penalty > qualityMaxRTTPenalty {
+			penalty = qualityMaxRTTPenalty
+		}
+		score -= penalty
+	}
+	penalty := int(math.Round(loss*100)) * qualityLossPerPercent
+	if penalty > qualityMaxLossPenalty {
+		penalty = qualityMaxLossPenalty
+	}
+	score -= penalty
+	if score < 1 {
+		score = 1
+	}
+	return score
+}
+
+// connQualityLocked returns the quality of the connection to de as of
+// now.
+//
+// de.mu must be held.
+func (de *endpoint) connQualityLocked(now mono.Time) *ipnstate.ConnQuality {
+	q := &ipnstate.ConnQuality{
+		Path: "derp",
+		Loss: de.heartbeatLoss.fraction(),
+	}
+	if udpAddr, derpAddr := de.addrForSendLocked(now); udpAddr.IsValid() && !derpAddr.IsValid() {
+		q.Path = "direct"
+		q.RTT = de.bestAddr.latency
+	} else if !de.relayedVia.IsZero() && now.Before(de.relayedRecvAt.Add(trustUDPAddrDuration)) {
+		q.Path = "peer-relay"
+	}
+	q.Score = connQualityScore(q.Path, q.RTT, q.Loss)
+	return q
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"tailscale.com/net/stun"
+	"tailscale.com/types/key"
+)
+
+func TestLossWindow(t *testing.T) {
+	var w lossWindow
+	if got := w.fraction(); got != 0 {
+		t.Errorf("empty fraction = %v; want 0", got)
+	}
+	w.record(true)
+	w.record(false)
+	w.record(false)
+	w.record(false)
+	if got := w.fraction(); got != 0.25 {
+		t.Errorf("fraction = %v; want 0.25", got)
+	}
+	// The lost ping ages out of the window.
+	for i := 0; i < lossWindowSize; i++ {
+		w.record(false)
+	}
+	if got := w.fraction(); got != 0 {
+		t.Errorf("fraction after window = %v; want 0", got)
+	}
+}
+
+func TestConnQualityScore(t *testing.T) {
+	tests := []struct {
+		path string
+		rtt  time.Duration
+		loss float64
+		want int
+	}{
+		{"direct", 10 * time.Millisecond, 0, 100},
+		{"direct", 150 * time.Millisecond, 0, 90},
+		{"direct", 5 * time.Second, 0, 60},
+		{"direct", 10 * time.Millisecond, 0.1, 80},
+		{"direct", 10 * time.Millisecond, 0.29, 42}, // 28.999… rounds to 29%
+		{"direct", 5 * time.Second, 1, 1},
+		{"peer-relay", 0, 0, 75},
+		{"derp", 0, 0, 50},
+		{"derp", 0, 0.5, 1},
+	}
+	for _, tt := range tests {
+		if got := connQualityScore(tt.path, tt.rtt, tt.loss); got != tt.want {
+			t.Errorf("connQualityScore(%q, %v, %v) = %d; want %d", tt.path, tt.rtt, tt.loss, got, tt.want)
+		}
+	}
+}
+
+func TestHeartbeatLossReset(t *testing.T) {
+	de := &endpoint{
+		c:             &Conn{logf: t.Logf},
+		publicKey:     key.NewNode().Public(),
+		sentPing:      map[stun.TxID]sentPing{},
+		endpointState: map[netip.AddrPort]*endpointState{},
+	}
+	ep := netip.MustParseAddrPort("203.0.113.5:41641")
+	de.bestAddr = addrLatency{AddrPort: ep}
+	de.endpointState[ep] = &endpointState{}
+	de.heartbeatLoss.record(true)
+	de.deleteEndpointLocked(ep)
+	if got := de.heartbeatLoss.fraction(); got != 0 {
+		t.Errorf("loss after best path removed = %v; want 0", got)
+	}
+
+	de.heartbeatLoss.record(true)
+	de.stopAndReset()
+	if got := de.heartbeatLoss.fraction(); got != 0 {
+		t.Errorf("loss after stopAndReset = %v; want 0", got)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"net/netip"
+
+	"go4.org/mem"
+	"tailscale.com/disco"
+	"tailscale.com/net/stun"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// SetStealth sets whether c is in stealth mode, in which UDP packets
+// are dropped, before any other processing, unless they come from the
+// current address of a peer, are disco messages from a peer's disco
+// key, or are STUN packets from a STUN server in the DERP map. A
+// scanner then can't tell the port is open.
+//
+// STUN servers are only recognized by the IPv4 and IPv6 addresses
+// given in the DERP map, not ones found by DNS.
+func (c *Conn) SetStealth(v bool) {
+	if c.stealth.Swap(v) != v {
+		c.logf("magicsock: stealth mode = %v", v)
+	}
+}
+
+// stealthAllows reports whether, in stealth mode, the UDP packet b
+// from ipp is attributable to a peer or STUN server and may be
+// processed.
+func (c *Conn) stealthAllows(b []byte, ipp netip.AddrPort, cache *ippEndpointCache) bool {
+	if stun.Is(b) {
+		return isDERPMapSTUNAddr(c.derpMapAtomic.Load(), ipp)
+	}
+	if cache.ipp == ipp && cache.de != nil && cache.gen == cache.de.numStopAndReset() {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.peerMap.endpointForIPPort(ipp); ok {
+		return true
+	}
+	const headerLen = len(disco.Magic) + key.DiscoPublicRawLen
+	if len(b) >= headerLen && string(b[:len(disco.Magic)]) == disco.Magic {
+		sender := key.DiscoPublicFromRaw32(mem.B(b[len(disco.Magic):headerLen]))
+		return c.peerMap.anyEndpointForDiscoKey(sender)
+	}
+	return false
+}
+
+// isDERPMapSTUNAddr reports whether ipp is the address of a STUN
+// server in dm.
+func isDERPMapSTUNAddr(dm *tailcfg.DERPMap, ipp netip.AddrPort) bool {
+	if dm == nil {
+		return false
+	}
+	for _, r := range dm.Regions {
+		for _, n := range r.Nodes {
+			port := n.STUNPort
+			if port == 0 {
+				port = 3478
+			}
+			if port < 0 || uint16(port) != ipp.Port() {
+				continue
+			}
+			for _, s := range []string{n.IPv4, n.IPv6} {
+				if ip, err := netip.ParseAddr(s); err == nil && ip == ipp.Addr().Unmap() {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
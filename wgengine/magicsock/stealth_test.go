@@ -0,0 +1,65 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"net/netip"
+	"testing"
+
+	"tailscale.com/disco"
+	"tailscale.com/net/stun"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+func TestStealthAllows(t *testing.T) {
+	c := &Conn{logf: t.Logf, peerMap: newPeerMap()}
+	c.derpMapAtomic.Store(&tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		1: {RegionID: 1, Nodes: []*tailcfg.DERPNode{
+			{Name: "1a", RegionID: 1, IPv4: "192.0.2.1", IPv6: "2001:db8::1"},
+			{Name: "1b", RegionID: 1, IPv4: "192.0.2.2", STUNPort: 3479},
+			{Name: "1c", RegionID: 1, IPv4: "192.0.2.3", STUNPort: -1},
+		}},
+	}})
+
+	peerDisco := key.NewDisco().Public()
+	de := &endpoint{c: c, publicKey: key.NewNode().Public(), discoKey: peerDisco}
+	c.peerMap.upsertEndpoint(de, key.DiscoPublic{})
+	peerAddr := netip.MustParseAddrPort("203.0.113.5:41641")
+	c.peerMap.setNodeKeyForIPPort(peerAddr, de.publicKey)
+
+	discoMsg := func(k key.DiscoPublic) []byte {
+		raw := k.Raw32()
+		b := append([]byte(disco.Magic), raw[:]...)
+		return append(b, make([]byte, 32)...)
+	}
+	stunResp := stun.Response(stun.NewTxID(), netip.MustParseAddrPort("198.51.100.9:1234"))
+	wgPacket := []byte{4, 0, 0, 0, 1, 2, 3, 4}
+	stranger := netip.MustParseAddrPort("198.51.100.7:41641")
+
+	tests := []struct {
+		name string
+		b    []byte
+		src  netip.AddrPort
+		want bool
+	}{
+		{"peer-data", wgPacket, peerAddr, true},
+		{"stranger-data", wgPacket, stranger, false},
+		{"peer-disco-new-addr", discoMsg(peerDisco), stranger, true},
+		{"stranger-disco", discoMsg(key.NewDisco().Public()), stranger, false},
+		{"stun-server", stunResp, netip.MustParseAddrPort("192.0.2.1:3478"), true},
+		{"stun-server-v6", stunResp, netip.MustParseAddrPort("[2001:db8::1]:3478"), true},
+		{"stun-server-v4mapped", stunResp, netip.MustParseAddrPort("[::ffff:192.0.2.1]:3478"), true},
+		{"stun-server-port", stunResp, netip.MustParseAddrPort("192.0.2.2:3479"), true},
+		{"stun-server-wrong-port", stunResp, netip.MustParseAddrPort("192.0.2.2:3478"), false},
+		{"stun-disabled", stunResp, netip.MustParseAddrPort("192.0.2.3:3478"), false},
+		{"stun-stranger", stunResp, netip.MustParseAddrPort("198.51.100.7:3478"), false},
+	}
+	for _, tt := range tests {
+		if got := c.stealthAllows(tt.b, tt.src, &ippEndpointCache{}); got != tt.want {
+			t.Errorf("%s: stealthAllows = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -17,6 +17,7 @@
 
 	"tailscale.com/net/interfaces"
 	"tailscale.com/types/logger"
+	"tailscale.com/util/clientmetric"
 )
 
 // pollWallTimeInterval is how often we check the time to check
@@ -26,6 +27,39 @@
 // us check the wall time sooner than this.
 const pollWallTimeInterval = 15 * time.Second
 
+// DebounceConfig configures how a Mon coalesces bursts of network
+// change events (for instance from a flapping Docker bridge or a VPN
+// reconnecting) before calling its ChangeFuncs.
+type DebounceConfig struct {
+	// MinInterval is the minimum time between calls to the
+	// ChangeFuncs. If zero, 250ms is used.
+	MinInterval time.Duration
+
+	// Settle, if non-zero, is how long events must stop arriving
+	// before the network state is checked, so a burst of events is
+	// handled once, after it ends. MaxSettle bounds the wait.
+	Settle time.Duration
+
+	// MaxSettle is the longest an event is delayed waiting for the
+	// network to settle. If zero, 10*Settle is used.
+	MaxSettle time.Duration
+
+	// MinorInterval, if non-zero, is the minimum time between calls
+	// to the ChangeFuncs for events that don't change the state of
+	// any interesting interface (calls with changed false). Such
+	// events that come sooner are dropped. Events from InjectEvent
+	// are never dropped.
+	MinorInterval time.Duration
+}
+
+const defaultMinInterval = 250 * time.Millisecond
+
+// defaultDebounce is the DebounceConfig of a new Mon.
+var defaultDebounce = DebounceConfig{
+	MinInterval:   defaultMinInterval,
+	MinorInterval: 2 * time.Second,
+}
+
 // message represents a message returned from an osMon.
 type message interface {
 	// Ignore is whether we should ignore this message.
@@ -54,6 +88,23 @@ type osMon interface {
 // callback.
 type ChangeFunc func(changed bool, state *interfaces.State)
 
+// RouteChange describes a change to the machine's default route.
+type RouteChange struct {
+	// OldInterface and Interface are the names of the default route's
+	// interface before and after the change. Either may be empty.
+	OldInterface, Interface string
+
+	// OldGateway and Gateway are the default gateway before and after
+	// the change. Like interfaces.LikelyHomeRouterIP, only private
+	// IPv4 gateways are detected; others are the zero value.
+	OldGateway, Gateway netip.Addr
+}
+
+// RouteChangeFunc is a callback function that's called when the
+// default route changes, just before the ChangeFuncs are called with
+// changed true.
+type RouteChangeFunc func(*RouteChange)
+
 // An allocated callbackHandle's address is the Mon.cbs map key.
 type callbackHandle byte
 
@@ -67,16 +118,21 @@ type Mon struct {
 	mu         sync.Mutex // guards all following fields
 	cbs        map[*callbackHandle]ChangeFunc
 	ruleDelCB  map[*callbackHandle]RuleDeleteCallback
+	routeCBs   map[*callbackHandle]RouteChangeFunc
 	ifState    *interfaces.State
 	gwValid    bool       // whether gw and gwSelfIP are valid
 	gw         netip.Addr // our gateway's IP
 	gwSelfIP   netip.Addr // our own IP address (that corresponds to gw)
+	routeGW    netip.Addr // default gateway as of the last check, if known
 	started    bool
 	closed     bool
 	goroutines sync.WaitGroup
 	wallTimer  *time.Timer // nil until Started; re-armed AfterFunc per tick
 	lastWall   time.Time
 	timeJumped bool // whether we need to send a changed=true after a big time jump
+	coalesce   DebounceConfig
+	injected   bool      // whether InjectEvent was called since the last check
+	lastMinor  time.Time // when the ChangeFuncs were last called with changed false
 }
 
 // New instantiates and starts a monitoring instance.
@@ -90,12 +146,14 @@ func New(logf logger.Logf) (*Mon, error) {
 		change:   make(chan struct{}, 1),
 		stop:     make(chan struct{}),
 		lastWall: wallTime(),
+		coalesce: defaultDebounce,
 	}
 	st, err := m.interfaceStateUncached()
 	if err != nil {
 		return nil, err
 	}
 	m.ifState = st
+	m.routeGW = defaultGateway()
 
 	m.om, err = newOSMon(logf, m)
 	if err != nil {
@@ -155,6 +213,35 @@ func (m *Mon) RegisterChangeCallback(callback ChangeFunc) (unregister func()) {
 	}
 }
 
+// RegisterRouteChangeCallback adds callback to the set of parties to be
+// notified (in their own goroutine) when the default route's interface
+// or gateway changes.
+// To remove this callback, call unregister (or close the monitor).
+func (m *Mon) RegisterRouteChangeCallback(callback RouteChangeFunc) (unregister func()) {
+	handle := new(callbackHandle)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.routeCBs == nil {
+		m.routeCBs = map[*callbackHandle]RouteChangeFunc{}
+	}
+	m.routeCBs[handle] = callback
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.routeCBs, handle)
+	}
+}
+
+// defaultGateway returns the machine's default gateway, or the zero
+// value if it's unknown. It's a variable for tests.
+var defaultGateway = func() netip.Addr {
+	gw, _, ok := interfaces.LikelyHomeRouterIP()
+	if !ok {
+		return netip.Addr{}
+	}
+	return gw
+}
+
 // RuleDeleteCallback is a callback when a Linux IP policy routing
 // rule is deleted. The table is the table number (52, 253, 354) and
 // priority is the priority order number (for Tailscale rules
@@ -229,11 +316,27 @@ func (m *Mon) Close() error {
 	return err
 }
 
+// SetDebounce sets how the monitor coalesces network change events.
+func (m *Mon) SetDebounce(c DebounceConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.coalesce = c
+}
+
 // InjectEvent forces the monitor to pretend there was a network
 // change and re-check the state of the network. Any registered
 // ChangeFunc callbacks will be called within the event coalescing
-// period (under a fraction of a second).
+// period (under a fraction of a second, unless a longer Settle time
+// is configured).
 func (m *Mon) InjectEvent() {
+	m.mu.Lock()
+	m.injected = true
+	m.mu.Unlock()
+	m.noteEvent()
+}
+
+// noteEvent signals the debounce goroutine that there's been an event.
+func (m *Mon) noteEvent() {
 	select {
 	case m.change <- struct{}{}:
 	default:
@@ -274,7 +377,8 @@ func (m *Mon) pump() {
 		if msg.ignore() {
 			continue
 		}
-		m.InjectEvent()
+		metricEvents.Add(1)
+		m.noteEvent()
 	}
 }
 
@@ -304,13 +408,41 @@ func (m *Mon) debounce() {
 		case <-m.change:
 		}
 
+		m.mu.Lock()
+		cfg := m.coalesce
+		m.mu.Unlock()
+		if cfg.Settle > 0 && !m.settle(cfg) {
+			return
+		}
+
 		if curState, err := m.interfaceStateUncached(); err != nil {
 			m.logf("interfaces.State: %v", err)
 		} else {
+			gw := defaultGateway()
 			m.mu.Lock()
 
 			oldState := m.ifState
 			changed := !curState.EqualFiltered(oldState, m.isInterestingInterface, interfaces.UseInterestingIPs)
+			// A new default route, such as from a changed route
+			// metric or a different gateway on the same interface,
+			// is a major change even if no interface changed. A
+			// gateway that's briefly unknown isn't a change.
+			var rc *RouteChange
+			if oldState.DefaultRouteInterface != curState.DefaultRouteInterface || (gw.IsValid() && gw != m.routeGW) {
+				rc = &RouteChange{
+					OldInterface: oldState.DefaultRouteInterface,
+					Interface:    curState.DefaultRouteInterface,
+					OldGateway:   m.routeGW,
+					Gateway:      gw,
+				}
+				if !changed {
+					m.logf("default route changed (interface %q => %q, gateway %v => %v); synthesizing major change event",
+						rc.OldInterface, rc.Interface, rc.OldGateway, rc.Gateway)
+					changed = true
+				}
+				m.routeGW = gw
+				metricRouteChanges.Add(1)
+			}
 			if changed {
 				m.gwValid = false
 				m.ifState = curState
@@ -330,16 +462,64 @@ func (m *Mon) debounce() {
 					changed = true
 				}
 			}
-			for _, cb := range m.cbs {
-				go cb(changed, m.ifState)
+			injected := m.injected
+			m.injected = false
+			now := time.Now()
+			if !changed && !injected && cfg.MinorInterval > 0 && now.Sub(m.lastMinor) < cfg.MinorInterval {
+				metricMinorSuppressed.Add(1)
+			} else {
+				if !changed {
+					m.lastMinor = now
+				}
+				if rc != nil {
+					for _, cb := range m.routeCBs {
+						go cb(rc)
+					}
+				}
+				for _, cb := range m.cbs {
+					go cb(changed, m.ifState)
+				}
 			}
 			m.mu.Unlock()
 		}
 
+		minInterval := cfg.MinInterval
+		if minInterval <= 0 {
+			minInterval = defaultMinInterval
+		}
 		select {
 		case <-m.stop:
 			return
-		case <-time.After(250 * time.Millisecond):
+		case <-time.After(minInterval):
+		}
+	}
+}
+
+// settle waits until no events have arrived for cfg.Settle, or for
+// at most cfg.MaxSettle. It reports false if the monitor was stopped.
+func (m *Mon) settle(cfg DebounceConfig) bool {
+	maxSettle := cfg.MaxSettle
+	if maxSettle <= 0 {
+		maxSettle = 10 * cfg.Settle
+	}
+	deadline := time.NewTimer(maxSettle)
+	defer deadline.Stop()
+	quiet := time.NewTimer(cfg.Settle)
+	defer quiet.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return false
+		case <-deadline.C:
+			return true
+		case <-quiet.C:
+			return true
+		case <-m.change:
+			metricEventsCoalesced.Add(1)
+			if !quiet.Stop() {
+				<-quiet.C
+			}
+			quiet.Reset(cfg.Settle)
 		}
 	}
 }
@@ -365,7 +545,7 @@ func (m *Mon) pollWallTime() {
 		return
 	}
 	if m.checkWallTimeAdvanceLocked() {
-		m.InjectEvent()
+		m.noteEvent()
 	}
 	m.wallTimer.Reset(pollWallTimeInterval)
 }
@@ -403,3 +583,10 @@ type ipRuleDeletedMessage struct {
 }
 
 func (ipRuleDeletedMessage) ignore() bool { return true }
+
+var (
+	metricEvents          = clientmetric.NewCounter("monitor_events")
+	metricEventsCoalesced = clientmetric.NewCounter("monitor_events_coalesced")
+	metricMinorSuppressed = clientmetric.NewCounter("monitor_minor_changes_suppressed")
+	metricRouteChanges    = clientmetric.NewCounter("monitor_default_route_changes")
+)
@@ -6,6 +6,8 @@
 
 import (
 	"flag"
+	"net/netip"
+	"sync"
 	"testing"
 	"time"
 
@@ -56,6 +58,112 @@ func TestMonitorInjectEvent(t *testing.T) {
 	}
 }
 
+func TestMonitorDebounce(t *testing.T) {
+	mon, err := New(t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mon.Close()
+	got := make(chan bool, 10)
+	mon.RegisterChangeCallback(func(changed bool, state *interfaces.State) {
+		got <- changed
+	})
+	mon.SetDebounce(DebounceConfig{
+		MinInterval:   time.Millisecond,
+		Settle:        50 * time.Millisecond,
+		MinorInterval: time.Hour,
+	})
+	mon.Start()
+
+	wantCalls := func(want int) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for i := 0; i < want; i++ {
+			select {
+			case changed := <-got:
+				if changed {
+					t.Skip("network changed during test")
+				}
+			case <-timeout:
+				t.Fatalf("got %d callbacks; want %d", i, want)
+			}
+		}
+		select {
+		case <-got:
+			t.Fatalf("got more than %d callbacks", want)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+
+	// A burst of events is handled once.
+	for i := 0; i < 5; i++ {
+		mon.noteEvent()
+		time.Sleep(5 * time.Millisecond)
+	}
+	wantCalls(1)
+
+	// Further minor changes within MinorInterval are dropped...
+	suppressed := metricMinorSuppressed.Value()
+	mon.noteEvent()
+	wantCalls(0)
+	if metricMinorSuppressed.Value() == suppressed {
+		t.Errorf("suppressed minor change not counted")
+	}
+
+	// ... unless injected.
+	mon.InjectEvent()
+	wantCalls(1)
+}
+
+func TestMonitorGatewayChange(t *testing.T) {
+	var mu sync.Mutex
+	gw := netip.MustParseAddr("192.168.0.1")
+	old := defaultGateway
+	defaultGateway = func() netip.Addr {
+		mu.Lock()
+		defer mu.Unlock()
+		return gw
+	}
+	defer func() { defaultGateway = old }()
+
+	mon, err := New(t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mon.Close()
+	routeChanged := make(chan *RouteChange, 1)
+	mon.RegisterRouteChangeCallback(func(rc *RouteChange) {
+		routeChanged <- rc
+	})
+	changed := make(chan bool, 1)
+	mon.RegisterChangeCallback(func(c bool, state *interfaces.State) {
+		changed <- c
+	})
+	mon.Start()
+
+	mu.Lock()
+	gw = netip.MustParseAddr("192.168.0.2")
+	mu.Unlock()
+	mon.InjectEvent()
+
+	select {
+	case rc := <-routeChanged:
+		if rc.OldGateway != netip.MustParseAddr("192.168.0.1") || rc.Gateway != netip.MustParseAddr("192.168.0.2") {
+			t.Errorf("got route change %+v", rc)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for route change")
+	}
+	select {
+	case c := <-changed:
+		if !c {
+			t.Error("gateway change wasn't a major change")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for change callback")
+	}
+}
+
 var monitor = flag.String("monitor", "", `go into monitor mode like 'route monitor'; test never terminates. Value can be either "raw" or "callback"`)
 
 func TestMonitorMode(t *testing.T) {
@@ -38,12 +38,14 @@
 	"tailscale.com/envknob"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/net/dns"
+	"tailscale.com/net/dropreason"
 	"tailscale.com/net/netaddr"
 	"tailscale.com/net/packet"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tsdial"
 	"tailscale.com/net/tstun"
 	"tailscale.com/syncs"
+	"tailscale.com/tstime/rate"
 	"tailscale.com/types/ipproto"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
@@ -109,6 +111,7 @@ type Impl struct {
 	ctxCancel context.CancelFunc     // called on Close
 	lb        *ipnlocal.LocalBackend // or nil
 	dns       *dns.Manager
+	lowMemory bool // engine is in low memory mode; see wgengine.Config.LowMemory
 
 	peerapiPort4Atomic uint32 // uint16 port number for IPv4 peerapi
 	peerapiPort6Atomic uint32 // uint16 port number for IPv6 peerapi
@@ -119,6 +122,11 @@ type Impl struct {
 	// updates.
 	atomicIsLocalIPFunc syncs.AtomicValue[func(netip.Addr) bool]
 
+	// atomicSelfAddrs holds the node's Tailscale addresses, used as the
+	// source of the ICMP errors netstack generates. It's changed on
+	// netmap updates.
+	atomicSelfAddrs syncs.AtomicValue[[]netip.Prefix]
+
 	mu sync.Mutex
 	// connsOpenBySubnetIP keeps track of number of connections open
 	// for each subnet IP temporarily registered on netstack for active
@@ -160,7 +168,22 @@ func Create(logf logger.Logf, tundev *tstun.Wrapper, e wgengine.Engine, mc *magi
 		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
 		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
 	})
-	linkEP := channel.New(512, mtu, "")
+	lowMem := wgengine.IsLowMemory(e)
+	linkQueueLen := 512
+	if lowMem {
+		linkQueueLen = 64
+		// Cap TCP buffers well below gVisor's multi-megabyte
+		// auto-tuning maximums; they're per connection.
+		sndOpt := tcpip.TCPSendBufferSizeRangeOption{Min: 4 << 10, Default: 32 << 10, Max: 256 << 10}
+		if tcpipErr := ipstack.SetTransportProtocolOption(tcp.ProtocolNumber, &sndOpt); tcpipErr != nil {
+			return nil, fmt.Errorf("could not set TCP send buffer range: %v", tcpipErr)
+		}
+		rcvOpt := tcpip.TCPReceiveBufferSizeRangeOption{Min: 4 << 10, Default: 32 << 10, Max: 256 << 10}
+		if tcpipErr := ipstack.SetTransportProtocolOption(tcp.ProtocolNumber, &rcvOpt); tcpipErr != nil {
+			return nil, fmt.Errorf("could not set TCP receive buffer range: %v", tcpipErr)
+		}
+	}
+	linkEP := channel.New(linkQueueLen, mtu, "")
 	if tcpipProblem := ipstack.CreateNIC(nicID, linkEP); tcpipProblem != nil {
 		return nil, fmt.Errorf("could not create netstack NIC: %v", tcpipProblem)
 	}
@@ -194,6 +217,7 @@ func Create(logf logger.Logf, tundev *tstun.Wrapper, e wgengine.Engine, mc *magi
 		dialer:              dialer,
 		connsOpenBySubnetIP: make(map[netip.Addr]int),
 		dns:                 dns,
+		lowMemory:           lowMem,
 	}
 	ns.ctx, ns.ctxCancel = context.WithCancel(context.Background())
 	ns.atomicIsLocalIPFunc.Store(tsaddr.NewContainsIPFunc(nil))
@@ -237,7 +261,10 @@ func (ns *Impl) Start() error {
 	ns.e.AddNetworkMapCallback(ns.updateIPs)
 	// size = 0 means use default buffer size
 	const tcpReceiveBufferSize = 0
-	const maxInFlightConnectionAttempts = 16
+	maxInFlightConnectionAttempts := 16
+	if ns.lowMemory {
+		maxInFlightConnectionAttempts = 4
+	}
 	tcpFwd := tcp.NewForwarder(ns.ipstack, tcpReceiveBufferSize, maxInFlightConnectionAttempts, ns.acceptTCP)
 	udpFwd := udp.NewForwarder(ns.ipstack, ns.acceptUDP)
 	ns.ipstack.SetTransportProtocolHandler(tcp.ProtocolNumber, ns.wrapProtoHandler(tcpFwd.HandlePacket))
@@ -295,6 +322,7 @@ func ipPrefixToAddressWithPrefix(ipp netip.Prefix) tcpip.AddressWithPrefix {
 
 func (ns *Impl) updateIPs(nm *netmap.NetworkMap) {
 	ns.atomicIsLocalIPFunc.Store(tsaddr.NewContainsIPFunc(nm.Addresses))
+	ns.atomicSelfAddrs.Store(nm.Addresses)
 
 	oldIPs := make(map[tcpip.AddressWithPrefix]bool)
 	for _, protocolAddr := range ns.ipstack.AllAddresses()[nicID] {
@@ -426,7 +454,12 @@ func (ns *Impl) DialContextTCP(ctx context.Context, ipp netip.AddrPort) (*gonet.
 		ipType = ipv6.ProtocolNumber
 	}
 
-	return gonet.DialContextTCP(ctx, ns.ipstack, remoteAddress, ipType)
+	start := time.Now()
+	c, err := gonet.DialContextTCP(ctx, ns.ipstack, remoteAddress, ipType)
+	if err == nil && ns.mc != nil {
+		ns.mc.RecordTCPConnectLatency(ipp.Addr(), time.Since(start))
+	}
+	return c, err
 }
 
 func (ns *Impl) DialContextUDP(ctx context.Context, ipp netip.AddrPort) (*gonet.UDPConn, error) {
@@ -646,6 +679,69 @@ func (ns *Impl) userPing(dstIP netip.Addr, pingResPkt []byte) {
 	}
 }
 
+// userPingDst returns the IP to ping with userPing to answer an echo
+// request to dstIP, and whether netstack answers it that way: for
+// subnet routes, including 4via6 ones, which are only handled when
+// ProcessSubnets is set.
+func (ns *Impl) userPingDst(dstIP netip.Addr) (pingIP netip.Addr, ok bool) {
+	if !ns.ProcessSubnets {
+		return netip.Addr{}, false
+	}
+	if viaRange.Contains(dstIP) {
+		return tsaddr.UnmapVia(dstIP), true
+	}
+	return dstIP, !tsaddr.IsTailscaleIP(dstIP)
+}
+
+// isRoutedDst reports whether netstack handles packets to ip as a
+// router (for a subnet route, including 4via6) rather than as their
+// final destination.
+func (ns *Impl) isRoutedDst(ip netip.Addr) bool {
+	return ns.ProcessSubnets && !ns.isLocalIP(ip) && !ip.IsMulticast() && ip != magicDNSIP && ip != magicDNSIPv6
+}
+
+// selfAddr returns the node's Tailscale IPv4 or IPv6 address.
+func (ns *Impl) selfAddr(is4 bool) (netip.Addr, bool) {
+	for _, p := range ns.atomicSelfAddrs.Load() {
+		if p.Addr().Is4() == is4 {
+			return p.Addr(), true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// timeExceededBucket limits how many ICMP Time Exceeded errors netstack
+// sends, as kernel routers do.
+var timeExceededBucket = rate.NewLimiter(rate.Every(10*time.Millisecond), 50)
+
+// timeExceeded returns an ICMP Time Exceeded error from src to the
+// sender of p, quoting as much of p as fits in the minimum MTU, per
+// RFC 1812 and RFC 4443.
+func timeExceeded(p *packet.Parsed, src netip.Addr) []byte {
+	quote := p.Buffer()
+	var h packet.Header
+	var maxLen int
+	if p.IPVersion == 4 {
+		h = &packet.ICMP4Header{
+			IP4Header: packet.IP4Header{Src: src, Dst: p.Src.Addr()},
+			Type:      packet.ICMP4TimeExceeded,
+		}
+		maxLen = 576 - 20 - 8
+	} else {
+		h = &packet.ICMP6Header{
+			IP6Header: packet.IP6Header{Src: src, Dst: p.Src.Addr()},
+			Type:      packet.ICMP6TimeExceeded,
+		}
+		maxLen = 1280 - 40 - 8
+	}
+	if len(quote) > maxLen {
+		quote = quote[:maxLen]
+	}
+	payload := make([]byte, 4+len(quote)) // 4 unused bytes, then the quote
+	copy(payload[4:], quote)
+	return packet.Generate(h, payload)
+}
+
 func (ns *Impl) isInboundTSSH(p *packet.Parsed) bool {
 	return p.IPProto == ipproto.TCP &&
 		p.Dst.Port() == 22 &&
@@ -664,7 +760,20 @@ func (ns *Impl) injectInbound(p *packet.Parsed, t *tstun.Wrapper) filter.Respons
 	}
 
 	destIP := p.Dst.Addr()
-	if p.IsEchoRequest() && ns.ProcessSubnets && !tsaddr.IsTailscaleIP(destIP) {
+	if p.TTL() <= 1 && ns.isRoutedDst(destIP) && !p.IsError() {
+		// A kernel router would drop this packet rather than forward
+		// it; do the same and tell the sender, so traceroute through
+		// a userspace subnet router shows this node as a hop.
+		if src, ok := ns.selfAddr(destIP.Is4()); ok && timeExceededBucket.Allow() {
+			if err := ns.tundev.InjectOutbound(timeExceeded(p, src)); err != nil {
+				ns.logf("InjectOutbound time exceeded: %v", err)
+			}
+		}
+		dropreason.Count(dropreason.TTLExceeded)
+		return filter.DropSilently
+	}
+
+	if pingIP, ok := ns.userPingDst(destIP); ok && p.IsEchoRequest() {
 		var pong []byte // the reply to the ping, if our relayed ping works
 		if destIP.Is4() {
 			h := p.ICMP4Header()
@@ -675,7 +784,7 @@ func (ns *Impl) injectInbound(p *packet.Parsed, t *tstun.Wrapper) filter.Respons
 			h.ToResponse()
 			pong = packet.Generate(&h, p.Payload())
 		}
-		go ns.userPing(destIP, pong)
+		go ns.userPing(pingIP, pong)
 		return filter.DropSilently
 	}
 
@@ -10,6 +10,8 @@
 	"testing"
 
 	"gvisor.dev/gvisor/pkg/refs"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
 	"tailscale.com/net/packet"
 	"tailscale.com/net/tsdial"
 	"tailscale.com/net/tstun"
@@ -84,3 +86,132 @@ func TestNetstackLeakMode(t *testing.T) {
 		t.Fatalf("refs.leakMode is 0, want a non-zero value")
 	}
 }
+
+func TestTimeExceeded(t *testing.T) {
+	self4 := netip.MustParseAddr("100.64.0.1")
+	self6 := netip.MustParseAddr("fd7a:115c:a1e0::1")
+	peer4 := netip.MustParseAddr("100.64.0.2")
+	peer6 := netip.MustParseAddr("fd7a:115c:a1e0::2")
+	tests := []struct {
+		name     string
+		hdr      packet.Header
+		self     netip.Addr
+		peer     netip.Addr
+		wantType uint8
+	}{
+		{
+			name: "udp4",
+			hdr: &packet.UDP4Header{
+				IP4Header: packet.IP4Header{Src: peer4, Dst: netip.MustParseAddr("192.168.1.5")},
+				SrcPort:   33434,
+				DstPort:   33434,
+			},
+			self:     self4,
+			peer:     peer4,
+			wantType: uint8(packet.ICMP4TimeExceeded),
+		},
+		{
+			name: "icmp6",
+			hdr: &packet.ICMP6Header{
+				IP6Header: packet.IP6Header{Src: peer6, Dst: netip.MustParseAddr("fd7a:115c:a1e0:b1a:0:7:c0a8:105")},
+				Type:      packet.ICMP6EchoRequest,
+			},
+			self:     self6,
+			peer:     peer6,
+			wantType: uint8(packet.ICMP6TimeExceeded),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var orig packet.Parsed
+			orig.Decode(packet.Generate(tt.hdr, make([]byte, 2000)))
+
+			var got packet.Parsed
+			got.Decode(timeExceeded(&orig, tt.self))
+			if got.Src.Addr() != tt.self || got.Dst.Addr() != tt.peer {
+				t.Errorf("got %v -> %v; want %v -> %v", got.Src.Addr(), got.Dst.Addr(), tt.self, tt.peer)
+			}
+			if !got.IsError() {
+				t.Fatalf("not an ICMP error: %v", got)
+			}
+			tr := got.Transport()
+			if tr[0] != tt.wantType {
+				t.Errorf("ICMP type = %d; want %d", tr[0], tt.wantType)
+			}
+			if quote := tr[8:]; string(quote) != string(orig.Buffer()[:len(quote)]) {
+				t.Error("quoted packet doesn't match original")
+			}
+			if n := len(got.Buffer()); n > 1280 {
+				t.Errorf("error is %d bytes; want at most the minimum MTU", n)
+			}
+		})
+	}
+}
+
+func TestLowMemory(t *testing.T) {
+	for _, lowMem := range []bool{false, true} {
+		dialer := new(tsdial.Dialer)
+		eng, err := wgengine.NewUserspaceEngine(t.Logf, wgengine.Config{
+			Tun:       tstun.NewFake(),
+			Dialer:    dialer,
+			LowMemory: lowMem,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer eng.Close()
+		tunWrap, magicSock, dns, ok := eng.(wgengine.InternalsGetter).GetInternals()
+		if !ok {
+			t.Fatal("failed to get internals")
+		}
+		ns, err := Create(t.Logf, tunWrap, eng, magicSock, dialer, dns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ns.Close()
+		if ns.lowMemory != lowMem {
+			t.Errorf("lowMemory = %v; want %v", ns.lowMemory, lowMem)
+		}
+		var snd tcpip.TCPSendBufferSizeRangeOption
+		if err := ns.ipstack.TransportProtocolOption(tcp.ProtocolNumber, &snd); err != nil {
+			t.Fatal(err)
+		}
+		var rcv tcpip.TCPReceiveBufferSizeRangeOption
+		if err := ns.ipstack.TransportProtocolOption(tcp.ProtocolNumber, &rcv); err != nil {
+			t.Fatal(err)
+		}
+		if small := snd.Max <= 256<<10 && rcv.Max <= 256<<10; small != lowMem {
+			t.Errorf("lowMem=%v: TCP buffer maximums are %d and %d", lowMem, snd.Max, rcv.Max)
+		}
+	}
+}
+
+func TestUserPingDst(t *testing.T) {
+	subnet := netip.MustParseAddr("192.168.1.5")
+	via := netip.MustParseAddr("fd7a:115c:a1e0:b1a:0:7:c0a8:105")
+	peer := netip.MustParseAddr("100.64.0.2")
+	tests := []struct {
+		name           string
+		processSubnets bool
+		dst            netip.Addr
+		want           netip.Addr // or zero, if not answered with userPing
+	}{
+		{"subnet", true, subnet, subnet},
+		{"via", true, via, subnet},
+		{"tailscale_ip", true, peer, netip.Addr{}},
+		{"subnet_not_processed", false, subnet, netip.Addr{}},
+		{"via_not_processed", false, via, netip.Addr{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns := &Impl{ProcessSubnets: tt.processSubnets}
+			got, ok := ns.userPingDst(tt.dst)
+			if !ok {
+				got = netip.Addr{}
+			}
+			if got != tt.want {
+				t.Errorf("userPingDst(%v) = %v, %v; want %v", tt.dst, got, ok, tt.want)
+			}
+		})
+	}
+}
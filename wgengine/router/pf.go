@@ -0,0 +1,124 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"fmt"
+	"strings"
+
+	"tailscale.com/net/tsaddr"
+)
+
+// pfAnchor is the name of the pf(4) anchor that the FreeBSD and OpenBSD
+// routers load their rules into. The admin's main ruleset must reference
+// it (see pfMissingHooks) for the rules to be evaluated.
+const pfAnchor = "tailscale"
+
+// pfRules returns the pf.conf(5) ruleset to load into pfAnchor for cfg.
+//
+// goos selects the rule dialect: OpenBSD uses match/nat-to rules, while
+// FreeBSD still uses the older separate nat rules. egressIf is the
+// interface that subnet and exit node traffic leaves through; it's
+// ignored on OpenBSD, which has the built-in "egress" interface group.
+// If egressIf is empty on FreeBSD, no NAT rules are generated.
+func pfRules(goos, tunname, egressIf string, cfg *Config) string {
+	var sb strings.Builder
+	sb.WriteString("# Managed by tailscaled; changes will be overwritten.\n")
+
+	if wantPFNAT(cfg) {
+		cgnat := tsaddr.CGNATRange()
+		ula := tsaddr.TailscaleULARange()
+		switch goos {
+		case "openbsd":
+			fmt.Fprintf(&sb, "match out on egress inet from %v to !%v nat-to (egress:0)\n", cgnat, cgnat)
+			fmt.Fprintf(&sb, "match out on egress inet6 from %v to !%v nat-to (egress:0)\n", ula, ula)
+		default:
+			if egressIf != "" {
+				fmt.Fprintf(&sb, "nat on %s inet from %v to !%v -> (%s:0)\n", egressIf, cgnat, cgnat, egressIf)
+				fmt.Fprintf(&sb, "nat on %s inet6 from %v to !%v -> (%s:0)\n", egressIf, ula, ula, egressIf)
+			}
+		}
+	}
+
+	// Traffic on the tailscale interface has already been filtered by
+	// tailscaled's own packet filter, so let it through regardless of
+	// the host's default block policy.
+	fmt.Fprintf(&sb, "pass in quick on %s all\n", tunname)
+	fmt.Fprintf(&sb, "pass out quick on %s all\n", tunname)
+
+	// With inbound shields, block everything else coming in, except
+	// what DHCP and IPv6 neighbor discovery need. Replies to
+	// connections this machine made match pf's state table before
+	// any rules are evaluated, so they still get through.
+	if cfg.InboundShields {
+		sb.WriteString("pass in quick on lo0 all\n")
+		sb.WriteString("pass in quick inet proto udp from port 67 to port 68\n")
+		sb.WriteString("pass in quick inet6 proto ipv6-icmp all\n")
+		sb.WriteString("pass in quick inet6 proto udp from port 547 to port 546\n")
+		if cfg.InboundUDPPort != 0 {
+			fmt.Fprintf(&sb, "pass in quick proto udp to port %d\n", cfg.InboundUDPPort)
+		}
+		for _, p := range cfg.InboundAllowed {
+			fmt.Fprintf(&sb, "pass in quick from %v\n", p)
+		}
+		sb.WriteString("block in quick all\n")
+	}
+	return sb.String()
+}
+
+// wantPFNAT reports whether cfg requires NAT of forwarded traffic,
+// which is the case when we advertise subnet routes (including exit
+// node default routes) with SNAT enabled.
+func wantPFNAT(cfg *Config) bool {
+	return cfg.SNATSubnetRoutes && len(cfg.SubnetRoutes) > 0
+}
+
+// pfMissingHooks returns the anchor hook lines that are missing from the
+// main pf ruleset mainRules (as printed by "pfctl -s rules" and, on
+// FreeBSD, "pfctl -s nat"). Rules loaded into pfAnchor are ignored by pf
+// unless the main ruleset references the anchor.
+func pfMissingHooks(goos, mainRules string, wantNAT bool) []string {
+	var haveAnchor, haveNATAnchor bool
+	quoted := fmt.Sprintf("%q", pfAnchor)
+	for _, line := range strings.Split(mainRules, "\n") {
+		f := strings.Fields(line)
+		if len(f) < 2 || f[1] != quoted {
+			continue
+		}
+		switch f[0] {
+		case "anchor":
+			haveAnchor = true
+		case "nat-anchor":
+			haveNATAnchor = true
+		}
+	}
+	var missing []string
+	if !haveAnchor {
+		missing = append(missing, "anchor "+quoted)
+	}
+	if wantNAT && goos != "openbsd" && !haveNATAnchor {
+		missing = append(missing, "nat-anchor "+quoted)
+	}
+	return missing
+}
+
+// pfConflicts returns the lines of the main pf ruleset mainRules that
+// translate traffic from the Tailscale CGNAT range outside of pfAnchor.
+// Such rules predate pfAnchor (hand-written pf.conf NAT for subnet
+// routers) and would shadow or duplicate the managed ones.
+func pfConflicts(mainRules string) []string {
+	cgnat := tsaddr.CGNATRange().String()
+	var conflicts []string
+	for _, line := range strings.Split(mainRules, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.Contains(line, cgnat) {
+			continue
+		}
+		if strings.HasPrefix(line, "nat ") || strings.Contains(line, " nat-to ") {
+			conflicts = append(conflicts, line)
+		}
+	}
+	return conflicts
+}
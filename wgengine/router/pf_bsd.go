@@ -0,0 +1,109 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build freebsd || openbsd
+// +build freebsd openbsd
+
+package router
+
+import (
+	"runtime"
+	"strings"
+
+	"tailscale.com/net/interfaces"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/preftype"
+)
+
+// pfManager keeps the rules in pfAnchor in sync with the router config.
+type pfManager struct {
+	logf    logger.Logf
+	tunname string
+
+	loaded    string // ruleset currently loaded into the anchor, or empty
+	lastWarns string // last hook/conflict warning logged, to avoid spam
+}
+
+func newPFManager(logf logger.Logf, tunname string) *pfManager {
+	return &pfManager{logf: logf, tunname: tunname}
+}
+
+// set loads the rules for cfg into pfAnchor, or flushes the anchor if
+// cfg disables netfilter management.
+//
+// Failures are logged rather than returned: pf is optional on the BSDs
+// and many hosts don't have it loaded, which mustn't break routing.
+func (m *pfManager) set(cfg *Config) {
+	if cfg.NetfilterMode == preftype.NetfilterOff {
+		m.flush()
+		return
+	}
+	var egressIf string
+	if runtime.GOOS != "openbsd" && wantPFNAT(cfg) {
+		var err error
+		egressIf, err = interfaces.DefaultRouteInterface()
+		if err != nil {
+			m.logf("pf: no default route interface; skipping NAT rules: %v", err)
+		}
+	}
+	rules := pfRules(runtime.GOOS, m.tunname, egressIf, cfg)
+	if rules != m.loaded {
+		c := cmd("pfctl", "-a", pfAnchor, "-f", "-")
+		c.Stdin = strings.NewReader(rules)
+		if out, err := c.CombinedOutput(); err != nil {
+			m.logf("pf: loading anchor %q failed: %v\n%s", pfAnchor, err, out)
+			return
+		}
+		m.loaded = rules
+	}
+	m.checkMainRuleset(wantPFNAT(cfg))
+}
+
+// checkMainRuleset logs a warning if the main pf ruleset doesn't
+// reference pfAnchor, or has its own NAT rules for Tailscale traffic.
+func (m *pfManager) checkMainRuleset(wantNAT bool) {
+	var main strings.Builder
+	for _, what := range []string{"rules", "nat"} {
+		if what == "nat" && runtime.GOOS == "openbsd" {
+			// OpenBSD's nat-to rules are part of the filter ruleset.
+			continue
+		}
+		out, err := cmd("pfctl", "-s", what).Output()
+		if err != nil {
+			m.logf("pf: pfctl -s %s: %v", what, err)
+			return
+		}
+		main.Write(out)
+	}
+	var warns []string
+	for _, hook := range pfMissingHooks(runtime.GOOS, main.String(), wantNAT) {
+		warns = append(warns, "main ruleset is missing \""+hook+"\"; add it to /etc/pf.conf")
+	}
+	for _, line := range pfConflicts(main.String()) {
+		warns = append(warns, "main ruleset rule conflicts with anchor \""+pfAnchor+"\": "+line)
+	}
+	joined := strings.Join(warns, "\n")
+	if joined == m.lastWarns {
+		return
+	}
+	m.lastWarns = joined
+	for _, w := range warns {
+		m.logf("pf: %s", w)
+	}
+}
+
+// flush removes all rules from pfAnchor.
+func (m *pfManager) flush() {
+	if m.loaded == "" {
+		return
+	}
+	flushPFAnchor(m.logf)
+	m.loaded = ""
+}
+
+func flushPFAnchor(logf logger.Logf) {
+	if out, err := cmd("pfctl", "-a", pfAnchor, "-F", "all").CombinedOutput(); err != nil {
+		logf("pf: flushing anchor %q failed: %v\n%s", pfAnchor, err, out)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPFRules(t *testing.T) {
+	exitNode := &Config{
+		SubnetRoutes:     mustCIDRs("0.0.0.0/0", "::/0"),
+		SNATSubnetRoutes: true,
+	}
+	tests := []struct {
+		name     string
+		goos     string
+		egressIf string
+		cfg      *Config
+		want     string
+	}{
+		{
+			name: "no_routes",
+			goos: "freebsd",
+			cfg:  &Config{SNATSubnetRoutes: true},
+			want: `# Managed by tailscaled; changes will be overwritten.
+pass in quick on tailscale0 all
+pass out quick on tailscale0 all
+`,
+		},
+		{
+			name:     "freebsd_exit_node",
+			goos:     "freebsd",
+			egressIf: "em0",
+			cfg:      exitNode,
+			want: `# Managed by tailscaled; changes will be overwritten.
+nat on em0 inet from 100.64.0.0/10 to !100.64.0.0/10 -> (em0:0)
+nat on em0 inet6 from fd7a:115c:a1e0::/48 to !fd7a:115c:a1e0::/48 -> (em0:0)
+pass in quick on tailscale0 all
+pass out quick on tailscale0 all
+`,
+		},
+		{
+			name: "freebsd_no_egress",
+			goos: "freebsd",
+			cfg:  exitNode,
+			want: `# Managed by tailscaled; changes will be overwritten.
+pass in quick on tailscale0 all
+pass out quick on tailscale0 all
+`,
+		},
+		{
+			name: "openbsd_subnet_router",
+			goos: "openbsd",
+			cfg: &Config{
+				SubnetRoutes:     mustCIDRs("192.168.1.0/24"),
+				SNATSubnetRoutes: true,
+			},
+			want: `# Managed by tailscaled; changes will be overwritten.
+match out on egress inet from 100.64.0.0/10 to !100.64.0.0/10 nat-to (egress:0)
+match out on egress inet6 from fd7a:115c:a1e0::/48 to !fd7a:115c:a1e0::/48 nat-to (egress:0)
+pass in quick on tailscale0 all
+pass out quick on tailscale0 all
+`,
+		},
+		{
+			name:     "no_snat",
+			goos:     "freebsd",
+			egressIf: "em0",
+			cfg:      &Config{SubnetRoutes: mustCIDRs("192.168.1.0/24")},
+			want: `# Managed by tailscaled; changes will be overwritten.
+pass in quick on tailscale0 all
+pass out quick on tailscale0 all
+`,
+		},
+		{
+			name: "inbound_shields",
+			goos: "openbsd",
+			cfg: &Config{
+				InboundShields: true,
+				InboundAllowed: mustCIDRs("192.168.1.0/24", "fd00::/64"),
+				InboundUDPPort: 41641,
+			},
+			want: `# Managed by tailscaled; changes will be overwritten.
+pass in quick on tailscale0 all
+pass out quick on tailscale0 all
+pass in quick on lo0 all
+pass in quick inet proto udp from port 67 to port 68
+pass in quick inet6 proto ipv6-icmp all
+pass in quick inet6 proto udp from port 547 to port 546
+pass in quick proto udp to port 41641
+pass in quick from 192.168.1.0/24
+pass in quick from fd00::/64
+block in quick all
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := pfRules(tt.goos, "tailscale0", tt.egressIf, tt.cfg)
+			if got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPFMissingHooks(t *testing.T) {
+	tests := []struct {
+		name    string
+		goos    string
+		main    string
+		wantNAT bool
+		want    []string
+	}{
+		{
+			name:    "empty",
+			goos:    "freebsd",
+			wantNAT: true,
+			want:    []string{`anchor "tailscale"`, `nat-anchor "tailscale"`},
+		},
+		{
+			name: "nat_anchor_only",
+			goos: "freebsd",
+			main: `nat-anchor "tailscale" all
+pass all flags S/SA keep state`,
+			want: []string{`anchor "tailscale"`},
+		},
+		{
+			name: "freebsd_complete",
+			goos: "freebsd",
+			main: `nat-anchor "tailscale" all
+anchor "tailscale" all
+block drop in all`,
+			wantNAT: true,
+		},
+		{
+			name:    "openbsd_no_nat_anchor_needed",
+			goos:    "openbsd",
+			main:    `anchor "tailscale" all`,
+			wantNAT: true,
+		},
+		{
+			name: "other_anchor",
+			goos: "openbsd",
+			main: `anchor "tailscale-other" all`,
+			want: []string{`anchor "tailscale"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := pfMissingHooks(tt.goos, tt.main, tt.wantNAT)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPFConflicts(t *testing.T) {
+	main := `nat-anchor "tailscale" all
+nat on em0 inet from 100.64.0.0/10 to any -> (em0) round-robin
+nat on em0 inet from 10.0.0.0/8 to any -> (em0) round-robin
+match out on egress inet from 100.64.0.0/10 to any nat-to (egress:0)
+pass in quick on tailscale0 inet from 100.64.0.0/10 to any`
+	got := pfConflicts(main)
+	want := []string{
+		"nat on em0 inet from 100.64.0.0/10 to any -> (em0) round-robin",
+		"match out on egress inet from 100.64.0.0/10 to any nat-to (egress:0)",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
@@ -68,10 +68,21 @@ type Config struct {
 	// routing rules apply.
 	LocalRoutes []netip.Prefix
 
-	// Linux-only things below, ignored on other platforms.
+	// Linux, FreeBSD and OpenBSD only things below, ignored on other platforms.
+	// (On the BSDs, they determine the rules in the pf anchor.)
 	SubnetRoutes     []netip.Prefix         // subnets being advertised to other Tailscale nodes
 	SNATSubnetRoutes bool                   // SNAT traffic to local subnets
 	NetfilterMode    preftype.NetfilterMode // how much to manage netfilter rules
+
+	// InboundShields, if true, blocks incoming connections that don't
+	// come over Tailscale, other than from InboundAllowed and to
+	// InboundUDPPort. Replies to connections this machine makes are
+	// still allowed. It's ignored if NetfilterMode is off, and isn't
+	// enforced on Linux if NetfilterMode is NetfilterNoDivert, as the
+	// rules are in the ts-input chain, which isn't jumped to then.
+	InboundShields bool
+	InboundAllowed []netip.Prefix // sources allowed in by InboundShields
+	InboundUDPPort uint16         // WireGuard port allowed in by InboundShields, if non-zero; set by the engine
 }
 
 func (a *Config) Equal(b *Config) bool {
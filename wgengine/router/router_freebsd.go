@@ -15,8 +15,37 @@
 // Work is currently underway for an in-kernel FreeBSD implementation of wireguard
 // https://svnweb.freebsd.org/base?view=revision&revision=357986
 
+// freebsdRouter is the userspace BSD router plus management of the
+// pf anchor used for subnet router and exit node NAT.
+type freebsdRouter struct {
+	Router
+	pf *pfManager
+}
+
 func newUserspaceRouter(logf logger.Logf, tundev tun.Device, linkMon *monitor.Mon) (Router, error) {
-	return newUserspaceBSDRouter(logf, tundev, linkMon)
+	r, err := newUserspaceBSDRouter(logf, tundev, linkMon)
+	if err != nil {
+		return nil, err
+	}
+	tunname, err := tundev.Name()
+	if err != nil {
+		return nil, err
+	}
+	return &freebsdRouter{Router: r, pf: newPFManager(logf, tunname)}, nil
+}
+
+func (r *freebsdRouter) Set(cfg *Config) error {
+	if cfg == nil {
+		cfg = &shutdownConfig
+	}
+	err := r.Router.Set(cfg)
+	r.pf.set(cfg)
+	return err
+}
+
+func (r *freebsdRouter) Close() error {
+	r.pf.flush()
+	return r.Router.Close()
 }
 
 func cleanup(logf logger.Logf, interfaceName string) {
@@ -28,4 +57,5 @@ func cleanup(logf logger.Logf, interfaceName string) {
 	if out, err := cmd(ifup...).CombinedOutput(); err != nil {
 		logf("ifconfig destroy: %v\n%s", err, out)
 	}
+	flushPFAnchor(logf)
 }
@@ -93,6 +93,7 @@ type linuxRouter struct {
 	routes           map[netip.Prefix]bool
 	localRoutes      map[netip.Prefix]bool
 	snatSubnetRoutes bool
+	shields          *inboundShields // nil if off
 	netfilterMode    preftype.NetfilterMode
 
 	// ruleRestorePending is whether a timer has been started to
@@ -325,13 +326,24 @@ func (r *linuxRouter) Set(cfg *Config) error {
 	}
 	r.snatSubnetRoutes = cfg.SNATSubnetRoutes
 
+	var shields *inboundShields
+	if cfg.InboundShields {
+		shields = &inboundShields{allowed: cfg.InboundAllowed, udpPort: cfg.InboundUDPPort}
+	}
+	if !shields.equal(r.shields) {
+		if err := r.setShieldsRules(shields); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
 	return multierr.New(errs...)
 }
 
 // setNetfilterMode switches the router to the given netfilter
 // mode. Netfilter state is created or deleted appropriately to
-// reflect the new mode, and r.snatSubnetRoutes is updated to reflect
-// the current state of subnet SNATing.
+// reflect the new mode, and r.snatSubnetRoutes and r.shields are
+// updated to reflect the current state of subnet SNATing and inbound
+// shields.
 func (r *linuxRouter) setNetfilterMode(mode preftype.NetfilterMode) error {
 	if distro.Get() == distro.Synology {
 		mode = netfilterOff
@@ -377,6 +389,7 @@ func (r *linuxRouter) setNetfilterMode(mode preftype.NetfilterMode) error {
 			}
 		}
 		r.snatSubnetRoutes = false
+		r.shields = nil
 	case netfilterNoDivert:
 		switch r.netfilterMode {
 		case netfilterOff:
@@ -388,6 +401,7 @@ func (r *linuxRouter) setNetfilterMode(mode preftype.NetfilterMode) error {
 				return err
 			}
 			r.snatSubnetRoutes = false
+			r.shields = nil
 		case netfilterOn:
 			if err := r.delNetfilterHooks(); err != nil {
 				return err
@@ -416,6 +430,7 @@ func (r *linuxRouter) setNetfilterMode(mode preftype.NetfilterMode) error {
 				return err
 			}
 			r.snatSubnetRoutes = false
+			r.shields = nil
 		case netfilterNoDivert:
 			reprocess = true
 			if err := r.delNetfilterBase(); err != nil {
@@ -428,6 +443,7 @@ func (r *linuxRouter) setNetfilterMode(mode preftype.NetfilterMode) error {
 				return err
 			}
 			r.snatSubnetRoutes = false
+			r.shields = nil
 		}
 	default:
 		panic("unhandled netfilter mode")
@@ -1374,6 +1390,103 @@ func (r *linuxRouter) delSNATRule() error {
 	return nil
 }
 
+// inboundShields is the state of the netfilter rules for
+// Config.InboundShields.
+type inboundShields struct {
+	allowed []netip.Prefix
+	udpPort uint16
+}
+
+func (s *inboundShields) equal(o *inboundShields) bool {
+	if s == nil || o == nil {
+		return s == o
+	}
+	if s.udpPort != o.udpPort || len(s.allowed) != len(o.allowed) {
+		return false
+	}
+	for i, p := range s.allowed {
+		if o.allowed[i] != p {
+			return false
+		}
+	}
+	return true
+}
+
+// shieldsRules returns the ts-input rules that implement s for IPv4
+// or, if v6, IPv6. They're appended after the base rules, so
+// traffic from the Tailscale interface, loopback, and replies to
+// connections this machine made return to the INPUT chain, as does
+// what's needed for DHCP and IPv6 neighbor discovery to keep working;
+// everything else not allowed by s is dropped.
+func (r *linuxRouter) shieldsRules(s *inboundShields, v6 bool) [][]string {
+	rules := [][]string{
+		{"-i", r.tunname, "-j", "RETURN"},
+		{"-i", "lo", "-j", "RETURN"},
+		{"-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "RETURN"},
+	}
+	if v6 {
+		rules = append(rules,
+			[]string{"-p", "ipv6-icmp", "-j", "RETURN"},
+			[]string{"-p", "udp", "--sport", "547", "--dport", "546", "-j", "RETURN"},
+		)
+	} else {
+		rules = append(rules, []string{"-p", "udp", "--sport", "67", "--dport", "68", "-j", "RETURN"})
+	}
+	if s.udpPort != 0 {
+		rules = append(rules, []string{"-p", "udp", "--dport", strconv.Itoa(int(s.udpPort)), "-j", "RETURN"})
+	}
+	for _, p := range s.allowed {
+		if p.Addr().Is6() == v6 {
+			rules = append(rules, []string{"-s", p.String(), "-j", "RETURN"})
+		}
+	}
+	return append(rules, []string{"-j", "DROP"})
+}
+
+// setShieldsRules replaces the netfilter rules for r.shields with
+// those for s, which is nil to remove them.
+func (r *linuxRouter) setShieldsRules(s *inboundShields) error {
+	if r.netfilterMode == netfilterOff {
+		r.shields = nil
+		return nil
+	}
+	type family struct {
+		name string
+		ipt  netfilterRunner
+		v6   bool
+	}
+	fams := []family{{"v4", r.ipt4, false}}
+	if r.v6Available {
+		fams = append(fams, family{"v6", r.ipt6, true})
+	}
+	var errs []error
+	if r.shields != nil {
+		// Keep going on errors, as a failed Append below may have
+		// left only some of the old rules in place.
+		for _, f := range fams {
+			for _, args := range r.shieldsRules(r.shields, f.v6) {
+				if err := f.ipt.Delete("filter", "ts-input", args...); err != nil {
+					errs = append(errs, fmt.Errorf("deleting %v in %s/filter/ts-input: %w", args, f.name, err))
+				}
+			}
+		}
+		r.shields = nil
+	}
+	if s == nil {
+		return multierr.New(errs...)
+	}
+	r.shields = s
+	for _, f := range fams {
+		for _, args := range r.shieldsRules(s, f.v6) {
+			if err := f.ipt.Append("filter", "ts-input", args...); err != nil {
+				errs = append(errs, fmt.Errorf("adding %v in %s/filter/ts-input: %w", args, f.name, err))
+				return multierr.New(errs...)
+			}
+		}
+	}
+	return multierr.New(errs...)
+}
+
 // cidrDiff calls add and del as needed to make the set of prefixes in
 // old and new match. Returns a map reflecting the actual new state
 // (which may be somewhere in between old and new if some commands
@@ -150,6 +150,55 @@ func TestRouterStates(t *testing.T) {
 `,
 		},
 
+		{
+			name: "addr and routes with netfilter and inbound shields",
+			in: &Config{
+				LocalAddrs:     mustCIDRs("100.101.102.104/10"),
+				Routes:         mustCIDRs("100.100.100.100/32", "10.0.0.0/8"),
+				NetfilterMode:  netfilterOn,
+				InboundShields: true,
+				InboundAllowed: mustCIDRs("192.168.1.0/24", "fd00::/64"),
+				InboundUDPPort: 41641,
+			},
+			want: `
+up
+ip addr add 100.101.102.104/10 dev tailscale0
+ip route add 10.0.0.0/8 dev tailscale0 table 52
+ip route add 100.100.100.100/32 dev tailscale0 table 52` + basic +
+				`v4/filter/FORWARD -j ts-forward
+v4/filter/INPUT -j ts-input
+v4/filter/ts-forward -i tailscale0 -j MARK --set-mark 0x40000
+v4/filter/ts-forward -m mark --mark 0x40000 -j ACCEPT
+v4/filter/ts-forward -o tailscale0 -s 100.64.0.0/10 -j DROP
+v4/filter/ts-forward -o tailscale0 -j ACCEPT
+v4/filter/ts-input -i lo -s 100.101.102.104 -j ACCEPT
+v4/filter/ts-input ! -i tailscale0 -s 100.115.92.0/23 -j RETURN
+v4/filter/ts-input ! -i tailscale0 -s 100.64.0.0/10 -j DROP
+v4/filter/ts-input -i tailscale0 -j RETURN
+v4/filter/ts-input -i lo -j RETURN
+v4/filter/ts-input -m conntrack --ctstate ESTABLISHED,RELATED -j RETURN
+v4/filter/ts-input -p udp --sport 67 --dport 68 -j RETURN
+v4/filter/ts-input -p udp --dport 41641 -j RETURN
+v4/filter/ts-input -s 192.168.1.0/24 -j RETURN
+v4/filter/ts-input -j DROP
+v4/nat/POSTROUTING -j ts-postrouting
+v6/filter/FORWARD -j ts-forward
+v6/filter/INPUT -j ts-input
+v6/filter/ts-forward -i tailscale0 -j MARK --set-mark 0x40000
+v6/filter/ts-forward -m mark --mark 0x40000 -j ACCEPT
+v6/filter/ts-forward -o tailscale0 -j ACCEPT
+v6/filter/ts-input -i tailscale0 -j RETURN
+v6/filter/ts-input -i lo -j RETURN
+v6/filter/ts-input -m conntrack --ctstate ESTABLISHED,RELATED -j RETURN
+v6/filter/ts-input -p ipv6-icmp -j RETURN
+v6/filter/ts-input -p udp --sport 547 --dport 546 -j RETURN
+v6/filter/ts-input -p udp --dport 41641 -j RETURN
+v6/filter/ts-input -s fd00::/64 -j RETURN
+v6/filter/ts-input -j DROP
+v6/nat/POSTROUTING -j ts-postrouting
+`,
+		},
+
 		{
 			name: "addr and routes and subnet routes with netfilter but no SNAT",
 			in: &Config{
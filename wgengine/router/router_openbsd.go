@@ -28,6 +28,7 @@ type openbsdRouter struct {
 	local4  netip.Prefix
 	local6  netip.Prefix
 	routes  map[netip.Prefix]struct{}
+	pf      *pfManager
 }
 
 func newUserspaceRouter(logf logger.Logf, tundev tun.Device, linkMon *monitor.Mon) (Router, error) {
@@ -40,6 +41,7 @@ func newUserspaceRouter(logf logger.Logf, tundev tun.Device, linkMon *monitor.Mo
 		logf:    logf,
 		linkMon: linkMon,
 		tunname: tunname,
+		pf:      newPFManager(logf, tunname),
 	}, nil
 }
 
@@ -225,10 +227,13 @@ func (r *openbsdRouter) Set(cfg *Config) error {
 	r.local6 = localAddr6
 	r.routes = newRoutes
 
+	r.pf.set(cfg)
+
 	return errq
 }
 
 func (r *openbsdRouter) Close() error {
+	r.pf.flush()
 	cleanup(r.logf, r.tunname)
 	return nil
 }
@@ -238,4 +243,5 @@ func cleanup(logf logger.Logf, interfaceName string) {
 	if err != nil {
 		logf("ifconfig down: %v\n%s", err, out)
 	}
+	flushPFAnchor(logf)
 }
@@ -24,6 +24,7 @@ func TestConfigEqual(t *testing.T) {
 	testedFields := []string{
 		"LocalAddrs", "Routes", "LocalRoutes", "SubnetRoutes",
 		"SNATSubnetRoutes", "NetfilterMode",
+		"InboundShields", "InboundAllowed", "InboundUDPPort",
 	}
 	configType := reflect.TypeOf(Config{})
 	configFields := []string{}
@@ -135,6 +136,22 @@ func TestConfigEqual(t *testing.T) {
 			&Config{NetfilterMode: preftype.NetfilterNoDivert},
 			true,
 		},
+
+		{
+			&Config{InboundShields: true},
+			&Config{InboundShields: false},
+			false,
+		},
+		{
+			&Config{InboundShields: true, InboundAllowed: nets("192.168.1.0/24")},
+			&Config{InboundShields: true, InboundAllowed: nets("192.168.2.0/24")},
+			false,
+		},
+		{
+			&Config{InboundShields: true, InboundAllowed: nets("192.168.1.0/24"), InboundUDPPort: 41641},
+			&Config{InboundShields: true, InboundAllowed: nets("192.168.1.0/24"), InboundUDPPort: 41641},
+			true,
+		},
 	}
 	for i, tt := range tests {
 		got := tt.a.Equal(tt.b)
@@ -16,6 +16,7 @@
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.zx2c4.com/wireguard/device"
@@ -100,6 +101,7 @@ type userspaceEngine struct {
 	linkMonOwned      bool       // whether we created linkMon (and thus need to close it)
 	linkMonUnregister func()     // unsubscribes from changes; used regardless of linkMonOwned
 	birdClient        BIRDClient // or nil
+	lowMemory         bool       // conf.LowMemory
 
 	testMaybeReconfigHook func() // for tests; if non-nil, fires if maybeReconfigWireguardLocked called
 
@@ -112,18 +114,28 @@ type userspaceEngine struct {
 	// is being routed over Tailscale.
 	isDNSIPOverTailscale syncs.AtomicValue[func(netip.Addr) bool]
 
+	// inboundUDPPort is the InboundUDPPort last given to the router,
+	// or zero if inbound shields are off.
+	inboundUDPPort atomic.Uint32
+
+	// dscpPeers maps destination IPs to peers for noteOutboundDSCP.
+	// It's rebuilt from each full wireguard config.
+	dscpPeers atomic.Pointer[dscpPeerTable]
+
 	wgLock              sync.Mutex // serializes all wgdev operations; see lock order comment below
 	lastCfgFull         wgcfg.Config
 	lastNMinPeers       int
-	lastRouterSig       deephash.Sum // of router.Config
-	lastEngineSigFull   deephash.Sum // of full wireguard config
-	lastEngineSigTrim   deephash.Sum // of trimmed wireguard config
+	lastRouterSig       deephash.Sum   // of router.Config
+	lastRouterConfig    *router.Config // last config given to the router, or nil
+	lastEngineSigFull   deephash.Sum   // of full wireguard config
+	lastEngineSigTrim   deephash.Sum   // of trimmed wireguard config
 	lastDNSConfig       *dns.Config
 	lastIsSubnetRouter  bool // was the node a primary subnet router in the last run.
 	recvActivityAt      map[key.NodePublic]mono.Time
 	trimmedNodes        map[key.NodePublic]bool   // set of node keys of peers currently excluded from wireguard config
 	sentActivityAt      map[netip.Addr]*mono.Time // value is accessed atomically
 	destIPActivityFuncs map[netip.Addr]func()
+	lastCfgDevice       *wgcfg.Config // config last given to wgdev, or nil if unknown
 	statusBufioReader   *bufio.Reader // reusable for UAPI
 	lastStatusPollTime  mono.Time     // last time we polled the engine status
 
@@ -217,6 +229,19 @@ type Config struct {
 	// BIRDClient, if non-nil, will be used to configure BIRD whenever
 	// this node is a primary subnet router.
 	BIRDClient BIRDClient
+
+	// LowMemory, if true, trades throughput for a smaller memory
+	// footprint: idle peers are always trimmed from the wireguard-go
+	// config, the packet filter's connection tracking table is
+	// smaller, magicsock uses shorter DERP write queues, and netstack
+	// (which checks IsLowMemory) uses smaller queues and TCP buffers.
+	// It's intended for embedded devices such as routers with 128MB
+	// of RAM.
+	//
+	// wireguard-go's own queue sizes and the size of gVisor's
+	// connection tracking table are compile-time constants and are
+	// not affected.
+	LowMemory bool
 }
 
 func NewFakeUserspaceEngine(logf logger.Logf, listenPort uint16) (Engine, error) {
@@ -246,6 +271,17 @@ func IsNetstackRouter(e Engine) bool {
 	return IsNetstack(e)
 }
 
+// IsLowMemory reports whether e was created with Config.LowMemory set.
+func IsLowMemory(e Engine) bool {
+	switch e := e.(type) {
+	case *userspaceEngine:
+		return e.lowMemory
+	case *watchdogEngine:
+		return IsLowMemory(e.wrap)
+	}
+	return false
+}
+
 // IsNetstack reports whether e is a netstack-based TUN-free engine.
 func IsNetstack(e Engine) bool {
 	ig, ok := e.(InternalsGetter)
@@ -303,6 +339,11 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 		router:         conf.Router,
 		confListenPort: conf.ListenPort,
 		birdClient:     conf.BIRDClient,
+		lowMemory:      conf.LowMemory,
+	}
+
+	if conf.LowMemory {
+		logf("wgengine: using low memory mode")
 	}
 
 	if e.birdClient != nil {
@@ -345,6 +386,12 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 		e.endpoints = append(e.endpoints[:0], endpoints...)
 		e.mu.Unlock()
 
+		// Endpoints are updated after magicsock rebinds, which
+		// can move it to a new port.
+		if p := e.inboundUDPPort.Load(); p != 0 && uint16(p) != e.magicConn.LocalPort() {
+			go e.updateInboundUDPPort()
+		}
+
 		e.RequestStatus()
 	}
 	magicsockOpts := magicsock.Options{
@@ -355,6 +402,8 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 		IdleFunc:         e.tundev.IdleDuration,
 		NoteRecvActivity: e.noteRecvActivity,
 		LinkMonitor:      e.linkMon,
+		LowMemory:        conf.LowMemory,
+		DERPDial:         conf.Dialer.SystemDial,
 	}
 
 	var err error
@@ -383,6 +432,8 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 		e.tundev.PostFilterOut = e.trackOpenPostFilterOut
 	}
 
+	e.tundev.OnOutboundDSCP = e.noteOutboundDSCP
+
 	e.wgLogger = wglog.NewLogger(logf)
 	e.tundev.OnTSMPPongReceived = func(pong packet.TSMPPongReply) {
 		e.mu.Lock()
@@ -543,11 +594,20 @@ func (e *userspaceEngine) pollResolver() {
 // TODO(bradfitz): remove this after our 1.0 launch; we don't want to
 // enable wireguard config trimming quite yet because it just landed
 // and we haven't got enough time testing it.
-func forceFullWireguardConfig(numPeers int) bool {
+func (e *userspaceEngine) forceFullWireguardConfig(numPeers int) bool {
 	// Did the user explicitly enable trimmming via the environment variable knob?
 	if b, ok := debugTrimWireguard.Get(); ok {
 		return !b
 	}
+	// In low memory mode, always configure peers lazily, regardless
+	// of what the control plane says.
+	if e.lowMemory {
+		return false
+	}
+	// Likewise if the user asked for it.
+	if e.lastCfgFull.LazyPeers {
+		return false
+	}
 	if opt := controlclient.TrimWGConfig(); opt != "" {
 		return !opt.EqualBool(true)
 	}
@@ -564,12 +624,17 @@ func forceFullWireguardConfig(numPeers int) bool {
 // isTrimmablePeer reports whether p is a peer that we can trim out of the
 // network map.
 //
+// Peers marked AlwaysOn are never trimmed.
+//
 // For implementation simplificy, we can only trim peers that have
 // only non-subnet AllowedIPs (an IPv4 /32 or IPv6 /128), which is the
 // common case for most peers. Subnet router nodes will just always be
 // created in the wireguard-go config.
-func isTrimmablePeer(p *wgcfg.Peer, numPeers int) bool {
-	if forceFullWireguardConfig(numPeers) {
+func (e *userspaceEngine) isTrimmablePeer(p *wgcfg.Peer, numPeers int) bool {
+	if e.forceFullWireguardConfig(numPeers) {
+		return false
+	}
+	if p.AlwaysOn {
 		return false
 	}
 
@@ -679,7 +744,7 @@ func (e *userspaceEngine) maybeReconfigWireguardLocked(discoChanged map[key.Node
 	for i := range full.Peers {
 		p := &full.Peers[i]
 		nk := p.PublicKey
-		if !isTrimmablePeer(p, len(full.Peers)) {
+		if !e.isTrimmablePeer(p, len(full.Peers)) {
 			min.Peers = append(min.Peers, *p)
 			if discoChanged[nk] {
 				needRemoveStep = true
@@ -729,7 +794,7 @@ func (e *userspaceEngine) maybeReconfigWireguardLocked(discoChanged map[key.Node
 		}
 		if numRemove > 0 {
 			e.logf("wgengine: Reconfig: removing session keys for %d peers", numRemove)
-			if err := wgcfg.ReconfigDevice(e.wgdev, &minner, e.logf); err != nil {
+			if err := e.reconfigDeviceLocked(&minner); err != nil {
 				e.logf("wgdev.Reconfig: %v", err)
 				return err
 			}
@@ -737,13 +802,54 @@ func (e *userspaceEngine) maybeReconfigWireguardLocked(discoChanged map[key.Node
 	}
 
 	e.logf("wgengine: Reconfig: configuring userspace WireGuard config (with %d/%d peers)", len(min.Peers), len(full.Peers))
-	if err := wgcfg.ReconfigDevice(e.wgdev, &min, e.logf); err != nil {
+	if err := e.reconfigDeviceLocked(&min); err != nil {
 		e.logf("wgdev.Reconfig: %v", err)
 		return err
 	}
 	return nil
 }
 
+// reconfigDeviceLocked sets the wireguard-go device's config to cfg,
+// writing only what changed since the last call, so that a netmap
+// change touching a few peers of a large tailnet doesn't rewrite (or
+// read back) the config of every peer.
+//
+// All changes to the device's config must go through here (or clear
+// e.lastCfgDevice), or the next call diffs against a stale config.
+//
+// e.wgLock must be held.
+func (e *userspaceEngine) reconfigDeviceLocked(cfg *wgcfg.Config) error {
+	prev := e.lastCfgDevice
+	if prev == nil {
+		var err error
+		if prev, err = wgcfg.DeviceConfig(e.wgdev); err != nil {
+			return err
+		}
+	}
+	// Until the write succeeds the device may be partially
+	// reconfigured; read its config back next time.
+	e.lastCfgDevice = nil
+	if err := wgcfg.ReconfigDeviceFrom(e.wgdev, prev, cfg, e.logf); err != nil {
+		return err
+	}
+	var self key.NodePublic
+	if !cfg.PrivateKey.IsZero() {
+		self = cfg.PrivateKey.Public()
+	}
+	applied := cfg.Clone()
+	for i := range applied.Peers {
+		if !self.IsZero() && applied.Peers[i].PublicKey == self {
+			// wireguard-go silently drops a peer with its own
+			// key, so applied isn't what the device has.
+			return nil
+		}
+		// As DeviceConfig would report it.
+		applied.Peers[i].WGEndpoint = applied.Peers[i].PublicKey
+	}
+	e.lastCfgDevice = applied
+	return nil
+}
+
 // updateActivityMapsLocked updates the data structures used for tracking the activity
 // of wireguard peers that we might add/remove dynamically from the real config
 // as given to wireguard-go.
@@ -859,10 +965,7 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 	isSubnetRouterChanged := isSubnetRouter != e.lastIsSubnetRouter
 
 	engineChanged := deephash.Update(&e.lastEngineSigFull, cfg)
-	routerChanged := deephash.Update(&e.lastRouterSig, &struct {
-		RouterConfig *router.Config
-		DNSConfig    *dns.Config
-	}{routerCfg, dnsCfg})
+	routerChanged := e.updateRouterSigLocked(e.withInboundUDPPort(routerCfg), dnsCfg)
 	if !engineChanged && !routerChanged && listenPort == e.magicConn.LocalPort() && !isSubnetRouterChanged {
 		return ErrNoChanges
 	}
@@ -900,6 +1003,7 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 	}
 
 	e.lastCfgFull = *cfg.Clone()
+	e.dscpPeers.Store(newDSCPPeerTable(cfg.Peers))
 
 	// Tell magicsock about the new (or initial) private key
 	// (which is needed by DERP) before wgdev gets it, as wgdev
@@ -911,13 +1015,19 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 	e.magicConn.UpdatePeers(peerSet)
 	e.magicConn.SetPreferredPort(listenPort)
 
+	// The port may have changed just now.
+	routerCfg = e.withInboundUDPPort(routerCfg)
+	if e.updateRouterSigLocked(routerCfg, dnsCfg) {
+		routerChanged = true
+	}
+
 	if err := e.maybeReconfigWireguardLocked(discoChanged); err != nil {
 		return err
 	}
 
 	if routerChanged {
 		e.logf("wgengine: Reconfig: configuring router")
-		err := e.router.Set(routerCfg)
+		err := e.setRouterLocked(routerCfg)
 		health.SetRouterHealth(err)
 		if err != nil {
 			return err
@@ -957,7 +1067,14 @@ func (e *userspaceEngine) GetFilter() *filter.Filter {
 	return e.tundev.GetFilter()
 }
 
+// maxFlowsLowMem is the size of the packet filter's connection
+// tracking table in low memory mode.
+const maxFlowsLowMem = 64
+
 func (e *userspaceEngine) SetFilter(filt *filter.Filter) {
+	if e.lowMemory && filt != nil {
+		filt.SetMaxFlows(maxFlowsLowMem)
+	}
 	e.tundev.SetFilter(filt)
 }
 
@@ -1069,8 +1186,11 @@ func (e *userspaceEngine) Close() {
 	e.closing = true
 	e.mu.Unlock()
 
+	e.wgLock.Lock()
 	r := bufio.NewReader(strings.NewReader(""))
 	e.wgdev.IpcSetOperation(r)
+	e.lastCfgDevice = nil
+	e.wgLock.Unlock()
 	e.magicConn.Close()
 	e.linkMonUnregister()
 	if e.linkMonOwned {
@@ -1102,6 +1222,73 @@ func (e *userspaceEngine) LinkChange(_ bool) {
 	e.linkMon.InjectEvent()
 }
 
+// withInboundUDPPort returns routerCfg with InboundUDPPort set to
+// magicsock's current port if InboundShields is set, so direct
+// connections from peers keep working. It doesn't modify routerCfg.
+func (e *userspaceEngine) withInboundUDPPort(routerCfg *router.Config) *router.Config {
+	if !routerCfg.InboundShields {
+		return routerCfg
+	}
+	port := e.magicConn.LocalPort()
+	if routerCfg.InboundUDPPort == port {
+		return routerCfg
+	}
+	c := *routerCfg
+	c.InboundUDPPort = port
+	return &c
+}
+
+// updateRouterSigLocked updates e.lastRouterSig and reports whether
+// routerCfg or dnsCfg changed since it was last updated.
+//
+// e.wgLock must be held.
+func (e *userspaceEngine) updateRouterSigLocked(routerCfg *router.Config, dnsCfg *dns.Config) bool {
+	return deephash.Update(&e.lastRouterSig, &struct {
+		RouterConfig *router.Config
+		DNSConfig    *dns.Config
+	}{routerCfg, dnsCfg})
+}
+
+// setRouterLocked configures the router with routerCfg.
+//
+// e.wgLock must be held.
+func (e *userspaceEngine) setRouterLocked(routerCfg *router.Config) error {
+	if err := e.router.Set(routerCfg); err != nil {
+		return err
+	}
+	e.lastRouterConfig = routerCfg
+	port := uint32(0)
+	if routerCfg.InboundShields {
+		port = uint32(routerCfg.InboundUDPPort)
+	}
+	e.inboundUDPPort.Store(port)
+	return nil
+}
+
+// updateInboundUDPPort reconfigures the router if magicsock has moved
+// to a new port (such as on a rebind) while inbound shields are up.
+func (e *userspaceEngine) updateInboundUDPPort() {
+	e.wgLock.Lock()
+	defer e.wgLock.Unlock()
+	e.mu.Lock()
+	closing := e.closing
+	e.mu.Unlock()
+	if closing || e.lastRouterConfig == nil {
+		return
+	}
+	routerCfg := e.withInboundUDPPort(e.lastRouterConfig)
+	if routerCfg == e.lastRouterConfig {
+		return
+	}
+	e.logf("wgengine: magicsock port changed to %d; reconfiguring router", routerCfg.InboundUDPPort)
+	e.updateRouterSigLocked(routerCfg, e.lastDNSConfig)
+	err := e.setRouterLocked(routerCfg)
+	health.SetRouterHealth(err)
+	if err != nil {
+		e.logf("wgengine: error reconfiguring router: %v", err)
+	}
+}
+
 func (e *userspaceEngine) linkChange(changed bool, cur *interfaces.State) {
 	up := cur.AnyInterfaceUp()
 	if !up {
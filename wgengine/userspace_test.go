@@ -6,8 +6,10 @@
 
 import (
 	"fmt"
+	"net"
 	"net/netip"
 	"reflect"
+	"sync"
 	"testing"
 
 	"go4.org/mem"
@@ -221,6 +223,35 @@ func nkFromHex(hex string) key.NodePublic {
 	return k
 }
 
+func TestDSCPPeerTable(t *testing.T) {
+	k1, k2, k3 := key.NewNode().Public(), key.NewNode().Public(), key.NewNode().Public()
+	tbl := newDSCPPeerTable([]wgcfg.Peer{
+		{PublicKey: k1, AllowedIPs: []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32"), netip.MustParsePrefix("10.0.0.0/8")}},
+		{PublicKey: k2, AllowedIPs: []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32"), netip.MustParsePrefix("10.1.0.0/16")}},
+		{PublicKey: k3, AllowedIPs: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")}},
+	})
+	tests := []struct {
+		ip   string
+		want key.NodePublic
+	}{
+		{"100.64.0.1", k1},
+		{"100.64.0.2", k2},
+		{"10.2.3.4", k1},
+		{"10.1.2.3", k2},
+		{"8.8.8.8", k3},
+		{"fd7a:115c:a1e0::1", key.NodePublic{}},
+	}
+	for _, tt := range tests {
+		got, _ := tbl.peerForIP(netip.MustParseAddr(tt.ip))
+		if got != tt.want {
+			t.Errorf("peerForIP(%s) = %v; want %v", tt.ip, got.ShortString(), tt.want.ShortString())
+		}
+	}
+	if _, ok := (*dscpPeerTable)(nil).peerForIP(netip.MustParseAddr("100.64.0.1")); ok {
+		t.Errorf("nil table found a peer")
+	}
+}
+
 // an experiment to see if genLocalAddrFunc was worth it. As of Go
 // 1.16, it still very much is. (30-40x faster)
 func BenchmarkGenLocalAddrFunc(b *testing.B) {
@@ -275,3 +306,217 @@ func BenchmarkGenLocalAddrFunc(b *testing.B) {
 	})
 	b.Logf("x = %v", x)
 }
+
+func TestUserspaceEngineAlwaysOnPeer(t *testing.T) {
+	e, err := NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	ue := e.(*userspaceEngine)
+
+	lazy := key.NewNode().Public()
+	alwaysOn := key.NewNode().Public()
+	cfg := &wgcfg.Config{
+		Peers: []wgcfg.Peer{
+			{
+				PublicKey:  lazy,
+				AllowedIPs: []netip.Prefix{netip.MustParsePrefix("100.100.99.1/32")},
+			},
+			{
+				PublicKey:  alwaysOn,
+				AllowedIPs: []netip.Prefix{netip.MustParsePrefix("100.100.99.2/32")},
+				AlwaysOn:   true,
+			},
+		},
+		LazyPeers: true,
+	}
+	e.SetNetworkMap(&netmap.NetworkMap{
+		Peers: []*tailcfg.Node{{Key: lazy}, {Key: alwaysOn}},
+	})
+	if err := e.Reconfig(cfg, &router.Config{}, &dns.Config{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := map[key.NodePublic]bool{lazy: true}
+	if got := ue.trimmedNodes; !reflect.DeepEqual(got, want) {
+		t.Errorf("trimmedNodes = %v; want only %v", got, lazy.ShortString())
+	}
+}
+
+func TestUserspaceEngineLowMemory(t *testing.T) {
+	def, err := NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(def.Close)
+	if IsLowMemory(def) || IsLowMemory(NewWatchdog(def)) {
+		t.Error("default engine is in low memory mode")
+	}
+
+	e, err := NewUserspaceEngine(t.Logf, Config{LowMemory: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	if !IsLowMemory(e) || !IsLowMemory(NewWatchdog(e)) {
+		t.Error("IsLowMemory = false; want true")
+	}
+
+	// Idle peers are trimmed even though the config doesn't ask for
+	// lazy peers.
+	peer := key.NewNode().Public()
+	cfg := &wgcfg.Config{
+		Peers: []wgcfg.Peer{{
+			PublicKey:  peer,
+			AllowedIPs: []netip.Prefix{netip.MustParsePrefix("100.100.99.1/32")},
+		}},
+	}
+	e.SetNetworkMap(&netmap.NetworkMap{
+		Peers: []*tailcfg.Node{{Key: peer}},
+	})
+	if err := e.Reconfig(cfg, &router.Config{}, &dns.Config{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := map[key.NodePublic]bool{peer: true}
+	if got := e.(*userspaceEngine).trimmedNodes; !reflect.DeepEqual(got, want) {
+		t.Errorf("trimmedNodes = %v; want %v", got, peer.ShortString())
+	}
+}
+
+// recordingRouter is a router.Router that records the last config
+// it was given.
+type recordingRouter struct {
+	router.Router
+	mu   sync.Mutex
+	last *router.Config
+}
+
+func (r *recordingRouter) Set(cfg *router.Config) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.last = cfg
+	return r.Router.Set(cfg)
+}
+
+func (r *recordingRouter) inboundUDPPort() uint16 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.last == nil {
+		return 0
+	}
+	return r.last.InboundUDPPort
+}
+
+func TestUserspaceEngineInboundUDPPort(t *testing.T) {
+	rr := &recordingRouter{Router: router.NewFake(t.Logf)}
+	e, err := NewUserspaceEngine(t.Logf, Config{Router: rr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	ue := e.(*userspaceEngine)
+
+	routerCfg := &router.Config{InboundShields: true}
+	if err := e.Reconfig(&wgcfg.Config{}, routerCfg, &dns.Config{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rr.inboundUDPPort(), ue.magicConn.LocalPort(); got != want {
+		t.Fatalf("InboundUDPPort = %d; want magicsock's port %d", got, want)
+	}
+	if routerCfg.InboundUDPPort != 0 {
+		t.Error("Reconfig modified the caller's router config")
+	}
+
+	// Move magicsock to another port, as a rebind can, and check
+	// the router follows.
+	pc, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPort := uint16(pc.LocalAddr().(*net.UDPAddr).Port)
+	pc.Close()
+	ue.magicConn.SetPreferredPort(newPort)
+	if ue.magicConn.LocalPort() != newPort {
+		t.Skipf("couldn't move magicsock to port %d", newPort)
+	}
+	ue.updateInboundUDPPort()
+	if got := rr.inboundUDPPort(); got != newPort {
+		t.Errorf("after port change, InboundUDPPort = %d; want %d", got, newPort)
+	}
+
+	// Without shields, no port is set.
+	if err := e.Reconfig(&wgcfg.Config{}, &router.Config{}, &dns.Config{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := rr.inboundUDPPort(); got != 0 {
+		t.Errorf("without shields, InboundUDPPort = %d; want 0", got)
+	}
+}
+
+// TestUserspaceEngineDeviceConfigCache checks that the config the
+// engine remembers giving wireguard-go matches the device's own after
+// each kind of reconfiguration.
+func TestUserspaceEngineDeviceConfigCache(t *testing.T) {
+	e, err := NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	ue := e.(*userspaceEngine)
+
+	k1, k2 := key.NewNode().Public(), key.NewNode().Public()
+	discos := map[key.NodePublic]key.DiscoPublic{}
+	peer := func(k key.NodePublic, ips ...string) wgcfg.Peer {
+		if _, ok := discos[k]; !ok {
+			discos[k] = key.NewDisco().Public()
+		}
+		p := wgcfg.Peer{PublicKey: k, DiscoKey: discos[k], AlwaysOn: true}
+		for _, ip := range ips {
+			p.AllowedIPs = append(p.AllowedIPs, netip.MustParsePrefix(ip))
+		}
+		return p
+	}
+	priv := key.NewNode()
+	e.SetNetworkMap(&netmap.NetworkMap{
+		Peers: []*tailcfg.Node{{Key: k1}, {Key: k2}, {Key: priv.Public()}},
+	})
+	configs := []struct {
+		name string
+		cfg  *wgcfg.Config
+	}{
+		{"one_peer", &wgcfg.Config{PrivateKey: priv, Peers: []wgcfg.Peer{peer(k1, "100.100.99.1/32")}}},
+		{"add_peer", &wgcfg.Config{PrivateKey: priv, Peers: []wgcfg.Peer{peer(k1, "100.100.99.1/32"), peer(k2, "100.100.99.2/32")}}},
+		{"change_ips", &wgcfg.Config{PrivateKey: priv, Peers: []wgcfg.Peer{peer(k1, "100.100.99.1/32", "10.0.0.0/24"), peer(k2, "100.100.99.2/32")}}},
+		{"remove_peer", &wgcfg.Config{PrivateKey: priv, Peers: []wgcfg.Peer{peer(k2, "100.100.99.2/32")}}},
+		{"new_key", &wgcfg.Config{PrivateKey: key.NewNode(), Peers: []wgcfg.Peer{peer(k2, "100.100.99.2/32")}}},
+		{"self_peer", &wgcfg.Config{PrivateKey: priv, Peers: []wgcfg.Peer{peer(priv.Public(), "100.100.99.3/32"), peer(k2, "100.100.99.2/32")}}},
+		{"after_self_peer", &wgcfg.Config{PrivateKey: priv, Peers: []wgcfg.Peer{peer(k2, "100.100.99.2/32")}}},
+	}
+	for _, c := range configs {
+		if err := e.Reconfig(c.cfg, &router.Config{}, &dns.Config{}, nil); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		ue.wgLock.Lock()
+		cached := ue.lastCfgDevice
+		got, err := wgcfg.DeviceConfig(ue.wgdev)
+		ue.wgLock.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cached == nil {
+			continue
+		}
+		if !cached.PrivateKey.Equal(got.PrivateKey) || !reflect.DeepEqual(peerIPs(cached), peerIPs(got)) {
+			t.Errorf("%s: cached device config %v differs from device's %v", c.name, peerIPs(cached), peerIPs(got))
+		}
+	}
+}
+
+// peerIPs returns the AllowedIPs of cfg's peers, by peer.
+func peerIPs(cfg *wgcfg.Config) map[key.NodePublic][]netip.Prefix {
+	m := map[key.NodePublic][]netip.Prefix{}
+	for _, p := range cfg.Peers {
+		m[p.PublicKey] = append([]netip.Prefix{}, p.AllowedIPs...)
+	}
+	return m
+}
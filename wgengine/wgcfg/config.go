@@ -22,6 +22,11 @@ type Config struct {
 	MTU        uint16
 	DNS        []netip.Addr
 	Peers      []Peer
+
+	// LazyPeers, if true, makes wgengine configure peers into
+	// WireGuard only while they have recent traffic, even if the
+	// control plane turns that off. It's not passed to WireGuard.
+	LazyPeers bool
 }
 
 type Peer struct {
@@ -29,6 +34,7 @@ type Peer struct {
 	DiscoKey            key.DiscoPublic // present only so we can handle restarts within wgengine, not passed to WireGuard
 	AllowedIPs          []netip.Prefix
 	PersistentKeepalive uint16
+	AlwaysOn            bool // never trimmed by wgengine's lazy configuration, not passed to WireGuard
 	// wireguard-go's endpoint for this peer. It should always equal Peer.PublicKey.
 	// We represent it explicitly so that we can detect if they diverge and recover.
 	// There is no need to set WGEndpoint explicitly when constructing a Peer by hand.
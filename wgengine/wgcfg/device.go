@@ -44,17 +44,25 @@ func DeviceConfig(d *device.Device) (*Config, error) {
 
 // ReconfigDevice replaces the existing device configuration with cfg.
 func ReconfigDevice(d *device.Device, cfg *Config, logf logger.Logf) (err error) {
+	prev, err := DeviceConfig(d)
+	if err != nil {
+		logf("wgcfg.Reconfig failed: %v", err)
+		return err
+	}
+	return ReconfigDeviceFrom(d, prev, cfg, logf)
+}
+
+// ReconfigDeviceFrom is like ReconfigDevice, but takes the device's
+// existing configuration, prev, instead of reading it back from the
+// device, which is slow for devices with many peers. Only what differs
+// between prev and cfg is written to the device.
+func ReconfigDeviceFrom(d *device.Device, prev, cfg *Config, logf logger.Logf) (err error) {
 	defer func() {
 		if err != nil {
 			logf("wgcfg.Reconfig failed: %v", err)
 		}
 	}()
 
-	prev, err := DeviceConfig(d)
-	if err != nil {
-		return err
-	}
-
 	r, w := io.Pipe()
 	errc := make(chan error, 1)
 	go func() {
@@ -139,6 +139,18 @@ func TestDeviceConfig(t *testing.T) {
 		cmp(t, device1, cfg1)
 	})
 
+	t.Run("device1 add allowed IP from known config", func(t *testing.T) {
+		prev, err := DeviceConfig(device1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg1.Peers[0].AllowedIPs = append(cfg1.Peers[0].AllowedIPs, netip.MustParsePrefix("192.168.0.0/24"))
+		if err := ReconfigDeviceFrom(device1, prev, cfg1, t.Logf); err != nil {
+			t.Fatal(err)
+		}
+		cmp(t, device1, cfg1)
+	})
+
 	t.Run("device1 add new peer", func(t *testing.T) {
 		cfg1.Peers = append(cfg1.Peers, Peer{
 			PublicKey:  k3,
@@ -37,6 +37,7 @@ func (src *Config) Clone() *Config {
 	MTU        uint16
 	DNS        []netip.Addr
 	Peers      []Peer
+	LazyPeers  bool
 }{})
 
 // Clone makes a deep copy of Peer.
@@ -57,5 +58,6 @@ func (src *Peer) Clone() *Peer {
 	DiscoKey            key.DiscoPublic
 	AllowedIPs          []netip.Prefix
 	PersistentKeepalive uint16
+	AlwaysOn            bool
 	WGEndpoint          key.NodePublic
 }{})
@@ -0,0 +1,72 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgcfg
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"tailscale.com/types/key"
+)
+
+// largeConfig returns a config with n peers, as a device would report
+// it after being configured with it.
+func largeConfig(n int) *Config {
+	cfg := &Config{PrivateKey: key.NewNode()}
+	for i := 0; i < n; i++ {
+		k := key.NewNode().Public()
+		ip := netip.AddrFrom4([4]byte{100, 64 + byte(i>>16), byte(i >> 8), byte(i)})
+		cfg.Peers = append(cfg.Peers, Peer{
+			PublicKey:  k,
+			WGEndpoint: k,
+			AllowedIPs: []netip.Prefix{netip.PrefixFrom(ip, 32)},
+		})
+	}
+	return cfg
+}
+
+func TestToUAPIIncremental(t *testing.T) {
+	prev := largeConfig(10000)
+	cfg := prev.Clone()
+
+	// Peer 1 starts advertising a subnet route; peer 2 swaps its
+	// route; peer 3 leaves; a new peer joins.
+	route := netip.MustParsePrefix("10.1.0.0/16")
+	cfg.Peers[1].AllowedIPs = append(cfg.Peers[1].AllowedIPs, route)
+	cfg.Peers[2].AllowedIPs = []netip.Prefix{route}
+	removed := cfg.Peers[3].PublicKey
+	cfg.Peers = append(cfg.Peers[:3], cfg.Peers[4:]...)
+	cfg.Peers = append(cfg.Peers, largeConfig(1).Peers...)
+
+	var buf strings.Builder
+	if err := cfg.ToUAPI(t.Logf, &buf, prev); err != nil {
+		t.Fatal(err)
+	}
+	peers := map[string]string{} // hex public key => its UAPI lines
+	var cur string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if strings.HasPrefix(line, "public_key=") {
+			cur = strings.TrimPrefix(line, "public_key=")
+			continue
+		}
+		peers[cur] += line + "\n"
+	}
+	if len(peers) != 4 {
+		t.Fatalf("UAPI output configures %d peers; want 4:\n%s", len(peers), buf.String())
+	}
+	if got, want := peers[cfg.Peers[1].PublicKey.UntypedHexString()], "protocol_version=1\nallowed_ip=10.1.0.0/16\n"; got != want {
+		t.Errorf("peer with added route:\n%s\nwant:\n%s", got, want)
+	}
+	if got := peers[cfg.Peers[2].PublicKey.UntypedHexString()]; !strings.Contains(got, "replace_allowed_ips=true\n") {
+		t.Errorf("peer with swapped route:\n%s\nwant replace_allowed_ips", got)
+	}
+	if got := peers[removed.UntypedHexString()]; got != "remove=true\n" {
+		t.Errorf("removed peer:\n%s\nwant remove", got)
+	}
+	if got := peers[cfg.Peers[len(cfg.Peers)-1].PublicKey.UntypedHexString()]; !strings.Contains(got, "endpoint=") {
+		t.Errorf("new peer:\n%s\nwant endpoint", got)
+	}
+}